@@ -1,24 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 
+	"github.com/onlitec/onlidesk-server/internal/approval"
+	"github.com/onlitec/onlidesk-server/internal/auth"
+	"github.com/onlitec/onlidesk-server/internal/delivery"
 	"github.com/onlitec/onlidesk-server/internal/filetransfer"
+	"github.com/onlitec/onlidesk-server/internal/metrics"
+	"github.com/onlitec/onlidesk-server/internal/redact"
 	"github.com/onlitec/onlidesk-server/internal/remoteaccess"
 )
 
+// serverVersion is the version reported by the health, info and capabilities endpoints
+const serverVersion = "1.0.0"
+
 // ServerConfig holds the server configuration
 type ServerConfig struct {
 	Port               string                           `json:"port"`
@@ -29,12 +40,18 @@ type ServerConfig struct {
 	TransferConfig     *filetransfer.TransferConfig     `json:"transfer_config"`
 	SecurityConfig     *filetransfer.SecurityConfig     `json:"security_config"`
 	RemoteAccessConfig *remoteaccess.RemoteAccessConfig `json:"remote_access_config"`
+	ExternalApproval   *approval.Config                 `json:"external_approval"`
+	Delivery           *delivery.Config                 `json:"delivery"` // retry policy shared by outbound integrations
+	Auth               *auth.Config                     `json:"auth"`     // authentication provider for the REST APIs
 	CORSOrigins        []string                         `json:"cors_origins"`
 	LogLevel           string                           `json:"log_level"`
 	MaxConnections     int                              `json:"max_connections"`
 	ReadTimeout        time.Duration                    `json:"read_timeout"`
 	WriteTimeout       time.Duration                    `json:"write_timeout"`
 	IdleTimeout        time.Duration                    `json:"idle_timeout"`
+	MaxRequestBodySize int64                            `json:"max_request_body_size"` // bytes; 0 uses the 1 MiB default
+	StrictConfig       bool                             `json:"strict_config"`         // refuse to start on unknown config keys instead of warning
+	MetricsEnabled     bool                             `json:"metrics_enabled"`       // serve Prometheus metrics at /metrics
 }
 
 // DefaultServerConfig returns default server configuration
@@ -48,12 +65,16 @@ func DefaultServerConfig() *ServerConfig {
 		TransferConfig:     filetransfer.DefaultTransferConfig(),
 		SecurityConfig:     filetransfer.DefaultSecurityConfig(),
 		RemoteAccessConfig: remoteaccess.DefaultRemoteAccessConfig(),
+		ExternalApproval:   approval.DefaultConfig(),
+		Delivery:           delivery.DefaultConfig(),
+		Auth:               auth.DefaultConfig(),
 		CORSOrigins:        []string{"http://localhost:3000", "http://localhost:5173"}, // React dev servers
 		LogLevel:           "info",
 		MaxConnections:     1000,
 		ReadTimeout:        30 * time.Second,
 		WriteTimeout:       30 * time.Second,
 		IdleTimeout:        60 * time.Second,
+		MaxRequestBodySize: remoteaccess.DefaultMaxRequestBodySize,
 	}
 }
 
@@ -64,27 +85,91 @@ type OnlideskServer struct {
 	remoteAccessHandler    *remoteaccess.WebSocketHandler
 	remoteAccessHTTP       *remoteaccess.HTTPHandlers
 	sessionManager         *remoteaccess.SessionManager
+	externalApprover       *approval.ExternalApprover
+	deliverer              *delivery.Deliverer
+	metrics                *metrics.Collector // nil unless metrics are enabled
 	httpServer             *http.Server
 	router                 *mux.Router
+	startTime              time.Time
 }
 
 // NewOnlideskServer creates a new server instance
 func NewOnlideskServer(configPath string) (*OnlideskServer, error) {
 	// Load configuration
+	// Only a missing file falls back to the defaults; a broken one must not start a server configured otherwise
 	config, err := loadConfig(configPath)
-	if err != nil {
-		log.Printf("Failed to load config, using defaults: %v", err)
+	if errors.Is(err, errConfigNotFound) {
+		log.Printf("%v, using defaults", err)
 		config = DefaultServerConfig()
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The key isn't serialized; refuse to start rather than encrypt with one that's lost on restart
+	if err := config.SecurityConfig.LoadEncryptionKey(); err != nil {
+		return nil, fmt.Errorf("invalid security config: %v", err)
+	}
+
+	// An unknown mask mode would quietly fall back to redacting
+	if err := redact.ValidateMode(config.SecurityConfig.AuditMaskMode); err != nil {
+		return nil, fmt.Errorf("invalid security config: audit_mask_mode: %v", err)
+	}
+	if err := redact.ValidateMode(config.RemoteAccessConfig.AuditMaskMode); err != nil {
+		return nil, fmt.Errorf("invalid remote access config: audit_mask_mode: %v", err)
+	}
+	if err := redact.LoadHashKey(); err != nil {
+		return nil, fmt.Errorf("invalid audit hash key: %v", err)
+	}
+
+	// Fail fast on storage and crypto problems that would otherwise only surface mid-transfer
+	auditLogDirs := append(filetransfer.AuditLogDirs(), remoteaccess.AuditLogDirs()...)
+	if err := filetransfer.SelfTest(config.TransferConfig, config.SecurityConfig, auditLogDirs); err != nil {
+		return nil, fmt.Errorf("startup self-test failed: %v", err)
 	}
 
 	// Create file transfer handler
-	fileTransferHandler := filetransfer.NewWebSocketHandler(config.TransferConfig, config.SecurityConfig)
+	fileTransferHandler, err := filetransfer.NewWebSocketHandlerE(config.TransferConfig, config.SecurityConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file transfer handler: %v", err)
+	}
 
 	// Create remote access components
-	sessionManager := remoteaccess.NewSessionManager(config.RemoteAccessConfig)
+	// The REST API shares the WebSocket handler's session manager so both see the same sessions
 	remoteAccessHandler := remoteaccess.NewWebSocketHandler(config.RemoteAccessConfig)
+	sessionManager := remoteAccessHandler.GetSessionManager()
 	remoteAccessHTTP := remoteaccess.NewHTTPHandlers(sessionManager)
 
+	// Transfers belonging to a remote access session must respect its upload/download settings
+	fileTransferHandler.GetSessionManager().SetTransferAuthorizer(sessionTransferAuthorizer(sessionManager))
+
+	// Outbound integrations share one deliverer so retries and dead letters are handled alike
+	if err := config.Delivery.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid delivery config: %v", err)
+	}
+	deliverer := delivery.NewDeliverer(config.Delivery)
+
+	// Approvals may be delegated to an external service, decided via a signed callback
+	if err := config.ExternalApproval.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid external approval config: %v", err)
+	}
+	externalApprover := approval.NewExternalApprover(config.ExternalApproval, deliverer)
+	fileTransferHandler.SetExternalApprover(externalApprover)
+	sessionManager.SetExternalApprover(externalApprover)
+
+	// REST API callers are authenticated by the configured provider, if any
+	authenticator, err := auth.NewAuthenticator(config.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth config: %v", err)
+	}
+	remoteAccessHTTP.SetAuthenticator(authenticator)
+	remoteAccessHandler.SetAuthenticator(authenticator)
+
+	// Metrics are only collected when they can be scraped
+	var collector *metrics.Collector
+	if config.MetricsEnabled {
+		collector = metrics.NewCollector(fileTransferHandler, sessionManager)
+	}
+
 	// Create router
 	router := mux.NewRouter()
 
@@ -95,7 +180,11 @@ func NewOnlideskServer(configPath string) (*OnlideskServer, error) {
 		remoteAccessHandler:    remoteAccessHandler,
 		remoteAccessHTTP:       remoteAccessHTTP,
 		sessionManager:         sessionManager,
+		externalApprover:       externalApprover,
+		deliverer:              deliverer,
+		metrics:                collector,
 		router:                 router,
+		startTime:              time.Now(),
 	}
 
 	// Setup routes
@@ -115,41 +204,81 @@ func NewOnlideskServer(configPath string) (*OnlideskServer, error) {
 
 // setupRoutes configures all HTTP routes
 func (s *OnlideskServer) setupRoutes() {
+	// Refuse sources outside the configured IP ranges before anything else runs
+	s.router.Use(s.remoteAccessHTTP.IPFilterMiddleware)
+
+	// Bound request bodies on every route; only the REST handlers read them
+	s.router.Use(remoteaccess.MaxBodySizeMiddleware(s.config.MaxRequestBodySize))
+
 	// Root redirect to portal
 	s.router.HandleFunc("/", s.handleRoot).Methods("GET")
 
 	// Health check endpoint
 	s.router.HandleFunc("/health", s.handleHealth).Methods("GET")
 
+	// Readiness probe: refuses while remote access sessions are at capacity or draining
+	s.router.HandleFunc("/ready", s.remoteAccessHTTP.HandleReadiness).Methods("GET")
+
+	// Prometheus metrics, when enabled
+	if s.metrics != nil {
+		s.router.Handle("/metrics", s.metrics.Handler()).Methods("GET")
+	}
+
 	// API info endpoint
 	s.router.HandleFunc("/api/info", s.handleAPIInfo).Methods("GET")
 
 	// WebSocket endpoints
-	s.router.HandleFunc("/ws/filetransfer", s.fileTransferHandler.HandleWebSocket)
-	s.router.HandleFunc("/ws/remoteaccess", s.remoteAccessHandler.HandleWebSocket)
+	// Connections may present a token: it identifies the approver behind a portal, and the owner
+	// who alone may resume an upload
+	s.router.Handle("/ws/filetransfer", s.remoteAccessHTTP.IdentifyMiddleware(http.HandlerFunc(s.fileTransferHandler.HandleWebSocket)))
+	s.router.Handle("/ws/remoteaccess", s.remoteAccessHTTP.IdentifyMiddleware(http.HandlerFunc(s.remoteAccessHandler.HandleWebSocket)))
+
+	// External approval decisions (authenticated by the callback signature rather than a bearer token)
+	s.router.HandleFunc("/api/v1/approvals/callback", s.externalApprover.HandleCallback).Methods("POST")
 
 	// File transfer REST API endpoints
 	api := s.router.PathPrefix("/api/v1").Subrouter()
+	api.Use(s.remoteAccessHTTP.AuthMiddleware)
 	
 	// Transfer management endpoints
 	api.HandleFunc("/transfers", s.handleGetTransfers).Methods("GET")
+	api.HandleFunc("/transfers/stream", s.fileTransferHandler.HandleTransferStream).Methods("GET")
+	api.HandleFunc("/transfers/history", s.handleGetTransferHistory).Methods("GET")
+	api.HandleFunc("/transfers/cancel-by-technician", s.remoteAccessHTTP.RequireScope(auth.ScopeTransfersApprove, s.handleCancelTransfersByTechnician)).Methods("POST")
 	api.HandleFunc("/transfers/{transferId}", s.handleGetTransfer).Methods("GET")
-	api.HandleFunc("/transfers/{transferId}/approve", s.handleApproveTransfer).Methods("POST")
+	api.HandleFunc("/transfers/{transferId}/approve", s.remoteAccessHTTP.RequireScope(auth.ScopeTransfersApprove, s.handleApproveTransfer)).Methods("POST")
 	api.HandleFunc("/transfers/{transferId}/control", s.handleControlTransfer).Methods("POST")
 	api.HandleFunc("/transfers/{transferId}/progress", s.handleGetProgress).Methods("GET")
+
+	// Per-session exceptions to the client download default
+	api.HandleFunc("/sessions/{sessionId}/client-downloads", s.remoteAccessHTTP.RequireScope(auth.ScopeTransfersApprove, s.handleGrantClientDownloads)).Methods("POST")
+	api.HandleFunc("/sessions/{sessionId}/client-downloads", s.remoteAccessHTTP.RequireScope(auth.ScopeTransfersApprove, s.handleRevokeClientDownloads)).Methods("DELETE")
 	
 	// Configuration endpoints
 	api.HandleFunc("/config/transfer", s.handleGetTransferConfig).Methods("GET")
-	api.HandleFunc("/config/transfer", s.handleUpdateTransferConfig).Methods("PUT")
+	api.HandleFunc("/config/transfer", s.remoteAccessHTTP.RequireScope(auth.ScopeConfigWrite, s.handleUpdateTransferConfig)).Methods("PUT")
 	
-	// Statistics endpoint
+	// Statistics endpoints
 	api.HandleFunc("/stats", s.handleGetStatistics).Methods("GET")
+	api.HandleFunc("/deliveries/stats", s.handleGetDeliveryStats).Methods("GET")
+
+	// Server limits, policy and capabilities endpoints
+	api.HandleFunc("/server-info", s.handleGetServerInfo).Methods("GET")
+	api.HandleFunc("/capabilities", s.handleGetCapabilities).Methods("GET")
 	
 	// File download endpoint (for completed transfers)
 	api.HandleFunc("/files/{transferId}/download", s.handleFileDownload).Methods("GET")
+	api.HandleFunc("/files/{transferId}/rescan", s.remoteAccessHTTP.RequireScope(auth.ScopeAdmin, s.handleRescanFile)).Methods("POST")
+
+	// Temp file maintenance endpoints (admin only)
+	api.HandleFunc("/temp/orphans", s.remoteAccessHTTP.RequireScope(auth.ScopeAdmin, s.handleGetOrphanedTempFiles)).Methods("GET")
+	api.HandleFunc("/temp/prune", s.remoteAccessHTTP.RequireScope(auth.ScopeAdmin, s.handlePruneTempFiles)).Methods("POST")
 
 	// Register remote access HTTP routes
-	s.remoteAccessHTTP.RegisterRoutes(s.router)
+	remoteAccessAPI := s.router.NewRoute().Subrouter()
+	remoteAccessAPI.Use(s.remoteAccessHTTP.RateLimitMiddleware)
+	remoteAccessAPI.Use(s.remoteAccessHTTP.AuthMiddleware)
+	s.remoteAccessHTTP.RegisterRoutes(remoteAccessAPI)
 
 	// Static file serving for the portal (if needed)
 	s.router.PathPrefix("/portal/").Handler(http.StripPrefix("/portal/", http.FileServer(http.Dir("./static/portal/"))))
@@ -157,6 +286,17 @@ func (s *OnlideskServer) setupRoutes() {
 	log.Println("Routes configured successfully")
 }
 
+// sessionTransferAuthorizer only lets transfers through that belong to a live remote access
+// session whose upload/download settings allow them
+func sessionTransferAuthorizer(sessionManager *remoteaccess.SessionManager) filetransfer.TransferAuthorizer {
+	return func(request *filetransfer.FileTransferRequest) error {
+		if request.SessionID == "" {
+			return fmt.Errorf("file transfers must belong to a remote access session")
+		}
+		return sessionManager.AuthorizeFileTransfer(request.SessionID, string(request.Type), request.Filename, request.FileSize)
+	}
+}
+
 // setupCORS configures CORS middleware
 func (s *OnlideskServer) setupCORS() http.Handler {
 	c := cors.New(cors.Options{
@@ -176,9 +316,9 @@ func (s *OnlideskServer) setupCORS() http.Handler {
 func (s *OnlideskServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	health := map[string]interface{}{
 		"status":    "healthy",
-		"timestamp": time.Now(),
-		"version":   "1.0.0",
-		"uptime":    time.Since(time.Now()), // This would be calculated from server start time
+		"timestamp": time.Now().UTC(),
+		"version":   serverVersion,
+		"uptime":    time.Since(s.startTime).Round(time.Millisecond).String(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -189,14 +329,21 @@ func (s *OnlideskServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 func (s *OnlideskServer) handleAPIInfo(w http.ResponseWriter, r *http.Request) {
 	info := map[string]interface{}{
 		"name":        "Onlidesk File Transfer API",
-		"version":     "1.0.0",
+		"version":     serverVersion,
 		"description": "Secure file transfer API for remote desktop sessions",
 		"endpoints": map[string]string{
-			"websocket":     "/ws/filetransfer",
-			"transfers":     "/api/v1/transfers",
-			"config":        "/api/v1/config/transfer",
-			"statistics":    "/api/v1/stats",
-			"health":        "/health",
+			"websocket":       "/ws/filetransfer",
+			"transfers":       "/api/v1/transfers",
+			"transfer_stream": "/api/v1/transfers/stream",
+			"transfer_history": "/api/v1/transfers/history",
+			"config":          "/api/v1/config/transfer",
+			"statistics":      "/api/v1/stats",
+			"delivery_stats":  "/api/v1/deliveries/stats",
+			"server_info":     "/api/v1/server-info",
+			"capabilities":    "/api/v1/capabilities",
+			"approvals":       "/api/v1/approvals/callback",
+			"health":          "/health",
+			"ready":           "/ready",
 		},
 		"features": []string{
 			"Secure file transfer",
@@ -215,15 +362,64 @@ func (s *OnlideskServer) handleAPIInfo(w http.ResponseWriter, r *http.Request) {
 // handleGetTransfers returns all active transfers
 func (s *OnlideskServer) handleGetTransfers(w http.ResponseWriter, r *http.Request) {
 	sessions := s.fileTransferHandler.GetSessionManager().GetActiveSessions()
-	
+
+	// metadata_key (and optionally metadata_value) narrows the list to transfers tagged with it
+	if key := r.URL.Query().Get("metadata_key"); key != "" {
+		value := r.URL.Query().Get("metadata_value")
+		for id, session := range sessions {
+			if !session.HasMetadata(key, value) {
+				delete(sessions, id)
+			}
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(sessions)
 }
 
+// handleGetTransferHistory returns finished transfers, most recent first, optionally narrowed by
+// status and technician and paged with limit and offset
+func (s *OnlideskServer) handleGetTransferHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := filetransfer.TransferHistoryFilter{
+		Status:     filetransfer.TransferStatus(query.Get("status")),
+		Technician: query.Get("technician"),
+		Limit:      50,
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > 1000 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = offset
+	}
+
+	transfers, total := s.fileTransferHandler.GetSessionManager().GetTransferHistory(filter)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transfers": transfers,
+		"total":     total,
+		"limit":     filter.Limit,
+		"offset":    filter.Offset,
+	})
+}
+
 // handleGetTransfer returns a specific transfer
 func (s *OnlideskServer) handleGetTransfer(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	transferID := vars["transferId"]
+	transferID, ok := transferIDParam(w, r)
+	if !ok {
+		return
+	}
 
 	session, exists := s.fileTransferHandler.GetSessionManager().GetSession(transferID)
 	if !exists {
@@ -237,8 +433,10 @@ func (s *OnlideskServer) handleGetTransfer(w http.ResponseWriter, r *http.Reques
 
 // handleApproveTransfer approves or rejects a transfer
 func (s *OnlideskServer) handleApproveTransfer(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	transferID := vars["transferId"]
+	transferID, ok := transferIDParam(w, r)
+	if !ok {
+		return
+	}
 
 	var approval struct {
 		Approved bool   `json:"approved"`
@@ -246,12 +444,65 @@ func (s *OnlideskServer) handleApproveTransfer(w http.ResponseWriter, r *http.Re
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&approval); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeBodyError(w, err)
 		return
 	}
 
-	if err := s.fileTransferHandler.GetSessionManager().ApproveTransfer(transferID, approval.Approved, approval.Message); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	sessionManager := s.fileTransferHandler.GetSessionManager()
+	if err := sessionManager.ApproveTransfer(transferID, approval.Approved, approval.Message); err != nil {
+		if errors.Is(err, filetransfer.ErrTransferNotPending) {
+			// Tell the caller why: the transfer was already decided, cancelled or finished
+			status, _ := sessionManager.GetTransferStatus(transferID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":       err.Error(),
+				"transfer_id": transferID,
+				"status":      status,
+			})
+			return
+		}
+		writeTransferError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// handleGrantClientDownloads lets a session pull files from the client, given a justification
+func (s *OnlideskServer) handleGrantClientDownloads(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionId"]
+
+	var request struct {
+		Justification string `json:"justification"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	grant, err := s.fileTransferHandler.GetSessionManager().GrantClientDownloads(sessionID, auth.Actor(r.Context()), request.Justification)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(grant)
+}
+
+// handleRevokeClientDownloads returns a session to the client download default
+func (s *OnlideskServer) handleRevokeClientDownloads(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionId"]
+	if err := filetransfer.ValidateSessionID(sessionID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.fileTransferHandler.GetSessionManager().RevokeClientDownloads(sessionID, auth.Actor(r.Context())) {
+		http.Error(w, "Session has no client download grant", http.StatusNotFound)
 		return
 	}
 
@@ -261,15 +512,17 @@ func (s *OnlideskServer) handleApproveTransfer(w http.ResponseWriter, r *http.Re
 
 // handleControlTransfer controls a transfer (pause, resume, cancel)
 func (s *OnlideskServer) handleControlTransfer(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	transferID := vars["transferId"]
+	transferID, ok := transferIDParam(w, r)
+	if !ok {
+		return
+	}
 
 	var control struct {
 		Action string `json:"action"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&control); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeBodyError(w, err)
 		return
 	}
 
@@ -287,7 +540,7 @@ func (s *OnlideskServer) handleControlTransfer(w http.ResponseWriter, r *http.Re
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeTransferError(w, err)
 		return
 	}
 
@@ -295,14 +548,41 @@ func (s *OnlideskServer) handleControlTransfer(w http.ResponseWriter, r *http.Re
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
 
+// handleCancelTransfersByTechnician cancels every active transfer a technician has in flight
+func (s *OnlideskServer) handleCancelTransfersByTechnician(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		TechnicianID string `json:"technician_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if request.TechnicianID == "" {
+		http.Error(w, "technician_id is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.fileTransferHandler.GetSessionManager().CancelTransfersByTechnician(request.TechnicianID, auth.Actor(r.Context()), s.fileTransferHandler.GetSessionManager().ClientIP(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 // handleGetProgress returns transfer progress
 func (s *OnlideskServer) handleGetProgress(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	transferID := vars["transferId"]
+	transferID, ok := transferIDParam(w, r)
+	if !ok {
+		return
+	}
 
 	progress, err := s.fileTransferHandler.GetSessionManager().GetTransferProgress(transferID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeTransferError(w, err)
 		return
 	}
 
@@ -322,12 +602,15 @@ func (s *OnlideskServer) handleGetTransferConfig(w http.ResponseWriter, r *http.
 func (s *OnlideskServer) handleUpdateTransferConfig(w http.ResponseWriter, r *http.Request) {
 	var config filetransfer.TransferConfig
 	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeBodyError(w, err)
+		return
+	}
+
+	if err := s.fileTransferHandler.GetSessionManager().UpdateConfigBy(&config, auth.Actor(r.Context()), s.fileTransferHandler.GetSessionManager().ClientIP(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	s.fileTransferHandler.GetSessionManager().UpdateConfig(&config)
-	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
@@ -340,31 +623,129 @@ func (s *OnlideskServer) handleGetStatistics(w http.ResponseWriter, r *http.Requ
 	json.NewEncoder(w).Encode(stats)
 }
 
+// handleGetDeliveryStats returns counters for outbound integration deliveries
+func (s *OnlideskServer) handleGetDeliveryStats(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]interface{}{
+		"deliveries":        s.deliverer.Stats(),
+		"pending_approvals": s.externalApprover.PendingCount(),
+		"timestamp":         time.Now().UTC(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleGetServerInfo returns the effective transfer limits and policy
+func (s *OnlideskServer) handleGetServerInfo(w http.ResponseWriter, r *http.Request) {
+	info := s.fileTransferHandler.GetServerInfo()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// serverCapabilities adds the server-wide features to the file transfer capabilities
+type serverCapabilities struct {
+	ServerVersion string `json:"server_version"`
+	*filetransfer.Capabilities
+	Auth filetransfer.FeatureStatus `json:"auth"`
+	TLS  bool                       `json:"tls"`
+}
+
+// handleGetCapabilities reports the optional features this deployment has compiled in and enabled
+func (s *OnlideskServer) handleGetCapabilities(w http.ResponseWriter, r *http.Request) {
+	provider := s.config.Auth.Provider
+	if provider == "" {
+		provider = auth.ProviderNone
+	}
+
+	capabilities := serverCapabilities{
+		ServerVersion: serverVersion,
+		Capabilities:  s.fileTransferHandler.GetCapabilities(),
+		Auth: filetransfer.FeatureStatus{
+			Enabled: provider != auth.ProviderNone,
+			Backend: provider,
+		},
+		TLS: s.config.TLSEnabled,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capabilities)
+}
+
 // handleFileDownload serves completed file transfers
 func (s *OnlideskServer) handleFileDownload(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	transferID := vars["transferId"]
+	transferID, ok := transferIDParam(w, r)
+	if !ok {
+		return
+	}
 
-	session, exists := s.fileTransferHandler.GetSessionManager().GetSession(transferID)
-	if !exists {
+	s.fileTransferHandler.GetSessionManager().ServeCompletedFile(w, r, transferID)
+}
+
+// handleRescanFile re-scans a completed or quarantined file for malware, quarantining it on a new detection
+func (s *OnlideskServer) handleRescanFile(w http.ResponseWriter, r *http.Request) {
+	transferID, ok := transferIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	sessionManager := s.fileTransferHandler.GetSessionManager()
+	if _, exists := sessionManager.GetSession(transferID); !exists {
 		http.Error(w, "Transfer not found", http.StatusNotFound)
 		return
 	}
 
-	if session.Status != filetransfer.StatusCompleted {
-		http.Error(w, "Transfer not completed", http.StatusBadRequest)
+	result, err := sessionManager.RescanFile(transferID)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleGetOrphanedTempFiles lists temp files not associated with any transfer session
+func (s *OnlideskServer) handleGetOrphanedTempFiles(w http.ResponseWriter, r *http.Request) {
+	orphans, err := s.fileTransferHandler.GetSessionManager().ListOrphanedTempFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if session.TempPath == "" {
-		http.Error(w, "File not available", http.StatusNotFound)
+	var totalSize int64
+	for _, orphan := range orphans {
+		totalSize += orphan.Size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files":      orphans,
+		"count":      len(orphans),
+		"total_size": totalSize,
+	})
+}
+
+// handlePruneTempFiles removes orphaned temp files now; min_age (e.g. "10m") keeps younger files
+func (s *OnlideskServer) handlePruneTempFiles(w http.ResponseWriter, r *http.Request) {
+	var minAge time.Duration
+	if value := r.URL.Query().Get("min_age"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid min_age", http.StatusBadRequest)
+			return
+		}
+		minAge = parsed
+	}
+
+	result, err := s.fileTransferHandler.GetSessionManager().PruneOrphanedTempFiles(minAge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Serve the file
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", session.Request.Filename))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	http.ServeFile(w, r, session.TempPath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 
 // handleRoot serves the main portal page
@@ -392,13 +773,19 @@ func (s *OnlideskServer) Start() error {
 func (s *OnlideskServer) Stop(ctx context.Context) error {
 	log.Println("Shutting down server...")
 
+	// Warn remote access clients before anything is closed so they can reconnect later
+	if s.remoteAccessHandler != nil {
+		s.remoteAccessHandler.Drain()
+	}
+
+	// Stop waiting on external approval decisions and dead-letter undelivered requests
+	s.externalApprover.Stop()
+	s.deliverer.Stop()
+
 	// Shutdown file transfer handler
 	s.fileTransferHandler.Shutdown()
 
-	// Close remote access components
-	if s.sessionManager != nil {
-		s.sessionManager.Shutdown()
-	}
+	// Close remote access components (this also shuts down the shared session manager)
 	if s.remoteAccessHandler != nil {
 		s.remoteAccessHandler.Shutdown()
 	}
@@ -407,6 +794,59 @@ func (s *OnlideskServer) Stop(ctx context.Context) error {
 	return s.httpServer.Shutdown(ctx)
 }
 
+// transferIDParam returns the request's transfer ID, answering 400 when it is malformed
+func transferIDParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	transferID := mux.Vars(r)["transferId"]
+	if err := filetransfer.ValidateTransferID(transferID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return transferID, true
+}
+
+// writeBodyError reports a request body that couldn't be decoded, or was too large
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Invalid request body", http.StatusBadRequest)
+}
+
+// transferErrorStatus maps an error from the transfer subsystem to the HTTP status it's reported with
+func transferErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, filetransfer.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, filetransfer.ErrInvalidState),
+		errors.Is(err, filetransfer.ErrTransferNotPending),
+		errors.Is(err, filetransfer.ErrTransferNotResumable),
+		errors.Is(err, filetransfer.ErrNothingToRescan):
+		return http.StatusConflict
+	case errors.Is(err, filetransfer.ErrMaxConcurrent):
+		return http.StatusTooManyRequests
+	case errors.Is(err, filetransfer.ErrFileTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, filetransfer.ErrTypeNotAllowed):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, filetransfer.ErrInvalidID),
+		errors.Is(err, filetransfer.ErrRejectionReasonRequired),
+		errors.Is(err, filetransfer.ErrJustificationRequired):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeTransferError reports an error from the transfer subsystem with the status it maps to
+func writeTransferError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), transferErrorStatus(err))
+}
+
+// errConfigNotFound is returned by loadConfig when there is no config file to load
+var errConfigNotFound = errors.New("config file not found")
+
 // loadConfig loads server configuration from file
 func loadConfig(configPath string) (*ServerConfig, error) {
 	if configPath == "" {
@@ -414,7 +854,7 @@ func loadConfig(configPath string) (*ServerConfig, error) {
 	}
 
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("config file not found: %s", configPath)
+		return nil, fmt.Errorf("%w: %s", errConfigNotFound, configPath)
 	}
 
 	data, err := os.ReadFile(configPath)
@@ -427,26 +867,44 @@ func loadConfig(configPath string) (*ServerConfig, error) {
 		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
 
+	// An unknown key is usually a typo whose setting would silently fall back to its default
+	if err := checkUnknownFields(data); err != nil {
+		if config.StrictConfig {
+			return nil, fmt.Errorf("invalid config file: %v", err)
+		}
+		log.Printf("Warning: config file %s: %v; set strict_config to reject unknown keys", configPath, err)
+	}
+
 	// Ensure default configurations are set if missing
 	if config.TransferConfig == nil {
 		config.TransferConfig = filetransfer.DefaultTransferConfig()
 	}
 	if config.SecurityConfig == nil {
 		config.SecurityConfig = filetransfer.DefaultSecurityConfig()
-	} else {
-		// Generate encryption key if not present (since it's not serialized)
-		if len(config.SecurityConfig.EncryptionKey) == 0 {
-			defaultSecurity := filetransfer.DefaultSecurityConfig()
-			config.SecurityConfig.EncryptionKey = defaultSecurity.EncryptionKey
-		}
 	}
 	if config.RemoteAccessConfig == nil {
 		config.RemoteAccessConfig = remoteaccess.DefaultRemoteAccessConfig()
 	}
+	if config.ExternalApproval == nil {
+		config.ExternalApproval = approval.DefaultConfig()
+	}
+	if config.Delivery == nil {
+		config.Delivery = delivery.DefaultConfig()
+	}
+	if config.Auth == nil {
+		config.Auth = auth.DefaultConfig()
+	}
 
 	return &config, nil
 }
 
+// checkUnknownFields reports the first key in the config file, at any level, that no setting uses
+func checkUnknownFields(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(&ServerConfig{})
+}
+
 // saveDefaultConfig saves a default configuration file
 func saveDefaultConfig(configPath string) error {
 	config := DefaultServerConfig()
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onlitec/onlidesk-server/internal/filetransfer"
+	"github.com/onlitec/onlidesk-server/internal/metrics"
+	"github.com/onlitec/onlidesk-server/internal/remoteaccess"
+)
+
+func TestOnlideskServer_HealthReportsUptime(t *testing.T) {
+	server := &OnlideskServer{startTime: time.Now()}
+	time.Sleep(10 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	server.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var health map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &health))
+	uptime, err := time.ParseDuration(health["uptime"].(string))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, uptime, 10*time.Millisecond)
+}
+
+func TestLoadConfig_ReportsUnknownFields(t *testing.T) {
+	writeConfig := func(content string) string {
+		path := filepath.Join(t.TempDir(), "server.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	// By default a typo'd key is only warned about, and its setting keeps the default
+	config, err := loadConfig(writeConfig(`{"port": "9090", "transfer_config": {"max_conccurent": 50}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "9090", config.Port)
+	assert.Zero(t, config.TransferConfig.MaxConcurrent)
+
+	_, err = loadConfig(writeConfig(`{"strict_config": true, "transfer_config": {"max_conccurent": 50}}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown field "max_conccurent"`)
+
+	_, err = loadConfig(writeConfig(`{"strict_config": true, "port": "9090"}`))
+	assert.NoError(t, err)
+}
+
+func TestLoadConfig_ShippedConfigNeedsAKeySource(t *testing.T) {
+	t.Setenv(filetransfer.EncryptionKeyEnv, "")
+
+	config, err := loadConfig("../config.json")
+	require.NoError(t, err)
+	require.True(t, config.SecurityConfig.EncryptionEnabled)
+	assert.ErrorIs(t, config.SecurityConfig.LoadEncryptionKey(), filetransfer.ErrNoEncryptionKey)
+
+	// Only the development config falls back to a throwaway key
+	config, err = loadConfig("../config.dev.json")
+	require.NoError(t, err)
+	assert.NoError(t, config.SecurityConfig.LoadEncryptionKey())
+	assert.Len(t, config.SecurityConfig.EncryptionKey, 32)
+}
+
+func TestNewOnlideskServer_RefusesConfigItCantLoad(t *testing.T) {
+	for name, content := range map[string]string{
+		"malformed": `{"port": `,
+		"strict":    `{"strict_config": true, "transfer_config": {"max_conccurent": 50}}`,
+	} {
+		path := filepath.Join(t.TempDir(), "server.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+		server, err := NewOnlideskServer(path)
+		assert.Error(t, err, name)
+		assert.Nil(t, server, name)
+	}
+
+	// Only a missing file falls back to the defaults
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	assert.ErrorIs(t, err, errConfigNotFound)
+}
+
+func TestOnlideskServer_MetricsReflectCompletedTransfers(t *testing.T) {
+	transferConfig := filetransfer.DefaultTransferConfig()
+	transferConfig.TempDir = t.TempDir()
+	securityConfig := filetransfer.DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	securityConfig.QuarantineDir = t.TempDir()
+	remoteAccessConfig := remoteaccess.DefaultRemoteAccessConfig()
+	remoteAccessConfig.RecordingDir = t.TempDir()
+
+	fileTransferHandler := filetransfer.NewWebSocketHandler(transferConfig, securityConfig)
+	t.Cleanup(fileTransferHandler.Shutdown)
+	remoteAccessHandler := remoteaccess.NewWebSocketHandler(remoteAccessConfig)
+	t.Cleanup(remoteAccessHandler.Shutdown)
+	sessionManager := remoteAccessHandler.GetSessionManager()
+
+	newServer := func(metricsEnabled bool) *OnlideskServer {
+		server := &OnlideskServer{
+			config:              &ServerConfig{MetricsEnabled: metricsEnabled},
+			fileTransferHandler: fileTransferHandler,
+			remoteAccessHandler: remoteAccessHandler,
+			remoteAccessHTTP:    remoteaccess.NewHTTPHandlers(sessionManager),
+			sessionManager:      sessionManager,
+			router:              mux.NewRouter(),
+		}
+		if metricsEnabled {
+			server.metrics = metrics.NewCollector(fileTransferHandler, sessionManager)
+		}
+		server.setupRoutes()
+		return server
+	}
+	scrape := func(server *OnlideskServer) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec
+	}
+
+	// Without the flag there's nothing to scrape
+	assert.Equal(t, http.StatusNotFound, scrape(newServer(false)).Code)
+
+	server := newServer(true)
+	transfers := fileTransferHandler.GetSessionManager()
+	completed, err := transfers.CreateTransferSession(&filetransfer.FileTransferRequest{
+		Type:     filetransfer.TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, transfers.CompleteTransfer(completed.ID, true, ""))
+
+	failed, err := transfers.CreateTransferSession(&filetransfer.FileTransferRequest{
+		Type:     filetransfer.TransferTypeUpload,
+		Filename: "notes.txt",
+		FileSize: 10,
+	}, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, transfers.CompleteTransfer(failed.ID, false, "checksum verification failed: file does not match expected checksum"))
+
+	_, err = sessionManager.CreateSession("client-1", "technician-1", nil)
+	require.NoError(t, err)
+
+	rec := scrape(server)
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, `onlidesk_transfers_completed_total{type="upload"} 1`)
+	assert.Contains(t, body, `onlidesk_transfer_bytes_total{type="upload"} 1024`)
+	assert.Contains(t, body, `onlidesk_transfer_failures_total{reason="checksum_mismatch"} 1`)
+	assert.Contains(t, body, "onlidesk_transfers_active 0")
+	assert.Contains(t, body, "onlidesk_remote_sessions_created_total 1")
+	assert.Contains(t, body, "onlidesk_remote_sessions_active 1")
+	assert.Contains(t, body, `onlidesk_websocket_connections{endpoint="file_transfer"} 0`)
+}
+
+func TestOnlideskServer_AdminRoutesNeedAnAuthProvider(t *testing.T) {
+	transferConfig := filetransfer.DefaultTransferConfig()
+	transferConfig.TempDir = t.TempDir()
+	securityConfig := filetransfer.DefaultSecurityConfig()
+	securityConfig.QuarantineDir = t.TempDir()
+	remoteAccessConfig := remoteaccess.DefaultRemoteAccessConfig()
+	remoteAccessConfig.RecordingDir = t.TempDir()
+	// Even with authentication waived for the other scoped routes
+	remoteAccessConfig.RequireAuthentication = false
+
+	fileTransferHandler := filetransfer.NewWebSocketHandler(transferConfig, securityConfig)
+	t.Cleanup(fileTransferHandler.Shutdown)
+	remoteAccessHandler := remoteaccess.NewWebSocketHandler(remoteAccessConfig)
+	t.Cleanup(remoteAccessHandler.Shutdown)
+	sessionManager := remoteAccessHandler.GetSessionManager()
+
+	server := &OnlideskServer{
+		config:              &ServerConfig{},
+		fileTransferHandler: fileTransferHandler,
+		remoteAccessHandler: remoteAccessHandler,
+		remoteAccessHTTP:    remoteaccess.NewHTTPHandlers(sessionManager),
+		sessionManager:      sessionManager,
+		router:              mux.NewRouter(),
+	}
+	server.setupRoutes()
+
+	orphan := filepath.Join(transferConfig.TempDir, "transfer_orphan_report.txt")
+	require.NoError(t, os.WriteFile(orphan, []byte("left behind"), 0644))
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/api/v1/temp/orphans"},
+		{http.MethodPost, "/api/v1/temp/prune"},
+		{http.MethodPost, "/api/v1/files/transfer-1/rescan"},
+	} {
+		rec := httptest.NewRecorder()
+		server.router.ServeHTTP(rec, httptest.NewRequest(route.method, route.path, nil))
+		assert.Equal(t, http.StatusForbidden, rec.Code, route.path)
+	}
+	assert.FileExists(t, orphan)
+}
+
+func TestSessionTransferAuthorizer_RequiresALiveSession(t *testing.T) {
+	remoteAccessConfig := remoteaccess.DefaultRemoteAccessConfig()
+	remoteAccessConfig.RecordingDir = t.TempDir()
+	remoteAccessHandler := remoteaccess.NewWebSocketHandler(remoteAccessConfig)
+	t.Cleanup(remoteAccessHandler.Shutdown)
+	sessionManager := remoteAccessHandler.GetSessionManager()
+	authorize := sessionTransferAuthorizer(sessionManager)
+
+	session, err := sessionManager.CreateSession("client-1", "technician-1", nil)
+	require.NoError(t, err)
+	request := func(sessionID string) *filetransfer.FileTransferRequest {
+		return &filetransfer.FileTransferRequest{SessionID: sessionID, Type: filetransfer.TransferTypeUpload, Filename: "report.txt", FileSize: 1024}
+	}
+
+	assert.NoError(t, authorize(request(session.ID)))
+	assert.Error(t, authorize(request("")))
+	assert.Error(t, authorize(request("no-such-session")))
+}
+
+func TestTransferErrorStatus(t *testing.T) {
+	for err, status := range map[error]int{
+		fmt.Errorf("transfer session %w: abc", filetransfer.ErrNotFound):            http.StatusNotFound,
+		fmt.Errorf("%w: transfer is completed", filetransfer.ErrTransferNotPending): http.StatusConflict,
+		fmt.Errorf("%w: file stream is paused", filetransfer.ErrInvalidState):       http.StatusConflict,
+		fmt.Errorf("%w (5)", filetransfer.ErrMaxConcurrent):                         http.StatusTooManyRequests,
+		fmt.Errorf("%w: 2048 bytes", filetransfer.ErrFileTooLarge):                  http.StatusRequestEntityTooLarge,
+		fmt.Errorf("%w: .exe", filetransfer.ErrTypeNotAllowed):                      http.StatusUnsupportedMediaType,
+		filetransfer.ErrRejectionReasonRequired:                                     http.StatusBadRequest,
+		fmt.Errorf("disk full"):                                                     http.StatusInternalServerError,
+	} {
+		assert.Equal(t, status, transferErrorStatus(err), err.Error())
+	}
+}
@@ -0,0 +1,273 @@
+package approval
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/delivery"
+)
+
+// SignatureHeader carries the HMAC-SHA256 signature of a request or callback body
+const SignatureHeader = "X-OnliDesk-Signature"
+
+// maxCallbackSize bounds the body accepted on the callback route
+const maxCallbackSize = 64 * 1024
+
+// Kinds of request that can be routed to the external approval service
+const (
+	KindTransfer  = "transfer"
+	KindPrivilege = "privilege"
+)
+
+// ErrUnknownRequest is returned when a callback refers to a request that isn't awaiting a decision
+var ErrUnknownRequest = errors.New("no approval pending for request")
+
+// ErrInvalidSignature is returned when a callback's signature doesn't match its body
+var ErrInvalidSignature = errors.New("invalid callback signature")
+
+// Config configures the external approval service integration
+type Config struct {
+	Enabled         bool          `json:"enabled"`
+	Endpoint        string        `json:"endpoint"`         // receives approval requests as signed JSON POSTs
+	CallbackURL     string        `json:"callback_url"`     // public URL of POST /api/v1/approvals/callback, passed to the service
+	Secret          string        `json:"secret"`           // HMAC-SHA256 key for request and callback signatures
+	DecisionTimeout time.Duration `json:"decision_timeout"` // requests without a callback by then are denied
+}
+
+// DefaultConfig returns the external approval configuration, disabled by default
+func DefaultConfig() *Config {
+	return &Config{
+		Enabled:         false,
+		DecisionTimeout: 30 * time.Minute,
+	}
+}
+
+// Validate checks that an enabled integration has everything it needs
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Endpoint == "" {
+		return fmt.Errorf("endpoint is required when external approval is enabled")
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("secret is required when external approval is enabled")
+	}
+	if c.DecisionTimeout <= 0 {
+		return fmt.Errorf("decision_timeout must be greater than 0")
+	}
+	return nil
+}
+
+// Request is sent to the external approval service
+type Request struct {
+	ID          string                 `json:"request_id"`
+	Kind        string                 `json:"kind"` // transfer, privilege
+	SessionID   string                 `json:"session_id"`
+	Requester   string                 `json:"requester,omitempty"`
+	Summary     string                 `json:"summary"`
+	Details     map[string]interface{} `json:"details,omitempty"`
+	CallbackURL string                 `json:"callback_url,omitempty"`
+	RequestedAt time.Time              `json:"requested_at"`
+	ExpiresAt   time.Time              `json:"expires_at"`
+}
+
+// Decision is delivered back by the external approval service, or made locally on timeout
+type Decision struct {
+	RequestID string `json:"request_id"`
+	Approved  bool   `json:"approved"`
+	Approver  string `json:"approver,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	TimedOut  bool   `json:"-"`
+}
+
+// DecisionFunc receives the decision for a request exactly once
+type DecisionFunc func(request Request, decision Decision)
+
+// pendingApproval is a request awaiting its callback
+type pendingApproval struct {
+	request Request
+	decide  DecisionFunc
+	timer   *time.Timer
+}
+
+// ExternalApprover routes approval requests to an external service and matches its callbacks to them
+type ExternalApprover struct {
+	config    *Config
+	deliverer *delivery.Deliverer
+	pending   map[string]*pendingApproval
+	mutex     sync.Mutex
+}
+
+// NewExternalApprover creates an approver that sends its requests through the shared deliverer
+func NewExternalApprover(config *Config, deliverer *delivery.Deliverer) *ExternalApprover {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if deliverer == nil {
+		deliverer = delivery.NewDeliverer(nil)
+	}
+
+	return &ExternalApprover{
+		config:    config,
+		deliverer: deliverer,
+		pending:   make(map[string]*pendingApproval),
+	}
+}
+
+// Enabled reports whether approvals should be routed to the external service
+func (ea *ExternalApprover) Enabled() bool {
+	return ea != nil && ea.config.Enabled
+}
+
+// RequestApproval sends a request to the external service without blocking. decide is called once,
+// with the service's decision, or with a denial if the request can't be delivered or times out.
+func (ea *ExternalApprover) RequestApproval(request Request, decide DecisionFunc) error {
+	if !ea.Enabled() {
+		return fmt.Errorf("external approval is not enabled")
+	}
+	if request.ID == "" {
+		return fmt.Errorf("request id is required")
+	}
+
+	now := time.Now().UTC()
+	request.CallbackURL = ea.config.CallbackURL
+	request.RequestedAt = now
+	request.ExpiresAt = now.Add(ea.config.DecisionTimeout)
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal approval request: %v", err)
+	}
+
+	ea.mutex.Lock()
+	if _, exists := ea.pending[request.ID]; exists {
+		ea.mutex.Unlock()
+		return fmt.Errorf("approval already pending for request %s", request.ID)
+	}
+	pending := &pendingApproval{request: request, decide: decide}
+	pending.timer = time.AfterFunc(ea.config.DecisionTimeout, func() {
+		ea.resolve(Decision{RequestID: request.ID, Approved: false, Reason: "external approval timed out", TimedOut: true})
+	})
+	ea.pending[request.ID] = pending
+	ea.mutex.Unlock()
+
+	// Retries happen in the background; a request that can't be delivered at all is denied
+	ea.deliverer.Deliver(delivery.Delivery{
+		ID:          request.ID,
+		Integration: "external_approval",
+		URL:         ea.config.Endpoint,
+		Body:        body,
+		Headers:     map[string]string{SignatureHeader: Sign(ea.config.Secret, body)},
+	}, func(err error) {
+		if err != nil {
+			ea.resolve(Decision{RequestID: request.ID, Approved: false, Reason: fmt.Sprintf("external approval request failed: %v", err)})
+		}
+	})
+
+	return nil
+}
+
+// Resolve delivers a decision to the request it belongs to
+func (ea *ExternalApprover) Resolve(decision Decision) error {
+	if !ea.resolve(decision) {
+		return fmt.Errorf("%w: %s", ErrUnknownRequest, decision.RequestID)
+	}
+	return nil
+}
+
+// resolve hands a decision to its request's callback, reporting whether the request was pending
+func (ea *ExternalApprover) resolve(decision Decision) bool {
+	ea.mutex.Lock()
+	pending, exists := ea.pending[decision.RequestID]
+	if exists {
+		delete(ea.pending, decision.RequestID)
+		pending.timer.Stop()
+	}
+	ea.mutex.Unlock()
+
+	if !exists {
+		return false
+	}
+	pending.decide(pending.request, decision)
+	return true
+}
+
+// PendingCount returns how many requests are awaiting a decision
+func (ea *ExternalApprover) PendingCount() int {
+	ea.mutex.Lock()
+	defer ea.mutex.Unlock()
+	return len(ea.pending)
+}
+
+// HandleCallback accepts a signed decision from the external service
+func (ea *ExternalApprover) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	if !ea.Enabled() {
+		http.Error(w, "External approval is not enabled", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCallbackSize))
+	if err != nil {
+		http.Error(w, "Failed to read callback", http.StatusBadRequest)
+		return
+	}
+	if !Verify(ea.config.Secret, body, r.Header.Get(SignatureHeader)) {
+		log.Printf("Rejected approval callback from %s: %v", r.RemoteAddr, ErrInvalidSignature)
+		http.Error(w, ErrInvalidSignature.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var decision Decision
+	if err := json.Unmarshal(body, &decision); err != nil || decision.RequestID == "" {
+		http.Error(w, "Invalid callback body", http.StatusBadRequest)
+		return
+	}
+
+	if err := ea.Resolve(decision); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request_id": decision.RequestID,
+		"status":     "accepted",
+	})
+}
+
+// Stop abandons every pending request without deciding it
+func (ea *ExternalApprover) Stop() {
+	ea.mutex.Lock()
+	defer ea.mutex.Unlock()
+
+	for id, pending := range ea.pending {
+		pending.timer.Stop()
+		delete(ea.pending, id)
+	}
+}
+
+// Sign returns the signature header value for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the valid signature of body
+func Verify(secret string, body []byte, signature string) bool {
+	if secret == "" || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
@@ -0,0 +1,151 @@
+package approval
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onlitec/onlidesk-server/internal/delivery"
+)
+
+const testSecret = "shared-secret"
+
+// newTestDeliverer creates a deliverer with fast retries that dead-letters under the test dir
+func newTestDeliverer(t *testing.T) *delivery.Deliverer {
+	t.Helper()
+
+	config := delivery.DefaultConfig()
+	config.InitialBackoff = time.Millisecond
+	config.MaxBackoff = 5 * time.Millisecond
+	config.DeadLetterPath = filepath.Join(t.TempDir(), "dead_letters.jsonl")
+	deliverer := delivery.NewDeliverer(config)
+	t.Cleanup(deliverer.Stop)
+	return deliverer
+}
+
+// postCallback delivers a decision to the callback URL, signed with secret
+func postCallback(t *testing.T, url, secret string, decision Decision) *http.Response {
+	t.Helper()
+
+	body, err := json.Marshal(decision)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set(SignatureHeader, Sign(secret, body))
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestExternalApprover_ApprovesViaCallback(t *testing.T) {
+	config := DefaultConfig()
+	config.Enabled = true
+	config.Secret = testSecret
+	ea := NewExternalApprover(config, newTestDeliverer(t))
+	defer ea.Stop()
+
+	callbacks := httptest.NewServer(http.HandlerFunc(ea.HandleCallback))
+	defer callbacks.Close()
+	config.CallbackURL = callbacks.URL
+
+	// The simulated ticketing system verifies the request, then approves it out of band
+	received := make(chan Request, 1)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify(testSecret, body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var request Request
+		json.Unmarshal(body, &request)
+		received <- request
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer service.Close()
+	config.Endpoint = service.URL
+
+	decisions := make(chan Decision, 1)
+	require.NoError(t, ea.RequestApproval(Request{
+		ID:        "transfer-1",
+		Kind:      KindTransfer,
+		SessionID: "session-1",
+		Summary:   "upload of fix.txt",
+	}, func(request Request, decision Decision) {
+		assert.Equal(t, "session-1", request.SessionID)
+		decisions <- decision
+	}))
+
+	var request Request
+	select {
+	case request = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("approval request never reached the service")
+	}
+	assert.Equal(t, "transfer-1", request.ID)
+	assert.Equal(t, callbacks.URL, request.CallbackURL)
+	assert.Equal(t, 1, ea.PendingCount())
+
+	resp := postCallback(t, request.CallbackURL, testSecret, Decision{RequestID: request.ID, Approved: true, Approver: "change-board"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case decision := <-decisions:
+		assert.True(t, decision.Approved)
+		assert.Equal(t, "change-board", decision.Approver)
+		assert.False(t, decision.TimedOut)
+	case <-time.After(5 * time.Second):
+		t.Fatal("decision was never delivered")
+	}
+	assert.Equal(t, 0, ea.PendingCount())
+
+	// A decision only counts once
+	resp = postCallback(t, callbacks.URL, testSecret, Decision{RequestID: request.ID, Approved: false})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestExternalApprover_RejectsForgedCallbacksAndTimesOut(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer service.Close()
+
+	config := DefaultConfig()
+	config.Enabled = true
+	config.Endpoint = service.URL
+	config.Secret = testSecret
+	config.DecisionTimeout = 100 * time.Millisecond
+	ea := NewExternalApprover(config, newTestDeliverer(t))
+	defer ea.Stop()
+
+	callbacks := httptest.NewServer(http.HandlerFunc(ea.HandleCallback))
+	defer callbacks.Close()
+
+	decisions := make(chan Decision, 1)
+	require.NoError(t, ea.RequestApproval(Request{ID: "privilege-1", Kind: KindPrivilege}, func(request Request, decision Decision) {
+		decisions <- decision
+	}))
+
+	resp := postCallback(t, callbacks.URL, "wrong-secret", Decision{RequestID: "privilege-1", Approved: true})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, 1, ea.PendingCount())
+
+	select {
+	case decision := <-decisions:
+		assert.False(t, decision.Approved)
+		assert.True(t, decision.TimedOut)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never timed out")
+	}
+	assert.Equal(t, 0, ea.PendingCount())
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Authentication providers selectable by config
+const (
+	ProviderNone = "none"
+	ProviderJWT  = "jwt"
+	ProviderOIDC = "oidc"
+)
+
+// Scopes required by sensitive endpoints
+const (
+	ScopeConfigWrite       = "config:write"
+	ScopeSessionsTerminate = "sessions:terminate"
+	ScopeTransfersApprove  = "transfers:approve"
+	ScopePrivilegesApprove = "privileges:approve"
+	ScopeAdmin             = "admin"
+)
+
+// Errors returned when a token is refused; the specific cause is wrapped with detail
+var (
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrTokenExpired    = errors.New("token expired")
+	ErrInvalidIssuer   = errors.New("token issuer not trusted")
+	ErrInvalidAudience = errors.New("token audience not accepted")
+)
+
+// Identity is the authenticated caller a token describes
+type Identity struct {
+	Subject   string                 `json:"subject"`
+	Issuer    string                 `json:"issuer,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Email     string                 `json:"email,omitempty"`
+	Roles     []string               `json:"roles,omitempty"`
+	Scopes    []string               `json:"scopes,omitempty"`
+	ExpiresAt time.Time              `json:"expires_at"`
+	Claims    map[string]interface{} `json:"-"`
+}
+
+// HasScope reports whether the token granted scope
+func (i Identity) HasScope(scope string) bool {
+	for _, granted := range i.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator validates a bearer token and returns the identity it carries
+type Authenticator interface {
+	Authenticate(token string) (Identity, error)
+}
+
+// Config selects and configures the authentication provider
+type Config struct {
+	Provider string      `json:"provider"` // none, jwt or oidc
+	JWT      *JWTConfig  `json:"jwt,omitempty"`
+	OIDC     *OIDCConfig `json:"oidc,omitempty"`
+}
+
+// DefaultConfig returns the authentication configuration, with no provider by default
+func DefaultConfig() *Config {
+	return &Config{
+		Provider: ProviderNone,
+	}
+}
+
+// Validate checks that the selected provider is configured
+func (c *Config) Validate() error {
+	switch c.Provider {
+	case "", ProviderNone:
+		return nil
+	case ProviderJWT:
+		if c.JWT == nil {
+			return fmt.Errorf("jwt settings are required for the jwt provider")
+		}
+		return c.JWT.Validate()
+	case ProviderOIDC:
+		if c.OIDC == nil {
+			return fmt.Errorf("oidc settings are required for the oidc provider")
+		}
+		return c.OIDC.Validate()
+	default:
+		return fmt.Errorf("unknown authentication provider %q", c.Provider)
+	}
+}
+
+// NewAuthenticator creates the configured provider, or returns nil when authentication is disabled
+func NewAuthenticator(config *Config) (Authenticator, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch config.Provider {
+	case ProviderJWT:
+		return NewJWTAuthenticator(config.JWT)
+	case ProviderOIDC:
+		return NewOIDCAuthenticator(config.OIDC), nil
+	default:
+		return nil, nil
+	}
+}
+
+type identityContextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the authenticated identity
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFromContext returns the identity stored by WithIdentity, if any
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(Identity)
+	return identity, ok
+}
+
+// Actor names the caller for audit records, or "anonymous" when the request wasn't authenticated
+func Actor(ctx context.Context) string {
+	if identity, ok := IdentityFromContext(ctx); ok && identity.Subject != "" {
+		return identity.Subject
+	}
+	return "anonymous"
+}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for RS256
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for RS384 and RS512
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// signingHashes maps the supported JWS algorithms onto their hash functions
+var signingHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// JWTConfig configures the built-in JWT validator
+type JWTConfig struct {
+	Algorithm     string        `json:"algorithm"`       // HS256, HS384, HS512, RS256, RS384 or RS512; tokens must use it
+	Secret        string        `json:"secret"`          // HMAC key for the HS algorithms
+	PublicKeyFile string        `json:"public_key_file"` // PEM RSA public key for the RS algorithms
+	Issuer        string        `json:"issuer"`          // required iss claim, if set
+	Audience      string        `json:"audience"`        // required aud entry, if set
+	RolesClaim    string        `json:"roles_claim"`     // claim holding the caller's roles, default "roles"
+	Leeway        time.Duration `json:"leeway"`          // clock skew tolerated on exp and nbf
+}
+
+// Validate checks that the configured algorithm has a key
+func (c *JWTConfig) Validate() error {
+	if _, ok := signingHashes[c.Algorithm]; !ok {
+		return fmt.Errorf("unsupported jwt algorithm %q", c.Algorithm)
+	}
+	if strings.HasPrefix(c.Algorithm, "HS") && c.Secret == "" {
+		return fmt.Errorf("secret is required for %s", c.Algorithm)
+	}
+	if strings.HasPrefix(c.Algorithm, "RS") && c.PublicKeyFile == "" {
+		return fmt.Errorf("public_key_file is required for %s", c.Algorithm)
+	}
+	if c.Leeway < 0 {
+		return fmt.Errorf("leeway cannot be negative")
+	}
+	return nil
+}
+
+// claimRules are the checks applied to a verified token's claims
+type claimRules struct {
+	issuer     string
+	audience   string
+	rolesClaim string
+	leeway     time.Duration
+}
+
+// JWTAuthenticator validates tokens signed with a single configured key
+type JWTAuthenticator struct {
+	algorithm string
+	key       interface{} // []byte for HS algorithms, *rsa.PublicKey for RS
+	rules     claimRules
+}
+
+// NewJWTAuthenticator creates a validator for the configured algorithm and key
+func NewJWTAuthenticator(config *JWTConfig) (*JWTAuthenticator, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	ja := &JWTAuthenticator{
+		algorithm: config.Algorithm,
+		rules: claimRules{
+			issuer:     config.Issuer,
+			audience:   config.Audience,
+			rolesClaim: config.RolesClaim,
+			leeway:     config.Leeway,
+		},
+	}
+
+	if strings.HasPrefix(config.Algorithm, "HS") {
+		ja.key = []byte(config.Secret)
+		return ja, nil
+	}
+
+	data, err := os.ReadFile(config.PublicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %v", err)
+	}
+	key, err := parseRSAPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	ja.key = key
+	return ja, nil
+}
+
+// Authenticate verifies the token's signature and claims
+func (ja *JWTAuthenticator) Authenticate(token string) (Identity, error) {
+	parsed, err := parseJWT(token)
+	if err != nil {
+		return Identity{}, err
+	}
+	// The algorithm is pinned so a token can't pick a weaker verification
+	if parsed.header.Alg != ja.algorithm {
+		return Identity{}, fmt.Errorf("%w: unexpected algorithm %q", ErrInvalidToken, parsed.header.Alg)
+	}
+	if err := parsed.verify(ja.key); err != nil {
+		return Identity{}, err
+	}
+	return ja.rules.identity(parsed.claims, time.Now())
+}
+
+// jwtHeader is the JOSE header of a compact JWS
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parsedJWT is a decoded but not yet verified token
+type parsedJWT struct {
+	header       jwtHeader
+	claims       map[string]interface{}
+	signingInput string
+	signature    []byte
+}
+
+// parseJWT decodes a compact JWS without verifying it
+func parseJWT(token string) (*parsedJWT, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	parsed := &parsedJWT{signingInput: parts[0] + "." + parts[1]}
+	if err := decodeSegment(parts[0], &parsed.header); err != nil {
+		return nil, fmt.Errorf("%w: bad header: %v", ErrInvalidToken, err)
+	}
+	if err := decodeSegment(parts[1], &parsed.claims); err != nil {
+		return nil, fmt.Errorf("%w: bad claims: %v", ErrInvalidToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidToken)
+	}
+	parsed.signature = signature
+	return parsed, nil
+}
+
+// decodeSegment decodes a base64url JSON segment into v
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verify checks the token's signature with key
+func (p *parsedJWT) verify(key interface{}) error {
+	hash, ok := signingHashes[p.header.Alg]
+	if !ok {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, p.header.Alg)
+	}
+
+	switch key := key.(type) {
+	case []byte:
+		if !strings.HasPrefix(p.header.Alg, "HS") {
+			return fmt.Errorf("%w: algorithm %q does not match key", ErrInvalidToken, p.header.Alg)
+		}
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(p.signingInput))
+		if !hmac.Equal(mac.Sum(nil), p.signature) {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(p.header.Alg, "RS") {
+			return fmt.Errorf("%w: algorithm %q does not match key", ErrInvalidToken, p.header.Alg)
+		}
+		hasher := hash.New()
+		hasher.Write([]byte(p.signingInput))
+		if err := rsa.VerifyPKCS1v15(key, hash, hasher.Sum(nil), p.signature); err != nil {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+	default:
+		return fmt.Errorf("%w: no usable key", ErrInvalidToken)
+	}
+	return nil
+}
+
+// identity checks the time, issuer and audience claims and builds the caller's identity
+func (rules claimRules) identity(claims map[string]interface{}, now time.Time) (Identity, error) {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return Identity{}, fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+	expiresAt := time.Unix(int64(exp), 0)
+	if now.After(expiresAt.Add(rules.leeway)) {
+		return Identity{}, fmt.Errorf("%w: expired at %s", ErrTokenExpired, expiresAt.Format(time.RFC3339))
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(rules.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return Identity{}, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+
+	issuer, _ := claims["iss"].(string)
+	if rules.issuer != "" && issuer != rules.issuer {
+		return Identity{}, fmt.Errorf("%w: %q", ErrInvalidIssuer, issuer)
+	}
+	if rules.audience != "" && !containsClaim(claims["aud"], rules.audience) {
+		return Identity{}, fmt.Errorf("%w: expected %q", ErrInvalidAudience, rules.audience)
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return Identity{}, fmt.Errorf("%w: missing sub claim", ErrInvalidToken)
+	}
+
+	identity := Identity{
+		Subject:   subject,
+		Issuer:    issuer,
+		ExpiresAt: expiresAt,
+		Claims:    claims,
+	}
+	identity.Name, _ = claims["name"].(string)
+	identity.Email, _ = claims["email"].(string)
+
+	rolesClaim := rules.rolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	identity.Roles = stringsClaim(claims[rolesClaim])
+
+	// Scopes come as the space-delimited OAuth "scope" claim, or the "scp" list some providers use
+	identity.Scopes = stringsClaim(claims["scope"])
+	if len(identity.Scopes) == 0 {
+		identity.Scopes = stringsClaim(claims["scp"])
+	}
+
+	return identity, nil
+}
+
+// stringsClaim reads a space-delimited string or string-array claim
+func stringsClaim(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		var values []string
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// containsClaim reports whether a string or string-array claim contains want
+func containsClaim(claim interface{}, want string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == want
+	case []interface{}:
+		for _, value := range claim {
+			if value == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseRSAPublicKey parses a PEM-encoded PKIX or PKCS#1 RSA public key
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("public key is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signHMAC signs claims into a compact JWT with the given HMAC algorithm
+func signHMAC(t *testing.T, alg, secret string, claims map[string]interface{}) string {
+	t.Helper()
+
+	hashes := map[string]func() hash.Hash{"HS256": sha256.New, "HS512": sha512.New}
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(hashes[alg], []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthenticator_ValidatesHMACTokens(t *testing.T) {
+	ja, err := NewJWTAuthenticator(&JWTConfig{Algorithm: "HS256", Secret: "shared", Issuer: "onlidesk"})
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{
+		"iss":   "onlidesk",
+		"sub":   "tech",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": "technician admin",
+		"scope": "openid config:write",
+	}
+
+	identity, err := ja.Authenticate(signHMAC(t, "HS256", "shared", claims))
+	require.NoError(t, err)
+	assert.Equal(t, "tech", identity.Subject)
+	assert.Equal(t, []string{"technician", "admin"}, identity.Roles)
+	assert.True(t, identity.HasScope(ScopeConfigWrite))
+	assert.False(t, identity.HasScope(ScopeTransfersApprove))
+
+	// Some providers list scopes under scp instead
+	delete(claims, "scope")
+	claims["scp"] = []string{ScopeTransfersApprove}
+	identity, err = ja.Authenticate(signHMAC(t, "HS256", "shared", claims))
+	require.NoError(t, err)
+	assert.Equal(t, []string{ScopeTransfersApprove}, identity.Scopes)
+
+	_, err = ja.Authenticate(signHMAC(t, "HS256", "guessed", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// The configured algorithm is pinned
+	_, err = ja.Authenticate(signHMAC(t, "HS512", "shared", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = ja.Authenticate(signHMAC(t, "HS256", "shared", claims))
+	assert.ErrorIs(t, err, ErrTokenExpired)
+
+	_, err = ja.Authenticate("not.a.token")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestConfig_SelectsProvider(t *testing.T) {
+	authenticator, err := NewAuthenticator(DefaultConfig())
+	require.NoError(t, err)
+	assert.Nil(t, authenticator)
+
+	authenticator, err = NewAuthenticator(&Config{Provider: ProviderJWT, JWT: &JWTConfig{Algorithm: "HS256", Secret: "shared"}})
+	require.NoError(t, err)
+	assert.IsType(t, &JWTAuthenticator{}, authenticator)
+
+	authenticator, err = NewAuthenticator(&Config{Provider: ProviderOIDC, OIDC: &OIDCConfig{IssuerURL: "https://idp.example.com", Audience: "onlidesk"}})
+	require.NoError(t, err)
+	assert.IsType(t, &OIDCAuthenticator{}, authenticator)
+
+	_, err = NewAuthenticator(&Config{Provider: ProviderOIDC, OIDC: &OIDCConfig{IssuerURL: "https://idp.example.com"}})
+	assert.Error(t, err)
+
+	_, err = NewAuthenticator(&Config{Provider: ProviderOIDC})
+	assert.Error(t, err)
+	_, err = NewAuthenticator(&Config{Provider: "saml"})
+	assert.Error(t, err)
+	_, err = NewAuthenticator(&Config{Provider: ProviderJWT, JWT: &JWTConfig{Algorithm: "none"}})
+	assert.Error(t, err)
+}
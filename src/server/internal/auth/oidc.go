@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig configures validation of tokens issued by an OpenID Connect provider
+type OIDCConfig struct {
+	IssuerURL          string        `json:"issuer_url"`           // discovery document is read from <issuer_url>/.well-known/openid-configuration
+	Audience           string        `json:"audience"`             // usually the client ID registered with the provider
+	RolesClaim         string        `json:"roles_claim"`          // claim holding the caller's roles, default "roles"
+	Leeway             time.Duration `json:"leeway"`               // clock skew tolerated on exp and nbf
+	JWKSCacheTTL       time.Duration `json:"jwks_cache_ttl"`       // how long signing keys are trusted before refetching; 0 uses 1h
+	MinRefreshInterval time.Duration `json:"min_refresh_interval"` // least time between refetches forced by unknown key IDs; 0 uses 1m
+	RequestTimeout     time.Duration `json:"request_timeout"`      // per discovery or JWKS request; 0 uses 10s
+}
+
+// Validate checks the provider settings
+func (c *OIDCConfig) Validate() error {
+	if c.IssuerURL == "" {
+		return fmt.Errorf("issuer_url is required for the oidc provider")
+	}
+	if c.Audience == "" {
+		return fmt.Errorf("audience is required for the oidc provider")
+	}
+	if c.Leeway < 0 || c.JWKSCacheTTL < 0 || c.MinRefreshInterval < 0 || c.RequestTimeout < 0 {
+		return fmt.Errorf("oidc durations cannot be negative")
+	}
+	return nil
+}
+
+// discoveryDocument holds the parts of the provider metadata that are used
+type discoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// jsonWebKey is a single key from a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// OIDCAuthenticator validates provider-issued RSA tokens against the provider's published signing keys.
+// Keys are cached and refetched when they age out or a token names a key that isn't cached,
+// so the provider can rotate keys without a restart.
+type OIDCAuthenticator struct {
+	config      *OIDCConfig
+	issuer      string
+	client      *http.Client
+	mutex       sync.RWMutex
+	jwksURI     string
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	lastRefresh time.Time
+}
+
+// NewOIDCAuthenticator creates an authenticator for the provider. The discovery document is
+// fetched on first use, so an unreachable provider doesn't prevent startup.
+func NewOIDCAuthenticator(config *OIDCConfig) *OIDCAuthenticator {
+	timeout := config.RequestTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &OIDCAuthenticator{
+		config: config,
+		issuer: strings.TrimSuffix(config.IssuerURL, "/"),
+		client: &http.Client{Timeout: timeout},
+		keys:   make(map[string]*rsa.PublicKey),
+	}
+}
+
+// Authenticate verifies the token against the provider's keys and checks its claims
+func (oa *OIDCAuthenticator) Authenticate(token string) (Identity, error) {
+	parsed, err := parseJWT(token)
+	if err != nil {
+		return Identity{}, err
+	}
+	if !strings.HasPrefix(parsed.header.Alg, "RS") {
+		return Identity{}, fmt.Errorf("%w: unexpected algorithm %q", ErrInvalidToken, parsed.header.Alg)
+	}
+
+	key, err := oa.signingKey(parsed.header.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+	if err := parsed.verify(key); err != nil {
+		return Identity{}, err
+	}
+
+	rules := claimRules{
+		issuer:     oa.issuer,
+		audience:   oa.config.Audience,
+		rolesClaim: oa.config.RolesClaim,
+		leeway:     oa.config.Leeway,
+	}
+	return rules.identity(parsed.claims, time.Now())
+}
+
+// signingKey returns the cached key for kid, refetching the key set if it is stale or doesn't have it
+func (oa *OIDCAuthenticator) signingKey(kid string) (*rsa.PublicKey, error) {
+	oa.mutex.RLock()
+	key, found := oa.lookupKey(kid)
+	fresh := oa.isFresh()
+	oa.mutex.RUnlock()
+	if found && fresh {
+		return key, nil
+	}
+
+	oa.mutex.Lock()
+	defer oa.mutex.Unlock()
+
+	// Another request may have refreshed the keys while the lock was released
+	key, found = oa.lookupKey(kid)
+	if found && oa.isFresh() {
+		return key, nil
+	}
+	if oa.isFresh() && time.Since(oa.lastRefresh) < oa.minRefreshInterval() {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidToken, kid)
+	}
+
+	if err := oa.refresh(); err != nil {
+		// Keep serving from the last good key set while the provider is unreachable
+		log.Printf("Failed to refresh OIDC signing keys: %v", err)
+		if found {
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w: signing keys unavailable: %v", ErrInvalidToken, err)
+	}
+
+	key, found = oa.lookupKey(kid)
+	if !found {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidToken, kid)
+	}
+	return key, nil
+}
+
+// lookupKey finds the key for kid; tokens without a kid may use the provider's only key
+func (oa *OIDCAuthenticator) lookupKey(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(oa.keys) == 1 {
+		for _, key := range oa.keys {
+			return key, true
+		}
+	}
+	key, found := oa.keys[kid]
+	return key, found
+}
+
+// isFresh reports whether the cached key set is within its TTL
+func (oa *OIDCAuthenticator) isFresh() bool {
+	ttl := oa.config.JWKSCacheTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	return !oa.fetchedAt.IsZero() && time.Since(oa.fetchedAt) < ttl
+}
+
+// minRefreshInterval returns the least time between forced refetches
+func (oa *OIDCAuthenticator) minRefreshInterval() time.Duration {
+	if oa.config.MinRefreshInterval == 0 {
+		return time.Minute
+	}
+	return oa.config.MinRefreshInterval
+}
+
+// refresh discovers the JWKS endpoint if needed and replaces the cached keys
+func (oa *OIDCAuthenticator) refresh() error {
+	oa.lastRefresh = time.Now()
+
+	if oa.jwksURI == "" {
+		var discovery discoveryDocument
+		if err := oa.getJSON(oa.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("discovery failed: %v", err)
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != oa.issuer {
+			return fmt.Errorf("discovery document issuer %q does not match %q", discovery.Issuer, oa.issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return fmt.Errorf("discovery document has no jwks_uri")
+		}
+		oa.jwksURI = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := oa.getJSON(oa.jwksURI, &jwks); err != nil {
+		return fmt.Errorf("jwks fetch failed: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := jwk.rsaPublicKey()
+		if err != nil {
+			log.Printf("Skipping OIDC signing key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("jwks has no usable RSA signing keys")
+	}
+
+	oa.keys = keys
+	oa.fetchedAt = time.Now()
+	return nil
+}
+
+// getJSON fetches url and decodes its JSON body into v
+func (oa *OIDCAuthenticator) getJSON(url string, v interface{}) error {
+	resp, err := oa.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// rsaPublicKey decodes the key's modulus and exponent
+func (jwk jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("bad modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("bad exponent: %v", err)
+	}
+	if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("malformed key")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
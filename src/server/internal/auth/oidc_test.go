@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockProvider is an OIDC provider serving a discovery document and a JWKS that can be rotated
+type mockProvider struct {
+	server     *httptest.Server
+	mutex      sync.Mutex
+	keys       map[string]*rsa.PrivateKey
+	jwksServed atomic.Int32
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	mp := &mockProvider{keys: make(map[string]*rsa.PrivateKey)}
+	mp.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   mp.server.URL,
+				"jwks_uri": mp.server.URL + "/jwks",
+			})
+		case "/jwks":
+			mp.jwksServed.Add(1)
+			mp.mutex.Lock()
+			var keys []map[string]string
+			for kid, key := range mp.keys {
+				keys = append(keys, map[string]string{
+					"kty": "RSA",
+					"kid": kid,
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				})
+			}
+			mp.mutex.Unlock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(mp.server.Close)
+	return mp
+}
+
+// rotate publishes a new signing key, optionally retiring the others
+func (mp *mockProvider) rotate(t *testing.T, kid string, retire bool) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if retire {
+		mp.keys = make(map[string]*rsa.PrivateKey)
+	}
+	mp.keys[kid] = key
+	return key
+}
+
+// signRS256 signs claims into a compact JWT
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCAuthenticator_ValidatesTokensAgainstJWKS(t *testing.T) {
+	provider := newMockProvider(t)
+	key := provider.rotate(t, "key-1", false)
+
+	oa := NewOIDCAuthenticator(&OIDCConfig{IssuerURL: provider.server.URL + "/", Audience: "onlidesk"})
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss":   provider.server.URL,
+			"sub":   "user-42",
+			"aud":   []string{"onlidesk", "other-app"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"email": "tech@example.com",
+			"roles": []string{"technician", "observer"},
+		}
+		for name, value := range overrides {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	identity, err := oa.Authenticate(signRS256(t, key, "key-1", claims(nil)))
+	require.NoError(t, err)
+	assert.Equal(t, "user-42", identity.Subject)
+	assert.Equal(t, "tech@example.com", identity.Email)
+	assert.Equal(t, []string{"technician", "observer"}, identity.Roles)
+
+	_, err = oa.Authenticate(signRS256(t, key, "key-1", claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})))
+	assert.ErrorIs(t, err, ErrTokenExpired)
+
+	_, err = oa.Authenticate(signRS256(t, key, "key-1", claims(map[string]interface{}{"iss": "https://evil.example.com"})))
+	assert.ErrorIs(t, err, ErrInvalidIssuer)
+
+	_, err = oa.Authenticate(signRS256(t, key, "key-1", claims(map[string]interface{}{"aud": "other-app"})))
+	assert.ErrorIs(t, err, ErrInvalidAudience)
+
+	// A token signed by a key the provider never published is refused
+	forged, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = oa.Authenticate(signRS256(t, forged, "key-1", claims(nil)))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// Everything so far was served from one fetch of the key set
+	assert.Equal(t, int32(1), provider.jwksServed.Load())
+}
+
+func TestOIDCAuthenticator_PicksUpRotatedKeys(t *testing.T) {
+	provider := newMockProvider(t)
+	oldKey := provider.rotate(t, "old", false)
+
+	oa := NewOIDCAuthenticator(&OIDCConfig{
+		IssuerURL:          provider.server.URL,
+		MinRefreshInterval: 50 * time.Millisecond,
+	})
+	claims := map[string]interface{}{
+		"iss": provider.server.URL,
+		"sub": "user-42",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	_, err := oa.Authenticate(signRS256(t, oldKey, "old", claims))
+	require.NoError(t, err)
+
+	// Once the refresh interval has passed, a token naming a key that isn't cached triggers a refetch
+	newKey := provider.rotate(t, "new", true)
+	time.Sleep(60 * time.Millisecond)
+	_, err = oa.Authenticate(signRS256(t, newKey, "new", claims))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), provider.jwksServed.Load())
+
+	// Unknown key IDs can't force a refetch on every request
+	_, err = oa.Authenticate(signRS256(t, newKey, "bogus", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = oa.Authenticate(signRS256(t, newKey, "bogus", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	assert.Equal(t, int32(2), provider.jwksServed.Load())
+
+	// The retired key stops working once the refreshed set has replaced it
+	_, err = oa.Authenticate(signRS256(t, oldKey, "old", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
@@ -0,0 +1,59 @@
+// Package bulk reports the per-item outcome of operations applied to many items at once
+package bulk
+
+// Item statuses
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// ItemResult is the outcome for one item of a bulk operation
+type ItemResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // ok or error
+	Error  string `json:"error,omitempty"`
+}
+
+// Result is the response shape shared by every bulk operation, so callers see exactly which
+// items failed and why
+type Result struct {
+	Results   []ItemResult `json:"results"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+}
+
+// NewResult creates an empty result
+func NewResult() *Result {
+	return &Result{Results: []ItemResult{}}
+}
+
+// Add records the outcome for an item; a nil err is a success
+func (r *Result) Add(id string, err error) {
+	if err != nil {
+		r.Results = append(r.Results, ItemResult{ID: id, Status: StatusError, Error: err.Error()})
+		r.Failed++
+		return
+	}
+	r.Results = append(r.Results, ItemResult{ID: id, Status: StatusOK})
+	r.Succeeded++
+}
+
+// Run applies fn to every id without stopping at the first failure
+func Run(ids []string, fn func(id string) error) *Result {
+	result := NewResult()
+	for _, id := range ids {
+		result.Add(id, fn(id))
+	}
+	return result
+}
+
+// IDs returns the items with the given status, in the order they were processed
+func (r *Result) IDs(status string) []string {
+	ids := []string{}
+	for _, item := range r.Results {
+		if item.Status == status {
+			ids = append(ids, item.ID)
+		}
+	}
+	return ids
+}
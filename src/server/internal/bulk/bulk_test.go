@@ -0,0 +1,46 @@
+package bulk
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun_ReportsEveryItem(t *testing.T) {
+	var attempted []string
+	result := Run([]string{"a", "b", "c", "d"}, func(id string) error {
+		attempted = append(attempted, id)
+		if id == "b" || id == "d" {
+			return errors.New(id + " is locked")
+		}
+		return nil
+	})
+
+	// A failure doesn't stop the rest from being attempted
+	assert.Equal(t, []string{"a", "b", "c", "d"}, attempted)
+	assert.Equal(t, 2, result.Succeeded)
+	assert.Equal(t, 2, result.Failed)
+	assert.Equal(t, []string{"a", "c"}, result.IDs(StatusOK))
+	assert.Equal(t, []string{"b", "d"}, result.IDs(StatusError))
+
+	data, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"results": [
+			{"id": "a", "status": "ok"},
+			{"id": "b", "status": "error", "error": "b is locked"},
+			{"id": "c", "status": "ok"},
+			{"id": "d", "status": "error", "error": "d is locked"}
+		],
+		"succeeded": 2,
+		"failed": 2
+	}`, string(data))
+
+	// Nothing to do still reports an empty list rather than null
+	data, err = json.Marshal(Run(nil, nil))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"results": [], "succeeded": 0, "failed": 0}`, string(data))
+}
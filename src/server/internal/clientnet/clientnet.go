@@ -0,0 +1,61 @@
+// Package clientnet works out where HTTP and WebSocket requests come from, shared by the file
+// transfer and remote access servers
+package clientnet
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the client IP address of a request. X-Forwarded-For and X-Real-IP are only
+// honoured when the peer is one of the trusted proxies (CIDRs); otherwise anyone could pick the
+// address that IP filters, rate limits and lockouts see with a single header. Of the forwarded
+// addresses, the rightmost one not itself a trusted proxy is the client, since earlier entries
+// can be supplied by the client.
+func ClientIP(r *http.Request, trustedProxies []string) string {
+	peer := PeerIP(r.RemoteAddr)
+	if !isTrusted(peer, trustedProxies) {
+		return peer
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if i == 0 || !isTrusted(hop, trustedProxies) {
+				return hop
+			}
+		}
+	}
+
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+		return xri
+	}
+	return peer
+}
+
+// PeerIP returns the host of a network address, without its port or IPv6 brackets
+func PeerIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// isTrusted reports whether ip falls within any of the trusted proxy CIDRs
+func isTrusted(ip string, trustedProxies []string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, cidr := range trustedProxies {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package clientnet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP_OnlyTrustsForwardingFromTrustedProxies(t *testing.T) {
+	request := func(remoteAddr, forwardedFor, realIP string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/api/remoteaccess/sessions", nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		if realIP != "" {
+			r.Header.Set("X-Real-IP", realIP)
+		}
+		return r
+	}
+	proxies := []string{"10.0.0.0/8"}
+
+	// Without trusted proxies the headers are ignored
+	assert.Equal(t, "198.51.100.7", ClientIP(request("198.51.100.7:5000", "203.0.113.7", "203.0.113.8"), nil))
+	assert.Equal(t, "198.51.100.7", ClientIP(request("198.51.100.7:5000", "203.0.113.7", ""), proxies))
+	assert.Equal(t, "::1", ClientIP(request("[::1]:5000", "", ""), nil))
+
+	// Behind a trusted proxy the client is the rightmost hop the proxies didn't add
+	assert.Equal(t, "203.0.113.7", ClientIP(request("10.0.0.2:5000", "203.0.113.7", ""), proxies))
+	assert.Equal(t, "203.0.113.7", ClientIP(request("10.0.0.2:5000", "192.0.2.66, 203.0.113.7, 10.0.0.9", ""), proxies))
+	assert.Equal(t, "10.0.0.9", ClientIP(request("10.0.0.2:5000", "10.0.0.9", ""), proxies))
+	assert.Equal(t, "203.0.113.8", ClientIP(request("10.0.0.2:5000", "", "203.0.113.8"), proxies))
+	assert.Equal(t, "10.0.0.2", ClientIP(request("10.0.0.2:5000", "", ""), proxies))
+}
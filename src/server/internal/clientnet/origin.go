@@ -0,0 +1,40 @@
+package clientnet
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginAllowed reports whether a WebSocket upgrade's Origin header matches one of the allowed
+// origins. A pattern matches exactly, ignoring case, and may hold one "*" standing for any run of
+// characters: "*" alone allows every origin, "https://*.example.com" the subdomains. An empty list
+// allows only the server's own origin. Requests without an Origin header don't come from a browser,
+// e.g. the desktop agents, and are always allowed.
+func OriginAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(allowed) == 0 {
+		parsed, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(parsed.Host, r.Host)
+	}
+
+	for _, pattern := range allowed {
+		if originMatches(strings.ToLower(origin), strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches matches a lower-cased origin against a lower-cased pattern with at most one "*"
+func originMatches(origin, pattern string) bool {
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return origin == pattern
+	}
+	return len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
@@ -0,0 +1,35 @@
+package clientnet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	request := func(origin string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://desk.example.com/ws/remoteaccess", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+	allowed := []string{"https://portal.example.com", "https://*.support.example.com"}
+
+	assert.True(t, OriginAllowed(request("https://portal.example.com"), allowed))
+	assert.True(t, OriginAllowed(request("HTTPS://Portal.Example.com"), allowed))
+	assert.True(t, OriginAllowed(request("https://eu.support.example.com"), allowed))
+	assert.False(t, OriginAllowed(request("https://support.example.com"), allowed))
+	assert.False(t, OriginAllowed(request("https://portal.example.com.evil.test"), allowed))
+	assert.False(t, OriginAllowed(request("https://evil.test"), allowed))
+
+	// Agents don't send an Origin, and a wildcard keeps the old permissive behavior
+	assert.True(t, OriginAllowed(request(""), allowed))
+	assert.True(t, OriginAllowed(request("https://evil.test"), []string{"*"}))
+
+	// Without a list only the server's own origin may connect
+	assert.True(t, OriginAllowed(request("http://desk.example.com"), nil))
+	assert.False(t, OriginAllowed(request("https://evil.test"), nil))
+}
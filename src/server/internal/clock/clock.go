@@ -0,0 +1,58 @@
+// Package clock tells the time to the expiry, timeout, retention and throttling logic, so tests can
+// move it forward instead of sleeping
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock reports the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// Real is the system clock, the default for every session manager and logger
+type Real struct{}
+
+// Now returns the current system time
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// Manual is a clock that only moves when told to, for tests
+type Manual struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewManual creates a manual clock stopped at start
+func NewManual(start time.Time) *Manual {
+	return &Manual{now: start}
+}
+
+// Now returns the clock's current time
+func (m *Manual) Now() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.now
+}
+
+// Advance moves the clock forward by d
+func (m *Manual) Advance(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.now = m.now.Add(d)
+}
+
+// Set moves the clock to t
+func (m *Manual) Set(t time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.now = t
+}
+
+// Since returns the time elapsed on c since t
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
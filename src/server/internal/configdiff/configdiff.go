@@ -0,0 +1,54 @@
+// Package configdiff reports which fields of a configuration an update changed
+package configdiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Change is a field's value before and after an update
+type Change struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// Diff compares two configurations by their JSON encoding and returns the changed fields,
+// keyed by JSON name. Nested objects are compared, and reported, as a whole.
+func Diff(before, after interface{}) (map[string]Change, error) {
+	oldFields, err := fields(before)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := fields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]Change)
+	for name, newValue := range newFields {
+		if oldValue := oldFields[name]; !reflect.DeepEqual(oldValue, newValue) {
+			changes[name] = Change{Old: oldValue, New: newValue}
+		}
+	}
+	for name, oldValue := range oldFields {
+		if _, ok := newFields[name]; !ok {
+			changes[name] = Change{Old: oldValue}
+		}
+	}
+	return changes, nil
+}
+
+// fields decodes a value's JSON encoding into its top-level fields
+func fields(config interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %v", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode config fields: %v", err)
+	}
+	return result, nil
+}
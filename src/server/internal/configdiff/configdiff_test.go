@@ -0,0 +1,32 @@
+package configdiff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	MaxSessions int               `json:"max_sessions"`
+	Timeout     time.Duration     `json:"timeout"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Name        string            `json:"name"`
+}
+
+func TestDiff_ReportsOnlyChangedFields(t *testing.T) {
+	before := &testConfig{MaxSessions: 10, Timeout: time.Minute, Labels: map[string]string{"env": "prod"}, Name: "main"}
+	after := &testConfig{MaxSessions: 20, Timeout: time.Minute, Name: "main"}
+
+	changes, err := Diff(before, after)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Change{
+		"max_sessions": {Old: float64(10), New: float64(20)},
+		"labels":       {Old: map[string]interface{}{"env": "prod"}},
+	}, changes)
+
+	changes, err = Diff(after, after)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
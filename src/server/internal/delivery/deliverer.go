@@ -0,0 +1,291 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config controls how outbound deliveries are retried
+type Config struct {
+	MaxAttempts    int           `json:"max_attempts"`
+	InitialBackoff time.Duration `json:"initial_backoff"`
+	MaxBackoff     time.Duration `json:"max_backoff"`
+	Jitter         float64       `json:"jitter"`           // fraction of each backoff randomised, 0-1
+	RequestTimeout time.Duration `json:"request_timeout"`  // per attempt
+	DeadLetterPath string        `json:"dead_letter_path"` // permanently failed deliveries, one JSON object per line
+}
+
+// DefaultConfig returns the default retry policy
+func DefaultConfig() *Config {
+	return &Config{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.2,
+		RequestTimeout: 10 * time.Second,
+		DeadLetterPath: "./logs/dead_letters.jsonl",
+	}
+}
+
+// Validate checks the retry policy
+func (c *Config) Validate() error {
+	if c.MaxAttempts <= 0 {
+		return fmt.Errorf("max_attempts must be greater than 0")
+	}
+	if c.InitialBackoff <= 0 {
+		return fmt.Errorf("initial_backoff must be greater than 0")
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("max_backoff cannot be less than initial_backoff")
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1")
+	}
+	if c.RequestTimeout <= 0 {
+		return fmt.Errorf("request_timeout must be greater than 0")
+	}
+	return nil
+}
+
+// Delivery is a single outbound JSON POST
+type Delivery struct {
+	ID          string            `json:"id"`
+	Integration string            `json:"integration"` // e.g. external_approval
+	URL         string            `json:"url"`
+	Body        []byte            `json:"-"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// DeadLetter records a delivery that was given up on
+type DeadLetter struct {
+	Delivery
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error"`
+	FailedAt  time.Time       `json:"failed_at"`
+}
+
+// Stats counts delivery outcomes since startup
+type Stats struct {
+	Attempts     int64 `json:"attempts"`
+	Retries      int64 `json:"retries"`
+	Delivered    int64 `json:"delivered"`
+	Failed       int64 `json:"failed"`
+	DeadLettered int64 `json:"dead_lettered"`
+	InFlight     int64 `json:"in_flight"`
+}
+
+// permanentError marks a failure that retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+// Deliverer sends outbound integration requests in the background, retrying transient failures
+// with exponential backoff and jitter and dead-lettering deliveries that never succeed
+type Deliverer struct {
+	config     *Config
+	client     *http.Client
+	ctx        context.Context
+	cancel     context.CancelFunc
+	deadLetter sync.Mutex
+	wg         sync.WaitGroup
+
+	attempts     atomic.Int64
+	retries      atomic.Int64
+	delivered    atomic.Int64
+	failed       atomic.Int64
+	deadLettered atomic.Int64
+	inFlight     atomic.Int64
+}
+
+// NewDeliverer creates a deliverer with the given retry policy
+func NewDeliverer(config *Config) *Deliverer {
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Deliverer{
+		config: config,
+		client: &http.Client{Timeout: config.RequestTimeout},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Deliver sends the delivery in the background and never blocks the caller. done, if set, is called
+// once with nil on success or the last error after the delivery has been dead-lettered.
+func (d *Deliverer) Deliver(delivery Delivery, done func(error)) {
+	d.inFlight.Add(1)
+	d.wg.Add(1)
+
+	go func() {
+		defer d.wg.Done()
+		defer d.inFlight.Add(-1)
+
+		err := d.deliver(delivery)
+		if done != nil {
+			done(err)
+		}
+	}()
+}
+
+// deliver makes up to MaxAttempts attempts, dead-lettering the delivery if none succeeds
+func (d *Deliverer) deliver(delivery Delivery) error {
+	var err error
+	attempt := 0
+	for attempt < d.config.MaxAttempts {
+		if attempt > 0 {
+			d.retries.Add(1)
+			select {
+			case <-time.After(d.backoff(attempt)):
+			case <-d.ctx.Done():
+				err = fmt.Errorf("delivery abandoned at shutdown after %d attempts: %v", attempt, err)
+				d.fail(delivery, attempt, err)
+				return err
+			}
+		}
+
+		attempt++
+		d.attempts.Add(1)
+		if err = d.send(delivery); err == nil {
+			d.delivered.Add(1)
+			return nil
+		}
+		log.Printf("Delivery %s to %s failed (attempt %d of %d): %v", delivery.ID, delivery.Integration, attempt, d.config.MaxAttempts, err)
+
+		if _, permanent := err.(*permanentError); permanent {
+			break
+		}
+	}
+
+	d.fail(delivery, attempt, err)
+	return err
+}
+
+// send makes a single attempt
+func (d *Deliverer) send(delivery Delivery) error {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return &permanentError{fmt.Errorf("failed to build request: %v", err)}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range delivery.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	default:
+		// Other client errors mean the request itself is wrong
+		return &permanentError{fmt.Errorf("endpoint responded with status %d", resp.StatusCode)}
+	}
+}
+
+// backoff returns the wait before the given retry: the initial backoff doubled per attempt,
+// capped at the maximum, then spread by up to ±Jitter
+func (d *Deliverer) backoff(attempt int) time.Duration {
+	delay := d.config.InitialBackoff
+	for i := 1; i < attempt && delay < d.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.config.MaxBackoff {
+		delay = d.config.MaxBackoff
+	}
+
+	if d.config.Jitter > 0 {
+		spread := (rand.Float64()*2 - 1) * d.config.Jitter * float64(delay)
+		delay += time.Duration(spread)
+	}
+	return delay
+}
+
+// fail counts a delivery as failed and appends it to the dead-letter log
+func (d *Deliverer) fail(delivery Delivery, attempts int, lastErr error) {
+	d.failed.Add(1)
+
+	letter := DeadLetter{
+		Delivery:  delivery,
+		Payload:   json.RawMessage(delivery.Body),
+		Attempts:  attempts,
+		LastError: lastErr.Error(),
+		FailedAt:  time.Now().UTC(),
+	}
+	if !json.Valid(delivery.Body) {
+		letter.Payload = nil
+	}
+
+	if err := d.writeDeadLetter(letter); err != nil {
+		log.Printf("Failed to dead-letter delivery %s: %v", delivery.ID, err)
+		return
+	}
+	d.deadLettered.Add(1)
+}
+
+// writeDeadLetter appends a dead letter to the log
+func (d *Deliverer) writeDeadLetter(letter DeadLetter) error {
+	if d.config.DeadLetterPath == "" {
+		return fmt.Errorf("no dead letter path configured")
+	}
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %v", err)
+	}
+
+	d.deadLetter.Lock()
+	defer d.deadLetter.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(d.config.DeadLetterPath), 0755); err != nil {
+		return fmt.Errorf("failed to create dead letter directory: %v", err)
+	}
+	file, err := os.OpenFile(d.config.DeadLetterPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open dead letter log: %v", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Stats returns delivery counters since startup
+func (d *Deliverer) Stats() Stats {
+	return Stats{
+		Attempts:     d.attempts.Load(),
+		Retries:      d.retries.Load(),
+		Delivered:    d.delivered.Load(),
+		Failed:       d.failed.Load(),
+		DeadLettered: d.deadLettered.Load(),
+		InFlight:     d.inFlight.Load(),
+	}
+}
+
+// Stop abandons pending retries, dead-lettering them, and waits for in-flight deliveries to finish
+func (d *Deliverer) Stop() {
+	d.cancel()
+	d.wg.Wait()
+}
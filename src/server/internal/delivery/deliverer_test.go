@@ -0,0 +1,140 @@
+package delivery
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDeliverer creates a deliverer with fast retries that dead-letters under the test dir
+func newTestDeliverer(t *testing.T, maxAttempts int) *Deliverer {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.MaxAttempts = maxAttempts
+	config.InitialBackoff = time.Millisecond
+	config.MaxBackoff = 10 * time.Millisecond
+	config.DeadLetterPath = filepath.Join(t.TempDir(), "dead_letters.jsonl")
+	d := NewDeliverer(config)
+	t.Cleanup(d.Stop)
+	return d
+}
+
+// deliverAndWait delivers and returns the outcome passed to done
+func deliverAndWait(t *testing.T, d *Deliverer, delivery Delivery) error {
+	t.Helper()
+
+	outcome := make(chan error, 1)
+	d.Deliver(delivery, func(err error) { outcome <- err })
+
+	select {
+	case err := <-outcome:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery never finished")
+		return nil
+	}
+}
+
+func TestDeliverer_RetriesTransientFailures(t *testing.T) {
+	var calls atomic.Int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "sha256=abc", r.Header.Get("X-Signature"))
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer endpoint.Close()
+
+	d := newTestDeliverer(t, 5)
+	err := deliverAndWait(t, d, Delivery{
+		ID:          "delivery-1",
+		Integration: "webhook",
+		URL:         endpoint.URL,
+		Body:        []byte(`{"event":"transfer_completed"}`),
+		Headers:     map[string]string{"X-Signature": "sha256=abc"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Equal(t, Stats{Attempts: 3, Retries: 2, Delivered: 1}, d.Stats())
+	_, err = os.Stat(d.config.DeadLetterPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDeliverer_DeadLettersPermanentFailures(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer endpoint.Close()
+
+	d := newTestDeliverer(t, 3)
+	err := deliverAndWait(t, d, Delivery{
+		ID:          "delivery-2",
+		Integration: "external_approval",
+		URL:         endpoint.URL,
+		Body:        []byte(`{"request_id":"r-1"}`),
+	})
+	require.Error(t, err)
+	assert.Equal(t, Stats{Attempts: 3, Retries: 2, Failed: 1, DeadLettered: 1}, d.Stats())
+
+	// Rejected requests aren't retried
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	require.Error(t, deliverAndWait(t, d, Delivery{ID: "delivery-3", Integration: "webhook", URL: rejecting.URL, Body: []byte(`{}`)}))
+	assert.Equal(t, int64(4), d.Stats().Attempts)
+
+	file, err := os.Open(d.config.DeadLetterPath)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var letter DeadLetter
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &letter))
+		letters = append(letters, letter)
+	}
+	require.Len(t, letters, 2)
+	assert.Equal(t, "delivery-2", letters[0].ID)
+	assert.Equal(t, "external_approval", letters[0].Integration)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.Contains(t, letters[0].LastError, "502")
+	assert.JSONEq(t, `{"request_id":"r-1"}`, string(letters[0].Payload))
+	assert.Equal(t, 1, letters[1].Attempts)
+}
+
+func TestDeliverer_BackoffGrowsAndIsCapped(t *testing.T) {
+	config := DefaultConfig()
+	config.InitialBackoff = 100 * time.Millisecond
+	config.MaxBackoff = 500 * time.Millisecond
+	config.Jitter = 0
+	d := NewDeliverer(config)
+	defer d.Stop()
+
+	assert.Equal(t, 100*time.Millisecond, d.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, d.backoff(2))
+	assert.Equal(t, 400*time.Millisecond, d.backoff(3))
+	assert.Equal(t, 500*time.Millisecond, d.backoff(4))
+	assert.Equal(t, 500*time.Millisecond, d.backoff(20))
+
+	config.Jitter = 0.5
+	for i := 0; i < 50; i++ {
+		delay := d.backoff(2)
+		assert.GreaterOrEqual(t, delay, 100*time.Millisecond)
+		assert.LessOrEqual(t, delay, 300*time.Millisecond)
+	}
+}
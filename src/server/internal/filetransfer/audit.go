@@ -8,6 +8,10 @@ import (
 	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/clock"
+	"github.com/onlitec/onlidesk-server/internal/lifecycle"
+	"github.com/onlitec/onlidesk-server/internal/redact"
 )
 
 // AuditEventType defines the type of audit event
@@ -17,6 +21,8 @@ const (
 	AuditEventTransferRequested AuditEventType = "transfer_requested"
 	AuditEventTransferApproved  AuditEventType = "transfer_approved"
 	AuditEventTransferRejected  AuditEventType = "transfer_rejected"
+	AuditEventApprovalPolicy    AuditEventType = "approval_policy_applied"
+	AuditEventExternalDecision  AuditEventType = "external_approval_decision"
 	AuditEventTransferStarted   AuditEventType = "transfer_started"
 	AuditEventTransferPaused    AuditEventType = "transfer_paused"
 	AuditEventTransferResumed   AuditEventType = "transfer_resumed"
@@ -25,8 +31,14 @@ const (
 	AuditEventTransferCancelled AuditEventType = "transfer_cancelled"
 	AuditEventFileValidated     AuditEventType = "file_validated"
 	AuditEventFileQuarantined   AuditEventType = "file_quarantined"
+	AuditEventFileRescanned     AuditEventType = "file_rescanned"
+	AuditEventFileDownloaded    AuditEventType = "file_downloaded"
 	AuditEventConfigUpdated     AuditEventType = "config_updated"
 	AuditEventSecurityViolation AuditEventType = "security_violation"
+	AuditEventClientDownloadsGranted AuditEventType = "client_downloads_granted"
+	AuditEventClientDownloadsRevoked AuditEventType = "client_downloads_revoked"
+	AuditEventClientDownloadsExpired AuditEventType = "client_downloads_expired"
+	AuditEventTransfersBulkCancelled AuditEventType = "transfers_bulk_cancelled"
 )
 
 // AuditEvent represents a single audit event
@@ -46,6 +58,19 @@ type AuditEvent struct {
 	Severity    string                 `json:"severity"`
 	Success     bool                   `json:"success"`
 	ErrorMsg    string                 `json:"error_message,omitempty"`
+	Metadata    map[string]string      `json:"metadata,omitempty"` // the transfer's client tags
+}
+
+// Directories the WebSocket handler's audit loggers write to
+const (
+	sessionAuditLogDir   = "./logs/sessions"
+	securityAuditLogDir  = "./logs/security"
+	websocketAuditLogDir = "./logs/websocket"
+)
+
+// AuditLogDirs returns the directories the WebSocket handler and its components audit to
+func AuditLogDirs() []string {
+	return []string{sessionAuditLogDir, securityAuditLogDir, websocketAuditLogDir}
 }
 
 // AuditLogger handles audit logging for file transfers
@@ -57,7 +82,10 @@ type AuditLogger struct {
 	enabled    bool
 	mutex      sync.RWMutex
 	logChan    chan *AuditEvent
-	stopChan   chan bool
+	workers    *lifecycle.Group
+	masker     *redact.Masker
+	violations *violationCoalescer
+	clock      clock.Clock // names log files, windows violations and ages out old logs
 }
 
 // NewAuditLogger creates a new audit logger
@@ -78,13 +106,16 @@ func NewAuditLogger(logDir string, enabled bool) *AuditLogger {
 		maxLogAge:  30 * 24 * time.Hour, // 30 days
 		enabled:    enabled,
 		logChan:    make(chan *AuditEvent, 1000),
-		stopChan:   make(chan bool),
+		workers:    lifecycle.NewGroup("audit logger " + logDir),
+		violations: newViolationCoalescer(defaultViolationWindow),
+		clock:      clock.Real{},
 	}
 	
 	if enabled {
-		logger.logFile = filepath.Join(logDir, fmt.Sprintf("audit_%s.log", time.Now().Format("2006-01-02")))
-		go logger.processLogs()
-		go logger.rotateLogsDaily()
+		logger.logFile = filepath.Join(logDir, fmt.Sprintf("audit_%s.log", logger.clock.Now().Format("2006-01-02")))
+		logger.workers.Go("process logs", logger.processLogs)
+		logger.workers.Go("rotate logs", logger.rotateLogsDaily)
+		logger.workers.Go("flush violations", logger.flushViolationsPeriodically)
 	}
 	
 	return logger
@@ -99,9 +130,11 @@ func (al *AuditLogger) LogEvent(event *AuditEvent) {
 	if event.ID == "" {
 		event.ID = generateEventID()
 	}
+	// Audit timestamps are always UTC, whatever zone the caller used
 	if event.Timestamp.IsZero() {
-		event.Timestamp = time.Now()
+		event.Timestamp = al.now()
 	}
+	event.Timestamp = event.Timestamp.UTC()
 	if event.Severity == "" {
 		event.Severity = al.determineSeverity(event.EventType)
 	}
@@ -115,6 +148,29 @@ func (al *AuditLogger) LogEvent(event *AuditEvent) {
 	}
 }
 
+// SetClock sets the clock log files are named by, violations windowed and old logs aged out on,
+// e.g. a manual one in tests
+func (al *AuditLogger) SetClock(c clock.Clock) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	al.clock = c
+}
+
+// now returns the current time on the logger's clock
+func (al *AuditLogger) now() time.Time {
+	al.mutex.RLock()
+	defer al.mutex.RUnlock()
+	return al.clock.Now()
+}
+
+// SetMask masks the values of the given detail keys in every event written from now on, replacing
+// them with a placeholder or their hash depending on mode
+func (al *AuditLogger) SetMask(keys []string, mode string) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	al.masker = redact.NewMasker(keys, mode)
+}
+
 // LogTransferRequest logs a transfer request event
 func (al *AuditLogger) LogTransferRequest(request *FileTransferRequest, ipAddress, userAgent string) {
 	event := &AuditEvent{
@@ -127,6 +183,7 @@ func (al *AuditLogger) LogTransferRequest(request *FileTransferRequest, ipAddres
 		IPAddress:  ipAddress,
 		UserAgent:  userAgent,
 		Success:    true,
+		Metadata:   request.Metadata,
 		Details: map[string]interface{}{
 			"transfer_type": request.Type,
 			"checksum":     request.Checksum,
@@ -153,6 +210,30 @@ func (al *AuditLogger) LogTransferApproval(transferID, sessionID string, approve
 			"message":  message,
 		},
 	}
+	if !approved {
+		event.Details["reason"] = message
+	}
+	al.LogEvent(event)
+}
+
+// LogApprovalPolicy logs whether a transfer was auto-approved or held for manual approval
+func (al *AuditLogger) LogApprovalPolicy(transferID, sessionID string, fileSize int64, manual bool, threshold int64) {
+	path := "auto_approved"
+	if manual {
+		path = "manual_approval"
+	}
+
+	event := &AuditEvent{
+		EventType:  AuditEventApprovalPolicy,
+		SessionID:  sessionID,
+		TransferID: transferID,
+		FileSize:   fileSize,
+		Success:    true,
+		Details: map[string]interface{}{
+			"path":               path,
+			"approval_threshold": threshold,
+		},
+	}
 	al.LogEvent(event)
 }
 
@@ -168,8 +249,22 @@ func (al *AuditLogger) LogTransferProgress(transferID, sessionID string, eventTy
 	al.LogEvent(event)
 }
 
-// LogSecurityViolation logs security violation events
+// LogSecurityViolation logs security violation events. The first occurrence is logged at once;
+// identical ones within the violation window are written as a single event with their count.
 func (al *AuditLogger) LogSecurityViolation(transferID, sessionID, filename, violation, ipAddress string) {
+	if !al.enabled {
+		return
+	}
+
+	key := violationKey{sessionID, filename, violation, ipAddress}
+	logNow, expired := al.violations.observe(key, transferID, al.now())
+	if expired != nil {
+		al.logCoalescedViolation(key, expired)
+	}
+	if !logNow {
+		return
+	}
+
 	event := &AuditEvent{
 		EventType:  AuditEventSecurityViolation,
 		SessionID:  sessionID,
@@ -182,6 +277,7 @@ func (al *AuditLogger) LogSecurityViolation(transferID, sessionID, filename, vio
 		Details: map[string]interface{}{
 			"violation_type": "security",
 			"description":    violation,
+			"count":          1,
 		},
 	}
 	al.LogEvent(event)
@@ -202,12 +298,12 @@ func (al *AuditLogger) LogConfigUpdate(userID, configType string, changes map[st
 }
 
 // processLogs processes audit events from the channel
-func (al *AuditLogger) processLogs() {
+func (al *AuditLogger) processLogs(stop <-chan struct{}) {
 	for {
 		select {
 		case event := <-al.logChan:
 			al.writeEvent(event)
-		case <-al.stopChan:
+		case <-stop:
 			// Process remaining events
 			for len(al.logChan) > 0 {
 				event := <-al.logChan
@@ -227,6 +323,17 @@ func (al *AuditLogger) writeEvent(event *AuditEvent) {
 	if al.needsRotation() {
 		al.rotateLog()
 	}
+
+	// Mask sensitive values on a copy; the caller may still hold the event
+	if al.masker != nil {
+		masked := *event
+		masked.Details = al.masker.Details(event.Details)
+		masked.Metadata = al.masker.Strings(event.Metadata)
+		if al.masker.Masks("filename") {
+			masked.Filename = al.masker.String(event.Filename)
+		}
+		event = &masked
+	}
 	
 	// Open log file
 	file, err := os.OpenFile(al.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
@@ -259,7 +366,7 @@ func (al *AuditLogger) needsRotation() bool {
 
 // rotateLog rotates the current log file
 func (al *AuditLogger) rotateLog() {
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
+	timestamp := al.clock.Now().Format("2006-01-02_15-04-05")
 	rotatedFile := filepath.Join(al.logDir, fmt.Sprintf("audit_%s.log", timestamp))
 	
 	if err := os.Rename(al.logFile, rotatedFile); err != nil {
@@ -271,7 +378,7 @@ func (al *AuditLogger) rotateLog() {
 }
 
 // rotateLogsDaily rotates logs daily and cleans up old logs
-func (al *AuditLogger) rotateLogsDaily() {
+func (al *AuditLogger) rotateLogsDaily(stop <-chan struct{}) {
 	ticker := time.NewTicker(24 * time.Hour)
 	defer ticker.Stop()
 	
@@ -281,9 +388,9 @@ func (al *AuditLogger) rotateLogsDaily() {
 			al.cleanupOldLogs()
 			// Update log file name for new day
 			al.mutex.Lock()
-			al.logFile = filepath.Join(al.logDir, fmt.Sprintf("audit_%s.log", time.Now().Format("2006-01-02")))
+			al.logFile = filepath.Join(al.logDir, fmt.Sprintf("audit_%s.log", al.clock.Now().Format("2006-01-02")))
 			al.mutex.Unlock()
-		case <-al.stopChan:
+		case <-stop:
 			return
 		}
 	}
@@ -291,7 +398,7 @@ func (al *AuditLogger) rotateLogsDaily() {
 
 // cleanupOldLogs removes old log files
 func (al *AuditLogger) cleanupOldLogs() {
-	cutoff := time.Now().Add(-al.maxLogAge)
+	cutoff := al.now().Add(-al.maxLogAge)
 	
 	files, err := filepath.Glob(filepath.Join(al.logDir, "audit_*.log"))
 	if err != nil {
@@ -320,7 +427,7 @@ func (al *AuditLogger) determineSeverity(eventType AuditEventType) string {
 	switch eventType {
 	case AuditEventSecurityViolation:
 		return "HIGH"
-	case AuditEventTransferFailed, AuditEventFileQuarantined:
+	case AuditEventTransferFailed, AuditEventFileQuarantined, AuditEventClientDownloadsGranted, AuditEventTransfersBulkCancelled:
 		return "MEDIUM"
 	case AuditEventTransferRejected, AuditEventTransferCancelled:
 		return "LOW"
@@ -334,11 +441,13 @@ func generateEventID() string {
 	return fmt.Sprintf("evt_%d_%d", time.Now().UnixNano(), time.Now().Nanosecond()%1000)
 }
 
-// Stop stops the audit logger
+// Stop stops the audit logger once queued events, including coalesced violations, are written.
+// It is safe to call more than once.
 func (al *AuditLogger) Stop() {
 	if al.enabled {
-		close(al.stopChan)
+		al.flushViolations(true)
 	}
+	al.workers.Stop(lifecycle.DefaultStopTimeout)
 }
 
 // GetAuditSummary returns a summary of audit events
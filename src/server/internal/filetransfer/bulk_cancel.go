@@ -0,0 +1,45 @@
+package filetransfer
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/onlitec/onlidesk-server/internal/bulk"
+)
+
+// CancelTransfersByTechnician cancels every active transfer the technician has in flight, as during
+// an incident. Each transfer is cancelled on its own so one failure doesn't stop the rest; the bulk
+// action is audited with the actor who started it.
+func (sm *SessionManager) CancelTransfersByTechnician(technician, actor, ipAddress string) (*bulk.Result, error) {
+	if technician == "" {
+		return nil, fmt.Errorf("technician is required")
+	}
+
+	var active []string
+	for id, session := range sm.GetSessionsByUser(technician) {
+		session.mutex.RLock()
+		if session.Status == StatusInProgress || session.Status == StatusPaused || session.Status == StatusPending || session.Status == StatusApproved {
+			active = append(active, id)
+		}
+		session.mutex.RUnlock()
+	}
+	sort.Strings(active)
+
+	result := bulk.Run(active, sm.CancelTransfer)
+
+	sm.auditLogger.LogEvent(&AuditEvent{
+		EventType:  AuditEventTransfersBulkCancelled,
+		UserID:     actor,
+		Technician: technician,
+		IPAddress:  ipAddress,
+		Success:    result.Failed == 0,
+		Details: map[string]interface{}{
+			"results":   result.Results,
+			"succeeded": result.Succeeded,
+			"failed":    result.Failed,
+		},
+	})
+	log.Printf("%s cancelled %d of %d active transfers for technician %s", actor, result.Succeeded, len(active), technician)
+	return result, nil
+}
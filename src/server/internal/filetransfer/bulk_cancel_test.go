@@ -0,0 +1,73 @@
+package filetransfer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onlitec/onlidesk-server/internal/bulk"
+)
+
+func TestSessionManager_CancelTransfersByTechnician(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.MaxConcurrent = 10
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, config, securityConfig)
+
+	create := func(technician string) *TransferSession {
+		session, err := sm.CreateTransferSession(&FileTransferRequest{
+			Type:       TransferTypeUpload,
+			Filename:   "notes.txt",
+			FileSize:   1024,
+			Technician: technician,
+		}, nil, nil)
+		require.NoError(t, err)
+		return session
+	}
+
+	// One pending, one approved and one finished transfer for the technician, and one for a colleague
+	pending := create("tech-1")
+	approved := create("tech-1")
+	require.NoError(t, sm.ApproveTransfer(approved.ID, true, ""))
+	finished := create("tech-1")
+	require.NoError(t, sm.CompleteTransfer(finished.ID, true, ""))
+	other := create("tech-2")
+
+	result, err := sm.CancelTransfersByTechnician("tech-1", "admin-1", "203.0.113.7")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{pending.ID, approved.ID}, result.IDs(bulk.StatusOK))
+	assert.Equal(t, 2, result.Succeeded)
+	assert.Zero(t, result.Failed)
+
+	for _, session := range []*TransferSession{pending, approved} {
+		status, _ := sm.GetTransferStatus(session.ID)
+		assert.Equal(t, StatusCancelled, status)
+	}
+	status, _ := sm.GetTransferStatus(finished.ID)
+	assert.Equal(t, StatusCompleted, status, "finished transfers are left alone")
+	status, _ = sm.GetTransferStatus(other.ID)
+	assert.Equal(t, StatusPending, status, "other technicians' transfers are left alone")
+
+	// Nothing is left to cancel the second time
+	result, err = sm.CancelTransfersByTechnician("tech-1", "admin-1", "203.0.113.7")
+	require.NoError(t, err)
+	assert.Empty(t, result.Results)
+
+	_, err = sm.CancelTransfersByTechnician("", "admin-1", "203.0.113.7")
+	assert.Error(t, err)
+
+	// The bulk cancel is audited with the admin who started it
+	var bulkEvents []AuditEvent
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == AuditEventTransfersBulkCancelled {
+			bulkEvents = append(bulkEvents, event)
+		}
+	}
+	require.Len(t, bulkEvents, 2)
+	assert.Equal(t, "admin-1", bulkEvents[0].UserID)
+	assert.Equal(t, "tech-1", bulkEvents[0].Technician)
+	assert.Equal(t, "203.0.113.7", bulkEvents[0].IPAddress)
+	assert.Equal(t, float64(2), bulkEvents[0].Details["succeeded"])
+}
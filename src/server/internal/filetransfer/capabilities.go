@@ -0,0 +1,55 @@
+package filetransfer
+
+// ProtocolVersion is the version of the file transfer WebSocket protocol the server speaks
+const ProtocolVersion = "1.0"
+
+// FeatureStatus reports whether an optional feature is enabled, and what provides it
+type FeatureStatus struct {
+	Enabled    bool     `json:"enabled"`
+	Backend    string   `json:"backend,omitempty"`
+	Algorithms []string `json:"algorithms,omitempty"`
+}
+
+// Capabilities describes the transfer features a deployment actually has, so clients and
+// operators can check them rather than assume them
+type Capabilities struct {
+	ProtocolVersion  string         `json:"protocol_version"`
+	TransferTypes    []TransferType `json:"transfer_types"`
+	Compression      FeatureStatus  `json:"compression"` // algorithms the server can decompress
+	Encryption       FeatureStatus  `json:"encryption"`  // of files at rest
+	MalwareScanning  FeatureStatus  `json:"malware_scanning"`
+	Storage          FeatureStatus  `json:"storage"`
+	ExternalApproval bool           `json:"external_approval"`
+	ResumableUploads bool           `json:"resumable_uploads"`
+	Limits           *ServerInfo    `json:"limits"`
+}
+
+// GetCapabilities reports the optional features compiled in and enabled by the current config
+func (wh *WebSocketHandler) GetCapabilities() *Capabilities {
+	config := wh.sessionManager.GetConfig()
+	securityConfig := wh.fileValidator.config
+
+	return &Capabilities{
+		ProtocolVersion: ProtocolVersion,
+		TransferTypes:   []TransferType{TransferTypeUpload, TransferTypeDownload, TransferTypeDirectory},
+		Compression: FeatureStatus{
+			Enabled:    securityConfig.CompressionEnabled,
+			Algorithms: []string{CompressionGzip},
+		},
+		Encryption: FeatureStatus{
+			Enabled:    securityConfig.EncryptionEnabled && config.EncryptFiles,
+			Algorithms: []string{"AES-256-GCM"},
+		},
+		MalwareScanning: FeatureStatus{
+			Enabled: securityConfig.ScanForMalware,
+			Backend: wh.fileValidator.ScannerName(),
+		},
+		Storage: FeatureStatus{
+			Enabled: true,
+			Backend: "local",
+		},
+		ExternalApproval: wh.approver.Enabled(),
+		ResumableUploads: true,
+		Limits:           wh.GetServerInfo(),
+	}
+}
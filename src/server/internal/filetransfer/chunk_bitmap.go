@@ -0,0 +1,109 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// chunkBitmapSuffix names the sidecar next to an upload's temp file that records which chunks are on disk
+const chunkBitmapSuffix = ".chunks"
+
+// chunkBitmapPath returns where the chunk bitmap for an upload's temp file is kept
+func chunkBitmapPath(tempPath string) string {
+	return tempPath + chunkBitmapSuffix
+}
+
+// removeChunkBitmap deletes an upload's chunk bitmap once the upload can no longer be resumed
+func removeChunkBitmap(tempPath string) {
+	if err := os.Remove(chunkBitmapPath(tempPath)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing chunk bitmap: %v", err)
+	}
+}
+
+// chunkBitmap records which chunks of an upload have been written, one bit per chunk, persisted
+// next to the temp file so an upload can pick up where it left off after its connection drops
+type chunkBitmap struct {
+	file *os.File
+	bits []byte
+}
+
+// openChunkBitmap opens the bitmap at path, creating it when the upload is new. Bits already
+// set by an earlier connection are kept.
+func openChunkBitmap(path string, chunks int) (*chunkBitmap, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk bitmap: %v", err)
+	}
+
+	bits := make([]byte, (chunks+7)/8)
+	// A new or partly written bitmap reads short; the missing bits are unset
+	if _, err := file.ReadAt(bits, 0); err != nil && !errors.Is(err, io.EOF) {
+		file.Close()
+		return nil, fmt.Errorf("failed to read chunk bitmap: %v", err)
+	}
+	return &chunkBitmap{file: file, bits: bits}, nil
+}
+
+// readChunkBitmap loads a persisted bitmap without opening it for writing, for uploads with no stream
+func readChunkBitmap(path string, chunks int) (*chunkBitmap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read chunk bitmap: %v", err)
+	}
+
+	bits := make([]byte, (chunks+7)/8)
+	copy(bits, data)
+	return &chunkBitmap{bits: bits}, nil
+}
+
+// has reports whether a chunk is on disk
+func (b *chunkBitmap) has(chunkIndex int) bool {
+	if chunkIndex < 0 || chunkIndex/8 >= len(b.bits) {
+		return false
+	}
+	return b.bits[chunkIndex/8]&(1<<uint(chunkIndex%8)) != 0
+}
+
+// set records a chunk as on disk, persisting the byte holding its bit
+func (b *chunkBitmap) set(chunkIndex int) error {
+	if chunkIndex < 0 || chunkIndex/8 >= len(b.bits) {
+		return fmt.Errorf("%w: %d", ErrChunkIndexOutOfRange, chunkIndex)
+	}
+	b.bits[chunkIndex/8] |= 1 << uint(chunkIndex%8)
+	if b.file == nil {
+		return nil
+	}
+	_, err := b.file.WriteAt(b.bits[chunkIndex/8:chunkIndex/8+1], int64(chunkIndex/8))
+	return err
+}
+
+// missing lists the chunks below count that aren't on disk, in order
+func (b *chunkBitmap) missing(count int) []int {
+	missing := []int{}
+	for i := 0; i < count; i++ {
+		if !b.has(i) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// close releases the bitmap's file; the bitmap stays on disk for a later connection
+func (b *chunkBitmap) close() error {
+	if b.file == nil {
+		return nil
+	}
+	return b.file.Close()
+}
+
+// chunksFor returns how many chunks a file of size bytes is sent in; an empty file still sends one
+func chunksFor(size, chunkSize int64) int {
+	chunks := int((size + chunkSize - 1) / chunkSize)
+	if chunks < 1 {
+		chunks = 1
+	}
+	return chunks
+}
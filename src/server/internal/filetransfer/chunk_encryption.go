@@ -0,0 +1,205 @@
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrChunkEncryptionDisabled is returned for an encrypted chunk on a stream without encryption
+var ErrChunkEncryptionDisabled = errors.New("chunk encryption is not enabled")
+
+// ErrChunkNotEncrypted is returned for a plaintext chunk on a stream that requires encryption
+var ErrChunkNotEncrypted = errors.New("chunk is not encrypted")
+
+// sealedLengthSize is the length prefix of each slot in a file sealed at rest
+const sealedLengthSize = 4
+
+// SetEncryptor encrypts the chunks the stream sends with encryptor, and lets it decrypt the
+// chunks it receives encrypted
+func (fs *FileStream) SetEncryptor(encryptor *FileEncryptor) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.encryptor = encryptor
+}
+
+// sealOutgoing compresses and then encrypts a chunk for sending. Its checksum covers the bytes
+// actually sent, so with GCM's nonce and tag an encrypted chunk is gcmOverhead longer than its data.
+func (fs *FileStream) sealOutgoing(chunk FileChunk) (FileChunk, error) {
+	chunk = fs.compressOutgoing(chunk)
+
+	fs.mutex.RLock()
+	encryptor := fs.encryptor
+	fs.mutex.RUnlock()
+
+	if encryptor == nil || chunk.Encrypted {
+		return chunk, nil
+	}
+
+	ciphertext, err := encryptor.EncryptChunk(chunk.Data)
+	if err != nil {
+		return chunk, fmt.Errorf("failed to encrypt chunk %d: %v", chunk.Sequence, err)
+	}
+	chunk.Data = ciphertext
+	chunk.Encrypted = true
+	chunk.Checksum = fs.calculateChunkChecksum(ciphertext)
+	return chunk, nil
+}
+
+// openIncoming returns the file data of a received chunk, decrypting and then decompressing it as
+// it was sent. Verify the chunk's checksum first, it covers the bytes as sent.
+func (fs *FileStream) openIncoming(data []byte, encrypted, compressed bool) ([]byte, error) {
+	fs.mutex.RLock()
+	encryptor, limit := fs.encryptor, fs.chunkSize+gcmOverhead
+	fs.mutex.RUnlock()
+
+	// With encryption on, a chunk sent in the clear has been read by anyone on the way
+	if !encrypted && encryptor != nil {
+		return nil, ErrChunkNotEncrypted
+	}
+	if encrypted {
+		if encryptor == nil {
+			return nil, ErrChunkEncryptionDisabled
+		}
+		// Sent data is never longer than a chunk, so anything more isn't worth decrypting
+		if int64(len(data)) > limit {
+			return nil, fmt.Errorf("encrypted chunk is %d bytes, longer than the %d-byte chunk size allows", len(data), limit)
+		}
+
+		plaintext, err := encryptor.DecryptChunk(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt chunk: %v", err)
+		}
+		data = plaintext
+	}
+	return fs.decompressIncoming(data, compressed)
+}
+
+// SealStoredChunks has the stream encrypt each chunk it receives before writing it, so an upload
+// is never on disk in the clear. The file is laid out in slots of sealedSlotSize, each a 4-byte
+// length and the sealed chunk, so chunks can still arrive in any order.
+func (fs *FileStream) SealStoredChunks(encryptor *FileEncryptor) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.sealer = encryptor
+}
+
+// sealedSlotSize is the room a sealed chunk takes on disk
+func sealedSlotSize(chunkSize int64) int64 {
+	return sealedLengthSize + chunkSize + gcmOverhead
+}
+
+// sealStoredChunk encrypts a chunk into its length-prefixed slot contents
+func sealStoredChunk(encryptor *FileEncryptor, data []byte) ([]byte, error) {
+	sealed, err := encryptor.EncryptChunk(data)
+	if err != nil {
+		return nil, err
+	}
+	slot := make([]byte, sealedLengthSize, sealedLengthSize+len(sealed))
+	binary.BigEndian.PutUint32(slot, uint32(len(sealed)))
+	return append(slot, sealed...), nil
+}
+
+// readSealedFile decrypts a file stored by a sealing stream back into the data that was sent,
+// each chunk at its offset. A slot left empty reads as zeros, as a hole does in a plain file.
+func readSealedFile(path string, chunkSize int, encryptor *FileEncryptor) ([]byte, error) {
+	if chunkSize <= 0 {
+		chunkSize = ChunkSize
+	}
+	if encryptor == nil {
+		return nil, ErrChunkEncryptionDisabled
+	}
+
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	slotSize := sealedSlotSize(int64(chunkSize))
+	var plaintext []byte
+	for index, offset := 0, int64(0); offset+sealedLengthSize <= int64(len(stored)); index, offset = index+1, offset+slotSize {
+		length := int64(binary.BigEndian.Uint32(stored[offset:]))
+		if length == 0 {
+			continue
+		}
+		start := offset + sealedLengthSize
+		if length > int64(chunkSize)+gcmOverhead || start+length > int64(len(stored)) {
+			return nil, fmt.Errorf("sealed chunk %d is corrupt", index)
+		}
+
+		chunk, err := encryptor.DecryptChunk(stored[start : start+length])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt stored chunk %d: %v", index, err)
+		}
+		end := int64(index)*int64(chunkSize) + int64(len(chunk))
+		if end > int64(len(plaintext)) {
+			plaintext = append(plaintext, make([]byte, end-int64(len(plaintext)))...)
+		}
+		copy(plaintext[int64(index)*int64(chunkSize):], chunk)
+	}
+	return plaintext, nil
+}
+
+// storedFile is where a transfer's file is kept, and how to read it back
+type storedFile struct {
+	path      string
+	sealed    bool
+	chunkSize int
+}
+
+// storedFile describes the session's temp file. Caller must hold session.mutex.
+func (s *TransferSession) storedFile() storedFile {
+	return storedFile{path: s.TempPath, sealed: s.SealedAtRest, chunkSize: s.Request.ChunkSize}
+}
+
+// readStoredFile returns the data of a stored file as it was sent
+func (sm *SessionManager) readStoredFile(file storedFile) ([]byte, error) {
+	if !file.sealed {
+		return os.ReadFile(file.path)
+	}
+	return readSealedFile(file.path, file.chunkSize, sm.fileEncryptor)
+}
+
+// storedFileChecksum returns the SHA-256 of a stored file's data as it was sent
+func (sm *SessionManager) storedFileChecksum(file storedFile) (string, error) {
+	if !file.sealed {
+		return GenerateFileChecksum(file.path)
+	}
+	data, err := sm.readStoredFile(file)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// withPlainFile calls fn with the path of a stored file's data as it was sent, for scanners that
+// read files by path. A sealed file is decrypted to a private copy beside it for the call.
+func (sm *SessionManager) withPlainFile(file storedFile, fn func(path string) error) error {
+	if !file.sealed {
+		return fn(file.path)
+	}
+
+	data, err := sm.readStoredFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt stored file: %v", err)
+	}
+	plain, err := os.CreateTemp(filepath.Dir(file.path), "plain_*_"+filepath.Base(file.path))
+	if err != nil {
+		return fmt.Errorf("failed to create decrypted copy: %v", err)
+	}
+	defer os.Remove(plain.Name())
+
+	_, err = plain.Write(data)
+	if closeErr := plain.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write decrypted copy: %v", err)
+	}
+	return fn(plain.Name())
+}
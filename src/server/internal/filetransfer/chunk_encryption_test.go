@@ -0,0 +1,158 @@
+package filetransfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStream_EncryptedDownloadReassemblesToTheSource(t *testing.T) {
+	serverConn, clientConn := newTestConnPair(t)
+	encryptor := NewFileEncryptor(DefaultSecurityConfig().EncryptionKey)
+
+	content := make([]byte, 3*4096+1000)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "download.bin")
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	sender, err := NewFileStream("encrypted", path, false, serverConn, 4096)
+	require.NoError(t, err)
+	sender.SetEncryptor(encryptor)
+	receiver, err := NewFileStream("encrypted", filepath.Join(t.TempDir(), "received.bin"), true, nil, 4096)
+	require.NoError(t, err)
+	receiver.SetEncryptor(encryptor)
+
+	require.NoError(t, sender.StartDownload())
+	defer func() {
+		sender.Cancel()
+		sender.Wait(5 * time.Second)
+	}()
+
+	var reassembled []byte
+	for {
+		clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		messageType, message, err := clientConn.ReadMessage()
+		require.NoError(t, err)
+		if messageType != websocket.BinaryMessage {
+			continue // progress updates
+		}
+
+		chunk, err := receiver.parseChunk(message)
+		require.NoError(t, err)
+		require.True(t, chunk.Encrypted)
+		assert.True(t, receiver.verifyChunkChecksum(chunk), "the checksum covers the ciphertext sent")
+
+		// GCM adds a nonce and tag to each chunk, and nothing of the plaintext shows on the wire
+		plaintext := content[chunk.Sequence*4096 : min((chunk.Sequence+1)*4096, len(content))]
+		assert.Len(t, chunk.Data, len(plaintext)+gcmOverhead)
+		assert.False(t, bytes.Contains(chunk.Data, plaintext[:64]))
+
+		data, err := receiver.openIncoming(chunk.Data, chunk.Encrypted, chunk.Compressed)
+		require.NoError(t, err)
+		reassembled = append(reassembled, data...)
+		if chunk.IsLast {
+			break
+		}
+	}
+	assert.Equal(t, content, reassembled)
+}
+
+func TestWebSocketHandler_DecryptsEncryptedUploadChunks(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.ChunkSize = 4096
+	config.RequireApproval = false
+	config.RetainCompletedFiles = true
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	securityConfig.CompressionEnabled = true
+	wh := newTestWebSocketHandler(t, config, securityConfig)
+	sm := wh.GetSessionManager()
+	serverConn, _ := newTestConnPair(t)
+
+	content := append(bytes.Repeat([]byte("compressible "), 400), make([]byte, 2*4096)...)
+	_, err := rand.Read(content[len(content)-2*4096:])
+	require.NoError(t, err)
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: int64(len(content)),
+	}, serverConn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(session.ID, true, "Auto-approved"))
+
+	// The client compresses what it can, then encrypts every chunk
+	for index := 0; index*4096 < len(content); index++ {
+		plaintext := content[index*4096 : min((index+1)*4096, len(content))]
+		chunk := &FileTransferChunk{TransferID: session.ID, ChunkIndex: index, Data: plaintext}
+		if compressed, err := compressChunk(plaintext, 6); err == nil && len(compressed) < len(plaintext) {
+			chunk.Data, chunk.Compressed = compressed, true
+		}
+		chunk.Data, err = wh.fileEncryptor.EncryptChunk(chunk.Data)
+		require.NoError(t, err)
+		chunk.Encrypted = true
+		require.NoError(t, wh.handleFileChunk(serverConn, chunk))
+	}
+
+	status, _ := sm.GetTransferStatus(session.ID)
+	require.Equal(t, StatusCompleted, status)
+	// The upload stays encrypted on disk, and decrypts to the source byte for byte
+	stored, err := os.ReadFile(session.TempPath)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(stored, content[:64]))
+	assert.False(t, bytes.Contains(stored, content[len(content)-64:]))
+	received, err := sm.readStoredFile(session.storedFile())
+	require.NoError(t, err)
+	assert.Equal(t, content, received, "the reassembled file matches the source byte for byte")
+	checksum, err := sm.storedFileChecksum(session.storedFile())
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content)), checksum)
+
+	// Downloads serve the file as it was sent
+	rec := httptest.NewRecorder()
+	sm.ServeCompletedFile(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+session.ID+"/download", nil), session.ID)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.Bytes())
+	assert.Equal(t, checksum, rec.Header().Get(HeaderChecksumSHA256))
+
+	progress, err := sm.GetTransferProgress(session.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), progress.BytesTransferred, "progress counts file bytes, not ciphertext")
+
+	// A tampered chunk doesn't decrypt
+	otherConn, _ := newTestConnPair(t)
+	other, err := sm.CreateTransferSession(&FileTransferRequest{Type: TransferTypeUpload, Filename: "other.txt", FileSize: 10}, otherConn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(other.ID, true, "Auto-approved"))
+	sealed, err := wh.fileEncryptor.EncryptChunk([]byte("0123456789"))
+	require.NoError(t, err)
+	sealed[len(sealed)-1] ^= 0xff
+	assert.ErrorContains(t, wh.handleFileChunk(otherConn, &FileTransferChunk{TransferID: other.ID, Data: sealed, Encrypted: true}), "failed to decrypt")
+
+	// Nor is a chunk sent in the clear accepted while encryption is on
+	assert.ErrorIs(t, wh.handleFileChunk(otherConn, &FileTransferChunk{TransferID: other.ID, Data: []byte("0123456789")}), ErrChunkNotEncrypted)
+}
+
+func TestFileStream_RefusesEncryptedChunksWithoutAnEncryptor(t *testing.T) {
+	stream, err := NewFileStream("plain", filepath.Join(t.TempDir(), "received.bin"), true, nil, 4096)
+	require.NoError(t, err)
+
+	_, err = stream.openIncoming([]byte("sealed"), true, false)
+	assert.ErrorIs(t, err, ErrChunkEncryptionDisabled)
+
+	stream.SetEncryptor(NewFileEncryptor(DefaultSecurityConfig().EncryptionKey))
+	_, err = stream.openIncoming(make([]byte, 4096+gcmOverhead+1), true, false)
+	assert.ErrorContains(t, err, "longer than")
+}
@@ -0,0 +1,144 @@
+package filetransfer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Malware scanner backends selectable with scanner_type
+const (
+	ScannerHeuristic = "heuristic"
+	ScannerClamAV    = "clamav"
+)
+
+const (
+	// clamdChunkSize is how much of a file is sent in each INSTREAM chunk
+	clamdChunkSize = 64 * 1024
+
+	// clamdTimeout bounds a whole scan, connecting included
+	clamdTimeout = 2 * time.Minute
+)
+
+// NewMalwareScanner creates the scanner configured by scanner_type, the heuristic one by default
+func NewMalwareScanner(config *SecurityConfig) (MalwareScanner, error) {
+	switch strings.ToLower(config.ScannerType) {
+	case "", ScannerHeuristic:
+		return heuristicScanner{}, nil
+	case ScannerClamAV:
+		if config.ScannerAddress == "" {
+			return nil, fmt.Errorf("the clamav scanner needs a scanner_address")
+		}
+		return NewClamAVScanner(config.ScannerAddress), nil
+	default:
+		return nil, fmt.Errorf("unknown scanner type: %s", config.ScannerType)
+	}
+}
+
+// ClamAVScanner scans files with a clamd daemon, streaming them to it with the INSTREAM command
+type ClamAVScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamAVScanner creates a scanner for the clamd listening at address: a unix socket path, or
+// host:port for TCP. Either may be prefixed with unix:// or tcp://.
+func NewClamAVScanner(address string) *ClamAVScanner {
+	network := "tcp"
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		network, address = "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		network = "unix"
+	}
+
+	return &ClamAVScanner{
+		network: network,
+		address: address,
+		timeout: clamdTimeout,
+	}
+}
+
+// Name identifies the scanner in capability reports
+func (s *ClamAVScanner) Name() string {
+	return ScannerClamAV
+}
+
+// Scan streams the file to clamd and reports what it found
+func (s *ClamAVScanner) Scan(filePath string) (*MalwareScanResult, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("failed to send INSTREAM to clamd: %v", err)
+	}
+
+	// Each chunk is prefixed with its length, and a zero length ends the stream
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := file.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return nil, fmt.Errorf("failed to stream file to clamd: %v", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read file: %v", readErr)
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, fmt.Errorf("failed to stream file to clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return nil, fmt.Errorf("failed to read clamd reply: %v", err)
+	}
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply interprets clamd's answer to INSTREAM: "stream: OK", "stream: <signature> FOUND",
+// or an error such as "INSTREAM size limit exceeded. ERROR"
+func parseClamdReply(reply string) (*MalwareScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case result == "OK":
+		return &MalwareScanResult{
+			Clean:   true,
+			Details: "No threats detected",
+			Scanner: ScannerClamAV,
+		}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &MalwareScanResult{
+			Clean:   false,
+			Details: strings.TrimSuffix(result, " FOUND"),
+			Scanner: ScannerClamAV,
+		}, nil
+	default:
+		return nil, fmt.Errorf("clamd: %s", reply)
+	}
+}
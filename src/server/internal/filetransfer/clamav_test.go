@@ -0,0 +1,175 @@
+package filetransfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eicar is the EICAR antivirus test file, which every scanner detects
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// eicarScanner flags files containing the EICAR test string
+type eicarScanner struct{}
+
+func (eicarScanner) Scan(filePath string) (*MalwareScanResult, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(data, []byte(eicar)) {
+		return &MalwareScanResult{Clean: false, Details: "Eicar-Test-Signature", Scanner: "eicar"}, nil
+	}
+	return &MalwareScanResult{Clean: true, Details: "No threats detected", Scanner: "eicar"}, nil
+}
+
+// newFakeClamd serves INSTREAM scans like clamd, flagging streams containing the EICAR string
+func newFakeClamd(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				command, err := reader.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var stream bytes.Buffer
+				for {
+					var length uint32
+					if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+						return
+					}
+					if length == 0 {
+						break
+					}
+					if _, err := io.CopyN(&stream, reader, int64(length)); err != nil {
+						return
+					}
+				}
+
+				if bytes.Contains(stream.Bytes(), []byte(eicar)) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestFileValidator_QuarantinesFilesTheScannerFlags(t *testing.T) {
+	config := DefaultSecurityConfig()
+	config.ScanForMalware = true
+	config.RequireChecksum = false
+	config.QuarantineDir = t.TempDir()
+	config.AllowedMimeTypes = nil // only the scan decides here
+	fv := NewFileValidator(config)
+	fv.auditLogger.Stop()
+	fv.auditLogger = NewAuditLogger(t.TempDir(), true)
+	fv.SetMalwareScanner(eicarScanner{})
+
+	dir := t.TempDir()
+	clean := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(clean, []byte("meeting notes"), 0644))
+	infected := filepath.Join(dir, "eicar.txt")
+	require.NoError(t, os.WriteFile(infected, []byte(eicar), 0644))
+
+	result, err := fv.ValidateFile(clean, "notes.txt")
+	require.NoError(t, err)
+	assert.True(t, result.Valid)
+	assert.FileExists(t, clean)
+
+	result, err = fv.ValidateFile(infected, "eicar.txt")
+	require.NoError(t, err)
+	assert.False(t, result.Valid)
+	assert.True(t, result.Quarantined)
+	assert.Equal(t, "Eicar-Test-Signature", result.ScanResults)
+	assert.NoFileExists(t, infected)
+	quarantined, err := filepath.Glob(filepath.Join(config.QuarantineDir, "*_eicar.txt"))
+	require.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+
+	var quarantineEvents []AuditEvent
+	for _, event := range readAuditEvents(t, fv.auditLogger) {
+		if event.EventType == AuditEventFileQuarantined {
+			quarantineEvents = append(quarantineEvents, event)
+		}
+	}
+	require.Len(t, quarantineEvents, 1)
+	assert.Equal(t, "Eicar-Test-Signature", quarantineEvents[0].Details["scan_results"])
+}
+
+func TestClamAVScanner_StreamsFilesToClamd(t *testing.T) {
+	scanner, err := NewMalwareScanner(&SecurityConfig{ScannerType: "ClamAV", ScannerAddress: "tcp://" + newFakeClamd(t)})
+	require.NoError(t, err)
+	assert.Equal(t, ScannerClamAV, scanner.(*ClamAVScanner).Name())
+
+	dir := t.TempDir()
+	// Larger than one INSTREAM chunk, with the signature straddling the chunk boundary
+	infected := append(bytes.Repeat([]byte("a"), clamdChunkSize-10), []byte(eicar)...)
+	infectedPath := filepath.Join(dir, "infected.bin")
+	require.NoError(t, os.WriteFile(infectedPath, infected, 0644))
+	cleanPath := filepath.Join(dir, "clean.bin")
+	require.NoError(t, os.WriteFile(cleanPath, bytes.Repeat([]byte("b"), 3*clamdChunkSize), 0644))
+
+	result, err := scanner.Scan(infectedPath)
+	require.NoError(t, err)
+	assert.False(t, result.Clean)
+	assert.Equal(t, "Eicar-Test-Signature", result.Details)
+	assert.Equal(t, ScannerClamAV, result.Scanner)
+
+	result, err = scanner.Scan(cleanPath)
+	require.NoError(t, err)
+	assert.True(t, result.Clean)
+
+	_, err = NewClamAVScanner("127.0.0.1:1").Scan(cleanPath)
+	assert.ErrorContains(t, err, "failed to connect to clamd")
+
+	_, err = parseClamdReply("INSTREAM size limit exceeded. ERROR\x00")
+	assert.ErrorContains(t, err, "size limit exceeded")
+}
+
+func TestNewMalwareScanner_RejectsIncompleteConfig(t *testing.T) {
+	scanner, err := NewMalwareScanner(&SecurityConfig{})
+	require.NoError(t, err)
+	assert.IsType(t, heuristicScanner{}, scanner)
+
+	assert.Equal(t, "unix", NewClamAVScanner("/var/run/clamav/clamd.ctl").network)
+
+	_, err = NewMalwareScanner(&SecurityConfig{ScannerType: ScannerClamAV})
+	assert.ErrorContains(t, err, "scanner_address")
+	_, err = NewMalwareScanner(&SecurityConfig{ScannerType: "sophos"})
+	assert.ErrorContains(t, err, "unknown scanner type")
+
+	// Scanning mustn't silently fall back to the heuristic scanner
+	config := DefaultTransferConfig()
+	config.TempDir = t.TempDir()
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.QuarantineDir = t.TempDir()
+	securityConfig.ScanForMalware = true
+	securityConfig.ScannerType = ScannerClamAV
+	assert.ErrorContains(t, SelfTest(config, securityConfig, nil), "malware scanner")
+}
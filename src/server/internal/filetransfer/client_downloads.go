@@ -0,0 +1,120 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Errors returned by the client download restriction
+var (
+	ErrClientDownloadsDisabled = errors.New("downloads from the client are disabled")
+	ErrJustificationRequired   = errors.New("a justification is required to allow downloads from the client")
+)
+
+// ClientDownloadGrant is a per-session exception to the AllowClientDownloads default
+type ClientDownloadGrant struct {
+	SessionID     string    `json:"session_id"`
+	GrantedBy     string    `json:"granted_by"`
+	Justification string    `json:"justification"`
+	GrantedAt     time.Time `json:"granted_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// GrantClientDownloads lets a session pull files from the client while they are disabled by default,
+// for the configured grant duration. The justification is required and recorded in the audit log.
+func (sm *SessionManager) GrantClientDownloads(sessionID, grantedBy, justification string) (*ClientDownloadGrant, error) {
+	justification = strings.TrimSpace(justification)
+	if justification == "" {
+		return nil, ErrJustificationRequired
+	}
+	if err := ValidateSessionID(sessionID); err != nil {
+		return nil, err
+	}
+
+	sm.mutex.Lock()
+	now := sm.clock.Now().UTC()
+	grant := &ClientDownloadGrant{
+		SessionID:     sessionID,
+		GrantedBy:     grantedBy,
+		Justification: justification,
+		GrantedAt:     now,
+		ExpiresAt:     now.Add(sm.config.GetClientDownloadGrantDuration()),
+	}
+	sm.downloadGrants[sessionID] = grant
+	sm.mutex.Unlock()
+
+	sm.auditLogger.LogEvent(&AuditEvent{
+		EventType: AuditEventClientDownloadsGranted,
+		SessionID: sessionID,
+		UserID:    grantedBy,
+		Success:   true,
+		Details: map[string]interface{}{
+			"justification": justification,
+			"expires_at":    grant.ExpiresAt,
+		},
+	})
+	return grant, nil
+}
+
+// RevokeClientDownloads removes a session's exception, returning false if it had none
+func (sm *SessionManager) RevokeClientDownloads(sessionID, revokedBy string) bool {
+	sm.mutex.Lock()
+	_, exists := sm.downloadGrants[sessionID]
+	delete(sm.downloadGrants, sessionID)
+	sm.mutex.Unlock()
+
+	if exists {
+		sm.auditLogger.LogEvent(&AuditEvent{
+			EventType: AuditEventClientDownloadsRevoked,
+			SessionID: sessionID,
+			UserID:    revokedBy,
+			Success:   true,
+		})
+	}
+	return exists
+}
+
+// GetClientDownloadGrant returns the session's exception, if it has one
+func (sm *SessionManager) GetClientDownloadGrant(sessionID string) (*ClientDownloadGrant, bool) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	grant, exists := sm.downloadGrants[sessionID]
+	return grant, exists
+}
+
+// checkClientDownload refuses downloads from the client unless enabled globally or granted to the session.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) checkClientDownload(request *FileTransferRequest) error {
+	if request.Type != TransferTypeDownload || sm.config.AllowClientDownloads {
+		return nil
+	}
+	// An expired grant no longer counts, even before the cleanup sweep drops it
+	if grant, granted := sm.downloadGrants[request.SessionID]; granted && request.SessionID != "" && !sm.clock.Now().After(grant.ExpiresAt) {
+		return nil
+	}
+	return fmt.Errorf("%w for session %s", ErrClientDownloadsDisabled, request.SessionID)
+}
+
+// expireClientDownloadGrants drops the grants past their expiry. Caller must hold sm.mutex.
+func (sm *SessionManager) expireClientDownloadGrants() {
+	now := sm.clock.Now()
+	for sessionID, grant := range sm.downloadGrants {
+		if !now.After(grant.ExpiresAt) {
+			continue
+		}
+		delete(sm.downloadGrants, sessionID)
+		sm.auditLogger.LogEvent(&AuditEvent{
+			EventType: AuditEventClientDownloadsExpired,
+			SessionID: sessionID,
+			UserID:    grant.GrantedBy,
+			Success:   true,
+			Details: map[string]interface{}{
+				"granted_at": grant.GrantedAt,
+				"expires_at": grant.ExpiresAt,
+			},
+		})
+	}
+}
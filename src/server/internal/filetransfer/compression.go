@@ -0,0 +1,115 @@
+package filetransfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// CompressionGzip is the gzip compression_algorithm, the one chunks can be compressed with
+const CompressionGzip = "gzip"
+
+// ErrUnsupportedCompression is returned for a compression algorithm the server doesn't implement,
+// or a compressed chunk when compression is disabled
+var ErrUnsupportedCompression = errors.New("unsupported chunk compression")
+
+// validateCompression checks that chunks can be compressed with algorithm at level
+func validateCompression(algorithm string, level int) error {
+	if algorithm != "" && !strings.EqualFold(algorithm, CompressionGzip) {
+		return fmt.Errorf("%w: %s", ErrUnsupportedCompression, algorithm)
+	}
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("compression level must be between %d and %d", gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	return nil
+}
+
+// compressChunk gzips a chunk's data at level
+func compressChunk(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress chunk: %v", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress chunk: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress chunk: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressChunk gunzips a chunk's data, refusing to expand it past limit bytes
+func decompressChunk(data []byte, limit int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk: %v", err)
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk: %v", err)
+	}
+	if int64(len(decompressed)) > limit {
+		return nil, fmt.Errorf("decompressed chunk is larger than the %d-byte chunk size", limit)
+	}
+	return decompressed, nil
+}
+
+// SetCompression gzips the chunks the stream sends at level, when that makes them smaller, and
+// lets it accept compressed chunks
+func (fs *FileStream) SetCompression(level int) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.compress = true
+	fs.compressLevel = level
+}
+
+// compressOutgoing replaces a chunk's data with its gzip when that is smaller. The checksum then
+// covers the compressed bytes actually sent; incompressible chunks go as they are.
+func (fs *FileStream) compressOutgoing(chunk FileChunk) FileChunk {
+	fs.mutex.RLock()
+	enabled, level := fs.compress, fs.compressLevel
+	fs.mutex.RUnlock()
+
+	if !enabled || chunk.Compressed {
+		return chunk
+	}
+
+	compressed, err := compressChunk(chunk.Data, level)
+	if err != nil {
+		log.Printf("Sending chunk %d uncompressed: %v", chunk.Sequence, err)
+		return chunk
+	}
+	if len(compressed) >= len(chunk.Data) {
+		return chunk
+	}
+
+	chunk.Data = compressed
+	chunk.Compressed = true
+	chunk.Checksum = fs.calculateChunkChecksum(compressed)
+	return chunk
+}
+
+// decompressIncoming returns the file data of a received chunk, decompressing it if it was sent
+// compressed. Verify the chunk's checksum first, it covers the bytes as sent.
+func (fs *FileStream) decompressIncoming(data []byte, compressed bool) ([]byte, error) {
+	if !compressed {
+		return data, nil
+	}
+
+	fs.mutex.RLock()
+	enabled, limit := fs.compress, fs.chunkSize
+	fs.mutex.RUnlock()
+
+	if !enabled {
+		return nil, fmt.Errorf("%w: compression is not enabled", ErrUnsupportedCompression)
+	}
+	return decompressChunk(data, limit)
+}
@@ -0,0 +1,89 @@
+package filetransfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStream_CompressesChunksOnlyWhenItHelps(t *testing.T) {
+	server, client := newTestConnPair(t)
+
+	sender, err := NewFileStream("send", filepath.Join(t.TempDir(), "sent"), true, server, 8192)
+	require.NoError(t, err)
+	sender.SetCompression(6)
+	receiver, err := NewFileStream("receive", filepath.Join(t.TempDir(), "received"), true, nil, 8192)
+	require.NoError(t, err)
+	receiver.SetCompression(6)
+
+	compressible := bytes.Repeat([]byte("2026-10-16 12:00:00 INFO transfer chunk written\n"), 150)
+	incompressible := make([]byte, 8192)
+	_, err = rand.Read(incompressible)
+	require.NoError(t, err)
+
+	for i, tc := range []struct {
+		name       string
+		data       []byte
+		compressed bool
+	}{
+		{"compressible", compressible, true},
+		{"incompressible", incompressible, false},
+	} {
+		require.NoError(t, sender.sendChunk(FileChunk{
+			ID:       "send",
+			Sequence: i,
+			Data:     tc.data,
+			Size:     len(tc.data),
+			Checksum: sender.calculateChunkChecksum(tc.data),
+		}))
+
+		messageType, message, err := client.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, websocket.BinaryMessage, messageType)
+
+		chunk, err := receiver.parseChunk(message)
+		require.NoError(t, err)
+		assert.Equal(t, tc.compressed, chunk.Compressed, tc.name)
+		assert.True(t, receiver.verifyChunkChecksum(chunk), "%s: the checksum covers the bytes sent", tc.name)
+		if tc.compressed {
+			assert.Less(t, len(chunk.Data), len(tc.data)/10, tc.name)
+		} else {
+			assert.Len(t, chunk.Data, len(tc.data), tc.name)
+		}
+
+		data, err := receiver.decompressIncoming(chunk.Data, chunk.Compressed)
+		require.NoError(t, err)
+		assert.Equal(t, tc.data, data, tc.name)
+	}
+}
+
+func TestFileStream_RefusesUnexpectedOrOversizedCompressedChunks(t *testing.T) {
+	compressed, err := compressChunk(make([]byte, 64*1024), 6)
+	require.NoError(t, err)
+
+	receiver, err := NewFileStream("receive", filepath.Join(t.TempDir(), "received"), true, nil, 8192)
+	require.NoError(t, err)
+
+	_, err = receiver.decompressIncoming(compressed, true)
+	assert.ErrorIs(t, err, ErrUnsupportedCompression, "compression is off for this stream")
+
+	// A small chunk mustn't expand past the chunk size
+	receiver.SetCompression(6)
+	_, err = receiver.decompressIncoming(compressed, true)
+	assert.ErrorContains(t, err, "larger than the 8192-byte chunk size")
+
+	_, err = receiver.decompressIncoming([]byte("not gzip"), true)
+	assert.Error(t, err)
+}
+
+func TestValidateCompression(t *testing.T) {
+	assert.NoError(t, validateCompression("", 6))
+	assert.NoError(t, validateCompression("GZIP", 9))
+	assert.ErrorIs(t, validateCompression("zstd", 3), ErrUnsupportedCompression)
+	assert.Error(t, validateCompression(CompressionGzip, 12))
+}
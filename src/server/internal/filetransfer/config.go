@@ -8,6 +8,8 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/redact"
 )
 
 // ConfigManager handles dynamic configuration updates
@@ -38,6 +40,9 @@ func NewConfigManager(configFile string) *ConfigManager {
 			log.Printf("Failed to save default config: %v", err)
 		}
 	}
+	if cm.securityConfig != nil {
+		cm.auditLogger.SetMask(cm.securityConfig.AuditMaskedFields, cm.securityConfig.AuditMaskMode)
+	}
 	
 	return cm
 }
@@ -86,7 +91,7 @@ func (cm *ConfigManager) SaveConfig() error {
 	}{
 		Transfer: cm.transferConfig,
 		Security: cm.securityConfig,
-		Updated:  time.Now(),
+		Updated:  time.Now().UTC(),
 	}
 	
 	data, err := json.MarshalIndent(config, "", "  ")
@@ -222,15 +227,65 @@ func (cm *ConfigManager) validateTransferConfig(config *TransferConfig) error {
 	if config.ChunkSize > 10*1024*1024 { // 10MB max chunk
 		return fmt.Errorf("chunk size cannot exceed 10MB")
 	}
+	if config.DownloadWindow < 0 {
+		return fmt.Errorf("download window cannot be negative")
+	}
+	if config.RateLimit < 0 || config.GlobalRateLimit < 0 {
+		return fmt.Errorf("rate limits cannot be negative")
+	}
+	if config.ProgressWorkers < 0 {
+		return fmt.Errorf("progress workers cannot be negative")
+	}
+	if config.MinChunkSize < 0 || config.MaxChunkSize < 0 {
+		return fmt.Errorf("chunk size bounds cannot be negative")
+	}
+	if config.MinChunkSize > 0 && config.MaxChunkSize > 0 {
+		if config.MinChunkSize > config.MaxChunkSize {
+			return fmt.Errorf("min chunk size cannot exceed max chunk size")
+		}
+		if config.MaxChunkSize > 10*1024*1024 {
+			return fmt.Errorf("max chunk size cannot exceed 10MB")
+		}
+	}
 	if config.TransferTimeout <= 0 {
 		return fmt.Errorf("transfer timeout must be positive")
 	}
 	if config.RetryAttempts < 0 {
 		return fmt.Errorf("retry attempts cannot be negative")
 	}
+	if config.ApprovalSizeThreshold < 0 {
+		return fmt.Errorf("approval size threshold cannot be negative")
+	}
+	if config.ReadIdleTimeout < 0 {
+		return fmt.Errorf("read idle timeout cannot be negative")
+	}
+	if config.MinUploadBandwidth < 0 {
+		return fmt.Errorf("min upload bandwidth cannot be negative")
+	}
+	if config.ApprovalGracePeriod < 0 {
+		return fmt.Errorf("approval grace period cannot be negative")
+	}
+	if config.DetachedUploadTimeout < 0 {
+		return fmt.Errorf("detached upload timeout cannot be negative")
+	}
+	if config.ClientDownloadGrantDuration < 0 {
+		return fmt.Errorf("client download grant duration cannot be negative")
+	}
+	if config.InactivityPromptInterval < 0 || config.InactivityPromptTimeout < 0 {
+		return fmt.Errorf("inactivity prompt interval and timeout cannot be negative")
+	}
+	if config.CompletedRetention < 0 {
+		return fmt.Errorf("completed retention cannot be negative")
+	}
+	if config.MaxMetadataEntries < 0 || config.MaxMetadataValueLength < 0 {
+		return fmt.Errorf("metadata limits cannot be negative")
+	}
 	if config.RetryAttempts > 10 {
 		return fmt.Errorf("retry attempts cannot exceed 10")
 	}
+	if err := validateCompression(config.CompressionAlgorithm, config.CompressionLevel); err != nil {
+		return err
+	}
 	
 	return nil
 }
@@ -249,6 +304,15 @@ func (cm *ConfigManager) validateSecurityConfig(config *SecurityConfig) error {
 	if config.QuarantineDir == "" {
 		return fmt.Errorf("quarantine directory cannot be empty")
 	}
+	if config.MaxConcurrentCrypto < 0 {
+		return fmt.Errorf("max concurrent crypto cannot be negative")
+	}
+	if _, err := NewMalwareScanner(config); err != nil {
+		return err
+	}
+	if err := redact.ValidateMode(config.AuditMaskMode); err != nil {
+		return fmt.Errorf("audit_mask_mode: %v", err)
+	}
 	
 	return nil
 }
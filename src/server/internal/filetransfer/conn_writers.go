@@ -0,0 +1,46 @@
+package filetransfer
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// connWriters hands out one write mutex per connection, so the handler's responses and every file
+// stream on a connection take turns; gorilla allows only one concurrent writer
+type connWriters struct {
+	mutexes map[*websocket.Conn]*sync.Mutex
+	mutex   sync.Mutex
+}
+
+// get returns the connection's write mutex, creating it on first use. A nil connection gets a
+// mutex of its own, there's nothing to share.
+func (cw *connWriters) get(conn *websocket.Conn) *sync.Mutex {
+	if conn == nil {
+		return &sync.Mutex{}
+	}
+
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	if cw.mutexes == nil {
+		cw.mutexes = make(map[*websocket.Conn]*sync.Mutex)
+	}
+	writer, exists := cw.mutexes[conn]
+	if !exists {
+		writer = &sync.Mutex{}
+		cw.mutexes[conn] = writer
+	}
+	return writer
+}
+
+// release forgets a closed connection's write mutex
+func (cw *connWriters) release(conn *websocket.Conn) {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	delete(cw.mutexes, conn)
+}
+
+// connWriteMutex returns the mutex serializing writes to conn
+func (sm *SessionManager) connWriteMutex(conn *websocket.Conn) *sync.Mutex {
+	return sm.writers.get(conn)
+}
@@ -0,0 +1,327 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// ErrInvalidManifest is returned for a directory transfer whose manifest is empty or lists
+// unsafe, duplicate or conflicting paths
+var ErrInvalidManifest = errors.New("invalid directory manifest")
+
+// ManifestEntry describes one file of a directory transfer
+type ManifestEntry struct {
+	Path       string `json:"path"` // relative to the directory, '/' separated
+	Size       int64  `json:"size"`
+	Checksum   string `json:"checksum,omitempty"`
+	TransferID string `json:"transfer_id,omitempty"` // assigned by the server; the file's chunks are sent under it
+}
+
+// childTransferID is the transfer ID of the index'th file of a directory transfer
+func childTransferID(parentID string, index int) string {
+	return fmt.Sprintf("%s-%d", parentID, index)
+}
+
+// validateManifest checks each file of a directory transfer against the transfer policy and sets
+// the request's size to their total, so the directory as a whole is held to MaxFileSize.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) validateManifest(request *FileTransferRequest) error {
+	if len(request.Manifest) == 0 {
+		return fmt.Errorf("%w: a directory transfer must list at least one file", ErrInvalidManifest)
+	}
+
+	files := make(map[string]bool, len(request.Manifest))
+	dirs := make(map[string]bool)
+	var total int64
+	for i := range request.Manifest {
+		entry := &request.Manifest[i]
+
+		// Entries become paths under the temp directory, so only plain relative paths are allowed
+		local := filepath.FromSlash(entry.Path)
+		if !filepath.IsLocal(local) {
+			return fmt.Errorf("%w: %q is not a relative path within the directory", ErrInvalidManifest, entry.Path)
+		}
+		entry.Path = filepath.ToSlash(filepath.Clean(local))
+		if files[entry.Path] || dirs[entry.Path] {
+			return fmt.Errorf("%w: %q is listed more than once", ErrInvalidManifest, entry.Path)
+		}
+		for dir := path.Dir(entry.Path); dir != "."; dir = path.Dir(dir) {
+			if files[dir] {
+				return fmt.Errorf("%w: %q is both a file and a directory", ErrInvalidManifest, dir)
+			}
+			dirs[dir] = true
+		}
+		files[entry.Path] = true
+
+		if entry.Size < 0 {
+			return fmt.Errorf("%w: %q has a negative size", ErrInvalidManifest, entry.Path)
+		}
+		// Checked entry by entry, so sizes near the int64 limit can't wrap the total around
+		if entry.Size > sm.config.MaxFileSize || total > sm.config.MaxFileSize-entry.Size {
+			return fmt.Errorf("%w: the directory passes %d bytes at %q", ErrFileTooLarge, sm.config.MaxFileSize, entry.Path)
+		}
+		if !sm.config.isAllowedType(entry.Path) {
+			return fmt.Errorf("%w: %s (%s)", ErrTypeNotAllowed, filepath.Ext(entry.Path), entry.Path)
+		}
+		if err := sm.validateChecksumRequest(&FileTransferRequest{Checksum: entry.Checksum, ChecksumAlgorithm: request.ChecksumAlgorithm}); err != nil {
+			sm.auditLogger.LogSecurityViolation(request.ID, request.SessionID, entry.Path, err.Error(), "")
+			return fmt.Errorf("%s: %w", entry.Path, err)
+		}
+		total += entry.Size
+	}
+
+	request.FileSize = total
+	return nil
+}
+
+// newDirectoryChildren creates a pending upload session for each file of a directory transfer,
+// recording its transfer ID in the manifest. Caller must hold sm.mutex.
+func (sm *SessionManager) newDirectoryChildren(parent *TransferSession) ([]*TransferSession, error) {
+	request := parent.Request
+	children := make([]*TransferSession, 0, len(request.Manifest))
+	for i := range request.Manifest {
+		entry := &request.Manifest[i]
+		childID := childTransferID(request.ID, i)
+		if err := ValidateTransferID(childID); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+		}
+		if _, exists := sm.sessions[childID]; exists {
+			return nil, fmt.Errorf("transfer %s already exists", childID)
+		}
+		entry.TransferID = childID
+
+		children = append(children, &TransferSession{
+			ID: childID,
+			Request: &FileTransferRequest{
+				ID:                childID,
+				SessionID:         request.SessionID,
+				Type:              TransferTypeUpload,
+				Filename:          path.Base(entry.Path),
+				FileSize:          entry.Size,
+				Checksum:          entry.Checksum,
+				ChecksumAlgorithm: request.ChecksumAlgorithm,
+				Timestamp:         request.Timestamp,
+				Technician:        request.Technician,
+				Owner:             request.Owner,
+				ChunkSize:         request.ChunkSize,
+				Metadata:          request.Metadata,
+			},
+			Status:         StatusPending,
+			StartTime:      parent.StartTime,
+			ReceivedChunks: make(map[int]bool),
+			ClientConn:     parent.ClientConn,
+			PortalConn:     parent.PortalConn,
+			ParentID:       parent.ID,
+		})
+		parent.Children = append(parent.Children, childID)
+	}
+	return children, nil
+}
+
+// approveDirectory creates the directory under TempDir and starts an upload for each of its
+// files. Empty files are written straight away. Caller must hold sm.mutex and session.mutex.
+func (sm *SessionManager) approveDirectory(session *TransferSession) error {
+	session.TempPath = filepath.Join(sm.config.TempDir, "transfer_"+session.ID)
+	if err := os.MkdirAll(session.TempPath, 0755); err != nil {
+		return fmt.Errorf("failed to create transfer directory: %v", err)
+	}
+
+	for i, childID := range session.Children {
+		child, exists := sm.sessions[childID]
+		if !exists {
+			return fmt.Errorf("transfer session %w: %s", ErrNotFound, childID)
+		}
+		child.mutex.Lock()
+		err := sm.startDirectoryChild(child, filepath.Join(session.TempPath, filepath.FromSlash(session.Request.Manifest[i].Path)), *session.ApprovedAt)
+		child.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startDirectoryChild starts the upload of one file of an approved directory transfer.
+// Caller must hold sm.mutex and child.mutex.
+func (sm *SessionManager) startDirectoryChild(child *TransferSession, tempPath string, approvedAt time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(tempPath), 0755); err != nil {
+		return fmt.Errorf("failed to create transfer directory: %v", err)
+	}
+	child.Status = StatusApproved
+	child.ApprovedAt = &approvedAt
+	child.TempPath = tempPath
+
+	// There's nothing to send for an empty file
+	if child.Request.FileSize == 0 {
+		file, err := os.Create(tempPath)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", child.Request.Filename, err)
+		}
+		file.Close()
+		child.Status = StatusCompleted
+		child.EndTime = &approvedAt
+		return nil
+	}
+
+	fileStream, err := sm.newTransferStream(child, child.ClientConn, false)
+	if err != nil {
+		return err
+	}
+	sm.fileStreams[child.ID] = fileStream
+	if err := fileStream.StartUpload(); err != nil {
+		return fmt.Errorf("failed to start upload of %s: %v", child.Request.Filename, err)
+	}
+	return nil
+}
+
+// endDirectoryChildren stops the unfinished files of a directory transfer with status.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) endDirectoryChildren(parent *TransferSession, status TransferStatus) {
+	for _, childID := range parent.Children {
+		if fileStream, exists := sm.fileStreams[childID]; exists {
+			fileStream.Cancel()
+			delete(sm.fileStreams, childID)
+		}
+
+		child, exists := sm.sessions[childID]
+		if !exists {
+			continue
+		}
+		child.mutex.Lock()
+		if !child.Status.IsTerminal() {
+			child.Status = status
+			now := sm.clock.Now().UTC()
+			child.EndTime = &now
+		}
+		child.mutex.Unlock()
+	}
+}
+
+// settleDirectory finishes a directory transfer once all of its files have: it completes when
+// every file did and fails otherwise. Caller must hold sm.mutex.
+func (sm *SessionManager) settleDirectory(parentID string) {
+	parent, exists := sm.sessions[parentID]
+	if !exists {
+		return
+	}
+
+	parent.mutex.Lock()
+	defer parent.mutex.Unlock()
+
+	if parent.Status.IsTerminal() {
+		return
+	}
+
+	var failed []string
+	for i, childID := range parent.Children {
+		child, exists := sm.sessions[childID]
+		if !exists {
+			failed = append(failed, parent.Request.Manifest[i].Path)
+			continue
+		}
+		child.mutex.RLock()
+		status := child.Status
+		child.mutex.RUnlock()
+
+		if !status.IsTerminal() {
+			return
+		}
+		if status != StatusCompleted {
+			failed = append(failed, parent.Request.Manifest[i].Path)
+		}
+	}
+
+	now := sm.clock.Now().UTC()
+	parent.EndTime = &now
+	details := map[string]interface{}{
+		"filename":      parent.Request.Filename,
+		"file_size":     parent.Request.FileSize,
+		"transfer_type": parent.Request.Type,
+		"technician":    parent.Request.Technician,
+		"duration":      sm.clock.Now().Sub(parent.StartTime).String(),
+		"file_count":    len(parent.Children),
+	}
+
+	if len(failed) > 0 {
+		parent.Status = StatusFailed
+		details["error_message"] = fmt.Sprintf("%d of %d files failed", len(failed), len(parent.Children))
+		details["failed_files"] = failed
+		sm.logTransferEvent(parent, AuditEventTransferFailed, details)
+		if sm.metrics != nil {
+			sm.metrics.TransferFailed(parent.Request.Type, 0, FailureFilesFailed)
+		}
+		log.Printf("Directory transfer failed: %s - %d of %d files failed", parentID, len(failed), len(parent.Children))
+		return
+	}
+
+	parent.Status = StatusCompleted
+	parent.Progress = &FileTransferProgress{
+		ID:               parentID,
+		BytesTransferred: parent.Request.FileSize,
+		TotalBytes:       parent.Request.FileSize,
+		Percentage:       100,
+	}
+	details["bytes_transferred"] = parent.Request.FileSize
+	sm.logTransferEvent(parent, AuditEventTransferCompleted, details)
+	// Its files have each counted their own bytes
+	if sm.metrics != nil {
+		sm.metrics.TransferCompleted(parent.Request.Type, 0)
+	}
+	log.Printf("Directory transfer completed successfully: %s", parentID)
+
+	// The files were removed as they completed; without retention the directory goes too
+	if !sm.config.RetainCompletedFiles && parent.TempPath != "" {
+		if err := os.RemoveAll(parent.TempPath); err != nil {
+			log.Printf("Error removing completed directory: %v", err)
+		}
+		parent.TempPath = ""
+	}
+}
+
+// failDirectory fails a directory transfer, stopping its unfinished files
+func (sm *SessionManager) failDirectory(transferID string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if parent, exists := sm.sessions[transferID]; exists {
+		sm.endDirectoryChildren(parent, StatusFailed)
+		sm.settleDirectory(transferID)
+	}
+}
+
+// directoryProgress combines the progress of a directory transfer's files
+func (sm *SessionManager) directoryProgress(session *TransferSession) *FileTransferProgress {
+	session.mutex.RLock()
+	status := session.Status
+	total := session.Request.FileSize
+	children := session.Children
+	session.mutex.RUnlock()
+
+	progress := &FileTransferProgress{ID: session.ID, TotalBytes: total}
+	if status == StatusCompleted {
+		progress.BytesTransferred = total
+		progress.Percentage = 100
+		return progress
+	}
+
+	for _, childID := range children {
+		childProgress, err := sm.GetTransferProgress(childID)
+		if err != nil {
+			continue
+		}
+		progress.BytesTransferred += childProgress.BytesTransferred
+		progress.Speed += childProgress.Speed
+	}
+	if total > 0 {
+		progress.Percentage = float64(progress.BytesTransferred) / float64(total) * 100
+	}
+	if progress.Speed > 0 {
+		progress.ETA = (total - progress.BytesTransferred) / progress.Speed
+	}
+	return progress
+}
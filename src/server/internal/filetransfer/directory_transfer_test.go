@@ -0,0 +1,151 @@
+package filetransfer
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDirectoryRequest(manifest ...ManifestEntry) *FileTransferRequest {
+	return &FileTransferRequest{
+		Type:     TransferTypeDirectory,
+		Filename: "logs",
+		Manifest: manifest,
+	}
+}
+
+func TestSessionManager_DirectoryTransferValidatesItsManifest(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.MaxFileSize = 100
+	sm := newTestSessionManager(t, config, nil)
+
+	_, err := sm.CreateTransferSession(newDirectoryRequest(), nil, nil)
+	assert.ErrorIs(t, err, ErrInvalidManifest)
+
+	for _, path := range []string{"../escape.txt", "/etc/passwd.txt", ""} {
+		_, err := sm.CreateTransferSession(newDirectoryRequest(ManifestEntry{Path: path, Size: 1}), nil, nil)
+		assert.ErrorIs(t, err, ErrInvalidManifest, path)
+	}
+
+	_, err = sm.CreateTransferSession(newDirectoryRequest(
+		ManifestEntry{Path: "a.txt", Size: 1},
+		ManifestEntry{Path: "./a.txt", Size: 1},
+	), nil, nil)
+	assert.ErrorIs(t, err, ErrInvalidManifest, "duplicate paths")
+
+	_, err = sm.CreateTransferSession(newDirectoryRequest(ManifestEntry{Path: "tools/setup.exe", Size: 1}), nil, nil)
+	assert.ErrorIs(t, err, ErrTypeNotAllowed)
+
+	// The files are held to MaxFileSize together
+	_, err = sm.CreateTransferSession(newDirectoryRequest(
+		ManifestEntry{Path: "a.txt", Size: 60},
+		ManifestEntry{Path: "sub/b.txt", Size: 60},
+	), nil, nil)
+	assert.ErrorIs(t, err, ErrFileTooLarge)
+
+	// Sizes that would overflow the total are refused, not wrapped around to something small
+	_, err = sm.CreateTransferSession(newDirectoryRequest(
+		ManifestEntry{Path: "a.txt", Size: math.MaxInt64},
+		ManifestEntry{Path: "b.txt", Size: math.MaxInt64},
+		ManifestEntry{Path: "c.txt", Size: 2},
+	), nil, nil)
+	assert.ErrorIs(t, err, ErrFileTooLarge)
+	_, err = sm.CreateTransferSession(newDirectoryRequest(ManifestEntry{Path: "a.txt", Size: 101}), nil, nil)
+	assert.ErrorIs(t, err, ErrFileTooLarge)
+	assert.Empty(t, sm.sessions, "nothing is created for a refused directory")
+}
+
+func TestSessionManager_DirectoryTransferCompletesWithItsFiles(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.RetainCompletedFiles = true
+	sm := newTestSessionManager(t, config, nil)
+	conn, _ := newTestConnPair(t)
+
+	parent, err := sm.CreateTransferSession(newDirectoryRequest(
+		ManifestEntry{Path: "app.txt", Size: 5},
+		ManifestEntry{Path: "sub/db.txt", Size: 3},
+		ManifestEntry{Path: "sub/empty.txt", Size: 0},
+	), conn, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), parent.Request.FileSize)
+	require.Len(t, parent.Children, 3)
+	assert.Equal(t, parent.ID+"-1", parent.Request.Manifest[1].TransferID)
+
+	require.NoError(t, sm.ApproveTransfer(parent.ID, true, "Auto-approved"))
+	assert.ErrorIs(t, sm.ApproveTransfer(parent.Children[0], true, ""), ErrInvalidState)
+	assert.FileExists(t, filepath.Join(parent.TempPath, "sub", "empty.txt"))
+
+	app, db := parent.Children[0], parent.Children[1]
+	require.NoError(t, sm.fileStreams[app].WriteChunk(0, []byte("hello")))
+	sm.MarkTransferStarted(app)
+	assert.Equal(t, StatusInProgress, parent.Status)
+
+	progress, err := sm.GetTransferProgress(parent.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), progress.BytesTransferred)
+	assert.Equal(t, int64(8), progress.TotalBytes)
+	assert.InDelta(t, 62.5, progress.Percentage, 0.01)
+
+	require.NoError(t, sm.CompleteTransfer(app, true, ""))
+	assert.Equal(t, StatusInProgress, parent.Status, "a directory isn't complete until all of its files are")
+	assert.Error(t, sm.CompleteTransfer(parent.ID, true, ""))
+
+	require.NoError(t, sm.fileStreams[db].WriteChunk(0, []byte("abc")))
+	require.NoError(t, sm.CompleteTransfer(db, true, ""))
+	assert.Equal(t, StatusCompleted, parent.Status)
+
+	content, err := os.ReadFile(filepath.Join(parent.TempPath, "sub", "db.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(content))
+
+	var completed []string
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == AuditEventTransferCompleted {
+			completed = append(completed, event.TransferID)
+		}
+	}
+	assert.Equal(t, []string{app, db, parent.ID}, completed, "the directory's completion is audited once, after its last file")
+}
+
+func TestSessionManager_CancellingADirectoryCancelsItsFiles(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	sm := newTestSessionManager(t, config, nil)
+	conn, _ := newTestConnPair(t)
+
+	parent, err := sm.CreateTransferSession(newDirectoryRequest(
+		ManifestEntry{Path: "a.txt", Size: 4},
+		ManifestEntry{Path: "nested/b.txt", Size: 4},
+	), conn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(parent.ID, true, "Auto-approved"))
+	require.NoError(t, sm.fileStreams[parent.Children[0]].WriteChunk(0, []byte("part")))
+	dir := parent.TempPath
+	require.DirExists(t, dir)
+
+	require.NoError(t, sm.CancelTransfer(parent.ID))
+	assert.Equal(t, StatusCancelled, parent.Status)
+	for _, childID := range parent.Children {
+		status, _ := sm.GetTransferStatus(childID)
+		assert.Equal(t, StatusCancelled, status)
+		assert.NotContains(t, sm.fileStreams, childID)
+	}
+	assert.NoDirExists(t, dir)
+
+	// Cancelling one file fails its directory
+	other, err := sm.CreateTransferSession(newDirectoryRequest(
+		ManifestEntry{Path: "a.txt", Size: 4},
+		ManifestEntry{Path: "b.txt", Size: 4},
+	), conn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(other.ID, true, "Auto-approved"))
+	require.NoError(t, sm.CancelTransfer(other.Children[0]))
+	assert.Equal(t, StatusApproved, other.Status)
+	require.NoError(t, sm.CompleteTransfer(other.Children[1], true, ""))
+	assert.Equal(t, StatusFailed, other.Status)
+}
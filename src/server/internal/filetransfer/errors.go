@@ -0,0 +1,24 @@
+package filetransfer
+
+import (
+	"errors"
+)
+
+// Errors shared across the transfer subsystem. They're returned wrapped with the transfer or value
+// concerned, so compare them with errors.Is.
+var (
+	// ErrMaxConcurrent is returned when a transfer would exceed the MaxConcurrent limit
+	ErrMaxConcurrent = errors.New("maximum concurrent transfers reached")
+
+	// ErrFileTooLarge is returned for a transfer larger than MaxFileSize
+	ErrFileTooLarge = errors.New("file exceeds maximum allowed size")
+
+	// ErrTypeNotAllowed is returned for a file whose extension isn't one of AllowedTypes
+	ErrTypeNotAllowed = errors.New("file type is not allowed")
+
+	// ErrNotFound is returned when the transfer or file stream asked for doesn't exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrInvalidState is returned for an operation the transfer can't take in its current state
+	ErrInvalidState = errors.New("invalid transfer state")
+)
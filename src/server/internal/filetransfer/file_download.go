@@ -0,0 +1,286 @@
+package filetransfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/auth"
+)
+
+// Integrity headers sent with a completed transfer's file
+const (
+	HeaderTransferID     = "X-Transfer-Id"
+	HeaderChecksumSHA256 = "X-Checksum-SHA256"
+)
+
+// ServeCompletedFile serves a completed transfer's file with the headers a client needs to verify it:
+// its length, detected content type, transfer ID and the SHA-256 recorded when it was received.
+// The download is bounded by the configured download timeout, so a slow or stalled client can't
+// hold the file open, or keep it from cleanup, indefinitely. Every download of a known transfer,
+// whole or ranged, is audited with who fetched it and how much was served.
+func (sm *SessionManager) ServeCompletedFile(w http.ResponseWriter, r *http.Request, transferID string) {
+	session, exists := sm.GetSession(transferID)
+	if !exists {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+
+	served := &countingResponseWriter{ResponseWriter: w}
+	defer sm.auditDownload(r, session, served)
+	w = served
+
+	session.mutex.RLock()
+	status := session.Status
+	stored := session.storedFile()
+	tempPath := stored.path
+	checksum := session.Checksum
+	filename := session.Request.Filename
+	session.mutex.RUnlock()
+
+	if status != StatusCompleted {
+		http.Error(w, "Transfer not completed", http.StatusBadRequest)
+		return
+	}
+
+	if tempPath == "" {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+
+	// Hold the file back from cleanup until the download ends
+	release, ok := sm.acquireServedFile(transferID, tempPath)
+	if !ok {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+	defer release()
+
+	timeout := sm.GetConfig().GetDownloadTimeout()
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// Writes to a client that stops reading fail at the deadline instead of blocking
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("Failed to set download write deadline for %s: %v", transferID, err)
+	}
+
+	file, err := os.Open(tempPath)
+	if err != nil {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to stat file", http.StatusInternalServerError)
+		return
+	}
+
+	var content io.ReadSeeker = file
+	size := info.Size()
+	var contentType string
+	if stored.sealed {
+		// A file kept encrypted at rest is served as it was sent
+		data, err := sm.readStoredFile(stored)
+		if err != nil {
+			log.Printf("Failed to decrypt %s for download: %v", transferID, err)
+			http.Error(w, "File not available", http.StatusInternalServerError)
+			return
+		}
+		content, size = bytes.NewReader(data), int64(len(data))
+		contentType = mimeTypeOf(tempPath, data[:min(len(data), 512)])
+	} else {
+		contentType, err = detectMimeType(tempPath)
+		if err != nil {
+			contentType = ""
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set(HeaderTransferID, transferID)
+	if checksum != "" {
+		w.Header().Set(HeaderChecksumSHA256, checksum)
+	}
+	http.ServeContent(w, r.WithContext(ctx), filename, info.ModTime(), &contextReader{ctx: ctx, file: content})
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("Download of %s stopped after %s", transferID, timeout)
+	}
+}
+
+// countingResponseWriter records the status and bytes written for a download's audit entry
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	err     error
+}
+
+func (cw *countingResponseWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingResponseWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// auditDownload records who downloaded a transfer's file and whether all of it, or all of the
+// requested range, was served
+func (sm *SessionManager) auditDownload(r *http.Request, session *TransferSession, served *countingResponseWriter) {
+	if !sm.GetConfig().AuditLog {
+		return
+	}
+
+	// Error responses write a message, not the file
+	servingFile := served.status == http.StatusOK || served.status == http.StatusPartialContent
+	var bytesServed int64
+	if servingFile {
+		bytesServed = served.written
+	}
+
+	success := servingFile && served.err == nil
+	errorMessage := ""
+	if served.err != nil {
+		errorMessage = served.err.Error()
+	}
+	if expected, err := strconv.ParseInt(served.Header().Get("Content-Length"), 10, 64); success && err == nil && bytesServed < expected {
+		success = false
+		errorMessage = fmt.Sprintf("download ended after %d of %d bytes", bytesServed, expected)
+	}
+	if !success && errorMessage == "" {
+		errorMessage = http.StatusText(served.status)
+	}
+
+	sm.auditLogger.LogEvent(&AuditEvent{
+		EventType:  AuditEventFileDownloaded,
+		SessionID:  session.Request.SessionID,
+		TransferID: session.ID,
+		UserID:     auth.Actor(r.Context()),
+		Filename:   session.Request.Filename,
+		FileSize:   bytesServed,
+		IPAddress:  sm.ClientIP(r),
+		UserAgent:  r.UserAgent(),
+		Success:    success,
+		ErrorMsg:   errorMessage,
+		Metadata:   session.Request.Metadata,
+		Details: map[string]interface{}{
+			"status":       served.status,
+			"bytes_served": bytesServed,
+			"range":        r.Header.Get("Range"),
+		},
+	})
+}
+
+// servedFile counts the downloads reading a temp file, and records whether the file was
+// removed while they were in progress
+type servedFile struct {
+	downloads int
+	removed   bool
+}
+
+// acquireServedFile marks a download of the transfer's temp file as in progress, returning the
+// func that ends it. It fails if the transfer was cleaned up after its file path was read.
+func (sm *SessionManager) acquireServedFile(transferID, tempPath string) (func(), bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	session, exists := sm.sessions[transferID]
+	if !exists {
+		return nil, false
+	}
+	session.mutex.RLock()
+	current := session.Status == StatusCompleted && session.TempPath == tempPath
+	session.mutex.RUnlock()
+	if !current {
+		return nil, false
+	}
+
+	served, exists := sm.servedFiles[tempPath]
+	if !exists {
+		served = &servedFile{}
+		sm.servedFiles[tempPath] = served
+	}
+	served.downloads++
+
+	return func() { sm.releaseServedFile(tempPath) }, true
+}
+
+// releaseServedFile ends a download, removing the file if cleanup asked for it meanwhile
+func (sm *SessionManager) releaseServedFile(tempPath string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	served, exists := sm.servedFiles[tempPath]
+	if !exists {
+		return
+	}
+	if served.downloads--; served.downloads > 0 {
+		return
+	}
+	delete(sm.servedFiles, tempPath)
+
+	if served.removed {
+		if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing temp file after download: %v", err)
+		}
+	}
+}
+
+// removeTempFile removes a temp file, or defers it until the downloads reading it end.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) removeTempFile(tempPath string) error {
+	removeChunkBitmap(tempPath)
+	if served, exists := sm.servedFiles[tempPath]; exists {
+		served.removed = true
+		return nil
+	}
+	return os.Remove(tempPath)
+}
+
+// contextReader reads a file until its context ends, so the copy serving a download stops
+// on timeout or client disconnect
+type contextReader struct {
+	ctx  context.Context
+	file io.ReadSeeker
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.file.Read(p)
+}
+
+func (cr *contextReader) Seek(offset int64, whence int) (int64, error) {
+	return cr.file.Seek(offset, whence)
+}
@@ -0,0 +1,246 @@
+package filetransfer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onlitec/onlidesk-server/internal/auth"
+)
+
+func TestSessionManager_ServeCompletedFileSetsIntegrityHeaders(t *testing.T) {
+	sm := newTestSessionManager(t, nil, nil)
+
+	content := []byte("%PDF-1.7 quarterly report")
+	source := filepath.Join(t.TempDir(), "source.pdf")
+	require.NoError(t, os.WriteFile(source, content, 0644))
+	checksum, err := GenerateFileChecksum(source)
+	require.NoError(t, err)
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:              TransferTypeUpload,
+		Filename:          "report.pdf",
+		FileSize:          int64(len(content)),
+		Checksum:          checksum,
+		ChecksumAlgorithm: "SHA256",
+	}, nil, nil)
+	require.NoError(t, err)
+
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		sm.ServeCompletedFile(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+session.ID+"/download", nil), session.ID)
+		return rec
+	}
+	assert.Equal(t, http.StatusBadRequest, serve().Code, "incomplete transfers aren't served")
+
+	// Simulate the upload having landed in the temp file
+	session.TempPath = filepath.Join(sm.config.TempDir, "transfer_"+session.ID+"_report.pdf")
+	require.NoError(t, os.WriteFile(session.TempPath, content, 0644))
+	require.NoError(t, sm.CompleteTransfer(session.ID, true, ""))
+
+	rec := serve()
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, content, rec.Body.Bytes())
+	assert.Equal(t, strconv.Itoa(len(content)), rec.Header().Get("Content-Length"))
+	assert.Equal(t, "application/pdf", rec.Header().Get("Content-Type"))
+	assert.Equal(t, session.ID, rec.Header().Get(HeaderTransferID))
+	assert.Equal(t, checksum, rec.Header().Get(HeaderChecksumSHA256))
+	assert.Equal(t, `attachment; filename="report.pdf"`, rec.Header().Get("Content-Disposition"))
+
+	rec = httptest.NewRecorder()
+	sm.ServeCompletedFile(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/missing/download", nil), "missing")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestSessionManager_ServeCompletedFileAuditsDownloads(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, nil, securityConfig)
+
+	content := []byte("quarterly figures, confidential")
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:      TransferTypeUpload,
+		SessionID: "support-session",
+		Filename:  "figures.txt",
+		FileSize:  int64(len(content)),
+	}, nil, nil)
+	require.NoError(t, err)
+
+	download := func(rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+session.ID+"/download", nil)
+		req = req.WithContext(auth.WithIdentity(req.Context(), auth.Identity{Subject: "alice@example.com"}))
+		req.RemoteAddr = "198.51.100.7:51000"
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		sm.ServeCompletedFile(rec, req, session.ID)
+		return rec
+	}
+
+	// Refused before completion
+	assert.Equal(t, http.StatusBadRequest, download("").Code)
+
+	session.TempPath = filepath.Join(sm.config.TempDir, "transfer_"+session.ID+"_figures.txt")
+	require.NoError(t, os.WriteFile(session.TempPath, content, 0644))
+	require.NoError(t, sm.CompleteTransfer(session.ID, true, ""))
+
+	require.Equal(t, http.StatusOK, download("").Code)
+	partial := download("bytes=0-9")
+	require.Equal(t, http.StatusPartialContent, partial.Code)
+	assert.Equal(t, content[:10], partial.Body.Bytes())
+
+	var downloads []AuditEvent
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == AuditEventFileDownloaded {
+			downloads = append(downloads, event)
+		}
+	}
+	require.Len(t, downloads, 3)
+	for _, event := range downloads {
+		assert.Equal(t, "alice@example.com", event.UserID)
+		assert.Equal(t, "198.51.100.7", event.IPAddress)
+		assert.Equal(t, session.ID, event.TransferID)
+		assert.Equal(t, "support-session", event.SessionID)
+		assert.Equal(t, "figures.txt", event.Filename)
+	}
+
+	assert.False(t, downloads[0].Success)
+	assert.Zero(t, downloads[0].FileSize)
+
+	assert.True(t, downloads[1].Success)
+	assert.Equal(t, int64(len(content)), downloads[1].FileSize)
+
+	assert.True(t, downloads[2].Success)
+	assert.Equal(t, int64(10), downloads[2].FileSize)
+	assert.Equal(t, "bytes=0-9", downloads[2].Details["range"])
+}
+
+func TestSessionManager_ServeCompletedFileBoundsSlowDownloads(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.DownloadTimeout = 200 * time.Millisecond
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, config, securityConfig)
+
+	// Large enough that the server blocks once the socket buffers fill
+	content := bytes.Repeat([]byte("%PDF-1.7 "), 4<<20)
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "large.pdf",
+		FileSize: int64(len(content)),
+	}, nil, nil)
+	require.NoError(t, err)
+	session.TempPath = filepath.Join(sm.config.TempDir, "transfer_"+session.ID+"_large.pdf")
+	require.NoError(t, os.WriteFile(session.TempPath, content, 0644))
+	require.NoError(t, sm.CompleteTransfer(session.ID, true, ""))
+
+	served := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(served)
+		sm.ServeCompletedFile(w, r, session.ID)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The client stalls without reading the body; the server gives up at the timeout
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download was not bounded by the timeout")
+	}
+
+	sm.mutex.RLock()
+	assert.Empty(t, sm.servedFiles, "the file is released once the download ends")
+	sm.mutex.RUnlock()
+
+	body, _ := io.ReadAll(resp.Body)
+	assert.Less(t, len(body), len(content))
+}
+
+func TestSessionManager_CleanupWaitsForInFlightDownloads(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, nil, securityConfig)
+
+	// Large enough that each download is still being written when cleanup runs
+	content := bytes.Repeat([]byte("%PDF-1.7 "), 4<<20)
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "large.pdf",
+		FileSize: int64(len(content)),
+	}, nil, nil)
+	require.NoError(t, err)
+	tempPath := filepath.Join(sm.config.TempDir, "transfer_"+session.ID+"_large.pdf")
+	session.TempPath = tempPath
+	require.NoError(t, os.WriteFile(tempPath, content, 0644))
+	require.NoError(t, sm.CompleteTransfer(session.ID, true, ""))
+
+	const downloads = 3
+	var served sync.WaitGroup
+	served.Add(downloads)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer served.Done()
+		sm.ServeCompletedFile(w, r, session.ID)
+	}))
+	defer server.Close()
+
+	var responses []*http.Response
+	for i := 0; i < downloads; i++ {
+		resp, err := http.Get(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		responses = append(responses, resp)
+	}
+
+	// The session ages out and every cleanup path runs while the downloads are in flight
+	session.mutex.Lock()
+	ended := time.Now().Add(-2 * time.Hour)
+	session.EndTime = &ended
+	session.mutex.Unlock()
+	sm.performCleanup()
+	_, err = sm.PruneOrphanedTempFiles(0)
+	require.NoError(t, err)
+
+	_, exists := sm.GetSession(session.ID)
+	assert.False(t, exists, "the session itself is cleaned up")
+	assert.FileExists(t, tempPath, "the file stays until its downloads end")
+
+	// A download that starts after cleanup finds nothing to serve
+	rec := httptest.NewRecorder()
+	sm.ServeCompletedFile(rec, httptest.NewRequest(http.MethodGet, "/", nil), session.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	var readers sync.WaitGroup
+	for _, resp := range responses {
+		readers.Add(1)
+		go func(resp *http.Response) {
+			defer readers.Done()
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(content, body), "download was cut short")
+		}(resp)
+	}
+	readers.Wait()
+	served.Wait()
+
+	assert.NoFileExists(t, tempPath, "the file is removed once the last download ends")
+	sm.mutex.RLock()
+	assert.Empty(t, sm.servedFiles)
+	sm.mutex.RUnlock()
+}
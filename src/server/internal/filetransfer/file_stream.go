@@ -2,8 +2,10 @@ package filetransfer
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,10 +14,12 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/onlitec/onlidesk-server/internal/lifecycle"
 )
 
 const (
-	// ChunkSize defines the size of each file chunk (64KB)
+	// ChunkSize is the default size of each file chunk (64KB), used when a transfer doesn't negotiate one
 	ChunkSize = 64 * 1024
 	// MaxConcurrentTransfers limits the number of simultaneous transfers
 	MaxConcurrentTransfers = 5
@@ -25,12 +29,22 @@ const (
 	RetryAttempts = 3
 )
 
+// ErrDeclaredSizeExceeded is returned when an upload sends more bytes than the size it declared
+var ErrDeclaredSizeExceeded = errors.New("upload exceeds its declared file size")
+
+// ErrChunkIndexOutOfRange is returned for a chunk index outside the chunks an upload's declared size allows
+var ErrChunkIndexOutOfRange = errors.New("chunk index out of range")
+
+// errStreamCancelled is returned when a stream is cancelled while waiting to send
+var errStreamCancelled = errors.New("transfer was cancelled")
+
 // FileStream manages the streaming of file data
 type FileStream struct {
 	transferID    string
 	filePath      string
 	file          *os.File
 	totalSize     int64
+	chunkSize     int64 // negotiated for this transfer; every offset and count is in these units
 	chunkCount    int
 	sentChunks    map[int]bool
 	failedChunks  map[int]int // chunk -> retry count
@@ -40,7 +54,6 @@ type FileStream struct {
 	progressChan  chan FileTransferProgress
 	errorChan     chan error
 	completeChan  chan bool
-	cancelChan    chan bool
 	pauseChan     chan bool
 	resumeChan    chan bool
 	mutex         sync.RWMutex
@@ -48,16 +61,56 @@ type FileStream struct {
 	paused        bool
 	startTime     time.Time
 	lastProgress  time.Time
+	lastActivity  time.Time                  // when a chunk was last sent, received or acknowledged
 	bytesPerSec   int64
+	contentCheck  func(head []byte) error    // optional check run on the first upload chunk
+	progressHook  func(FileTransferProgress) // optional observer of progress updates
+	maxBytes      int64                      // most an upload may send; 0 means unbounded
+	maxChunks     int                        // chunk indices an upload may use, derived from maxBytes
+	receivedBytes int64                      // distinct upload bytes received so far
+	window        int                        // chunks a download may send ahead of the client's acknowledgements; 0 is unbounded
+	acked         int                        // download chunks the client has acknowledged, in order
+	ackChan       chan struct{}              // wakes a download waiting on its window
+	compress      bool                       // gzip sent chunks where it helps, and accept compressed chunks
+	compressLevel int                        // gzip level for sent chunks
+	encryptor     *FileEncryptor             // seals sent chunks and opens encrypted received ones; nil sends plaintext
+	sealer        *FileEncryptor             // seals received chunks before they're stored; nil stores them as sent
+	writeMutex    *sync.Mutex                // serializes writes to conn, shared by streams on the same connection
+	chunks        *chunkBitmap               // persisted record of the upload chunks on disk, when tracked
+	progress      *progressPool              // delivers progress updates; without one they stay queued
+	delivering    bool                       // handed to a delivery worker that hasn't drained progressChan yet
+	limiter       *rateLimiter               // paces a download to its own rate limit; nil is unlimited
+	sharedLimiter *rateLimiter               // paces a download within a limit shared with other streams
+	workers       *lifecycle.Group           // the transfer's worker; cancelling it cancels the transfer
+}
+
+// NewFileStream creates a new file stream instance. A chunkSize of 0 uses the default ChunkSize.
+func NewFileStream(transferID, filePath string, isUpload bool, conn *websocket.Conn, chunkSize int) (*FileStream, error) {
+	return newFileStream(transferID, filePath, isUpload, conn, chunkSize, false)
+}
+
+// ResumeUploadStream creates a stream that carries on an interrupted upload, keeping the bytes
+// already in its file. Pair it with TrackChunks so the chunks on disk aren't asked for again.
+func ResumeUploadStream(transferID, filePath string, conn *websocket.Conn, chunkSize int) (*FileStream, error) {
+	return newFileStream(transferID, filePath, true, conn, chunkSize, true)
 }
 
-// NewFileStream creates a new file stream instance
-func NewFileStream(transferID, filePath string, isUpload bool, conn *websocket.Conn) (*FileStream, error) {
+func newFileStream(transferID, filePath string, isUpload bool, conn *websocket.Conn, chunkSize int, resume bool) (*FileStream, error) {
+	if chunkSize <= 0 {
+		chunkSize = ChunkSize
+	}
+
 	var file *os.File
 	var totalSize int64
 	var err error
 
-	if isUpload {
+	if isUpload && resume {
+		// Keep what the interrupted upload already wrote
+		file, err = os.OpenFile(filePath, os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reopen file: %v", err)
+		}
+	} else if isUpload {
 		// For uploads, create the file
 		file, err = os.Create(filePath)
 		if err != nil {
@@ -79,13 +132,14 @@ func NewFileStream(transferID, filePath string, isUpload bool, conn *websocket.C
 		totalSize = stat.Size()
 	}
 
-	chunkCount := int((totalSize + ChunkSize - 1) / ChunkSize) // Ceiling division
+	chunkCount := int((totalSize + int64(chunkSize) - 1) / int64(chunkSize)) // Ceiling division
 
 	return &FileStream{
 		transferID:   transferID,
 		filePath:     filePath,
 		file:         file,
 		totalSize:    totalSize,
+		chunkSize:    int64(chunkSize),
 		chunkCount:   chunkCount,
 		sentChunks:   make(map[int]bool),
 		failedChunks: make(map[int]int),
@@ -94,22 +148,276 @@ func NewFileStream(transferID, filePath string, isUpload bool, conn *websocket.C
 		progressChan: make(chan FileTransferProgress, 100),
 		errorChan:    make(chan error, 10),
 		completeChan: make(chan bool, 1),
-		cancelChan:   make(chan bool, 1),
 		pauseChan:    make(chan bool, 1),
 		resumeChan:   make(chan bool, 1),
+		ackChan:      make(chan struct{}, 1),
 		startTime:    time.Now(),
 		lastProgress: time.Now(),
+		lastActivity: time.Now(),
+		writeMutex:   &sync.Mutex{},
+		workers:      lifecycle.NewGroup("file stream " + transferID),
 	}, nil
 }
 
+// SetContentValidator installs a check that runs on the first chunk of an upload
+func (fs *FileStream) SetContentValidator(validate func(head []byte) error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.contentCheck = validate
+}
+
+// SetWindow bounds how many chunks a download may send ahead of the client's acknowledgements,
+// so a slow client holds the server back instead of letting chunks pile up in the socket
+func (fs *FileStream) SetWindow(window int) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.window = window
+}
+
+// AcknowledgeChunk records that the client has received a download's chunks up to and including
+// chunkIndex, opening the window for more. Chunks not yet sent can't be acknowledged.
+func (fs *FileStream) AcknowledgeChunk(chunkIndex int) {
+	fs.mutex.Lock()
+	if chunkIndex >= fs.currentChunk {
+		chunkIndex = fs.currentChunk - 1
+	}
+	if chunkIndex+1 > fs.acked {
+		fs.acked = chunkIndex + 1
+	}
+	fs.lastActivity = time.Now()
+	fs.mutex.Unlock()
+
+	select {
+	case fs.ackChan <- struct{}{}:
+	default:
+	}
+}
+
+// waitForWindow blocks until chunkIndex is within the window of acknowledged chunks, returning
+// false if the stream is stopped first
+func (fs *FileStream) waitForWindow(chunkIndex int, stop <-chan struct{}) bool {
+	for {
+		fs.mutex.RLock()
+		open := fs.window <= 0 || chunkIndex < fs.acked+fs.window
+		fs.mutex.RUnlock()
+		if open {
+			return true
+		}
+
+		select {
+		case <-fs.ackChan:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// SetTotalSize sets the size an upload's progress is measured against, its declared file size
+func (fs *FileStream) SetTotalSize(totalSize int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.totalSize = totalSize
+}
+
+// SetSizeLimit bounds the bytes an upload may send, and so the chunk indices it may use;
+// chunks beyond either are refused
+func (fs *FileStream) SetSizeLimit(maxBytes int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.maxBytes = maxBytes
+	fs.maxChunks = int((maxBytes + fs.chunkSize - 1) / fs.chunkSize)
+	if fs.maxChunks < 1 {
+		fs.maxChunks = 1 // an empty file still sends one chunk
+	}
+}
+
+// TrackChunks records the upload chunks on disk in the bitmap at path, picking up the chunks an
+// earlier stream for the same file recorded there. Call it after SetTotalSize and SetSizeLimit.
+func (fs *FileStream) TrackChunks(path string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// Cover every index the upload may use, not just those its declared size needs
+	count := chunksFor(fs.totalSize, fs.chunkSize)
+	if fs.maxChunks > count {
+		count = fs.maxChunks
+	}
+	bitmap, err := openChunkBitmap(path, count)
+	if err != nil {
+		return err
+	}
+	fs.chunks = bitmap
+
+	// Chunks written before a reconnect count as received
+	for i := 0; i < count; i++ {
+		if bitmap.has(i) && !fs.sentChunks[i] {
+			fs.sentChunks[i] = true
+			fs.receivedBytes += fs.chunkLength(i)
+		}
+	}
+	return nil
+}
+
+// MissingChunks lists the chunks of an upload's declared size that haven't been received
+func (fs *FileStream) MissingChunks() []int {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	missing := []int{}
+	for i := 0; i < chunksFor(fs.totalSize, fs.chunkSize); i++ {
+		if !fs.sentChunks[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// ReceivedAll reports whether an upload has every chunk of its declared size, and exactly
+// its declared number of bytes
+func (fs *FileStream) ReceivedAll() bool {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	if fs.receivedBytes != fs.totalSize {
+		return false
+	}
+	for i := 0; i < chunksFor(fs.totalSize, fs.chunkSize); i++ {
+		if !fs.sentChunks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// chunkLength returns how many bytes of the declared size fall in a chunk. Caller must hold fs.mutex.
+func (fs *FileStream) chunkLength(chunkIndex int) int64 {
+	length := fs.totalSize - int64(chunkIndex)*fs.chunkSize
+	if length > fs.chunkSize {
+		length = fs.chunkSize
+	}
+	if length < 0 {
+		length = 0
+	}
+	return length
+}
+
+// storeChunk writes a chunk at its offset and records it as received. Chunks already on disk,
+// resent or written before a reconnect, are left alone so nothing is written twice. A sealing
+// stream stores the chunk encrypted, in its slot of the sealed layout.
+// Caller must hold fs.mutex.
+func (fs *FileStream) storeChunk(chunkIndex int, data []byte) error {
+	if fs.sentChunks[chunkIndex] {
+		return nil
+	}
+
+	stored, offset := data, int64(chunkIndex)*fs.chunkSize
+	if fs.sealer != nil {
+		sealed, err := sealStoredChunk(fs.sealer, data)
+		if err != nil {
+			return fmt.Errorf("failed to seal chunk %d: %v", chunkIndex, err)
+		}
+		stored, offset = sealed, int64(chunkIndex)*sealedSlotSize(fs.chunkSize)
+	}
+
+	if _, err := fs.file.WriteAt(stored, offset); err != nil {
+		return fmt.Errorf("failed to write chunk data: %v", err)
+	}
+	fs.sentChunks[chunkIndex] = true
+	fs.receivedBytes += int64(len(data))
+
+	if fs.chunks != nil {
+		if err := fs.chunks.set(chunkIndex); err != nil {
+			return fmt.Errorf("failed to record chunk %d: %v", chunkIndex, err)
+		}
+	}
+	return nil
+}
+
+// checkChunkIndex refuses indices a bounded upload can't use, before they're used as an offset
+// or buffered. Caller must hold fs.mutex.
+func (fs *FileStream) checkChunkIndex(chunkIndex int) error {
+	if chunkIndex < 0 || (fs.maxBytes > 0 && chunkIndex >= fs.maxChunks) {
+		return fmt.Errorf("%w: %d", ErrChunkIndexOutOfRange, chunkIndex)
+	}
+	return nil
+}
+
+// setProgressPool has the pool deliver the stream's progress once it starts
+func (fs *FileStream) setProgressPool(pool *progressPool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.progress = pool
+}
+
+// startProgress registers the stream for the pool's per-interval progress updates
+func (fs *FileStream) startProgress() {
+	fs.mutex.RLock()
+	pool := fs.progress
+	fs.mutex.RUnlock()
+	if pool != nil {
+		pool.add(fs)
+	}
+}
+
+// SetRateLimit holds a download to bytesPerSecond; 0 removes the limit
+func (fs *FileStream) SetRateLimit(bytesPerSecond int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.limiter = nil
+	if bytesPerSecond > 0 {
+		fs.limiter = newRateLimiter(bytesPerSecond)
+	}
+}
+
+// shareWriteMutex serializes the stream's writes with those of other streams on its connection.
+// Call it before the stream starts.
+func (fs *FileStream) shareWriteMutex(mutex *sync.Mutex) {
+	fs.writeMutex = mutex
+}
+
+// shareRateLimiter also holds a download to a limit shared with other streams, once it starts
+func (fs *FileStream) shareRateLimiter(limiter *rateLimiter) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.sharedLimiter = limiter
+}
+
+// effectiveRate returns the rate a download is currently held to: the lower of its own limit and
+// its share of the shared one. 0 means unthrottled. Caller must hold fs.mutex.
+func (fs *FileStream) effectiveRate() int64 {
+	var rate int64
+	if fs.limiter != nil {
+		rate = fs.limiter.rate
+	}
+	if fs.sharedLimiter != nil {
+		if share := fs.sharedLimiter.share(); share > 0 && (rate == 0 || share < rate) {
+			rate = share
+		}
+	}
+	return rate
+}
+
+// SetProgressHook installs an observer called with each progress update sent to the client
+func (fs *FileStream) SetProgressHook(hook func(FileTransferProgress)) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.progressHook = hook
+}
+
 // StartDownload begins downloading a file to the client
 func (fs *FileStream) StartDownload() error {
 	fs.mutex.Lock()
 	fs.active = true
+	if fs.sharedLimiter != nil {
+		fs.sharedLimiter.join()
+	}
 	fs.mutex.Unlock()
 
-	go fs.downloadWorker()
-	go fs.progressMonitor()
+	if !fs.workers.Go("download worker", fs.downloadWorker) {
+		fs.cleanup()
+		return fmt.Errorf("transfer %s was cancelled", fs.transferID)
+	}
+	fs.startProgress()
 
 	return nil
 }
@@ -120,39 +428,42 @@ func (fs *FileStream) StartUpload() error {
 	fs.active = true
 	fs.mutex.Unlock()
 
-	go fs.uploadWorker()
-	go fs.progressMonitor()
+	if !fs.workers.Go("upload worker", fs.uploadWorker) {
+		fs.cleanup()
+		return fmt.Errorf("transfer %s was cancelled", fs.transferID)
+	}
+	fs.startProgress()
 
 	return nil
 }
 
 // downloadWorker handles the download process
-func (fs *FileStream) downloadWorker() {
+func (fs *FileStream) downloadWorker(stop <-chan struct{}) {
 	defer fs.cleanup()
 
 	reader := bufio.NewReader(fs.file)
-	buffer := make([]byte, ChunkSize)
+	buffer := make([]byte, fs.chunkSize)
 
 	for chunkIndex := 0; chunkIndex < fs.chunkCount; chunkIndex++ {
 		// Check for pause/cancel signals
 		select {
-		case <-fs.cancelChan:
+		case <-stop:
 			log.Printf("Download cancelled: %s", fs.transferID)
 			return
 		case <-fs.pauseChan:
-			fs.mutex.Lock()
-			fs.paused = true
-			fs.mutex.Unlock()
-			
-			// Wait for resume signal
-			<-fs.resumeChan
-			
-			fs.mutex.Lock()
-			fs.paused = false
-			fs.mutex.Unlock()
+			if !fs.holdWhilePaused(stop) {
+				log.Printf("Download cancelled: %s", fs.transferID)
+				return
+			}
 		default:
 		}
 
+		// Hold off until the client has caught up
+		if !fs.waitForWindow(chunkIndex, stop) {
+			log.Printf("Download cancelled: %s", fs.transferID)
+			return
+		}
+
 		// Read chunk from file
 		n, err := reader.Read(buffer)
 		if err != nil && err != io.EOF {
@@ -175,7 +486,11 @@ func (fs *FileStream) downloadWorker() {
 		}
 
 		// Send chunk with retry logic
-		if err := fs.sendChunkWithRetry(chunk); err != nil {
+		if err := fs.sendChunkWithRetry(chunk, stop); err != nil {
+			if errors.Is(err, errStreamCancelled) {
+				log.Printf("Download cancelled: %s", fs.transferID)
+				return
+			}
 			fs.errorChan <- fmt.Errorf("failed to send chunk %d after retries: %v", chunkIndex, err)
 			return
 		}
@@ -196,17 +511,32 @@ func (fs *FileStream) downloadWorker() {
 }
 
 // uploadWorker handles the upload process
-func (fs *FileStream) uploadWorker() {
+func (fs *FileStream) uploadWorker(stop <-chan struct{}) {
 	defer fs.cleanup()
 
-	writer := bufio.NewWriter(fs.file)
 	receivedChunks := make(map[int][]byte)
 	expectedChunk := 0
 
+	// Without a connection to read from, chunks only arrive through WriteChunk
+	if checkConn(fs.conn) != nil {
+		for {
+			select {
+			case <-stop:
+				log.Printf("Upload cancelled: %s", fs.transferID)
+				return
+			case <-fs.pauseChan:
+				if !fs.holdWhilePaused(stop) {
+					log.Printf("Upload cancelled: %s", fs.transferID)
+					return
+				}
+			}
+		}
+	}
+
 	// Listen for incoming chunks
 	for {
 		select {
-		case <-fs.cancelChan:
+		case <-stop:
 			log.Printf("Upload cancelled: %s", fs.transferID)
 			return
 		case <-fs.pauseChan:
@@ -214,8 +544,13 @@ func (fs *FileStream) uploadWorker() {
 			fs.paused = true
 			fs.mutex.Unlock()
 			
-			// Wait for resume signal
-			<-fs.resumeChan
+			// Wait for resume signal; a paused transfer can still be cancelled
+			select {
+			case <-fs.resumeChan:
+			case <-stop:
+				log.Printf("Upload cancelled: %s", fs.transferID)
+				return
+			}
 			
 			fs.mutex.Lock()
 			fs.paused = false
@@ -245,47 +580,91 @@ func (fs *FileStream) uploadWorker() {
 					continue
 				}
 
-				// Store chunk
-				receivedChunks[chunk.Sequence] = chunk.Data
+				// The checksum covers the chunk as sent, so it's decrypted and decompressed only once verified
+				if chunk.Data, err = fs.openIncoming(chunk.Data, chunk.Encrypted, chunk.Compressed); err != nil {
+					fs.errorChan <- fmt.Errorf("chunk %d: %v", chunk.Sequence, err)
+					return
+				}
+
+				// Refuse indices the upload can't use rather than buffering them
+				fs.mutex.RLock()
+				indexErr := fs.checkChunkIndex(chunk.Sequence)
+				fs.mutex.RUnlock()
+				if indexErr != nil {
+					fs.errorChan <- indexErr
+					return
+				}
+
+				// Store chunk, unless it's already on disk
+				fs.mutex.RLock()
+				onDisk := fs.sentChunks[chunk.Sequence]
+				fs.mutex.RUnlock()
+				if !onDisk {
+					receivedChunks[chunk.Sequence] = chunk.Data
+				}
 
-				// Write chunks in order
+				// Write chunks in order, stepping over those already on disk
 				for {
-					if data, exists := receivedChunks[expectedChunk]; exists {
-						if _, err := writer.Write(data); err != nil {
-							fs.errorChan <- fmt.Errorf("error writing chunk %d: %v", expectedChunk, err)
-							return
-						}
+					fs.mutex.RLock()
+					onDisk := fs.sentChunks[expectedChunk]
+					fs.mutex.RUnlock()
+					data, exists := receivedChunks[expectedChunk]
+					if !exists && !onDisk {
+						break
+					}
 
-						delete(receivedChunks, expectedChunk)
-						expectedChunk++
+					if !onDisk {
+						if expectedChunk == 0 && fs.contentCheck != nil {
+							if err := fs.contentCheck(data); err != nil {
+								fs.errorChan <- err
+								return
+							}
+						}
 
-						// Update progress
 						fs.mutex.Lock()
-						fs.currentChunk = expectedChunk
+						if fs.maxBytes > 0 && fs.receivedBytes+int64(len(data)) > fs.maxBytes {
+							fs.mutex.Unlock()
+							fs.errorChan <- fmt.Errorf("%w: chunk %d passes %d bytes", ErrDeclaredSizeExceeded, expectedChunk, fs.maxBytes)
+							return
+						}
+						err := fs.storeChunk(expectedChunk, data)
 						fs.mutex.Unlock()
-
-						fs.sendProgress()
-
-						// Check if this was the last chunk
-						if chunk.IsLast {
-							writer.Flush()
-							fs.completeChan <- true
-							log.Printf("Upload completed: %s", fs.transferID)
+						if err != nil {
+							fs.errorChan <- fmt.Errorf("error writing chunk %d: %v", expectedChunk, err)
 							return
 						}
-					} else {
-						break
 					}
+
+					delete(receivedChunks, expectedChunk)
+					expectedChunk++
+
+					// Update progress
+					fs.mutex.Lock()
+					fs.currentChunk = expectedChunk
+					fs.mutex.Unlock()
+
+					fs.sendProgress()
+				}
+
+				// Chunks may arrive out of order, so the upload is complete once every one is on disk
+				// rather than when the one flagged last arrives
+				if fs.ReceivedAll() {
+					fs.completeChan <- true
+					log.Printf("Upload completed: %s", fs.transferID)
+					return
 				}
 			}
 		}
 	}
 }
 
-// sendChunkWithRetry sends a chunk with retry logic
-func (fs *FileStream) sendChunkWithRetry(chunk FileChunk) error {
+// sendChunkWithRetry sends a chunk with retry logic, every attempt paced by the stream's rate limits
+func (fs *FileStream) sendChunkWithRetry(chunk FileChunk, stop <-chan struct{}) error {
 	retryCount := 0
 	for retryCount < RetryAttempts {
+		if !fs.throttle(len(chunk.Data), stop) {
+			return errStreamCancelled
+		}
 		if err := fs.sendChunk(chunk); err != nil {
 			retryCount++
 			log.Printf("Failed to send chunk %d, attempt %d: %v", chunk.Sequence, retryCount, err)
@@ -301,13 +680,78 @@ func (fs *FileStream) sendChunkWithRetry(chunk FileChunk) error {
 	return fmt.Errorf("max retry attempts exceeded")
 }
 
+// throttle waits until the stream's rate limits allow n more bytes, pausing on request while it
+// waits. It reports false if the transfer was cancelled.
+func (fs *FileStream) throttle(n int, stop <-chan struct{}) bool {
+	fs.mutex.RLock()
+	limiters := []*rateLimiter{fs.limiter, fs.sharedLimiter}
+	fs.mutex.RUnlock()
+
+	var delay time.Duration
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		if wait := limiter.reserve(n); wait > delay {
+			delay = wait
+		}
+	}
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-fs.pauseChan:
+			if !fs.holdWhilePaused(stop) {
+				return false
+			}
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// holdWhilePaused blocks a paused transfer until it is resumed, reporting false if it is
+// cancelled instead
+func (fs *FileStream) holdWhilePaused(stop <-chan struct{}) bool {
+	fs.mutex.Lock()
+	fs.paused = true
+	fs.mutex.Unlock()
+
+	select {
+	case <-fs.resumeChan:
+	case <-stop:
+		return false
+	}
+
+	fs.mutex.Lock()
+	fs.paused = false
+	fs.mutex.Unlock()
+	return true
+}
+
 // sendChunk sends a single chunk over WebSocket
 func (fs *FileStream) sendChunk(chunk FileChunk) error {
-	// Create chunk message with header + data
-	header, err := json.Marshal(chunk)
+	chunk, err := fs.sealOutgoing(chunk)
+	if err != nil {
+		return err
+	}
+
+	// Create chunk message with header + data; the data follows the header rather than being encoded in it
+	headerFields := chunk
+	headerFields.Data = nil
+	header, err := json.Marshal(headerFields)
 	if err != nil {
 		return fmt.Errorf("error marshaling chunk header: %v", err)
 	}
+	if len(header) > 256 {
+		return fmt.Errorf("chunk header is %d bytes, longer than 256", len(header))
+	}
 
 	// Pad header to fixed size (256 bytes)
 	headerPadded := make([]byte, 256)
@@ -317,9 +761,15 @@ func (fs *FileStream) sendChunk(chunk FileChunk) error {
 	message := append(headerPadded, chunk.Data...)
 
 	// Send as binary message
+	if err := checkConn(fs.conn); err != nil {
+		return fmt.Errorf("error sending chunk: %w", err)
+	}
+	fs.writeMutex.Lock()
+	defer fs.writeMutex.Unlock()
 	if err := fs.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
 		return fmt.Errorf("error sending chunk: %v", err)
 	}
+	fs.touch()
 
 	return nil
 }
@@ -332,8 +782,8 @@ func (fs *FileStream) parseChunk(data []byte) (FileChunk, error) {
 		return chunk, fmt.Errorf("invalid chunk data: too short")
 	}
 
-	// Parse header
-	header := data[:256]
+	// Parse header, dropping its padding
+	header := bytes.TrimRight(data[:256], "\x00")
 	if err := json.Unmarshal(header, &chunk); err != nil {
 		return chunk, fmt.Errorf("error parsing chunk header: %v", err)
 	}
@@ -371,6 +821,12 @@ func (fs *FileStream) requestChunkRetransmission(sequence int) {
 		return
 	}
 
+	if err := checkConn(fs.conn); err != nil {
+		log.Printf("Error sending retransmission request: %v", err)
+		return
+	}
+	fs.writeMutex.Lock()
+	defer fs.writeMutex.Unlock()
 	if err := fs.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 		log.Printf("Error sending retransmission request: %v", err)
 	}
@@ -378,22 +834,20 @@ func (fs *FileStream) requestChunkRetransmission(sequence int) {
 
 // sendProgress sends progress updates
 func (fs *FileStream) sendProgress() {
-	fs.mutex.RLock()
-	currentChunk := fs.currentChunk
-	fs.mutex.RUnlock()
-
-	bytesTransferred := int64(currentChunk) * ChunkSize
-	if bytesTransferred > fs.totalSize {
-		bytesTransferred = fs.totalSize
+	// Updates are computed and queued under the lock, so none is sent once cleanup has run
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if !fs.active {
+		return
 	}
 
-	percentage := float64(bytesTransferred) / float64(fs.totalSize) * 100
+	bytesTransferred, percentage := fs.transferred()
 
 	// Calculate transfer speed
 	now := time.Now()
 	elapsed := now.Sub(fs.lastProgress).Seconds()
 	if elapsed > 0 {
-		fs.bytesPerSec = int64(float64(ChunkSize) / elapsed)
+		fs.bytesPerSec = int64(float64(fs.chunkSize) / elapsed)
 		fs.lastProgress = now
 	}
 
@@ -411,6 +865,7 @@ func (fs *FileStream) sendProgress() {
 		Percentage:       percentage,
 		Speed:            fs.bytesPerSec,
 		ETA:              eta,
+		RateLimit:        fs.effectiveRate(),
 	}
 
 	select {
@@ -418,39 +873,60 @@ func (fs *FileStream) sendProgress() {
 	default:
 		// Channel full, skip this update
 	}
-}
 
-// progressMonitor monitors and broadcasts progress updates
-func (fs *FileStream) progressMonitor() {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	if fs.progress != nil && !fs.delivering {
+		fs.delivering = fs.progress.notify(fs)
+	}
+}
 
+// deliverProgress sends the stream's queued progress updates to its hook and client. It
+// reports false once the client can't be written to, after which updates are no longer delivered.
+func (fs *FileStream) deliverProgress() bool {
 	for {
+		// Updates are queued under the lock, so an empty queue here means none is stranded
+		fs.mutex.Lock()
+		var progress FileTransferProgress
 		select {
-		case <-ticker.C:
-			fs.sendProgress()
-		case progress := <-fs.progressChan:
-			// Send progress to WebSocket
-			progressMsg := map[string]interface{}{
-				"type":     "transfer_progress",
-				"progress": progress,
-			}
+		case progress = <-fs.progressChan:
+		default:
+			fs.delivering = false
+			fs.mutex.Unlock()
+			return true
+		}
+		hook := fs.progressHook
+		fs.mutex.Unlock()
 
-			message, err := json.Marshal(progressMsg)
-			if err != nil {
-				log.Printf("Error marshaling progress: %v", err)
-				continue
-			}
+		if hook != nil {
+			hook(progress)
+		}
 
-			if err := fs.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("Error sending progress: %v", err)
-				return
-			}
-		case <-fs.completeChan:
-			return
-		case err := <-fs.errorChan:
-			log.Printf("File stream error: %v", err)
-			return
+		// Observers are still told of progress the client can't be sent
+		if checkConn(fs.conn) != nil {
+			continue
+		}
+
+		// Send progress to WebSocket
+		progressMsg := map[string]interface{}{
+			"type":     "transfer_progress",
+			"progress": progress,
+		}
+
+		message, err := json.Marshal(progressMsg)
+		if err != nil {
+			log.Printf("Error marshaling progress: %v", err)
+			continue
+		}
+
+		fs.writeMutex.Lock()
+		err = fs.conn.WriteMessage(websocket.TextMessage, message)
+		fs.writeMutex.Unlock()
+		if err != nil {
+			log.Printf("Error sending progress: %v", err)
+			fs.mutex.Lock()
+			fs.progress = nil
+			fs.delivering = false
+			fs.mutex.Unlock()
+			return false
 		}
 	}
 }
@@ -478,6 +954,8 @@ func (fs *FileStream) Resume() {
 	fs.mutex.RUnlock()
 
 	if active && paused {
+		// Time spent paused doesn't count as the transfer going idle
+		fs.touch()
 		select {
 		case fs.resumeChan <- true:
 		default:
@@ -487,16 +965,12 @@ func (fs *FileStream) Resume() {
 
 // Cancel cancels the file transfer
 func (fs *FileStream) Cancel() {
-	fs.mutex.RLock()
-	active := fs.active
-	fs.mutex.RUnlock()
+	fs.workers.Cancel()
+}
 
-	if active {
-		select {
-		case fs.cancelChan <- true:
-		default:
-		}
-	}
+// Wait waits up to timeout for the stream's goroutines to exit, reporting whether they did
+func (fs *FileStream) Wait(timeout time.Duration) bool {
+	return fs.workers.Wait(timeout)
 }
 
 // cleanup performs cleanup operations
@@ -508,14 +982,48 @@ func (fs *FileStream) cleanup() {
 	if fs.file != nil {
 		fs.file.Close()
 	}
+	if fs.chunks != nil {
+		fs.chunks.close()
+	}
+
+	fs.mutex.Lock()
+	pool := fs.progress
+	shared := fs.sharedLimiter
+	fs.sharedLimiter = nil
+	fs.mutex.Unlock()
+	if pool != nil {
+		pool.remove(fs)
+	}
+	// The streams still sending split the shared limit between them
+	if shared != nil {
+		shared.leave()
+	}
+
+	// Nothing else reads the stream's errors, so report why it stopped here
+	select {
+	case err := <-fs.errorChan:
+		log.Printf("File stream error: %v", err)
+	default:
+	}
+
+	// The signalling channels stay open so late Pause, Resume or Cancel calls can't panic
+	fs.workers.Cancel()
+}
 
-	// Close channels
-	close(fs.progressChan)
-	close(fs.errorChan)
-	close(fs.completeChan)
-	close(fs.cancelChan)
-	close(fs.pauseChan)
-	close(fs.resumeChan)
+// transferred returns the bytes moved so far and the share of the total they make up. Uploads count
+// the distinct bytes received, since chunks may arrive out of order. Caller must hold fs.mutex.
+func (fs *FileStream) transferred() (int64, float64) {
+	bytesTransferred := int64(fs.currentChunk) * fs.chunkSize
+	if fs.isUpload {
+		bytesTransferred = fs.receivedBytes
+	}
+	if bytesTransferred > fs.totalSize {
+		bytesTransferred = fs.totalSize
+	}
+	if fs.totalSize <= 0 {
+		return bytesTransferred, 0
+	}
+	return bytesTransferred, float64(bytesTransferred) / float64(fs.totalSize) * 100
 }
 
 // GetProgress returns the current transfer progress
@@ -523,12 +1031,7 @@ func (fs *FileStream) GetProgress() FileTransferProgress {
 	fs.mutex.RLock()
 	defer fs.mutex.RUnlock()
 
-	bytesTransferred := int64(fs.currentChunk) * ChunkSize
-	if bytesTransferred > fs.totalSize {
-		bytesTransferred = fs.totalSize
-	}
-
-	percentage := float64(bytesTransferred) / float64(fs.totalSize) * 100
+	bytesTransferred, percentage := fs.transferred()
 
 	return FileTransferProgress{
 		ID:               fs.transferID,
@@ -536,6 +1039,7 @@ func (fs *FileStream) GetProgress() FileTransferProgress {
 		TotalBytes:       fs.totalSize,
 		Percentage:       percentage,
 		Speed:            fs.bytesPerSec,
+		RateLimit:        fs.effectiveRate(),
 	}
 }
 
@@ -553,6 +1057,13 @@ func (fs *FileStream) IsPaused() bool {
 	return fs.paused
 }
 
+// ReceivedBytes returns the distinct bytes an upload has received, counting resent chunks once
+func (fs *FileStream) ReceivedBytes() int64 {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.receivedBytes
+}
+
 // GetTransferInfo returns basic information about the transfer
 func (fs *FileStream) GetTransferInfo() map[string]interface{} {
 	fs.mutex.RLock()
@@ -574,36 +1085,64 @@ func (fs *FileStream) GetTransferInfo() map[string]interface{} {
 
 // WriteChunk writes a chunk of data to the file
 func (fs *FileStream) WriteChunk(chunkIndex int, data []byte) error {
+	if err := fs.writeChunk(chunkIndex, data); err != nil {
+		return err
+	}
+
+	// Update progress
+	fs.sendProgress()
+
+	return nil
+}
+
+// writeChunk writes a chunk under the stream's lock; progress is sent once it's released
+func (fs *FileStream) writeChunk(chunkIndex int, data []byte) error {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 
 	if !fs.active {
-		return fmt.Errorf("file stream is not active")
+		return fmt.Errorf("%w: file stream is not active", ErrInvalidState)
 	}
 
 	if fs.paused {
-		return fmt.Errorf("file stream is paused")
+		return fmt.Errorf("%w: file stream is paused", ErrInvalidState)
 	}
+	fs.lastActivity = time.Now()
 
-	// Calculate the offset for this chunk
-	offset := int64(chunkIndex) * ChunkSize
+	if err := fs.checkChunkIndex(chunkIndex); err != nil {
+		return err
+	}
 
-	// Seek to the correct position in the file
-	if _, err := fs.file.Seek(offset, 0); err != nil {
-		return fmt.Errorf("failed to seek to chunk position: %v", err)
+	// A chunk larger than negotiated would overwrite the start of the next one
+	if int64(len(data)) > fs.chunkSize {
+		return fmt.Errorf("chunk %d is %d bytes, larger than the %d-byte chunk size", chunkIndex, len(data), fs.chunkSize)
 	}
 
-	// Write the chunk data
-	if _, err := fs.file.Write(data); err != nil {
-		return fmt.Errorf("failed to write chunk data: %v", err)
+	// A resent chunk, or one written before a reconnect, is already on disk
+	if fs.sentChunks[chunkIndex] {
+		fs.currentChunk = chunkIndex + 1
+		return nil
 	}
 
-	// Mark this chunk as received
-	fs.sentChunks[chunkIndex] = true
-	fs.currentChunk = chunkIndex + 1
+	// Reject disallowed content before the rest of the payload arrives
+	if chunkIndex == 0 && fs.contentCheck != nil {
+		if err := fs.contentCheck(data); err != nil {
+			return err
+		}
+	}
 
-	// Update progress
-	fs.sendProgress()
+	// Refuse bytes beyond the declared size before they reach the disk
+	offset := int64(chunkIndex) * fs.chunkSize
+	if fs.maxBytes > 0 {
+		if fs.receivedBytes+int64(len(data)) > fs.maxBytes || offset+int64(len(data)) > fs.maxBytes {
+			return fmt.Errorf("%w: chunk %d passes %d bytes", ErrDeclaredSizeExceeded, chunkIndex, fs.maxBytes)
+		}
+	}
+
+	if err := fs.storeChunk(chunkIndex, data); err != nil {
+		return err
+	}
+	fs.currentChunk = chunkIndex + 1
 
 	return nil
 }
\ No newline at end of file
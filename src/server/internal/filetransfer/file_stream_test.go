@@ -0,0 +1,207 @@
+package filetransfer
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStream_WritesRacingCompletionDontPanic(t *testing.T) {
+	serverConn, _ := newTestConnPair(t)
+
+	fs, err := NewFileStream("race", filepath.Join(t.TempDir(), "upload.bin"), true, serverConn, 0)
+	require.NoError(t, err)
+	require.NoError(t, fs.StartUpload())
+
+	// Chunks keep arriving while the stream completes underneath them
+	var writers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 50; i++ {
+				fs.WriteChunk(w*50+i, []byte("chunk"))
+				fs.GetProgress()
+			}
+		}(w)
+	}
+	time.Sleep(time.Millisecond)
+	fs.cleanup()
+	writers.Wait()
+
+	// The upload worker is blocked reading the connection until it closes
+	serverConn.Close()
+	require.True(t, fs.Wait(5*time.Second))
+
+	// Late chunks are refused and queue no progress
+	queued := len(fs.progressChan)
+	assert.Error(t, fs.WriteChunk(1000, []byte("late")))
+	fs.sendProgress()
+	assert.Equal(t, queued, len(fs.progressChan))
+}
+
+func TestFileStream_RejectsChunkIndicesBeyondDeclaredSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	fs, err := NewFileStream("huge-index", path, true, nil, 0)
+	require.NoError(t, err)
+	fs.mutex.Lock()
+	fs.active = true
+	fs.mutex.Unlock()
+	defer fs.cleanup()
+
+	// Two chunks' worth of declared data
+	fs.SetSizeLimit(ChunkSize + 10)
+
+	assert.ErrorIs(t, fs.WriteChunk(math.MaxInt32, []byte("x")), ErrChunkIndexOutOfRange)
+	assert.ErrorIs(t, fs.WriteChunk(1<<40, []byte("x")), ErrChunkIndexOutOfRange)
+	assert.ErrorIs(t, fs.WriteChunk(-1, []byte("x")), ErrChunkIndexOutOfRange)
+	assert.ErrorIs(t, fs.WriteChunk(2, []byte("x")), ErrChunkIndexOutOfRange)
+
+	// Nothing was seeked to, so no sparse file was grown
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	require.NoError(t, fs.WriteChunk(1, []byte("tail")))
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(ChunkSize+4), info.Size())
+}
+
+func TestFileStream_UsesNegotiatedChunkSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	fs, err := NewFileStream("small-chunks", path, true, nil, 4096)
+	require.NoError(t, err)
+	fs.mutex.Lock()
+	fs.active = true
+	fs.mutex.Unlock()
+	defer fs.cleanup()
+
+	fs.SetSizeLimit(2 * 4096)
+	assert.Error(t, fs.WriteChunk(0, make([]byte, 4097)), "chunks can't exceed the negotiated size")
+	assert.ErrorIs(t, fs.WriteChunk(2, []byte("x")), ErrChunkIndexOutOfRange)
+
+	// Offsets follow the negotiated size, not the default
+	require.NoError(t, fs.WriteChunk(1, []byte("tail")))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4096+4), info.Size())
+}
+
+func TestFileStream_DownloadRespectsTheClientWindow(t *testing.T) {
+	serverConn, clientConn := newTestConnPair(t)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 10*4096/16) // ten 4KB chunks
+	path := filepath.Join(t.TempDir(), "download.bin")
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	fs, err := NewFileStream("windowed", path, false, serverConn, 4096)
+	require.NoError(t, err)
+	fs.SetWindow(3)
+	require.NoError(t, fs.StartDownload())
+	defer func() {
+		fs.Cancel()
+		serverConn.Close()
+		fs.Wait(5 * time.Second)
+	}()
+
+	// A slow receiver: chunks are only read off the socket here, and acknowledged when the test says
+	chunks := make(chan FileChunk, 16)
+	go func() {
+		for {
+			messageType, data, err := clientConn.ReadMessage()
+			if err != nil {
+				close(chunks)
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				continue // progress updates
+			}
+			chunk, err := fs.parseChunk(data)
+			if err != nil {
+				t.Errorf("bad chunk: %v", err)
+				continue
+			}
+			chunks <- chunk
+		}
+	}()
+
+	receive := func(want int) []byte {
+		var received []byte
+		for i := 0; i < want; i++ {
+			select {
+			case chunk := <-chunks:
+				received = append(received, chunk.Data...)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("chunk %d of %d never arrived", i+1, want)
+			}
+		}
+		select {
+		case chunk := <-chunks:
+			t.Fatalf("chunk %d was sent beyond the window", chunk.Sequence)
+		case <-time.After(200 * time.Millisecond):
+		}
+		return received
+	}
+
+	received := receive(3)
+
+	// Acknowledging chunks the server hasn't sent doesn't stretch the window
+	fs.AcknowledgeChunk(1)
+	received = append(received, receive(2)...)
+	fs.AcknowledgeChunk(4)
+	received = append(received, receive(3)...)
+	fs.AcknowledgeChunk(7)
+	received = append(received, receive(2)...)
+
+	assert.Equal(t, content, received)
+}
+
+func TestFileStream_UploadCompletesWhenChunksArriveOutOfOrder(t *testing.T) {
+	serverConn, clientConn := newTestConnPair(t)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 3*4096/16+10) // three full chunks and a tail
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	fs, err := NewFileStream("out-of-order", path, true, serverConn, 4096)
+	require.NoError(t, err)
+	fs.SetTotalSize(int64(len(content)))
+	require.NoError(t, fs.StartUpload())
+	defer func() {
+		fs.Cancel()
+		fs.Wait(5 * time.Second)
+	}()
+
+	// The chunk flagged last goes first, so the others are what finish the upload
+	sender, err := NewFileStream("out-of-order", filepath.Join(t.TempDir(), "unused.bin"), true, clientConn, 4096)
+	require.NoError(t, err)
+	for _, sequence := range []int{3, 1, 0, 2} {
+		data := content[sequence*4096 : min((sequence+1)*4096, len(content))]
+		require.NoError(t, sender.sendChunk(FileChunk{
+			Sequence: sequence,
+			Data:     data,
+			Size:     len(data),
+			IsLast:   sequence == 3,
+			Checksum: sender.calculateChunkChecksum(data),
+		}))
+	}
+
+	select {
+	case <-fs.completeChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload never completed")
+	}
+	require.True(t, fs.Wait(5*time.Second))
+	assert.True(t, fs.ReceivedAll())
+
+	received, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, content, received)
+}
@@ -0,0 +1,37 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// MaxIDLength bounds transfer and session IDs
+const MaxIDLength = 128
+
+// ErrInvalidID is returned for a transfer or session ID that isn't a UUID or other safe identifier
+var ErrInvalidID = errors.New("invalid identifier")
+
+// idPattern admits UUIDs and similar identifiers, and nothing that could act as a path or separator
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// validateID checks an ID against the safe identifier format
+func validateID(kind, id string) error {
+	if len(id) > MaxIDLength {
+		return fmt.Errorf("%w: %s is longer than %d characters", ErrInvalidID, kind, MaxIDLength)
+	}
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("%w: %s %q must be a UUID or contain only letters, digits, '-' and '_'", ErrInvalidID, kind, id)
+	}
+	return nil
+}
+
+// ValidateTransferID checks that a transfer ID is safe to use in file paths and lookups
+func ValidateTransferID(transferID string) error {
+	return validateID("transfer ID", transferID)
+}
+
+// ValidateSessionID checks that a session ID is safe to use in lookups
+func ValidateSessionID(sessionID string) error {
+	return validateID("session ID", sessionID)
+}
@@ -0,0 +1,199 @@
+package filetransfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// InactivityPromptMessage is the message type sent to the client of an idle transfer. The client
+// answers with a transfer_still_active message whose action is "continue" or "abort".
+const InactivityPromptMessage = "transfer_still_active?"
+
+// inactivityPrompt asks the client whether a transfer that has gone without chunks is still active
+type inactivityPrompt struct {
+	Type       string    `json:"type"`
+	TransferID string    `json:"transfer_id"`
+	IdleFor    string    `json:"idle_for"`
+	Deadline   time.Time `json:"deadline"` // the transfer fails unless the client answers by then
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// inactivityCheckPeriod is how often idle transfers are checked: every second, or more often
+// when the interval or timeout is shorter than that
+func inactivityCheckPeriod(config *TransferConfig) time.Duration {
+	period := time.Second
+	if config.InactivityPromptInterval > 0 {
+		period = min(period, config.InactivityPromptInterval/2, config.GetInactivityPromptTimeout()/2)
+	}
+	return max(period, 10*time.Millisecond)
+}
+
+// LastActivity returns when the stream last sent or received a chunk, or had one acknowledged
+func (fs *FileStream) LastActivity() time.Time {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return fs.lastActivity
+}
+
+// touch records activity on the stream
+func (fs *FileStream) touch() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.lastActivity = time.Now()
+}
+
+// sendMessage writes a JSON text message to the stream's connection
+func (fs *FileStream) sendMessage(message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %v", err)
+	}
+	if err := checkConn(fs.conn); err != nil {
+		return err
+	}
+
+	fs.writeMutex.Lock()
+	defer fs.writeMutex.Unlock()
+	fs.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return fs.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// transferStreams returns the streams carrying a transfer, for a directory those of its files.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) transferStreams(session *TransferSession) []*FileStream {
+	ids := []string{session.ID}
+	if session.Request.Type == TransferTypeDirectory {
+		ids = session.Children
+	}
+
+	var streams []*FileStream
+	for _, id := range ids {
+		if fileStream, exists := sm.fileStreams[id]; exists {
+			streams = append(streams, fileStream)
+		}
+	}
+	return streams
+}
+
+// inactivityRoutine periodically prompts the clients of idle transfers
+func (sm *SessionManager) inactivityRoutine(stop <-chan struct{}) {
+	ticker := time.NewTicker(inactivityCheckPeriod(sm.GetConfig()))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sm.checkIdleTransfers()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkIdleTransfers asks the client of each approved or in-progress transfer that has gone
+// without chunks for the inactivity prompt interval whether it's still active, and fails those
+// whose client doesn't answer within the timeout. A slow client keeps sending chunks or answers;
+// a dead one does neither, and its transfer gives up its slot.
+func (sm *SessionManager) checkIdleTransfers() {
+	type idleTransfer struct {
+		id      string
+		stream  *FileStream
+		idleFor time.Duration
+	}
+
+	sm.mutex.RLock()
+	interval := sm.config.InactivityPromptInterval
+	timeout := sm.config.GetInactivityPromptTimeout()
+	if interval <= 0 {
+		sm.mutex.RUnlock()
+		return
+	}
+
+	now := time.Now()
+	var prompts []idleTransfer
+	var expired []string
+	for id, session := range sm.sessions {
+		// A directory's files may wait their turn; it's the directory as a whole that goes idle
+		if session.ParentID != "" {
+			continue
+		}
+		streams := sm.transferStreams(session)
+		if len(streams) == 0 {
+			continue
+		}
+		var lastActivity time.Time
+		for _, fileStream := range streams {
+			if activity := fileStream.LastActivity(); activity.After(lastActivity) {
+				lastActivity = activity
+			}
+		}
+
+		session.mutex.Lock()
+		switch {
+		case session.Status != StatusApproved && session.Status != StatusInProgress:
+			// Paused transfers are idle on purpose
+			session.PromptedAt = nil
+		case session.PromptedAt != nil && lastActivity.After(*session.PromptedAt):
+			// Chunks resumed, or the client answered
+			session.PromptedAt = nil
+		case session.PromptedAt == nil && now.Sub(lastActivity) >= interval:
+			promptedAt := now
+			session.PromptedAt = &promptedAt
+			prompts = append(prompts, idleTransfer{id: id, stream: streams[0], idleFor: now.Sub(lastActivity)})
+		case session.PromptedAt != nil && now.Sub(*session.PromptedAt) >= timeout:
+			expired = append(expired, id)
+		}
+		session.mutex.Unlock()
+	}
+	sm.mutex.RUnlock()
+
+	for _, idle := range prompts {
+		prompt := inactivityPrompt{
+			Type:       InactivityPromptMessage,
+			TransferID: idle.id,
+			IdleFor:    idle.idleFor.Round(time.Millisecond).String(),
+			Deadline:   now.Add(timeout).UTC(),
+			Timestamp:  now.UTC(),
+		}
+		// A client that can't be written to won't answer either, and times out like one that doesn't
+		if err := idle.stream.sendMessage(prompt); err != nil {
+			log.Printf("Error prompting client of idle transfer %s: %v", idle.id, err)
+			continue
+		}
+		log.Printf("Asked client whether idle transfer %s is still active", idle.id)
+	}
+
+	for _, id := range expired {
+		errorMessage := fmt.Sprintf("client did not answer the inactivity prompt within %s", timeout)
+		if err := sm.CompleteTransfer(id, false, errorMessage); err != nil {
+			log.Printf("Error failing idle transfer %s: %v", id, err)
+		}
+	}
+}
+
+// AnswerInactivityPrompt applies the client's answer to an inactivity prompt: "continue" gives
+// the transfer another interval to send chunks in, "abort" cancels it
+func (sm *SessionManager) AnswerInactivityPrompt(transferID, action string) error {
+	switch action {
+	case "continue":
+		sm.mutex.RLock()
+		defer sm.mutex.RUnlock()
+
+		session, exists := sm.sessions[transferID]
+		if !exists {
+			return fmt.Errorf("transfer session %w: %s", ErrNotFound, transferID)
+		}
+		for _, fileStream := range sm.transferStreams(session) {
+			fileStream.touch()
+		}
+		return nil
+	case "abort":
+		return sm.CancelTransfer(transferID)
+	default:
+		return fmt.Errorf("unknown inactivity prompt action: %s", action)
+	}
+}
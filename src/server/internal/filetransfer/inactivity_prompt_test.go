@@ -0,0 +1,107 @@
+package filetransfer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newIdleTestConfig() *TransferConfig {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.MaxConcurrent = 1
+	config.InactivityPromptInterval = 50 * time.Millisecond
+	config.InactivityPromptTimeout = 100 * time.Millisecond
+	return config
+}
+
+func TestSessionManager_ReapsTransferWhoseClientStopsResponding(t *testing.T) {
+	sm := newTestSessionManager(t, newIdleTestConfig(), nil)
+	serverConn, clientConn := newTestConnPair(t)
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, serverConn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(session.ID, true, "Auto-approved"))
+
+	// No chunks arrive, so the client is asked whether it's still there
+	prompt := readJSON(t, clientConn)
+	assert.Equal(t, InactivityPromptMessage, prompt["type"])
+	assert.Equal(t, session.ID, prompt["transfer_id"])
+	assert.NotEmpty(t, prompt["deadline"])
+
+	// It never answers
+	require.Eventually(t, func() bool {
+		status, _ := sm.GetTransferStatus(session.ID)
+		return status == StatusFailed
+	}, 5*time.Second, 10*time.Millisecond)
+
+	sm.mutex.RLock()
+	assert.NotContains(t, sm.fileStreams, session.ID)
+	sm.mutex.RUnlock()
+
+	// The slot is free for the next transfer
+	_, err = sm.CreateTransferSession(&FileTransferRequest{Type: TransferTypeUpload, Filename: "next.txt", FileSize: 10}, serverConn, nil)
+	assert.NoError(t, err)
+
+	var failure *AuditEvent
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == AuditEventTransferFailed && event.TransferID == session.ID {
+			failure = &event
+		}
+	}
+	require.NotNil(t, failure)
+	assert.Contains(t, failure.Details["error_message"], "did not answer the inactivity prompt")
+}
+
+func TestWebSocketHandler_AnsweringTheInactivityPromptKeepsTheTransfer(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	wh := newTestWebSocketHandler(t, newIdleTestConfig(), securityConfig)
+	sm := wh.GetSessionManager()
+	serverConn, clientConn := newTestConnPair(t)
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, serverConn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(session.ID, true, "Auto-approved"))
+
+	answer := func(action string) error {
+		message, err := json.Marshal(map[string]string{
+			"type":        "transfer_still_active",
+			"transfer_id": session.ID,
+			"action":      action,
+		})
+		require.NoError(t, err)
+		return wh.handleTextMessage(serverConn, message)
+	}
+
+	// A slow client answers each prompt and keeps its transfer past the timeout
+	for i := 0; i < 3; i++ {
+		prompt := readJSON(t, clientConn)
+		require.Equal(t, InactivityPromptMessage, prompt["type"])
+		require.NoError(t, answer("continue"))
+	}
+	status, _ := sm.GetTransferStatus(session.ID)
+	assert.Equal(t, StatusApproved, status)
+
+	// Only the transfer's own client may answer for it
+	otherConn, _ := newTestConnPair(t)
+	message, err := json.Marshal(map[string]string{"type": "transfer_still_active", "transfer_id": session.ID, "action": "continue"})
+	require.NoError(t, err)
+	assert.ErrorIs(t, wh.handleTextMessage(otherConn, message), ErrNotFound)
+	assert.ErrorContains(t, answer("later"), "unknown inactivity prompt action")
+
+	require.NoError(t, answer("abort"))
+	status, _ = sm.GetTransferStatus(session.ID)
+	assert.Equal(t, StatusCancelled, status)
+}
@@ -0,0 +1,55 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// maxMetadataKeyLength bounds a metadata key, which is also used as a query filter
+const maxMetadataKeyLength = 64
+
+// ErrInvalidMetadata is returned when a transfer's metadata is malformed or over its limits
+var ErrInvalidMetadata = errors.New("invalid transfer metadata")
+
+// GetMaxMetadataEntries returns how many metadata tags a transfer may carry
+func (c *TransferConfig) GetMaxMetadataEntries() int {
+	if c.MaxMetadataEntries <= 0 {
+		return 16
+	}
+	return c.MaxMetadataEntries
+}
+
+// GetMaxMetadataValueLength returns the longest metadata value allowed, in bytes
+func (c *TransferConfig) GetMaxMetadataValueLength() int {
+	if c.MaxMetadataValueLength <= 0 {
+		return 256
+	}
+	return c.MaxMetadataValueLength
+}
+
+// validateMetadata bounds a transfer's metadata, which is kept with the session and copied
+// into every audit event for it
+func (c *TransferConfig) validateMetadata(metadata map[string]string) error {
+	if len(metadata) > c.GetMaxMetadataEntries() {
+		return fmt.Errorf("%w: %d entries, at most %d allowed", ErrInvalidMetadata, len(metadata), c.GetMaxMetadataEntries())
+	}
+	for key, value := range metadata {
+		if key == "" || len(key) > maxMetadataKeyLength {
+			return fmt.Errorf("%w: keys must be 1 to %d bytes", ErrInvalidMetadata, maxMetadataKeyLength)
+		}
+		if len(value) > c.GetMaxMetadataValueLength() {
+			return fmt.Errorf("%w: value for %q exceeds %d bytes", ErrInvalidMetadata, key, c.GetMaxMetadataValueLength())
+		}
+		if !utf8.ValidString(key) || !utf8.ValidString(value) {
+			return fmt.Errorf("%w: %q is not valid UTF-8", ErrInvalidMetadata, key)
+		}
+	}
+	return nil
+}
+
+// HasMetadata reports whether the transfer was tagged with key, and with value unless value is empty
+func (ts *TransferSession) HasMetadata(key, value string) bool {
+	tagged, exists := ts.Request.Metadata[key]
+	return exists && (value == "" || tagged == value)
+}
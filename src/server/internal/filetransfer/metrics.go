@@ -0,0 +1,50 @@
+package filetransfer
+
+import (
+	"strings"
+)
+
+// Reasons a failed transfer is counted under
+const (
+	FailureChecksumMismatch = "checksum_mismatch"
+	FailureContentRejected  = "content_rejected"
+	FailureSizeExceeded     = "size_exceeded"
+	FailureInactive         = "inactive"
+	FailureFilesFailed      = "files_failed" // some of a directory's files failed
+	FailureOther            = "other"
+)
+
+// TransferMetrics is told about each transfer that finishes, e.g. to export counters for scraping
+type TransferMetrics interface {
+	TransferCompleted(transferType TransferType, bytes int64)
+	TransferFailed(transferType TransferType, bytes int64, reason string)
+}
+
+// SetMetrics sets what finished transfers are reported to
+func (sm *SessionManager) SetMetrics(metrics TransferMetrics) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.metrics = metrics
+}
+
+// failureReason classifies a transfer's error message into one of the Failure reasons
+func failureReason(errorMessage string) string {
+	switch {
+	case strings.Contains(errorMessage, "checksum verification failed"):
+		return FailureChecksumMismatch
+	case strings.Contains(errorMessage, ErrContentRejected.Error()):
+		return FailureContentRejected
+	case strings.Contains(errorMessage, ErrDeclaredSizeExceeded.Error()),
+		strings.Contains(errorMessage, ErrChunkIndexOutOfRange.Error()):
+		return FailureSizeExceeded
+	case strings.Contains(errorMessage, "inactivity prompt"):
+		return FailureInactive
+	default:
+		return FailureOther
+	}
+}
+
+// ConnectionCount returns how many file transfer WebSockets are open
+func (wh *WebSocketHandler) ConnectionCount() int {
+	return int(wh.openConnections.Load())
+}
@@ -0,0 +1,119 @@
+package filetransfer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/lifecycle"
+)
+
+// progressInterval is how often every active transfer reports its progress
+const progressInterval = time.Second
+
+// progressQueueSize bounds the streams waiting for a delivery worker; a stream that doesn't fit
+// keeps its updates queued until the next tick
+const progressQueueSize = 256
+
+// progressPool broadcasts progress for all of a session manager's streams from one ticker and a
+// fixed number of delivery workers, so the goroutine count doesn't grow with the transfer count
+type progressPool struct {
+	mutex    sync.Mutex
+	streams  map[*FileStream]struct{}
+	ready    chan *FileStream // streams with progress queued for delivery
+	interval time.Duration
+	workers  *lifecycle.Group
+}
+
+// newProgressPool starts a pool with the given number of delivery workers
+func newProgressPool(workers int, interval time.Duration) *progressPool {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	pool := &progressPool{
+		streams:  make(map[*FileStream]struct{}),
+		ready:    make(chan *FileStream, progressQueueSize),
+		interval: interval,
+		workers:  lifecycle.NewGroup("progress pool"),
+	}
+	pool.workers.Go("progress ticker", pool.tick)
+	for i := 0; i < workers; i++ {
+		pool.workers.Go("progress worker", pool.deliver)
+	}
+	return pool
+}
+
+// add starts reporting a stream's progress on every tick
+func (p *progressPool) add(fs *FileStream) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.streams[fs] = struct{}{}
+}
+
+// remove stops reporting a stream's progress
+func (p *progressPool) remove(fs *FileStream) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.streams, fs)
+}
+
+// size returns how many streams the pool reports on
+func (p *progressPool) size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.streams)
+}
+
+// notify hands a stream with queued progress to a delivery worker, reporting whether it was taken
+func (p *progressPool) notify(fs *FileStream) bool {
+	select {
+	case p.ready <- fs:
+		return true
+	default:
+		return false
+	}
+}
+
+// tick queues a progress update for every stream once per interval
+func (p *progressPool) tick(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.mutex.Lock()
+			streams := make([]*FileStream, 0, len(p.streams))
+			for fs := range p.streams {
+				streams = append(streams, fs)
+			}
+			p.mutex.Unlock()
+
+			for _, fs := range streams {
+				fs.sendProgress()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// deliver sends queued progress for the streams handed to it
+func (p *progressPool) deliver(stop <-chan struct{}) {
+	for {
+		select {
+		case fs := <-p.ready:
+			if !fs.deliverProgress() {
+				// The client is gone; don't keep trying it every tick
+				p.remove(fs)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stop halts the ticker and workers
+func (p *progressPool) stop() {
+	p.workers.Stop(lifecycle.DefaultStopTimeout)
+}
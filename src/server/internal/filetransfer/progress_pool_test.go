@@ -0,0 +1,65 @@
+package filetransfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionManager_ProgressGoroutinesDontGrowWithTransfers(t *testing.T) {
+	const transfers = 40
+
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.MaxConcurrent = transfers
+	config.ProgressWorkers = 2
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, config, securityConfig)
+
+	// Connections first, so only the transfers' own goroutines are counted
+	serverConns := make([]*websocket.Conn, transfers)
+	clientConns := make([]*websocket.Conn, transfers)
+	for i := range serverConns {
+		serverConns[i], clientConns[i] = newTestConnPair(t)
+	}
+	before := runtime.NumGoroutine()
+
+	for i, conn := range serverConns {
+		session, err := sm.CreateTransferSession(&FileTransferRequest{
+			Type:      TransferTypeUpload,
+			Filename:  fmt.Sprintf("report-%d.txt", i),
+			FileSize:  1024,
+			SessionID: fmt.Sprintf("session-%d", i),
+		}, conn, nil)
+		require.NoError(t, err)
+		require.NoError(t, sm.ApproveTransfer(session.ID, true, ""))
+	}
+	assert.Equal(t, transfers, sm.progress.size())
+
+	// One worker per transfer; progress comes from the shared pool, not a monitor per stream
+	assert.LessOrEqual(t, runtime.NumGoroutine()-before, transfers+2)
+
+	// Each transfer still reports progress on the regular cadence
+	for _, index := range []int{0, transfers - 1} {
+		client := clientConns[index]
+		client.SetReadDeadline(time.Now().Add(3 * progressInterval))
+		_, data, err := client.ReadMessage()
+		require.NoError(t, err)
+		var message map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &message))
+		assert.Equal(t, "transfer_progress", message["type"])
+	}
+
+	// Streams leave the pool as their clients go away
+	for _, conn := range serverConns {
+		conn.Close()
+	}
+	assert.Eventually(t, func() bool { return sm.progress.size() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
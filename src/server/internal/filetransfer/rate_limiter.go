@@ -0,0 +1,89 @@
+package filetransfer
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket pacing sends to a rate in bytes per second. A rate of 0 doesn't
+// limit. One limiter may be shared by several streams, which then split its rate between them.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64     // bytes per second; 0 is unlimited
+	tokens float64   // bytes that may be sent now; negative once sends are reserved ahead
+	last   time.Time // when tokens was last topped up
+	users  int       // streams sharing the limiter
+}
+
+// newRateLimiter creates a limiter for rate bytes per second. It starts empty, so the first
+// second is paced like every other.
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, last: time.Now()}
+}
+
+// setRate changes the limit for sends reserved from now on
+func (rl *rateLimiter) setRate(rate int64) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.refill(time.Now())
+	rl.rate = rate
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before sending them.
+// A send larger than a second's worth is allowed and paid back by the sends after it.
+func (rl *rateLimiter) reserve(n int) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	rl.refill(now)
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / float64(rl.rate) * float64(time.Second))
+}
+
+// refill tops the bucket up for the time since it was last touched, holding at most a
+// second's worth. Caller must hold rl.mutex.
+func (rl *rateLimiter) refill(now time.Time) {
+	if rl.rate > 0 {
+		rl.tokens += now.Sub(rl.last).Seconds() * float64(rl.rate)
+		if rl.tokens > float64(rl.rate) {
+			rl.tokens = float64(rl.rate)
+		}
+	}
+	rl.last = now
+}
+
+// join and leave track the streams sharing the limiter
+func (rl *rateLimiter) join() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.users++
+}
+
+func (rl *rateLimiter) leave() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.users > 0 {
+		rl.users--
+	}
+}
+
+// share returns the rate each of the limiter's streams gets, or 0 when it doesn't limit
+func (rl *rateLimiter) share() int64 {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.rate <= 0 {
+		return 0
+	}
+	if rl.users <= 1 {
+		return rl.rate
+	}
+	return rl.rate / int64(rl.users)
+}
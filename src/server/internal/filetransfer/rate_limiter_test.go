@@ -0,0 +1,93 @@
+package filetransfer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStream_DownloadsShareTheGlobalRateLimit(t *testing.T) {
+	const globalRate = 1024 * 1024
+	content := bytes.Repeat([]byte("0123456789abcdef"), 10*4096) // ten 64KB chunks per download
+
+	global := newRateLimiter(globalRate)
+	var streams []*FileStream
+	var clients []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(t.TempDir(), "download.bin")
+		require.NoError(t, os.WriteFile(path, content, 0644))
+
+		serverConn, clientConn := newTestConnPair(t)
+		fs, err := NewFileStream(fmt.Sprintf("throttled-%d", i), path, false, serverConn, 0)
+		require.NoError(t, err)
+		fs.SetRateLimit(4 * globalRate) // the global limit is the tighter one
+		fs.shareRateLimiter(global)
+		streams = append(streams, fs)
+		clients = append(clients, clientConn)
+	}
+
+	start := time.Now()
+	for _, fs := range streams {
+		require.NoError(t, fs.StartDownload())
+		defer func(fs *FileStream) {
+			fs.Cancel()
+			fs.Wait(5 * time.Second)
+		}(fs)
+	}
+	assert.Equal(t, int64(globalRate/2), streams[0].GetProgress().RateLimit)
+
+	var received sync.WaitGroup
+	for i, client := range clients {
+		received.Add(1)
+		go func(fs *FileStream, client *websocket.Conn) {
+			defer received.Done()
+			var total int
+			for total < len(content) {
+				client.SetReadDeadline(time.Now().Add(10 * time.Second))
+				messageType, data, err := client.ReadMessage()
+				if err != nil {
+					t.Errorf("download stopped after %d bytes: %v", total, err)
+					return
+				}
+				if messageType != websocket.BinaryMessage {
+					continue // progress updates
+				}
+				chunk, err := fs.parseChunk(data)
+				if err != nil {
+					t.Errorf("bad chunk: %v", err)
+					return
+				}
+				total += len(chunk.Data)
+			}
+		}(streams[i], client)
+	}
+	received.Wait()
+	elapsed := time.Since(start)
+
+	rate := float64(2*len(content)) / elapsed.Seconds()
+	assert.InDelta(t, globalRate, rate, globalRate*0.1, "combined throughput was %.0f bytes/s", rate)
+}
+
+func TestRateLimiter_PacesReservations(t *testing.T) {
+	limiter := newRateLimiter(1000)
+	assert.Zero(t, newRateLimiter(0).reserve(1<<30), "a zero rate doesn't limit")
+
+	// An empty bucket makes the first send wait its share of a second
+	assert.InDelta(t, 500*time.Millisecond, limiter.reserve(500), float64(50*time.Millisecond))
+	// Sends reserved ahead queue up behind it
+	assert.InDelta(t, time.Second, limiter.reserve(500), float64(50*time.Millisecond))
+
+	limiter.join()
+	limiter.join()
+	assert.Equal(t, int64(500), limiter.share())
+	limiter.leave()
+	assert.Equal(t, int64(1000), limiter.share())
+}
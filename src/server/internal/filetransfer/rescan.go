@@ -0,0 +1,123 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrNothingToRescan is returned when a transfer has neither a retained completed file nor a quarantined one
+var ErrNothingToRescan = errors.New("transfer has no retained or quarantined file to rescan")
+
+// RescanResult is the outcome of re-scanning a transfer's file
+type RescanResult struct {
+	TransferID  string    `json:"transfer_id"`
+	Filename    string    `json:"filename"`
+	Clean       bool      `json:"clean"`
+	Details     string    `json:"details"`
+	Scanner     string    `json:"scanner"`
+	Quarantined bool      `json:"quarantined"`
+	ScannedAt   time.Time `json:"scanned_at"`
+}
+
+// RescanFile re-runs the malware scanner over a transfer's retained or quarantined file, so files
+// that passed an older signature set can be caught later. A newly detected file is quarantined,
+// and the download endpoint stops serving it.
+func (sm *SessionManager) RescanFile(transferID string) (*RescanResult, error) {
+	session, exists := sm.GetSession(transferID)
+	if !exists {
+		return nil, fmt.Errorf("transfer session %w: %s", ErrNotFound, transferID)
+	}
+
+	sm.mutex.RLock()
+	validator := sm.fileValidator
+	sm.mutex.RUnlock()
+	if validator == nil {
+		return nil, fmt.Errorf("no file validator configured")
+	}
+
+	session.mutex.RLock()
+	status := session.Status
+	stored := session.storedFile()
+	tempPath := stored.path
+	quarantinePath := session.QuarantinePath
+	filename := session.Request.Filename
+	session.mutex.RUnlock()
+
+	if quarantinePath != "" {
+		stored.path = quarantinePath
+	} else if status != StatusCompleted || tempPath == "" {
+		return nil, ErrNothingToRescan
+	}
+
+	// Scan outside the locks, an engine can take a while
+	var scan *MalwareScanResult
+	err := sm.withPlainFile(stored, func(path string) error {
+		var err error
+		scan, err = validator.scanForMalware(path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan file: %v", err)
+	}
+
+	result := &RescanResult{
+		TransferID:  transferID,
+		Filename:    filename,
+		Clean:       scan.Clean,
+		Details:     scan.Details,
+		Scanner:     scan.Scanner,
+		Quarantined: quarantinePath != "",
+		ScannedAt:   time.Now().UTC(),
+	}
+
+	if !scan.Clean && quarantinePath == "" {
+		quarantined, err := sm.quarantineCompletedFile(session, validator, tempPath)
+		if err != nil {
+			return nil, err
+		}
+		result.Quarantined = quarantined
+		if quarantined {
+			sm.logTransferEvent(session, AuditEventFileQuarantined, map[string]interface{}{
+				"filename":     filename,
+				"reason":       "Malware detected on rescan",
+				"scan_results": scan.Details,
+			})
+		}
+	}
+
+	sm.logTransferEvent(session, AuditEventFileRescanned, map[string]interface{}{
+		"filename":     filename,
+		"clean":        scan.Clean,
+		"scanner":      scan.Scanner,
+		"scan_results": scan.Details,
+		"quarantined":  result.Quarantined,
+	})
+
+	return result, nil
+}
+
+// quarantineCompletedFile moves a completed transfer's file into quarantine, unless it was
+// removed or replaced while it was being scanned
+func (sm *SessionManager) quarantineCompletedFile(session *TransferSession, validator *FileValidator, tempPath string) (bool, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.TempPath != tempPath {
+		log.Printf("File for transfer %s changed during rescan, not quarantining", session.ID)
+		return false, nil
+	}
+
+	// Downloads already in flight keep reading the open file; new ones find nothing to serve
+	quarantinePath, err := validator.quarantineFile(tempPath, session.Request.Filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to quarantine file: %v", err)
+	}
+	session.TempPath = ""
+	session.QuarantinePath = quarantinePath
+	return true, nil
+}
@@ -0,0 +1,168 @@
+package filetransfer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flippingScanner reports files clean until its signatures are updated
+type flippingScanner struct {
+	mutex    sync.Mutex
+	detected bool
+}
+
+func (fs *flippingScanner) updateSignatures() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.detected = true
+}
+
+func (fs *flippingScanner) Scan(filePath string) (*MalwareScanResult, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, err
+	}
+	if fs.detected {
+		return &MalwareScanResult{Clean: false, Details: "Eicar-Test-Signature", Scanner: "flipping"}, nil
+	}
+	return &MalwareScanResult{Clean: true, Details: "No threats detected", Scanner: "flipping"}, nil
+}
+
+func TestSessionManager_RescanQuarantinesNewDetections(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	wh := newTestWebSocketHandler(t, nil, securityConfig)
+	sm := wh.sessionManager
+	sm.auditLogger.Stop()
+	sm.auditLogger = NewAuditLogger(t.TempDir(), true)
+	scanner := &flippingScanner{}
+	wh.GetFileValidator().SetMalwareScanner(scanner)
+
+	content := []byte("plain text that a newer signature set flags")
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "notes.txt",
+		FileSize: int64(len(content)),
+	}, nil, nil)
+	require.NoError(t, err)
+
+	_, err = sm.RescanFile(session.ID)
+	assert.ErrorIs(t, err, ErrNothingToRescan, "incomplete transfers have no file to rescan")
+
+	tempPath := filepath.Join(sm.config.TempDir, "transfer_"+session.ID+"_notes.txt")
+	session.TempPath = tempPath
+	require.NoError(t, os.WriteFile(tempPath, content, 0644))
+	require.NoError(t, sm.CompleteTransfer(session.ID, true, ""))
+
+	result, err := sm.RescanFile(session.ID)
+	require.NoError(t, err)
+	assert.True(t, result.Clean)
+	assert.False(t, result.Quarantined)
+	assert.FileExists(t, tempPath)
+
+	// The signatures update and the same file is now flagged
+	scanner.updateSignatures()
+	result, err = sm.RescanFile(session.ID)
+	require.NoError(t, err)
+	assert.False(t, result.Clean)
+	assert.True(t, result.Quarantined)
+	assert.Equal(t, "Eicar-Test-Signature", result.Details)
+
+	assert.NoFileExists(t, tempPath)
+	session.mutex.RLock()
+	quarantinePath := session.QuarantinePath
+	session.mutex.RUnlock()
+	assert.Equal(t, securityConfig.QuarantineDir, filepath.Dir(quarantinePath))
+	quarantined, err := os.ReadFile(quarantinePath)
+	require.NoError(t, err)
+	assert.Equal(t, content, quarantined)
+
+	rec := httptest.NewRecorder()
+	sm.ServeCompletedFile(rec, httptest.NewRequest(http.MethodGet, "/", nil), session.ID)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "quarantined files aren't served")
+
+	// A quarantined file can be rescanned where it lies
+	result, err = sm.RescanFile(session.ID)
+	require.NoError(t, err)
+	assert.True(t, result.Quarantined)
+	assert.FileExists(t, quarantinePath)
+
+	var rescans, quarantines int
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		switch event.EventType {
+		case AuditEventFileRescanned:
+			rescans++
+			assert.Equal(t, session.ID, event.TransferID)
+		case AuditEventFileQuarantined:
+			quarantines++
+			assert.Equal(t, "Malware detected on rescan", event.Details["reason"])
+		}
+	}
+	assert.Equal(t, 3, rescans)
+	assert.Equal(t, 1, quarantines)
+}
+
+func TestSessionManager_CompleteTransferScansUploads(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	securityConfig.ScanForMalware = true
+	wh := newTestWebSocketHandler(t, nil, securityConfig)
+	sm := wh.sessionManager
+	wh.GetFileValidator().SetMalwareScanner(eicarScanner{})
+
+	upload := func(filename string, content []byte, sealed bool) (*TransferSession, string) {
+		session, err := sm.CreateTransferSession(&FileTransferRequest{
+			Type:     TransferTypeUpload,
+			Filename: filename,
+			FileSize: int64(len(content)),
+		}, nil, nil)
+		require.NoError(t, err)
+
+		stored := content
+		if sealed {
+			stored, err = sealStoredChunk(sm.fileEncryptor, content)
+			require.NoError(t, err)
+		}
+		tempPath := filepath.Join(sm.config.TempDir, "transfer_"+session.ID+"_"+filename)
+		require.NoError(t, os.WriteFile(tempPath, stored, 0644))
+		session.mutex.Lock()
+		session.TempPath = tempPath
+		session.SealedAtRest = sealed
+		session.mutex.Unlock()
+		return session, tempPath
+	}
+	statusOf := func(session *TransferSession) TransferStatus {
+		session.mutex.RLock()
+		defer session.mutex.RUnlock()
+		return session.Status
+	}
+
+	clean, _ := upload("notes.txt", []byte("meeting notes"), false)
+	require.NoError(t, sm.CompleteTransfer(clean.ID, true, ""))
+	assert.Equal(t, StatusCompleted, statusOf(clean))
+
+	for filename, sealed := range map[string]bool{"eicar.txt": false, "eicar-sealed.txt": true} {
+		infected, tempPath := upload(filename, []byte(eicar), sealed)
+		err := sm.CompleteTransfer(infected.ID, true, "")
+		require.Error(t, err, "sealed=%v", sealed)
+		assert.Contains(t, err.Error(), "File failed malware scan")
+		assert.Equal(t, StatusFailed, statusOf(infected))
+		assert.NoFileExists(t, tempPath)
+
+		// The file is quarantined as it was sent, even when it was stored sealed
+		infected.mutex.RLock()
+		quarantinePath := infected.QuarantinePath
+		infected.mutex.RUnlock()
+		quarantined, err := os.ReadFile(quarantinePath)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(eicar), quarantined)
+	}
+}
@@ -1,18 +1,23 @@
 package filetransfer
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,11 +28,64 @@ type SecurityConfig struct {
 	BlockedExtensions   []string `json:"blocked_extensions"`
 	MaxFilenameLength   int      `json:"max_filename_length"`
 	ScanForMalware      bool     `json:"scan_for_malware"`
+	ScannerType         string   `json:"scanner_type,omitempty"`    // heuristic (default) or clamav
+	ScannerAddress      string   `json:"scanner_address,omitempty"` // clamd's unix socket path or host:port, for the clamav scanner
 	QuarantineDir       string   `json:"quarantine_dir"`
 	RequireChecksum     bool     `json:"require_checksum"`
 	ChecksumAlgorithm   string   `json:"checksum_algorithm"`
 	EncryptionEnabled   bool     `json:"encryption_enabled"`
 	CompressionEnabled  bool     `json:"compression_enabled"`
+	EncryptionKeyFile   string   `json:"encryption_key_file,omitempty"` // file holding the hex-encoded key
+	AllowEphemeralKey   bool     `json:"allow_ephemeral_key,omitempty"` // development only: generate a throwaway key when none is configured
+	AuditMaskedFields   []string `json:"audit_masked_fields,omitempty"` // detail and metadata keys never written to audit logs in plaintext; "filename" also masks the event's filename
+	AuditMaskMode       string   `json:"audit_mask_mode,omitempty"`     // redact (default) or hash
+	MaxConcurrentCrypto int      `json:"max_concurrent_crypto,omitempty"` // AES-GCM operations run at once; 0 uses GOMAXPROCS
+}
+
+// EncryptionKeyEnv names the environment variable a hex-encoded encryption key can be supplied in
+const EncryptionKeyEnv = "ONLIDESK_ENCRYPTION_KEY"
+
+// ErrNoEncryptionKey is returned when encryption is enabled but no key source is configured
+var ErrNoEncryptionKey = errors.New("encryption is enabled but no encryption key source is configured")
+
+// LoadEncryptionKey sets the encryption key from the configured key file, or failing that the
+// environment. Without either, a throwaway key is only generated when AllowEphemeralKey is set:
+// anything encrypted with it can't be decrypted after a restart.
+func (c *SecurityConfig) LoadEncryptionKey() error {
+	var encoded string
+	switch {
+	case c.EncryptionKeyFile != "":
+		data, err := os.ReadFile(c.EncryptionKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read encryption key file: %v", err)
+		}
+		encoded = string(data)
+	case os.Getenv(EncryptionKeyEnv) != "":
+		encoded = os.Getenv(EncryptionKeyEnv)
+	case !c.EncryptionEnabled || c.AllowEphemeralKey:
+		// Nothing is encrypted with the key unless encryption is enabled
+		if c.EncryptionEnabled {
+			log.Printf("Warning: no encryption key configured, using a throwaway key; encrypted data won't survive a restart")
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("failed to generate encryption key: %v", err)
+		}
+		c.EncryptionKey = key
+		return nil
+	default:
+		return fmt.Errorf("%w: set encryption_key_file or %s, or allow_ephemeral_key for development as config.dev.json does", ErrNoEncryptionKey, EncryptionKeyEnv)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return fmt.Errorf("encryption key is not valid hex: %v", err)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	c.EncryptionKey = key
+	return nil
 }
 
 // DefaultSecurityConfig returns default security configuration
@@ -75,6 +133,7 @@ func DefaultSecurityConfig() *SecurityConfig {
 type FileValidator struct {
 	config      *SecurityConfig
 	auditLogger *AuditLogger
+	scanner     MalwareScanner
 }
 
 // NewFileValidator creates a new file validator
@@ -88,12 +147,27 @@ func NewFileValidator(config *SecurityConfig) *FileValidator {
 		log.Printf("Failed to create quarantine directory: %v", err)
 	}
 
+	auditLogger := NewAuditLogger(securityAuditLogDir, true)
+	auditLogger.SetMask(config.AuditMaskedFields, config.AuditMaskMode)
+
+	scanner, err := NewMalwareScanner(config)
+	if err != nil {
+		log.Printf("Failed to create malware scanner, using the heuristic one: %v", err)
+		scanner = heuristicScanner{}
+	}
+
 	return &FileValidator{
 		config:      config,
-		auditLogger: NewAuditLogger("./logs/security", true),
+		auditLogger: auditLogger,
+		scanner:     scanner,
 	}
 }
 
+// Stop flushes and stops the validator's audit logger
+func (fv *FileValidator) Stop() {
+	fv.auditLogger.Stop()
+}
+
 // ValidationResult represents the result of file validation
 type ValidationResult struct {
 	Valid        bool     `json:"valid"`
@@ -103,6 +177,7 @@ type ValidationResult struct {
 	FileSize     int64    `json:"file_size"`
 	Checksum     string   `json:"checksum"`
 	Quarantined  bool     `json:"quarantined"`
+	QuarantinePath string `json:"-"` // where a quarantined file was moved to
 	ScanResults  string   `json:"scan_results,omitempty"`
 }
 
@@ -139,12 +214,12 @@ func (fv *FileValidator) ValidateFile(filePath, originalFilename string) (*Valid
 	}
 
 	// Detect and validate MIME type
-	mimeType, err := fv.detectMimeType(filePath)
+	mimeType, err := detectMimeType(filePath)
 	if err != nil {
 		result.Warnings = append(result.Warnings, fmt.Sprintf("Failed to detect MIME type: %v", err))
 	} else {
 		result.MimeType = mimeType
-		if err := fv.validateMimeType(mimeType); err != nil {
+		if err := fv.validateMimeType(baseMimeType(mimeType)); err != nil {
 			result.Valid = false
 			result.Errors = append(result.Errors, err.Error())
 			// Log security violation for invalid MIME type
@@ -176,10 +251,11 @@ func (fv *FileValidator) ValidateFile(filePath, originalFilename string) (*Valid
 			fv.auditLogger.LogSecurityViolation("", "", originalFilename, "Malware detected: "+scanResult.Details, "")
 			
 			// Quarantine the file
-			if err := fv.quarantineFile(filePath, originalFilename); err != nil {
+			if quarantinePath, err := fv.quarantineFile(filePath, originalFilename); err != nil {
 				log.Printf("Failed to quarantine file: %v", err)
 			} else {
 				result.Quarantined = true
+				result.QuarantinePath = quarantinePath
 				// Log file quarantine
 				fv.auditLogger.LogTransferProgress("", "", AuditEventFileQuarantined, map[string]interface{}{
 					"filename": originalFilename,
@@ -249,7 +325,7 @@ func (fv *FileValidator) validateFileExtension(filename string) error {
 }
 
 // detectMimeType detects the MIME type of a file
-func (fv *FileValidator) detectMimeType(filePath string) (string, error) {
+func detectMimeType(filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
@@ -263,6 +339,11 @@ func (fv *FileValidator) detectMimeType(filePath string) (string, error) {
 		return "", err
 	}
 
+	return mimeTypeOf(filePath, buffer[:n]), nil
+}
+
+// mimeTypeOf detects the MIME type of a file from its name and leading content
+func mimeTypeOf(filePath string, content []byte) string {
 	// Use Go's built-in MIME type detection
 	mimeType := mime.TypeByExtension(filepath.Ext(filePath))
 	if mimeType == "" {
@@ -270,7 +351,6 @@ func (fv *FileValidator) detectMimeType(filePath string) (string, error) {
 		mimeType = "application/octet-stream" // Default binary type
 		
 		// Simple content-based detection
-		content := buffer[:n]
 		if len(content) >= 4 {
 			// PDF
 			if string(content[:4]) == "%PDF" {
@@ -291,7 +371,92 @@ func (fv *FileValidator) detectMimeType(filePath string) (string, error) {
 		}
 	}
 
-	return mimeType, nil
+	return mimeType
+}
+
+// ErrContentRejected is returned when uploaded content fails type validation
+var ErrContentRejected = errors.New("file content rejected")
+
+// gcmOverhead is the nonce and tag AES-256-GCM adds to each encrypted payload
+const gcmOverhead = 12 + 16
+
+// maxUploadBytes is the most an upload may send for its declared size, allowing for what
+// encryption and compression add to incompressible data
+func maxUploadBytes(declared int64, securityConfig *SecurityConfig) int64 {
+	limit := declared
+	if securityConfig == nil {
+		return limit
+	}
+	if securityConfig.EncryptionEnabled {
+		limit += gcmOverhead
+	}
+	if securityConfig.CompressionEnabled {
+		// Deflate stores incompressible data in 64KB blocks with a 5-byte header, inside an 18-byte gzip frame
+		limit += 5*((declared+65534)/65535) + 18
+	}
+	return limit
+}
+
+// ValidateContent sniffs the leading bytes of an upload and rejects content whose type is not
+// allowed or does not match the declared filename extension
+func (fv *FileValidator) ValidateContent(filename string, head []byte) error {
+	detected := detectContentType(head)
+
+	if err := fv.validateMimeType(detected); err != nil {
+		fv.auditLogger.LogSecurityViolation("", "", filename, "Disallowed content type: "+detected, "")
+		return fmt.Errorf("%w: %v", ErrContentRejected, err)
+	}
+
+	declared := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+	if declared != "" && !contentMatchesDeclared(declared, detected) {
+		fv.auditLogger.LogSecurityViolation("", "", filename, fmt.Sprintf("Content type %s contradicts declared type %s", detected, declared), "")
+		return fmt.Errorf("%w: content type %s does not match declared type %s", ErrContentRejected, detected, declared)
+	}
+
+	return nil
+}
+
+// detectContentType identifies content from its leading bytes, ignoring any filename
+func detectContentType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-shellscript"
+	}
+
+	return baseMimeType(http.DetectContentType(head))
+}
+
+// contentMatchesDeclared reports whether sniffed content is plausible for the declared type
+func contentMatchesDeclared(declared, detected string) bool {
+	declared = baseMimeType(declared)
+
+	switch {
+	case detected == declared:
+		return true
+	case detected == "application/octet-stream":
+		// Nothing recognisable in the header; leave it to the allow list
+		return !strings.HasPrefix(declared, "text/")
+	case detected == "text/plain":
+		// Plain text can legitimately back many text-based formats
+		return strings.HasPrefix(declared, "text/") || strings.HasSuffix(declared, "json") || strings.HasSuffix(declared, "xml")
+	case detected == "application/zip":
+		// Office Open XML, OpenDocument and similar formats are zip containers
+		return strings.Contains(declared, "openxmlformats") || strings.Contains(declared, "opendocument") || strings.Contains(declared, "zip")
+	}
+
+	return false
+}
+
+// baseMimeType strips parameters such as charset from a MIME type
+func baseMimeType(mimeType string) string {
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return strings.TrimSpace(mimeType)
 }
 
 // validateMimeType checks if the MIME type is allowed
@@ -336,8 +501,40 @@ type MalwareScanResult struct {
 	Scanner string `json:"scanner"`
 }
 
-// scanForMalware performs malware scanning (placeholder implementation)
+// MalwareScanner scans a file for malware, e.g. by handing it to an antivirus engine
+type MalwareScanner interface {
+	Scan(filePath string) (*MalwareScanResult, error)
+}
+
+// SetMalwareScanner replaces the scanner files are checked with
+func (fv *FileValidator) SetMalwareScanner(scanner MalwareScanner) {
+	fv.scanner = scanner
+}
+
+// scanForMalware scans a file with the configured scanner
 func (fv *FileValidator) scanForMalware(filePath string) (*MalwareScanResult, error) {
+	return fv.scanner.Scan(filePath)
+}
+
+// ScannerName names the malware scanner backend files are checked with; a scanner can name
+// itself with a Name method
+func (fv *FileValidator) ScannerName() string {
+	if named, ok := fv.scanner.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", fv.scanner)
+}
+
+// heuristicScanner is the default scanner, flagging files by size alone
+type heuristicScanner struct{}
+
+// Name identifies the scanner in capability reports
+func (heuristicScanner) Name() string {
+	return "basic_heuristic"
+}
+
+// Scan performs malware scanning (placeholder implementation)
+func (heuristicScanner) Scan(filePath string) (*MalwareScanResult, error) {
 	// This is a placeholder implementation
 	// In production, this would integrate with antivirus engines like ClamAV
 	
@@ -363,28 +560,60 @@ func (fv *FileValidator) scanForMalware(filePath string) (*MalwareScanResult, er
 	}, nil
 }
 
-// quarantineFile moves a file to quarantine
-func (fv *FileValidator) quarantineFile(filePath, originalFilename string) error {
+// quarantineFile moves a file to quarantine, returning where it now lives
+func (fv *FileValidator) quarantineFile(filePath, originalFilename string) (string, error) {
 	timestamp := time.Now().Format("20060102_150405")
 	quarantinePath := filepath.Join(fv.config.QuarantineDir, fmt.Sprintf("%s_%s", timestamp, originalFilename))
 
-	return os.Rename(filePath, quarantinePath)
+	if err := os.Rename(filePath, quarantinePath); err != nil {
+		return "", err
+	}
+	return quarantinePath, nil
 }
 
 // FileEncryptor handles file encryption and decryption
 type FileEncryptor struct {
-	key []byte
+	key   []byte
+	mutex sync.RWMutex
+	slots chan struct{} // bounds concurrent AES-GCM operations; nil doesn't limit them
 }
 
-// NewFileEncryptor creates a new file encryptor
+// NewFileEncryptor creates a new file encryptor running up to GOMAXPROCS operations at once
 func NewFileEncryptor(key []byte) *FileEncryptor {
 	if len(key) != 32 {
 		panic("encryption key must be 32 bytes for AES-256")
 	}
 
-	return &FileEncryptor{
+	fe := &FileEncryptor{
 		key: key,
 	}
+	fe.SetMaxConcurrent(0)
+	return fe
+}
+
+// SetMaxConcurrent caps how many encryptions and decryptions run at once, so crypto load across
+// many parallel transfers stays predictable. A limit of 0 or less uses GOMAXPROCS.
+func (fe *FileEncryptor) SetMaxConcurrent(limit int) {
+	if limit <= 0 {
+		limit = runtime.GOMAXPROCS(0)
+	}
+
+	fe.mutex.Lock()
+	defer fe.mutex.Unlock()
+	fe.slots = make(chan struct{}, limit)
+}
+
+// acquire waits for a crypto slot and returns the function that releases it
+func (fe *FileEncryptor) acquire() func() {
+	fe.mutex.RLock()
+	slots := fe.slots
+	fe.mutex.RUnlock()
+
+	if slots == nil {
+		return func() {}
+	}
+	slots <- struct{}{}
+	return func() { <-slots }
 }
 
 // EncryptFile encrypts a file using AES-256-GCM
@@ -414,7 +643,9 @@ func (fe *FileEncryptor) EncryptFile(inputPath, outputPath string) error {
 	}
 
 	// Encrypt the data
+	release := fe.acquire()
 	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	release()
 
 	// Write encrypted file
 	if err := os.WriteFile(outputPath, ciphertext, 0644); err != nil {
@@ -454,7 +685,9 @@ func (fe *FileEncryptor) DecryptFile(inputPath, outputPath string) error {
 	ciphertext = ciphertext[nonceSize:]
 
 	// Decrypt the data
+	release := fe.acquire()
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	release()
 	if err != nil {
 		return fmt.Errorf("failed to decrypt: %v", err)
 	}
@@ -488,7 +721,9 @@ func (fe *FileEncryptor) EncryptChunk(data []byte) ([]byte, error) {
 	}
 
 	// Encrypt the data
+	release := fe.acquire()
 	ciphertext := gcm.Seal(nonce, nonce, data, nil)
+	release()
 
 	return ciphertext, nil
 }
@@ -517,7 +752,9 @@ func (fe *FileEncryptor) DecryptChunk(ciphertext []byte) ([]byte, error) {
 	ciphertext = ciphertext[nonceSize:]
 
 	// Decrypt the data
+	release := fe.acquire()
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	release()
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt: %v", err)
 	}
@@ -0,0 +1,168 @@
+package filetransfer
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultViolationWindow is how long identical security violations are coalesced after the first
+const defaultViolationWindow = time.Minute
+
+// violationFlushInterval is how often coalesced violations whose window has passed are written
+const violationFlushInterval = time.Second
+
+// maxCoalescedTransferIDs caps how many distinct transfer IDs a coalesced violation lists
+const maxCoalescedTransferIDs = 20
+
+// violationKey identifies violations that are the same alert. The transfer ID isn't part of it,
+// so a client retrying a refused file under a new transfer each time is still coalesced.
+type violationKey struct {
+	sessionID string
+	filename  string
+	violation string
+	ipAddress string
+}
+
+// violationWindow tracks the repeats of one violation since its first occurrence was logged
+type violationWindow struct {
+	firstSeen   time.Time
+	lastSeen    time.Time
+	repeats     int
+	transferIDs []string // distinct transfers the repeats came from, up to maxCoalescedTransferIDs
+}
+
+// addTransfer records the transfer a repeat came from
+func (w *violationWindow) addTransfer(transferID string) {
+	if transferID == "" || len(w.transferIDs) >= maxCoalescedTransferIDs {
+		return
+	}
+	for _, seen := range w.transferIDs {
+		if seen == transferID {
+			return
+		}
+	}
+	w.transferIDs = append(w.transferIDs, transferID)
+}
+
+// violationCoalescer rate-limits security violations: the first occurrence is logged at once, and
+// identical ones within the window are counted and written as a single event when it closes
+type violationCoalescer struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	pending map[violationKey]*violationWindow
+}
+
+func newViolationCoalescer(window time.Duration) *violationCoalescer {
+	return &violationCoalescer{
+		window:  window,
+		pending: make(map[violationKey]*violationWindow),
+	}
+}
+
+// observe records an occurrence of key. It reports whether it should be logged now, and returns
+// the repeats of an expired window for the same key that must be written first.
+func (vc *violationCoalescer) observe(key violationKey, transferID string, now time.Time) (bool, *violationWindow) {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	if vc.window <= 0 {
+		return true, nil
+	}
+
+	current, exists := vc.pending[key]
+	if exists && now.Sub(current.firstSeen) < vc.window {
+		current.repeats++
+		current.lastSeen = now
+		current.addTransfer(transferID)
+		return false, nil
+	}
+
+	vc.pending[key] = &violationWindow{firstSeen: now, lastSeen: now}
+	if exists && current.repeats > 0 {
+		return true, current
+	}
+	return true, nil
+}
+
+// expire removes the windows that have closed by now, or all of them when all is set, and returns
+// the ones with repeats to write
+func (vc *violationCoalescer) expire(now time.Time, all bool) map[violationKey]*violationWindow {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	expired := make(map[violationKey]*violationWindow)
+	for key, window := range vc.pending {
+		if !all && now.Sub(window.firstSeen) < vc.window {
+			continue
+		}
+		delete(vc.pending, key)
+		if window.repeats > 0 {
+			expired[key] = window
+		}
+	}
+	return expired
+}
+
+// setWindow changes the coalescing window for violations seen from now on
+func (vc *violationCoalescer) setWindow(window time.Duration) {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+	vc.window = window
+}
+
+// SetViolationWindow sets how long identical security violations are coalesced into one event.
+// A window of 0 logs every violation.
+func (al *AuditLogger) SetViolationWindow(window time.Duration) {
+	al.violations.setWindow(window)
+}
+
+// logCoalescedViolation writes the repeats of a violation counted during its window
+func (al *AuditLogger) logCoalescedViolation(key violationKey, window *violationWindow) {
+	transferID := ""
+	if len(window.transferIDs) == 1 {
+		transferID = window.transferIDs[0]
+	}
+
+	al.LogEvent(&AuditEvent{
+		Timestamp:  window.lastSeen,
+		EventType:  AuditEventSecurityViolation,
+		SessionID:  key.sessionID,
+		TransferID: transferID,
+		Filename:   key.filename,
+		IPAddress:  key.ipAddress,
+		Success:    false,
+		ErrorMsg:   key.violation,
+		Severity:   "HIGH",
+		Details: map[string]interface{}{
+			"violation_type": "security",
+			"description":    key.violation,
+			"coalesced":      true,
+			"count":          window.repeats,
+			"first_seen":     window.firstSeen.UTC(),
+			"last_seen":      window.lastSeen.UTC(),
+			"transfer_ids":   window.transferIDs,
+		},
+	})
+}
+
+// flushViolations writes the coalesced violations whose window has closed, or all of them
+func (al *AuditLogger) flushViolations(all bool) {
+	for key, window := range al.violations.expire(al.now(), all) {
+		al.logCoalescedViolation(key, window)
+	}
+}
+
+// flushViolationsPeriodically writes coalesced violations as their windows close
+func (al *AuditLogger) flushViolationsPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(violationFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			al.flushViolations(false)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package filetransfer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLogger_CoalescesRepeatedSecurityViolations(t *testing.T) {
+	al := NewAuditLogger(t.TempDir(), true)
+
+	// An attacker probes a blocked extension over and over
+	for i := 0; i < 100; i++ {
+		al.LogSecurityViolation("", "", "payload.exe", "Blocked file extension: .exe", "203.0.113.7")
+	}
+	al.LogSecurityViolation("", "", "payload.bat", "Blocked file extension: .bat", "203.0.113.7")
+
+	var violations []AuditEvent
+	for _, event := range readAuditEvents(t, al) {
+		if event.EventType == AuditEventSecurityViolation {
+			violations = append(violations, event)
+		}
+	}
+	require.Len(t, violations, 3)
+
+	// The first occurrence is written at once, the repeats as one event when the logger stops
+	assert.Equal(t, "payload.exe", violations[0].Filename)
+	assert.Equal(t, 1.0, violations[0].Details["count"])
+	assert.Nil(t, violations[0].Details["coalesced"])
+
+	assert.Equal(t, "payload.bat", violations[1].Filename)
+	assert.Equal(t, 1.0, violations[1].Details["count"])
+
+	assert.Equal(t, "payload.exe", violations[2].Filename)
+	assert.Equal(t, "203.0.113.7", violations[2].IPAddress)
+	assert.Equal(t, "Blocked file extension: .exe", violations[2].ErrorMsg)
+	assert.Equal(t, true, violations[2].Details["coalesced"])
+	assert.Equal(t, 99.0, violations[2].Details["count"])
+}
+
+func TestAuditLogger_StartsANewViolationWindowOnceItCloses(t *testing.T) {
+	al := NewAuditLogger(t.TempDir(), true)
+	al.SetViolationWindow(50 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		al.LogSecurityViolation("transfer-1", "session-1", "notes.exe", "Blocked file extension: .exe", "")
+	}
+	time.Sleep(100 * time.Millisecond)
+	al.LogSecurityViolation("transfer-1", "session-1", "notes.exe", "Blocked file extension: .exe", "")
+
+	var counts []interface{}
+	for _, event := range readAuditEvents(t, al) {
+		if event.EventType == AuditEventSecurityViolation {
+			counts = append(counts, event.Details["count"])
+		}
+	}
+	// The closed window's repeats are written before the occurrence that opens the next one
+	assert.Equal(t, []interface{}{1.0, 4.0, 1.0}, counts)
+}
+
+func TestAuditLogger_CoalescesViolationsAcrossTransfers(t *testing.T) {
+	al := NewAuditLogger(t.TempDir(), true)
+
+	// Each retry of the refused file comes in as a new transfer
+	for _, transferID := range []string{"transfer-1", "transfer-2", "transfer-3", "transfer-2"} {
+		al.LogSecurityViolation(transferID, "session-1", "payload.exe", "Blocked file extension: .exe", "203.0.113.7")
+	}
+
+	var violations []AuditEvent
+	for _, event := range readAuditEvents(t, al) {
+		if event.EventType == AuditEventSecurityViolation {
+			violations = append(violations, event)
+		}
+	}
+	require.Len(t, violations, 2)
+	assert.Equal(t, "transfer-1", violations[0].TransferID)
+	assert.Equal(t, 3.0, violations[1].Details["count"])
+	assert.Equal(t, []interface{}{"transfer-2", "transfer-3"}, violations[1].Details["transfer_ids"])
+	assert.Empty(t, violations[1].TransferID)
+}
+
+func TestAuditLogger_ZeroViolationWindowLogsEveryViolation(t *testing.T) {
+	al := NewAuditLogger(t.TempDir(), true)
+	al.SetViolationWindow(0)
+
+	for i := 0; i < 3; i++ {
+		al.LogSecurityViolation("", "", "", "checksum mismatch", "")
+	}
+
+	var violations int
+	for _, event := range readAuditEvents(t, al) {
+		if event.EventType == AuditEventSecurityViolation {
+			violations++
+		}
+	}
+	assert.Equal(t, 3, violations)
+}
@@ -0,0 +1,120 @@
+package filetransfer
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurityConfig_LoadEncryptionKeyRequiresAKeySource(t *testing.T) {
+	t.Setenv(EncryptionKeyEnv, "")
+	key := strings.Repeat("ab", 32)
+
+	t.Run("no source", func(t *testing.T) {
+		config := &SecurityConfig{EncryptionEnabled: true}
+		assert.ErrorIs(t, config.LoadEncryptionKey(), ErrNoEncryptionKey)
+		assert.Empty(t, config.EncryptionKey, "no throwaway key is generated")
+	})
+
+	t.Run("development flag", func(t *testing.T) {
+		config := &SecurityConfig{EncryptionEnabled: true, AllowEphemeralKey: true}
+		require.NoError(t, config.LoadEncryptionKey())
+		assert.Len(t, config.EncryptionKey, 32)
+	})
+
+	t.Run("encryption disabled", func(t *testing.T) {
+		config := &SecurityConfig{}
+		require.NoError(t, config.LoadEncryptionKey())
+		assert.Len(t, config.EncryptionKey, 32)
+	})
+
+	t.Run("key file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "transfer.key")
+		require.NoError(t, os.WriteFile(path, []byte(key+"\n"), 0600))
+		config := &SecurityConfig{EncryptionEnabled: true, EncryptionKeyFile: path}
+		require.NoError(t, config.LoadEncryptionKey())
+		assert.Equal(t, key, hex.EncodeToString(config.EncryptionKey))
+
+		config.EncryptionKeyFile = filepath.Join(t.TempDir(), "missing.key")
+		assert.Error(t, config.LoadEncryptionKey())
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv(EncryptionKeyEnv, key)
+		config := &SecurityConfig{EncryptionEnabled: true}
+		require.NoError(t, config.LoadEncryptionKey())
+		assert.Equal(t, key, hex.EncodeToString(config.EncryptionKey))
+
+		t.Setenv(EncryptionKeyEnv, "abcd")
+		assert.Error(t, config.LoadEncryptionKey(), "short keys are refused")
+	})
+}
+
+func TestFileEncryptor_BoundsConcurrentOperations(t *testing.T) {
+	fe := NewFileEncryptor(make([]byte, 32))
+	assert.Equal(t, runtime.GOMAXPROCS(0), cap(fe.slots), "defaults to GOMAXPROCS")
+
+	fe.SetMaxConcurrent(2)
+	first, second := fe.acquire(), fe.acquire()
+
+	// A third operation waits for a slot
+	acquired := make(chan func())
+	go func() { acquired <- fe.acquire() }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a third slot with a limit of 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("a released slot wasn't handed on")
+	}
+	second()
+
+	// Operations still round-trip under the limit
+	ciphertext, err := fe.EncryptChunk([]byte("bounded"))
+	require.NoError(t, err)
+	plaintext, err := fe.DecryptChunk(ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "bounded", string(plaintext))
+}
+
+// BenchmarkFileEncryptor_ConcurrentChunks encrypts 64KB chunks from many more goroutines than
+// there are CPUs, as many parallel transfers would, with and without the crypto slot limit
+func BenchmarkFileEncryptor_ConcurrentChunks(b *testing.B) {
+	chunk := make([]byte, 64*1024)
+	for _, bounded := range []bool{false, true} {
+		name := "unbounded"
+		if bounded {
+			name = "bounded"
+		}
+		b.Run(name, func(b *testing.B) {
+			fe := NewFileEncryptor(make([]byte, 32))
+			if !bounded {
+				fe.slots = nil
+			}
+			b.SetBytes(int64(len(chunk)))
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := fe.EncryptChunk(chunk); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package filetransfer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// SelfTest checks at startup what transfers otherwise only find out mid-transfer: that the temp
+// and quarantine directories and the given audit log directories can be written to, and that the
+// encryption key round-trips data. The first problem found is returned.
+func SelfTest(config *TransferConfig, securityConfig *SecurityConfig, auditLogDirs []string) error {
+	if err := checkWritableDir(config.TempDir); err != nil {
+		return fmt.Errorf("temp dir: %v", err)
+	}
+	if err := checkWritableDir(securityConfig.QuarantineDir); err != nil {
+		return fmt.Errorf("quarantine dir: %v", err)
+	}
+	for _, dir := range auditLogDirs {
+		if err := checkWritableDir(dir); err != nil {
+			return fmt.Errorf("audit log dir: %v", err)
+		}
+	}
+	if err := checkEncryption(securityConfig.EncryptionKey); err != nil {
+		return fmt.Errorf("encryption: %v", err)
+	}
+	// The validator falls back to the heuristic scanner, which mustn't happen silently when scanning
+	if securityConfig.ScanForMalware {
+		if _, err := NewMalwareScanner(securityConfig); err != nil {
+			return fmt.Errorf("malware scanner: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkWritableDir creates dir if needed, then writes, reads back and removes a probe file in it
+func checkWritableDir(dir string) error {
+	if dir == "" {
+		return fmt.Errorf("no directory configured")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create %s: %v", dir, err)
+	}
+
+	probe, err := os.CreateTemp(dir, ".selftest-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	defer os.Remove(probe.Name())
+
+	content := []byte("onlidesk self-test")
+	if _, err := probe.Write(content); err != nil {
+		probe.Close()
+		return fmt.Errorf("cannot write to %s: %v", dir, err)
+	}
+	if err := probe.Close(); err != nil {
+		return fmt.Errorf("cannot write to %s: %v", dir, err)
+	}
+	if written, err := os.ReadFile(probe.Name()); err != nil || !bytes.Equal(written, content) {
+		return fmt.Errorf("cannot read back a file written to %s", dir)
+	}
+	if err := os.Remove(probe.Name()); err != nil {
+		return fmt.Errorf("cannot delete from %s: %v", dir, err)
+	}
+	return nil
+}
+
+// checkEncryption encrypts and decrypts a test buffer with the configured key
+func checkEncryption(key []byte) error {
+	// NewFileEncryptor panics on a bad key, so check it here first
+	if len(key) != 32 {
+		return fmt.Errorf("key is %d bytes, AES-256 needs 32", len(key))
+	}
+
+	encryptor := NewFileEncryptor(key)
+	plaintext := []byte("onlidesk encryption self-test")
+	ciphertext, err := encryptor.EncryptChunk(plaintext)
+	if err != nil {
+		return err
+	}
+	decrypted, err := encryptor.DecryptChunk(ciphertext)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		return fmt.Errorf("decrypted data doesn't match what was encrypted")
+	}
+	return nil
+}
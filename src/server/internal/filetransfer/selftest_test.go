@@ -0,0 +1,72 @@
+package filetransfer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest_FailsFastOnUnusableStorageOrCrypto(t *testing.T) {
+	newConfigs := func() (*TransferConfig, *SecurityConfig, []string) {
+		config := DefaultTransferConfig()
+		config.TempDir = filepath.Join(t.TempDir(), "temp")
+		securityConfig := DefaultSecurityConfig()
+		securityConfig.QuarantineDir = filepath.Join(t.TempDir(), "quarantine")
+		return config, securityConfig, []string{filepath.Join(t.TempDir(), "audit")}
+	}
+
+	config, securityConfig, auditDirs := newConfigs()
+	require.NoError(t, SelfTest(config, securityConfig, auditDirs))
+	entries, err := os.ReadDir(config.TempDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "probe files are cleaned up")
+
+	t.Run("read-only temp dir", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("permission bits don't restrict root")
+		}
+		config, securityConfig, auditDirs := newConfigs()
+		readOnly := t.TempDir()
+		require.NoError(t, os.Chmod(readOnly, 0555))
+		t.Cleanup(func() { os.Chmod(readOnly, 0755) })
+		config.TempDir = readOnly
+
+		err := SelfTest(config, securityConfig, auditDirs)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "temp dir")
+		assert.Contains(t, err.Error(), readOnly)
+	})
+
+	t.Run("quarantine path is a file", func(t *testing.T) {
+		config, securityConfig, auditDirs := newConfigs()
+		blocker := filepath.Join(t.TempDir(), "not-a-dir")
+		require.NoError(t, os.WriteFile(blocker, nil, 0644))
+		securityConfig.QuarantineDir = filepath.Join(blocker, "quarantine")
+
+		err := SelfTest(config, securityConfig, auditDirs)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "quarantine dir")
+	})
+
+	t.Run("audit dir can't be created", func(t *testing.T) {
+		config, securityConfig, _ := newConfigs()
+		blocker := filepath.Join(t.TempDir(), "logs")
+		require.NoError(t, os.WriteFile(blocker, nil, 0644))
+
+		err := SelfTest(config, securityConfig, []string{filepath.Join(blocker, "sessions")})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "audit log dir")
+	})
+
+	t.Run("bad encryption key", func(t *testing.T) {
+		config, securityConfig, auditDirs := newConfigs()
+		securityConfig.EncryptionKey = []byte("too short")
+
+		err := SelfTest(config, securityConfig, auditDirs)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "encryption")
+	})
+}
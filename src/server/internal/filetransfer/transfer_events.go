@@ -0,0 +1,195 @@
+package filetransfer
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Transfer lifecycle event types emitted on the event stream
+const (
+	TransferEventCreated   = "created"
+	TransferEventApproved  = "approved"
+	TransferEventRejected  = "rejected"
+	TransferEventProgress  = "progress"
+	TransferEventPaused    = "paused"
+	TransferEventResumed   = "resumed"
+	TransferEventCompleted = "completed"
+	TransferEventFailed    = "failed"
+	TransferEventCancelled = "cancelled"
+)
+
+// transferEventBuffer is how many events a subscriber may fall behind before events are dropped
+const transferEventBuffer = 256
+
+// transferProgressInterval limits how often progress is published for a single transfer
+const transferProgressInterval = time.Second
+
+// lifecycleEventTypes maps audited transfer events onto stream event types
+var lifecycleEventTypes = map[AuditEventType]string{
+	AuditEventTransferPaused:    TransferEventPaused,
+	AuditEventTransferResumed:   TransferEventResumed,
+	AuditEventTransferCompleted: TransferEventCompleted,
+	AuditEventTransferFailed:    TransferEventFailed,
+	AuditEventTransferCancelled: TransferEventCancelled,
+}
+
+// TransferEvent is a single transfer state change as emitted on the event stream
+type TransferEvent struct {
+	Type             string                 `json:"type"`
+	TransferID       string                 `json:"transfer_id"`
+	SessionID        string                 `json:"session_id,omitempty"`
+	Filename         string                 `json:"filename,omitempty"`
+	TransferType     TransferType           `json:"transfer_type,omitempty"`
+	FileSize         int64                  `json:"file_size,omitempty"`
+	BytesTransferred int64                  `json:"bytes_transferred,omitempty"`
+	Percentage       float64                `json:"percentage,omitempty"`
+	Metadata         map[string]string      `json:"metadata,omitempty"`
+	Details          map[string]interface{} `json:"details,omitempty"`
+	Timestamp        time.Time              `json:"timestamp"`
+}
+
+// TransferEventHub fans transfer events out to stream subscribers
+type TransferEventHub struct {
+	subscribers  map[chan TransferEvent]struct{}
+	lastProgress map[string]TransferEvent
+	mutex        sync.Mutex
+}
+
+// NewTransferEventHub creates an event hub with no subscribers
+func NewTransferEventHub() *TransferEventHub {
+	return &TransferEventHub{
+		subscribers:  make(map[chan TransferEvent]struct{}),
+		lastProgress: make(map[string]TransferEvent),
+	}
+}
+
+// Subscribe registers a subscriber and returns its event channel and a function to unsubscribe
+func (h *TransferEventHub) Subscribe() (<-chan TransferEvent, func()) {
+	events := make(chan TransferEvent, transferEventBuffer)
+
+	h.mutex.Lock()
+	h.subscribers[events] = struct{}{}
+	h.mutex.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			h.mutex.Lock()
+			delete(h.subscribers, events)
+			h.mutex.Unlock()
+		})
+	}
+}
+
+// Publish delivers an event to every subscriber, dropping it for subscribers that have fallen behind
+func (h *TransferEventHub) Publish(event TransferEvent) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	switch event.Type {
+	case TransferEventProgress:
+		// Skip repeats and updates arriving faster than the progress interval
+		last, seen := h.lastProgress[event.TransferID]
+		if seen && (last.BytesTransferred == event.BytesTransferred || event.Timestamp.Sub(last.Timestamp) < transferProgressInterval) {
+			return
+		}
+		h.lastProgress[event.TransferID] = event
+	case TransferEventCompleted, TransferEventFailed, TransferEventCancelled, TransferEventRejected:
+		delete(h.lastProgress, event.TransferID)
+	}
+
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			log.Printf("Transfer event subscriber is behind, dropping %s event for %s", event.Type, event.TransferID)
+		}
+	}
+}
+
+// newTransferEvent builds a stream event describing the session's transfer
+func newTransferEvent(eventType string, session *TransferSession, details map[string]interface{}) TransferEvent {
+	return TransferEvent{
+		Type:         eventType,
+		TransferID:   session.ID,
+		SessionID:    session.Request.SessionID,
+		Filename:     session.Request.Filename,
+		TransferType: session.Request.Type,
+		FileSize:     session.Request.FileSize,
+		Metadata:     session.Request.Metadata,
+		Details:      details,
+		Timestamp:    time.Now().UTC(),
+	}
+}
+
+// logTransferEvent audits a transfer lifecycle event and publishes it to stream subscribers
+func (sm *SessionManager) logTransferEvent(session *TransferSession, eventType AuditEventType, details map[string]interface{}) {
+	sm.auditLogger.LogEvent(&AuditEvent{
+		EventType:  eventType,
+		SessionID:  session.Request.SessionID,
+		TransferID: session.ID,
+		Success:    true,
+		Details:    details,
+		Metadata:   session.Request.Metadata,
+	})
+	if streamType, ok := lifecycleEventTypes[eventType]; ok {
+		sm.events.Publish(newTransferEvent(streamType, session, details))
+	}
+}
+
+// publishProgress publishes a progress update for the session's transfer
+func (sm *SessionManager) publishProgress(session *TransferSession, progress FileTransferProgress) {
+	session.mutex.Lock()
+	session.Progress = &progress
+	session.mutex.Unlock()
+
+	event := newTransferEvent(TransferEventProgress, session, nil)
+	event.BytesTransferred = progress.BytesTransferred
+	event.Percentage = progress.Percentage
+	sm.events.Publish(event)
+}
+
+// SubscribeTransferEvents returns a channel of transfer lifecycle events and a function to unsubscribe
+func (sm *SessionManager) SubscribeTransferEvents() (<-chan TransferEvent, func()) {
+	return sm.events.Subscribe()
+}
+
+// HandleTransferStream streams transfer lifecycle events as newline-delimited JSON until the client disconnects
+func (wh *WebSocketHandler) HandleTransferStream(w http.ResponseWriter, r *http.Request) {
+	events, unsubscribe := wh.sessionManager.SubscribeTransferEvents()
+	defer unsubscribe()
+
+	// The stream outlives the server's write timeout
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		log.Printf("Transfer stream does not support flushing: %v", err)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
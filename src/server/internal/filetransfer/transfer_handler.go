@@ -19,8 +19,9 @@ import (
 type TransferType string
 
 const (
-	TransferTypeUpload   TransferType = "upload"
-	TransferTypeDownload TransferType = "download"
+	TransferTypeUpload    TransferType = "upload"
+	TransferTypeDownload  TransferType = "download"
+	TransferTypeDirectory TransferType = "directory" // an upload of several files, listed in the manifest
 )
 
 // TransferStatus defines the current status of a transfer
@@ -37,6 +38,15 @@ const (
 	StatusFailed     TransferStatus = "failed"
 )
 
+// IsTerminal reports whether a transfer in this status has finished for good
+func (s TransferStatus) IsTerminal() bool {
+	switch s {
+	case StatusCompleted, StatusCancelled, StatusFailed, StatusRejected:
+		return true
+	}
+	return false
+}
+
 // FileTransferRequest represents a file transfer request
 type FileTransferRequest struct {
 	ID          string       `json:"id"`
@@ -45,18 +55,27 @@ type FileTransferRequest struct {
 	Filename    string       `json:"filename"`
 	FileSize    int64        `json:"file_size"`
 	Checksum    string       `json:"checksum,omitempty"`
+	ChecksumAlgorithm string `json:"checksum_algorithm,omitempty"`
 	Timestamp   time.Time    `json:"timestamp"`
 	Technician  string       `json:"technician"`
+	ChunkSize   int          `json:"chunk_size,omitempty"` // the client's preferred chunk size; the server replies with the one agreed
+	Metadata    map[string]string `json:"metadata,omitempty"` // client tags, e.g. a ticket number, for later correlation
+	Manifest    []ManifestEntry   `json:"manifest,omitempty"` // the files of a directory transfer
+	Owner       string            `json:"-"` // authenticated subject whose connection requested the transfer; set by the server
 }
 
 // FileTransferResponse represents a response to a transfer request
 type FileTransferResponse struct {
-	Type       string    `json:"type"`
-	TransferID string    `json:"transfer_id"`
-	Status     string    `json:"status"`
-	Message    string    `json:"message,omitempty"`
-	Approved   bool      `json:"approved"`
-	Timestamp  time.Time `json:"timestamp"`
+	Type          string    `json:"type"`
+	TransferID    string    `json:"transfer_id"`
+	Status        string    `json:"status"`
+	Message       string    `json:"message,omitempty"`
+	Approved      bool      `json:"approved"`
+	ChunkSize     int       `json:"chunk_size,omitempty"`     // negotiated for the transfer
+	Window        int       `json:"window,omitempty"`         // download chunks the server sends ahead of the client's acknowledgements
+	MissingChunks []int     `json:"missing_chunks,omitempty"` // chunks a resumed upload still needs
+	Manifest      []ManifestEntry `json:"manifest,omitempty"` // a directory transfer's files, with the transfer ID to send each one's chunks under
+	Timestamp     time.Time `json:"timestamp"`
 }
 
 // FileTransferProgress represents transfer progress information
@@ -67,6 +86,7 @@ type FileTransferProgress struct {
 	Percentage      float64 `json:"percentage"`
 	Speed           int64   `json:"speed"` // bytes per second
 	ETA             int64   `json:"eta"`   // estimated time remaining in seconds
+	RateLimit       int64   `json:"rate_limit,omitempty"` // bytes per second the transfer is held to; 0 when unthrottled
 }
 
 // FileChunk represents a chunk of file data
@@ -77,6 +97,8 @@ type FileChunk struct {
 	Size        int    `json:"size"`
 	IsLast      bool   `json:"is_last"`
 	Checksum    string `json:"checksum"`
+	Compressed  bool   `json:"compressed,omitempty"` // Data is gzipped; Checksum covers it as sent
+	Encrypted   bool   `json:"encrypted,omitempty"`  // Data is AES-256-GCM sealed, after any compression
 }
 
 // FileTransferChunk represents a chunk of file data for WebSocket transfer
@@ -86,6 +108,8 @@ type FileTransferChunk struct {
 	Data       []byte `json:"data"`
 	Checksum   string `json:"checksum"`
 	IsLast     bool   `json:"is_last"`
+	Compressed bool   `json:"compressed,omitempty"` // Data is gzipped
+	Encrypted  bool   `json:"encrypted,omitempty"`  // Data is AES-256-GCM sealed, after any compression
 }
 
 // TransferSession manages an active file transfer
@@ -95,18 +119,29 @@ type TransferSession struct {
 	Status       TransferStatus
 	StartTime    time.Time
 	EndTime      *time.Time
+	ApprovedAt   *time.Time
 	BytesTransferred int64
 	TotalChunks  int
 	ReceivedChunks map[int]bool
 	File         *os.File
 	TempPath     string
+	QuarantinePath string // where the file was moved once flagged as malware
 	Checksum     string
+	SealedAtRest bool // the temp file holds the upload's chunks encrypted, see SealStoredChunks
+	Progress     *FileTransferProgress // latest snapshot, still reported once the stream is gone
+	PromptedAt   *time.Time // when the client was asked whether the idle transfer is still active, until it answers
+	DetachedAt   *time.Time // when the connection sending the upload dropped, until the upload is resumed
+	ParentID     string   // the directory transfer this file belongs to, if any
+	Children     []string // a directory transfer's file transfers, in manifest order
 	ClientConn   *websocket.Conn
 	PortalConn   *websocket.Conn
 	mutex        sync.RWMutex
 }
 
-// TransferHandler manages file transfer operations
+// TransferHandler manages file transfer operations.
+//
+// Deprecated: the server routes transfers through WebSocketHandler, whose SessionManager keeps
+// completed files for the download endpoint. This handler deletes them as soon as they complete.
 type TransferHandler struct {
 	activeSessions map[string]*TransferSession
 	maxFileSize    int64
@@ -116,16 +151,30 @@ type TransferHandler struct {
 	mutex          sync.RWMutex
 }
 
-// NewTransferHandler creates a new file transfer handler
+// NewTransferHandler creates a new file transfer handler, carrying on if the temp directory can't
+// be created
 func NewTransferHandler(maxFileSize int64, allowedTypes []string, tempDir string) *TransferHandler {
-	allowedTypesMap := make(map[string]bool)
-	for _, ext := range allowedTypes {
-		allowedTypesMap[ext] = true
+	handler, err := NewTransferHandlerE(maxFileSize, allowedTypes, tempDir)
+	if err != nil {
+		log.Printf("Transfers will fail until the temp directory exists: %v", err)
+		handler = newTransferHandler(maxFileSize, allowedTypes, tempDir)
 	}
+	return handler
+}
 
-	// Create temp directory if it doesn't exist
+// NewTransferHandlerE creates a new file transfer handler, failing if the temp directory can't be created
+func NewTransferHandlerE(maxFileSize int64, allowedTypes []string, tempDir string) (*TransferHandler, error) {
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		log.Printf("Failed to create temp directory: %v", err)
+		return nil, fmt.Errorf("failed to create temp directory %s: %v", tempDir, err)
+	}
+	return newTransferHandler(maxFileSize, allowedTypes, tempDir), nil
+}
+
+// newTransferHandler creates a transfer handler without touching the temp directory
+func newTransferHandler(maxFileSize int64, allowedTypes []string, tempDir string) *TransferHandler {
+	allowedTypesMap := make(map[string]bool)
+	for _, ext := range allowedTypes {
+		allowedTypesMap[ext] = true
 	}
 
 	// Initialize audit logger
@@ -234,7 +283,7 @@ func (h *TransferHandler) handleNewTransferRequest(conn *websocket.Conn, message
 		ID:             request.ID,
 		Request:        &request,
 		Status:         StatusPending,
-		StartTime:      time.Now(),
+		StartTime:      time.Now().UTC(),
 		ReceivedChunks: make(map[int]bool),
 		PortalConn:     conn,
 	}
@@ -303,6 +352,8 @@ func (h *TransferHandler) handleTransferResponse(conn *websocket.Conn, message [
 		log.Printf("Transfer approved: %s", response.TransferID)
 	} else {
 		session.Status = StatusRejected
+		now := time.Now().UTC()
+		session.EndTime = &now
 		// Log transfer rejection
 		h.auditLogger.LogTransferApproval(response.TransferID, session.Request.SessionID, false, response.Message, "")
 		log.Printf("Transfer rejected: %s", response.TransferID)
@@ -414,7 +465,7 @@ func (h *TransferHandler) completeTransfer(session *TransferSession) {
 	}
 
 	session.Status = StatusCompleted
-	now := time.Now()
+	now := time.Now().UTC()
 	session.EndTime = &now
 
 	// Log successful transfer completion
@@ -490,6 +541,10 @@ func (h *TransferHandler) sendJSON(conn *websocket.Conn, data interface{}) {
 		return
 	}
 
+	if err := checkConn(conn); err != nil {
+		log.Printf("Error sending message: %v", err)
+		return
+	}
 	if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
 		log.Printf("Error sending message: %v", err)
 	}
@@ -0,0 +1,144 @@
+package filetransfer
+
+import (
+	"sort"
+	"time"
+)
+
+// defaultHistorySize is how many finished transfers are remembered when HistorySize isn't set
+const defaultHistorySize = 1000
+
+// TransferSummary describes a finished transfer, kept after its session is cleaned up
+type TransferSummary struct {
+	ID         string         `json:"id"`
+	ParentID   string         `json:"parent_id,omitempty"` // the directory transfer the file belonged to
+	SessionID  string         `json:"session_id"`
+	Filename   string         `json:"filename"`
+	FileSize   int64          `json:"file_size"`
+	Type       TransferType   `json:"type"`
+	Status     TransferStatus `json:"status"`
+	Technician string         `json:"technician"`
+	Duration   time.Duration  `json:"duration"`
+	EndTime    time.Time      `json:"end_time"`
+}
+
+// TransferHistoryFilter narrows and pages a transfer history query; empty fields match everything
+type TransferHistoryFilter struct {
+	Status     TransferStatus
+	Technician string
+	Offset     int
+	Limit      int // 0 returns every match after Offset
+}
+
+// matches reports whether a summary passes the filter's status and technician
+func (f TransferHistoryFilter) matches(summary TransferSummary) bool {
+	if f.Status != "" && summary.Status != f.Status {
+		return false
+	}
+	return f.Technician == "" || summary.Technician == f.Technician
+}
+
+// transferHistory is a ring buffer of the most recently cleaned up transfers
+type transferHistory struct {
+	entries []TransferSummary
+	start   int // index of the oldest entry once the buffer is full
+}
+
+// newTransferHistory creates a history remembering up to size transfers
+func newTransferHistory(size int) *transferHistory {
+	return &transferHistory{entries: make([]TransferSummary, 0, size)}
+}
+
+// add remembers a transfer, dropping the oldest when the buffer is full
+func (h *transferHistory) add(summary TransferSummary) {
+	if cap(h.entries) == 0 {
+		return
+	}
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, summary)
+		return
+	}
+	h.entries[h.start] = summary
+	h.start = (h.start + 1) % len(h.entries)
+}
+
+// list returns the remembered transfers, oldest first
+func (h *transferHistory) list() []TransferSummary {
+	result := make([]TransferSummary, 0, len(h.entries))
+	result = append(result, h.entries[h.start:]...)
+	return append(result, h.entries[:h.start]...)
+}
+
+// resize changes how many transfers are remembered, keeping the most recent
+func (h *transferHistory) resize(size int) {
+	if size == cap(h.entries) {
+		return
+	}
+	entries := h.list()
+	if len(entries) > size {
+		entries = entries[len(entries)-size:]
+	}
+	h.entries = append(make([]TransferSummary, 0, size), entries...)
+	h.start = 0
+}
+
+// summarizeTransfer captures a finished session for the history. Caller must hold session.mutex.
+func summarizeTransfer(session *TransferSession) TransferSummary {
+	endTime := session.StartTime
+	if session.EndTime != nil {
+		endTime = *session.EndTime
+	}
+
+	return TransferSummary{
+		ID:         session.ID,
+		ParentID:   session.ParentID,
+		SessionID:  session.Request.SessionID,
+		Filename:   session.Request.Filename,
+		FileSize:   session.Request.FileSize,
+		Type:       session.Request.Type,
+		Status:     session.Status,
+		Technician: session.Request.Technician,
+		Duration:   endTime.Sub(session.StartTime),
+		EndTime:    endTime,
+	}
+}
+
+// GetTransferHistory returns finished transfers matching the filter, most recently ended first, along
+// with how many matched before paging. It covers transfers still held for retention as well as
+// the last HistorySize ones cleaned up.
+func (sm *SessionManager) GetTransferHistory(filter TransferHistoryFilter) ([]TransferSummary, int) {
+	sm.mutex.RLock()
+	summaries := sm.history.list()
+	for _, session := range sm.sessions {
+		session.mutex.RLock()
+		if session.Status.IsTerminal() {
+			summaries = append(summaries, summarizeTransfer(session))
+		}
+		session.mutex.RUnlock()
+	}
+	sm.mutex.RUnlock()
+
+	matches := make([]TransferSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		if filter.matches(summary) {
+			matches = append(matches, summary)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].EndTime.After(matches[j].EndTime)
+	})
+
+	total := len(matches)
+	start := filter.Offset
+	if start < 0 {
+		start = 0
+	}
+	if start > total {
+		start = total
+	}
+	end := total
+	if filter.Limit > 0 && start+filter.Limit < total {
+		end = start + filter.Limit
+	}
+	return matches[start:end], total
+}
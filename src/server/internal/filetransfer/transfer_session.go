@@ -2,15 +2,24 @@ package filetransfer
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+
+	"github.com/onlitec/onlidesk-server/internal/clientnet"
+	"github.com/onlitec/onlidesk-server/internal/clock"
+	"github.com/onlitec/onlidesk-server/internal/configdiff"
+	"github.com/onlitec/onlidesk-server/internal/idgen"
+	"github.com/onlitec/onlidesk-server/internal/lifecycle"
 )
 
 // SessionManager manages all active file transfer sessions
@@ -20,10 +29,33 @@ type SessionManager struct {
 	config          *TransferConfig
 	mutex           sync.RWMutex
 	cleanupTicker   *time.Ticker
-	shutdownChan    chan bool
+	workers         *lifecycle.Group
 	auditLogger     *AuditLogger
+	securityConfig  *SecurityConfig
+	fileValidator   *FileValidator
+	fileEncryptor   *FileEncryptor // seals chunks on the wire when encryption is enabled
+	events          *TransferEventHub
+	authorizer      TransferAuthorizer
+	downloadGrants  map[string]*ClientDownloadGrant // sessionID -> exception to AllowClientDownloads
+	servedFiles     map[string]*servedFile          // temp path -> downloads in progress, which hold off its removal
+	idGenerator     idgen.Generator
+	progress        *progressPool // delivers progress for every stream from a fixed set of goroutines
+	rateLimiter     *rateLimiter  // holds all downloads together to GlobalRateLimit
+	metrics         TransferMetrics // counts finished transfers when set
+	history         *transferHistory // finished transfers remembered after cleanup
+	clock           clock.Clock      // times transfers, approval grace periods and cleanup
+	writers         connWriters      // one write mutex per connection, shared by its streams and responses
 }
 
+// ErrTransferNotPending is returned when deciding a transfer that has already been rejected or has moved past approval
+var ErrTransferNotPending = errors.New("transfer is not awaiting approval")
+
+// ErrRejectionReasonRequired is returned when rejecting a transfer without a reason while the policy requires one
+var ErrRejectionReasonRequired = errors.New("a reason is required to reject a transfer")
+
+// TransferAuthorizer decides whether a transfer request may proceed, returning an error to refuse it
+type TransferAuthorizer func(request *FileTransferRequest) error
+
 // TransferConfig holds configuration for file transfers
 type TransferConfig struct {
 	MaxFileSize      int64             `json:"max_file_size"`
@@ -32,14 +64,38 @@ type TransferConfig struct {
 	MaxConcurrent    int               `json:"max_concurrent"`
 	TransferTimeout  time.Duration     `json:"transfer_timeout"`
 	CleanupInterval  time.Duration     `json:"cleanup_interval"`
-	RateLimit        int64             `json:"rate_limit"` // bytes per second
+	RateLimit        int64             `json:"rate_limit"` // bytes per second, per download; 0 is unlimited
+	GlobalRateLimit  int64             `json:"global_rate_limit"` // bytes per second across all downloads; 0 is unlimited
 	RequireApproval  bool              `json:"require_approval"`
+	ApprovalSizeThreshold int64        `json:"approval_size_threshold"` // bytes; when set, overrides RequireApproval
+	RequireRejectionReason bool        `json:"require_rejection_reason"` // rejecting a transfer needs a non-empty message
 	AuditLog         bool              `json:"audit_log"`
 	VirusScan        bool              `json:"virus_scan"`
 	EncryptFiles     bool              `json:"encrypt_files"`
 	CompressionLevel int               `json:"compression_level"`
+	CompressionAlgorithm string        `json:"compression_algorithm"` // for chunks when security_config enables compression; only "gzip" is supported
 	RetryAttempts    int               `json:"retry_attempts"`
 	ChunkSize        int               `json:"chunk_size"`
+	MinChunkSize     int               `json:"min_chunk_size"` // bounds on the chunk size a client may negotiate; 0 keeps ChunkSize fixed
+	MaxChunkSize     int               `json:"max_chunk_size"`
+	DownloadWindow   int               `json:"download_window"` // chunks a download may send ahead of the client's acknowledgements; 0 disables flow control
+	ReadIdleTimeout  time.Duration     `json:"read_idle_timeout"`    // max wait for the next message
+	MinUploadBandwidth int64           `json:"min_upload_bandwidth"` // bytes per second a slow but valid client must sustain
+	ApprovalGracePeriod time.Duration  `json:"approval_grace_period"` // how long an approved upload may wait for its first chunk; 0 disables
+	DetachedUploadTimeout time.Duration `json:"detached_upload_timeout"` // how long an upload whose connection dropped waits to be resumed before it fails; 0 uses 10m
+	InactivityPromptInterval time.Duration `json:"inactivity_prompt_interval"` // how long a transfer may go without chunks before the client is asked whether it's still there; 0 disables
+	InactivityPromptTimeout time.Duration `json:"inactivity_prompt_timeout"` // how long the client has to answer before the transfer fails; 0 uses 30s
+	AllowClientDownloads bool          `json:"allow_client_downloads"` // pull files from the client without a per-session grant
+	ClientDownloadGrantDuration time.Duration `json:"client_download_grant_duration"` // how long a per-session grant lasts; 0 uses 1h
+	DownloadTimeout  time.Duration     `json:"download_timeout"` // longest a client may take to fetch a completed file; 0 uses 10m
+	RetainCompletedFiles bool          `json:"retain_completed_files"` // keep completed uploads for download until they age out, instead of deleting them on completion
+	CompletedRetention time.Duration   `json:"completed_retention"` // how long finished transfers and their files are kept; 0 uses 1h
+	MaxMetadataEntries int             `json:"max_metadata_entries"` // metadata tags a transfer may carry; 0 uses 16
+	MaxMetadataValueLength int         `json:"max_metadata_value_length"` // longest metadata value in bytes; 0 uses 256
+	ProgressWorkers  int               `json:"progress_workers"` // goroutines delivering progress for all transfers; 0 uses 4
+	HistorySize      int               `json:"history_size"` // finished transfers remembered after cleanup for the history; 0 uses 1000
+	AllowedOrigins   []string          `json:"allowed_origins"` // browser origins that may open a transfer WebSocket; "*" allows any, empty only the server's own, unset any
+	TrustedProxies   []string          `json:"trusted_proxies"` // CIDRs of proxies whose X-Forwarded-For and X-Real-IP are believed; empty trusts none
 }
 
 // DefaultTransferConfig returns default configuration
@@ -57,9 +113,167 @@ func DefaultTransferConfig() *TransferConfig {
 		VirusScan:        false,
 		EncryptFiles:     true,
 		CompressionLevel: 6,
+		CompressionAlgorithm: CompressionGzip,
 		RetryAttempts:    3,
 		ChunkSize:        64 * 1024, // 64KB
+		MinChunkSize:     4 * 1024,    // 4KB
+		MaxChunkSize:     1024 * 1024, // 1MB
+		DownloadWindow:   0, // opt-in, as clients that don't acknowledge chunks would stall
+		ReadIdleTimeout:  60 * time.Second,
+		MinUploadBandwidth: 1024, // 1KB/s
+		ApprovalGracePeriod: 2 * time.Minute,
+		DetachedUploadTimeout: 10 * time.Minute,
+		ClientDownloadGrantDuration: time.Hour,
+		DownloadTimeout:  10 * time.Minute,
+		RetainCompletedFiles: true,
+		CompletedRetention: time.Hour,
+		MaxMetadataEntries: 16,
+		MaxMetadataValueLength: 256,
+		ProgressWorkers:  4,
+		HistorySize:      defaultHistorySize,
+		AllowedOrigins:   []string{"*"},
+	}
+}
+
+// GetProgressWorkers returns how many goroutines deliver progress updates, however many transfers run
+func (c *TransferConfig) GetProgressWorkers() int {
+	if c.ProgressWorkers <= 0 {
+		return 4
+	}
+	return c.ProgressWorkers
+}
+
+// GetHistorySize returns how many finished transfers the history remembers after cleanup
+func (c *TransferConfig) GetHistorySize() int {
+	if c.HistorySize <= 0 {
+		return defaultHistorySize
+	}
+	return c.HistorySize
+}
+
+// RequiresApproval reports whether a transfer of the given size needs manual approval.
+// A positive ApprovalSizeThreshold auto-approves smaller transfers and holds larger ones for review,
+// otherwise the blanket RequireApproval setting applies.
+func (c *TransferConfig) RequiresApproval(fileSize int64) bool {
+	if c.ApprovalSizeThreshold > 0 {
+		return fileSize >= c.ApprovalSizeThreshold
 	}
+	return c.RequireApproval
+}
+
+// isAllowedType reports whether the filename's extension is one of AllowedTypes, when any are set
+func (c *TransferConfig) isAllowedType(filename string) bool {
+	if len(c.AllowedTypes) == 0 {
+		return true
+	}
+	ext := filepath.Ext(filename)
+	for _, allowedType := range c.AllowedTypes {
+		if ext == allowedType {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCompressionAlgorithm returns the algorithm compressed chunks use, or "" when compression is off
+func (c *TransferConfig) GetCompressionAlgorithm(enabled bool) string {
+	if !enabled {
+		return ""
+	}
+	if c.CompressionAlgorithm == "" {
+		return CompressionGzip
+	}
+	return strings.ToLower(c.CompressionAlgorithm)
+}
+
+// GetReadIdleTimeout returns how long to wait for the next message before dropping the connection
+func (c *TransferConfig) GetReadIdleTimeout() time.Duration {
+	if c.ReadIdleTimeout <= 0 {
+		return 60 * time.Second
+	}
+	return c.ReadIdleTimeout
+}
+
+// GetDetachedUploadTimeout returns how long a paused upload without a connection is kept for resuming
+func (c *TransferConfig) GetDetachedUploadTimeout() time.Duration {
+	if c.DetachedUploadTimeout <= 0 {
+		return 10 * time.Minute
+	}
+	return c.DetachedUploadTimeout
+}
+
+// GetClientDownloadGrantDuration returns how long a session may pull files from the client once granted
+func (c *TransferConfig) GetClientDownloadGrantDuration() time.Duration {
+	if c.ClientDownloadGrantDuration <= 0 {
+		return time.Hour
+	}
+	return c.ClientDownloadGrantDuration
+}
+
+// GetInactivityPromptTimeout returns how long the client of an idle transfer has to answer the prompt
+func (c *TransferConfig) GetInactivityPromptTimeout() time.Duration {
+	if c.InactivityPromptTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return c.InactivityPromptTimeout
+}
+
+// GetDownloadTimeout returns how long a client may take to fetch a completed file
+func (c *TransferConfig) GetDownloadTimeout() time.Duration {
+	if c.DownloadTimeout <= 0 {
+		return 10 * time.Minute
+	}
+	return c.DownloadTimeout
+}
+
+// NegotiateChunkSize returns the chunk size for a transfer: the client's requested size held within the
+// configured bounds, or the configured size when it didn't ask for one or no bounds are set
+func (c *TransferConfig) NegotiateChunkSize(requested int) int {
+	size := c.ChunkSize
+	if size <= 0 {
+		size = ChunkSize
+	}
+	if requested <= 0 || c.MinChunkSize <= 0 || c.MaxChunkSize <= 0 {
+		return size
+	}
+
+	if requested < c.MinChunkSize {
+		return c.MinChunkSize
+	}
+	if requested > c.MaxChunkSize {
+		return c.MaxChunkSize
+	}
+	return requested
+}
+
+// GetAllowedOrigins returns the browser origins that may open a transfer WebSocket. Config files
+// written before the setting existed leave it unset and keep allowing any origin.
+func (c *TransferConfig) GetAllowedOrigins() []string {
+	if c.AllowedOrigins == nil {
+		return []string{"*"}
+	}
+	return c.AllowedOrigins
+}
+
+// GetCompletedRetention returns how long finished transfers are kept before cleanup
+func (c *TransferConfig) GetCompletedRetention() time.Duration {
+	if c.CompletedRetention <= 0 {
+		return time.Hour
+	}
+	return c.CompletedRetention
+}
+
+// ChunkReadTimeout returns the read budget for one chunk at the minimum expected bandwidth,
+// never less than the idle timeout
+func (c *TransferConfig) ChunkReadTimeout() time.Duration {
+	timeout := c.GetReadIdleTimeout()
+	if c.MinUploadBandwidth > 0 && c.ChunkSize > 0 {
+		expected := time.Duration(float64(c.ChunkSize) / float64(c.MinUploadBandwidth) * float64(time.Second))
+		if expected > timeout {
+			timeout = expected
+		}
+	}
+	return timeout
 }
 
 // AuditLogEntry represents an audit log entry for file transfers
@@ -80,28 +294,56 @@ type AuditLogEntry struct {
 	UserAgent    string        `json:"user_agent"`
 }
 
-// NewSessionManager creates a new session manager
+// NewSessionManager creates a new session manager. If the temp directory can't be created it
+// carries on regardless and every transfer fails until it exists; servers should use
+// NewSessionManagerE and refuse to start instead.
 func NewSessionManager(config *TransferConfig) *SessionManager {
 	if config == nil {
 		config = DefaultTransferConfig()
 	}
 
-	// Ensure temp directory exists
+	sm, err := NewSessionManagerE(config)
+	if err != nil {
+		log.Printf("Transfers will fail until the temp directory exists: %v", err)
+		sm = newSessionManager(config)
+	}
+	return sm
+}
+
+// NewSessionManagerE creates a new session manager, failing if the temp directory can't be created
+func NewSessionManagerE(config *TransferConfig) (*SessionManager, error) {
+	if config == nil {
+		config = DefaultTransferConfig()
+	}
+
 	if err := os.MkdirAll(config.TempDir, 0755); err != nil {
-		log.Printf("Failed to create temp directory: %v", err)
+		return nil, fmt.Errorf("failed to create temp directory %s: %v", config.TempDir, err)
 	}
+	return newSessionManager(config), nil
+}
 
+// newSessionManager creates a session manager and starts its background routines
+func newSessionManager(config *TransferConfig) *SessionManager {
 	sm := &SessionManager{
 		sessions:      make(map[string]*TransferSession),
 		fileStreams:   make(map[string]*FileStream),
 		config:        config,
 		cleanupTicker: time.NewTicker(config.CleanupInterval),
-		shutdownChan:  make(chan bool),
-		auditLogger:   NewAuditLogger("./logs/sessions", true),
+		workers:       lifecycle.NewGroup("transfer session manager"),
+		auditLogger:   NewAuditLogger(sessionAuditLogDir, true),
+		events:        NewTransferEventHub(),
+		downloadGrants: make(map[string]*ClientDownloadGrant),
+		servedFiles:    make(map[string]*servedFile),
+		idGenerator:    idgen.UUID{},
+		progress:       newProgressPool(config.GetProgressWorkers(), progressInterval),
+		rateLimiter:    newRateLimiter(config.GlobalRateLimit),
+		history:        newTransferHistory(config.GetHistorySize()),
+		clock:          clock.Real{},
 	}
 
 	// Start cleanup routine
-	go sm.cleanupRoutine()
+	sm.workers.Go("cleanup routine", sm.cleanupRoutine)
+	sm.workers.Go("inactivity prompts", sm.inactivityRoutine)
 
 	return sm
 }
@@ -111,34 +353,99 @@ func (sm *SessionManager) CreateTransferSession(request *FileTransferRequest, cl
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
-	// Check if we've reached the maximum concurrent transfers
-	if len(sm.sessions) >= sm.config.MaxConcurrent {
-		return nil, fmt.Errorf("maximum concurrent transfers reached (%d)", sm.config.MaxConcurrent)
+	// Client-supplied IDs end up in file paths and map keys, so reject anything malformed first
+	if request.ID != "" {
+		if err := ValidateTransferID(request.ID); err != nil {
+			return nil, err
+		}
+		if _, exists := sm.sessions[request.ID]; exists {
+			return nil, fmt.Errorf("transfer %s already exists", request.ID)
+		}
+	}
+	if request.SessionID != "" {
+		if err := ValidateSessionID(request.SessionID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check if we've reached the maximum concurrent transfers; finished sessions kept for auditing don't count
+	active := 0
+	for _, existing := range sm.sessions {
+		existing.mutex.RLock()
+		if !existing.Status.IsTerminal() && existing.ParentID == "" { // a directory's files count as one transfer
+			active++
+		}
+		existing.mutex.RUnlock()
+	}
+	if active >= sm.config.MaxConcurrent {
+		return nil, fmt.Errorf("%w (%d)", ErrMaxConcurrent, sm.config.MaxConcurrent)
+	}
+
+	// A directory is checked file by file, and its size is theirs combined
+	directory := request.Type == TransferTypeDirectory
+	if directory {
+		if err := sm.validateManifest(request); err != nil {
+			return nil, err
+		}
 	}
 
 	// Validate file size
 	if request.FileSize > sm.config.MaxFileSize {
-		return nil, fmt.Errorf("file size (%d bytes) exceeds maximum allowed size (%d bytes)", request.FileSize, sm.config.MaxFileSize)
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d bytes", ErrFileTooLarge, request.FileSize, sm.config.MaxFileSize)
 	}
 
 	// Validate file type
-	if len(sm.config.AllowedTypes) > 0 {
-		ext := filepath.Ext(request.Filename)
-		allowed := false
-		for _, allowedType := range sm.config.AllowedTypes {
-			if ext == allowedType {
-				allowed = true
-				break
-			}
-		}
-		if !allowed {
-			return nil, fmt.Errorf("file type %s is not allowed", ext)
-		}
+	if !directory && !sm.config.isAllowedType(request.Filename) {
+		return nil, fmt.Errorf("%w: %s", ErrTypeNotAllowed, filepath.Ext(request.Filename))
 	}
 
 	// Generate unique transfer ID if not provided
 	if request.ID == "" {
-		request.ID = uuid.New().String()
+		transferID, err := idgen.Unique(sm.idGenerator, func(id string) bool {
+			_, exists := sm.sessions[id]
+			return exists
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate transfer ID: %w", err)
+		}
+		request.ID = transferID
+	}
+
+	if err := sm.config.validateMetadata(request.Metadata); err != nil {
+		return nil, err
+	}
+
+	// Settle the chunk size now; the response tells the client what was agreed
+	request.ChunkSize = sm.config.NegotiateChunkSize(request.ChunkSize)
+
+	// Refuse requests that would skip integrity verification; a directory's files carry their own checksums
+	if !directory {
+		if err := sm.validateChecksumRequest(request); err != nil {
+			sm.auditLogger.LogSecurityViolation(request.ID, request.SessionID, request.Filename, err.Error(), "")
+			return nil, err
+		}
+	}
+
+	// Let the owning session's policy refuse the transfer, e.g. a blocked direction
+	if sm.authorizer != nil {
+		if err := sm.authorizer(request); err != nil {
+			sm.auditLogger.LogTransferProgress(request.ID, request.SessionID, AuditEventTransferRejected, map[string]interface{}{
+				"transfer_type": request.Type,
+				"filename":      request.Filename,
+				"reason":        err.Error(),
+			})
+			return nil, err
+		}
+	}
+
+	// Downloads from the client need the global default or a justified grant for the session
+	if err := sm.checkClientDownload(request); err != nil {
+		sm.auditLogger.LogTransferProgress(request.ID, request.SessionID, AuditEventTransferRejected, map[string]interface{}{
+			"transfer_type": request.Type,
+			"filename":      request.Filename,
+			"reason":        err.Error(),
+		})
+		return nil, err
 	}
 
 	// Create transfer session
@@ -146,19 +453,30 @@ func (sm *SessionManager) CreateTransferSession(request *FileTransferRequest, cl
 		ID:             request.ID,
 		Request:        request,
 		Status:         StatusPending,
-		StartTime:      time.Now(),
+		StartTime:      sm.clock.Now().UTC(),
 		ReceivedChunks: make(map[int]bool),
 		ClientConn:     clientConn,
 		PortalConn:     portalConn,
 	}
+	var children []*TransferSession
+	if directory {
+		var err error
+		if children, err = sm.newDirectoryChildren(session); err != nil {
+			return nil, err
+		}
+	}
 
 	// Store session
 	sm.sessions[request.ID] = session
+	for _, child := range children {
+		sm.sessions[child.ID] = child
+	}
+	sm.events.Publish(newTransferEvent(TransferEventCreated, session, nil))
 
 	// Log audit entry
 	if sm.config.AuditLog {
 		sm.logAuditEntry(&AuditLogEntry{
-			Timestamp:    time.Now(),
+			Timestamp:    time.Now().UTC(),
 			TransferID:   request.ID,
 			SessionID:    request.SessionID,
 			Technician:   request.Technician,
@@ -184,90 +502,255 @@ func (sm *SessionManager) GetSession(transferID string) (*TransferSession, bool)
 
 // ApproveTransfer approves a pending transfer
 func (sm *SessionManager) ApproveTransfer(transferID string, approved bool, message string) error {
+	if err := ValidateTransferID(transferID); err != nil {
+		return err
+	}
+
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
 	session, exists := sm.sessions[transferID]
 	if !exists {
-		return fmt.Errorf("transfer session not found: %s", transferID)
+		return fmt.Errorf("transfer session %w: %s", ErrNotFound, transferID)
+	}
+	if session.ParentID != "" {
+		return fmt.Errorf("%w: transfer %s is part of directory transfer %s, which is approved as a whole", ErrInvalidState, transferID, session.ParentID)
+	}
+	// A directory of empty files is complete as soon as it's approved
+	if session.Request.Type == TransferTypeDirectory {
+		defer sm.settleDirectory(transferID)
 	}
 
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
 
 	if session.Status != StatusPending {
-		return fmt.Errorf("transfer is not in pending state: %s", session.Status)
+		// Approving again is a no-op until the transfer finishes
+		if approved && session.ApprovedAt != nil && (session.Status == StatusApproved || session.Status == StatusInProgress || session.Status == StatusPaused) {
+			return nil
+		}
+		return fmt.Errorf("%w: transfer is %s", ErrTransferNotPending, session.Status)
+	}
+
+	if !approved && sm.config.RequireRejectionReason && strings.TrimSpace(message) == "" {
+		return ErrRejectionReasonRequired
 	}
 
 	if approved {
 		session.Status = StatusApproved
+		approvedAt := sm.clock.Now().UTC()
+		session.ApprovedAt = &approvedAt
 
-		// Create temporary file path
-		tempPath := filepath.Join(sm.config.TempDir, fmt.Sprintf("transfer_%s_%s", transferID, session.Request.Filename))
-		session.TempPath = tempPath
-
-		// Create file stream
-		fileStream, err := NewFileStream(transferID, tempPath, session.Request.Type == TransferTypeUpload, session.ClientConn)
-		if err != nil {
-			return fmt.Errorf("failed to create file stream: %v", err)
-		}
-
-		sm.fileStreams[transferID] = fileStream
-
-		// Start the appropriate transfer process
-		if session.Request.Type == TransferTypeUpload {
-			if err := fileStream.StartUpload(); err != nil {
-				return fmt.Errorf("failed to start upload: %v", err)
+		if session.Request.Type == TransferTypeDirectory {
+			if err := sm.approveDirectory(session); err != nil {
+				return err
 			}
+			log.Printf("Directory transfer approved and started: %s", transferID)
+		} else if err := sm.startTransferStream(session); err != nil {
+			return err
 		} else {
-			if err := fileStream.StartDownload(); err != nil {
-				return fmt.Errorf("failed to start download: %v", err)
-			}
+			log.Printf("Transfer approved and started: %s", transferID)
 		}
-
-		log.Printf("Transfer approved and started: %s", transferID)
 	} else {
 		session.Status = StatusRejected
+		rejectedAt := sm.clock.Now().UTC()
+		session.EndTime = &rejectedAt
+		sm.endDirectoryChildren(session, StatusRejected)
 		log.Printf("Transfer rejected: %s", transferID)
 	}
 
 	// Log audit entry using new audit system
 	if approved {
 		sm.auditLogger.LogTransferApproval(transferID, session.Request.SessionID, true, message, session.Request.Technician)
-		sm.auditLogger.LogTransferProgress(transferID, session.Request.SessionID, AuditEventTransferStarted, map[string]interface{}{
+		sm.logTransferEvent(session, AuditEventTransferStarted, map[string]interface{}{
 			"filename":      session.Request.Filename,
 			"file_size":     session.Request.FileSize,
 			"transfer_type": session.Request.Type,
 			"technician":    session.Request.Technician,
 			"temp_path":     session.TempPath,
 		})
+		sm.events.Publish(newTransferEvent(TransferEventApproved, session, map[string]interface{}{"message": message}))
 	} else {
 		sm.auditLogger.LogTransferApproval(transferID, session.Request.SessionID, false, message, session.Request.Technician)
+		sm.events.Publish(newTransferEvent(TransferEventRejected, session, map[string]interface{}{"message": message}))
+	}
+
+	return nil
+}
+
+// startTransferStream creates an approved transfer's temp file path and starts its file stream.
+// Caller must hold sm.mutex and session.mutex.
+func (sm *SessionManager) startTransferStream(session *TransferSession) error {
+	// Create temporary file path
+	tempPath := filepath.Join(sm.config.TempDir, fmt.Sprintf("transfer_%s_%s", session.ID, session.Request.Filename))
+	session.TempPath = tempPath
+
+	// Create file stream
+	fileStream, err := sm.newTransferStream(session, session.ClientConn, false)
+	if err != nil {
+		return err
 	}
+	sm.fileStreams[session.ID] = fileStream
 
+	// Start the appropriate transfer process
+	if session.Request.Type == TransferTypeUpload {
+		if err := fileStream.StartUpload(); err != nil {
+			return fmt.Errorf("failed to start upload: %v", err)
+		}
+	} else {
+		// The window must be in place before the first chunk goes out
+		fileStream.SetWindow(sm.config.DownloadWindow)
+		if err := fileStream.StartDownload(); err != nil {
+			return fmt.Errorf("failed to start download: %v", err)
+		}
+		// The server drives downloads, so they are under way as soon as the stream starts
+		session.Status = StatusInProgress
+	}
 	return nil
 }
 
+// newTransferStream creates the file stream for a session's temp file. Uploads record their
+// chunks in a bitmap beside the file; with resume set, the stream keeps the chunks an earlier
+// connection wrote instead of starting over.
+// Caller must hold session.mutex.
+func (sm *SessionManager) newTransferStream(session *TransferSession, conn *websocket.Conn, resume bool) (*FileStream, error) {
+	isUpload := session.Request.Type == TransferTypeUpload
+
+	var fileStream *FileStream
+	var err error
+	if resume {
+		fileStream, err = ResumeUploadStream(session.ID, session.TempPath, conn, session.Request.ChunkSize)
+	} else {
+		fileStream, err = NewFileStream(session.ID, session.TempPath, isUpload, conn, session.Request.ChunkSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file stream: %v", err)
+	}
+
+	if isUpload {
+		fileStream.SetTotalSize(session.Request.FileSize)
+		fileStream.SetSizeLimit(maxUploadBytes(session.Request.FileSize, sm.securityConfig))
+
+		// A bitmap left by an earlier transfer with the same path doesn't describe this file
+		if !resume {
+			removeChunkBitmap(session.TempPath)
+		}
+		if err := fileStream.TrackChunks(chunkBitmapPath(session.TempPath)); err != nil {
+			fileStream.cleanup()
+			return nil, err
+		}
+	}
+
+	if !isUpload {
+		fileStream.SetRateLimit(sm.config.RateLimit)
+		fileStream.shareRateLimiter(sm.rateLimiter)
+	}
+
+	if sm.securityConfig != nil && sm.securityConfig.CompressionEnabled {
+		fileStream.SetCompression(sm.config.CompressionLevel)
+	}
+	encrypted := sm.fileEncryptor != nil && sm.config.EncryptFiles && sm.securityConfig != nil && sm.securityConfig.EncryptionEnabled
+	if encrypted {
+		fileStream.SetEncryptor(sm.fileEncryptor)
+	}
+	// Encrypted uploads stay encrypted on disk; a resumed upload keeps the layout it started with
+	if isUpload {
+		if !resume {
+			session.SealedAtRest = encrypted
+		}
+		if session.SealedAtRest {
+			if sm.fileEncryptor == nil {
+				fileStream.cleanup()
+				return nil, fmt.Errorf("upload was stored encrypted and no encryption key is loaded")
+			}
+			fileStream.SealStoredChunks(sm.fileEncryptor)
+		}
+	}
+
+	// The stream takes turns writing with the handler and the connection's other streams
+	fileStream.shareWriteMutex(sm.connWriteMutex(conn))
+
+	if isUpload && sm.fileValidator != nil {
+		validator := sm.fileValidator
+		filename := session.Request.Filename
+		fileStream.SetContentValidator(func(head []byte) error {
+			return validator.ValidateContent(filename, head)
+		})
+	}
+
+	fileStream.SetProgressHook(func(progress FileTransferProgress) {
+		sm.publishProgress(session, progress)
+	})
+	fileStream.setProgressPool(sm.progress)
+	return fileStream, nil
+}
+
+// GetTransferStatus returns the current status of a transfer
+func (sm *SessionManager) GetTransferStatus(transferID string) (TransferStatus, bool) {
+	session, exists := sm.GetSession(transferID)
+	if !exists {
+		return "", false
+	}
+
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+	return session.Status, true
+}
+
+// isFinished reports whether a transfer has already reached a terminal status
+func (sm *SessionManager) isFinished(transferID string) bool {
+	status, exists := sm.GetTransferStatus(transferID)
+	return exists && status.IsTerminal()
+}
+
+// MarkTransferStarted moves an approved transfer to in progress once its first chunk arrives
+func (sm *SessionManager) MarkTransferStarted(transferID string) {
+	session, exists := sm.GetSession(transferID)
+	if !exists {
+		return
+	}
+	// A directory is under way once any of its files is
+	if session.ParentID != "" {
+		defer sm.MarkTransferStarted(session.ParentID)
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.Status == StatusApproved {
+		session.Status = StatusInProgress
+	}
+}
+
 // PauseTransfer pauses an active transfer
 func (sm *SessionManager) PauseTransfer(transferID string) error {
+	if err := ValidateTransferID(transferID); err != nil {
+		return err
+	}
+	if sm.isFinished(transferID) {
+		log.Printf("Ignoring pause for finished transfer: %s", transferID)
+		return nil
+	}
+
 	sm.mutex.RLock()
 	fileStream, exists := sm.fileStreams[transferID]
 	sm.mutex.RUnlock()
 
 	if !exists {
-		return fmt.Errorf("file stream not found: %s", transferID)
+		return fmt.Errorf("file stream %w: %s", ErrNotFound, transferID)
 	}
 
 	fileStream.Pause()
+	progress := fileStream.GetProgress()
 
 	sm.mutex.Lock()
 	if session, exists := sm.sessions[transferID]; exists {
 		session.mutex.Lock()
 		session.Status = StatusPaused
+		session.Progress = &progress
 		session.mutex.Unlock()
 		
 		// Log audit entry using new audit system
-		sm.auditLogger.LogTransferProgress(transferID, session.Request.SessionID, AuditEventTransferPaused, map[string]interface{}{
+		sm.logTransferEvent(session, AuditEventTransferPaused, map[string]interface{}{
 			"filename":      session.Request.Filename,
 			"file_size":     session.Request.FileSize,
 			"transfer_type": session.Request.Type,
@@ -282,12 +765,20 @@ func (sm *SessionManager) PauseTransfer(transferID string) error {
 
 // ResumeTransfer resumes a paused transfer
 func (sm *SessionManager) ResumeTransfer(transferID string) error {
+	if err := ValidateTransferID(transferID); err != nil {
+		return err
+	}
+	if sm.isFinished(transferID) {
+		log.Printf("Ignoring resume for finished transfer: %s", transferID)
+		return nil
+	}
+
 	sm.mutex.RLock()
 	fileStream, exists := sm.fileStreams[transferID]
 	sm.mutex.RUnlock()
 
 	if !exists {
-		return fmt.Errorf("file stream not found: %s", transferID)
+		return fmt.Errorf("file stream %w: %s", ErrNotFound, transferID)
 	}
 
 	fileStream.Resume()
@@ -299,7 +790,7 @@ func (sm *SessionManager) ResumeTransfer(transferID string) error {
 		session.mutex.Unlock()
 		
 		// Log audit entry using new audit system
-		sm.auditLogger.LogTransferProgress(transferID, session.Request.SessionID, AuditEventTransferResumed, map[string]interface{}{
+		sm.logTransferEvent(session, AuditEventTransferResumed, map[string]interface{}{
 			"filename":      session.Request.Filename,
 			"file_size":     session.Request.FileSize,
 			"transfer_type": session.Request.Type,
@@ -314,11 +805,22 @@ func (sm *SessionManager) ResumeTransfer(transferID string) error {
 
 // CancelTransfer cancels an active transfer
 func (sm *SessionManager) CancelTransfer(transferID string) error {
+	if err := ValidateTransferID(transferID); err != nil {
+		return err
+	}
+	if sm.isFinished(transferID) {
+		log.Printf("Ignoring cancel for finished transfer: %s", transferID)
+		return nil
+	}
+
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
-	// Cancel file stream
+	// Cancel file stream, keeping where it got to
+	var progress *FileTransferProgress
 	if fileStream, exists := sm.fileStreams[transferID]; exists {
+		snapshot := fileStream.GetProgress()
+		progress = &snapshot
 		fileStream.Cancel()
 		delete(sm.fileStreams, transferID)
 	}
@@ -327,28 +829,44 @@ func (sm *SessionManager) CancelTransfer(transferID string) error {
 	if session, exists := sm.sessions[transferID]; exists {
 		session.mutex.Lock()
 		session.Status = StatusCancelled
-		now := time.Now()
+		if progress != nil {
+			session.Progress = progress
+		}
+		now := sm.clock.Now().UTC()
 		session.EndTime = &now
 		session.mutex.Unlock()
 
-		// Clean up temporary files
-		if session.TempPath != "" {
-			if err := os.Remove(session.TempPath); err != nil {
+		// Clean up temporary files, for a directory the partial directory and everything in it
+		if session.Request.Type == TransferTypeDirectory {
+			sm.endDirectoryChildren(session, StatusCancelled)
+			if session.TempPath != "" {
+				if err := os.RemoveAll(session.TempPath); err != nil {
+					log.Printf("Error removing transfer directory: %v", err)
+				}
+			}
+		} else if session.TempPath != "" {
+			if err := sm.removeTempFile(session.TempPath); err != nil {
 				log.Printf("Error removing temp file: %v", err)
 			}
 		}
 
 		// Log audit entry using new audit system
-		sm.auditLogger.LogTransferProgress(transferID, session.Request.SessionID, AuditEventTransferCancelled, map[string]interface{}{
+		sm.logTransferEvent(session, AuditEventTransferCancelled, map[string]interface{}{
 			"filename":      session.Request.Filename,
 			"file_size":     session.Request.FileSize,
 			"transfer_type": session.Request.Type,
 			"technician":    session.Request.Technician,
-			"duration":      time.Since(session.StartTime).String(),
+			"duration":      sm.clock.Now().Sub(session.StartTime).String(),
 			"reason":        "User cancelled",
 		})
 
-		delete(sm.sessions, transferID)
+		// Without this file its directory can't complete
+		if session.ParentID != "" {
+			sm.settleDirectory(session.ParentID)
+		}
+
+		// Keep the cancelled session so retried controls see its final status;
+		// the cleanup routine removes it later
 	}
 
 	log.Printf("Transfer cancelled: %s", transferID)
@@ -357,51 +875,137 @@ func (sm *SessionManager) CancelTransfer(transferID string) error {
 
 // CompleteTransfer marks a transfer as completed
 func (sm *SessionManager) CompleteTransfer(transferID string, success bool, errorMessage string) error {
+	if sm.isFinished(transferID) {
+		log.Printf("Ignoring completion for finished transfer: %s", transferID)
+		return nil
+	}
+
+	// A directory completes with its files; failing it stops those still going
+	if session, exists := sm.GetSession(transferID); exists && session.Request.Type == TransferTypeDirectory {
+		if success {
+			return fmt.Errorf("%w: directory transfer %s completes once all of its files have", ErrInvalidState, transferID)
+		}
+		log.Printf("Directory transfer failing: %s - %s", transferID, errorMessage)
+		sm.failDirectory(transferID)
+		return nil
+	}
+
+	// Verify the received file before taking the locks, hashing and scanning can take a while
+	var verifyErr error
+	var checksum string
+	var validation *ValidationResult
+	if success {
+		if session, exists := sm.GetSession(transferID); exists {
+			checksum, verifyErr = sm.verifyTransferChecksum(session)
+			if verifyErr == nil {
+				validation, verifyErr = sm.validateReceivedFile(session)
+			}
+			if verifyErr != nil {
+				success = false
+				errorMessage = verifyErr.Error()
+			}
+		}
+	}
+
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
 	session, exists := sm.sessions[transferID]
 	if !exists {
-		return fmt.Errorf("transfer session not found: %s", transferID)
+		return fmt.Errorf("transfer session %w: %s", ErrNotFound, transferID)
+	}
+	// The directory completes with its last file
+	if session.ParentID != "" {
+		defer sm.settleDirectory(session.ParentID)
 	}
 
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
 
-	now := time.Now()
+	// Another completion may have won the race while the checksum was verified
+	if session.Status.IsTerminal() {
+		log.Printf("Ignoring completion for finished transfer: %s", transferID)
+		return nil
+	}
+
+	now := sm.clock.Now().UTC()
 	session.EndTime = &now
 
+	// A finished upload can't be resumed
+	if session.TempPath != "" {
+		removeChunkBitmap(session.TempPath)
+	}
+
 	if success {
 		session.Status = StatusCompleted
+		session.Checksum = checksum
 		log.Printf("Transfer completed successfully: %s", transferID)
+
+		// Without retention there's nothing left to download once the transfer completes
+		if !sm.config.RetainCompletedFiles && session.TempPath != "" {
+			if err := sm.removeTempFile(session.TempPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing completed file: %v", err)
+			}
+			session.TempPath = ""
+		}
 	} else {
 		session.Status = StatusFailed
 		log.Printf("Transfer failed: %s - %s", transferID, errorMessage)
+
+		// The scan quarantined the file as it was sent; a sealed original is no longer needed
+		if validation != nil && validation.Quarantined {
+			if session.SealedAtRest && session.TempPath != "" {
+				if err := sm.removeTempFile(session.TempPath); err != nil && !os.IsNotExist(err) {
+					log.Printf("Error removing quarantined upload: %v", err)
+				}
+			}
+			session.TempPath = ""
+			session.SealedAtRest = false
+			session.QuarantinePath = validation.QuarantinePath
+		}
 	}
 
-	// Clean up file stream
+	// Clean up file stream, keeping its final progress
+	var bytesTransferred int64
 	if fileStream, exists := sm.fileStreams[transferID]; exists {
+		progress := fileStream.GetProgress()
+		bytesTransferred = progress.BytesTransferred
+		if success {
+			progress.BytesTransferred = session.Request.FileSize
+			progress.TotalBytes = session.Request.FileSize
+			progress.Percentage = 100
+			progress.ETA = 0
+		}
+		session.Progress = &progress
 		fileStream.Cancel() // This will trigger cleanup
 		delete(sm.fileStreams, transferID)
 	}
 
+	if sm.metrics != nil {
+		if success {
+			sm.metrics.TransferCompleted(session.Request.Type, session.Request.FileSize)
+		} else {
+			sm.metrics.TransferFailed(session.Request.Type, bytesTransferred, failureReason(errorMessage))
+		}
+	}
+
 	// Log audit entry using new audit system
 	if success {
-		sm.auditLogger.LogTransferProgress(transferID, session.Request.SessionID, AuditEventTransferCompleted, map[string]interface{}{
+		sm.logTransferEvent(session, AuditEventTransferCompleted, map[string]interface{}{
 			"filename":        session.Request.Filename,
 			"file_size":       session.Request.FileSize,
 			"transfer_type":   session.Request.Type,
 			"technician":      session.Request.Technician,
-			"duration":        time.Since(session.StartTime).String(),
+			"duration":        sm.clock.Now().Sub(session.StartTime).String(),
 			"bytes_transferred": session.Request.FileSize,
 		})
 	} else {
-		sm.auditLogger.LogTransferProgress(transferID, session.Request.SessionID, AuditEventTransferFailed, map[string]interface{}{
+		sm.logTransferEvent(session, AuditEventTransferFailed, map[string]interface{}{
 			"filename":        session.Request.Filename,
 			"file_size":       session.Request.FileSize,
 			"transfer_type":   session.Request.Type,
 			"technician":      session.Request.Technician,
-			"duration":        time.Since(session.StartTime).String(),
+			"duration":        sm.clock.Now().Sub(session.StartTime).String(),
 			"error_message":   errorMessage,
 		})
 	}
@@ -409,23 +1013,208 @@ func (sm *SessionManager) CompleteTransfer(transferID string, success bool, erro
 	// Keep completed sessions for a while for audit purposes
 	// They will be cleaned up by the cleanup routine
 
+	return verifyErr
+}
+
+// SetSecurityConfig sets the security policy used for checksum enforcement
+func (sm *SessionManager) SetSecurityConfig(securityConfig *SecurityConfig) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.securityConfig = securityConfig
+	sm.auditLogger.SetMask(securityConfig.AuditMaskedFields, securityConfig.AuditMaskMode)
+}
+
+// SetFileValidator sets the validator used to sniff upload content as it arrives
+func (sm *SessionManager) SetFileValidator(fileValidator *FileValidator) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.fileValidator = fileValidator
+}
+
+// SetFileEncryptor sets the encryptor chunks are sealed with while encryption is enabled
+func (sm *SessionManager) SetFileEncryptor(fileEncryptor *FileEncryptor) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.fileEncryptor = fileEncryptor
+}
+
+// SetIDGenerator sets the generator for transfer IDs the client didn't supply, e.g. a deterministic one in tests
+func (sm *SessionManager) SetIDGenerator(gen idgen.Generator) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.idGenerator = gen
+}
+
+// SetClock sets the clock transfers, approval grace periods and cleanup are timed on, and the audit
+// log's rotation and violation windows, e.g. a manual one in tests
+func (sm *SessionManager) SetClock(c clock.Clock) {
+	sm.mutex.Lock()
+	sm.clock = c
+	sm.mutex.Unlock()
+	sm.auditLogger.SetClock(c)
+}
+
+// SetTransferAuthorizer sets the policy consulted before each transfer session is created
+func (sm *SessionManager) SetTransferAuthorizer(authorizer TransferAuthorizer) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.authorizer = authorizer
+}
+
+// validateChecksumRequest rejects requests without a usable checksum when checksums are required.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) validateChecksumRequest(request *FileTransferRequest) error {
+	if sm.securityConfig == nil || !sm.securityConfig.RequireChecksum {
+		return nil
+	}
+
+	if request.Checksum == "" {
+		return fmt.Errorf("checksum is required for file transfers")
+	}
+	if request.ChecksumAlgorithm == "" {
+		return fmt.Errorf("checksum algorithm is required for file transfers")
+	}
+	if !strings.EqualFold(request.ChecksumAlgorithm, sm.securityConfig.ChecksumAlgorithm) {
+		return fmt.Errorf("unsupported checksum algorithm: %s (expected %s)", request.ChecksumAlgorithm, sm.securityConfig.ChecksumAlgorithm)
+	}
+
 	return nil
 }
 
-// GetTransferProgress returns the current progress of a transfer
+// verifyTransferChecksum checks a completed upload against the checksum from its request,
+// returning the SHA-256 of the received file to record for later downloads
+func (sm *SessionManager) verifyTransferChecksum(session *TransferSession) (string, error) {
+	sm.mutex.RLock()
+	required := sm.securityConfig != nil && sm.securityConfig.RequireChecksum
+	sm.mutex.RUnlock()
+
+	session.mutex.RLock()
+	request := session.Request
+	stored := session.storedFile()
+	session.mutex.RUnlock()
+	tempPath := stored.path
+
+	if request.Type != TransferTypeUpload {
+		return "", nil
+	}
+	if request.Checksum == "" && required {
+		return "", fmt.Errorf("checksum verification failed: no checksum provided")
+	}
+	if tempPath == "" {
+		if request.Checksum == "" {
+			return "", nil
+		}
+		return "", fmt.Errorf("checksum verification failed: no data received")
+	}
+
+	checksum, err := sm.storedFileChecksum(stored)
+	if err != nil {
+		if request.Checksum == "" {
+			return "", nil
+		}
+		return "", fmt.Errorf("checksum verification failed: %v", err)
+	}
+	if request.Checksum != "" && !strings.EqualFold(checksum, request.Checksum) {
+		sm.auditLogger.LogSecurityViolation(request.ID, request.SessionID, request.Filename, "checksum mismatch", "")
+		return "", fmt.Errorf("checksum verification failed: file does not match expected checksum")
+	}
+
+	return checksum, nil
+}
+
+// validateReceivedFile runs the file validator, malware scan included, over a received upload
+// when scanning is enabled. A sealed file is checked as it was sent.
+func (sm *SessionManager) validateReceivedFile(session *TransferSession) (*ValidationResult, error) {
+	sm.mutex.RLock()
+	validator := sm.fileValidator
+	scan := sm.securityConfig != nil && sm.securityConfig.ScanForMalware
+	sm.mutex.RUnlock()
+
+	session.mutex.RLock()
+	request := session.Request
+	stored := session.storedFile()
+	session.mutex.RUnlock()
+
+	if validator == nil || !scan || request.Type != TransferTypeUpload || stored.path == "" {
+		return nil, nil
+	}
+
+	var result *ValidationResult
+	err := sm.withPlainFile(stored, func(path string) error {
+		var err error
+		result, err = validator.ValidateFile(path, request.Filename)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("file validation failed: %v", err)
+	}
+	if !result.Valid {
+		return result, fmt.Errorf("file validation failed: %s", strings.Join(result.Errors, "; "))
+	}
+	return result, nil
+}
+
+// GetTransferProgress returns the current progress of a transfer, derived from the session when it
+// has no stream, and errors only for unknown transfers
 func (sm *SessionManager) GetTransferProgress(transferID string) (*FileTransferProgress, error) {
 	sm.mutex.RLock()
-	fileStream, exists := sm.fileStreams[transferID]
+	fileStream, streaming := sm.fileStreams[transferID]
+	session, exists := sm.sessions[transferID]
 	sm.mutex.RUnlock()
 
+	if exists && session.Request.Type == TransferTypeDirectory {
+		return sm.directoryProgress(session), nil
+	}
+
+	if streaming {
+		progress := fileStream.GetProgress()
+		if exists {
+			snapshot := progress
+			session.mutex.Lock()
+			session.Progress = &snapshot
+			session.mutex.Unlock()
+		}
+		return &progress, nil
+	}
+
 	if !exists {
-		return nil, fmt.Errorf("file stream not found: %s", transferID)
+		return nil, fmt.Errorf("transfer session %w: %s", ErrNotFound, transferID)
 	}
 
-	progress := fileStream.GetProgress()
+	// Without a stream, progress follows from the session: none yet before it starts, all of
+	// it once completed, and otherwise the last the stream made
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+
+	progress := FileTransferProgress{ID: transferID, TotalBytes: session.Request.FileSize}
+	switch {
+	case session.Status == StatusCompleted:
+		progress.BytesTransferred = session.Request.FileSize
+		progress.Percentage = 100
+	case session.Progress != nil:
+		progress = *session.Progress
+	}
 	return &progress, nil
 }
 
+// AcknowledgeDownloadChunk records the client's acknowledgement of a download's chunks up to
+// chunkIndex, letting the stream send further ahead
+func (sm *SessionManager) AcknowledgeDownloadChunk(transferID string, chunkIndex int) error {
+	sm.mutex.RLock()
+	fileStream, exists := sm.fileStreams[transferID]
+	sm.mutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("file stream %w: %s", ErrNotFound, transferID)
+	}
+	if fileStream.isUpload {
+		return fmt.Errorf("%w: transfer %s is not a download", ErrInvalidState, transferID)
+	}
+
+	fileStream.AcknowledgeChunk(chunkIndex)
+	return nil
+}
+
 // GetActiveSessions returns all active transfer sessions
 func (sm *SessionManager) GetActiveSessions() map[string]*TransferSession {
 	sm.mutex.RLock()
@@ -463,13 +1252,38 @@ func (sm *SessionManager) UpdateConfig(config *TransferConfig) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
+	previous := sm.config
 	sm.config = config
+	sm.rateLimiter.setRate(config.GlobalRateLimit)
+	sm.history.resize(config.GetHistorySize())
 
-	// Restart cleanup ticker with new interval
-	if sm.cleanupTicker != nil {
-		sm.cleanupTicker.Stop()
+	// Reschedule the cleanup ticker in place; replacing it would race with cleanupRoutine
+	// reading its channel
+	if sm.cleanupTicker != nil && config.CleanupInterval > 0 && config.CleanupInterval != previous.CleanupInterval {
+		sm.cleanupTicker.Reset(config.CleanupInterval)
 	}
-	sm.cleanupTicker = time.NewTicker(config.CleanupInterval)
+}
+
+// UpdateConfigBy applies a configuration update made by actor and audits the fields it changed
+func (sm *SessionManager) UpdateConfigBy(config *TransferConfig, actor, ipAddress string) error {
+	changes, err := configdiff.Diff(sm.GetConfig(), config)
+	if err != nil {
+		return err
+	}
+
+	sm.UpdateConfig(config)
+
+	sm.auditLogger.LogEvent(&AuditEvent{
+		EventType: AuditEventConfigUpdated,
+		UserID:    actor,
+		IPAddress: ipAddress,
+		Success:   true,
+		Details: map[string]interface{}{
+			"config_type": "transfer_config",
+			"changes":     changes,
+		},
+	})
+	return nil
 }
 
 // GetConfig returns the current configuration
@@ -480,13 +1294,19 @@ func (sm *SessionManager) GetConfig() *TransferConfig {
 	return sm.config
 }
 
-// cleanupRoutine periodically cleans up old sessions and temporary files
-func (sm *SessionManager) cleanupRoutine() {
+// ClientIP returns a request's client IP, believing forwarding headers only from the trusted proxies
+func (sm *SessionManager) ClientIP(r *http.Request) string {
+	return clientnet.ClientIP(r, sm.GetConfig().TrustedProxies)
+}
+
+// cleanupRoutine periodically cleans up old sessions and temporary files. UpdateConfig resets the
+// same ticker rather than replacing it, so a new interval takes effect here without a restart.
+func (sm *SessionManager) cleanupRoutine(stop <-chan struct{}) {
 	for {
 		select {
 		case <-sm.cleanupTicker.C:
 			sm.performCleanup()
-		case <-sm.shutdownChan:
+		case <-stop:
 			return
 		}
 	}
@@ -497,29 +1317,56 @@ func (sm *SessionManager) performCleanup() {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
-	cutoffTime := time.Now().Add(-1 * time.Hour) // Keep sessions for 1 hour after completion
+	cutoffTime := sm.clock.Now().Add(-sm.config.GetCompletedRetention()) // Keep sessions, and completed files, for a while after they end
 
+	var cleanedUp []TransferSummary
 	for id, session := range sm.sessions {
 		session.mutex.RLock()
-		shoudCleanup := (session.Status == StatusCompleted || session.Status == StatusFailed || session.Status == StatusCancelled) &&
+		shoudCleanup := session.Status.IsTerminal() &&
 			session.EndTime != nil && session.EndTime.Before(cutoffTime)
 		tempPath := session.TempPath
+		var summary TransferSummary
+		if shoudCleanup {
+			summary = summarizeTransfer(session)
+		}
 		session.mutex.RUnlock()
 
 		if shoudCleanup {
-			// Remove temporary file
-			if tempPath != "" {
-				if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+			// Remove temporary file, once any downloads of it have finished
+			if tempPath != "" && session.Request.Type == TransferTypeDirectory {
+				if err := os.RemoveAll(tempPath); err != nil {
+					log.Printf("Error removing transfer directory during cleanup: %v", err)
+				}
+			} else if tempPath != "" {
+				if err := sm.removeTempFile(tempPath); err != nil && !os.IsNotExist(err) {
 					log.Printf("Error removing temp file during cleanup: %v", err)
 				}
 			}
 
-			// Remove session
+			// Remove session, remembering it for the history
+			cleanedUp = append(cleanedUp, summary)
 			delete(sm.sessions, id)
 			log.Printf("Cleaned up old transfer session: %s", id)
 		}
 	}
 
+	// The history drops the oldest transfers first, so add them in the order they ended
+	sort.Slice(cleanedUp, func(i, j int) bool {
+		return cleanedUp[i].EndTime.Before(cleanedUp[j].EndTime)
+	})
+	for _, summary := range cleanedUp {
+		sm.history.add(summary)
+	}
+
+	// Release approved transfers that never started
+	sm.expireStalledApprovals()
+
+	// Fail uploads whose client never came back to resume them
+	sm.expireDetachedUploads()
+
+	// Drop download grants that have run their course
+	sm.expireClientDownloadGrants()
+
 	// Clean up orphaned file streams
 	for id, fileStream := range sm.fileStreams {
 		if !fileStream.IsActive() {
@@ -532,38 +1379,207 @@ func (sm *SessionManager) performCleanup() {
 	sm.cleanupOrphanedTempFiles()
 }
 
-// cleanupOrphanedTempFiles removes temporary files that are no longer associated with active sessions
-func (sm *SessionManager) cleanupOrphanedTempFiles() {
+// expireStalledApprovals cancels approved transfers whose first chunk didn't arrive within the
+// grace period, freeing their slot, file stream and temp file.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) expireStalledApprovals() {
+	grace := sm.config.ApprovalGracePeriod
+	if grace <= 0 {
+		return
+	}
+
+	for id, session := range sm.sessions {
+		// A directory's files may wait their turn; it's the directory as a whole that stalls
+		if session.ParentID != "" {
+			continue
+		}
+		session.mutex.Lock()
+		stalled := session.Status == StatusApproved && session.ApprovedAt != nil && sm.clock.Now().Sub(*session.ApprovedAt) > grace
+		if !stalled {
+			session.mutex.Unlock()
+			continue
+		}
+		session.Status = StatusCancelled
+		now := sm.clock.Now().UTC()
+		session.EndTime = &now
+		tempPath := session.TempPath
+		session.mutex.Unlock()
+
+		if fileStream, exists := sm.fileStreams[id]; exists {
+			fileStream.Cancel()
+			delete(sm.fileStreams, id)
+		}
+		if session.Request.Type == TransferTypeDirectory {
+			sm.endDirectoryChildren(session, StatusCancelled)
+			if tempPath != "" {
+				if err := os.RemoveAll(tempPath); err != nil {
+					log.Printf("Error removing directory for stalled transfer: %v", err)
+				}
+			}
+		} else if tempPath != "" {
+			if err := sm.removeTempFile(tempPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing temp file for stalled transfer: %v", err)
+			}
+		}
+
+		sm.logTransferEvent(session, AuditEventTransferCancelled, map[string]interface{}{
+			"filename":      session.Request.Filename,
+			"file_size":     session.Request.FileSize,
+			"transfer_type": session.Request.Type,
+			"technician":    session.Request.Technician,
+			"grace_period":  grace.String(),
+			"reason":        "Approved transfer did not start within the grace period",
+		})
+		log.Printf("Cancelled stalled approved transfer: %s", id)
+	}
+}
+
+// expireDetachedUploads fails paused uploads whose connection dropped longer ago than the detached
+// upload timeout, freeing their slot and removing their partial file and chunk bitmap.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) expireDetachedUploads() {
+	timeout := sm.config.GetDetachedUploadTimeout()
+
+	for _, session := range sm.sessions {
+		session.mutex.Lock()
+		expired := session.Status == StatusPaused && session.ClientConn == nil &&
+			session.DetachedAt != nil && sm.clock.Now().Sub(*session.DetachedAt) > timeout
+		if !expired {
+			session.mutex.Unlock()
+			continue
+		}
+		session.Status = StatusFailed
+		now := sm.clock.Now().UTC()
+		session.EndTime = &now
+		session.DetachedAt = nil
+		tempPath := session.TempPath
+		session.mutex.Unlock()
+
+		if tempPath != "" {
+			if err := sm.removeTempFile(tempPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing temp file for detached upload: %v", err)
+			}
+		}
+		if sm.metrics != nil {
+			sm.metrics.TransferFailed(session.Request.Type, 0, FailureInactive)
+		}
+
+		sm.logTransferEvent(session, AuditEventTransferFailed, map[string]interface{}{
+			"filename":      session.Request.Filename,
+			"file_size":     session.Request.FileSize,
+			"transfer_type": session.Request.Type,
+			"technician":    session.Request.Technician,
+			"timeout":       timeout.String(),
+			"error_message": "Upload was not resumed after its connection dropped",
+		})
+		log.Printf("Failed detached upload: %s", session.ID)
+
+		// Without this file its directory can't complete
+		if session.ParentID != "" {
+			sm.settleDirectory(session.ParentID)
+		}
+	}
+}
+
+// orphanedTempFileMinAge is how old an orphaned temp file must be before the cleanup routine removes it
+const orphanedTempFileMinAge = time.Hour
+
+// TempFileInfo describes a file in the transfer temp directory
+type TempFileInfo struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	AgeSeconds int64     `json:"age_seconds"`
+}
+
+// PruneResult reports the temp files removed by a prune and the bytes reclaimed
+type PruneResult struct {
+	Removed        []TempFileInfo `json:"removed"`
+	ReclaimedBytes int64          `json:"reclaimed_bytes"`
+}
+
+// ListOrphanedTempFiles returns temp files that no known transfer session refers to
+func (sm *SessionManager) ListOrphanedTempFiles() ([]TempFileInfo, error) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.orphanedTempFiles()
+}
+
+// PruneOrphanedTempFiles removes orphaned temp files at least minAge old and reports what was reclaimed
+func (sm *SessionManager) PruneOrphanedTempFiles(minAge time.Duration) (*PruneResult, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.pruneOrphanedTempFiles(minAge)
+}
+
+// orphanedTempFiles lists temp files not associated with any session.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) orphanedTempFiles() ([]TempFileInfo, error) {
 	files, err := os.ReadDir(sm.config.TempDir)
 	if err != nil {
-		log.Printf("Error reading temp directory: %v", err)
-		return
+		return nil, fmt.Errorf("failed to read temp directory: %v", err)
 	}
 
 	activeFiles := make(map[string]bool)
 	for _, session := range sm.sessions {
 		if session.TempPath != "" {
 			activeFiles[filepath.Base(session.TempPath)] = true
+			activeFiles[filepath.Base(chunkBitmapPath(session.TempPath))] = true
 		}
 	}
+	// Files still being downloaded aren't orphans, even once their session is gone
+	for path := range sm.servedFiles {
+		activeFiles[filepath.Base(path)] = true
+	}
 
+	orphans := []TempFileInfo{}
+	now := time.Now()
 	for _, file := range files {
-		if !file.IsDir() && !activeFiles[file.Name()] {
-			filePath := filepath.Join(sm.config.TempDir, file.Name())
-			fileInfo, err := file.Info()
-			if err != nil {
-				continue
-			}
+		if file.IsDir() || activeFiles[file.Name()] {
+			continue
+		}
+		fileInfo, err := file.Info()
+		if err != nil {
+			continue
+		}
+		orphans = append(orphans, TempFileInfo{
+			Name:       file.Name(),
+			Size:       fileInfo.Size(),
+			ModifiedAt: fileInfo.ModTime(),
+			AgeSeconds: int64(now.Sub(fileInfo.ModTime()) / time.Second),
+		})
+	}
+	return orphans, nil
+}
 
-			// Remove files older than 1 hour
-			if time.Since(fileInfo.ModTime()) > time.Hour {
-				if err := os.Remove(filePath); err != nil {
-					log.Printf("Error removing orphaned temp file: %v", err)
-				} else {
-					log.Printf("Removed orphaned temp file: %s", file.Name())
-				}
-			}
+// pruneOrphanedTempFiles removes orphaned temp files at least minAge old.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) pruneOrphanedTempFiles(minAge time.Duration) (*PruneResult, error) {
+	orphans, err := sm.orphanedTempFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PruneResult{Removed: []TempFileInfo{}}
+	for _, orphan := range orphans {
+		if time.Since(orphan.ModifiedAt) < minAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(sm.config.TempDir, orphan.Name)); err != nil {
+			log.Printf("Error removing orphaned temp file: %v", err)
+			continue
 		}
+		log.Printf("Removed orphaned temp file: %s", orphan.Name)
+		result.Removed = append(result.Removed, orphan)
+		result.ReclaimedBytes += orphan.Size
+	}
+	return result, nil
+}
+
+// cleanupOrphanedTempFiles removes temporary files that are no longer associated with active sessions
+func (sm *SessionManager) cleanupOrphanedTempFiles() {
+	if _, err := sm.pruneOrphanedTempFiles(orphanedTempFileMinAge); err != nil {
+		log.Printf("Error cleaning up orphaned temp files: %v", err)
 	}
 }
 
@@ -615,8 +1631,8 @@ func (sm *SessionManager) GetStatistics() map[string]interface{} {
 func (sm *SessionManager) Shutdown() {
 	log.Println("Shutting down transfer session manager...")
 
-	// Signal cleanup routine to stop
-	close(sm.shutdownChan)
+	// Stop the cleanup routine and wait for it, so it can't race the final cleanup
+	sm.workers.Stop(lifecycle.DefaultStopTimeout)
 
 	// Stop cleanup ticker
 	if sm.cleanupTicker != nil {
@@ -625,15 +1641,24 @@ func (sm *SessionManager) Shutdown() {
 
 	// Cancel all active transfers
 	sm.mutex.Lock()
-	for id := range sm.sessions {
-		if fileStream, exists := sm.fileStreams[id]; exists {
-			fileStream.Cancel()
-		}
+	fileStreams := make([]*FileStream, 0, len(sm.fileStreams))
+	for _, fileStream := range sm.fileStreams {
+		fileStream.Cancel()
+		fileStreams = append(fileStreams, fileStream)
 	}
 	sm.mutex.Unlock()
 
+	// Wait for their workers outside the lock; they may need it to finish
+	for _, fileStream := range fileStreams {
+		fileStream.Wait(lifecycle.DefaultStopTimeout)
+	}
+	sm.progress.stop()
+
 	// Perform final cleanup
 	sm.performCleanup()
 
+	// Flush the audit trail last so the shutdown's own events are kept
+	sm.auditLogger.Stop()
+
 	log.Println("Transfer session manager shutdown complete")
 }
\ No newline at end of file
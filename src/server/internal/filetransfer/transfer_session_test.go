@@ -0,0 +1,791 @@
+package filetransfer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onlitec/onlidesk-server/internal/clock"
+)
+
+// newTestSessionManager creates a session manager whose temp and log dirs live under the test dir
+func newTestSessionManager(t *testing.T, config *TransferConfig, securityConfig *SecurityConfig) *SessionManager {
+	t.Helper()
+
+	if config == nil {
+		config = DefaultTransferConfig()
+	}
+	config.TempDir = t.TempDir()
+
+	sm := NewSessionManager(config)
+	sm.auditLogger.Stop()
+	sm.auditLogger = NewAuditLogger(t.TempDir(), true)
+	if securityConfig != nil {
+		sm.SetSecurityConfig(securityConfig)
+	}
+	t.Cleanup(sm.Shutdown)
+	return sm
+}
+
+// readAuditEvents stops the logger so its queue is flushed, then reads back what it wrote
+func readAuditEvents(t *testing.T, al *AuditLogger) []AuditEvent {
+	t.Helper()
+
+	al.Stop()
+	file, err := os.Open(al.logFile)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func TestSessionManager_RejectsChecksumlessRequestsWhenRequired(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = true
+	sm := newTestSessionManager(t, nil, securityConfig)
+
+	_, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, nil, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum is required")
+
+	_, err = sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: 1024,
+		Checksum: "abc123",
+	}, nil, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum algorithm is required")
+
+	_, err = sm.CreateTransferSession(&FileTransferRequest{
+		Type:              TransferTypeUpload,
+		Filename:          "report.txt",
+		FileSize:          1024,
+		Checksum:          "abc123",
+		ChecksumAlgorithm: "MD5",
+	}, nil, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported checksum algorithm")
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:              TransferTypeUpload,
+		Filename:          "report.txt",
+		FileSize:          1024,
+		Checksum:          "abc123",
+		ChecksumAlgorithm: "sha256",
+	}, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPending, session.Status)
+}
+
+func TestSessionManager_ConsultsTransferAuthorizer(t *testing.T) {
+	sm := newTestSessionManager(t, nil, nil)
+	sm.SetTransferAuthorizer(func(request *FileTransferRequest) error {
+		if request.Type == TransferTypeDownload {
+			return fmt.Errorf("downloads are blocked for session %s", request.SessionID)
+		}
+		return nil
+	})
+
+	_, err := sm.CreateTransferSession(&FileTransferRequest{
+		SessionID: "session-1",
+		Type:      TransferTypeUpload,
+		Filename:  "fix.txt",
+		FileSize:  1024,
+	}, nil, nil)
+	assert.NoError(t, err)
+
+	_, err = sm.CreateTransferSession(&FileTransferRequest{
+		SessionID: "session-1",
+		Type:      TransferTypeDownload,
+		Filename:  "secrets.txt",
+		FileSize:  1024,
+	}, nil, nil)
+	assert.EqualError(t, err, "downloads are blocked for session session-1")
+	assert.Len(t, sm.GetActiveSessions(), 1)
+}
+
+func TestSessionManager_ClientDownloadsNeedGrantWhenDisabled(t *testing.T) {
+	sm := newTestSessionManager(t, nil, nil)
+	download := func(sessionID string) error {
+		_, err := sm.CreateTransferSession(&FileTransferRequest{
+			SessionID: sessionID,
+			Type:      TransferTypeDownload,
+			Filename:  "logs.zip",
+			FileSize:  1024,
+		}, nil, nil)
+		return err
+	}
+
+	// Downloads from the client are off by default; uploads are unaffected
+	assert.ErrorIs(t, download("session-1"), ErrClientDownloadsDisabled)
+	_, err := sm.CreateTransferSession(&FileTransferRequest{
+		SessionID: "session-1",
+		Type:      TransferTypeUpload,
+		Filename:  "fix.txt",
+		FileSize:  1024,
+	}, nil, nil)
+	assert.NoError(t, err)
+
+	_, err = sm.GrantClientDownloads("session-1", "tech-1", "  ")
+	assert.ErrorIs(t, err, ErrJustificationRequired)
+
+	grant, err := sm.GrantClientDownloads("session-1", "tech-1", "collect crash dumps for ticket 4521")
+	require.NoError(t, err)
+	assert.Equal(t, "tech-1", grant.GrantedBy)
+	assert.NoError(t, download("session-1"))
+	assert.ErrorIs(t, download("session-2"), ErrClientDownloadsDisabled)
+
+	assert.True(t, sm.RevokeClientDownloads("session-1", "tech-1"))
+	assert.ErrorIs(t, download("session-1"), ErrClientDownloadsDisabled)
+	assert.False(t, sm.RevokeClientDownloads("session-1", "tech-1"))
+
+	// A grant lasts for the configured duration; the sweep then drops it
+	now := clock.NewManual(time.Now())
+	sm.SetClock(now)
+	grant, err = sm.GrantClientDownloads("session-1", "tech-1", "collect crash dumps for ticket 4521")
+	require.NoError(t, err)
+	assert.True(t, grant.ExpiresAt.Equal(now.Now().Add(time.Hour)))
+	now.Advance(time.Hour)
+	assert.NoError(t, download("session-1"))
+	now.Advance(time.Second)
+	assert.ErrorIs(t, download("session-1"), ErrClientDownloadsDisabled)
+	sm.performCleanup()
+	_, exists := sm.GetClientDownloadGrant("session-1")
+	assert.False(t, exists)
+
+	// The global default lets every session download
+	config := *sm.GetConfig()
+	config.AllowClientDownloads = true
+	sm.UpdateConfig(&config)
+	assert.NoError(t, download("session-2"))
+}
+
+func TestSessionManager_RejectsMalformedIDs(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, nil, securityConfig)
+
+	create := func(transferID, sessionID string) error {
+		_, err := sm.CreateTransferSession(&FileTransferRequest{
+			ID:        transferID,
+			SessionID: sessionID,
+			Type:      TransferTypeUpload,
+			Filename:  "report.txt",
+			FileSize:  1024,
+		}, nil, nil)
+		return err
+	}
+
+	for _, transferID := range []string{"../../etc/passwd", "a/b", `a\b`, "-leading-dash", "id with spaces", "id\x00", strings.Repeat("a", MaxIDLength+1)} {
+		assert.ErrorIs(t, create(transferID, ""), ErrInvalidID, transferID)
+	}
+	for _, sessionID := range []string{"../session", "session_portal\n", "a.b"} {
+		assert.ErrorIs(t, create("", sessionID), ErrInvalidID, sessionID)
+	}
+	assert.Empty(t, sm.GetActiveSessions())
+
+	// UUIDs and plain identifiers are accepted, but an ID can't be reused
+	transferID := uuid.New().String()
+	require.NoError(t, create(transferID, uuid.New().String()))
+	require.NoError(t, create("transfer_2", "session-1"))
+	assert.Error(t, create(transferID, ""))
+
+	assert.ErrorIs(t, sm.ApproveTransfer("../"+transferID, true, ""), ErrInvalidID)
+	assert.ErrorIs(t, sm.PauseTransfer("a/b"), ErrInvalidID)
+	assert.ErrorIs(t, sm.ResumeTransfer(""), ErrInvalidID)
+	assert.ErrorIs(t, sm.CancelTransfer("x;rm"), ErrInvalidID)
+	_, err := sm.GrantClientDownloads("../session", "tech-1", "needs logs")
+	assert.ErrorIs(t, err, ErrInvalidID)
+}
+
+func TestSessionManager_ErrorsWrapSentinels(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.MaxConcurrent = 1
+	config.MaxFileSize = 1024
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, config, securityConfig)
+
+	create := func(filename string, fileSize int64) (*TransferSession, error) {
+		return sm.CreateTransferSession(&FileTransferRequest{
+			Type:     TransferTypeUpload,
+			Filename: filename,
+			FileSize: fileSize,
+		}, nil, nil)
+	}
+
+	_, err := create("report.txt", 2048)
+	assert.ErrorIs(t, err, ErrFileTooLarge)
+	assert.ErrorContains(t, err, "2048 bytes", "the error says which limit was hit")
+	_, err = create("setup.exe", 10)
+	assert.ErrorIs(t, err, ErrTypeNotAllowed)
+	assert.ErrorContains(t, err, ".exe")
+
+	session, err := create("report.txt", 10)
+	require.NoError(t, err)
+	_, err = create("notes.txt", 10)
+	assert.ErrorIs(t, err, ErrMaxConcurrent)
+
+	missing := uuid.New().String()
+	assert.ErrorIs(t, sm.ApproveTransfer(missing, true, ""), ErrNotFound)
+	assert.ErrorIs(t, sm.PauseTransfer(missing), ErrNotFound)
+	assert.ErrorIs(t, sm.ResumeTransfer(missing), ErrNotFound)
+	_, err = sm.GetTransferProgress(missing)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorContains(t, err, missing)
+
+	// Only a download's chunks are acknowledged, and only once it's streaming
+	assert.ErrorIs(t, sm.AcknowledgeDownloadChunk(session.ID, 0), ErrNotFound)
+	require.NoError(t, sm.ApproveTransfer(session.ID, true, ""))
+	assert.ErrorIs(t, sm.AcknowledgeDownloadChunk(session.ID, 0), ErrInvalidState)
+	require.NoError(t, sm.CancelTransfer(session.ID))
+	assert.ErrorIs(t, sm.ApproveTransfer(session.ID, true, ""), ErrTransferNotPending)
+}
+
+func TestSessionManager_AllowsChecksumlessRequestsWhenOptional(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, nil, securityConfig)
+
+	_, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, nil, nil)
+	assert.NoError(t, err)
+}
+
+func TestSessionManager_CompleteTransferVerifiesChecksum(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = true
+	sm := newTestSessionManager(t, nil, securityConfig)
+
+	content := []byte("checksum protected content")
+	source := filepath.Join(t.TempDir(), "source.txt")
+	require.NoError(t, os.WriteFile(source, content, 0644))
+	checksum, err := GenerateFileChecksum(source)
+	require.NoError(t, err)
+
+	createReceived := func(expectedChecksum string) *TransferSession {
+		session, err := sm.CreateTransferSession(&FileTransferRequest{
+			Type:              TransferTypeUpload,
+			Filename:          "report.txt",
+			FileSize:          int64(len(content)),
+			Checksum:          expectedChecksum,
+			ChecksumAlgorithm: "SHA256",
+		}, nil, nil)
+		require.NoError(t, err)
+
+		// Simulate the upload having landed in the temp file
+		session.TempPath = filepath.Join(sm.config.TempDir, "transfer_"+session.ID+"_report.txt")
+		require.NoError(t, os.WriteFile(session.TempPath, content, 0644))
+		return session
+	}
+
+	good := createReceived(checksum)
+	require.NoError(t, sm.CompleteTransfer(good.ID, true, ""))
+	assert.Equal(t, StatusCompleted, good.Status)
+
+	bad := createReceived("0000000000000000000000000000000000000000000000000000000000000000")
+	err = sm.CompleteTransfer(bad.ID, true, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum verification failed")
+	assert.Equal(t, StatusFailed, bad.Status)
+}
+
+func TestSessionManager_DoubleCompletionIsIgnored(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.MaxConcurrent = 1
+	config.AllowClientDownloads = true
+	sm := newTestSessionManager(t, config, nil)
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeDownload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, nil, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, sm.CompleteTransfer(session.ID, true, ""))
+	endTime := *session.EndTime
+
+	require.NoError(t, sm.CompleteTransfer(session.ID, false, "retried after timeout"))
+	assert.Equal(t, StatusCompleted, session.Status)
+	assert.Equal(t, endTime, *session.EndTime)
+	assert.NoError(t, sm.CancelTransfer(session.ID))
+	assert.Equal(t, StatusCompleted, session.Status)
+
+	// Finished sessions kept for auditing don't block new transfers
+	_, err = sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeDownload,
+		Filename: "next.txt",
+		FileSize: 1024,
+	}, nil, nil)
+	assert.NoError(t, err)
+}
+
+func TestSessionManager_ConfigUpdatesDuringCleanup(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.CleanupInterval = time.Millisecond
+	config.AllowClientDownloads = true
+	sm := newTestSessionManager(t, config, nil)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			session, err := sm.CreateTransferSession(&FileTransferRequest{
+				Type:     TransferTypeDownload,
+				Filename: "report.txt",
+				FileSize: 1024,
+			}, nil, nil)
+			if err == nil {
+				sm.CompleteTransfer(session.ID, true, "")
+			}
+			sm.GetStatistics()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		updated := *sm.GetConfig()
+		updated.CleanupInterval = time.Duration(1+i%3) * time.Millisecond
+		updated.MaxConcurrent = 1 + i%4
+		sm.UpdateConfig(&updated)
+	}
+	close(done)
+	wg.Wait()
+
+	assert.Equal(t, time.Millisecond, sm.GetConfig().CleanupInterval)
+}
+
+func TestSessionManager_CleanupFollowsUpdatedInterval(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.CleanupInterval = time.Hour
+	config.CompletedRetention = time.Millisecond
+	config.AllowClientDownloads = true
+	sm := newTestSessionManager(t, config, nil)
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeDownload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.CompleteTransfer(session.ID, true, ""))
+
+	// Nothing is cleaned up on the hourly interval; once shortened, the routine picks it up
+	updated := *sm.GetConfig()
+	updated.CleanupInterval = 10 * time.Millisecond
+	sm.UpdateConfig(&updated)
+
+	require.Eventually(t, func() bool {
+		_, exists := sm.GetSession(session.ID)
+		return !exists
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSessionManager_ExpiresApprovedTransfersThatNeverStart(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.MaxConcurrent = 2
+	config.CleanupInterval = 5 * time.Millisecond
+	config.ApprovalGracePeriod = 50 * time.Millisecond
+	sm := newTestSessionManager(t, config, nil)
+
+	newUpload := func(filename string) *TransferSession {
+		serverConn, _ := newTestConnPair(t)
+		session, err := sm.CreateTransferSession(&FileTransferRequest{
+			Type:     TransferTypeUpload,
+			Filename: filename,
+			FileSize: 1024,
+		}, serverConn, nil)
+		require.NoError(t, err)
+		require.NoError(t, sm.ApproveTransfer(session.ID, true, "approved"))
+		return session
+	}
+
+	idle := newUpload("idle.txt")
+	started := newUpload("started.txt")
+	sm.MarkTransferStarted(started.ID)
+
+	require.Eventually(t, func() bool {
+		status, _ := sm.GetTransferStatus(idle.ID)
+		return status == StatusCancelled
+	}, 2*time.Second, 5*time.Millisecond)
+
+	sm.mutex.RLock()
+	_, idleStream := sm.fileStreams[idle.ID]
+	_, startedStream := sm.fileStreams[started.ID]
+	sm.mutex.RUnlock()
+	assert.False(t, idleStream)
+	assert.True(t, startedStream)
+	assert.NoFileExists(t, idle.TempPath)
+
+	status, _ := sm.GetTransferStatus(started.ID)
+	assert.Equal(t, StatusInProgress, status)
+
+	// The idle transfer's slot is free again
+	_, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "next.txt",
+		FileSize: 1024,
+	}, nil, nil)
+	assert.NoError(t, err)
+}
+
+func TestSessionManager_ApprovingDecidedTransfers(t *testing.T) {
+	sm := newTestSessionManager(t, nil, nil)
+
+	newUpload := func(filename string) *TransferSession {
+		serverConn, _ := newTestConnPair(t)
+		session, err := sm.CreateTransferSession(&FileTransferRequest{
+			Type:     TransferTypeUpload,
+			Filename: filename,
+			FileSize: 1024,
+		}, serverConn, nil)
+		require.NoError(t, err)
+		return session
+	}
+
+	rejected := newUpload("rejected.txt")
+	require.NoError(t, sm.ApproveTransfer(rejected.ID, false, "no"))
+	err := sm.ApproveTransfer(rejected.ID, true, "changed my mind")
+	assert.ErrorIs(t, err, ErrTransferNotPending)
+	assert.Contains(t, err.Error(), string(StatusRejected))
+
+	cancelled := newUpload("cancelled.txt")
+	require.NoError(t, sm.CancelTransfer(cancelled.ID))
+	err = sm.ApproveTransfer(cancelled.ID, true, "approved")
+	assert.ErrorIs(t, err, ErrTransferNotPending)
+	assert.Contains(t, err.Error(), string(StatusCancelled))
+	status, _ := sm.GetTransferStatus(cancelled.ID)
+	assert.Equal(t, StatusCancelled, status)
+
+	// A repeated approval succeeds without starting a second stream
+	approved := newUpload("approved.txt")
+	require.NoError(t, sm.ApproveTransfer(approved.ID, true, "approved"))
+	sm.mutex.RLock()
+	stream := sm.fileStreams[approved.ID]
+	sm.mutex.RUnlock()
+	approvedAt := *approved.ApprovedAt
+
+	require.NoError(t, sm.ApproveTransfer(approved.ID, true, "approved again"))
+	sm.mutex.RLock()
+	assert.Same(t, stream, sm.fileStreams[approved.ID])
+	sm.mutex.RUnlock()
+	assert.Equal(t, approvedAt, *approved.ApprovedAt)
+
+	// Rejecting it now is a conflict rather than a silent reversal
+	assert.ErrorIs(t, sm.ApproveTransfer(approved.ID, false, "no"), ErrTransferNotPending)
+	status, _ = sm.GetTransferStatus(approved.ID)
+	assert.Equal(t, StatusApproved, status)
+}
+
+func TestSessionManager_ListsAndPrunesOrphanedTempFiles(t *testing.T) {
+	sm := newTestSessionManager(t, nil, nil)
+
+	// A file belonging to a live transfer is never an orphan
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, nil, nil)
+	require.NoError(t, err)
+	session.TempPath = filepath.Join(sm.config.TempDir, "transfer_"+session.ID+"_report.txt")
+	require.NoError(t, os.WriteFile(session.TempPath, make([]byte, 64), 0644))
+
+	stale := filepath.Join(sm.config.TempDir, "transfer_gone_old.bin")
+	require.NoError(t, os.WriteFile(stale, make([]byte, 2048), 0644))
+	staleTime := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(stale, staleTime, staleTime))
+	fresh := filepath.Join(sm.config.TempDir, "transfer_gone_new.bin")
+	require.NoError(t, os.WriteFile(fresh, make([]byte, 512), 0644))
+
+	orphans, err := sm.ListOrphanedTempFiles()
+	require.NoError(t, err)
+	require.Len(t, orphans, 2)
+	sizes := map[string]int64{}
+	for _, orphan := range orphans {
+		sizes[orphan.Name] = orphan.Size
+	}
+	assert.Equal(t, map[string]int64{"transfer_gone_old.bin": 2048, "transfer_gone_new.bin": 512}, sizes)
+
+	// Only orphans past the minimum age are pruned
+	result, err := sm.PruneOrphanedTempFiles(time.Hour)
+	require.NoError(t, err)
+	require.Len(t, result.Removed, 1)
+	assert.Equal(t, "transfer_gone_old.bin", result.Removed[0].Name)
+	assert.GreaterOrEqual(t, result.Removed[0].AgeSeconds, int64(7200))
+	assert.Equal(t, int64(2048), result.ReclaimedBytes)
+	assert.NoFileExists(t, stale)
+
+	result, err = sm.PruneOrphanedTempFiles(0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(512), result.ReclaimedBytes)
+	assert.NoFileExists(t, fresh)
+	assert.FileExists(t, session.TempPath)
+
+	orphans, err = sm.ListOrphanedTempFiles()
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+}
+
+func TestSessionManager_TransferMetadata(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	config := DefaultTransferConfig()
+	config.MaxMetadataEntries = 2
+	config.MaxMetadataValueLength = 16
+	sm := newTestSessionManager(t, config, securityConfig)
+
+	create := func(filename string, metadata map[string]string) (*TransferSession, error) {
+		return sm.CreateTransferSession(&FileTransferRequest{
+			Type:     TransferTypeUpload,
+			Filename: filename,
+			FileSize: 128,
+			Metadata: metadata,
+		}, nil, nil)
+	}
+
+	ticket, err := create("ticket.txt", map[string]string{"ticket": "INC-42", "category": "logs"})
+	require.NoError(t, err)
+	other, err := create("other.txt", map[string]string{"ticket": "INC-7"})
+	require.NoError(t, err)
+	untagged, err := create("untagged.txt", nil)
+	require.NoError(t, err)
+
+	_, err = create("many.txt", map[string]string{"a": "1", "b": "2", "c": "3"})
+	assert.ErrorIs(t, err, ErrInvalidMetadata)
+	_, err = create("long.txt", map[string]string{"ticket": strings.Repeat("x", 17)})
+	assert.ErrorIs(t, err, ErrInvalidMetadata)
+	_, err = create("empty-key.txt", map[string]string{"": "value"})
+	assert.ErrorIs(t, err, ErrInvalidMetadata)
+
+	// Filtering matches the key, and the value when one is given
+	assert.True(t, ticket.HasMetadata("ticket", "INC-42"))
+	assert.False(t, other.HasMetadata("ticket", "INC-42"))
+	assert.True(t, other.HasMetadata("ticket", ""))
+	assert.False(t, untagged.HasMetadata("ticket", ""))
+	assert.True(t, ticket.HasMetadata("category", "logs"))
+
+	// The tags follow the transfer into its audit trail
+	require.NoError(t, sm.CancelTransfer(ticket.ID))
+	var cancelled *AuditEvent
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == AuditEventTransferCancelled && event.TransferID == ticket.ID {
+			cancelled = &event
+		}
+	}
+	require.NotNil(t, cancelled)
+	assert.Equal(t, map[string]string{"ticket": "INC-42", "category": "logs"}, cancelled.Metadata)
+}
+
+func TestSessionManager_MasksConfiguredAuditFields(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	securityConfig.AuditMaskedFields = []string{"filename", "Customer"}
+	sm := newTestSessionManager(t, nil, securityConfig)
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "payroll-jane-doe.txt",
+		FileSize: 128,
+		Metadata: map[string]string{"customer": "Jane Doe", "ticket": "INC-42"},
+	}, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.CancelTransfer(session.ID))
+
+	// The session itself keeps the real values; only what's written is masked
+	assert.Equal(t, "payroll-jane-doe.txt", session.Request.Filename)
+	assert.Equal(t, "Jane Doe", session.Request.Metadata["customer"])
+
+	var cancelled *AuditEvent
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == AuditEventTransferCancelled {
+			cancelled = &event
+		}
+	}
+	require.NotNil(t, cancelled)
+	assert.Equal(t, "[REDACTED]", cancelled.Details["filename"])
+	assert.Equal(t, "User cancelled", cancelled.Details["reason"])
+	assert.Equal(t, float64(128), cancelled.Details["file_size"])
+	assert.Equal(t, map[string]string{"customer": "[REDACTED]", "ticket": "INC-42"}, cancelled.Metadata)
+}
+
+func TestSessionManager_RejectionRequiresAReasonWhenConfigured(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireRejectionReason = true
+	config.CompletedRetention = time.Millisecond
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, config, securityConfig)
+
+	serverConn, _ := newTestConnPair(t)
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, serverConn, nil)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, sm.ApproveTransfer(session.ID, false, ""), ErrRejectionReasonRequired)
+	status, _ := sm.GetTransferStatus(session.ID)
+	assert.Equal(t, StatusPending, status)
+
+	require.NoError(t, sm.ApproveTransfer(session.ID, false, "not an approved file share"))
+	status, _ = sm.GetTransferStatus(session.ID)
+	assert.Equal(t, StatusRejected, status)
+	session.mutex.RLock()
+	assert.NotNil(t, session.EndTime)
+	session.mutex.RUnlock()
+
+	var reasons []interface{}
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == AuditEventTransferRejected {
+			reasons = append(reasons, event.Details["reason"])
+		}
+	}
+	assert.Equal(t, []interface{}{"not an approved file share"}, reasons)
+
+	// Rejected transfers are cleaned up like any other finished one
+	time.Sleep(2 * time.Millisecond)
+	sm.performCleanup()
+	_, exists := sm.GetSession(session.ID)
+	assert.False(t, exists)
+}
+
+func TestSessionManager_TransferHistoryOutlivesCleanup(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.AllowClientDownloads = true
+	config.MaxConcurrent = 10
+	config.CompletedRetention = time.Millisecond
+	config.HistorySize = 2
+	sm := newTestSessionManager(t, config, nil)
+
+	finish := func(technician string, success bool) *TransferSession {
+		session, err := sm.CreateTransferSession(&FileTransferRequest{
+			Type:       TransferTypeDownload,
+			Filename:   "report.txt",
+			FileSize:   1024,
+			Technician: technician,
+		}, nil, nil)
+		require.NoError(t, err)
+		sm.CompleteTransfer(session.ID, success, "client went away")
+		time.Sleep(2 * time.Millisecond)
+		return session
+	}
+
+	finish("alice", false)
+	failed := finish("bob", false)
+	second := finish("alice", true)
+	sm.performCleanup()
+	_, exists := sm.GetSession(second.ID)
+	require.False(t, exists)
+
+	// The oldest cleaned up transfer falls out of the buffer; finished transfers not yet cleaned up are included
+	latest := finish("alice", true)
+	history, total := sm.GetTransferHistory(TransferHistoryFilter{})
+	require.Equal(t, 3, total)
+	assert.Equal(t, []string{latest.ID, second.ID, failed.ID}, []string{history[0].ID, history[1].ID, history[2].ID})
+	assert.Equal(t, StatusFailed, history[2].Status)
+	assert.Equal(t, "bob", history[2].Technician)
+	assert.Equal(t, int64(1024), history[1].FileSize)
+
+	history, total = sm.GetTransferHistory(TransferHistoryFilter{Technician: "alice", Status: StatusCompleted, Offset: 1, Limit: 1})
+	assert.Equal(t, 2, total)
+	require.Len(t, history, 1)
+	assert.Equal(t, second.ID, history[0].ID)
+
+	// Shrinking the buffer keeps the most recent transfers
+	updated := *sm.GetConfig()
+	updated.HistorySize = 1
+	sm.UpdateConfig(&updated)
+	_, total = sm.GetTransferHistory(TransferHistoryFilter{Status: StatusFailed})
+	assert.Equal(t, 0, total)
+}
+
+func TestSessionManager_ManualClockDrivesRetention(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.AllowClientDownloads = true
+	config.CompletedRetention = time.Hour
+	sm := newTestSessionManager(t, config, nil)
+	now := clock.NewManual(time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	sm.SetClock(now)
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:       TransferTypeDownload,
+		Filename:   "report.txt",
+		FileSize:   1024,
+		Technician: "alice",
+	}, nil, nil)
+	require.NoError(t, err)
+	now.Advance(30 * time.Second)
+	sm.CompleteTransfer(session.ID, true, "")
+
+	summary, _ := sm.GetTransferHistory(TransferHistoryFilter{})
+	require.Len(t, summary, 1)
+	assert.Equal(t, 30*time.Second, summary[0].Duration)
+
+	// A finished transfer is kept for exactly the retention period
+	now.Advance(time.Hour)
+	sm.performCleanup()
+	_, exists := sm.GetSession(session.ID)
+	assert.True(t, exists)
+	now.Advance(time.Nanosecond)
+	sm.performCleanup()
+	_, exists = sm.GetSession(session.ID)
+	assert.False(t, exists)
+}
+
+func TestNewSessionManagerE_FailsWhenTempDirCannotBeCreated(t *testing.T) {
+	blocker := filepath.Join(t.TempDir(), "not-a-directory")
+	require.NoError(t, os.WriteFile(blocker, []byte("x"), 0644))
+	config := DefaultTransferConfig()
+	config.TempDir = filepath.Join(blocker, "temp")
+
+	sm, err := NewSessionManagerE(config)
+	require.Error(t, err)
+	assert.Nil(t, sm)
+	assert.Contains(t, err.Error(), config.TempDir)
+
+	wh, err := NewWebSocketHandlerE(config, nil)
+	require.Error(t, err)
+	assert.Nil(t, wh)
+
+	_, err = NewTransferHandlerE(1024, []string{".txt"}, config.TempDir)
+	assert.Error(t, err)
+
+	// The lenient constructor still returns a manager for embedded and test use
+	sm = NewSessionManager(config)
+	t.Cleanup(sm.Shutdown)
+	require.NotNil(t, sm)
+}
@@ -0,0 +1,175 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrTransferNotResumable is returned when resuming a transfer that isn't a paused, unfinished upload
+var ErrTransferNotResumable = errors.New("transfer can't be resumed")
+
+// uploadChunkSize returns the chunk size an upload's stream writes with
+func uploadChunkSize(request *FileTransferRequest) int64 {
+	if request.ChunkSize <= 0 {
+		return ChunkSize
+	}
+	return int64(request.ChunkSize)
+}
+
+// GetMissingChunks lists the chunks of an unfinished upload that aren't on disk yet, so a client
+// resuming it sends only those
+func (sm *SessionManager) GetMissingChunks(transferID string) ([]int, error) {
+	if err := ValidateTransferID(transferID); err != nil {
+		return nil, err
+	}
+
+	sm.mutex.RLock()
+	session, exists := sm.sessions[transferID]
+	fileStream, streaming := sm.fileStreams[transferID]
+	sm.mutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("transfer session %w: %s", ErrNotFound, transferID)
+	}
+
+	session.mutex.RLock()
+	status := session.Status
+	tempPath := session.TempPath
+	session.mutex.RUnlock()
+
+	if session.Request.Type != TransferTypeUpload || status.IsTerminal() || tempPath == "" {
+		return nil, fmt.Errorf("%w: %s %s", ErrTransferNotResumable, status, session.Request.Type)
+	}
+
+	if streaming {
+		return fileStream.MissingChunks(), nil
+	}
+
+	// No stream since the connection dropped; the bitmap on disk says what arrived
+	count := chunksFor(session.Request.FileSize, uploadChunkSize(session.Request))
+	bitmap, err := readChunkBitmap(chunkBitmapPath(tempPath), count)
+	if err != nil {
+		return nil, err
+	}
+	return bitmap.missing(count), nil
+}
+
+// DetachConnection pauses the uploads a closed connection was sending. Their streams stop, but
+// the temp files and chunk bitmaps stay so the client can resume on a new connection, until the
+// detached upload timeout fails them.
+func (sm *SessionManager) DetachConnection(conn *websocket.Conn) {
+	if conn == nil {
+		return
+	}
+
+	sm.mutex.Lock()
+	var detached []*TransferSession
+	for id, session := range sm.sessions {
+		session.mutex.RLock()
+		attached := session.ClientConn == conn && session.Request.Type == TransferTypeUpload &&
+			(session.Status == StatusInProgress || session.Status == StatusPaused)
+		session.mutex.RUnlock()
+		if !attached {
+			continue
+		}
+
+		// Stop the stream, keeping where it got to
+		var progress *FileTransferProgress
+		if fileStream, exists := sm.fileStreams[id]; exists {
+			snapshot := fileStream.GetProgress()
+			progress = &snapshot
+			fileStream.Cancel()
+			delete(sm.fileStreams, id)
+		}
+
+		session.mutex.Lock()
+		session.Status = StatusPaused
+		session.ClientConn = nil
+		detachedAt := sm.clock.Now().UTC()
+		session.DetachedAt = &detachedAt
+		if progress != nil {
+			session.Progress = progress
+		}
+		session.mutex.Unlock()
+		detached = append(detached, session)
+	}
+	sm.mutex.Unlock()
+
+	for _, session := range detached {
+		sm.logTransferEvent(session, AuditEventTransferPaused, map[string]interface{}{
+			"filename":      session.Request.Filename,
+			"file_size":     session.Request.FileSize,
+			"transfer_type": session.Request.Type,
+			"technician":    session.Request.Technician,
+			"reason":        "connection lost",
+		})
+		log.Printf("Transfer paused on disconnect: %s", session.ID)
+	}
+}
+
+// ReattachUpload resumes a paused upload on a new connection authenticated as owner, who must be
+// whoever requested it. The new stream keeps the chunks already on disk, so only the missing ones
+// need sending.
+func (sm *SessionManager) ReattachUpload(transferID, sessionID, owner string, conn *websocket.Conn) error {
+	if err := ValidateTransferID(transferID); err != nil {
+		return err
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	session, exists := sm.sessions[transferID]
+	if !exists {
+		return fmt.Errorf("transfer session %w: %s", ErrNotFound, transferID)
+	}
+
+	session.mutex.RLock()
+	status := session.Status
+	tempPath := session.TempPath
+	session.mutex.RUnlock()
+
+	if session.Request.Type != TransferTypeUpload || status != StatusPaused || tempPath == "" {
+		return fmt.Errorf("%w: transfer is %s", ErrTransferNotResumable, status)
+	}
+	if session.Request.SessionID != sessionID {
+		return fmt.Errorf("%w: transfer belongs to another session", ErrTransferNotResumable)
+	}
+	if session.Request.Owner != owner {
+		sm.auditLogger.LogSecurityViolation(transferID, sessionID, session.Request.Filename, "resume attempted by another user", "")
+		return fmt.Errorf("%w: transfer belongs to another user", ErrTransferNotResumable)
+	}
+
+	// A transfer paused by request still has its stream on the old connection
+	if fileStream, exists := sm.fileStreams[transferID]; exists {
+		fileStream.Cancel()
+		delete(sm.fileStreams, transferID)
+	}
+
+	session.mutex.Lock()
+	fileStream, err := sm.newTransferStream(session, conn, true)
+	if err != nil {
+		session.mutex.Unlock()
+		return err
+	}
+	if err := fileStream.StartUpload(); err != nil {
+		session.mutex.Unlock()
+		return fmt.Errorf("failed to start upload: %v", err)
+	}
+	sm.fileStreams[transferID] = fileStream
+	session.Status = StatusInProgress
+	session.ClientConn = conn
+	session.DetachedAt = nil
+	session.mutex.Unlock()
+
+	sm.logTransferEvent(session, AuditEventTransferResumed, map[string]interface{}{
+		"filename":      session.Request.Filename,
+		"file_size":     session.Request.FileSize,
+		"transfer_type": session.Request.Type,
+		"technician":    session.Request.Technician,
+		"reattached":    true,
+	})
+	log.Printf("Transfer reattached: %s", transferID)
+	return nil
+}
@@ -0,0 +1,158 @@
+package filetransfer
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onlitec/onlidesk-server/internal/clock"
+)
+
+func TestSessionManager_ResumesUploadsAcrossReconnects(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.EncryptFiles = false // chunks are sent in the clear
+	config.ChunkSize = 4096
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	wh := newTestWebSocketHandler(t, config, securityConfig)
+	sm := wh.GetSessionManager()
+	sm.auditLogger.Stop()
+	sm.auditLogger = NewAuditLogger(t.TempDir(), true)
+
+	content := bytes.Repeat([]byte("resumable line\n"), 1000) // four chunks, the last one short
+	firstConn, _ := newTestConnPair(t)
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:      TransferTypeUpload,
+		Filename:  "notes.txt",
+		FileSize:  int64(len(content)),
+		SessionID: "remote-session",
+		Owner:     "alice",
+	}, firstConn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(session.ID, true, ""))
+	tempPath := session.TempPath
+
+	writeChunk := func(index int, data []byte) error {
+		sm.mutex.RLock()
+		fileStream, exists := sm.fileStreams[session.ID]
+		sm.mutex.RUnlock()
+		require.True(t, exists)
+		return fileStream.WriteChunk(index, data)
+	}
+	chunk := func(index int) []byte {
+		end := (index + 1) * 4096
+		if end > len(content) {
+			end = len(content)
+		}
+		return content[index*4096 : end]
+	}
+
+	// Chunks arrive out of order before the connection drops
+	require.NoError(t, writeChunk(2, chunk(2)))
+	require.NoError(t, writeChunk(0, chunk(0)))
+	sm.MarkTransferStarted(session.ID)
+	missing, err := sm.GetMissingChunks(session.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, missing)
+
+	sm.DetachConnection(firstConn)
+	firstConn.Close()
+	status, _ := sm.GetTransferStatus(session.ID)
+	assert.Equal(t, StatusPaused, status)
+
+	// With no stream left, the bitmap on disk still knows what arrived
+	missing, err = sm.GetMissingChunks(session.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, missing)
+
+	// The client reconnects; only its owner, in the session that started the upload, may resume it
+	secondConn, client := newTestConnPair(t)
+	assert.Error(t, wh.handleTextMessage(secondConn, []byte(`{"type":"resume_upload","transfer_id":"`+session.ID+`","session_id":"remote-session"}`)))
+	wh.setConnOwner(secondConn, "mallory")
+	assert.Error(t, wh.handleTextMessage(secondConn, []byte(`{"type":"resume_upload","transfer_id":"`+session.ID+`","session_id":"remote-session"}`)))
+	wh.setConnOwner(secondConn, "alice")
+	assert.Error(t, wh.handleTextMessage(secondConn, []byte(`{"type":"resume_upload","transfer_id":"`+session.ID+`","session_id":"other-session"}`)))
+	require.NoError(t, wh.handleTextMessage(secondConn, []byte(`{"type":"resume_upload","transfer_id":"`+session.ID+`","session_id":"remote-session"}`)))
+
+	reply := readJSON(t, client)
+	assert.Equal(t, "resume_upload_response", reply["type"])
+	assert.Equal(t, string(StatusInProgress), reply["status"])
+	assert.Equal(t, []interface{}{1.0, 3.0}, reply["missing_chunks"])
+	assert.Equal(t, 4096.0, reply["chunk_size"])
+
+	// A resent chunk is already on disk and isn't written again
+	require.NoError(t, writeChunk(0, bytes.Repeat([]byte("x"), 4096)))
+	require.NoError(t, writeChunk(1, chunk(1)))
+	require.NoError(t, writeChunk(3, chunk(3)))
+
+	missing, err = sm.GetMissingChunks(session.ID)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+	written, err := os.ReadFile(tempPath)
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+
+	require.NoError(t, sm.CompleteTransfer(session.ID, true, ""))
+	assert.NoFileExists(t, chunkBitmapPath(tempPath))
+	_, err = sm.GetMissingChunks(session.ID)
+	assert.ErrorIs(t, err, ErrTransferNotResumable)
+
+	var pauses, resumes int
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		switch event.EventType {
+		case AuditEventTransferPaused:
+			pauses++
+			assert.Equal(t, "connection lost", event.Details["reason"])
+		case AuditEventTransferResumed:
+			resumes++
+			assert.Equal(t, true, event.Details["reattached"])
+		}
+	}
+	assert.Equal(t, 1, pauses)
+	assert.Equal(t, 1, resumes)
+}
+
+func TestSessionManager_FailsUploadsNotResumedInTime(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.MaxConcurrent = 1
+	config.DetachedUploadTimeout = 5 * time.Minute
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	sm := newTestSessionManager(t, config, securityConfig)
+	now := clock.NewManual(time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	sm.SetClock(now)
+
+	conn, _ := newTestConnPair(t)
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "notes.txt",
+		FileSize: 8192,
+	}, conn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(session.ID, true, ""))
+	sm.MarkTransferStarted(session.ID)
+	tempPath := session.TempPath
+	require.FileExists(t, chunkBitmapPath(tempPath))
+
+	sm.DetachConnection(conn)
+	now.Advance(5 * time.Minute)
+	sm.performCleanup()
+	status, _ := sm.GetTransferStatus(session.ID)
+	require.Equal(t, StatusPaused, status, "the client still has time to resume")
+
+	// Once the timeout passes the upload fails, its files go and its slot is free again
+	now.Advance(time.Second)
+	sm.performCleanup()
+	status, _ = sm.GetTransferStatus(session.ID)
+	assert.Equal(t, StatusFailed, status)
+	assert.NoFileExists(t, tempPath)
+	assert.NoFileExists(t, chunkBitmapPath(tempPath))
+	_, err = sm.CreateTransferSession(&FileTransferRequest{Type: TransferTypeUpload, Filename: "next.txt", FileSize: 10}, conn, nil)
+	assert.NoError(t, err)
+}
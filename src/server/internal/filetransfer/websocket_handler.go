@@ -2,12 +2,20 @@ package filetransfer
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/onlitec/onlidesk-server/internal/approval"
+	"github.com/onlitec/onlidesk-server/internal/auth"
+	"github.com/onlitec/onlidesk-server/internal/clientnet"
 )
 
 // WebSocketHandler manages WebSocket connections for file transfers
@@ -19,33 +27,85 @@ type WebSocketHandler struct {
 	connections    map[string]*websocket.Conn // sessionID -> connection
 	config         *TransferConfig
 	auditLogger    *AuditLogger
+	approver       *approval.ExternalApprover // routes approvals to an external service when enabled
+	openConnections atomic.Int64              // WebSockets currently being served
+	owners         map[*websocket.Conn]string // the authenticated subject each connection opened as
+	ownersMutex    sync.RWMutex
 }
 
-// NewWebSocketHandler creates a new WebSocket handler
+// NewWebSocketHandler creates a new WebSocket handler, carrying on if the temp directory can't be created
 func NewWebSocketHandler(config *TransferConfig, securityConfig *SecurityConfig) *WebSocketHandler {
 	if config == nil {
 		config = DefaultTransferConfig()
 	}
+	return newWebSocketHandler(NewSessionManager(config), config, securityConfig)
+}
+
+// NewWebSocketHandlerE creates a new WebSocket handler, failing if the temp directory can't be created
+func NewWebSocketHandlerE(config *TransferConfig, securityConfig *SecurityConfig) (*WebSocketHandler, error) {
+	if config == nil {
+		config = DefaultTransferConfig()
+	}
+	sessionManager, err := NewSessionManagerE(config)
+	if err != nil {
+		return nil, err
+	}
+	return newWebSocketHandler(sessionManager, config, securityConfig), nil
+}
+
+// newWebSocketHandler creates a WebSocket handler around a session manager
+func newWebSocketHandler(sessionManager *SessionManager, config *TransferConfig, securityConfig *SecurityConfig) *WebSocketHandler {
 	if securityConfig == nil {
 		securityConfig = DefaultSecurityConfig()
 	}
 
-	return &WebSocketHandler{
-		sessionManager: NewSessionManager(config),
-		fileValidator:  NewFileValidator(securityConfig),
-		fileEncryptor:  NewFileEncryptor(securityConfig.EncryptionKey),
+	sessionManager.SetSecurityConfig(securityConfig)
+	fileValidator := NewFileValidator(securityConfig)
+	sessionManager.SetFileValidator(fileValidator)
+	auditLogger := NewAuditLogger(websocketAuditLogDir, true)
+	auditLogger.SetMask(securityConfig.AuditMaskedFields, securityConfig.AuditMaskMode)
+	fileEncryptor := NewFileEncryptor(securityConfig.EncryptionKey)
+	fileEncryptor.SetMaxConcurrent(securityConfig.MaxConcurrentCrypto)
+	sessionManager.SetFileEncryptor(fileEncryptor)
+
+	wh := &WebSocketHandler{
+		sessionManager: sessionManager,
+		fileValidator:  fileValidator,
+		fileEncryptor:  fileEncryptor,
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				// In production, implement proper origin checking
-				return true
-			},
 			ReadBufferSize:  1024 * 64,  // 64KB
 			WriteBufferSize: 1024 * 64,  // 64KB
 		},
 		connections: make(map[string]*websocket.Conn),
+		owners:      make(map[*websocket.Conn]string),
 		config:      config,
-		auditLogger: NewAuditLogger("./logs/websocket", true),
+		auditLogger: auditLogger,
 	}
+	wh.upgrader.CheckOrigin = wh.originAllowed
+	return wh
+}
+
+// setConnOwner records the subject a connection authenticated as, forgetting it when empty
+func (wh *WebSocketHandler) setConnOwner(conn *websocket.Conn, owner string) {
+	wh.ownersMutex.Lock()
+	defer wh.ownersMutex.Unlock()
+	if owner == "" {
+		delete(wh.owners, conn)
+		return
+	}
+	wh.owners[conn] = owner
+}
+
+// connOwner returns the subject a connection authenticated as, empty for anonymous connections
+func (wh *WebSocketHandler) connOwner(conn *websocket.Conn) string {
+	wh.ownersMutex.RLock()
+	defer wh.ownersMutex.RUnlock()
+	return wh.owners[conn]
+}
+
+// originAllowed is the upgrader's origin check against the live configuration
+func (wh *WebSocketHandler) originAllowed(r *http.Request) bool {
+	return clientnet.OriginAllowed(r, wh.sessionManager.GetConfig().GetAllowedOrigins())
 }
 
 // HandleWebSocket handles WebSocket connections for file transfers
@@ -54,6 +114,13 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 	ipAddress := r.RemoteAddr
 	userAgent := r.Header.Get("User-Agent")
 
+	// Browsers may only connect from the configured origins; checked here so the refusal is audited once
+	if !wh.originAllowed(r) {
+		wh.auditLogger.LogSecurityViolation("", "", "", fmt.Sprintf("WebSocket origin not allowed: %s", r.Header.Get("Origin")), ipAddress)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := wh.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -63,14 +130,21 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	defer conn.Close()
+	defer wh.sessionManager.writers.release(conn)
+	identity, _ := auth.IdentityFromContext(r.Context())
+	wh.setConnOwner(conn, identity.Subject)
+	defer wh.setConnOwner(conn, "")
+	wh.openConnections.Add(1)
+	defer wh.openConnections.Add(-1)
 
 	// Set connection timeouts
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	idleTimeout := wh.sessionManager.GetConfig().GetReadIdleTimeout()
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
 	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 
 	// Handle ping/pong for connection keep-alive
 	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
 		return nil
 	})
 
@@ -82,7 +156,7 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 		Details:     map[string]interface{}{"connection_type": "websocket"},
 		Severity:    "info",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
 	log.Printf("New WebSocket connection established from %s", r.RemoteAddr)
@@ -90,7 +164,7 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 	// Message handling loop
 	for {
 		// Read message from client
-		messageType, message, err := conn.ReadMessage()
+		messageType, message, err := wh.readMessage(conn)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
@@ -98,9 +172,6 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 			break
 		}
 
-		// Reset read deadline
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-
 		// Handle different message types
 		switch messageType {
 		case websocket.TextMessage:
@@ -118,13 +189,20 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 				wh.sendErrorResponse(conn, "binary_error", err.Error())
 			}
 		case websocket.PingMessage:
-			if err := conn.WriteMessage(websocket.PongMessage, nil); err != nil {
+			writer := wh.sessionManager.connWriteMutex(conn)
+			writer.Lock()
+			err := conn.WriteMessage(websocket.PongMessage, nil)
+			writer.Unlock()
+			if err != nil {
 				log.Printf("Error sending pong: %v", err)
 				return
 			}
 		}
 	}
 
+	// Uploads this connection was sending wait for the client to reconnect
+	wh.sessionManager.DetachConnection(conn)
+
 	// Log WebSocket disconnection
 	wh.auditLogger.LogEvent(&AuditEvent{
 		EventType:   "websocket_disconnected",
@@ -133,12 +211,49 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 		Details:     map[string]interface{}{"connection_type": "websocket"},
 		Severity:    "info",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
 	log.Printf("WebSocket connection closed for %s", r.RemoteAddr)
 }
 
+// readMessage reads the next message, waiting up to the idle timeout for it to start.
+// Binary chunks get a read budget sized for the minimum expected bandwidth, re-armed as data
+// arrives, so slow but progressing uploads aren't cut off mid-chunk.
+func (wh *WebSocketHandler) readMessage(conn *websocket.Conn) (int, []byte, error) {
+	config := wh.sessionManager.GetConfig()
+
+	conn.SetReadDeadline(time.Now().Add(config.GetReadIdleTimeout()))
+	messageType, reader, err := conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+
+	if messageType == websocket.BinaryMessage {
+		chunkTimeout := config.ChunkReadTimeout()
+		conn.SetReadDeadline(time.Now().Add(chunkTimeout))
+		reader = &deadlineReader{reader: reader, conn: conn, timeout: chunkTimeout}
+	}
+
+	message, err := io.ReadAll(reader)
+	return messageType, message, err
+}
+
+// deadlineReader pushes the connection read deadline forward every time data arrives
+type deadlineReader struct {
+	reader  io.Reader
+	conn    *websocket.Conn
+	timeout time.Duration
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	n, err := dr.reader.Read(p)
+	if n > 0 {
+		dr.conn.SetReadDeadline(time.Now().Add(dr.timeout))
+	}
+	return n, err
+}
+
 // handleTextMessage processes text-based control messages
 func (wh *WebSocketHandler) handleTextMessage(conn *websocket.Conn, message []byte) error {
 	// Parse the message as JSON
@@ -160,8 +275,16 @@ func (wh *WebSocketHandler) handleTextMessage(conn *websocket.Conn, message []by
 		return wh.handleTransferControl(conn, message)
 	case "progress_request":
 		return wh.handleProgressRequest(conn, message)
+	case "download_ack":
+		return wh.handleDownloadAck(conn, message)
+	case "transfer_still_active":
+		return wh.handleInactivityAnswer(conn, message)
 	case "session_register":
 		return wh.handleSessionRegister(conn, message)
+	case "server_info":
+		return wh.handleServerInfo(conn)
+	case "resume_upload":
+		return wh.handleResumeUpload(conn, message)
 	case "ping":
 		return wh.sendPongResponse(conn)
 	default:
@@ -207,6 +330,14 @@ func (wh *WebSocketHandler) handleFileTransferRequest(conn *websocket.Conn, mess
 	}
 
 	log.Printf("Received file transfer request: %s (%d bytes)", request.Filename, request.FileSize)
+	request.Owner = wh.connOwner(conn)
+
+	// Registering a paused upload again picks it up on this connection
+	if request.ID != "" {
+		if status, exists := wh.sessionManager.GetTransferStatus(request.ID); exists && status == StatusPaused {
+			return wh.resumeUpload(conn, "file_transfer_response", request.ID, request.SessionID)
+		}
+	}
 
 	// Create transfer session
 	session, err := wh.sessionManager.CreateTransferSession(&request, conn, nil)
@@ -220,10 +351,25 @@ func (wh *WebSocketHandler) handleFileTransferRequest(conn *websocket.Conn, mess
 		TransferID: session.ID,
 		Status:     string(session.Status),
 		Message:    "Transfer request received",
-		Timestamp:  time.Now(),
+		ChunkSize:  session.Request.ChunkSize,
+		Manifest:   session.Request.Manifest,
+		Timestamp:  time.Now().UTC(),
+	}
+	if request.Type == TransferTypeDownload {
+		response.Window = wh.sessionManager.GetConfig().DownloadWindow
 	}
 
-	if wh.config.RequireApproval {
+	// Small transfers may skip review when a size threshold is configured
+	config := wh.sessionManager.GetConfig()
+	requireApproval := config.RequiresApproval(request.FileSize)
+	wh.auditLogger.LogApprovalPolicy(session.ID, request.SessionID, request.FileSize, requireApproval, config.ApprovalSizeThreshold)
+
+	if requireApproval && wh.approver.Enabled() {
+		response.Message = "Transfer request pending external approval"
+		if err := wh.requestExternalApproval(session); err != nil {
+			return fmt.Errorf("failed to request external approval: %v", err)
+		}
+	} else if requireApproval {
 		response.Message = "Transfer request pending approval"
 		// In a real implementation, you would notify the portal/technician here
 		wh.notifyPortalOfTransferRequest(session)
@@ -260,23 +406,76 @@ func (wh *WebSocketHandler) handleTransferApproval(conn *websocket.Conn, message
 	}
 
 	// Notify client of approval status
-	session, exists := wh.sessionManager.GetSession(approval.TransferID)
-	if exists {
-		response := FileTransferResponse{
-			Type:       "transfer_status_update",
-			TransferID: approval.TransferID,
-			Status:     string(session.Status),
-			Message:    approval.Message,
-			Timestamp:  time.Now(),
-		}
+	wh.notifyTransferStatus(approval.TransferID, approval.Message)
 
-		// Send to client connection
-		if session.ClientConn != nil {
-			wh.sendJSONResponse(session.ClientConn, response)
-		}
+	return nil
+}
+
+// notifyTransferStatus tells the transfer's client its current status
+func (wh *WebSocketHandler) notifyTransferStatus(transferID, message string) {
+	session, exists := wh.sessionManager.GetSession(transferID)
+	if !exists {
+		return
 	}
 
-	return nil
+	response := FileTransferResponse{
+		Type:       "transfer_status_update",
+		TransferID: transferID,
+		Status:     string(session.Status),
+		Message:    message,
+		Timestamp:  time.Now().UTC(),
+	}
+
+	// Send to client connection
+	if session.ClientConn != nil {
+		wh.sendJSONResponse(session.ClientConn, response)
+	}
+}
+
+// SetExternalApprover routes transfers that need approval to an external approval service
+func (wh *WebSocketHandler) SetExternalApprover(approver *approval.ExternalApprover) {
+	wh.approver = approver
+}
+
+// requestExternalApproval sends a pending transfer to the external approval service
+func (wh *WebSocketHandler) requestExternalApproval(session *TransferSession) error {
+	request := session.Request
+	return wh.approver.RequestApproval(approval.Request{
+		ID:        session.ID,
+		Kind:      approval.KindTransfer,
+		SessionID: request.SessionID,
+		Requester: request.Technician,
+		Summary:   fmt.Sprintf("%s of %s (%d bytes)", request.Type, request.Filename, request.FileSize),
+		Details: map[string]interface{}{
+			"filename":      request.Filename,
+			"file_size":     request.FileSize,
+			"transfer_type": request.Type,
+			"metadata":      request.Metadata,
+		},
+	}, wh.applyExternalDecision)
+}
+
+// applyExternalDecision audits the external service's decision and applies it to the transfer
+func (wh *WebSocketHandler) applyExternalDecision(request approval.Request, decision approval.Decision) {
+	wh.sessionManager.auditLogger.LogTransferProgress(request.ID, request.SessionID, AuditEventExternalDecision, map[string]interface{}{
+		"approved":  decision.Approved,
+		"approver":  decision.Approver,
+		"reason":    decision.Reason,
+		"timed_out": decision.TimedOut,
+	})
+
+	message := decision.Reason
+	if message == "" && decision.Approved {
+		message = "Approved by external approval service"
+	} else if message == "" {
+		message = "Rejected by external approval service"
+	}
+
+	if err := wh.sessionManager.ApproveTransfer(request.ID, decision.Approved, message); err != nil {
+		log.Printf("Failed to apply external decision for transfer %s: %v", request.ID, err)
+		return
+	}
+	wh.notifyTransferStatus(request.ID, message)
 }
 
 // handleTransferControl processes transfer control commands (pause, resume, cancel)
@@ -293,6 +492,9 @@ func (wh *WebSocketHandler) handleTransferControl(conn *websocket.Conn, message
 
 	log.Printf("Transfer control received: %s - %s", control.TransferID, control.Action)
 
+	// Retries against a finished transfer succeed without doing anything
+	alreadyFinished := wh.sessionManager.isFinished(control.TransferID)
+
 	var err error
 	switch control.Action {
 	case "pause":
@@ -309,19 +511,27 @@ func (wh *WebSocketHandler) handleTransferControl(conn *websocket.Conn, message
 		return fmt.Errorf("failed to execute control action: %v", err)
 	}
 
+	transferStatus, _ := wh.sessionManager.GetTransferStatus(control.TransferID)
+
 	// Send confirmation
 	response := struct {
-		Type       string    `json:"type"`
-		TransferID string    `json:"transfer_id"`
-		Action     string    `json:"action"`
-		Status     string    `json:"status"`
-		Timestamp  time.Time `json:"timestamp"`
+		Type           string         `json:"type"`
+		TransferID     string         `json:"transfer_id"`
+		Action         string         `json:"action"`
+		Status         string         `json:"status"`
+		TransferStatus TransferStatus `json:"transfer_status,omitempty"`
+		Message        string         `json:"message,omitempty"`
+		Timestamp      time.Time      `json:"timestamp"`
 	}{
-		Type:       "control_response",
-		TransferID: control.TransferID,
-		Action:     control.Action,
-		Status:     "success",
-		Timestamp:  time.Now(),
+		Type:           "control_response",
+		TransferID:     control.TransferID,
+		Action:         control.Action,
+		Status:         "success",
+		TransferStatus: transferStatus,
+		Timestamp:      time.Now().UTC(),
+	}
+	if alreadyFinished {
+		response.Message = fmt.Sprintf("transfer already %s", transferStatus)
 	}
 
 	return wh.sendJSONResponse(conn, response)
@@ -356,6 +566,55 @@ func (wh *WebSocketHandler) handleProgressRequest(conn *websocket.Conn, message
 	return wh.sendJSONResponse(conn, response)
 }
 
+// handleDownloadAck applies a client's acknowledgement of the download chunks it has received
+func (wh *WebSocketHandler) handleDownloadAck(conn *websocket.Conn, message []byte) error {
+	var ack struct {
+		Type       string `json:"type"`
+		TransferID string `json:"transfer_id"`
+		ChunkIndex int    `json:"chunk_index"`
+	}
+
+	if err := json.Unmarshal(message, &ack); err != nil {
+		return fmt.Errorf("failed to parse download ack: %v", err)
+	}
+
+	// Only the connection receiving the download may open its window
+	session, exists := wh.sessionManager.GetSession(ack.TransferID)
+	if !exists || !session.attachedTo(conn) {
+		return fmt.Errorf("transfer session %w: %s", ErrNotFound, ack.TransferID)
+	}
+
+	return wh.sessionManager.AcknowledgeDownloadChunk(ack.TransferID, ack.ChunkIndex)
+}
+
+// handleInactivityAnswer applies a client's answer to the prompt sent when its transfer went idle
+func (wh *WebSocketHandler) handleInactivityAnswer(conn *websocket.Conn, message []byte) error {
+	var answer struct {
+		Type       string `json:"type"`
+		TransferID string `json:"transfer_id"`
+		Action     string `json:"action"` // continue, abort
+	}
+
+	if err := json.Unmarshal(message, &answer); err != nil {
+		return fmt.Errorf("failed to parse inactivity answer: %v", err)
+	}
+
+	// Only the connection sending or receiving the transfer may keep it alive
+	session, exists := wh.sessionManager.GetSession(answer.TransferID)
+	if !exists || !session.attachedTo(conn) {
+		return fmt.Errorf("transfer session %w: %s", ErrNotFound, answer.TransferID)
+	}
+
+	return wh.sessionManager.AnswerInactivityPrompt(answer.TransferID, answer.Action)
+}
+
+// attachedTo reports whether conn is the connection sending or receiving the transfer
+func (s *TransferSession) attachedTo(conn *websocket.Conn) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.ClientConn == conn
+}
+
 // handleSessionRegister registers a WebSocket connection with a session ID
 func (wh *WebSocketHandler) handleSessionRegister(conn *websocket.Conn, message []byte) error {
 	var register struct {
@@ -367,6 +626,9 @@ func (wh *WebSocketHandler) handleSessionRegister(conn *websocket.Conn, message
 	if err := json.Unmarshal(message, &register); err != nil {
 		return fmt.Errorf("failed to parse session register: %v", err)
 	}
+	if err := ValidateSessionID(register.SessionID); err != nil {
+		return err
+	}
 
 	// Store connection mapping
 	wh.connections[register.SessionID] = conn
@@ -375,11 +637,11 @@ func (wh *WebSocketHandler) handleSessionRegister(conn *websocket.Conn, message
 	wh.auditLogger.LogEvent(&AuditEvent{
 		EventType:   "session_registered",
 		SessionID:   register.SessionID,
-		IPAddress:   conn.RemoteAddr().String(),
+		IPAddress:   remoteAddr(conn),
 		Details:     map[string]interface{}{"role": register.Role, "session_id": register.SessionID},
 		Severity:    "info",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
 	log.Printf("WebSocket connection registered for session %s as %s", register.SessionID, register.Role)
@@ -394,26 +656,150 @@ func (wh *WebSocketHandler) handleSessionRegister(conn *websocket.Conn, message
 		Type:      "session_registered",
 		SessionID: register.SessionID,
 		Status:    "success",
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
 	return wh.sendJSONResponse(conn, response)
 }
 
+// ServerInfo describes the effective transfer limits and policy so clients can adapt to them
+type ServerInfo struct {
+	ChunkSize             int      `json:"chunk_size"`
+	MinChunkSize          int      `json:"min_chunk_size"` // a transfer request may ask for a chunk size within these bounds
+	MaxChunkSize          int      `json:"max_chunk_size"`
+	DownloadWindow        int      `json:"download_window"` // download chunks sent ahead of acknowledgements; 0 means no flow control
+	MaxFileSize           int64    `json:"max_file_size"`
+	MaxConcurrent         int      `json:"max_concurrent"`
+	AllowedTypes          []string `json:"allowed_types"`
+	BlockedExtensions     []string `json:"blocked_extensions"`
+	AllowedMimeTypes      []string `json:"allowed_mime_types"`
+	RequireApproval       bool     `json:"require_approval"`
+	ApprovalSizeThreshold int64    `json:"approval_size_threshold"`
+	RequireChecksum       bool     `json:"require_checksum"`
+	ChecksumAlgorithm     string   `json:"checksum_algorithm"`
+	CompressionSupported  bool     `json:"compression_supported"`
+	CompressionAlgorithm  string   `json:"compression_algorithm,omitempty"` // what compressed chunks use, when supported
+	EncryptionSupported   bool     `json:"encryption_supported"`
+}
+
+// GetServerInfo returns the limits and policy currently in effect
+func (wh *WebSocketHandler) GetServerInfo() *ServerInfo {
+	config := wh.sessionManager.GetConfig()
+	securityConfig := wh.fileValidator.config
+
+	return &ServerInfo{
+		ChunkSize:             config.ChunkSize,
+		MinChunkSize:          config.MinChunkSize,
+		MaxChunkSize:          config.MaxChunkSize,
+		DownloadWindow:        config.DownloadWindow,
+		MaxFileSize:           config.MaxFileSize,
+		MaxConcurrent:         config.MaxConcurrent,
+		AllowedTypes:          config.AllowedTypes,
+		BlockedExtensions:     securityConfig.BlockedExtensions,
+		AllowedMimeTypes:      securityConfig.AllowedMimeTypes,
+		RequireApproval:       config.RequireApproval,
+		ApprovalSizeThreshold: config.ApprovalSizeThreshold,
+		RequireChecksum:       securityConfig.RequireChecksum,
+		ChecksumAlgorithm:     securityConfig.ChecksumAlgorithm,
+		CompressionSupported:  securityConfig.CompressionEnabled,
+		CompressionAlgorithm:  config.GetCompressionAlgorithm(securityConfig.CompressionEnabled),
+		EncryptionSupported:   securityConfig.EncryptionEnabled && config.EncryptFiles,
+	}
+}
+
+// handleServerInfo replies with the server's effective transfer limits
+func (wh *WebSocketHandler) handleServerInfo(conn *websocket.Conn) error {
+	response := struct {
+		Type      string      `json:"type"`
+		Info      *ServerInfo `json:"info"`
+		Timestamp time.Time   `json:"timestamp"`
+	}{
+		Type:      "server_info_response",
+		Info:      wh.GetServerInfo(),
+		Timestamp: time.Now().UTC(),
+	}
+
+	return wh.sendJSONResponse(conn, response)
+}
+
+// handleResumeUpload reattaches a paused upload to this connection and replies with the chunks it still needs
+func (wh *WebSocketHandler) handleResumeUpload(conn *websocket.Conn, message []byte) error {
+	var resume struct {
+		TransferID string `json:"transfer_id"`
+		SessionID  string `json:"session_id"`
+	}
+	if err := json.Unmarshal(message, &resume); err != nil {
+		return fmt.Errorf("failed to parse resume request: %v", err)
+	}
+
+	return wh.resumeUpload(conn, "resume_upload_response", resume.TransferID, resume.SessionID)
+}
+
+// resumeUpload reattaches a paused upload and replies with a response of responseType listing
+// the chunks still missing
+func (wh *WebSocketHandler) resumeUpload(conn *websocket.Conn, responseType, transferID, sessionID string) error {
+	if err := wh.sessionManager.ReattachUpload(transferID, sessionID, wh.connOwner(conn), conn); err != nil {
+		return fmt.Errorf("failed to resume upload: %v", err)
+	}
+
+	missing, err := wh.sessionManager.GetMissingChunks(transferID)
+	if err != nil {
+		return fmt.Errorf("failed to list missing chunks: %v", err)
+	}
+	session, _ := wh.sessionManager.GetSession(transferID)
+
+	response := FileTransferResponse{
+		Type:          responseType,
+		TransferID:    transferID,
+		Status:        string(StatusInProgress),
+		Message:       "Upload resumed",
+		Approved:      true,
+		ChunkSize:     int(uploadChunkSize(session.Request)),
+		MissingChunks: missing,
+		Timestamp:     time.Now().UTC(),
+	}
+	return wh.sendJSONResponse(conn, response)
+}
+
 // handleFileChunk processes incoming file chunks
 func (wh *WebSocketHandler) handleFileChunk(conn *websocket.Conn, chunk *FileTransferChunk) error {
 	log.Printf("Received file chunk: transfer=%s, chunk=%d, size=%d", chunk.TransferID, chunk.ChunkIndex, len(chunk.Data))
 
 	// Get the file stream for this transfer
+	wh.sessionManager.mutex.RLock()
 	fileStream, exists := wh.sessionManager.fileStreams[chunk.TransferID]
+	wh.sessionManager.mutex.RUnlock()
 	if !exists {
-		return fmt.Errorf("file stream not found for transfer: %s", chunk.TransferID)
+		return fmt.Errorf("file stream %w for transfer: %s", ErrNotFound, chunk.TransferID)
+	}
+
+	data, err := fileStream.openIncoming(chunk.Data, chunk.Encrypted, chunk.Compressed)
+	if err != nil {
+		return fmt.Errorf("failed to read chunk %d: %w", chunk.ChunkIndex, err)
 	}
 
 	// Process the chunk
-	if err := fileStream.WriteChunk(chunk.ChunkIndex, chunk.Data); err != nil {
+	if err := fileStream.WriteChunk(chunk.ChunkIndex, data); err != nil {
+		oversized := errors.Is(err, ErrDeclaredSizeExceeded) || errors.Is(err, ErrChunkIndexOutOfRange)
+		if oversized {
+			if session, exists := wh.sessionManager.GetSession(chunk.TransferID); exists {
+				wh.sessionManager.auditLogger.LogSecurityViolation(chunk.TransferID, session.Request.SessionID, session.Request.Filename, err.Error(), remoteAddr(conn))
+			}
+		}
+		if oversized || errors.Is(err, ErrContentRejected) {
+			// Stop the upload now rather than accepting the rest of the payload
+			if completeErr := wh.sessionManager.CompleteTransfer(chunk.TransferID, false, err.Error()); completeErr != nil {
+				log.Printf("Failed to fail rejected transfer %s: %v", chunk.TransferID, completeErr)
+			}
+			if session, exists := wh.sessionManager.GetSession(chunk.TransferID); exists && session.TempPath != "" {
+				wh.sessionManager.mutex.Lock()
+				wh.sessionManager.removeTempFile(session.TempPath)
+				wh.sessionManager.mutex.Unlock()
+			}
+		}
 		return fmt.Errorf("failed to write chunk: %v", err)
 	}
+	wh.sessionManager.MarkTransferStarted(chunk.TransferID)
 
 	// Send chunk acknowledgment
 	ack := struct {
@@ -427,10 +813,60 @@ func (wh *WebSocketHandler) handleFileChunk(conn *websocket.Conn, chunk *FileTra
 		TransferID: chunk.TransferID,
 		ChunkIndex: chunk.ChunkIndex,
 		Status:     "received",
-		Timestamp:  time.Now(),
+		Timestamp:  time.Now().UTC(),
+	}
+
+	if err := wh.sendJSONResponse(conn, ack); err != nil {
+		return err
+	}
+
+	// The chunk marked as last only finishes the upload once nothing is missing, and a lost
+	// last chunk doesn't hold it up
+	if fileStream.ReceivedAll() {
+		return wh.completeUpload(conn, chunk.TransferID)
+	}
+	if chunk.IsLast {
+		log.Printf("Last chunk of transfer %s arrived with chunks still missing", chunk.TransferID)
+	}
+	return nil
+}
+
+// completeUpload finishes an upload once its last chunk is written, verifying it and telling the
+// client whether it can now be downloaded
+func (wh *WebSocketHandler) completeUpload(conn *websocket.Conn, transferID string) error {
+	if err := wh.sessionManager.CompleteTransfer(transferID, true, ""); err != nil {
+		return fmt.Errorf("failed to complete transfer: %v", err)
+	}
+
+	session, exists := wh.sessionManager.GetSession(transferID)
+	if !exists {
+		return fmt.Errorf("transfer session %w: %s", ErrNotFound, transferID)
+	}
+
+	session.mutex.RLock()
+	status := session.Status
+	session.mutex.RUnlock()
+
+	message := "File transfer completed successfully"
+	if status != StatusCompleted {
+		message = "File transfer failed verification"
+	}
+
+	completion := struct {
+		Type       string         `json:"type"`
+		TransferID string         `json:"transfer_id"`
+		Status     TransferStatus `json:"status"`
+		Message    string         `json:"message"`
+		Timestamp  time.Time      `json:"timestamp"`
+	}{
+		Type:       "transfer_completed",
+		TransferID: transferID,
+		Status:     status,
+		Message:    message,
+		Timestamp:  time.Now().UTC(),
 	}
 
-	return wh.sendJSONResponse(conn, ack)
+	return wh.sendJSONResponse(conn, completion)
 }
 
 // notifyPortalOfTransferRequest notifies the portal of a new transfer request
@@ -453,13 +889,40 @@ func (wh *WebSocketHandler) notifyPortalOfTransferRequest(session *TransferSessi
 	}
 }
 
+// ErrNoConnection is returned when writing to a connection that is nil or was never established
+var ErrNoConnection = errors.New("no websocket connection")
+
+// checkConn returns ErrNoConnection for a nil connection, or a zero-value one with no network
+// connection beneath it, either of which would panic when written to
+func checkConn(conn *websocket.Conn) error {
+	if conn == nil || conn.UnderlyingConn() == nil {
+		return ErrNoConnection
+	}
+	return nil
+}
+
+// remoteAddr returns the connection's peer address, or nothing when there is no connection
+func remoteAddr(conn *websocket.Conn) string {
+	if checkConn(conn) != nil {
+		return ""
+	}
+	return conn.RemoteAddr().String()
+}
+
 // sendJSONResponse sends a JSON response to a WebSocket connection
 func (wh *WebSocketHandler) sendJSONResponse(conn *websocket.Conn, response interface{}) error {
+	if err := checkConn(conn); err != nil {
+		return err
+	}
 	data, err := json.Marshal(response)
 	if err != nil {
 		return fmt.Errorf("failed to marshal response: %v", err)
 	}
 
+	// File streams on the connection write to it too
+	writer := wh.sessionManager.connWriteMutex(conn)
+	writer.Lock()
+	defer writer.Unlock()
 	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 	return conn.WriteMessage(websocket.TextMessage, data)
 }
@@ -475,7 +938,7 @@ func (wh *WebSocketHandler) sendErrorResponse(conn *websocket.Conn, errorType, m
 		Type:      "error",
 		Error:     errorType,
 		Message:   message,
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
 	if err := wh.sendJSONResponse(conn, errorResponse); err != nil {
@@ -490,7 +953,7 @@ func (wh *WebSocketHandler) sendPongResponse(conn *websocket.Conn) error {
 		Timestamp time.Time `json:"timestamp"`
 	}{
 		Type:      "pong",
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
 	return wh.sendJSONResponse(conn, pongResponse)
@@ -526,5 +989,9 @@ func (wh *WebSocketHandler) Shutdown() {
 	// Shutdown session manager
 	wh.sessionManager.Shutdown()
 
+	// Flush the handler's own audit trails
+	wh.fileValidator.Stop()
+	wh.auditLogger.Stop()
+
 	log.Println("WebSocket handler shutdown complete")
 }
\ No newline at end of file
@@ -0,0 +1,910 @@
+package filetransfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// newTestConnPair returns the server and client ends of a live WebSocket connection
+func newTestConnPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+
+	serverConns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	clientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { clientConn.Close() })
+
+	serverConn := <-serverConns
+	t.Cleanup(func() { serverConn.Close() })
+
+	return serverConn, clientConn
+}
+
+// newTestWebSocketHandler creates a handler whose temp and quarantine dirs live under the test dir
+func newTestWebSocketHandler(t *testing.T, config *TransferConfig, securityConfig *SecurityConfig) *WebSocketHandler {
+	t.Helper()
+
+	if config == nil {
+		config = DefaultTransferConfig()
+	}
+	if securityConfig == nil {
+		securityConfig = DefaultSecurityConfig()
+	}
+	config.TempDir = t.TempDir()
+	securityConfig.QuarantineDir = t.TempDir()
+
+	wh := NewWebSocketHandler(config, securityConfig)
+	t.Cleanup(wh.Shutdown)
+	return wh
+}
+
+// readJSON reads the next text message from conn into a generic map
+func readJSON(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+
+	var message map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &message))
+	return message
+}
+
+func TestWebSocketHandler_ServerInfoMatchesConfig(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.ChunkSize = 128 * 1024
+	config.MaxFileSize = 42 * 1024 * 1024
+	config.AllowedTypes = []string{".txt", ".log"}
+	config.RequireApproval = false
+
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.BlockedExtensions = []string{".exe"}
+	securityConfig.CompressionEnabled = true
+
+	wh := newTestWebSocketHandler(t, config, securityConfig)
+
+	info := wh.GetServerInfo()
+	assert.Equal(t, 128*1024, info.ChunkSize)
+	assert.Equal(t, int64(42*1024*1024), info.MaxFileSize)
+	assert.Equal(t, []string{".txt", ".log"}, info.AllowedTypes)
+	assert.Equal(t, []string{".exe"}, info.BlockedExtensions)
+	assert.False(t, info.RequireApproval)
+	assert.True(t, info.CompressionSupported)
+	assert.True(t, info.EncryptionSupported)
+
+	serverConn, clientConn := newTestConnPair(t)
+	require.NoError(t, wh.handleTextMessage(serverConn, []byte(`{"type":"server_info"}`)))
+
+	response := readJSON(t, clientConn)
+	assert.Equal(t, "server_info_response", response["type"])
+	payload := response["info"].(map[string]interface{})
+	assert.Equal(t, float64(128*1024), payload["chunk_size"])
+	assert.Equal(t, float64(42*1024*1024), payload["max_file_size"])
+	assert.Equal(t, false, payload["require_approval"])
+}
+
+type namedScanner struct{ heuristicScanner }
+
+func (namedScanner) Name() string { return "clamav" }
+
+func TestWebSocketHandler_CapabilitiesReflectConfig(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.EncryptFiles = false
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.CompressionEnabled = true
+	securityConfig.ScanForMalware = true
+
+	wh := newTestWebSocketHandler(t, config, securityConfig)
+
+	capabilities := wh.GetCapabilities()
+	assert.Equal(t, ProtocolVersion, capabilities.ProtocolVersion)
+	assert.Contains(t, capabilities.TransferTypes, TransferTypeDirectory)
+	assert.Equal(t, FeatureStatus{Enabled: true, Algorithms: []string{CompressionGzip}}, capabilities.Compression)
+	assert.False(t, capabilities.Encryption.Enabled, "files aren't encrypted at rest when encrypt_files is off")
+	assert.Equal(t, FeatureStatus{Enabled: true, Backend: "basic_heuristic"}, capabilities.MalwareScanning)
+	assert.Equal(t, "local", capabilities.Storage.Backend)
+	assert.False(t, capabilities.ExternalApproval)
+	assert.Equal(t, config.MaxFileSize, capabilities.Limits.MaxFileSize)
+
+	wh.fileValidator.SetMalwareScanner(namedScanner{})
+	assert.Equal(t, "clamav", wh.GetCapabilities().MalwareScanning.Backend)
+
+	// Disabled features are still listed, so clients can tell off from unsupported
+	defaults := newTestWebSocketHandler(t, nil, nil).GetCapabilities()
+	assert.False(t, defaults.Compression.Enabled)
+	assert.Equal(t, []string{CompressionGzip}, defaults.Compression.Algorithms)
+	assert.True(t, defaults.Encryption.Enabled)
+	assert.False(t, defaults.MalwareScanning.Enabled)
+}
+
+func TestWebSocketHandler_ApprovalSizeThreshold(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = true
+	config.ApprovalSizeThreshold = 1024 * 1024
+
+	wh := newTestWebSocketHandler(t, config, nil)
+
+	sendRequest := func(filename string, size int64) map[string]interface{} {
+		serverConn, clientConn := newTestConnPair(t)
+		request, err := json.Marshal(FileTransferRequest{
+			Type:              TransferTypeUpload,
+			Filename:          filename,
+			FileSize:          size,
+			Checksum:          "abc123",
+			ChecksumAlgorithm: "SHA256",
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, wh.handleFileTransferRequest(serverConn, request))
+		return readJSON(t, clientConn)
+	}
+
+	small := sendRequest("small.txt", 4*1024)
+	assert.Equal(t, string(StatusApproved), small["status"])
+	assert.Equal(t, "Transfer approved and ready", small["message"])
+
+	large := sendRequest("large.txt", 2*1024*1024)
+	assert.Equal(t, string(StatusPending), large["status"])
+	assert.Equal(t, "Transfer request pending approval", large["message"])
+
+	session, exists := wh.sessionManager.GetSession(large["transfer_id"].(string))
+	require.True(t, exists)
+	assert.Equal(t, StatusPending, session.Status)
+}
+
+func TestTransferConfig_RequiresApproval(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	assert.False(t, config.RequiresApproval(10*1024*1024))
+
+	config.ApprovalSizeThreshold = 1000
+	assert.False(t, config.RequiresApproval(999))
+	assert.True(t, config.RequiresApproval(1000))
+
+	config.RequireApproval = true
+	config.ApprovalSizeThreshold = 0
+	assert.True(t, config.RequiresApproval(1))
+}
+
+func TestWebSocketHandler_SlowChunkSurvivesShortIdleTimeout(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.ReadIdleTimeout = 100 * time.Millisecond
+	config.ChunkSize = 64 * 1024
+	config.MinUploadBandwidth = 64 * 1024 // one chunk may take up to a second
+
+	wh := newTestWebSocketHandler(t, config, nil)
+	server := httptest.NewServer(http.HandlerFunc(wh.HandleWebSocket))
+	t.Cleanup(server.Close)
+
+	// A small write buffer makes the client flush each piece as its own frame
+	dialer := websocket.Dialer{WriteBufferSize: 512}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	header, err := json.Marshal(FileTransferChunk{TransferID: "slow-transfer", ChunkIndex: 0})
+	require.NoError(t, err)
+	message := []byte{byte(len(header) >> 24), byte(len(header) >> 16), byte(len(header) >> 8), byte(len(header))}
+	message = append(message, header...)
+	message = append(message, make([]byte, 4096)...)
+
+	// Trickle the chunk in over ~400ms, well past the 100ms idle timeout
+	writer, err := conn.NextWriter(websocket.BinaryMessage)
+	require.NoError(t, err)
+	for offset := 0; offset < len(message); offset += 512 {
+		end := offset + 512
+		if end > len(message) {
+			end = len(message)
+		}
+		_, err := writer.Write(message[offset:end])
+		require.NoError(t, err)
+		time.Sleep(40 * time.Millisecond)
+	}
+	require.NoError(t, writer.Close())
+
+	// The server read the whole chunk and answered instead of timing out
+	response := readJSON(t, conn)
+	assert.Equal(t, "error", response["type"])
+	assert.Equal(t, "binary_error", response["error"])
+	assert.Contains(t, response["message"], "file stream not found")
+}
+
+func TestTransferConfig_ChunkReadTimeout(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.ReadIdleTimeout = 10 * time.Second
+	config.ChunkSize = 1024 * 1024
+	config.MinUploadBandwidth = 8 * 1024
+	assert.Equal(t, 128*time.Second, config.ChunkReadTimeout())
+
+	config.MinUploadBandwidth = 1024 * 1024
+	assert.Equal(t, 10*time.Second, config.ChunkReadTimeout())
+}
+
+func TestWebSocketHandler_RejectsDisguisedUploadOnFirstChunk(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.EncryptFiles = false // chunks are sent in the clear
+
+	wh := newTestWebSocketHandler(t, config, nil)
+	serverConn, clientConn := newTestConnPair(t)
+
+	request, err := json.Marshal(FileTransferRequest{
+		Type:              TransferTypeUpload,
+		Filename:          "report.txt",
+		FileSize:          4 * ChunkSize,
+		Checksum:          "abc123",
+		ChecksumAlgorithm: "SHA256",
+	})
+	require.NoError(t, err)
+	require.NoError(t, wh.handleFileTransferRequest(serverConn, request))
+
+	response := readJSON(t, clientConn)
+	require.Equal(t, string(StatusApproved), response["status"])
+	transferID := response["transfer_id"].(string)
+
+	session, exists := wh.sessionManager.GetSession(transferID)
+	require.True(t, exists)
+
+	// A Windows executable renamed to .txt
+	disguised := append([]byte("MZ\x90\x00\x03\x00\x00\x00"), make([]byte, 1024)...)
+	err = wh.handleFileChunk(serverConn, &FileTransferChunk{TransferID: transferID, ChunkIndex: 0, Data: disguised})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ErrContentRejected.Error())
+
+	assert.Equal(t, StatusFailed, session.Status)
+	assert.NoFileExists(t, session.TempPath)
+
+	// The rest of the upload is refused instead of being written
+	err = wh.handleFileChunk(serverConn, &FileTransferChunk{TransferID: transferID, ChunkIndex: 1, Data: make([]byte, 1024)})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestWebSocketHandler_CompletedUploadCanBeDownloaded(t *testing.T) {
+	content := []byte("quarterly notes\n")
+	sum := sha256.Sum256(content)
+
+	upload := func(t *testing.T, config *TransferConfig) (*WebSocketHandler, string) {
+		config.RequireApproval = false
+		config.EncryptFiles = false // chunks are sent in the clear
+		wh := newTestWebSocketHandler(t, config, nil)
+		serverConn, clientConn := newTestConnPair(t)
+
+		request, err := json.Marshal(FileTransferRequest{
+			Type:              TransferTypeUpload,
+			Filename:          "notes.txt",
+			FileSize:          int64(len(content)),
+			Checksum:          hex.EncodeToString(sum[:]),
+			ChecksumAlgorithm: "SHA256",
+		})
+		require.NoError(t, err)
+		require.NoError(t, wh.handleFileTransferRequest(serverConn, request))
+		transferID := readJSON(t, clientConn)["transfer_id"].(string)
+
+		require.NoError(t, wh.handleFileChunk(serverConn, &FileTransferChunk{TransferID: transferID, ChunkIndex: 0, Data: content, IsLast: true}))
+		assert.Equal(t, "chunk_ack", readJSON(t, clientConn)["type"])
+		completion := readJSON(t, clientConn)
+		assert.Equal(t, "transfer_completed", completion["type"])
+		assert.Equal(t, string(StatusCompleted), completion["status"])
+		return wh, transferID
+	}
+
+	download := func(wh *WebSocketHandler, transferID string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		wh.sessionManager.ServeCompletedFile(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+transferID+"/download", nil), transferID)
+		return rec
+	}
+
+	t.Run("retained", func(t *testing.T) {
+		wh, transferID := upload(t, DefaultTransferConfig())
+
+		rec := download(wh, transferID)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Equal(t, content, rec.Body.Bytes())
+		assert.Equal(t, hex.EncodeToString(sum[:]), rec.Header().Get(HeaderChecksumSHA256))
+	})
+
+	t.Run("not retained", func(t *testing.T) {
+		config := DefaultTransferConfig()
+		config.RetainCompletedFiles = false
+		wh, transferID := upload(t, config)
+
+		session, exists := wh.sessionManager.GetSession(transferID)
+		require.True(t, exists)
+		assert.Equal(t, StatusCompleted, session.Status)
+		assert.Empty(t, session.TempPath)
+		assert.Equal(t, http.StatusNotFound, download(wh, transferID).Code)
+
+		entries, err := os.ReadDir(config.TempDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries, "the completed file is deleted")
+	})
+}
+
+func TestWebSocketHandler_CompletesUploadWithoutLastChunkMarker(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.EncryptFiles = false // chunks are sent in the clear
+	wh := newTestWebSocketHandler(t, config, nil)
+	serverConn, clientConn := newTestConnPair(t)
+
+	content := []byte(strings.Repeat("lost marker ", 1000))
+	sum := sha256.Sum256(content)
+
+	request, err := json.Marshal(FileTransferRequest{
+		Type:              TransferTypeUpload,
+		Filename:          "marker.txt",
+		FileSize:          int64(len(content)),
+		Checksum:          hex.EncodeToString(sum[:]),
+		ChecksumAlgorithm: "SHA256",
+		ChunkSize:         4096,
+	})
+	require.NoError(t, err)
+	require.NoError(t, wh.handleFileTransferRequest(serverConn, request))
+	transferID := readJSON(t, clientConn)["transfer_id"].(string)
+
+	// No chunk is flagged as last; the final byte arriving completes the transfer
+	for _, index := range []int{2, 0, 1} {
+		end := (index + 1) * 4096
+		if end > len(content) {
+			end = len(content)
+		}
+		chunk := &FileTransferChunk{TransferID: transferID, ChunkIndex: index, Data: content[index*4096 : end]}
+		require.NoError(t, wh.handleFileChunk(serverConn, chunk))
+		assert.Equal(t, "chunk_ack", readJSON(t, clientConn)["type"])
+
+		session, _ := wh.sessionManager.GetSession(transferID)
+		session.mutex.RLock()
+		status := session.Status
+		session.mutex.RUnlock()
+		if index != 1 {
+			assert.False(t, status.IsTerminal(), "completed before every byte arrived")
+		}
+	}
+
+	completion := readJSON(t, clientConn)
+	assert.Equal(t, "transfer_completed", completion["type"])
+	assert.Equal(t, string(StatusCompleted), completion["status"])
+
+	rec := httptest.NewRecorder()
+	wh.sessionManager.ServeCompletedFile(rec, httptest.NewRequest(http.MethodGet, "/", nil), transferID)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, content, rec.Body.Bytes())
+}
+
+func TestWebSocketHandler_ReassemblesUploadWithNegotiatedChunkSize(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.EncryptFiles = false // chunks are sent in the clear
+	wh := newTestWebSocketHandler(t, config, nil)
+	serverConn, clientConn := newTestConnPair(t)
+
+	content := []byte(strings.Repeat("0123456789abcdef", 600)) // 9600 bytes, three 4KB chunks
+	sum := sha256.Sum256(content)
+
+	request, err := json.Marshal(FileTransferRequest{
+		Type:              TransferTypeUpload,
+		Filename:          "notes.txt",
+		FileSize:          int64(len(content)),
+		Checksum:          hex.EncodeToString(sum[:]),
+		ChecksumAlgorithm: "SHA256",
+		ChunkSize:         4096,
+	})
+	require.NoError(t, err)
+	require.NoError(t, wh.handleFileTransferRequest(serverConn, request))
+	response := readJSON(t, clientConn)
+	require.Equal(t, float64(4096), response["chunk_size"])
+	transferID := response["transfer_id"].(string)
+
+	// Chunks arrive out of order and land at offsets in the negotiated size; the one marked
+	// last doesn't finish the upload while others are missing
+	for _, index := range []int{2, 0, 1} {
+		end := (index + 1) * 4096
+		if end > len(content) {
+			end = len(content)
+		}
+		chunk := &FileTransferChunk{TransferID: transferID, ChunkIndex: index, Data: content[index*4096 : end], IsLast: index == 2}
+		require.NoError(t, wh.handleFileChunk(serverConn, chunk))
+		assert.Equal(t, "chunk_ack", readJSON(t, clientConn)["type"])
+	}
+	assert.Equal(t, string(StatusCompleted), readJSON(t, clientConn)["status"])
+
+	rec := httptest.NewRecorder()
+	wh.sessionManager.ServeCompletedFile(rec, httptest.NewRequest(http.MethodGet, "/", nil), transferID)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, content, rec.Body.Bytes())
+}
+
+func TestTransferConfig_NegotiateChunkSize(t *testing.T) {
+	config := DefaultTransferConfig()
+	assert.Equal(t, config.ChunkSize, config.NegotiateChunkSize(0))
+	assert.Equal(t, 16*1024, config.NegotiateChunkSize(16*1024))
+	assert.Equal(t, config.MinChunkSize, config.NegotiateChunkSize(1))
+	assert.Equal(t, config.MaxChunkSize, config.NegotiateChunkSize(100*1024*1024))
+
+	// Without bounds the configured size is fixed
+	config.MinChunkSize, config.MaxChunkSize = 0, 0
+	assert.Equal(t, config.ChunkSize, config.NegotiateChunkSize(16*1024))
+}
+
+func TestWebSocketHandler_AbortsUploadSendingMoreThanDeclared(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.EncryptFiles = false // chunks are sent in the clear
+
+	wh := newTestWebSocketHandler(t, config, nil)
+	wh.sessionManager.auditLogger.Stop()
+	wh.sessionManager.auditLogger = NewAuditLogger(t.TempDir(), true)
+	serverConn, clientConn := newTestConnPair(t)
+
+	request, err := json.Marshal(FileTransferRequest{
+		Type:              TransferTypeUpload,
+		Filename:          "notes.txt",
+		FileSize:          ChunkSize + 100,
+		Checksum:          "abc123",
+		ChecksumAlgorithm: "SHA256",
+	})
+	require.NoError(t, err)
+	require.NoError(t, wh.handleFileTransferRequest(serverConn, request))
+
+	response := readJSON(t, clientConn)
+	require.Equal(t, string(StatusApproved), response["status"])
+	transferID := response["transfer_id"].(string)
+
+	session, exists := wh.sessionManager.GetSession(transferID)
+	require.True(t, exists)
+
+	// Data within the declared size is accepted
+	require.NoError(t, wh.handleFileChunk(serverConn, &FileTransferChunk{TransferID: transferID, ChunkIndex: 0, Data: []byte(strings.Repeat("n", ChunkSize))}))
+	assert.Equal(t, "chunk_ack", readJSON(t, clientConn)["type"])
+
+	// The client keeps sending past what it declared
+	err = wh.handleFileChunk(serverConn, &FileTransferChunk{TransferID: transferID, ChunkIndex: 1, Data: []byte(strings.Repeat("notes ", 100))})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ErrDeclaredSizeExceeded.Error())
+
+	assert.Equal(t, StatusFailed, session.Status)
+	assert.NoFileExists(t, session.TempPath)
+
+	var violations []AuditEvent
+	for _, event := range readAuditEvents(t, wh.sessionManager.auditLogger) {
+		if event.EventType == AuditEventSecurityViolation {
+			violations = append(violations, event)
+		}
+	}
+	require.Len(t, violations, 1)
+	assert.Equal(t, transferID, violations[0].TransferID)
+	assert.Contains(t, violations[0].ErrorMsg, ErrDeclaredSizeExceeded.Error())
+}
+
+func TestMaxUploadBytes(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.EncryptionEnabled = false
+	securityConfig.CompressionEnabled = false
+	assert.Equal(t, int64(1000), maxUploadBytes(1000, nil))
+	assert.Equal(t, int64(1000), maxUploadBytes(1000, securityConfig))
+
+	// Encryption and compression each leave room for their overhead on incompressible data
+	securityConfig.EncryptionEnabled = true
+	assert.Equal(t, int64(1000+gcmOverhead), maxUploadBytes(1000, securityConfig))
+	securityConfig.CompressionEnabled = true
+	assert.Equal(t, int64(1000+gcmOverhead+5+18), maxUploadBytes(1000, securityConfig))
+}
+
+func TestFileValidator_ValidateContent(t *testing.T) {
+	fv := NewFileValidator(DefaultSecurityConfig())
+	defer fv.auditLogger.Stop()
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	assert.NoError(t, fv.ValidateContent("notes.txt", []byte("plain old notes\n")))
+	assert.NoError(t, fv.ValidateContent("photo.png", png))
+	assert.NoError(t, fv.ValidateContent("sheet.xlsx", []byte("PK\x03\x04\x14\x00\x06\x00")))
+
+	assert.ErrorIs(t, fv.ValidateContent("photo.jpg", png), ErrContentRejected)
+	assert.ErrorIs(t, fv.ValidateContent("notes.txt", png), ErrContentRejected)
+	assert.ErrorIs(t, fv.ValidateContent("notes.txt", []byte("#!/bin/sh\nrm -rf /\n")), ErrContentRejected)
+}
+
+func TestWebSocketHandler_DuplicateControlCommandsAreIdempotent(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+
+	wh := newTestWebSocketHandler(t, config, nil)
+	serverConn, clientConn := newTestConnPair(t)
+
+	request, err := json.Marshal(FileTransferRequest{
+		Type:              TransferTypeUpload,
+		Filename:          "report.txt",
+		FileSize:          1024,
+		Checksum:          "abc123",
+		ChecksumAlgorithm: "SHA256",
+	})
+	require.NoError(t, err)
+	require.NoError(t, wh.handleFileTransferRequest(serverConn, request))
+	transferID := readJSON(t, clientConn)["transfer_id"].(string)
+
+	control := []byte(`{"type":"transfer_control","transfer_id":"` + transferID + `","action":"cancel"}`)
+
+	require.NoError(t, wh.handleTextMessage(serverConn, control))
+	first := readJSON(t, clientConn)
+	assert.Equal(t, "success", first["status"])
+	assert.Equal(t, string(StatusCancelled), first["transfer_status"])
+	assert.Nil(t, first["message"])
+
+	// A retried cancel, pause or resume is a no-op that reports the final status
+	for _, action := range []string{"cancel", "pause", "resume"} {
+		control := []byte(`{"type":"transfer_control","transfer_id":"` + transferID + `","action":"` + action + `"}`)
+		require.NoError(t, wh.handleTextMessage(serverConn, control), action)
+
+		response := readJSON(t, clientConn)
+		assert.Equal(t, "control_response", response["type"])
+		assert.Equal(t, "success", response["status"], action)
+		assert.Equal(t, string(StatusCancelled), response["transfer_status"], action)
+		assert.Equal(t, "transfer already cancelled", response["message"], action)
+	}
+
+	// A late completion doesn't overwrite the cancellation
+	require.NoError(t, wh.sessionManager.CompleteTransfer(transferID, true, ""))
+	status, exists := wh.sessionManager.GetTransferStatus(transferID)
+	require.True(t, exists)
+	assert.Equal(t, StatusCancelled, status)
+}
+
+func TestWebSocketHandler_StreamsTransferEventsAsNDJSON(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	wh := newTestWebSocketHandler(t, nil, securityConfig)
+	sm := wh.GetSessionManager()
+
+	server := httptest.NewServer(http.HandlerFunc(wh.HandleTransferStream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	serverConn, _ := newTestConnPair(t)
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:      TransferTypeUpload,
+		Filename:  "report.txt",
+		FileSize:  1024,
+		SessionID: "remote-session",
+	}, serverConn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(session.ID, true, "looks fine"))
+	require.NoError(t, sm.CompleteTransfer(session.ID, false, "client aborted"))
+
+	// Progress updates may interleave; the lifecycle events arrive in order
+	lines := make(chan []byte)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- append([]byte(nil), scanner.Bytes()...)
+		}
+		close(lines)
+	}()
+
+	var lifecycle []string
+	for len(lifecycle) < 3 {
+		select {
+		case line, ok := <-lines:
+			require.True(t, ok, "stream closed early")
+			var event TransferEvent
+			require.NoError(t, json.Unmarshal(line, &event))
+			assert.Equal(t, session.ID, event.TransferID)
+			assert.Equal(t, "remote-session", event.SessionID)
+			assert.Equal(t, "report.txt", event.Filename)
+			if event.Type != TransferEventProgress {
+				lifecycle = append(lifecycle, event.Type)
+			}
+			if event.Type == TransferEventFailed {
+				assert.Equal(t, "client aborted", event.Details["error_message"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for events, got %v", lifecycle)
+		}
+	}
+	assert.Equal(t, []string{TransferEventCreated, TransferEventApproved, TransferEventFailed}, lifecycle)
+
+	// Disconnecting the client unsubscribes it
+	resp.Body.Close()
+	assert.Eventually(t, func() bool {
+		sm.events.mutex.Lock()
+		defer sm.events.mutex.Unlock()
+		return len(sm.events.subscribers) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestWebSocketHandler_ShutdownJoinsBackgroundGoroutines(t *testing.T) {
+	// Registered first so it runs after every other cleanup, including the test servers
+	ignore := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+
+	wh := newTestWebSocketHandler(t, nil, nil)
+	sm := wh.GetSessionManager()
+
+	// An approved upload waits on the client for data, keeping its worker busy
+	serverConn, _ := newTestConnPair(t)
+	wh.connections["session-1"] = serverConn
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		SessionID:         "session-1",
+		Type:              TransferTypeUpload,
+		Filename:          "report.txt",
+		FileSize:          1024,
+		Checksum:          "abc123",
+		ChecksumAlgorithm: "sha256",
+	}, serverConn, nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApproveTransfer(session.ID, true, ""))
+	fileStream := sm.fileStreams[session.ID]
+	require.True(t, fileStream.IsActive())
+
+	wh.Shutdown()
+	assert.True(t, fileStream.Wait(time.Second))
+	assert.False(t, fileStream.IsActive())
+
+	// Late calls on the stopped stream and a second shutdown are harmless
+	fileStream.Pause()
+	fileStream.Cancel()
+	wh.Shutdown()
+}
+
+func TestSessionManager_ReportsProgressForPausedAndEndedTransfers(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.EncryptFiles = false // chunks are sent in the clear
+	wh := newTestWebSocketHandler(t, config, nil)
+	sm := wh.sessionManager
+	serverConn, clientConn := newTestConnPair(t)
+
+	request, err := json.Marshal(FileTransferRequest{
+		Type:              TransferTypeUpload,
+		Filename:          "progress.txt",
+		FileSize:          8192,
+		Checksum:          "abc123",
+		ChecksumAlgorithm: "SHA256",
+		ChunkSize:         4096,
+	})
+	require.NoError(t, err)
+	require.NoError(t, wh.handleFileTransferRequest(serverConn, request))
+	transferID := readJSON(t, clientConn)["transfer_id"].(string)
+
+	chunk := &FileTransferChunk{TransferID: transferID, ChunkIndex: 0, Data: []byte(strings.Repeat("a", 4096))}
+	require.NoError(t, wh.handleFileChunk(serverConn, chunk))
+	require.NoError(t, sm.PauseTransfer(transferID))
+
+	progress, err := sm.GetTransferProgress(transferID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4096), progress.BytesTransferred)
+	assert.Equal(t, int64(8192), progress.TotalBytes)
+	assert.Equal(t, float64(50), progress.Percentage)
+
+	// The stream is gone once the transfer ends, but its last progress is still reported
+	require.NoError(t, sm.CancelTransfer(transferID))
+	progress, err = sm.GetTransferProgress(transferID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4096), progress.BytesTransferred)
+
+	_, err = sm.GetTransferProgress("00000000-0000-0000-0000-000000000000")
+	assert.Error(t, err)
+}
+
+func TestSessionManager_SynthesizesProgressWithoutAStream(t *testing.T) {
+	content := []byte(strings.Repeat("b", 8192))
+	sum := sha256.Sum256(content)
+
+	// start requests an upload and returns its ID, auto-approved unless held for approval
+	start := func(t *testing.T, requireApproval bool) (*WebSocketHandler, *websocket.Conn, string) {
+		config := DefaultTransferConfig()
+		config.RequireApproval = requireApproval
+		config.EncryptFiles = false // chunks are sent in the clear
+		wh := newTestWebSocketHandler(t, config, nil)
+		serverConn, clientConn := newTestConnPair(t)
+
+		request, err := json.Marshal(FileTransferRequest{
+			Type:              TransferTypeUpload,
+			Filename:          "states.txt",
+			FileSize:          int64(len(content)),
+			Checksum:          hex.EncodeToString(sum[:]),
+			ChecksumAlgorithm: "SHA256",
+			ChunkSize:         4096,
+		})
+		require.NoError(t, err)
+		require.NoError(t, wh.handleFileTransferRequest(serverConn, request))
+		transferID := readJSON(t, clientConn)["transfer_id"].(string)
+		return wh, serverConn, transferID
+	}
+	sendChunk := func(t *testing.T, wh *WebSocketHandler, conn *websocket.Conn, transferID string, index int) {
+		chunk := &FileTransferChunk{TransferID: transferID, ChunkIndex: index, Data: content[index*4096 : (index+1)*4096]}
+		require.NoError(t, wh.handleFileChunk(conn, chunk))
+	}
+	progressOf := func(t *testing.T, wh *WebSocketHandler, transferID string) *FileTransferProgress {
+		progress, err := wh.sessionManager.GetTransferProgress(transferID)
+		require.NoError(t, err)
+		assert.Equal(t, transferID, progress.ID)
+		assert.Equal(t, int64(len(content)), progress.TotalBytes)
+		return progress
+	}
+
+	t.Run("pending", func(t *testing.T) {
+		wh, _, transferID := start(t, true)
+		progress := progressOf(t, wh, transferID)
+		assert.Zero(t, progress.BytesTransferred)
+		assert.Zero(t, progress.Percentage)
+	})
+
+	t.Run("approved but not started", func(t *testing.T) {
+		wh, _, transferID := start(t, false)
+		progress := progressOf(t, wh, transferID)
+		assert.Zero(t, progress.BytesTransferred)
+		assert.Zero(t, progress.Percentage)
+	})
+
+	t.Run("completed", func(t *testing.T) {
+		wh, conn, transferID := start(t, false)
+		sendChunk(t, wh, conn, transferID, 0)
+		sendChunk(t, wh, conn, transferID, 1)
+		status, _ := wh.sessionManager.GetTransferStatus(transferID)
+		require.Equal(t, StatusCompleted, status)
+
+		progress := progressOf(t, wh, transferID)
+		assert.Equal(t, int64(len(content)), progress.BytesTransferred)
+		assert.Equal(t, float64(100), progress.Percentage)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		wh, conn, transferID := start(t, false)
+		sendChunk(t, wh, conn, transferID, 0)
+		require.NoError(t, wh.sessionManager.CancelTransfer(transferID))
+
+		progress := progressOf(t, wh, transferID)
+		assert.Equal(t, int64(4096), progress.BytesTransferred)
+		assert.Equal(t, float64(50), progress.Percentage)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		wh, conn, transferID := start(t, false)
+		sendChunk(t, wh, conn, transferID, 0)
+		require.NoError(t, wh.sessionManager.CompleteTransfer(transferID, false, "client went away"))
+
+		progress := progressOf(t, wh, transferID)
+		assert.Equal(t, int64(4096), progress.BytesTransferred)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		wh := newTestWebSocketHandler(t, nil, nil)
+		_, err := wh.sessionManager.GetTransferProgress("00000000-0000-0000-0000-000000000000")
+		assert.Error(t, err)
+	})
+}
+
+func TestWebSocketHandler_TimestampsAreUTC(t *testing.T) {
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	wh := newTestWebSocketHandler(t, nil, securityConfig)
+	sm := wh.GetSessionManager()
+	sm.auditLogger.Stop()
+	sm.auditLogger = NewAuditLogger(t.TempDir(), true)
+
+	serverConn, clientConn := newTestConnPair(t)
+	require.NoError(t, wh.handleTextMessage(serverConn, []byte(`{"type":"server_info"}`)))
+	assert.Regexp(t, `Z$`, readJSON(t, clientConn)["timestamp"])
+
+	session, err := sm.CreateTransferSession(&FileTransferRequest{
+		Type:     TransferTypeUpload,
+		Filename: "report.txt",
+		FileSize: 1024,
+	}, nil, nil)
+	require.NoError(t, err)
+	encoded, err := json.Marshal(session)
+	require.NoError(t, err)
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(encoded, &record))
+	assert.Regexp(t, `Z$`, record["StartTime"])
+
+	// A caller's local time keeps its instant but is written in UTC
+	saoPaulo := time.FixedZone("BRT", -3*60*60)
+	sm.auditLogger.LogEvent(&AuditEvent{EventType: AuditEventFileRescanned, TransferID: session.ID, Timestamp: time.Date(2026, 3, 1, 9, 0, 0, 0, saoPaulo)})
+
+	events := readAuditEvents(t, sm.auditLogger)
+	require.NotEmpty(t, events)
+	for _, event := range events {
+		assert.Equal(t, time.UTC, event.Timestamp.Location(), string(event.EventType))
+	}
+	assert.Equal(t, "2026-03-01T12:00:00Z", events[len(events)-1].Timestamp.Format(time.RFC3339))
+}
+
+func TestWebSocketHandler_MissingConnectionsFailGracefully(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.RequireApproval = false
+	config.EncryptFiles = false // chunks are sent in the clear
+	securityConfig := DefaultSecurityConfig()
+	securityConfig.RequireChecksum = false
+	wh := newTestWebSocketHandler(t, config, securityConfig)
+	sm := wh.GetSessionManager()
+
+	for name, conn := range map[string]*websocket.Conn{"nil": nil, "zero-value": {}} {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorIs(t, wh.sendJSONResponse(conn, map[string]string{"type": "pong"}), ErrNoConnection)
+			assert.NotPanics(t, func() { wh.sendErrorResponse(conn, "message_error", "no one to tell") })
+
+			// The transfer is created and approved, and the connection's absence is reported when it's answered
+			request, err := json.Marshal(FileTransferRequest{Type: TransferTypeUpload, Filename: "notes.txt", FileSize: 5})
+			require.NoError(t, err)
+			assert.ErrorIs(t, wh.handleFileTransferRequest(conn, request), ErrNoConnection)
+
+			var session *TransferSession
+			for _, active := range sm.GetActiveSessions() {
+				if active.ClientConn == conn {
+					session = active
+				}
+			}
+			require.NotNil(t, session)
+			assert.Nil(t, session.PortalConn)
+
+			// Its stream runs, and reports progress, without a connection to write to
+			chunk := &FileTransferChunk{TransferID: session.ID, Data: []byte("hello"), IsLast: true}
+			assert.ErrorIs(t, wh.handleFileChunk(conn, chunk), ErrNoConnection)
+			require.NoError(t, sm.CancelTransfer(session.ID))
+
+			stream, err := NewFileStream("download", filepath.Join(t.TempDir(), "missing"), true, conn, 0)
+			require.NoError(t, err)
+			assert.ErrorIs(t, stream.sendChunk(FileChunk{ID: "download", Data: []byte("data")}), ErrNoConnection)
+			assert.NotPanics(t, func() { stream.requestChunkRetransmission(0) })
+			assert.ErrorIs(t, stream.sendMessage(map[string]string{"type": InactivityPromptMessage}), ErrNoConnection)
+		})
+	}
+}
+
+func TestWebSocketHandler_ChecksOriginAgainstAllowedOrigins(t *testing.T) {
+	config := DefaultTransferConfig()
+	config.AllowedOrigins = []string{"https://portal.example.com"}
+	wh := newTestWebSocketHandler(t, config, nil)
+
+	server := httptest.NewServer(http.HandlerFunc(wh.HandleWebSocket))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.test"}})
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	for _, origin := range []string{"https://portal.example.com", ""} {
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		require.NoError(t, err, origin)
+		conn.Close()
+	}
+
+	// Config files without the setting keep accepting the portal from its own port
+	var legacy TransferConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"max_concurrent": 5}`), &legacy))
+	assert.Equal(t, []string{"*"}, legacy.GetAllowedOrigins())
+}
@@ -0,0 +1,116 @@
+// Package idgen generates the identifiers given to sessions and transfers
+package idgen
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ErrExhausted is returned when every candidate drawn was already in use
+var ErrExhausted = errors.New("no unused identifier found")
+
+// maxAttempts bounds how many candidates Unique draws before giving up
+const maxAttempts = 32
+
+// Generator produces candidate identifiers. Candidates needn't be unique on their own;
+// callers pass them through Unique to skip the ones already in use.
+type Generator interface {
+	NewID() string
+}
+
+// UUID generates random UUIDs, the default for every session manager
+type UUID struct{}
+
+// NewID returns a new random UUID
+func (UUID) NewID() string {
+	return uuid.New().String()
+}
+
+// shortCodeAlphabet leaves out characters easily confused when read aloud or handwritten (0/O, 1/I/L, U/V)
+const shortCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTWXYZ"
+
+// DefaultShortCodeLength gives about 594 million codes, plenty for the sessions live at once
+const DefaultShortCodeLength = 6
+
+// ShortCode generates short codes such as "K7M-4QX" that a customer can read to a technician
+// over the phone. There are far fewer of them than UUIDs, so they rely on Unique to avoid
+// handing out a code that is still in use.
+type ShortCode struct {
+	Length int // characters, not counting separators; DefaultShortCodeLength when zero
+}
+
+// NewID returns a random code, grouped in threes
+func (s ShortCode) NewID() string {
+	length := s.Length
+	if length <= 0 {
+		length = DefaultShortCodeLength
+	}
+
+	var code strings.Builder
+	alphabetSize := big.NewInt(int64(len(shortCodeAlphabet)))
+	for i := 0; i < length; i++ {
+		if i > 0 && i%3 == 0 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			// crypto/rand doesn't fail on supported platforms
+			panic("idgen: failed to read random bytes: " + err.Error())
+		}
+		code.WriteByte(shortCodeAlphabet[n.Int64()])
+	}
+	return code.String()
+}
+
+// NormalizeShortCode canonicalizes a code as typed or read back by a person: case, spaces
+// and misplaced separators are ignored
+func NormalizeShortCode(code string) string {
+	var characters strings.Builder
+	for _, c := range strings.ToUpper(code) {
+		if c == '-' || c == ' ' || c == '\t' {
+			continue
+		}
+		characters.WriteRune(c)
+	}
+
+	var normalized strings.Builder
+	for i, c := range characters.String() {
+		if i > 0 && i%3 == 0 {
+			normalized.WriteByte('-')
+		}
+		normalized.WriteRune(c)
+	}
+	return normalized.String()
+}
+
+// IsShortCode reports whether id has the shape of a code from ShortCode
+func IsShortCode(id string) bool {
+	groups := strings.Split(id, "-")
+	for i, group := range groups {
+		// Every group is three characters except possibly the last
+		if group == "" || len(group) > 3 || (i < len(groups)-1 && len(group) != 3) {
+			return false
+		}
+		for _, c := range group {
+			if !strings.ContainsRune(shortCodeAlphabet, c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Unique draws candidates from gen until one isn't taken
+func Unique(gen Generator, taken func(id string) bool) (string, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		id := gen.NewID()
+		if id != "" && !taken(id) {
+			return id, nil
+		}
+	}
+	return "", ErrExhausted
+}
@@ -0,0 +1,57 @@
+package idgen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUUID_GeneratesParseableIDs(t *testing.T) {
+	id := UUID{}.NewID()
+	_, err := uuid.Parse(id)
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, UUID{}.NewID())
+}
+
+func TestShortCode_ReadableGroupedCodes(t *testing.T) {
+	code := ShortCode{}.NewID()
+	assert.Regexp(t, `^[2-9A-HJKMNP-TW-Z]{3}-[2-9A-HJKMNP-TW-Z]{3}$`, code)
+	assert.True(t, IsShortCode(code))
+
+	assert.Len(t, ShortCode{Length: 4}.NewID(), 5)
+	assert.True(t, IsShortCode(ShortCode{Length: 4}.NewID()))
+
+	assert.Equal(t, "K7M-4QX", NormalizeShortCode(" k7m 4qx"))
+	assert.Equal(t, "K7M-4QX-P", NormalizeShortCode("K7-M4QXP"))
+
+	for _, id := range []string{"", "ABC-", "AB-CDE", "ABC-DEF0", "abc-def", "ABCD", uuid.New().String()} {
+		assert.False(t, IsShortCode(id), id)
+	}
+}
+
+func TestUnique_SkipsCodesInUse(t *testing.T) {
+	// Single-character codes make collisions certain once most are taken
+	gen := ShortCode{Length: 1}
+	taken := make(map[string]bool)
+	for len(taken) < len(shortCodeAlphabet) {
+		id, err := Unique(gen, func(id string) bool { return taken[id] })
+		if err != nil {
+			// Drawing blind, the last few free codes can take more than maxAttempts to find
+			require.ErrorIs(t, err, ErrExhausted)
+			require.Greater(t, len(taken), len(shortCodeAlphabet)/2)
+			break
+		}
+		require.False(t, taken[id], "%s was handed out twice", id)
+		require.True(t, strings.Contains(shortCodeAlphabet, id))
+		taken[id] = true
+	}
+
+	for _, c := range shortCodeAlphabet {
+		taken[string(c)] = true
+	}
+	_, err := Unique(gen, func(id string) bool { return taken[id] })
+	assert.ErrorIs(t, err, ErrExhausted)
+}
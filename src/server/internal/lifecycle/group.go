@@ -0,0 +1,123 @@
+// Package lifecycle tracks long-lived goroutines so shutdown can stop them and wait for them to exit
+package lifecycle
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStopTimeout is how long a component waits for its goroutines to exit on shutdown
+const DefaultStopTimeout = 5 * time.Second
+
+// Group runs named goroutines that share a stop signal. Stopping the group closes the signal
+// and waits for every goroutine to return, logging any still running when the deadline passes.
+type Group struct {
+	name    string
+	mutex   sync.Mutex
+	running map[string]int
+	stopped bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewGroup creates a group; name identifies it in shutdown logs
+func NewGroup(name string) *Group {
+	return &Group{
+		name:    name,
+		running: make(map[string]int),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Go runs fn in a tracked goroutine. fn must return once stop is closed. Nothing is started,
+// and false is returned, once the group has been cancelled.
+func (g *Group) Go(name string, fn func(stop <-chan struct{})) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.stopped {
+		return false
+	}
+	g.running[name]++
+	g.wg.Add(1)
+
+	go func() {
+		defer g.finished(name)
+		fn(g.stop)
+	}()
+	return true
+}
+
+// finished records that a goroutine returned
+func (g *Group) finished(name string) {
+	g.mutex.Lock()
+	g.running[name]--
+	if g.running[name] == 0 {
+		delete(g.running, name)
+	}
+	g.mutex.Unlock()
+	g.wg.Done()
+}
+
+// Done returns the group's stop signal
+func (g *Group) Done() <-chan struct{} {
+	return g.stop
+}
+
+// Cancel closes the stop signal without waiting. Later calls do nothing.
+func (g *Group) Cancel() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.stopped {
+		g.stopped = true
+		close(g.stop)
+	}
+}
+
+// Wait waits up to timeout for the group's goroutines to return after Cancel, logging the ones
+// that didn't. It reports whether they all exited.
+func (g *Group) Wait(timeout time.Duration) bool {
+	exited := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(exited)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+		return true
+	case <-timer.C:
+		log.Printf("%s: goroutines still running %s after shutdown: %s", g.name, timeout, strings.Join(g.Running(), ", "))
+		return false
+	}
+}
+
+// Stop cancels the group and waits up to timeout for its goroutines to return
+func (g *Group) Stop(timeout time.Duration) bool {
+	g.Cancel()
+	return g.Wait(timeout)
+}
+
+// Running lists the goroutines that haven't returned yet, with a count when a name has several
+func (g *Group) Running() []string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	running := make([]string, 0, len(g.running))
+	for name, count := range g.running {
+		if count > 1 {
+			name = fmt.Sprintf("%s (x%d)", name, count)
+		}
+		running = append(running, name)
+	}
+	sort.Strings(running)
+	return running
+}
@@ -0,0 +1,42 @@
+package lifecycle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestGroup_StopJoinsGoroutines(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	group := NewGroup("test")
+	for i := 0; i < 3; i++ {
+		assert.True(t, group.Go("worker", func(stop <-chan struct{}) {
+			<-stop
+		}))
+	}
+	assert.Equal(t, []string{"worker (x3)"}, group.Running())
+
+	assert.True(t, group.Stop(time.Second))
+	assert.Empty(t, group.Running())
+
+	// A stopped group starts nothing, and stopping again is harmless
+	assert.False(t, group.Go("late", func(stop <-chan struct{}) {}))
+	assert.True(t, group.Stop(time.Second))
+}
+
+func TestGroup_StopReportsStragglers(t *testing.T) {
+	release := make(chan struct{})
+	group := NewGroup("test")
+	group.Go("stuck", func(stop <-chan struct{}) {
+		<-release
+	})
+
+	assert.False(t, group.Stop(20*time.Millisecond))
+	assert.Equal(t, []string{"stuck"}, group.Running())
+
+	close(release)
+	assert.True(t, group.Wait(time.Second))
+}
@@ -0,0 +1,173 @@
+// Package metrics exports file transfer and remote access metrics for Prometheus to scrape
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/onlitec/onlidesk-server/internal/filetransfer"
+	"github.com/onlitec/onlidesk-server/internal/remoteaccess"
+)
+
+// namespace prefixes every metric name
+const namespace = "onlidesk"
+
+// remoteAccessEndpoint labels the WebSocket traffic metrics, which only the remote access endpoint reports
+var remoteAccessEndpoint = prometheus.Labels{"endpoint": "remote_access"}
+
+// Collector counts finished transfers and session events, and reads the live gauges from the handlers on each scrape
+type Collector struct {
+	registry             *prometheus.Registry
+	transfersCompleted   *prometheus.CounterVec
+	transferBytes        *prometheus.CounterVec
+	transferFailures     *prometheus.CounterVec
+	sessionsCreated      prometheus.Counter
+	privilegeEscalations *prometheus.CounterVec
+	websocketBytes       *prometheus.CounterVec
+	websocketMessages    *prometheus.CounterVec
+	websocketErrors      prometheus.Counter
+}
+
+// NewCollector creates a collector and hooks it into the file transfer and remote access session managers
+func NewCollector(fileTransfers *filetransfer.WebSocketHandler, remoteAccess *remoteaccess.SessionManager) *Collector {
+	transfers := fileTransfers.GetSessionManager()
+
+	c := &Collector{
+		registry: prometheus.NewRegistry(),
+		transfersCompleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transfers_completed_total",
+			Help:      "File transfers that completed successfully.",
+		}, []string{"type"}),
+		transferBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transfer_bytes_total",
+			Help:      "Bytes moved by finished file transfers, including those of failed transfers.",
+		}, []string{"type"}),
+		transferFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transfer_failures_total",
+			Help:      "File transfers that failed, by reason.",
+		}, []string{"reason"}),
+		sessionsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "remote_sessions_created_total",
+			Help:      "Remote access sessions created.",
+		}),
+		privilegeEscalations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "privilege_escalations_total",
+			Help:      "Privilege escalations approved in remote access sessions.",
+		}, []string{"privilege_type"}),
+		websocketBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "websocket_bytes_total",
+			Help:        "Bytes read from and written to WebSocket connections, by direction.",
+			ConstLabels: remoteAccessEndpoint,
+		}, []string{"direction"}),
+		websocketMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "websocket_messages_received_total",
+			Help:        "Messages read from WebSocket connections, by type.",
+			ConstLabels: remoteAccessEndpoint,
+		}, []string{"type"}),
+		websocketErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "websocket_errors_total",
+			Help:        "Failed WebSocket reads and writes, and messages that failed handling.",
+			ConstLabels: remoteAccessEndpoint,
+		}),
+	}
+
+	c.registry.MustRegister(
+		c.transfersCompleted,
+		c.transferBytes,
+		c.transferFailures,
+		c.sessionsCreated,
+		c.privilegeEscalations,
+		c.websocketBytes,
+		c.websocketMessages,
+		c.websocketErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "transfers_active",
+			Help:      "File transfers pending, approved, in progress or paused.",
+		}, func() float64 {
+			return float64(len(transfers.GetActiveSessions()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "remote_sessions_active",
+			Help:      "Remote access sessions pending or active.",
+		}, func() float64 {
+			return float64(len(remoteAccess.GetActiveSessions()))
+		}),
+		connectionGauge("file_transfer", fileTransfers.ConnectionCount),
+		connectionGauge("remote_access", remoteAccess.ConnectionCount),
+	)
+
+	transfers.SetMetrics(c)
+	remoteAccess.SetMetrics(c)
+	return c
+}
+
+// connectionGauge reports the open WebSocket connections of one endpoint
+func connectionGauge(endpoint string, count func() int) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "websocket_connections",
+		Help:        "Open WebSocket connections, by endpoint.",
+		ConstLabels: prometheus.Labels{"endpoint": endpoint},
+	}, func() float64 {
+		return float64(count())
+	})
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (c *Collector) Handler() http.Handler {
+	return promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{})
+}
+
+// TransferCompleted counts a transfer that completed successfully
+func (c *Collector) TransferCompleted(transferType filetransfer.TransferType, bytes int64) {
+	c.transfersCompleted.WithLabelValues(string(transferType)).Inc()
+	c.transferBytes.WithLabelValues(string(transferType)).Add(float64(bytes))
+}
+
+// TransferFailed counts a failed transfer and the bytes it moved before failing
+func (c *Collector) TransferFailed(transferType filetransfer.TransferType, bytes int64, reason string) {
+	c.transferFailures.WithLabelValues(reason).Inc()
+	c.transferBytes.WithLabelValues(string(transferType)).Add(float64(bytes))
+}
+
+// SessionCreated counts a new remote access session
+func (c *Collector) SessionCreated() {
+	c.sessionsCreated.Inc()
+}
+
+// PrivilegeEscalated counts an approved privilege escalation
+func (c *Collector) PrivilegeEscalated(privilegeType remoteaccess.PrivilegeType) {
+	c.privilegeEscalations.WithLabelValues(string(privilegeType)).Inc()
+}
+
+// BytesRead counts bytes read from a remote access WebSocket
+func (c *Collector) BytesRead(bytes int) {
+	c.websocketBytes.WithLabelValues("read").Add(float64(bytes))
+}
+
+// BytesWritten counts bytes written to a remote access WebSocket
+func (c *Collector) BytesWritten(bytes int) {
+	c.websocketBytes.WithLabelValues("written").Add(float64(bytes))
+}
+
+// MessageReceived counts a message read from a remote access WebSocket
+func (c *Collector) MessageReceived(messageType string) {
+	c.websocketMessages.WithLabelValues(messageType).Inc()
+}
+
+// ConnectionError counts an error on a remote access WebSocket
+func (c *Collector) ConnectionError() {
+	c.websocketErrors.Inc()
+}
@@ -0,0 +1,185 @@
+// Package redact masks sensitive values in audit event details before they are written
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Masking modes
+const (
+	ModeRedact = "redact" // replace the value with Placeholder
+	ModeHash   = "hash"   // replace the value with its keyed hash, so equal values can still be correlated
+)
+
+// Placeholder replaces values masked in redact mode
+const Placeholder = "[REDACTED]"
+
+// HashKeyEnv names the environment variable a hex-encoded key for hash mode can be supplied in
+const HashKeyEnv = "ONLIDESK_AUDIT_HASH_KEY"
+
+// minHashKeyLength is the shortest key accepted from HashKeyEnv, in bytes
+const minHashKeyLength = 16
+
+var (
+	hashKeyMutex sync.RWMutex
+	hashKey      = randomHashKey()
+)
+
+// LoadHashKey sets the key hash mode uses from HashKeyEnv. Without one, a random key is kept and
+// hashes only correlate within one run of the server.
+func LoadHashKey() error {
+	encoded := strings.TrimSpace(os.Getenv(HashKeyEnv))
+	if encoded == "" {
+		return nil
+	}
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("%s is not valid hex: %v", HashKeyEnv, err)
+	}
+	if len(key) < minHashKeyLength {
+		return fmt.Errorf("%s must be at least %d bytes, got %d", HashKeyEnv, minHashKeyLength, len(key))
+	}
+
+	hashKeyMutex.Lock()
+	defer hashKeyMutex.Unlock()
+	hashKey = key
+	return nil
+}
+
+// randomHashKey returns a fresh key for hash mode
+func randomHashKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		// crypto/rand doesn't fail on supported platforms
+		panic("redact: failed to read random bytes: " + err.Error())
+	}
+	return key
+}
+
+// ValidateMode checks a configured masking mode; empty means ModeRedact
+func ValidateMode(mode string) error {
+	switch mode {
+	case "", ModeRedact, ModeHash:
+		return nil
+	}
+	return fmt.Errorf("mask mode must be one of %s, %s", ModeRedact, ModeHash)
+}
+
+// Masker replaces the values of configured keys, matched case-insensitively at any depth of
+// nested details. A nil Masker masks nothing.
+type Masker struct {
+	keys map[string]bool
+	mode string
+}
+
+// NewMasker creates a masker for keys, or returns nil when there are none
+func NewMasker(keys []string, mode string) *Masker {
+	if len(keys) == 0 {
+		return nil
+	}
+	if mode == "" {
+		mode = ModeRedact
+	}
+
+	m := &Masker{keys: make(map[string]bool, len(keys)), mode: mode}
+	for _, key := range keys {
+		m.keys[strings.ToLower(key)] = true
+	}
+	return m
+}
+
+// Masks reports whether values under key are masked
+func (m *Masker) Masks(key string) bool {
+	return m != nil && m.keys[strings.ToLower(key)]
+}
+
+// Details returns a copy of details with the configured keys masked. The original is left
+// untouched, since callers may still hold it.
+func (m *Masker) Details(details map[string]interface{}) map[string]interface{} {
+	if m == nil || details == nil {
+		return details
+	}
+
+	masked := make(map[string]interface{}, len(details))
+	for key, value := range details {
+		if m.Masks(key) {
+			masked[key] = m.mask(value)
+			continue
+		}
+		switch nested := value.(type) {
+		case map[string]interface{}:
+			masked[key] = m.Details(nested)
+		case map[string]string:
+			masked[key] = m.Strings(nested)
+		default:
+			masked[key] = value
+		}
+	}
+	return masked
+}
+
+// Strings returns a copy of a string map with the configured keys masked
+func (m *Masker) Strings(values map[string]string) map[string]string {
+	if m == nil || values == nil {
+		return values
+	}
+
+	masked := make(map[string]string, len(values))
+	for key, value := range values {
+		if m.Masks(key) {
+			value = m.String(value)
+		}
+		masked[key] = value
+	}
+	return masked
+}
+
+// String masks a single value regardless of its key
+func (m *Masker) String(value string) string {
+	if m == nil || value == "" {
+		return value
+	}
+	if m.mode == ModeHash {
+		return hashValue([]byte(value))
+	}
+	return Placeholder
+}
+
+// mask replaces any value, keeping empty strings and nils so their absence stays visible
+func (m *Masker) mask(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return m.String(v)
+	}
+
+	if m.mode == ModeHash {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return Placeholder
+		}
+		return hashValue(encoded)
+	}
+	return Placeholder
+}
+
+// hashValue is an HMAC-SHA256 under the hash key, enough to correlate equal values across events
+// without letting anyone lacking the key confirm a guessed value
+func hashValue(data []byte) string {
+	hashKeyMutex.RLock()
+	mac := hmac.New(sha256.New, hashKey)
+	hashKeyMutex.RUnlock()
+
+	mac.Write(data)
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
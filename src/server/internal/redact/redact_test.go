@@ -0,0 +1,73 @@
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMasker_MasksOnlyConfiguredKeys(t *testing.T) {
+	m := NewMasker([]string{"Password", "output"}, ModeRedact)
+
+	masked := m.Details(map[string]interface{}{
+		"password": "hunter2",
+		"OUTPUT":   []string{"line"},
+		"empty":    "",
+		"user":     "jane",
+		"nested":   map[string]string{"password": "x", "host": "h"},
+	})
+	assert.Equal(t, map[string]interface{}{
+		"password": Placeholder,
+		"OUTPUT":   Placeholder,
+		"empty":    "",
+		"user":     "jane",
+		"nested":   map[string]string{"password": Placeholder, "host": "h"},
+	}, masked)
+
+	// No keys, no masking
+	none := NewMasker(nil, ModeHash)
+	assert.Nil(t, none)
+	assert.Equal(t, map[string]interface{}{"password": "hunter2"}, none.Details(map[string]interface{}{"password": "hunter2"}))
+
+	hashed := NewMasker([]string{"count"}, ModeHash).Details(map[string]interface{}{"count": 3})
+	assert.Regexp(t, `^hmac-sha256:[0-9a-f]{64}$`, hashed["count"])
+
+	// The hash is keyed, so a guessed value can't be confirmed without the key
+	unkeyed := sha256.Sum256([]byte("hunter2"))
+	assert.NotContains(t, NewMasker([]string{"password"}, ModeHash).String("hunter2"), hex.EncodeToString(unkeyed[:]))
+
+	assert.NoError(t, ValidateMode(""))
+	assert.Error(t, ValidateMode("encrypt"))
+}
+
+func TestLoadHashKey(t *testing.T) {
+	hashKeyMutex.RLock()
+	original := hashKey
+	hashKeyMutex.RUnlock()
+	t.Cleanup(func() {
+		hashKeyMutex.Lock()
+		hashKey = original
+		hashKeyMutex.Unlock()
+	})
+	m := NewMasker([]string{"password"}, ModeHash)
+
+	t.Setenv(HashKeyEnv, "not hex")
+	assert.Error(t, LoadHashKey())
+	t.Setenv(HashKeyEnv, "0011")
+	assert.Error(t, LoadHashKey(), "too short")
+
+	// The same key gives the same hash, so values correlate across restarts
+	t.Setenv(HashKeyEnv, strings.Repeat("ab", 32))
+	require.NoError(t, LoadHashKey())
+	first := m.String("hunter2")
+	require.NoError(t, LoadHashKey())
+	assert.Equal(t, first, m.String("hunter2"))
+
+	t.Setenv(HashKeyEnv, strings.Repeat("cd", 32))
+	require.NoError(t, LoadHashKey())
+	assert.NotEqual(t, first, m.String("hunter2"))
+}
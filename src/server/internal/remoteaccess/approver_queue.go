@@ -0,0 +1,270 @@
+package remoteaccess
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// approverQueues tracks how busy the approvers of unattended sessions are: the requests waiting
+// for an approver with room, and when each approver was last sent a digest
+type approverQueues struct {
+	backlog []backlogEntry             // oldest first
+	digests map[string]*approverDigest // approver -> digest throttling state
+	mutex   sync.Mutex
+}
+
+// backlogEntry is a routed privilege request every eligible approver was too busy to take
+type backlogEntry struct {
+	sessionID string
+	requestID string
+	approvers []string
+	queuedAt  time.Time
+}
+
+// approverDigest throttles notifications to an approver with a long queue
+type approverDigest struct {
+	sentAt time.Time
+	unsent int // requests routed since the last digest
+}
+
+// approverNotification is what an approver is told once a request has been routed to them
+type approverNotification struct {
+	approver string
+	digest   bool // a digest of the approver's queue rather than the request itself
+	deferred bool // nothing is sent now; the request is counted in the approver's next digest
+	pending  int
+	session  *RemoteAccessSession
+	request  PrivilegeRequest
+}
+
+// ApprovalQueueStats reports how many routed privilege requests await each approver, and how many
+// wait in the backlog for an approver with room
+type ApprovalQueueStats struct {
+	Approvers map[string]int `json:"approvers"`
+	Backlog   int            `json:"backlog"`
+}
+
+// GetApprovalQueueStats returns the pending routed requests of every approver and the backlog length
+func (sm *SessionManager) GetApprovalQueueStats() ApprovalQueueStats {
+	sm.queues.mutex.Lock()
+	backlog := len(sm.queues.backlog)
+	sm.queues.mutex.Unlock()
+
+	return ApprovalQueueStats{
+		Approvers: sm.pendingByApprover(),
+		Backlog:   backlog,
+	}
+}
+
+// pendingByApprover counts the undecided requests assigned to each approver across live sessions
+func (sm *SessionManager) pendingByApprover() map[string]int {
+	sm.mutex.RLock()
+	sessions := make([]*RemoteAccessSession, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	sm.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for _, session := range sessions {
+		session.countPendingByApprover(counts)
+	}
+	return counts
+}
+
+// routeToApprover assigns a request to the first of the approvers with room in their queue and
+// notifies them. It returns the approver chosen, or "" when every approver was full and the
+// request went to the backlog.
+func (sm *SessionManager) routeToApprover(session *RemoteAccessSession, requestID string, approvers []string) (string, error) {
+	sm.queues.mutex.Lock()
+	notification, err := sm.assignApprover(session, requestID, approvers, sm.pendingByApprover())
+	if err == nil && notification == nil {
+		sm.queues.backlog = append(sm.queues.backlog, backlogEntry{
+			sessionID: session.ID,
+			requestID: requestID,
+			approvers: approvers,
+			queuedAt:  sm.now(),
+		})
+	}
+	sm.queues.mutex.Unlock()
+
+	if err != nil || notification == nil {
+		return "", err
+	}
+	sm.sendApproverNotification(*notification)
+	return notification.approver, nil
+}
+
+// assignApprover assigns a request to the first approver whose queue has room, counting it in
+// counts, and returns how to notify them; nil means every queue was full. Caller must hold sm.queues.mutex.
+func (sm *SessionManager) assignApprover(session *RemoteAccessSession, requestID string, approvers []string, counts map[string]int) (*approverNotification, error) {
+	policy := sm.GetConfig().PrivilegeEscalation
+
+	for _, approver := range approvers {
+		if policy.MaxPendingPerApprover > 0 && counts[approver] >= policy.MaxPendingPerApprover {
+			continue
+		}
+		if err := session.AssignPrivilegeApprover(requestID, approver); err != nil {
+			return nil, err
+		}
+		counts[approver]++
+		request, _ := session.GetPrivilegeRequest(requestID)
+
+		notification := &approverNotification{
+			approver: approver,
+			pending:  counts[approver],
+			session:  session,
+			request:  request,
+		}
+		// Past the threshold the approver gets a digest of their queue, at most once per interval
+		if policy.DigestThreshold > 0 && counts[approver] > policy.DigestThreshold {
+			notification.digest = true
+			notification.deferred = !sm.digestDue(approver, policy.DigestInterval)
+		}
+		return notification, nil
+	}
+	return nil, nil
+}
+
+// digestDue counts a request routed to an approver with a long queue, and reports whether a digest
+// should go out now rather than with a later one. Caller must hold sm.queues.mutex.
+func (sm *SessionManager) digestDue(approver string, interval time.Duration) bool {
+	if sm.queues.digests == nil {
+		sm.queues.digests = make(map[string]*approverDigest)
+	}
+	digest, exists := sm.queues.digests[approver]
+	if !exists {
+		digest = &approverDigest{}
+		sm.queues.digests[approver] = digest
+	}
+
+	now := sm.now()
+	digest.unsent++
+	if now.Sub(digest.sentAt) < interval {
+		return false
+	}
+	digest.sentAt = now
+	digest.unsent = 0
+	return true
+}
+
+// drainApprovalBacklog routes backlogged requests to approvers whose queues have room again,
+// dropping those decided or expired in the meantime
+func (sm *SessionManager) drainApprovalBacklog() {
+	sm.queues.mutex.Lock()
+	if len(sm.queues.backlog) == 0 {
+		sm.queues.mutex.Unlock()
+		return
+	}
+
+	counts := sm.pendingByApprover()
+	var notifications []approverNotification
+	var routed []backlogEntry
+	remaining := sm.queues.backlog[:0]
+	for _, entry := range sm.queues.backlog {
+		session, exists := sm.GetSession(entry.sessionID)
+		if !exists {
+			continue
+		}
+		if request, found := session.GetPrivilegeRequest(entry.requestID); !found || request.Status != "pending" {
+			continue
+		}
+
+		notification, err := sm.assignApprover(session, entry.requestID, entry.approvers, counts)
+		switch {
+		case err != nil:
+			log.Printf("Failed to route backlogged privilege request %s: %v", entry.requestID, err)
+		case notification == nil:
+			remaining = append(remaining, entry)
+		default:
+			routed = append(routed, entry)
+			notifications = append(notifications, *notification)
+		}
+	}
+	sm.queues.backlog = remaining
+	sm.queues.mutex.Unlock()
+
+	for i, notification := range notifications {
+		sm.auditLogger.LogEvent(AuditEvent{
+			EventType:  "privilege_backlog_routed",
+			SessionID:  routed[i].sessionID,
+			Technician: notification.approver,
+			Details:    map[string]interface{}{"request_id": routed[i].requestID, "approver": notification.approver, "waited": sm.now().Sub(routed[i].queuedAt).String()},
+			Severity:   "info",
+			Success:    true,
+			Timestamp:  time.Now().UTC(),
+		})
+		sm.sendApproverNotification(notification)
+	}
+}
+
+// sendDueDigests sends a digest to every approver with requests routed since their last digest,
+// once the digest interval has passed
+func (sm *SessionManager) sendDueDigests() {
+	interval := sm.GetConfig().PrivilegeEscalation.DigestInterval
+	now := sm.now()
+
+	sm.queues.mutex.Lock()
+	var due []string
+	for approver, digest := range sm.queues.digests {
+		if digest.unsent > 0 && now.Sub(digest.sentAt) >= interval {
+			digest.sentAt = now
+			digest.unsent = 0
+			due = append(due, approver)
+		}
+	}
+	sm.queues.mutex.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+	counts := sm.pendingByApprover()
+	for _, approver := range due {
+		sm.sendApproverNotification(approverNotification{approver: approver, digest: true, pending: counts[approver]})
+	}
+}
+
+// sendApproverNotification tells an approver about a routed request, or sends the digest of their
+// queue
+func (sm *SessionManager) sendApproverNotification(notification approverNotification) {
+	switch {
+	case notification.deferred:
+	case notification.digest:
+		sm.notifyApproverDigest(notification.approver, notification.pending)
+	default:
+		request := notification.request
+		sm.notifyApproverPrivilegeRequest(notification.approver, notification.session, request.ID, request.Type, request.Justification, request.Duration)
+	}
+}
+
+// notifyApproverDigest sends an approver a summary of their queue instead of one notification per request
+func (sm *SessionManager) notifyApproverDigest(approver string, pending int) {
+	for _, portal := range sm.approverPortals(approver) {
+		notification := map[string]interface{}{
+			"type":      "privilege_request_digest",
+			"approver":  approver,
+			"pending":   pending,
+			"timestamp": time.Now().UTC(),
+		}
+		if err := sm.writeMessage(portal, notification); err != nil {
+			log.Printf("Failed to send digest to approver %s: %v", approver, err)
+		}
+	}
+}
+
+// approverPortals returns every portal connection the approver has open
+func (sm *SessionManager) approverPortals(approver string) []*websocket.Conn {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	var portals []*websocket.Conn
+	for _, candidate := range sm.sessions {
+		if candidate.TechnicianID == approver && candidate.PortalConn != nil {
+			portals = append(portals, candidate.PortalConn)
+		}
+	}
+	return portals
+}
@@ -1,13 +1,19 @@
 package remoteaccess
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/clock"
+	"github.com/onlitec/onlidesk-server/internal/redact"
 )
 
 // AuditEvent represents an audit log event
@@ -25,6 +31,14 @@ type AuditEvent struct {
 	CorrelationID string               `json:"correlation_id,omitempty"`
 }
 
+// auditLogDir is where the session manager and WebSocket handler write their audit logs
+const auditLogDir = "./logs/remoteaccess"
+
+// AuditLogDirs returns the directories remote access audits to
+func AuditLogDirs() []string {
+	return []string{auditLogDir}
+}
+
 // AuditLogger handles audit logging for remote access events
 type AuditLogger struct {
 	logDir      string
@@ -34,6 +48,19 @@ type AuditLogger struct {
 	rotateSize  int64
 	maxFiles    int
 	currentSize int64
+	eventTypes  map[string]bool // empty means all event types are persisted
+	minSeverity int
+	masker      *redact.Masker
+	store       *AuditStore // also receives every event written, and serves searches, when set
+	clock       clock.Clock // names rotated files and stamps events given no timestamp
+}
+
+// severityRank orders audit severities from least to most important
+var severityRank = map[string]int{
+	"info":     0,
+	"warning":  1,
+	"error":    2,
+	"critical": 3,
 }
 
 // NewAuditLogger creates a new audit logger
@@ -43,6 +70,7 @@ func NewAuditLogger(logDir string, enabled bool) *AuditLogger {
 		enabled:    enabled,
 		rotateSize: 100 * 1024 * 1024, // 100MB
 		maxFiles:   10,
+		clock:      clock.Real{},
 	}
 
 	if enabled {
@@ -63,7 +91,7 @@ func (al *AuditLogger) initLogFile() error {
 	}
 
 	// Create log file with timestamp
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
+	timestamp := al.clock.Now().Format(auditFileTimestampFormat)
 	logFile := filepath.Join(al.logDir, fmt.Sprintf("remoteaccess_audit_%s.log", timestamp))
 
 	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
@@ -82,6 +110,62 @@ func (al *AuditLogger) initLogFile() error {
 	return nil
 }
 
+// SetFilter limits which events are persisted. Security, privilege and config events, and anything
+// at error severity or above, are always written regardless of the filter.
+func (al *AuditLogger) SetFilter(eventTypes []string, minSeverity string) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	al.eventTypes = make(map[string]bool, len(eventTypes))
+	for _, eventType := range eventTypes {
+		al.eventTypes[eventType] = true
+	}
+	al.minSeverity = severityRank[minSeverity]
+}
+
+// SetMask masks the values of the given detail keys in every event written from now on, replacing
+// them with a placeholder or their hash depending on mode
+func (al *AuditLogger) SetMask(keys []string, mode string) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	al.masker = redact.NewMasker(keys, mode)
+}
+
+// SetClock sets the clock log files are named and events stamped by, e.g. a manual one in tests
+func (al *AuditLogger) SetClock(c clock.Clock) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	al.clock = c
+}
+
+// SetStore sets the database events are stored in alongside the log file. Searches are answered from
+// it while it's set, and by scanning the log files otherwise.
+func (al *AuditLogger) SetStore(store *AuditStore) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	al.store = store
+}
+
+// shouldLog applies the configured filter to an event. Caller must hold al.mutex.
+func (al *AuditLogger) shouldLog(event AuditEvent) bool {
+	if isAlwaysAudited(event) {
+		return true
+	}
+	if len(al.eventTypes) > 0 && !al.eventTypes[event.EventType] {
+		return false
+	}
+	return severityRank[event.Severity] >= al.minSeverity
+}
+
+// isAlwaysAudited reports whether an event must be persisted regardless of filtering
+func isAlwaysAudited(event AuditEvent) bool {
+	if strings.HasPrefix(event.EventType, "security_") || strings.HasPrefix(event.EventType, "privilege_") ||
+		strings.HasPrefix(event.EventType, "config_") {
+		return true
+	}
+	return severityRank[event.Severity] >= severityRank["error"]
+}
+
 // LogEvent logs an audit event
 func (al *AuditLogger) LogEvent(event AuditEvent) {
 	if !al.enabled {
@@ -91,11 +175,24 @@ func (al *AuditLogger) LogEvent(event AuditEvent) {
 	al.mutex.Lock()
 	defer al.mutex.Unlock()
 
+	if !al.shouldLog(event) {
+		return
+	}
+
 	// Check if log rotation is needed
 	if al.currentSize > al.rotateSize {
 		al.rotateLog()
 	}
 
+	// Mask sensitive details; the caller's map is left as it was
+	event.Details = al.masker.Details(event.Details)
+
+	// Audit timestamps are always UTC, whatever zone the caller used
+	if event.Timestamp.IsZero() {
+		event.Timestamp = al.clock.Now()
+	}
+	event.Timestamp = event.Timestamp.UTC()
+
 	// Marshal event to JSON
 	eventJSON, err := json.Marshal(event)
 	if err != nil {
@@ -103,6 +200,12 @@ func (al *AuditLogger) LogEvent(event AuditEvent) {
 		return
 	}
 
+	if al.store != nil {
+		if err := al.store.Insert(event); err != nil {
+			log.Printf("Failed to store audit event: %v", err)
+		}
+	}
+
 	// Write to log file
 	logLine := fmt.Sprintf("%s\n", string(eventJSON))
 	n, err := al.file.WriteString(logLine)
@@ -132,7 +235,7 @@ func (al *AuditLogger) LogSecurityViolation(sessionID, clientID, technician, vio
 		},
 		Severity:  "critical",
 		Success:   false,
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
 	al.LogEvent(event)
@@ -157,7 +260,7 @@ func (al *AuditLogger) LogPrivilegeEscalation(sessionID, technician string, priv
 		},
 		Severity:  severity,
 		Success:   approved,
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
 	al.LogEvent(event)
@@ -174,7 +277,7 @@ func (al *AuditLogger) LogSessionActivity(sessionID, technician, activity string
 		},
 		Severity:  "info",
 		Success:   true,
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
 	// Merge additional details
@@ -200,7 +303,7 @@ func (al *AuditLogger) LogFileTransfer(sessionID, technician, filename string, f
 		},
 		Severity:  "info",
 		Success:   success,
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
 	if !success {
@@ -222,7 +325,7 @@ func (al *AuditLogger) LogCommandExecution(sessionID, technician, command string
 		},
 		Severity:  "info",
 		Success:   success,
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
 	// Increase severity for certain commands
@@ -332,31 +435,147 @@ func (al *AuditLogger) GetLogFiles() ([]string, error) {
 	return filepath.Glob(filepath.Join(al.logDir, "remoteaccess_audit_*.log"))
 }
 
-// SearchLogs searches audit logs for specific criteria
-func (al *AuditLogger) SearchLogs(criteria map[string]interface{}, limit int) ([]AuditEvent, error) {
+// auditFileTimestampFormat is the timestamp embedded in audit log file names
+const auditFileTimestampFormat = "2006-01-02_15-04-05"
+
+// AuditSummary aggregates audit events within a time range
+type AuditSummary struct {
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Total      int            `json:"total"`
+	ByType     map[string]int `json:"by_type"`
+	BySeverity map[string]int `json:"by_severity"`
+}
+
+// scanLogs calls visit for every event logged within [start, end], newest file first, until
+// visit returns false. Files that were rotated out before start, or opened after end, are skipped.
+func (al *AuditLogger) scanLogs(start, end time.Time, visit func(AuditEvent) bool) error {
 	files, err := al.GetLogFiles()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get log files: %v", err)
+		return fmt.Errorf("failed to get log files: %v", err)
 	}
+	sort.Strings(files) // timestamped names sort chronologically
 
-	var events []AuditEvent
-	count := 0
+	for i := len(files) - 1; i >= 0; i-- {
+		if opened, ok := auditFileOpenedAt(files[i]); ok && !end.IsZero() && opened.After(end) {
+			continue
+		}
+		if i+1 < len(files) && !start.IsZero() {
+			// A file only holds events up to the moment the next one was opened
+			if rotated, ok := auditFileOpenedAt(files[i+1]); ok && rotated.Before(start) {
+				break
+			}
+		}
 
-	// Search through log files (newest first)
-	for i := len(files) - 1; i >= 0 && count < limit; i-- {
-		file, err := os.Open(files[i])
+		more, err := scanLogFile(files[i], start, end, visit)
 		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// scanLogFile visits the events of one log file that fall within [start, end]
+func scanLogFile(path string, start, end time.Time, visit func(AuditEvent) bool) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil // rotated away while scanning
+		}
+		return false, fmt.Errorf("failed to open log file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue // skip partial or corrupt lines
+		}
+		if (!start.IsZero() && event.Timestamp.Before(start)) || (!end.IsZero() && event.Timestamp.After(end)) {
 			continue
 		}
+		if !visit(event) {
+			return false, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("failed to read log file: %v", err)
+	}
+
+	return true, nil
+}
 
-		// Read file line by line
-		// This is a simplified implementation - in production you might want to use a more efficient approach
-		file.Close()
+// auditFileOpenedAt parses the creation time embedded in an audit log file name
+func auditFileOpenedAt(path string) (time.Time, bool) {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "remoteaccess_audit_"), ".log")
+	opened, err := time.ParseInLocation(auditFileTimestampFormat, name, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return opened, true
+}
+
+// SearchLogs searches audit logs for specific criteria. Supported criteria are session_id,
+// event_type and severity (exact matches) and start/end (time.Time bounds).
+func (al *AuditLogger) SearchLogs(criteria map[string]interface{}, limit int) ([]AuditEvent, error) {
+	al.mutex.Lock()
+	store := al.store
+	al.mutex.Unlock()
+	if store != nil {
+		return store.Search(criteria, limit)
+	}
+
+	start, _ := criteria["start"].(time.Time)
+	end, _ := criteria["end"].(time.Time)
+	sessionID, _ := criteria["session_id"].(string)
+	eventType, _ := criteria["event_type"].(string)
+	severity, _ := criteria["severity"].(string)
+
+	var events []AuditEvent
+	err := al.scanLogs(start, end, func(event AuditEvent) bool {
+		if (sessionID != "" && event.SessionID != sessionID) ||
+			(eventType != "" && event.EventType != eventType) ||
+			(severity != "" && event.Severity != severity) {
+			return true
+		}
+		events = append(events, event)
+		return limit <= 0 || len(events) < limit
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return events, nil
 }
 
+// GetAuditSummary counts the events logged within [start, end] by type and severity
+func (al *AuditLogger) GetAuditSummary(start, end time.Time) (*AuditSummary, error) {
+	summary := &AuditSummary{
+		Start:      start,
+		End:        end,
+		ByType:     make(map[string]int),
+		BySeverity: make(map[string]int),
+	}
+
+	err := al.scanLogs(start, end, func(event AuditEvent) bool {
+		summary.Total++
+		summary.ByType[event.EventType]++
+		summary.BySeverity[event.Severity]++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
 // GetStatistics returns audit logging statistics
 func (al *AuditLogger) GetStatistics() map[string]interface{} {
 	stats := map[string]interface{}{
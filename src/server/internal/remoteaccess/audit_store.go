@@ -0,0 +1,158 @@
+package remoteaccess
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+)
+
+// auditSchema creates the events table and the indexes searches narrow on
+var auditSchema = []string{
+	`CREATE TABLE IF NOT EXISTS audit_events (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_type     TEXT NOT NULL,
+		session_id     TEXT NOT NULL DEFAULT '',
+		client_id      TEXT NOT NULL DEFAULT '',
+		technician     TEXT NOT NULL DEFAULT '',
+		ip_address     TEXT NOT NULL DEFAULT '',
+		user_agent     TEXT NOT NULL DEFAULT '',
+		details        TEXT,
+		severity       TEXT NOT NULL,
+		success        INTEGER NOT NULL,
+		timestamp      INTEGER NOT NULL, -- Unix nanoseconds
+		correlation_id TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_audit_events_timestamp ON audit_events (timestamp)`,
+	`CREATE INDEX IF NOT EXISTS idx_audit_events_session_id ON audit_events (session_id)`,
+}
+
+// auditEventColumns are the columns an AuditEvent is stored in and read back from, in scan order
+const auditEventColumns = "event_type, session_id, client_id, technician, ip_address, user_agent, details, severity, success, timestamp, correlation_id"
+
+// AuditStore keeps audit events in a SQLite database, so searches don't have to scan the log files
+type AuditStore struct {
+	db *sql.DB
+}
+
+// OpenAuditStore opens the SQLite database at path, creating it and its schema if needed
+func OpenAuditStore(path string) (*AuditStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit database directory: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit database: %v", err)
+	}
+	// SQLite takes one writer at a time; queuing here beats "database is locked" errors
+	db.SetMaxOpenConns(1)
+
+	for _, statement := range auditSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create audit schema: %v", err)
+		}
+	}
+
+	return &AuditStore{db: db}, nil
+}
+
+// Insert stores an event as it was written to the log file
+func (s *AuditStore) Insert(event AuditEvent) error {
+	var details interface{}
+	if event.Details != nil {
+		data, err := json.Marshal(event.Details)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event details: %v", err)
+		}
+		details = string(data)
+	}
+
+	_, err := s.db.Exec("INSERT INTO audit_events ("+auditEventColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		event.EventType, event.SessionID, event.ClientID, event.Technician, event.IPAddress, event.UserAgent,
+		details, event.Severity, event.Success, event.Timestamp.UnixNano(), event.CorrelationID)
+	if err != nil {
+		return fmt.Errorf("failed to insert audit event: %v", err)
+	}
+	return nil
+}
+
+// Search returns the events matching the criteria SearchLogs accepts, newest first. A limit of
+// zero or less returns every match.
+func (s *AuditStore) Search(criteria map[string]interface{}, limit int) ([]AuditEvent, error) {
+	var where []string
+	var args []interface{}
+	for _, column := range []string{"session_id", "event_type", "severity"} {
+		if value, _ := criteria[column].(string); value != "" {
+			where = append(where, column+" = ?")
+			args = append(args, value)
+		}
+	}
+	if start, _ := criteria["start"].(time.Time); !start.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, start.UnixNano())
+	}
+	if end, _ := criteria["end"].(time.Time); !end.IsZero() {
+		where = append(where, "timestamp <= ?")
+		args = append(args, end.UnixNano())
+	}
+
+	query := "SELECT " + auditEventColumns + " FROM audit_events"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY timestamp DESC, id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search audit events: %v", err)
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var event AuditEvent
+		var details sql.NullString
+		var timestamp int64
+		if err := rows.Scan(&event.EventType, &event.SessionID, &event.ClientID, &event.Technician, &event.IPAddress,
+			&event.UserAgent, &details, &event.Severity, &event.Success, &timestamp, &event.CorrelationID); err != nil {
+			return nil, fmt.Errorf("failed to read audit event: %v", err)
+		}
+		if details.Valid {
+			if err := json.Unmarshal([]byte(details.String), &event.Details); err != nil {
+				return nil, fmt.Errorf("failed to parse audit event details: %v", err)
+			}
+		}
+		event.Timestamp = time.Unix(0, timestamp).UTC()
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search audit events: %v", err)
+	}
+
+	return events, nil
+}
+
+// DeleteBefore removes the events older than cutoff and returns how many there were
+func (s *AuditStore) DeleteBefore(cutoff time.Time) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM audit_events WHERE timestamp < ?", cutoff.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired audit events: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// Close closes the database
+func (s *AuditStore) Close() error {
+	return s.db.Close()
+}
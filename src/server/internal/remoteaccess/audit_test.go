@@ -0,0 +1,304 @@
+package remoteaccess
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onlitec/onlidesk-server/internal/clock"
+)
+
+// readAuditEvents returns the events written to the logger's files, in order
+func readAuditEvents(t *testing.T, al *AuditLogger) []AuditEvent {
+	t.Helper()
+
+	files, err := al.GetLogFiles()
+	require.NoError(t, err)
+
+	var events []AuditEvent
+	for _, path := range files {
+		file, err := os.Open(path)
+		require.NoError(t, err)
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event AuditEvent
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			events = append(events, event)
+		}
+		file.Close()
+	}
+	return events
+}
+
+// readAuditEventTypes returns the event types written to the logger's files, in order
+func readAuditEventTypes(t *testing.T, al *AuditLogger) []string {
+	t.Helper()
+
+	var eventTypes []string
+	for _, event := range readAuditEvents(t, al) {
+		eventTypes = append(eventTypes, event.EventType)
+	}
+	return eventTypes
+}
+
+func TestAuditLogger_FilterDropsUnlistedEvents(t *testing.T) {
+	al := NewAuditLogger(t.TempDir(), true)
+	defer al.Close()
+	al.SetFilter([]string{"session_created", "session_terminated"}, "info")
+
+	for _, event := range []AuditEvent{
+		{EventType: "http_request", Severity: "info"},
+		{EventType: "session_created", Severity: "info"},
+		{EventType: "connection_registered", Severity: "info"},
+		{EventType: "privilege_requested", Severity: "warning"},
+		{EventType: "security_violation", Severity: "critical"},
+		{EventType: "websocket_upgrade_failed", Severity: "error"},
+		{EventType: "session_terminated", Severity: "info"},
+	} {
+		event.Timestamp = time.Now()
+		al.LogEvent(event)
+	}
+
+	assert.Equal(t, []string{
+		"session_created",
+		"privilege_requested",
+		"security_violation",
+		"websocket_upgrade_failed",
+		"session_terminated",
+	}, readAuditEventTypes(t, al))
+}
+
+func TestAuditLogger_MinimumSeverity(t *testing.T) {
+	al := NewAuditLogger(t.TempDir(), true)
+	defer al.Close()
+	al.SetFilter(nil, "warning")
+
+	al.LogEvent(AuditEvent{EventType: "http_request", Severity: "info", Timestamp: time.Now()})
+	al.LogEvent(AuditEvent{EventType: "file_transfer_blocked", Severity: "warning", Timestamp: time.Now()})
+	al.LogEvent(AuditEvent{EventType: "privilege_approved", Severity: "info", Timestamp: time.Now()})
+
+	assert.Equal(t, []string{"file_transfer_blocked", "privilege_approved"}, readAuditEventTypes(t, al))
+}
+
+func TestAuditLogger_SummaryCountsEventsInRange(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	al := NewAuditLogger(t.TempDir(), true)
+	defer al.Close()
+	sm.auditLogger = al
+
+	// Files opened after the window ends are skipped, so keep the window after the file was opened
+	base := time.Now().Truncate(time.Second).Add(time.Second)
+	for _, event := range []AuditEvent{
+		{EventType: "session_created", Severity: "info", Timestamp: base.Add(-2 * time.Hour)}, // before the window
+		{EventType: "session_created", Severity: "info", Timestamp: base},
+		{EventType: "session_created", Severity: "info", Timestamp: base.Add(10 * time.Minute)},
+		{EventType: "privilege_requested", Severity: "warning", Timestamp: base.Add(20 * time.Minute)},
+		{EventType: "security_violation", Severity: "critical", Timestamp: base.Add(30 * time.Minute)},
+		{EventType: "session_terminated", Severity: "info", Timestamp: base.Add(3 * time.Hour)}, // after the window
+	} {
+		al.LogEvent(event)
+	}
+
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+
+	query := "?start=" + base.Format(time.RFC3339) + "&end=" + base.Add(time.Hour).Format(time.RFC3339)
+	req := httptest.NewRequest(http.MethodGet, "/api/remoteaccess/audit/summary"+query, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var summary AuditSummary
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &summary))
+	assert.Equal(t, 4, summary.Total)
+	assert.Equal(t, map[string]int{"session_created": 2, "privilege_requested": 1, "security_violation": 1}, summary.ByType)
+	assert.Equal(t, map[string]int{"info": 2, "warning": 1, "critical": 1}, summary.BySeverity)
+
+	// Search honours the same window alongside its other criteria
+	events, err := al.SearchLogs(map[string]interface{}{
+		"event_type": "session_created",
+		"start":      base,
+		"end":        base.Add(time.Hour),
+	}, 10)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/remoteaccess/audit/summary?start=yesterday", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestAuditLogger_SearchesTheAuditDatabase(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.AuditDatabase = filepath.Join(t.TempDir(), "audit", "events.db")
+	sm := newTestSessionManager(t, config)
+	require.NotNil(t, sm.auditStore)
+	sm.auditLogger.SetStore(sm.auditStore) // the helper swapped in its own logger
+
+	base := time.Now().UTC().Truncate(time.Second)
+	for _, event := range []AuditEvent{
+		{EventType: "session_created", SessionID: "s-1", Severity: "info", Timestamp: base, Details: map[string]interface{}{"hostname": "desk-1"}},
+		{EventType: "privilege_requested", SessionID: "s-1", Severity: "warning", Timestamp: base.Add(time.Minute)},
+		{EventType: "session_created", SessionID: "s-2", Severity: "info", Timestamp: base.Add(2 * time.Minute)},
+		{EventType: "session_terminated", SessionID: "s-1", Severity: "info", Timestamp: base.Add(3 * time.Minute)},
+	} {
+		sm.auditLogger.LogEvent(event)
+	}
+
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+	req := httptest.NewRequest(http.MethodGet, "/api/remoteaccess/audit?event_type=session_created", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var response struct {
+		Events []AuditEvent `json:"events"`
+		Total  int          `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	require.Equal(t, 2, response.Total)
+	assert.Equal(t, "s-2", response.Events[0].SessionID, "newest first")
+	assert.Equal(t, "s-1", response.Events[1].SessionID)
+	assert.Equal(t, "desk-1", response.Events[1].Details["hostname"])
+	assert.True(t, base.Equal(response.Events[1].Timestamp))
+
+	// The criteria combine, and the time range bounds the search
+	events, err := sm.auditLogger.SearchLogs(map[string]interface{}{
+		"session_id": "s-1",
+		"severity":   "info",
+		"start":      base.Add(time.Second),
+	}, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "session_terminated", events[0].EventType)
+
+	events, err = sm.auditLogger.SearchLogs(map[string]interface{}{"end": base.Add(90 * time.Second)}, 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "privilege_requested", events[0].EventType)
+
+	// The log file is still written
+	assert.Len(t, readAuditEvents(t, sm.auditLogger), 4)
+}
+
+func TestSessionManager_PrunesTheAuditDatabase(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.AuditDatabase = filepath.Join(t.TempDir(), "audit", "events.db")
+	config.AuditRetentionDays = 30
+	sm := newTestSessionManager(t, config)
+	require.NotNil(t, sm.auditStore)
+	sm.auditLogger.SetStore(sm.auditStore) // the helper swapped in its own logger
+
+	now := time.Now().UTC()
+	for _, event := range []AuditEvent{
+		{EventType: "session_created", SessionID: "old", Severity: "info", Timestamp: now.AddDate(0, 0, -31)},
+		{EventType: "session_created", SessionID: "recent", Severity: "info", Timestamp: now.AddDate(0, 0, -29)},
+	} {
+		sm.auditLogger.LogEvent(event)
+	}
+
+	sm.pruneAuditStore()
+
+	events, err := sm.auditLogger.SearchLogs(map[string]interface{}{"event_type": "session_created"}, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "recent", events[0].SessionID)
+
+	pruned, err := sm.auditLogger.SearchLogs(map[string]interface{}{"event_type": "audit_events_pruned"}, 0)
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.EqualValues(t, 1, pruned[0].Details["deleted"])
+}
+
+func TestAuditLogger_MasksConfiguredDetailKeys(t *testing.T) {
+	al := NewAuditLogger(t.TempDir(), true)
+	defer al.Close()
+	al.SetMask([]string{"output", "hostname"}, "redact")
+
+	details := map[string]interface{}{
+		"command":     "ipconfig /all",
+		"output":      "Host Name: ACCT-07 ... secret",
+		"client_info": map[string]interface{}{"hostname": "ACCT-07", "os": "windows"},
+	}
+	al.LogEvent(AuditEvent{EventType: "command_executed", Severity: "info", Details: details, Timestamp: time.Now()})
+
+	// The caller's details aren't touched
+	assert.Equal(t, "Host Name: ACCT-07 ... secret", details["output"])
+
+	al.SetMask([]string{"output"}, "hash")
+	al.LogEvent(AuditEvent{EventType: "command_executed", Severity: "info", Details: map[string]interface{}{"output": "same"}, Timestamp: time.Now()})
+	al.LogEvent(AuditEvent{EventType: "command_executed", Severity: "info", Details: map[string]interface{}{"output": "same"}, Timestamp: time.Now()})
+
+	events := readAuditEvents(t, al)
+	require.Len(t, events, 3)
+	assert.Equal(t, map[string]interface{}{
+		"command":     "ipconfig /all",
+		"output":      "[REDACTED]",
+		"client_info": map[string]interface{}{"hostname": "[REDACTED]", "os": "windows"},
+	}, events[0].Details)
+
+	// Hashed values still correlate without revealing the value
+	assert.Regexp(t, `^hmac-sha256:[0-9a-f]{64}$`, events[1].Details["output"])
+	assert.Equal(t, events[1].Details["output"], events[2].Details["output"])
+}
+
+func TestAuditLogger_WritesTimestampsInUTC(t *testing.T) {
+	sm := newTestSessionManager(t, nil)
+	session, err := sm.CreateSession("client-1", "tech-1", nil)
+	require.NoError(t, err)
+
+	// Session records and audit events serialize as RFC3339 with a Z suffix
+	encoded, err := json.Marshal(session)
+	require.NoError(t, err)
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(encoded, &record))
+	assert.Regexp(t, `Z$`, record["start_time"])
+	assert.Regexp(t, `Z$`, record["last_activity"])
+
+	// A caller's local time keeps its instant but is written in UTC
+	saoPaulo := time.FixedZone("BRT", -3*60*60)
+	sm.auditLogger.LogEvent(AuditEvent{EventType: "session_viewed", Severity: "info", Timestamp: time.Date(2026, 3, 1, 9, 0, 0, 0, saoPaulo)})
+
+	events := readAuditEvents(t, sm.auditLogger)
+	require.NotEmpty(t, events)
+	for _, event := range events {
+		assert.Equal(t, time.UTC, event.Timestamp.Location(), event.EventType)
+	}
+	assert.Equal(t, "2026-03-01T12:00:00Z", events[len(events)-1].Timestamp.Format(time.RFC3339))
+}
+
+func TestAuditLogger_NamesRotatedFilesByItsClock(t *testing.T) {
+	dir := t.TempDir()
+	al := NewAuditLogger(dir, true)
+	t.Cleanup(func() { al.Close() })
+	now := clock.NewManual(time.Date(2026, 3, 1, 9, 0, 0, 0, time.Local))
+	al.SetClock(now)
+	al.rotateSize = 1 // every event after the first rotates
+
+	for i := 0; i < 3; i++ {
+		now.Advance(time.Second)
+		al.LogEvent(AuditEvent{EventType: "session_created", Severity: "info"})
+	}
+
+	for _, name := range []string{"remoteaccess_audit_2026-03-01_09-00-02.log", "remoteaccess_audit_2026-03-01_09-00-03.log"} {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+	var stamps []time.Time
+	for _, event := range readAuditEvents(t, al) {
+		stamps = append(stamps, event.Timestamp)
+	}
+	start := time.Date(2026, 3, 1, 9, 0, 0, 0, time.Local).UTC()
+	assert.ElementsMatch(t, []time.Time{start.Add(time.Second), start.Add(2 * time.Second), start.Add(3 * time.Second)}, stamps)
+}
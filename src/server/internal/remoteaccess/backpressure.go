@@ -0,0 +1,203 @@
+package remoteaccess
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrAtCapacity is returned when the maximum number of concurrent sessions has been reached
+var ErrAtCapacity = errors.New("maximum number of sessions reached")
+
+// Reasons given to clients whose connection or session was refused
+const (
+	RetryReasonAtCapacity = "at_capacity"
+	RetryReasonDraining   = "draining"
+)
+
+// capacityRejectionWindow is how far back capacity rejections count towards the backoff
+const capacityRejectionWindow = time.Minute
+
+// maxBackoffDoublings caps the exponent of the capacity backoff
+const maxBackoffDoublings = 10
+
+// RetryHint tells a refused client why it was refused and how long to wait before trying again
+type RetryHint struct {
+	Reason     string `json:"reason"`
+	RetryAfter int    `json:"retry_after"` // seconds
+	Message    string `json:"message,omitempty"`
+
+	// Session counts at the time of the refusal, so clients and load balancers can react
+	ActiveSessions int `json:"active_sessions"`
+	MaxSessions    int `json:"max_sessions"`
+}
+
+// Capacity is how many sessions are open against the configured limit
+type Capacity struct {
+	ActiveSessions int  `json:"active_sessions"`
+	MaxSessions    int  `json:"max_sessions"`
+	AtCapacity     bool `json:"at_capacity"`
+	Draining       bool `json:"draining"`
+}
+
+// Ready reports whether new sessions would currently be accepted
+func (c Capacity) Ready() bool {
+	return !c.AtCapacity && !c.Draining
+}
+
+// BeginDrain stops the session manager from accepting new connections and sessions,
+// reporting whether this call started the drain
+func (sm *SessionManager) BeginDrain() bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	started := !sm.draining
+	sm.draining = true
+	return started
+}
+
+// IsDraining reports whether the session manager is refusing new work ahead of shutdown
+func (sm *SessionManager) IsDraining() bool {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.draining
+}
+
+// Capacity returns the current and maximum session counts
+func (sm *SessionManager) Capacity() Capacity {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	return Capacity{
+		ActiveSessions: len(sm.sessions),
+		MaxSessions:    sm.config.MaxConcurrentSessions,
+		AtCapacity:     len(sm.sessions) >= sm.config.MaxConcurrentSessions,
+		Draining:       sm.draining,
+	}
+}
+
+// RetryHint builds the retry guidance for a refusal with the given reason
+func (sm *SessionManager) RetryHint(reason string) RetryHint {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	hint := RetryHint{
+		Reason:         reason,
+		RetryAfter:     retrySeconds(sm.retryAfter(reason)),
+		ActiveSessions: len(sm.sessions),
+		MaxSessions:    sm.config.MaxConcurrentSessions,
+	}
+	switch reason {
+	case RetryReasonDraining:
+		hint.Message = "Server is shutting down, reconnect later"
+	case RetryReasonAtCapacity:
+		hint.Message = "Server is at capacity, retry later"
+	}
+	return hint
+}
+
+// retryAfter derives the suggested wait from drain state and recent demand: each capacity
+// rejection within the last minute doubles the base delay, up to the configured maximum.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) retryAfter(reason string) time.Duration {
+	if sm.draining || reason == RetryReasonDraining {
+		return sm.config.ReconnectDrainDelay
+	}
+
+	since := time.Now().Add(-capacityRejectionWindow)
+	recent := 0
+	for _, rejectedAt := range sm.rejections {
+		if rejectedAt.After(since) {
+			recent++
+		}
+	}
+	if recent > 0 {
+		recent-- // the rejection being answered doesn't count against itself
+	}
+	if recent > maxBackoffDoublings {
+		recent = maxBackoffDoublings
+	}
+
+	delay := sm.config.ReconnectBaseDelay << uint(recent)
+	if max := sm.config.ReconnectMaxDelay; max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// recordCapacityRejection notes a refused session so later hints back off further.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) recordCapacityRejection() {
+	now := time.Now()
+	since := now.Add(-capacityRejectionWindow)
+
+	kept := sm.rejections[:0]
+	for _, rejectedAt := range sm.rejections {
+		if rejectedAt.After(since) {
+			kept = append(kept, rejectedAt)
+		}
+	}
+	sm.rejections = append(kept, now)
+}
+
+// retrySeconds rounds a delay up to whole seconds, never below one
+func retrySeconds(delay time.Duration) int {
+	seconds := int((delay + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// writeRetryRejection answers an HTTP request with 503, a Retry-After header and the hint as JSON
+func writeRetryRejection(w http.ResponseWriter, hint RetryHint) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(hint.RetryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":           hint.Message,
+		"status":          http.StatusServiceUnavailable,
+		"reason":          hint.Reason,
+		"retry_after":     hint.RetryAfter,
+		"active_sessions": hint.ActiveSessions,
+		"max_sessions":    hint.MaxSessions,
+		"timestamp":       time.Now().UTC(),
+	})
+}
+
+// HandleReadiness is the readiness probe: 200 while new sessions are accepted, and 503 with
+// the session counts and a Retry-After while the server is full or draining, so orchestration
+// can route elsewhere or scale out. It isn't authenticated, like the health check.
+func (h *HTTPHandlers) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	capacity := h.sessionManager.Capacity()
+	if capacity.Ready() {
+		h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+			"status":          "ready",
+			"active_sessions": capacity.ActiveSessions,
+			"max_sessions":    capacity.MaxSessions,
+			"timestamp":       time.Now().UTC(),
+		})
+		return
+	}
+
+	reason := RetryReasonAtCapacity
+	if capacity.Draining {
+		reason = RetryReasonDraining
+	}
+	writeRetryRejection(w, h.sessionManager.RetryHint(reason))
+}
+
+// closeWithRetryHint closes a WebSocket with a close frame whose reason is the hint as JSON
+func closeWithRetryHint(conn *websocket.Conn, code int, hint RetryHint, writeTimeout time.Duration) error {
+	// Close frame reasons are limited to 123 bytes, so leave out the message
+	reason, err := json.Marshal(RetryHint{Reason: hint.Reason, RetryAfter: hint.RetryAfter})
+	if err != nil {
+		return err
+	}
+	return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, string(reason)), time.Now().Add(writeTimeout))
+}
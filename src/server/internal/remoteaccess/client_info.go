@@ -0,0 +1,122 @@
+package remoteaccess
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Limits applied to client-reported machine information
+const (
+	maxClientInfoFieldLength = 255
+	maxUserAgentLength       = 512
+	maxSystemInfoEntries     = 32
+	maxSystemInfoKeyLength   = 64
+	maxSystemInfoValueLength = 512
+)
+
+// ErrInvalidClientInfo is returned when client-reported machine information is malformed
+var ErrInvalidClientInfo = errors.New("invalid client info")
+
+var (
+	hostnamePattern         = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?$`)
+	screenResolutionPattern = regexp.MustCompile(`^[1-9][0-9]{1,4}x[1-9][0-9]{1,4}$`)
+	systemInfoKeyPattern    = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+	// Any OS name is accepted as long as it reads like one, e.g. "Windows 11 Pro 23H2" or "macOS 14.4 (Sonoma)"
+	operatingSystemPattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N} ._()/,+:-]*$`)
+)
+
+// Validate checks client-reported fields against length and allowed-value constraints
+func (ci *ClientInfo) Validate() error {
+	if ci == nil {
+		return nil
+	}
+
+	for name, value := range map[string]string{
+		"hostname":          ci.Hostname,
+		"operating_system":  ci.OperatingSystem,
+		"ip_address":        ci.IPAddress,
+		"screen_resolution": ci.ScreenResolution,
+		"current_user":      ci.CurrentUser,
+	} {
+		if len(value) > maxClientInfoFieldLength {
+			return fmt.Errorf("%w: %s exceeds %d characters", ErrInvalidClientInfo, name, maxClientInfoFieldLength)
+		}
+		if strings.ContainsAny(value, "\x00\r\n") {
+			return fmt.Errorf("%w: %s contains control characters", ErrInvalidClientInfo, name)
+		}
+	}
+	if len(ci.UserAgent) > maxUserAgentLength {
+		return fmt.Errorf("%w: user_agent exceeds %d characters", ErrInvalidClientInfo, maxUserAgentLength)
+	}
+
+	if ci.Hostname != "" && !hostnamePattern.MatchString(ci.Hostname) {
+		return fmt.Errorf("%w: malformed hostname %q", ErrInvalidClientInfo, ci.Hostname)
+	}
+	if ci.IPAddress != "" && net.ParseIP(ci.IPAddress) == nil {
+		return fmt.Errorf("%w: malformed ip_address %q", ErrInvalidClientInfo, ci.IPAddress)
+	}
+	if ci.ScreenResolution != "" && !screenResolutionPattern.MatchString(ci.ScreenResolution) {
+		return fmt.Errorf("%w: screen_resolution must look like 1920x1080", ErrInvalidClientInfo)
+	}
+	if ci.OperatingSystem != "" && !operatingSystemPattern.MatchString(ci.OperatingSystem) {
+		return fmt.Errorf("%w: malformed operating_system %q", ErrInvalidClientInfo, ci.OperatingSystem)
+	}
+
+	if len(ci.SystemInfo) > maxSystemInfoEntries {
+		return fmt.Errorf("%w: system_info has more than %d entries", ErrInvalidClientInfo, maxSystemInfoEntries)
+	}
+	for key, value := range ci.SystemInfo {
+		if len(key) > maxSystemInfoKeyLength || !systemInfoKeyPattern.MatchString(key) {
+			return fmt.Errorf("%w: malformed system_info key %q", ErrInvalidClientInfo, key)
+		}
+		if len(value) > maxSystemInfoValueLength {
+			return fmt.Errorf("%w: system_info value for %s exceeds %d characters", ErrInvalidClientInfo, key, maxSystemInfoValueLength)
+		}
+	}
+
+	return nil
+}
+
+// UpdateClientInfo merges reported machine information into the session and marks it active.
+// Empty fields keep their previous values; system info entries are merged up to the entry limit.
+func (s *RemoteAccessSession) UpdateClientInfo(info *ClientInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ClientInfo == nil {
+		s.ClientInfo = &ClientInfo{}
+	}
+	if s.ClientInfo.SystemInfo == nil {
+		s.ClientInfo.SystemInfo = make(map[string]string)
+	}
+
+	current := s.ClientInfo
+	for _, field := range []struct {
+		dst *string
+		src string
+	}{
+		{&current.Hostname, info.Hostname},
+		{&current.OperatingSystem, info.OperatingSystem},
+		{&current.IPAddress, info.IPAddress},
+		{&current.UserAgent, info.UserAgent},
+		{&current.ScreenResolution, info.ScreenResolution},
+		{&current.CurrentUser, info.CurrentUser},
+	} {
+		if field.src != "" {
+			*field.dst = field.src
+		}
+	}
+
+	for key, value := range info.SystemInfo {
+		if _, exists := current.SystemInfo[key]; !exists && len(current.SystemInfo) >= maxSystemInfoEntries {
+			continue
+		}
+		current.SystemInfo[key] = value
+	}
+
+	s.LastActivity = time.Now().UTC()
+}
@@ -0,0 +1,109 @@
+package remoteaccess
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrClientNotSupported is returned when a client agent is refused by the client policy
+var ErrClientNotSupported = errors.New("client not supported")
+
+// versionPattern matches a dotted version number such as 2.4.1
+var versionPattern = regexp.MustCompile(`^\d+(\.\d+)*$`)
+
+// Validate checks the client policy for malformed entries
+func (c *ClientPolicyConfig) Validate() error {
+	if c.MinimumClientVersion != "" {
+		if !versionPattern.MatchString(c.MinimumClientVersion) {
+			return fmt.Errorf("minimum_client_version must be a dotted version such as 2.4.1")
+		}
+		if c.ClientAgentName == "" {
+			return fmt.Errorf("client_agent_name is required when minimum_client_version is set")
+		}
+	}
+
+	for _, denied := range append(append([]string{}, c.DeniedOperatingSystems...), c.DeniedUserAgents...) {
+		if strings.TrimSpace(denied) == "" {
+			return fmt.Errorf("deny list entries cannot be empty")
+		}
+	}
+
+	return nil
+}
+
+// Check reports why a client may not open a session, or nil if it is allowed.
+// A client whose version can't be read from its user agent is refused when a minimum version is set.
+func (c *ClientPolicyConfig) Check(info *ClientInfo) error {
+	if info == nil {
+		info = &ClientInfo{}
+	}
+
+	operatingSystem := strings.ToLower(strings.TrimSpace(info.OperatingSystem))
+	for _, denied := range c.DeniedOperatingSystems {
+		if strings.HasPrefix(operatingSystem, strings.ToLower(strings.TrimSpace(denied))) {
+			return c.reject(fmt.Sprintf("operating system %q is no longer supported", info.OperatingSystem))
+		}
+	}
+
+	userAgent := strings.ToLower(info.UserAgent)
+	for _, denied := range c.DeniedUserAgents {
+		if strings.Contains(userAgent, strings.ToLower(strings.TrimSpace(denied))) {
+			return c.reject(fmt.Sprintf("client %q is no longer supported", info.UserAgent))
+		}
+	}
+
+	if c.MinimumClientVersion != "" {
+		version, ok := clientAgentVersion(info.UserAgent, c.ClientAgentName)
+		if !ok {
+			return c.reject(fmt.Sprintf("client version could not be determined, minimum is %s", c.MinimumClientVersion))
+		}
+		if compareVersions(version, c.MinimumClientVersion) < 0 {
+			return c.reject(fmt.Sprintf("client version %s is below the minimum %s", version, c.MinimumClientVersion))
+		}
+	}
+
+	return nil
+}
+
+// reject builds the error shown to a refused client, pointing it at the update
+func (c *ClientPolicyConfig) reject(reason string) error {
+	if c.UpdateURL != "" {
+		return fmt.Errorf("%w: %s, please update your client from %s", ErrClientNotSupported, reason, c.UpdateURL)
+	}
+	return fmt.Errorf("%w: %s, please update your client", ErrClientNotSupported, reason)
+}
+
+// clientAgentVersion extracts the version following the agent's product token, e.g. 2.4.1 from "OnliDesk-Client/2.4.1"
+func clientAgentVersion(userAgent, agentName string) (string, bool) {
+	pattern := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(agentName) + `/v?(\d+(?:\.\d+)*)`)
+	match := pattern.FindStringSubmatch(userAgent)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// compareVersions compares dotted versions numerically, treating missing parts as zero
+func compareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aValue, bValue int
+		if i < len(aParts) {
+			aValue, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bValue, _ = strconv.Atoi(bParts[i])
+		}
+		if aValue != bValue {
+			if aValue < bValue {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
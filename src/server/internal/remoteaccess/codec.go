@@ -0,0 +1,82 @@
+package remoteaccess
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Wire encodings a connection can negotiate for its control messages
+const (
+	EncodingJSON    = "json"
+	EncodingMsgPack = "msgpack"
+)
+
+// MessageCodec encodes and decodes control messages for one wire format, so handlers
+// work with the same message structs whichever format the connection negotiated
+type MessageCodec interface {
+	Name() string
+	FrameType() int // WebSocket frame type messages are sent in
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// jsonCodec is the default encoding, sent as text frames
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return EncodingJSON }
+func (jsonCodec) FrameType() int                             { return websocket.TextMessage }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec is the compact binary encoding for high-throughput sessions, sent as binary frames.
+// It reads the json struct tags so both encodings use the same field names.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string   { return EncodingMsgPack }
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+// LookupCodec returns the codec for an encoding name
+func LookupCodec(name string) (MessageCodec, error) {
+	switch name {
+	case EncodingJSON:
+		return jsonCodec{}, nil
+	case EncodingMsgPack:
+		return msgpackCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported message encoding %q", name)
+	}
+}
+
+// negotiateEncoding picks the first of the client's preferred encodings the server offers,
+// falling back to JSON
+func negotiateEncoding(preferred []string, msgpackEnabled bool) string {
+	for _, name := range preferred {
+		switch {
+		case name == EncodingJSON:
+			return EncodingJSON
+		case name == EncodingMsgPack && msgpackEnabled:
+			return EncodingMsgPack
+		}
+	}
+	return EncodingJSON
+}
@@ -0,0 +1,103 @@
+package remoteaccess
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// ControlCommand is a command the portal sends for the client to run
+type ControlCommand struct {
+	Type      string                 `json:"type"`
+	SessionID string                 `json:"session_id"`
+	CommandID string                 `json:"command_id,omitempty"` // echoed in the client's command_result
+	Command   string                 `json:"command"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+
+	RequestedBy string `json:"-"` // authenticated sender, who may not approve the command
+}
+
+// clientConsentActor is recorded as the approver of commands the client user consented to
+const clientConsentActor = "client:consent"
+
+// RequestCommandApproval holds a high-risk command behind a command privilege request. The
+// command is sent to the client once the request is approved, and dropped if it is denied or expires.
+// Only the client user or an approver other than requestedBy can approve it.
+func (sm *SessionManager) RequestCommandApproval(command ControlCommand, requestedBy string) (string, error) {
+	command.RequestedBy = requestedBy
+	requestID, err := sm.requestPrivilege(command.SessionID, PrivilegeTypeCommand, command.Command, 0, &command)
+	if err != nil {
+		return "", fmt.Errorf("failed to request command approval: %v", err)
+	}
+
+	if session, exists := sm.GetSession(command.SessionID); exists {
+		sm.askClientToApproveCommand(session, requestID, command)
+	}
+	return requestID, nil
+}
+
+// askClientToApproveCommand offers a still pending command to the client user for consent
+func (sm *SessionManager) askClientToApproveCommand(session *RemoteAccessSession, requestID string, command ControlCommand) {
+	if request, found := session.GetPrivilegeRequest(requestID); !found || request.Status != "pending" {
+		return
+	}
+
+	sm.mutex.RLock()
+	conn := session.ClientConn
+	sm.mutex.RUnlock()
+	if conn == nil {
+		return
+	}
+
+	notification := map[string]interface{}{
+		"type":       "command_approval_request",
+		"session_id": session.ID,
+		"request_id": requestID,
+		"command_id": command.CommandID,
+		"command":    command.Command,
+		"timestamp":  time.Now().UTC(),
+	}
+	if err := sm.writeMessage(conn, notification); err != nil {
+		log.Printf("Failed to ask client to approve command %s: %v", command.CommandID, err)
+	}
+}
+
+// sendApprovedCommand records a command whose approval came through and sends it to the client
+func (sm *SessionManager) sendApprovedCommand(session *RemoteAccessSession, command ControlCommand) {
+	session.IncrementCommand(command.Command)
+	session.RecordCommand(command.CommandID, command.Command)
+
+	if session.ClientConn != nil {
+		if err := sm.writeMessage(session.ClientConn, command); err != nil {
+			log.Printf("Failed to send approved command %s to session %s: %v", command.CommandID, session.ID, err)
+		}
+	}
+}
+
+// dropHeldCommand discards a command whose approval was refused and tells the portal it won't run
+func (sm *SessionManager) dropHeldCommand(session *RemoteAccessSession, command ControlCommand, reason string) {
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:  "command_denied",
+		SessionID:  session.ID,
+		ClientID:   session.ClientID,
+		Technician: session.TechnicianID,
+		Details:    map[string]interface{}{"command_id": command.CommandID, "command": command.Command, "reason": reason},
+		Severity:   "warning",
+		Success:    false,
+		Timestamp:  time.Now().UTC(),
+	})
+
+	if session.PortalConn != nil {
+		notification := map[string]interface{}{
+			"type":       "command_denied",
+			"session_id": session.ID,
+			"command_id": command.CommandID,
+			"command":    command.Command,
+			"reason":     reason,
+			"timestamp":  time.Now().UTC(),
+		}
+		if err := sm.writeMessage(session.PortalConn, notification); err != nil {
+			log.Printf("Failed to notify portal of denied command %s: %v", command.CommandID, err)
+		}
+	}
+}
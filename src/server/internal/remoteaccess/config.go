@@ -2,7 +2,11 @@ package remoteaccess
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/redact"
 )
 
 type PrivilegeType string
@@ -12,12 +16,13 @@ const (
 	PrivilegeTypeElevated PrivilegeType = "elevated"
 	PrivilegeTypeRegistry PrivilegeType = "registry"
 	PrivilegeTypeServices PrivilegeType = "services"
+	PrivilegeTypeCommand  PrivilegeType = "command" // approval to run one high-risk command
 )
 
 // IsValid checks if the privilege type is valid
 func (p PrivilegeType) IsValid() bool {
 	switch p {
-	case PrivilegeTypeAdmin, PrivilegeTypeElevated, PrivilegeTypeRegistry, PrivilegeTypeServices:
+	case PrivilegeTypeAdmin, PrivilegeTypeElevated, PrivilegeTypeRegistry, PrivilegeTypeServices, PrivilegeTypeCommand:
 		return true
 	default:
 		return false
@@ -30,24 +35,45 @@ type RemoteAccessConfig struct {
 	Enabled                bool          `json:"enabled" yaml:"enabled"`
 	MaxConcurrentSessions  int           `json:"max_concurrent_sessions" yaml:"max_concurrent_sessions"`
 	SessionTimeout         time.Duration `json:"session_timeout" yaml:"session_timeout"`
+	MaxSessionDuration     time.Duration `json:"max_session_duration" yaml:"max_session_duration"` // extensions can't keep a session open longer; 0 is unbounded
 	IdleTimeout            time.Duration `json:"idle_timeout" yaml:"idle_timeout"`
 	CleanupInterval        time.Duration `json:"cleanup_interval" yaml:"cleanup_interval"`
+	SessionCodeLength      int           `json:"session_code_length" yaml:"session_code_length"` // characters in the short code given to every session, 6 to 9
+
+	// Session history settings
+	TerminatedSessionRetention time.Duration `json:"terminated_session_retention" yaml:"terminated_session_retention"`
+	MaxTerminatedSessions      int           `json:"max_terminated_sessions" yaml:"max_terminated_sessions"`
 
 	// WebSocket settings
 	WebSocketReadTimeout   time.Duration `json:"websocket_read_timeout" yaml:"websocket_read_timeout"`
 	WebSocketWriteTimeout  time.Duration `json:"websocket_write_timeout" yaml:"websocket_write_timeout"`
 	WebSocketPingInterval  time.Duration `json:"websocket_ping_interval" yaml:"websocket_ping_interval"`
 	WebSocketPongTimeout   time.Duration `json:"websocket_pong_timeout" yaml:"websocket_pong_timeout"`
+	HighLatencyThreshold   time.Duration `json:"high_latency_threshold" yaml:"high_latency_threshold"`
 	MaxMessageSize         int64         `json:"max_message_size" yaml:"max_message_size"`
+	MessagePackEnabled     bool          `json:"messagepack_enabled" yaml:"messagepack_enabled"` // lets clients negotiate MessagePack in the hello handshake; JSON is always available
+
+	// Reconnect backoff advertised to refused clients
+	ReconnectBaseDelay     time.Duration `json:"reconnect_base_delay" yaml:"reconnect_base_delay"`
+	ReconnectMaxDelay      time.Duration `json:"reconnect_max_delay" yaml:"reconnect_max_delay"`
+	ReconnectDrainDelay    time.Duration `json:"reconnect_drain_delay" yaml:"reconnect_drain_delay"`
 
 	// Security settings
-	RequireAuthentication  bool          `json:"require_authentication" yaml:"require_authentication"`
-	AllowedOrigins         []string      `json:"allowed_origins" yaml:"allowed_origins"`
+	RequireAuthentication  bool          `json:"require_authentication" yaml:"require_authentication"` // refuse scoped REST routes while no auth provider is configured
+	AllowedOrigins         []string      `json:"allowed_origins" yaml:"allowed_origins"` // browser origins that may open a WebSocket; "*" allows any, empty only the server's own
+	AllowedIPRanges        []string      `json:"allowed_ip_ranges" yaml:"allowed_ip_ranges"` // CIDRs; empty allows any source not blocked
+	BlockedIPRanges        []string      `json:"blocked_ip_ranges" yaml:"blocked_ip_ranges"` // CIDRs; take precedence over the allowlist
+	TrustedProxies         []string      `json:"trusted_proxies" yaml:"trusted_proxies"` // CIDRs of proxies whose X-Forwarded-For and X-Real-IP are believed; empty trusts none
 	RateLimitEnabled       bool          `json:"rate_limit_enabled" yaml:"rate_limit_enabled"`
 	RateLimitRequests      int           `json:"rate_limit_requests" yaml:"rate_limit_requests"`
 	RateLimitWindow        time.Duration `json:"rate_limit_window" yaml:"rate_limit_window"`
 	MaxFailedAttempts      int           `json:"max_failed_attempts" yaml:"max_failed_attempts"`
 	LockoutDuration        time.Duration `json:"lockout_duration" yaml:"lockout_duration"`
+	RoleMessagePolicy      map[string][]string `json:"role_message_policy" yaml:"role_message_policy"` // role to allowed message types; unlisted roles are unrestricted, nil uses the defaults
+	UnauthenticatedPaths   []string      `json:"unauthenticated_paths" yaml:"unauthenticated_paths"` // REST paths served without a bearer token when authentication is configured
+
+	// Client agent policy
+	ClientPolicy           ClientPolicyConfig `json:"client_policy" yaml:"client_policy"`
 
 	// Privilege escalation settings
 	PrivilegeEscalation    PrivilegeEscalationConfig `json:"privilege_escalation" yaml:"privilege_escalation"`
@@ -56,24 +82,49 @@ type RemoteAccessConfig struct {
 	AuditEnabled           bool   `json:"audit_enabled" yaml:"audit_enabled"`
 	AuditLogDir            string `json:"audit_log_dir" yaml:"audit_log_dir"`
 	AuditRetentionDays     int    `json:"audit_retention_days" yaml:"audit_retention_days"`
+	AuditEventTypes        []string `json:"audit_event_types" yaml:"audit_event_types"` // empty means all
+	AuditMinSeverity       string `json:"audit_min_severity" yaml:"audit_min_severity"`
+	AuditMaskedFields      []string `json:"audit_masked_fields" yaml:"audit_masked_fields"` // detail keys whose values are never written in plaintext
+	AuditMaskMode          string `json:"audit_mask_mode" yaml:"audit_mask_mode"` // redact or hash
+	AuditDatabase          string `json:"audit_database" yaml:"audit_database"` // SQLite file events are also stored in for searching; empty searches the log files
 
 	// File transfer settings
 	FileTransferEnabled    bool  `json:"file_transfer_enabled" yaml:"file_transfer_enabled"`
 	MaxFileSize            int64 `json:"max_file_size" yaml:"max_file_size"`
 	AllowedFileTypes       []string `json:"allowed_file_types" yaml:"allowed_file_types"`
 	BlockedFileTypes       []string `json:"blocked_file_types" yaml:"blocked_file_types"`
+	MaxSessionTransferBytes int64   `json:"max_session_transfer_bytes" yaml:"max_session_transfer_bytes"` // 0 means unlimited
+	MaxConcurrentTransfersPerSession int `json:"max_concurrent_transfers_per_session" yaml:"max_concurrent_transfers_per_session"` // 0 means unlimited
+	DenyUploads            bool  `json:"deny_uploads" yaml:"deny_uploads"`     // technician to client machine
+	DenyDownloads          bool  `json:"deny_downloads" yaml:"deny_downloads"` // client machine to technician
 
 	// Screen sharing settings
 	ScreenSharingEnabled   bool `json:"screen_sharing_enabled" yaml:"screen_sharing_enabled"`
 	MaxScreenshotSize      int  `json:"max_screenshot_size" yaml:"max_screenshot_size"`
-	ScreenshotQuality      int  `json:"screenshot_quality" yaml:"screenshot_quality"`
+	ScreenshotQuality      int  `json:"screenshot_quality" yaml:"screenshot_quality"` // used when a capture request doesn't ask for one
+	MinScreenshotQuality   int  `json:"min_screenshot_quality" yaml:"min_screenshot_quality"` // 0 means unset
+	MaxScreenshotQuality   int  `json:"max_screenshot_quality" yaml:"max_screenshot_quality"` // 0 means unset
 	ScreenshotInterval     time.Duration `json:"screenshot_interval" yaml:"screenshot_interval"`
 
+	// Session recording settings
+	RecordingEnabled       bool   `json:"recording_enabled" yaml:"recording_enabled"`
+	RecordingDir           string `json:"recording_dir" yaml:"recording_dir"`
+	RecordingEncoder       string `json:"recording_encoder" yaml:"recording_encoder"` // auto, ffmpeg, archive
+	FFmpegPath             string `json:"ffmpeg_path" yaml:"ffmpeg_path"`
+	MaxRecordingExportSize int64  `json:"max_recording_export_size" yaml:"max_recording_export_size"`
+	RecordInputEvents      bool   `json:"record_input_events" yaml:"record_input_events"`
+	RecordKeystrokes       bool   `json:"record_keystrokes" yaml:"record_keystrokes"` // keystrokes in sensitive fields are always redacted
+	MaxInputEventLogSize   int64  `json:"max_input_event_log_size" yaml:"max_input_event_log_size"`
+
 	// Command execution settings
 	CommandExecutionEnabled bool     `json:"command_execution_enabled" yaml:"command_execution_enabled"`
 	AllowedCommands        []string `json:"allowed_commands" yaml:"allowed_commands"`
 	BlockedCommands        []string `json:"blocked_commands" yaml:"blocked_commands"`
 	CommandTimeout         time.Duration `json:"command_timeout" yaml:"command_timeout"`
+	MaxCommandHistory      int      `json:"max_command_history" yaml:"max_command_history"` // commands kept per session; 0 keeps none
+	MaxCommandOutput       int      `json:"max_command_output" yaml:"max_command_output"`   // bytes of each command's output kept
+	RequireCommandApproval bool     `json:"require_command_approval" yaml:"require_command_approval"` // high-risk commands wait for an approved privilege request
+	HighRiskCommandPatterns []string `json:"high_risk_command_patterns" yaml:"high_risk_command_patterns"` // command prefixes needing approval; empty uses the built-in list
 }
 
 // PrivilegeEscalationConfig holds privilege escalation configuration
@@ -88,6 +139,58 @@ type PrivilegeEscalationConfig struct {
 	AllowedPrivileges      []PrivilegeType `json:"allowed_privileges" yaml:"allowed_privileges"`
 	NotifyOnEscalation     bool          `json:"notify_on_escalation" yaml:"notify_on_escalation"`
 	LogAllRequests         bool          `json:"log_all_requests" yaml:"log_all_requests"`
+	MaxRequestsPerMinute   int           `json:"max_requests_per_minute" yaml:"max_requests_per_minute"` // 0 disables the per-session limit
+	MaxPendingRequests     int           `json:"max_pending_requests" yaml:"max_pending_requests"`       // across all sessions; 0 disables the cap
+	PendingRequestTimeout  time.Duration `json:"pending_request_timeout" yaml:"pending_request_timeout"` // undecided requests expire after this; 0 keeps them
+	RequireDenialReason    bool          `json:"require_denial_reason" yaml:"require_denial_reason"`     // denying a request needs a non-empty reason
+
+	// Unattended sessions (no portal connected) are routed by these rules, then the default decision
+	UnattendedApprovers       []UnattendedApprovalRule `json:"unattended_approvers" yaml:"unattended_approvers"`
+	UnattendedDefaultDecision string                   `json:"unattended_default_decision" yaml:"unattended_default_decision"` // pending, approve, deny
+
+	// Directory OU of each enrolled client, by client ID, as recorded by the server at enrollment.
+	// Organizational unit rules match against these only, never an OU the client reports itself.
+	EnrolledOrganizationalUnits map[string]string `json:"enrolled_organizational_units" yaml:"enrolled_organizational_units"`
+
+	// Bounds on how many routed requests one approver is asked to handle
+	MaxPendingPerApprover int           `json:"max_pending_per_approver" yaml:"max_pending_per_approver"` // beyond this, requests overflow to the next approver or the backlog; 0 disables the cap
+	DigestThreshold       int           `json:"digest_threshold" yaml:"digest_threshold"`                 // beyond this many pending, approvers get digests instead of a notification per request; 0 disables digests
+	DigestInterval        time.Duration `json:"digest_interval" yaml:"digest_interval"`                   // least time between two digests to the same approver
+}
+
+// ClientPolicyConfig decides which client agents may open sessions, based on the OS and
+// user agent they report
+type ClientPolicyConfig struct {
+	DeniedOperatingSystems []string `json:"denied_operating_systems" yaml:"denied_operating_systems"` // case-insensitive prefixes, e.g. "windows 7"
+	DeniedUserAgents       []string `json:"denied_user_agents" yaml:"denied_user_agents"`             // case-insensitive substrings
+	MinimumClientVersion   string   `json:"minimum_client_version" yaml:"minimum_client_version"`     // empty allows any version
+	ClientAgentName        string   `json:"client_agent_name" yaml:"client_agent_name"`               // product token carrying the version in the user agent
+	UpdateURL              string   `json:"update_url" yaml:"update_url"`                             // shown to rejected clients
+}
+
+// Decisions a policy can apply to an unattended privilege request
+const (
+	UnattendedDecisionPending = "pending"
+	UnattendedDecisionApprove = "approve"
+	UnattendedDecisionDeny    = "deny"
+)
+
+// UnattendedApprovalRule routes privilege requests from unattended clients, matched by client ID
+// or organizational unit, either to a designated approver or to an automatic decision
+type UnattendedApprovalRule struct {
+	ClientID           string `json:"client_id,omitempty" yaml:"client_id,omitempty"`
+	OrganizationalUnit string `json:"organizational_unit,omitempty" yaml:"organizational_unit,omitempty"`
+	Approver           string `json:"approver,omitempty" yaml:"approver,omitempty"`
+	OverflowApprovers  []string `json:"overflow_approvers,omitempty" yaml:"overflow_approvers,omitempty"` // tried in order once the approver's queue is full
+	Decision           string `json:"decision,omitempty" yaml:"decision,omitempty"`
+}
+
+// Approvers returns who may be routed a request matching the rule, in the order they are tried
+func (r UnattendedApprovalRule) Approvers() []string {
+	if r.Approver == "" {
+		return nil
+	}
+	return append([]string{r.Approver}, r.OverflowApprovers...)
 }
 
 // DefaultRemoteAccessConfig returns default configuration
@@ -97,15 +200,28 @@ func DefaultRemoteAccessConfig() *RemoteAccessConfig {
 		Enabled:               true,
 		MaxConcurrentSessions: 10,
 		SessionTimeout:        4 * time.Hour,
+		MaxSessionDuration:    12 * time.Hour,
 		IdleTimeout:           30 * time.Minute,
 		CleanupInterval:       5 * time.Minute,
+		SessionCodeLength:     defaultSessionCodeLength,
+
+		// Session history settings
+		TerminatedSessionRetention: time.Hour,
+		MaxTerminatedSessions:      500,
 
 		// WebSocket settings
 		WebSocketReadTimeout:  60 * time.Second,
 		WebSocketWriteTimeout: 10 * time.Second,
 		WebSocketPingInterval: 30 * time.Second,
 		WebSocketPongTimeout:  10 * time.Second,
+		HighLatencyThreshold:  300 * time.Millisecond,
 		MaxMessageSize:        1024 * 1024, // 1MB
+		MessagePackEnabled:    true,
+
+		// Reconnect backoff
+		ReconnectBaseDelay:  5 * time.Second,
+		ReconnectMaxDelay:   5 * time.Minute,
+		ReconnectDrainDelay: 30 * time.Second,
 
 		// Security settings
 		RequireAuthentication: true,
@@ -115,6 +231,15 @@ func DefaultRemoteAccessConfig() *RemoteAccessConfig {
 		RateLimitWindow:       time.Minute,
 		MaxFailedAttempts:     5,
 		LockoutDuration:       15 * time.Minute,
+		RoleMessagePolicy:     defaultRoleMessagePolicy(),
+		UnauthenticatedPaths:  []string{"/api/remoteaccess/health"},
+
+		// Client agent policy
+		ClientPolicy: ClientPolicyConfig{
+			DeniedOperatingSystems: []string{},
+			DeniedUserAgents:       []string{},
+			ClientAgentName:        "OnliDesk-Client",
+		},
 
 		// Privilege escalation settings
 		PrivilegeEscalation: PrivilegeEscalationConfig{
@@ -130,32 +255,61 @@ func DefaultRemoteAccessConfig() *RemoteAccessConfig {
 				PrivilegeTypeRegistry,
 				PrivilegeTypeServices,
 			},
-			NotifyOnEscalation: true,
-			LogAllRequests:     true,
+			NotifyOnEscalation:    true,
+			LogAllRequests:        true,
+			MaxRequestsPerMinute:  5,
+			MaxPendingRequests:    100,
+			PendingRequestTimeout: 10 * time.Minute,
+
+			UnattendedDefaultDecision: UnattendedDecisionPending,
+
+			MaxPendingPerApprover: 25,
+			DigestThreshold:       10,
+			DigestInterval:        time.Minute,
 		},
 
 		// Audit settings
 		AuditEnabled:       true,
 		AuditLogDir:        "./logs/audit",
 		AuditRetentionDays: 90,
+		AuditEventTypes:    []string{},
+		AuditMinSeverity:   "info",
+		AuditMaskMode:      redact.ModeRedact,
 
 		// File transfer settings
 		FileTransferEnabled: true,
 		MaxFileSize:        100 * 1024 * 1024, // 100MB
 		AllowedFileTypes:   []string{".txt", ".log", ".cfg", ".conf", ".ini", ".xml", ".json", ".yaml", ".yml"},
 		BlockedFileTypes:   []string{".exe", ".bat", ".cmd", ".ps1", ".sh", ".scr", ".com", ".pif"},
+		MaxSessionTransferBytes: 1024 * 1024 * 1024, // 1GB
+		MaxConcurrentTransfersPerSession: 3,
 
 		// Screen sharing settings
 		ScreenSharingEnabled: true,
 		MaxScreenshotSize:   1920 * 1080,
 		ScreenshotQuality:   80,
+		MinScreenshotQuality: 10,
+		MaxScreenshotQuality: 95,
 		ScreenshotInterval:  time.Second,
 
+		// Session recording settings
+		RecordingEnabled:       false,
+		RecordingDir:           "./recordings",
+		RecordingEncoder:       "auto",
+		FFmpegPath:             "ffmpeg",
+		MaxRecordingExportSize: 512 * 1024 * 1024, // 512MB
+		RecordInputEvents:      false,
+		RecordKeystrokes:       true,
+		MaxInputEventLogSize:   16 * 1024 * 1024, // 16MB
+
 		// Command execution settings
 		CommandExecutionEnabled: false, // Disabled by default for security
 		AllowedCommands:        []string{"dir", "ls", "pwd", "whoami", "hostname", "ipconfig", "ifconfig"},
 		BlockedCommands:        []string{"rm", "del", "format", "fdisk", "mkfs", "sudo", "su", "runas"},
 		CommandTimeout:         30 * time.Second,
+		MaxCommandHistory:      100,
+		MaxCommandOutput:       4096,
+		RequireCommandApproval: true,
 	}
 }
 
@@ -169,10 +323,29 @@ func (c *RemoteAccessConfig) Validate() error {
 		return fmt.Errorf("session_timeout must be greater than 0")
 	}
 
+	if c.MaxSessionDuration < 0 {
+		return fmt.Errorf("max_session_duration cannot be negative")
+	}
+	if c.MaxSessionDuration > 0 && c.MaxSessionDuration < c.SessionTimeout {
+		return fmt.Errorf("max_session_duration cannot be shorter than session_timeout")
+	}
+
 	if c.IdleTimeout <= 0 {
 		return fmt.Errorf("idle_timeout must be greater than 0")
 	}
 
+	if c.SessionCodeLength != 0 && (c.SessionCodeLength < minSessionCodeLength || c.SessionCodeLength > maxSessionCodeLength) {
+		return fmt.Errorf("session_code_length must be between %d and %d", minSessionCodeLength, maxSessionCodeLength)
+	}
+
+	if c.TerminatedSessionRetention < 0 {
+		return fmt.Errorf("terminated_session_retention cannot be negative")
+	}
+
+	if c.MaxTerminatedSessions < 0 {
+		return fmt.Errorf("max_terminated_sessions cannot be negative")
+	}
+
 	if c.WebSocketReadTimeout <= 0 {
 		return fmt.Errorf("websocket_read_timeout must be greater than 0")
 	}
@@ -181,10 +354,22 @@ func (c *RemoteAccessConfig) Validate() error {
 		return fmt.Errorf("websocket_write_timeout must be greater than 0")
 	}
 
+	if c.HighLatencyThreshold < 0 {
+		return fmt.Errorf("high_latency_threshold cannot be negative")
+	}
+
 	if c.MaxMessageSize <= 0 {
 		return fmt.Errorf("max_message_size must be greater than 0")
 	}
 
+	if c.ReconnectBaseDelay <= 0 || c.ReconnectDrainDelay <= 0 {
+		return fmt.Errorf("reconnect_base_delay and reconnect_drain_delay must be greater than 0")
+	}
+
+	if c.ReconnectMaxDelay < c.ReconnectBaseDelay {
+		return fmt.Errorf("reconnect_max_delay cannot be less than reconnect_base_delay")
+	}
+
 	if c.RateLimitEnabled {
 		if c.RateLimitRequests <= 0 {
 			return fmt.Errorf("rate_limit_requests must be greater than 0 when rate limiting is enabled")
@@ -202,6 +387,14 @@ func (c *RemoteAccessConfig) Validate() error {
 		return fmt.Errorf("lockout_duration must be greater than 0")
 	}
 
+	if err := validateRoleMessagePolicy(c.RoleMessagePolicy); err != nil {
+		return fmt.Errorf("role_message_policy config error: %v", err)
+	}
+
+	if err := c.ClientPolicy.Validate(); err != nil {
+		return fmt.Errorf("client_policy config error: %v", err)
+	}
+
 	// Validate privilege escalation config
 	if err := c.PrivilegeEscalation.Validate(); err != nil {
 		return fmt.Errorf("privilege_escalation config error: %v", err)
@@ -211,10 +404,26 @@ func (c *RemoteAccessConfig) Validate() error {
 		return fmt.Errorf("audit_retention_days must be greater than 0")
 	}
 
+	if c.AuditMinSeverity != "" {
+		if _, ok := severityRank[c.AuditMinSeverity]; !ok {
+			return fmt.Errorf("audit_min_severity must be one of info, warning, error, critical")
+		}
+	}
+
+	if err := redact.ValidateMode(c.AuditMaskMode); err != nil {
+		return fmt.Errorf("audit_mask_mode: %v", err)
+	}
+
 	if c.FileTransferEnabled {
 		if c.MaxFileSize <= 0 {
 			return fmt.Errorf("max_file_size must be greater than 0 when file transfer is enabled")
 		}
+		if c.MaxSessionTransferBytes < 0 {
+			return fmt.Errorf("max_session_transfer_bytes cannot be negative")
+		}
+		if c.MaxConcurrentTransfersPerSession < 0 {
+			return fmt.Errorf("max_concurrent_transfers_per_session cannot be negative")
+		}
 	}
 
 	if c.ScreenSharingEnabled {
@@ -224,17 +433,69 @@ func (c *RemoteAccessConfig) Validate() error {
 		if c.ScreenshotQuality < 1 || c.ScreenshotQuality > 100 {
 			return fmt.Errorf("screenshot_quality must be between 1 and 100")
 		}
+		if c.MinScreenshotQuality < 0 || c.MaxScreenshotQuality < 0 || c.MaxScreenshotQuality > 100 {
+			return fmt.Errorf("min_screenshot_quality and max_screenshot_quality must be between 0 (unset) and 100")
+		}
+		if c.MaxScreenshotQuality > 0 && c.MinScreenshotQuality > c.MaxScreenshotQuality {
+			return fmt.Errorf("min_screenshot_quality cannot exceed max_screenshot_quality")
+		}
+		if c.ScreenshotQuality < c.MinScreenshotQuality || (c.MaxScreenshotQuality > 0 && c.ScreenshotQuality > c.MaxScreenshotQuality) {
+			return fmt.Errorf("screenshot_quality must be between min_screenshot_quality and max_screenshot_quality")
+		}
 		if c.ScreenshotInterval <= 0 {
 			return fmt.Errorf("screenshot_interval must be greater than 0")
 		}
 	}
 
+	if c.RecordingEnabled {
+		if c.RecordingDir == "" {
+			return fmt.Errorf("recording_dir is required when recording is enabled")
+		}
+		switch c.RecordingEncoder {
+		case "", "auto", "ffmpeg", "archive":
+		default:
+			return fmt.Errorf("recording_encoder must be one of auto, ffmpeg, archive")
+		}
+	}
+
+	if c.MaxRecordingExportSize < 0 {
+		return fmt.Errorf("max_recording_export_size cannot be negative")
+	}
+
+	if c.MaxInputEventLogSize < 0 {
+		return fmt.Errorf("max_input_event_log_size cannot be negative")
+	}
+
 	if c.CommandExecutionEnabled {
 		if c.CommandTimeout <= 0 {
 			return fmt.Errorf("command_timeout must be greater than 0 when command execution is enabled")
 		}
 	}
 
+	if c.MaxCommandHistory < 0 {
+		return fmt.Errorf("max_command_history cannot be negative")
+	}
+
+	if c.MaxCommandOutput < 0 {
+		return fmt.Errorf("max_command_output cannot be negative")
+	}
+
+	for _, cidr := range c.AllowedIPRanges {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("allowed_ip_ranges: invalid CIDR %q", cidr)
+		}
+	}
+	for _, cidr := range c.BlockedIPRanges {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("blocked_ip_ranges: invalid CIDR %q", cidr)
+		}
+	}
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("trusted_proxies: invalid CIDR %q", cidr)
+		}
+	}
+
 	return nil
 }
 
@@ -268,6 +529,50 @@ func (c *PrivilegeEscalationConfig) Validate() error {
 		return fmt.Errorf("at least one privilege type must be allowed")
 	}
 
+	if c.MaxRequestsPerMinute < 0 {
+		return fmt.Errorf("max_requests_per_minute cannot be negative")
+	}
+
+	if c.MaxPendingRequests < 0 {
+		return fmt.Errorf("max_pending_requests cannot be negative")
+	}
+
+	if c.PendingRequestTimeout < 0 {
+		return fmt.Errorf("pending_request_timeout cannot be negative")
+	}
+
+	switch c.UnattendedDefaultDecision {
+	case "", UnattendedDecisionPending, UnattendedDecisionApprove, UnattendedDecisionDeny:
+	default:
+		return fmt.Errorf("unattended_default_decision must be one of pending, approve, deny")
+	}
+
+	for i, rule := range c.UnattendedApprovers {
+		if rule.ClientID == "" && rule.OrganizationalUnit == "" {
+			return fmt.Errorf("unattended_approvers[%d] must match a client_id or organizational_unit", i)
+		}
+		if (rule.Approver == "") == (rule.Decision == "") {
+			return fmt.Errorf("unattended_approvers[%d] must set exactly one of approver or decision", i)
+		}
+		if rule.Decision != "" && rule.Decision != UnattendedDecisionApprove && rule.Decision != UnattendedDecisionDeny {
+			return fmt.Errorf("unattended_approvers[%d] decision must be approve or deny", i)
+		}
+		if len(rule.OverflowApprovers) > 0 && rule.Approver == "" {
+			return fmt.Errorf("unattended_approvers[%d] overflow_approvers needs an approver", i)
+		}
+	}
+
+	if c.MaxPendingPerApprover < 0 {
+		return fmt.Errorf("max_pending_per_approver cannot be negative")
+	}
+
+	if c.DigestThreshold < 0 {
+		return fmt.Errorf("digest_threshold cannot be negative")
+	}
+	if c.DigestThreshold > 0 && c.DigestInterval <= 0 {
+		return fmt.Errorf("digest_interval must be greater than 0 when digests are enabled")
+	}
+
 	// Validate privilege types
 	for _, privilege := range c.AllowedPrivileges {
 		if !privilege.IsValid() {
@@ -329,6 +634,115 @@ func (c *RemoteAccessConfig) IsFileTypeAllowed(filename string) bool {
 	return false
 }
 
+// IsIPAllowed checks a client IP against the blocked and allowed ranges. When any range is
+// configured, an address that can't be parsed is refused.
+func (c *RemoteAccessConfig) IsIPAllowed(ip string) bool {
+	if len(c.AllowedIPRanges) == 0 && len(c.BlockedIPRanges) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	if ipInRanges(addr, c.BlockedIPRanges) {
+		return false
+	}
+	return len(c.AllowedIPRanges) == 0 || ipInRanges(addr, c.AllowedIPRanges)
+}
+
+// ipInRanges reports whether addr falls within any of the CIDRs
+func ipInRanges(addr net.IP, cidrs []string) bool {
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandRequiresApproval reports whether a command must wait for an approved privilege request
+// before it is sent to the client
+func (c *RemoteAccessConfig) CommandRequiresApproval(command string) bool {
+	if !c.CommandExecutionEnabled || !c.RequireCommandApproval {
+		return false
+	}
+
+	// Every command in a chain, pipeline or substitution is checked, not just the first
+	for _, segment := range commandSegments(command) {
+		if len(c.HighRiskCommandPatterns) == 0 {
+			if isHighRiskCommand(segment) {
+				return true
+			}
+			continue
+		}
+		for _, pattern := range c.HighRiskCommandPatterns {
+			if pattern != "" && strings.HasPrefix(segment, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// commandWrappers run the command that follows them, so what they wrap is matched as well
+var commandWrappers = map[string]bool{
+	"env": true, "nohup": true, "nice": true, "time": true, "timeout": true, "command": true,
+	"exec": true, "xargs": true, "stdbuf": true, "busybox": true, "sudo": true, "doas": true,
+	"runas": true, "cmd": true, "cmd.exe": true, "powershell": true, "powershell.exe": true,
+	"pwsh": true, "start": true,
+}
+
+// commandSegments splits a shell command line into the commands it runs. A command behind a
+// wrapper is returned both with and without the wrapper, its options and variable assignments,
+// and each program name is stripped of its path.
+func commandSegments(command string) []string {
+	fields := strings.FieldsFunc(command, func(r rune) bool {
+		return strings.ContainsRune(";&|\n`$(){}", r)
+	})
+
+	var segments []string
+	for _, field := range fields {
+		words := strings.Fields(field)
+		for i := 0; i < len(words); {
+			if strings.Contains(words[i], "=") && !strings.HasPrefix(words[i], "-") {
+				i++
+				continue
+			}
+
+			words[i] = programName(words[i])
+			segments = append(segments, strings.Join(words[i:], " "))
+			if !commandWrappers[strings.ToLower(words[i])] {
+				break
+			}
+			for i++; i < len(words) && isWrapperArgument(words[i]); i++ {
+			}
+		}
+	}
+	return segments
+}
+
+// isWrapperArgument reports whether a word is an option or value given to a wrapper rather than
+// the wrapped command, e.g. the "-n 10" of nice or the "/c" of cmd
+func isWrapperArgument(word string) bool {
+	switch {
+	case strings.HasPrefix(word, "-"), strings.Contains(word, "="):
+		return true
+	case strings.HasPrefix(word, "/"):
+		return !strings.Contains(word[1:], "/")
+	}
+	return word[0] >= '0' && word[0] <= '9'
+}
+
+// programName strips the directory from a program path, so /bin/rm matches rm
+func programName(word string) string {
+	if i := strings.LastIndexAny(word, "/\\"); i >= 0 && i < len(word)-1 {
+		return word[i+1:]
+	}
+	return word
+}
+
 // IsCommandAllowed checks if a command is allowed for execution
 func (c *RemoteAccessConfig) IsCommandAllowed(command string) bool {
 	if !c.CommandExecutionEnabled {
@@ -392,6 +806,31 @@ func (c *RemoteAccessConfig) GetPrivilegeTimeout(privilegeType PrivilegeType, re
 	return requestedDuration
 }
 
+// UnattendedRule returns the rule for an unattended client, preferring a client ID match over a
+// match on its enrolled organizational unit and falling back to the default decision. ok is false
+// when the request should simply wait for an interactive approver.
+func (c *PrivilegeEscalationConfig) UnattendedRule(clientID string) (rule UnattendedApprovalRule, ok bool) {
+	organizationalUnit := c.EnrolledOrganizationalUnits[clientID]
+	for _, candidate := range c.UnattendedApprovers {
+		if candidate.ClientID != "" && candidate.ClientID == clientID {
+			return candidate, true
+		}
+	}
+	if organizationalUnit != "" {
+		for _, candidate := range c.UnattendedApprovers {
+			if candidate.ClientID == "" && strings.EqualFold(candidate.OrganizationalUnit, organizationalUnit) {
+				return candidate, true
+			}
+		}
+	}
+
+	switch c.UnattendedDefaultDecision {
+	case UnattendedDecisionApprove, UnattendedDecisionDeny:
+		return UnattendedApprovalRule{Decision: c.UnattendedDefaultDecision}, true
+	}
+	return UnattendedApprovalRule{}, false
+}
+
 // IsPrivilegeAllowed checks if a privilege type is allowed
 func (c *RemoteAccessConfig) IsPrivilegeAllowed(privilegeType PrivilegeType) bool {
 	if !c.PrivilegeEscalation.Enabled {
@@ -407,6 +846,35 @@ func (c *RemoteAccessConfig) IsPrivilegeAllowed(privilegeType PrivilegeType) boo
 	return false
 }
 
+// ScreenCaptureOptions resolves a client's requested capture quality and format: a missing quality
+// falls back to ScreenshotQuality, out-of-range values are clamped to the configured bounds (zero
+// bounds are unset, leaving 1-100) and a missing format defaults to jpeg. Unsupported formats are rejected.
+func (c *RemoteAccessConfig) ScreenCaptureOptions(quality int, format string) (int, string, error) {
+	ext, err := frameExtension(format)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if quality == 0 {
+		quality = c.ScreenshotQuality
+	}
+	minQuality, maxQuality := 1, 100
+	if c.MinScreenshotQuality > 0 {
+		minQuality = c.MinScreenshotQuality
+	}
+	if c.MaxScreenshotQuality > 0 {
+		maxQuality = c.MaxScreenshotQuality
+	}
+	if quality < minQuality {
+		quality = minQuality
+	}
+	if quality > maxQuality {
+		quality = maxQuality
+	}
+
+	return quality, strings.TrimPrefix(ext, "."), nil
+}
+
 // Clone creates a deep copy of the configuration
 func (c *RemoteAccessConfig) Clone() *RemoteAccessConfig {
 	clone := *c
@@ -415,20 +883,49 @@ func (c *RemoteAccessConfig) Clone() *RemoteAccessConfig {
 	clone.AllowedOrigins = make([]string, len(c.AllowedOrigins))
 	copy(clone.AllowedOrigins, c.AllowedOrigins)
 
+	clone.AllowedIPRanges = append([]string(nil), c.AllowedIPRanges...)
+	clone.BlockedIPRanges = append([]string(nil), c.BlockedIPRanges...)
+	clone.TrustedProxies = append([]string(nil), c.TrustedProxies...)
+
 	clone.AllowedFileTypes = make([]string, len(c.AllowedFileTypes))
 	copy(clone.AllowedFileTypes, c.AllowedFileTypes)
 
 	clone.BlockedFileTypes = make([]string, len(c.BlockedFileTypes))
 	copy(clone.BlockedFileTypes, c.BlockedFileTypes)
 
+	clone.AuditEventTypes = make([]string, len(c.AuditEventTypes))
+	copy(clone.AuditEventTypes, c.AuditEventTypes)
+	clone.AuditMaskedFields = append([]string(nil), c.AuditMaskedFields...)
+
 	clone.AllowedCommands = make([]string, len(c.AllowedCommands))
 	copy(clone.AllowedCommands, c.AllowedCommands)
 
 	clone.BlockedCommands = make([]string, len(c.BlockedCommands))
 	copy(clone.BlockedCommands, c.BlockedCommands)
 
+	if c.RoleMessagePolicy != nil {
+		clone.RoleMessagePolicy = make(map[string][]string, len(c.RoleMessagePolicy))
+		for role, messageTypes := range c.RoleMessagePolicy {
+			clone.RoleMessagePolicy[role] = append([]string(nil), messageTypes...)
+		}
+	}
+
+	clone.ClientPolicy.DeniedOperatingSystems = make([]string, len(c.ClientPolicy.DeniedOperatingSystems))
+	copy(clone.ClientPolicy.DeniedOperatingSystems, c.ClientPolicy.DeniedOperatingSystems)
+
+	clone.ClientPolicy.DeniedUserAgents = make([]string, len(c.ClientPolicy.DeniedUserAgents))
+	copy(clone.ClientPolicy.DeniedUserAgents, c.ClientPolicy.DeniedUserAgents)
+
 	clone.PrivilegeEscalation.AllowedPrivileges = make([]PrivilegeType, len(c.PrivilegeEscalation.AllowedPrivileges))
 	copy(clone.PrivilegeEscalation.AllowedPrivileges, c.PrivilegeEscalation.AllowedPrivileges)
 
+	clone.PrivilegeEscalation.UnattendedApprovers = make([]UnattendedApprovalRule, len(c.PrivilegeEscalation.UnattendedApprovers))
+	copy(clone.PrivilegeEscalation.UnattendedApprovers, c.PrivilegeEscalation.UnattendedApprovers)
+
+	clone.PrivilegeEscalation.EnrolledOrganizationalUnits = make(map[string]string, len(c.PrivilegeEscalation.EnrolledOrganizationalUnits))
+	for clientID, organizationalUnit := range c.PrivilegeEscalation.EnrolledOrganizationalUnits {
+		clone.PrivilegeEscalation.EnrolledOrganizationalUnits[clientID] = organizationalUnit
+	}
+
 	return &clone
 }
\ No newline at end of file
@@ -0,0 +1,300 @@
+package remoteaccess
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// latencySmoothing is the weight given to the newest RTT sample in the moving average
+const latencySmoothing = 0.2
+
+// ConnectionStats describes a live WebSocket connection and its measured round-trip latency
+type ConnectionStats struct {
+	ID          string        `json:"id"`
+	RemoteAddr  string        `json:"remote_addr"`
+	ClientIP    string        `json:"client_ip"`          // resolved through the trusted proxies, what lockouts are keyed on
+	Identity    string        `json:"identity,omitempty"` // authenticated subject; empty for anonymous connections
+	SessionID   string        `json:"session_id,omitempty"`
+	Role        string        `json:"role,omitempty"`
+	Encoding    string        `json:"encoding"`
+	ConnectedAt time.Time     `json:"connected_at"`
+	Latency     time.Duration `json:"latency"`
+	LastRTT     time.Duration `json:"last_rtt"`
+	LastPongAt  *time.Time    `json:"last_pong_at,omitempty"`
+	PongCount   int64         `json:"pong_count"`
+	HighLatency bool          `json:"high_latency"`
+
+	// Traffic, counted as messages are read and written
+	BytesRead       int64            `json:"bytes_read"`
+	BytesWritten    int64            `json:"bytes_written"`
+	MessagesRead    int64            `json:"messages_read"`
+	MessagesWritten int64            `json:"messages_written"`
+	MessageTypes    map[string]int64 `json:"message_types,omitempty"` // messages read, by type
+	Errors          int64            `json:"errors"`                  // failed reads and writes, and messages that failed handling
+}
+
+// snapshot copies the stats, so the copy can be read while the connection keeps counting
+func (s *ConnectionStats) snapshot() ConnectionStats {
+	copied := *s
+	if s.MessageTypes != nil {
+		copied.MessageTypes = make(map[string]int64, len(s.MessageTypes))
+		for messageType, count := range s.MessageTypes {
+			copied.MessageTypes[messageType] = count
+		}
+	}
+	return copied
+}
+
+// ConnectionTracker keeps per-connection stats for every open WebSocket
+type ConnectionTracker struct {
+	connections map[*websocket.Conn]*ConnectionStats
+	writers     map[*websocket.Conn]*sync.Mutex // gorilla allows one concurrent writer per connection
+	metrics     TrafficMetrics                  // sums the traffic of every connection when set
+	mutex       sync.RWMutex
+}
+
+// NewConnectionTracker creates an empty connection tracker
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{
+		connections: make(map[*websocket.Conn]*ConnectionStats),
+		writers:     make(map[*websocket.Conn]*sync.Mutex),
+	}
+}
+
+// Track starts tracking a connection opened by clientIP, authenticated as identity if not empty
+func (ct *ConnectionTracker) Track(conn *websocket.Conn, clientIP, identity string) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	ct.connections[conn] = &ConnectionStats{
+		ID:          uuid.New().String(),
+		RemoteAddr:  conn.RemoteAddr().String(),
+		ClientIP:    clientIP,
+		Identity:    identity,
+		Encoding:    EncodingJSON,
+		ConnectedAt: time.Now().UTC(),
+	}
+	ct.writers[conn] = &sync.Mutex{}
+}
+
+// Untrack stops tracking a connection
+func (ct *ConnectionTracker) Untrack(conn *websocket.Conn) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	delete(ct.connections, conn)
+	delete(ct.writers, conn)
+}
+
+// LockWrites serialises writes to a tracked connection, returning the function that releases it.
+// Untracked connections aren't locked.
+func (ct *ConnectionTracker) LockWrites(conn *websocket.Conn) func() {
+	ct.mutex.RLock()
+	writer, exists := ct.writers[conn]
+	ct.mutex.RUnlock()
+
+	if !exists {
+		return func() {}
+	}
+	writer.Lock()
+	return writer.Unlock
+}
+
+// Conns returns every tracked connection
+func (ct *ConnectionTracker) Conns() []*websocket.Conn {
+	ct.mutex.RLock()
+	defer ct.mutex.RUnlock()
+
+	conns := make([]*websocket.Conn, 0, len(ct.connections))
+	for conn := range ct.connections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Count returns how many connections are tracked
+func (ct *ConnectionTracker) Count() int {
+	ct.mutex.RLock()
+	defer ct.mutex.RUnlock()
+	return len(ct.connections)
+}
+
+// Associate links a tracked connection to a session and role
+func (ct *ConnectionTracker) Associate(conn *websocket.Conn, sessionID, role string) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	if stats, exists := ct.connections[conn]; exists {
+		stats.SessionID = sessionID
+		stats.Role = role
+	}
+}
+
+// Codec returns the codec a connection negotiated; untracked connections use JSON
+func (ct *ConnectionTracker) Codec(conn *websocket.Conn) MessageCodec {
+	ct.mutex.RLock()
+	defer ct.mutex.RUnlock()
+
+	if stats, exists := ct.connections[conn]; exists && stats.Encoding == EncodingMsgPack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+// SetEncoding switches the encoding used for a tracked connection's messages
+func (ct *ConnectionTracker) SetEncoding(conn *websocket.Conn, encoding string) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	if stats, exists := ct.connections[conn]; exists {
+		stats.Encoding = encoding
+	}
+}
+
+// Lookup returns a snapshot of a tracked connection's stats
+func (ct *ConnectionTracker) Lookup(conn *websocket.Conn) (ConnectionStats, bool) {
+	ct.mutex.RLock()
+	defer ct.mutex.RUnlock()
+
+	stats, exists := ct.connections[conn]
+	if !exists {
+		return ConnectionStats{}, false
+	}
+	return stats.snapshot(), true
+}
+
+// RecordRTT folds a round-trip sample into the connection's smoothed latency and returns the updated stats
+func (ct *ConnectionTracker) RecordRTT(conn *websocket.Conn, rtt time.Duration, highLatencyThreshold time.Duration) (ConnectionStats, bool) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	stats, exists := ct.connections[conn]
+	if !exists {
+		return ConnectionStats{}, false
+	}
+
+	if stats.PongCount == 0 {
+		stats.Latency = rtt
+	} else {
+		stats.Latency = time.Duration(latencySmoothing*float64(rtt) + (1-latencySmoothing)*float64(stats.Latency))
+	}
+	now := time.Now().UTC()
+	stats.LastRTT = rtt
+	stats.LastPongAt = &now
+	stats.PongCount++
+	stats.HighLatency = highLatencyThreshold > 0 && stats.Latency > highLatencyThreshold
+
+	return stats.snapshot(), true
+}
+
+// List returns a snapshot of all tracked connections
+func (ct *ConnectionTracker) List() []ConnectionStats {
+	ct.mutex.RLock()
+	defer ct.mutex.RUnlock()
+
+	list := make([]ConnectionStats, 0, len(ct.connections))
+	for _, stats := range ct.connections {
+		list = append(list, stats.snapshot())
+	}
+	return list
+}
+
+// SetMetrics sets what the traffic of every connection is also reported to
+func (ct *ConnectionTracker) SetMetrics(metrics TrafficMetrics) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	ct.metrics = metrics
+}
+
+// ReadMessage reads the next message from a connection, counting it against the connection.
+// Closes the peer asked for aren't counted as errors.
+func (ct *ConnectionTracker) ReadMessage(conn *websocket.Conn) (int, []byte, error) {
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			ct.RecordError(conn)
+		}
+		return frameType, data, err
+	}
+
+	if metrics := ct.update(conn, func(stats *ConnectionStats) {
+		stats.BytesRead += int64(len(data))
+		stats.MessagesRead++
+	}); metrics != nil {
+		metrics.BytesRead(len(data))
+	}
+	return frameType, data, nil
+}
+
+// WriteMessage writes a message to a connection, counting it, or the failure, against the connection
+func (ct *ConnectionTracker) WriteMessage(conn *websocket.Conn, frameType int, data []byte) error {
+	if err := conn.WriteMessage(frameType, data); err != nil {
+		ct.RecordError(conn)
+		return err
+	}
+
+	if metrics := ct.update(conn, func(stats *ConnectionStats) {
+		stats.BytesWritten += int64(len(data))
+		stats.MessagesWritten++
+	}); metrics != nil {
+		metrics.BytesWritten(len(data))
+	}
+	return nil
+}
+
+// RecordMessageType counts a message read from a connection under its type. Types the dispatcher
+// doesn't know are counted together, so clients can't grow the set without bound.
+func (ct *ConnectionTracker) RecordMessageType(conn *websocket.Conn, messageType string) {
+	if !knownMessageTypes[messageType] {
+		messageType = "unknown"
+	}
+
+	if metrics := ct.update(conn, func(stats *ConnectionStats) {
+		if stats.MessageTypes == nil {
+			stats.MessageTypes = make(map[string]int64)
+		}
+		stats.MessageTypes[messageType]++
+	}); metrics != nil {
+		metrics.MessageReceived(messageType)
+	}
+}
+
+// RecordError counts an error on a connection
+func (ct *ConnectionTracker) RecordError(conn *websocket.Conn) {
+	if metrics := ct.update(conn, func(stats *ConnectionStats) {
+		stats.Errors++
+	}); metrics != nil {
+		metrics.ConnectionError()
+	}
+}
+
+// update applies a change to a tracked connection's stats, returning what the traffic is also
+// reported to. Untracked connections are neither changed nor reported.
+func (ct *ConnectionTracker) update(conn *websocket.Conn, change func(stats *ConnectionStats)) TrafficMetrics {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	stats, exists := ct.connections[conn]
+	if !exists {
+		return nil
+	}
+	change(stats)
+	return ct.metrics
+}
+
+// encodePingPayload timestamps an outgoing ping so the pong can be timed
+func encodePingPayload(sent time.Time) []byte {
+	return []byte(strconv.FormatInt(sent.UnixNano(), 10))
+}
+
+// decodePingPayload recovers the send time from a pong payload
+func decodePingPayload(payload string) (time.Time, bool) {
+	nanos, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
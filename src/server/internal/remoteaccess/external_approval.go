@@ -0,0 +1,88 @@
+package remoteaccess
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/approval"
+)
+
+// externalApprovalActor is recorded as the approver of requests decided by the external service
+const externalApprovalActor = "external"
+
+// SetExternalApprover routes privilege requests that need approval to an external approval service
+func (sm *SessionManager) SetExternalApprover(approver *approval.ExternalApprover) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.approver = approver
+}
+
+// requestExternalPrivilegeApproval sends a privilege request to the external approval service,
+// falling back to the in-app routing if it can't be sent
+func (sm *SessionManager) requestExternalPrivilegeApproval(approver *approval.ExternalApprover, session *RemoteAccessSession, requestID string, privilegeType PrivilegeType, justification string, duration time.Duration) {
+	err := approver.RequestApproval(approval.Request{
+		ID:        requestID,
+		Kind:      approval.KindPrivilege,
+		SessionID: session.ID,
+		Requester: session.TechnicianID,
+		Summary:   fmt.Sprintf("%s privileges for %s", privilegeType, duration),
+		Details: map[string]interface{}{
+			"client_id":      session.ClientID,
+			"privilege_type": privilegeType,
+			"justification":  justification,
+			"duration":       duration.String(),
+		},
+	}, sm.applyExternalPrivilegeDecision)
+	if err == nil {
+		return
+	}
+
+	log.Printf("Failed to route privilege request %s to external approval: %v", requestID, err)
+	if session.PortalConn != nil {
+		sm.notifyPortalPrivilegeRequest(session, requestID, privilegeType, justification, duration)
+	} else {
+		sm.applyUnattendedPolicy(session, requestID, privilegeType, justification, duration)
+	}
+}
+
+// applyExternalPrivilegeDecision audits the external service's decision and applies it to the request
+func (sm *SessionManager) applyExternalPrivilegeDecision(request approval.Request, decision approval.Decision) {
+	approved := decision.Approved
+	privilegeType, _ := request.Details["privilege_type"].(PrivilegeType)
+
+	// The external service can never grant a privilege that is disallowed outright
+	if approved && !sm.GetConfig().IsPrivilegeAllowed(privilegeType) {
+		approved = false
+		decision.Reason = fmt.Sprintf("privilege type %s is not allowed", privilegeType)
+	}
+
+	actor := externalApprovalActor
+	if decision.Approver != "" {
+		actor = externalApprovalActor + ":" + decision.Approver
+	}
+
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:  "privilege_external_decision",
+		SessionID:  request.SessionID,
+		Technician: request.Requester,
+		Details:    map[string]interface{}{"request_id": request.ID, "privilege_type": privilegeType, "approved": approved, "approver": decision.Approver, "reason": decision.Reason, "timed_out": decision.TimedOut},
+		Severity:   "warning",
+		Success:    approved,
+		Timestamp:  time.Now().UTC(),
+	})
+
+	var err error
+	if approved {
+		err = sm.ApprovePrivilege(request.SessionID, request.ID, actor)
+	} else {
+		reason := decision.Reason
+		if reason == "" {
+			reason = "Denied by external approval service"
+		}
+		err = sm.DenyPrivilege(request.SessionID, request.ID, actor, reason)
+	}
+	if err != nil {
+		log.Printf("Failed to apply external decision for privilege request %s: %v", request.ID, err)
+	}
+}
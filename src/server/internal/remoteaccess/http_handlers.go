@@ -2,53 +2,80 @@ package remoteaccess
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+
+	"github.com/onlitec/onlidesk-server/internal/auth"
 )
 
+// DefaultMaxRequestBodySize bounds REST request bodies when no limit is configured
+const DefaultMaxRequestBodySize = 1 << 20 // 1 MiB
+
 // HTTPHandlers provides HTTP endpoints for remote access management
 type HTTPHandlers struct {
 	sessionManager *SessionManager
+	authenticator  auth.Authenticator
+	requestLimiter *requestLimiter
 }
 
 // NewHTTPHandlers creates a new HTTP handlers instance
 func NewHTTPHandlers(sessionManager *SessionManager) *HTTPHandlers {
 	return &HTTPHandlers{
 		sessionManager: sessionManager,
+		requestLimiter: newRequestLimiter(),
 	}
 }
 
+// SetAuthenticator makes AuthMiddleware require a bearer token the authenticator accepts.
+// Without one, AuthMiddleware lets every request through.
+func (h *HTTPHandlers) SetAuthenticator(authenticator auth.Authenticator) {
+	h.authenticator = authenticator
+}
+
 // RegisterRoutes registers HTTP routes for remote access
 func (h *HTTPHandlers) RegisterRoutes(router *mux.Router) {
 	// Session management
 	router.HandleFunc("/api/remoteaccess/sessions", h.handleGetSessions).Methods("GET")
 	router.HandleFunc("/api/remoteaccess/sessions", h.handleCreateSession).Methods("POST")
+	router.HandleFunc("/api/remoteaccess/sessions/by-code/{code}", h.handleGetSessionByCode).Methods("GET")
 	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}", h.handleGetSession).Methods("GET")
-	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}", h.handleTerminateSession).Methods("DELETE")
+	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}", h.RequireScope(auth.ScopeSessionsTerminate, h.handleTerminateSession)).Methods("DELETE")
 	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/extend", h.handleExtendSession).Methods("POST")
+	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/tags", h.handleSetSessionTags).Methods("PUT")
+	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/recording", h.handleGetSessionRecording).Methods("GET")
+	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/recording.mp4", h.handleGetRecording).Methods("GET")
+	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/recording/input-events", h.handleGetInputEvents).Methods("GET")
+	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/commands", h.handleGetCommandHistory).Methods("GET")
 
 	// Privilege management
 	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/privileges", h.handleRequestPrivilege).Methods("POST")
-	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/privileges/{privilegeId}", h.handleApprovePrivilege).Methods("PUT")
+	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/privileges/{privilegeId}", h.RequireScope(auth.ScopePrivilegesApprove, h.handleApprovePrivilege)).Methods("PUT")
 	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/privileges/{privilegeId}", h.handleRevokePrivilege).Methods("DELETE")
+	router.HandleFunc("/api/remoteaccess/approvals/pending", h.handleGetApprovalQueues).Methods("GET")
 
 	// Statistics and monitoring
 	router.HandleFunc("/api/remoteaccess/stats", h.handleGetStatistics).Methods("GET")
+	router.HandleFunc("/api/remoteaccess/connections", h.handleGetConnections).Methods("GET")
 	router.HandleFunc("/api/remoteaccess/sessions/{sessionId}/stats", h.handleGetSessionStatistics).Methods("GET")
 
 	// Configuration
 	router.HandleFunc("/api/remoteaccess/config", h.handleGetConfig).Methods("GET")
-	router.HandleFunc("/api/remoteaccess/config", h.handleUpdateConfig).Methods("PUT")
+	router.HandleFunc("/api/remoteaccess/config", h.RequireScope(auth.ScopeConfigWrite, h.handleUpdateConfig)).Methods("PUT")
 
 	// Health check
 	router.HandleFunc("/api/remoteaccess/health", h.handleHealthCheck).Methods("GET")
 
 	// Audit logs
 	router.HandleFunc("/api/remoteaccess/audit", h.handleGetAuditLogs).Methods("GET")
+	router.HandleFunc("/api/remoteaccess/audit/summary", h.handleGetAuditSummary).Methods("GET")
 }
 
 // Session management handlers
@@ -61,6 +88,13 @@ func (h *HTTPHandlers) handleGetSessions(w http.ResponseWriter, r *http.Request)
 	limitStr := query.Get("limit")
 	offsetStr := query.Get("offset")
 
+	// Tag filters are repeated key:value pairs; a bare key matches any value
+	tagFilter := make(map[string]string)
+	for _, tag := range query["tag"] {
+		key, value, _ := strings.Cut(tag, ":")
+		tagFilter[key] = value
+	}
+
 	limit := 50 // default
 	if limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
@@ -91,6 +125,11 @@ func (h *HTTPHandlers) handleGetSessions(w http.ResponseWriter, r *http.Request)
 			continue
 		}
 
+		// Tag filter
+		if len(tagFilter) > 0 && !session.MatchesTags(tagFilter) {
+			continue
+		}
+
 		filteredSessions = append(filteredSessions, session)
 	}
 
@@ -131,6 +170,14 @@ func (h *HTTPHandlers) handleCreateSession(w http.ResponseWriter, r *http.Reques
 		} `json:"client_info"`
 	}
 
+	// Clients that keep failing are locked out for a while
+	callerIP := h.sessionManager.ClientIP(r)
+	if locked, until := h.sessionManager.IsLockedOut(callerIP); locked {
+		h.sessionManager.logLockedOutAttempt(callerIP, "session_create", until)
+		h.writeLockedOut(w, until)
+		return
+	}
+
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", err)
 		return
@@ -142,35 +189,64 @@ func (h *HTTPHandlers) handleCreateSession(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// An authenticated caller creates sessions as themselves; the body can't name someone else
+	if identity, ok := auth.IdentityFromContext(r.Context()); ok && identity.Subject != "" {
+		if req.TechnicianID != "" && req.TechnicianID != identity.Subject {
+			h.sessionManager.RecordFailedAttempt(callerIP, "session_create")
+			h.writeErrorResponse(w, http.StatusForbidden, "technician_id does not match the authenticated caller", nil)
+			return
+		}
+		req.TechnicianID = identity.Subject
+	}
+
 	if req.TechnicianID == "" {
 		h.writeErrorResponse(w, http.StatusBadRequest, "technician_id is required", nil)
 		return
 	}
 
-	// Create session
-	session, err := h.sessionManager.CreateSession(req.ClientID, req.TechnicianID, nil)
-	if err != nil {
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to create session", err)
-		return
+	// Build client info from the request body, falling back to what the HTTP request tells us
+	clientInfo := &ClientInfo{
+		Hostname:        req.ClientInfo.Hostname,
+		OperatingSystem: req.ClientInfo.OS,
+		IPAddress:       req.ClientInfo.IPAddress,
+		UserAgent:       req.ClientInfo.UserAgent,
+		SystemInfo:      make(map[string]string),
 	}
-
-	// Update client info if provided
-	if req.ClientInfo.Hostname != "" {
-		session.ClientInfo.Hostname = req.ClientInfo.Hostname
+	if clientInfo.IPAddress == "" {
+		clientInfo.IPAddress = callerIP
 	}
-	if req.ClientInfo.OS != "" {
-		session.ClientInfo.OperatingSystem = req.ClientInfo.OS
+	if clientInfo.UserAgent == "" {
+		clientInfo.UserAgent = r.UserAgent()
 	}
 	if req.ClientInfo.Version != "" {
-		// Version field mapping - using UserAgent as closest match
-		session.ClientInfo.UserAgent = req.ClientInfo.Version
-	}
-	if req.ClientInfo.IPAddress != "" {
-		session.ClientInfo.IPAddress = req.ClientInfo.IPAddress
+		clientInfo.SystemInfo["version"] = req.ClientInfo.Version
 	}
-	if req.ClientInfo.UserAgent != "" {
-		session.ClientInfo.UserAgent = req.ClientInfo.UserAgent
+
+	// Create session
+	session, err := h.sessionManager.CreateSession(req.ClientID, req.TechnicianID, clientInfo)
+	if err != nil {
+		if errors.Is(err, ErrInvalidClientInfo) {
+			h.sessionManager.RecordFailedAttempt(callerIP, "session_create")
+			h.writeErrorResponse(w, http.StatusBadRequest, "Invalid client info", err)
+			return
+		}
+		if errors.Is(err, ErrClientNotSupported) {
+			h.sessionManager.RecordFailedAttempt(callerIP, "session_create")
+			h.writeErrorResponse(w, http.StatusForbidden, "Client not supported", err)
+			return
+		}
+		if errors.Is(err, ErrAtCapacity) {
+			writeRetryRejection(w, h.sessionManager.RetryHint(RetryReasonAtCapacity))
+			return
+		}
+		if h.sessionManager.IsDraining() {
+			writeRetryRejection(w, h.sessionManager.RetryHint(RetryReasonDraining))
+			return
+		}
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to create session", err)
+		return
 	}
+	h.sessionManager.ClearFailedAttempts(callerIP)
 
 	h.writeJSONResponse(w, http.StatusCreated, session)
 }
@@ -188,6 +264,29 @@ func (h *HTTPHandlers) handleGetSession(w http.ResponseWriter, r *http.Request)
 	h.writeJSONResponse(w, http.StatusOK, session)
 }
 
+func (h *HTTPHandlers) handleGetSessionByCode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	// Guessing codes counts towards a lockout
+	callerIP := h.sessionManager.ClientIP(r)
+	if locked, until := h.sessionManager.IsLockedOut(callerIP); locked {
+		h.sessionManager.logLockedOutAttempt(callerIP, "session_join", until)
+		h.writeLockedOut(w, until)
+		return
+	}
+
+	session, exists := h.sessionManager.GetSessionByCode(code)
+	if !exists {
+		h.sessionManager.RecordFailedAttempt(callerIP, "session_join")
+		h.writeErrorResponse(w, http.StatusNotFound, "No live session has this code", nil)
+		return
+	}
+	h.sessionManager.ClearFailedAttempts(callerIP)
+
+	h.writeJSONResponse(w, http.StatusOK, session)
+}
+
 func (h *HTTPHandlers) handleTerminateSession(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["sessionId"]
@@ -214,23 +313,183 @@ func (h *HTTPHandlers) handleExtendSession(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	_, err := time.ParseDuration(req.Duration)
+	duration, err := time.ParseDuration(req.Duration)
 	if err != nil {
 		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid duration format", err)
 		return
 	}
+	if duration <= 0 {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Duration must be positive", nil)
+		return
+	}
 
-	session, exists := h.sessionManager.GetSession(sessionID)
-	if !exists {
+	if _, exists := h.sessionManager.GetSession(sessionID); !exists {
 		h.writeErrorResponse(w, http.StatusNotFound, "Session not found", nil)
 		return
 	}
 
-	// Session extension logic would be implemented here
+	expiresAt, err := h.sessionManager.ExtendSession(sessionID, duration)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrSessionDurationExceeded):
+			h.writeErrorResponse(w, http.StatusBadRequest, "Extension exceeds the maximum session duration", err)
+		case errors.Is(err, ErrSessionEnded):
+			h.writeErrorResponse(w, http.StatusConflict, "Session has ended", err)
+		default:
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to extend session", err)
+		}
+		return
+	}
 
 	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
 		"message":    "Session extended successfully",
-		"expires_at": session.StartTime.Add(time.Hour * 24),
+		"expires_at": expiresAt,
+	})
+}
+
+// handleSetSessionTags replaces the session's tags
+func (h *HTTPHandlers) handleSetSessionTags(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["sessionId"]
+
+	var req struct {
+		Tags      map[string]string `json:"tags"`
+		UpdatedBy string            `json:"updated_by"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+
+	if _, exists := h.sessionManager.GetSession(sessionID); !exists {
+		h.writeErrorResponse(w, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+
+	if err := h.sessionManager.SetSessionTags(sessionID, req.Tags, req.UpdatedBy); err != nil {
+		if errors.Is(err, ErrInvalidTags) {
+			h.writeErrorResponse(w, http.StatusBadRequest, "Invalid tags", err)
+			return
+		}
+		h.writeErrorResponse(w, http.StatusNotFound, "Session not found", err)
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"session_id": sessionID,
+		"tags":       req.Tags,
+	})
+}
+
+func (h *HTTPHandlers) handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["sessionId"]
+
+	if _, exists := h.sessionManager.GetSession(sessionID); !exists {
+		h.writeErrorResponse(w, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+
+	path, encoder, err := h.sessionManager.ExportRecording(r.Context(), sessionID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNoRecording):
+			h.writeErrorResponse(w, http.StatusNotFound, "No recording for session", err)
+		case errors.Is(err, ErrRecordingTooLarge):
+			h.writeErrorResponse(w, http.StatusRequestEntityTooLarge, "Recording too large to export", err)
+		default:
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to export recording", err)
+		}
+		return
+	}
+	defer os.Remove(path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to open recording", err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to stat recording", err)
+		return
+	}
+
+	// Without a video encoder the frames are served as an archive instead
+	filename := "recording_" + sessionID + encoder.Extension()
+	w.Header().Set("Content-Type", encoder.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("X-Recording-Encoder", encoder.Name())
+	http.ServeContent(w, r, filename, info.ModTime(), file)
+}
+
+// handleGetSessionRecording streams the session's recorded messages as JSON lines for replay.
+// Recordings outlive the session history, so the file is looked up directly.
+func (h *HTTPHandlers) handleGetSessionRecording(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["sessionId"]
+
+	recording, err := h.sessionManager.GetRecording(sessionID)
+	if err != nil {
+		if errors.Is(err, ErrNoSessionRecording) {
+			h.writeErrorResponse(w, http.StatusNotFound, "No recording for session", err)
+		} else {
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to open recording", err)
+		}
+		return
+	}
+	defer recording.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "recording_"+sessionID+".jsonl"))
+	io.Copy(w, recording)
+}
+
+// handleGetInputEvents returns the recorded input events for replay alongside a video export,
+// which cannot carry them itself
+func (h *HTTPHandlers) handleGetInputEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["sessionId"]
+
+	if _, exists := h.sessionManager.GetSession(sessionID); !exists {
+		h.writeErrorResponse(w, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+
+	events, err := h.sessionManager.GetInputEvents(sessionID)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to read input events", err)
+		return
+	}
+	if events == nil {
+		events = []InputEventRecord{}
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"session_id": sessionID,
+		"events":     events,
+		"total":      len(events),
+	})
+}
+
+func (h *HTTPHandlers) handleGetCommandHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["sessionId"]
+
+	session, exists := h.sessionManager.GetSession(sessionID)
+	if !exists {
+		h.writeErrorResponse(w, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+
+	commands := session.GetCommandHistory()
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"session_id": sessionID,
+		"commands":   commands,
+		"total":      len(commands),
 	})
 }
 
@@ -251,8 +510,7 @@ func (h *HTTPHandlers) handleRequestPrivilege(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	session, exists := h.sessionManager.GetSession(sessionID)
-	if !exists {
+	if _, exists := h.sessionManager.GetSession(sessionID); !exists {
 		h.writeErrorResponse(w, http.StatusNotFound, "Session not found", nil)
 		return
 	}
@@ -269,7 +527,21 @@ func (h *HTTPHandlers) handleRequestPrivilege(w http.ResponseWriter, r *http.Req
 	}
 
 	// Request privilege
-	privilegeID := session.RequestPrivilege(req.PrivilegeType, req.Justification, duration)
+	privilegeID, err := h.sessionManager.RequestPrivilege(sessionID, req.PrivilegeType, req.Justification, duration)
+	if err != nil {
+		if errors.Is(err, ErrPrivilegeRateLimited) {
+			w.Header().Set("Retry-After", "60")
+			h.writeErrorResponse(w, http.StatusTooManyRequests, "Too many privilege requests", err)
+			return
+		}
+		if errors.Is(err, ErrPrivilegeBacklogFull) {
+			w.Header().Set("Retry-After", "30")
+			h.writeErrorResponse(w, http.StatusServiceUnavailable, "Too many privilege requests awaiting decision", err)
+			return
+		}
+		h.writeErrorResponse(w, http.StatusBadRequest, "Failed to request privilege", err)
+		return
+	}
 
 	h.writeJSONResponse(w, http.StatusCreated, map[string]interface{}{
 		"privilege_id": privilegeID,
@@ -283,8 +555,7 @@ func (h *HTTPHandlers) handleApprovePrivilege(w http.ResponseWriter, r *http.Req
 	privilegeID := vars["privilegeId"]
 
 	var req struct {
-		ApprovedBy string `json:"approved_by"`
-		Comments   string `json:"comments,omitempty"`
+		Comments string `json:"comments,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -292,13 +563,23 @@ func (h *HTTPHandlers) handleApprovePrivilege(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	session, exists := h.sessionManager.GetSession(sessionID)
-	if !exists {
+	// The approval is recorded against the authenticated caller, never a name in the body
+	identity, ok := auth.IdentityFromContext(r.Context())
+	if !ok || identity.Subject == "" {
+		h.writeErrorResponse(w, http.StatusForbidden, "An authenticated approver is required", nil)
+		return
+	}
+
+	if _, exists := h.sessionManager.GetSession(sessionID); !exists {
 		h.writeErrorResponse(w, http.StatusNotFound, "Session not found", nil)
 		return
 	}
 
-	if err := session.ApprovePrivilege(privilegeID, req.ApprovedBy); err != nil {
+	if err := h.sessionManager.ApprovePrivilege(sessionID, privilegeID, identity.Subject); err != nil {
+		if errors.Is(err, ErrCommandSelfApproval) {
+			h.writeErrorResponse(w, http.StatusForbidden, "Privilege request cannot be approved by its requester", err)
+			return
+		}
 		h.writeErrorResponse(w, http.StatusNotFound, "Privilege request not found", nil)
 		return
 	}
@@ -335,6 +616,11 @@ func (h *HTTPHandlers) handleRevokePrivilege(w http.ResponseWriter, r *http.Requ
 	h.writeJSONResponse(w, http.StatusOK, map[string]string{"message": "Privilege revoked successfully"})
 }
 
+// handleGetApprovalQueues reports how many routed privilege requests await each approver
+func (h *HTTPHandlers) handleGetApprovalQueues(w http.ResponseWriter, r *http.Request) {
+	h.writeJSONResponse(w, http.StatusOK, h.sessionManager.GetApprovalQueueStats())
+}
+
 // Statistics and monitoring handlers
 
 func (h *HTTPHandlers) handleGetStatistics(w http.ResponseWriter, r *http.Request) {
@@ -363,12 +649,32 @@ func (h *HTTPHandlers) handleGetSessionStatistics(w http.ResponseWriter, r *http
 		"files_transferred": session.Statistics.FilesTransferred,
 		"screenshots_taken": session.Statistics.ScreenshotsTaken,
 		"privileges_active":  len(session.ActivePrivileges),
+		"client_latency_ms":  session.Statistics.ClientLatency.Milliseconds(),
+		"portal_latency_ms":  session.Statistics.PortalLatency.Milliseconds(),
+		"high_latency":       session.Statistics.HighLatency,
 	}
 	session.mutex.RUnlock()
 
 	h.writeJSONResponse(w, http.StatusOK, stats)
 }
 
+func (h *HTTPHandlers) handleGetConnections(w http.ResponseWriter, r *http.Request) {
+	connections := h.sessionManager.GetConnections()
+
+	highLatency := 0
+	for _, connection := range connections {
+		if connection.HighLatency {
+			highLatency++
+		}
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"connections":  connections,
+		"total":        len(connections),
+		"high_latency": highLatency,
+	})
+}
+
 // Configuration handlers
 
 func (h *HTTPHandlers) handleGetConfig(w http.ResponseWriter, r *http.Request) {
@@ -390,7 +696,10 @@ func (h *HTTPHandlers) handleUpdateConfig(w http.ResponseWriter, r *http.Request
 	}
 
 	// Update configuration
-	h.sessionManager.UpdateConfig(&newConfig)
+	if err := h.sessionManager.UpdateConfigBy(&newConfig, auth.Actor(r.Context()), h.sessionManager.ClientIP(r)); err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to update configuration", err)
+		return
+	}
 
 	h.writeJSONResponse(w, http.StatusOK, map[string]string{"message": "Configuration updated successfully"})
 }
@@ -399,15 +708,18 @@ func (h *HTTPHandlers) handleUpdateConfig(w http.ResponseWriter, r *http.Request
 
 func (h *HTTPHandlers) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	stats := h.sessionManager.GetStatistics()
+	capacity := h.sessionManager.Capacity()
 
 	health := map[string]interface{}{
 		"status":           "healthy",
-		"timestamp":        time.Now(),
+		"timestamp":        time.Now().UTC(),
 		"active_sessions":  stats["active_sessions"],
 		"total_sessions":   stats["total_sessions"],
 		"uptime":           stats["uptime"],
 		"memory_usage":     stats["memory_usage"],
 		"websocket_connections": stats["websocket_connections"],
+		"max_sessions":     capacity.MaxSessions,
+		"at_capacity":      capacity.AtCapacity,
 	}
 
 	h.writeJSONResponse(w, http.StatusOK, health)
@@ -463,6 +775,51 @@ func (h *HTTPHandlers) handleGetAuditLogs(w http.ResponseWriter, r *http.Request
 	h.writeJSONResponse(w, http.StatusOK, response)
 }
 
+// handleGetAuditSummary returns event counts by type and severity for a time range,
+// defaulting to the last 24 hours
+func (h *HTTPHandlers) handleGetAuditSummary(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	end := time.Now()
+	if endStr := query.Get("end"); endStr != "" {
+		parsed, err := time.Parse(time.RFC3339, endStr)
+		if err != nil {
+			h.writeErrorResponse(w, http.StatusBadRequest, "Invalid end time, expected RFC 3339", err)
+			return
+		}
+		end = parsed
+	}
+
+	start := end.Add(-24 * time.Hour)
+	if startStr := query.Get("start"); startStr != "" {
+		parsed, err := time.Parse(time.RFC3339, startStr)
+		if err != nil {
+			h.writeErrorResponse(w, http.StatusBadRequest, "Invalid start time, expected RFC 3339", err)
+			return
+		}
+		start = parsed
+	}
+
+	if start.After(end) {
+		h.writeErrorResponse(w, http.StatusBadRequest, "start must not be after end", nil)
+		return
+	}
+
+	auditLogger := h.sessionManager.auditLogger
+	if auditLogger == nil {
+		h.writeErrorResponse(w, http.StatusServiceUnavailable, "Audit logging not enabled", nil)
+		return
+	}
+
+	summary, err := auditLogger.GetAuditSummary(start, end)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to summarize audit logs", err)
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, summary)
+}
+
 // Helper methods
 
 func (h *HTTPHandlers) writeJSONResponse(w http.ResponseWriter, statusCode int, data interface{}) {
@@ -475,10 +832,16 @@ func (h *HTTPHandlers) writeJSONResponse(w http.ResponseWriter, statusCode int,
 }
 
 func (h *HTTPHandlers) writeErrorResponse(w http.ResponseWriter, statusCode int, message string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		statusCode = http.StatusRequestEntityTooLarge
+		message = "Request body too large"
+	}
+
 	errorResponse := map[string]interface{}{
 		"error":   message,
 		"status":  statusCode,
-		"timestamp": time.Now(),
+		"timestamp": time.Now().UTC(),
 	}
 
 	if err != nil {
@@ -488,6 +851,18 @@ func (h *HTTPHandlers) writeErrorResponse(w http.ResponseWriter, statusCode int,
 	h.writeJSONResponse(w, statusCode, errorResponse)
 }
 
+// writeLockedOut refuses a locked out client with 423, telling it when the lockout ends
+func (h *HTTPHandlers) writeLockedOut(w http.ResponseWriter, until time.Time) {
+	seconds := int(time.Until(until).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	h.writeJSONResponse(w, http.StatusLocked, map[string]interface{}{
+		"error":        "Too many failed attempts",
+		"status":       http.StatusLocked,
+		"locked_until": until.UTC(),
+		"timestamp":    time.Now().UTC(),
+	})
+}
+
 // CORS middleware
 func (h *HTTPHandlers) CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -504,20 +879,145 @@ func (h *HTTPHandlers) CORSMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// Authentication middleware (placeholder)
+// MaxBodySizeMiddleware limits request bodies to limit bytes, or DefaultMaxRequestBodySize when limit is 0.
+// Bodies declared larger are rejected with 413 up front; others fail with 413 once the limit is read past.
+func MaxBodySizeMiddleware(limit int64) mux.MiddlewareFunc {
+	if limit <= 0 {
+		limit = DefaultMaxRequestBodySize
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AuthMiddleware authenticates the request's bearer token with the configured authenticator,
+// making the caller's identity available through auth.IdentityFromContext. Paths listed in the
+// config's unauthenticated_paths are served without a token.
 func (h *HTTPHandlers) AuthMiddleware(next http.Handler) http.Handler {
+	return h.authMiddleware(next, true)
+}
+
+// IdentifyMiddleware authenticates a bearer token like AuthMiddleware when the request carries
+// one, but lets requests without a token through anonymously. The remote access WebSocket uses
+// it: clients connect without tokens, while portals identify who approves their decisions.
+func (h *HTTPHandlers) IdentifyMiddleware(next http.Handler) http.Handler {
+	return h.authMiddleware(next, false)
+}
+
+// authMiddleware authenticates bearer tokens, refusing requests without one when required
+func (h *HTTPHandlers) authMiddleware(next http.Handler, required bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Implement authentication logic
-		// For now, allow all requests
-		next.ServeHTTP(w, r)
+		if h.authenticator == nil || h.isUnauthenticatedPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !required && r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			h.writeErrorResponse(w, http.StatusUnauthorized, "Authentication required", nil)
+			return
+		}
+
+		identity, err := h.authenticator.Authenticate(token)
+		if err != nil {
+			if h.sessionManager.auditLogger != nil {
+				h.sessionManager.auditLogger.LogEvent(AuditEvent{
+					EventType: "authentication_failed",
+					IPAddress: h.sessionManager.ClientIP(r),
+					UserAgent: r.UserAgent(),
+					Details:   map[string]interface{}{"method": r.Method, "path": r.URL.Path, "reason": err.Error()},
+					Severity:  "warning",
+					Success:   false,
+					Timestamp: time.Now().UTC(),
+				})
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			h.writeErrorResponse(w, http.StatusUnauthorized, "Invalid token", err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
 	})
 }
 
-// Rate limiting middleware (placeholder)
+// isUnauthenticatedPath reports whether path is allowlisted to skip authentication
+func (h *HTTPHandlers) isUnauthenticatedPath(path string) bool {
+	for _, allowed := range h.sessionManager.GetConfig().UnauthenticatedPaths {
+		if path == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope wraps a handler so only callers whose token grants scope reach it. Without an
+// authenticator nobody can hold a scope, so the route is refused unless require_authentication
+// is turned off; admin routes are refused regardless.
+func (h *HTTPHandlers) RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.authenticator == nil && scope != auth.ScopeAdmin && !h.sessionManager.GetConfig().RequireAuthentication {
+			next(w, r)
+			return
+		}
+
+		identity, ok := auth.IdentityFromContext(r.Context())
+		if !ok || !identity.HasScope(scope) {
+			if h.sessionManager.auditLogger != nil {
+				h.sessionManager.auditLogger.LogEvent(AuditEvent{
+					EventType:  "authorization_denied",
+					Technician: identity.Subject,
+					IPAddress:  h.sessionManager.ClientIP(r),
+					UserAgent:  r.UserAgent(),
+					Details:    map[string]interface{}{"method": r.Method, "path": r.URL.Path, "required_scope": scope},
+					Severity:   "warning",
+					Success:    false,
+					Timestamp:  time.Now().UTC(),
+				})
+			}
+			h.writeErrorResponse(w, http.StatusForbidden, "Insufficient scope", fmt.Errorf("scope %q is required", scope))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// RateLimitMiddleware allows each client IP rate_limit_requests requests per rate_limit_window,
+// answering the rest with 429 and a Retry-After until the window has room again
 func (h *HTTPHandlers) RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Implement rate limiting logic
-		// For now, allow all requests
+		config := h.sessionManager.GetConfig()
+		if !config.RateLimitEnabled || config.RateLimitRequests <= 0 || config.RateLimitWindow <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, retryAfter := h.requestLimiter.allow(h.sessionManager.ClientIP(r), config.RateLimitRequests, config.RateLimitWindow, h.sessionManager.now())
+		if !allowed {
+			seconds := int((retryAfter + time.Second - 1) / time.Second)
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			h.writeErrorResponse(w, http.StatusTooManyRequests, "Rate limit exceeded",
+				fmt.Errorf("at most %d requests are allowed per %s", config.RateLimitRequests, config.RateLimitWindow))
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -538,7 +1038,7 @@ func (h *HTTPHandlers) LoggingMiddleware(next http.Handler) http.Handler {
 		if h.sessionManager.auditLogger != nil {
 			h.sessionManager.auditLogger.LogEvent(AuditEvent{
 				EventType: "http_request",
-				IPAddress: getClientIP(r),
+				IPAddress: h.sessionManager.ClientIP(r),
 				UserAgent: r.UserAgent(),
 				Details: map[string]interface{}{
 					"method":      r.Method,
@@ -548,7 +1048,7 @@ func (h *HTTPHandlers) LoggingMiddleware(next http.Handler) http.Handler {
 				},
 				Severity:  "info",
 				Success:   wrapper.statusCode < 400,
-				Timestamp: time.Now(),
+				Timestamp: time.Now().UTC(),
 			})
 		}
 	})
@@ -564,26 +1064,3 @@ func (w *responseWriterWrapper) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
 	w.ResponseWriter.WriteHeader(statusCode)
 }
-
-// getClientIP extracts the client IP address from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first IP in the list
-		if idx := strings.Index(xff, ","); idx != -1 {
-			return strings.TrimSpace(xff[:idx])
-		}
-		return strings.TrimSpace(xff)
-	}
-
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return strings.TrimSpace(xri)
-	}
-
-	// Fall back to RemoteAddr
-	if idx := strings.LastIndex(r.RemoteAddr, ":"); idx != -1 {
-		return r.RemoteAddr[:idx]
-	}
-	return r.RemoteAddr
-}
\ No newline at end of file
@@ -0,0 +1,591 @@
+package remoteaccess
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onlitec/onlidesk-server/internal/auth"
+)
+
+func TestHTTPHandlers_RejectsOversizedBodies(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	router := mux.NewRouter()
+	router.Use(MaxBodySizeMiddleware(1024))
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+
+	oversized := `{"client_id": "client", "technician_id": "tech", "padding": "` + strings.Repeat("x", 2048) + `"}`
+
+	// A declared length over the limit is refused before the handler runs
+	req := httptest.NewRequest(http.MethodPut, "/api/remoteaccess/config", bytes.NewBufferString(oversized))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// Without a declared length the limit trips while the handler decodes
+	req = httptest.NewRequest(http.MethodPost, "/api/remoteaccess/sessions", io.MultiReader(strings.NewReader(oversized)))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+	assert.Empty(t, sm.GetAllSessions())
+
+	// Bodies within the limit are unaffected
+	req = httptest.NewRequest(http.MethodPost, "/api/remoteaccess/sessions", bytes.NewBufferString(`{"client_id": "client", "technician_id": "tech"}`))
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+}
+
+func TestHTTPHandlers_IPFilterMiddleware(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.AllowedIPRanges = []string{"10.0.0.0/8", "2001:db8::/32"}
+	config.BlockedIPRanges = []string{"10.66.0.0/16"}
+	config.TrustedProxies = []string{"10.1.0.0/16", "192.0.2.0/24"}
+	require.NoError(t, config.Validate())
+	sm := newTestSessionManager(t, config)
+	router := mux.NewRouter()
+	router.Use(NewHTTPHandlers(sm).IPFilterMiddleware)
+	router.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+
+	request := func(remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("10.1.2.3:5000", ""))
+	assert.Equal(t, http.StatusOK, request("[2001:db8::7]:5000", ""))
+	assert.Equal(t, http.StatusForbidden, request("203.0.113.7:5000", ""), "outside the allowlist")
+	assert.Equal(t, http.StatusForbidden, request("10.66.1.1:5000", ""), "the denylist wins over the allowlist")
+
+	// The client IP resolved through the proxy is what's checked, not the proxy's own
+	assert.Equal(t, http.StatusForbidden, request("10.1.2.3:5000", "203.0.113.7"))
+	assert.Equal(t, http.StatusOK, request("192.0.2.1:5000", "10.1.2.3, 192.0.2.1"))
+
+	// Forwarding headers from anyone else can't smuggle a client into the allowlist
+	assert.Equal(t, http.StatusForbidden, request("203.0.113.9:5000", "10.1.2.3"))
+
+	var blocked []AuditEvent
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == "connection_blocked" {
+			blocked = append(blocked, event)
+		}
+	}
+	require.Len(t, blocked, 4)
+	assert.Equal(t, "203.0.113.7", blocked[0].IPAddress)
+	assert.Equal(t, "10.66.1.1", blocked[1].IPAddress)
+	assert.Equal(t, "203.0.113.7", blocked[2].IPAddress)
+
+	config.BlockedIPRanges = []string{"10.66.0.0"}
+	assert.Error(t, config.Validate())
+}
+
+// stubAuthenticator accepts a fixed set of tokens
+type stubAuthenticator map[string]auth.Identity
+
+func (a stubAuthenticator) Authenticate(token string) (auth.Identity, error) {
+	identity, ok := a[token]
+	if !ok {
+		return auth.Identity{}, fmt.Errorf("%w: unknown token", auth.ErrInvalidToken)
+	}
+	return identity, nil
+}
+
+func TestHTTPHandlers_AuthMiddlewareUsesConfiguredAuthenticator(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	handlers := NewHTTPHandlers(sm)
+
+	var seen auth.Identity
+	router := mux.NewRouter()
+	router.Use(handlers.AuthMiddleware)
+	router.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = auth.IdentityFromContext(r.Context())
+	})
+
+	request := func(authorization string) int {
+		req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without an authenticator every request is let through
+	assert.Equal(t, http.StatusOK, request(""))
+
+	handlers.SetAuthenticator(stubAuthenticator{"good": {Subject: "tech-1"}})
+	assert.Equal(t, http.StatusUnauthorized, request(""))
+	assert.Equal(t, http.StatusUnauthorized, request("Basic dXNlcjpwYXNz"))
+	assert.Equal(t, http.StatusUnauthorized, request("Bearer forged"))
+	require.Equal(t, http.StatusOK, request("Bearer good"))
+	assert.Equal(t, "tech-1", seen.Subject)
+
+	assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "authentication_failed")
+}
+
+func TestHTTPHandlers_IdentifyMiddlewareLetsAnonymousRequestsThrough(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	handlers := NewHTTPHandlers(sm)
+	handlers.SetAuthenticator(stubAuthenticator{"good": {Subject: "supervisor"}})
+
+	var seen auth.Identity
+	handler := handlers.IdentifyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = auth.IdentityFromContext(r.Context())
+	}))
+	request := func(authorization string) int {
+		seen = auth.Identity{}
+		req := httptest.NewRequest(http.MethodGet, "/ws/remoteaccess", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request(""))
+	assert.Empty(t, seen.Subject)
+	assert.Equal(t, http.StatusUnauthorized, request("Bearer forged"), "a token that's presented must be valid")
+	require.Equal(t, http.StatusOK, request("Bearer good"))
+	assert.Equal(t, "supervisor", seen.Subject)
+}
+
+func TestHTTPHandlers_RequireScopeOnSensitiveRoutes(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	handlers := NewHTTPHandlers(sm)
+	handlers.SetAuthenticator(stubAuthenticator{
+		"viewer":   {Subject: "viewer", Scopes: []string{"sessions:read"}},
+		"operator": {Subject: "operator", Scopes: []string{auth.ScopeSessionsTerminate, auth.ScopeConfigWrite}},
+	})
+	router := mux.NewRouter()
+	router.Use(handlers.AuthMiddleware)
+	handlers.RegisterRoutes(router)
+
+	send := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	// Unscoped endpoints only need a valid token
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/api/remoteaccess/sessions", "viewer", "").Code)
+
+	assert.Equal(t, http.StatusForbidden, send(http.MethodDelete, "/api/remoteaccess/sessions/"+session.ID, "viewer", "").Code)
+	assert.Equal(t, StatusPending, session.Status)
+	rec := send(http.MethodDelete, "/api/remoteaccess/sessions/"+session.ID, "operator", "")
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	config, err := json.Marshal(sm.GetConfig())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPut, "/api/remoteaccess/config", "viewer", string(config)).Code)
+	rec = send(http.MethodPut, "/api/remoteaccess/config", "operator", string(config))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// The operator wasn't granted privilege approval
+	rec = send(http.MethodPut, "/api/remoteaccess/sessions/"+session.ID+"/privileges/any", "operator", `{"approved_by": "operator"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "authorization_denied")
+}
+
+func TestHTTPHandlers_RequireScopeFailsClosedWithoutAnAuthenticator(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	sm := newTestSessionManager(t, config)
+	handlers := NewHTTPHandlers(sm)
+	router := mux.NewRouter()
+	router.Use(handlers.AuthMiddleware)
+	handlers.RegisterRoutes(router)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	terminate := func() int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/remoteaccess/sessions/"+session.ID, nil))
+		return rec.Code
+	}
+	admin := handlers.RequireScope(auth.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	adminCode := func() int {
+		rec := httptest.NewRecorder()
+		admin(rec, httptest.NewRequest(http.MethodPost, "/admin", nil))
+		return rec.Code
+	}
+
+	// require_authentication is on by default, so nobody holds a scope
+	assert.Equal(t, http.StatusForbidden, terminate())
+	assert.Equal(t, http.StatusForbidden, adminCode())
+	_, exists := sm.GetSession(session.ID)
+	assert.True(t, exists)
+
+	// Waiving it opens the scoped routes, but never the admin ones
+	config = sm.GetConfig().Clone()
+	config.RequireAuthentication = false
+	sm.UpdateConfig(config)
+	assert.Equal(t, http.StatusOK, terminate())
+	assert.Equal(t, http.StatusForbidden, adminCode())
+}
+
+func TestHTTPHandlers_ApprovePrivilegeRecordsTheAuthenticatedApprover(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	handlers := NewHTTPHandlers(sm)
+	handlers.SetAuthenticator(stubAuthenticator{
+		"approver": {Subject: "approver-1", Scopes: []string{auth.ScopePrivilegesApprove}},
+	})
+	router := mux.NewRouter()
+	router.Use(handlers.AuthMiddleware)
+	handlers.RegisterRoutes(router)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	requestID, err := sm.RequestPrivilege(session.ID, PrivilegeTypeServices, "restart print spooler", time.Minute)
+	require.NoError(t, err)
+
+	// A name in the body is ignored
+	req := httptest.NewRequest(http.MethodPut, "/api/remoteaccess/sessions/"+session.ID+"/privileges/"+requestID, bytes.NewBufferString(`{"approved_by": "ceo"}`))
+	req.Header.Set("Authorization", "Bearer approver")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	request, found := session.GetPrivilegeRequest(requestID)
+	require.True(t, found)
+	assert.Equal(t, "approved", request.Status)
+	assert.Equal(t, "approver-1", request.ApprovedBy)
+	assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "privilege_approved")
+}
+
+func TestHTTPHandlers_AuditsConfigChanges(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.TrustedProxies = []string{"192.0.2.0/24"} // httptest requests come from 192.0.2.1
+	sm := newTestSessionManager(t, config)
+	// Config changes are recorded even when the filter would drop info events
+	sm.auditLogger.SetFilter([]string{"session_created"}, "error")
+	handlers := NewHTTPHandlers(sm)
+	handlers.SetAuthenticator(stubAuthenticator{
+		"admin": {Subject: "admin-1", Scopes: []string{auth.ScopeConfigWrite}},
+	})
+	router := mux.NewRouter()
+	router.Use(handlers.AuthMiddleware)
+	handlers.RegisterRoutes(router)
+
+	updated := DefaultRemoteAccessConfig()
+	updated.TrustedProxies = config.TrustedProxies
+	updated.MaxConcurrentSessions = 25
+	body, err := json.Marshal(updated)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPut, "/api/remoteaccess/config", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var updates []AuditEvent
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == "config_updated" {
+			updates = append(updates, event)
+		}
+	}
+	require.Len(t, updates, 1)
+	assert.Equal(t, "admin-1", updates[0].Technician)
+	assert.Equal(t, "203.0.113.7", updates[0].IPAddress)
+	assert.Equal(t, "remote_access", updates[0].Details["config_type"])
+	assert.Equal(t, map[string]interface{}{
+		"max_concurrent_sessions": map[string]interface{}{"old": float64(10), "new": float64(25)},
+	}, updates[0].Details["changes"])
+}
+
+func TestHTTPHandlers_ReportsCapacityWhenSessionCapIsHit(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxConcurrentSessions = 2
+	config.ReconnectBaseDelay = 5 * time.Second
+	sm := newTestSessionManager(t, config)
+	router := mux.NewRouter()
+	handlers := NewHTTPHandlers(sm)
+	handlers.RegisterRoutes(router)
+	router.HandleFunc("/ready", handlers.HandleReadiness)
+
+	createSession := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/remoteaccess/sessions", bytes.NewBufferString(`{"client_id": "client", "technician_id": "tech"}`))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	ready := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return rec
+	}
+
+	var created []string
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusOK, ready().Code)
+		rec := createSession()
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var session map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &session))
+		created = append(created, session["id"].(string))
+	}
+
+	// The cap is hit: the create is refused with the counts and a retry hint
+	rec := createSession()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, RetryReasonAtCapacity, body["reason"])
+	assert.Equal(t, float64(5), body["retry_after"])
+	assert.Equal(t, float64(2), body["active_sessions"])
+	assert.Equal(t, float64(2), body["max_sessions"])
+	assert.Len(t, sm.GetAllSessions(), 2)
+
+	// Readiness fails until a session ends
+	rec = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	body = nil
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, RetryReasonAtCapacity, body["reason"])
+	assert.Equal(t, float64(2), body["active_sessions"])
+
+	require.NoError(t, sm.TerminateSession(created[0]))
+	rec = ready()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body = nil
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, float64(1), body["active_sessions"])
+	assert.Equal(t, float64(2), body["max_sessions"])
+
+	// Draining takes the server out of rotation regardless of load
+	sm.BeginDrain()
+	rec = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	body = nil
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, RetryReasonDraining, body["reason"])
+}
+
+func TestHTTPHandlers_HealthReportsUptime(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+
+	time.Sleep(10 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/remoteaccess/health", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var health map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &health))
+	uptime, ok := health["uptime"].(string)
+	require.True(t, ok, "uptime is a duration string, got %v", health["uptime"])
+	parsed, err := time.ParseDuration(uptime)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, parsed, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, sm.Uptime(), parsed)
+}
+
+func TestHTTPHandlers_JWTAuthenticationOnRemoteAccessRoutes(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	handlers := NewHTTPHandlers(sm)
+	authenticator, err := auth.NewJWTAuthenticator(&auth.JWTConfig{
+		Algorithm: "HS256",
+		Secret:    "shared",
+		Issuer:    "onlidesk",
+		Audience:  "remoteaccess",
+		Leeway:    time.Second,
+	})
+	require.NoError(t, err)
+	handlers.SetAuthenticator(authenticator)
+	router := mux.NewRouter()
+	router.Use(handlers.AuthMiddleware)
+	handlers.RegisterRoutes(router)
+
+	sign := func(claims map[string]interface{}) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+		payload, err := json.Marshal(claims)
+		require.NoError(t, err)
+		signingInput := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+		mac := hmac.New(sha256.New, []byte("shared"))
+		mac.Write([]byte(signingInput))
+		return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub": "tech-1",
+			"iss": "onlidesk",
+			"aud": "remoteaccess",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for key, value := range overrides {
+			claims[key] = value
+		}
+		return claims
+	}
+	send := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The health check is allowlisted; everything else needs a valid token
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/api/remoteaccess/health", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/remoteaccess/sessions", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/remoteaccess/sessions", "not.a.jwt", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/remoteaccess/sessions", sign(claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), "").Code)
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/remoteaccess/sessions", sign(claims(map[string]interface{}{"iss": "someone-else"})), "").Code)
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/remoteaccess/sessions", sign(claims(map[string]interface{}{"aud": "filetransfer"})), "").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/api/remoteaccess/sessions", sign(claims(nil)), "").Code)
+
+	// Sessions are created for the technician the token names, not the one the body claims
+	token := sign(claims(nil))
+	rec := send(http.MethodPost, "/api/remoteaccess/sessions", token, `{"client_id": "client-1", "technician_id": "tech-2"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code, rec.Body.String())
+
+	rec = send(http.MethodPost, "/api/remoteaccess/sessions", token, `{"client_id": "client-1"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	session, exists := sm.GetSession(created["id"].(string))
+	require.True(t, exists)
+	assert.Equal(t, "tech-1", session.TechnicianID)
+
+	// The allowlist is configurable
+	config := *sm.GetConfig()
+	config.UnauthenticatedPaths = nil
+	sm.UpdateConfig(&config)
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/remoteaccess/health", "", "").Code)
+}
+
+func TestHTTPHandlers_RateLimitsEachClientIP(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.RateLimitRequests = 3
+	config.RateLimitWindow = time.Minute
+	config.TrustedProxies = []string{"192.0.2.0/24", "10.0.0.0/8"}
+	sm := newTestSessionManager(t, config)
+	handlers := NewHTTPHandlers(sm)
+	router := mux.NewRouter()
+	router.Use(handlers.RateLimitMiddleware)
+	handlers.RegisterRoutes(router)
+
+	send := func(forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/remoteaccess/health", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < config.RateLimitRequests; i++ {
+		assert.Equal(t, http.StatusOK, send("203.0.113.7").Code)
+	}
+	rec := send("203.0.113.7, 10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 60, retryAfter, 1)
+
+	// Other clients have their own allowance
+	assert.Equal(t, http.StatusOK, send("198.51.100.2").Code)
+
+	// Disabling the limit lets the throttled client through
+	disabled := *sm.GetConfig()
+	disabled.RateLimitEnabled = false
+	sm.UpdateConfig(&disabled)
+	assert.Equal(t, http.StatusOK, send("203.0.113.7").Code)
+}
+
+func TestRequestLimiter_SlidesTheWindowAndForgetsIdleClients(t *testing.T) {
+	limiter := newRequestLimiter()
+	start := time.Now()
+
+	allowed, _ := limiter.allow("a", 2, time.Second, start)
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow("a", 2, time.Second, start.Add(500*time.Millisecond))
+	assert.True(t, allowed)
+	allowed, retryAfter := limiter.allow("a", 2, time.Second, start.Add(600*time.Millisecond))
+	assert.False(t, allowed)
+	assert.Equal(t, 400*time.Millisecond, retryAfter)
+
+	// The first request leaves the window, making room for one more
+	allowed, _ = limiter.allow("a", 2, time.Second, start.Add(1100*time.Millisecond))
+	assert.True(t, allowed)
+
+	for i := 0; i < 100; i++ {
+		limiter.allow(fmt.Sprintf("idle-%d", i), 2, time.Second, start.Add(1100*time.Millisecond))
+	}
+	assert.Equal(t, 101, limiter.size())
+
+	// A window later only the client still sending is tracked
+	limiter.allow("a", 2, time.Second, start.Add(2200*time.Millisecond))
+	assert.Equal(t, 1, limiter.size())
+}
+
+func TestHTTPHandlers_LockedOutClientsGet423(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxFailedAttempts = 2
+	config.LockoutDuration = time.Minute
+	config.TrustedProxies = []string{"192.0.2.0/24"}
+	sm := newTestSessionManager(t, config)
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Guessing session codes trips the lockout
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/api/remoteaccess/sessions/by-code/AAAAAA", "").Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/api/remoteaccess/sessions/by-code/BBBBBB", "").Code)
+
+	for _, rec := range []*httptest.ResponseRecorder{
+		send(http.MethodGet, "/api/remoteaccess/sessions/by-code/CCCCCC", ""),
+		send(http.MethodPost, "/api/remoteaccess/sessions", `{"client_id": "client", "technician_id": "tech"}`),
+	} {
+		require.Equal(t, http.StatusLocked, rec.Code, rec.Body.String())
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		lockedUntil, err := time.Parse(time.RFC3339Nano, body["locked_until"].(string))
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), lockedUntil, 5*time.Second)
+		assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	}
+}
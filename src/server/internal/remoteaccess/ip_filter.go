@@ -0,0 +1,46 @@
+package remoteaccess
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/clientnet"
+)
+
+// ClientIP returns a request's client IP, believing forwarding headers only from the trusted proxies
+func (sm *SessionManager) ClientIP(r *http.Request) string {
+	return clientnet.ClientIP(r, sm.GetConfig().TrustedProxies)
+}
+
+// AllowSource reports whether a request's client IP is within the configured ranges,
+// auditing the refusal when it isn't
+func (sm *SessionManager) AllowSource(r *http.Request) bool {
+	ipAddress := sm.ClientIP(r)
+	if sm.GetConfig().IsIPAllowed(ipAddress) {
+		return true
+	}
+
+	if sm.auditLogger != nil {
+		sm.auditLogger.LogEvent(AuditEvent{
+			EventType: "connection_blocked",
+			IPAddress: ipAddress,
+			UserAgent: r.UserAgent(),
+			Details:   map[string]interface{}{"method": r.Method, "path": r.URL.Path, "reason": "source IP not allowed"},
+			Severity:  "warning",
+			Success:   false,
+			Timestamp: time.Now().UTC(),
+		})
+	}
+	return false
+}
+
+// IPFilterMiddleware refuses requests from client IPs outside the configured allowed and blocked ranges
+func (h *HTTPHandlers) IPFilterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.sessionManager.AllowSource(r) {
+			h.writeErrorResponse(w, http.StatusForbidden, "Source address not allowed", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+package remoteaccess
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLockedOut is returned for session attempts from a client locked out after repeated failures
+var ErrLockedOut = errors.New("too many failed attempts")
+
+// failedAttempts tracks one client's recent failed session attempts
+type failedAttempts struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// IsLockedOut reports whether identifier, a client IP, is locked out of creating and joining
+// sessions, and if so until when. An expired lockout is cleared.
+func (sm *SessionManager) IsLockedOut(identifier string) (bool, time.Time) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	attempts, exists := sm.failures[identifier]
+	if !exists || attempts.lockedUntil.IsZero() {
+		return false, time.Time{}
+	}
+	if !sm.clock.Now().Before(attempts.lockedUntil) {
+		delete(sm.failures, identifier)
+		return false, time.Time{}
+	}
+	return true, attempts.lockedUntil
+}
+
+// CheckLockout refuses an attempt, such as session_create or session_join, from a locked out
+// client, auditing it as a security violation
+func (sm *SessionManager) CheckLockout(identifier, attempt string) error {
+	locked, until := sm.IsLockedOut(identifier)
+	if !locked {
+		return nil
+	}
+
+	sm.logLockedOutAttempt(identifier, attempt, until)
+	return fmt.Errorf("%w: locked out until %s", ErrLockedOut, until.UTC().Format(time.RFC3339))
+}
+
+// logLockedOutAttempt audits an attempt refused by a lockout
+func (sm *SessionManager) logLockedOutAttempt(identifier, attempt string, until time.Time) {
+	sm.auditLogger.LogSecurityViolation("", "", "", fmt.Sprintf("%s attempted while locked out until %s", attempt, until.UTC().Format(time.RFC3339)), identifier)
+}
+
+// RecordFailedAttempt counts a failed session attempt from identifier, locking it out for
+// lockout_duration once max_failed_attempts fail within that time. It reports whether the
+// client is now locked out.
+func (sm *SessionManager) RecordFailedAttempt(identifier, attempt string) bool {
+	sm.mutex.Lock()
+	now := sm.clock.Now()
+	attempts, exists := sm.failures[identifier]
+	if !exists || now.Sub(attempts.lastFailure) >= sm.config.LockoutDuration {
+		attempts = &failedAttempts{}
+		sm.failures[identifier] = attempts
+	}
+	attempts.count++
+	attempts.lastFailure = now
+
+	lockedOut := attempts.count >= sm.config.MaxFailedAttempts
+	if lockedOut && attempts.lockedUntil.IsZero() {
+		attempts.lockedUntil = now.Add(sm.config.LockoutDuration)
+	} else {
+		lockedOut = false // only the failure that trips the lockout reports it
+	}
+	count, until := attempts.count, attempts.lockedUntil
+	sm.mutex.Unlock()
+
+	if lockedOut {
+		sm.auditLogger.LogSecurityViolation("", "", "", fmt.Sprintf("locked out of session attempts until %s after %d failed attempts, the last a %s", until.UTC().Format(time.RFC3339), count, attempt), identifier)
+	}
+	return lockedOut
+}
+
+// ClearFailedAttempts forgets identifier's failures after a successful attempt
+func (sm *SessionManager) ClearFailedAttempts(identifier string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if attempts, exists := sm.failures[identifier]; exists && attempts.lockedUntil.IsZero() {
+		delete(sm.failures, identifier)
+	}
+}
+
+// pruneFailedAttempts forgets clients whose failures and lockouts have lapsed
+func (sm *SessionManager) pruneFailedAttempts() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	now := sm.clock.Now()
+	for identifier, attempts := range sm.failures {
+		if now.Before(attempts.lockedUntil) {
+			continue
+		}
+		if attempts.lockedUntil.IsZero() && now.Sub(attempts.lastFailure) < sm.config.LockoutDuration {
+			continue
+		}
+		delete(sm.failures, identifier)
+	}
+}
@@ -0,0 +1,137 @@
+package remoteaccess
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrMessageNotPermitted is returned when a connection's role may not send a message type
+var ErrMessageNotPermitted = errors.New("message type not permitted for role")
+
+// ErrRoleNotPermitted is returned when a connection registers as a role its identity doesn't allow
+var ErrRoleNotPermitted = errors.New("role not permitted for connection")
+
+// RoleObserver is a view-only participant that may watch the screen but not act on the client
+const RoleObserver = "observer"
+
+// registrationMessageTypes are the only messages a connection may send before it has a role
+var registrationMessageTypes = map[string]bool{
+	"hello":            true,
+	"session_register": true,
+	"session_create":   true,
+	"session_join":     true,
+}
+
+// knownMessageTypes lists every message type the WebSocket dispatcher handles
+var knownMessageTypes = map[string]bool{
+	"hello":                 true,
+	"session_register":      true,
+	"session_create":        true,
+	"client_info":           true,
+	"session_join":          true,
+	"session_terminate":     true,
+	"privilege_request":     true,
+	"privilege_response":    true,
+	"privilege_revoke":      true,
+	"control_command":       true,
+	"command_result":        true,
+	"screen_capture":        true,
+	"screen_frame":          true,
+	"input_event":           true,
+	"file_transfer_request": true,
+	"heartbeat":             true,
+}
+
+// defaultRoleMessagePolicy limits observers to watching the screen and keeping the connection alive
+func defaultRoleMessagePolicy() map[string][]string {
+	return map[string][]string{
+		RoleObserver: {"screen_capture", "heartbeat"},
+	}
+}
+
+// validateRoleMessagePolicy checks that every allow-list names only known message types
+func validateRoleMessagePolicy(policy map[string][]string) error {
+	roles := make([]string, 0, len(policy))
+	for role := range policy {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	for _, role := range roles {
+		if role == "" {
+			return fmt.Errorf("role names cannot be empty")
+		}
+		for _, messageType := range policy[role] {
+			if !knownMessageTypes[messageType] {
+				return fmt.Errorf("unknown message type %q for role %s", messageType, role)
+			}
+		}
+	}
+	return nil
+}
+
+// AuthorizeMessage checks a message type against the allow-list for the connection's registered role.
+// Connections that haven't registered yet may only negotiate and register. Roles without an
+// allow-list are unrestricted; a nil policy means the defaults, an empty one disables the check.
+// Refusals are audited as security violations.
+func (sm *SessionManager) AuthorizeMessage(conn *websocket.Conn, messageType string) error {
+	stats, tracked := sm.connTracker.Lookup(conn)
+	if !tracked || stats.Role == "" {
+		if registrationMessageTypes[messageType] {
+			return nil
+		}
+		sm.auditLogger.LogSecurityViolation("", "", "", fmt.Sprintf("unregistered connection sent message type %s", messageType), stats.RemoteAddr)
+		return fmt.Errorf("%w: unregistered connections may not send %s", ErrMessageNotPermitted, messageType)
+	}
+
+	// Config files written before the policy existed still get the default restrictions
+	policy := sm.GetConfig().RoleMessagePolicy
+	if policy == nil {
+		policy = defaultRoleMessagePolicy()
+	}
+
+	allowed, restricted := policy[stats.Role]
+	if !restricted {
+		return nil
+	}
+	for _, permitted := range allowed {
+		if permitted == messageType {
+			return nil
+		}
+	}
+
+	sm.auditLogger.LogSecurityViolation(stats.SessionID, "", "", fmt.Sprintf("role %s sent disallowed message type %s", stats.Role, messageType), stats.RemoteAddr)
+	return fmt.Errorf("%w: %s may not send %s", ErrMessageNotPermitted, stats.Role, messageType)
+}
+
+// registrationRole derives the role a connection registers as from its authenticated identity
+// rather than the role it asks for. Anonymous connections can only be the client; authenticated
+// ones are the portal, or an observer if they ask to be. Without an auth provider nobody can
+// authenticate, so the requested role is kept.
+func (wh *WebSocketHandler) registrationRole(conn *websocket.Conn, requested string) (string, error) {
+	if wh.authenticator == nil {
+		switch requested {
+		case "", "client":
+			return "client", nil
+		case "portal", RoleObserver:
+			return requested, nil
+		}
+		return "", fmt.Errorf("%w: unknown role %s", ErrRoleNotPermitted, requested)
+	}
+
+	authenticated := wh.connIdentity(conn) != ""
+	switch {
+	case !authenticated && (requested == "" || requested == "client"):
+		return "client", nil
+	case !authenticated:
+		return "", fmt.Errorf("%w: %s requires an authenticated connection", ErrRoleNotPermitted, requested)
+	case requested == "" || requested == "portal":
+		return "portal", nil
+	case requested == RoleObserver:
+		return RoleObserver, nil
+	}
+	return "", fmt.Errorf("%w: authenticated connections can't register as %s", ErrRoleNotPermitted, requested)
+}
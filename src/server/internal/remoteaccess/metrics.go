@@ -0,0 +1,29 @@
+package remoteaccess
+
+// SessionMetrics is told about session events worth counting, e.g. to export them for scraping
+type SessionMetrics interface {
+	SessionCreated()
+	PrivilegeEscalated(privilegeType PrivilegeType)
+	TrafficMetrics
+}
+
+// TrafficMetrics is told about WebSocket traffic, summed over every connection
+type TrafficMetrics interface {
+	BytesRead(bytes int)
+	BytesWritten(bytes int)
+	MessageReceived(messageType string)
+	ConnectionError()
+}
+
+// SetMetrics sets what session creations, privilege escalations and connection traffic are reported to
+func (sm *SessionManager) SetMetrics(metrics SessionMetrics) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.metrics = metrics
+	sm.connTracker.SetMetrics(metrics)
+}
+
+// ConnectionCount returns how many remote access WebSockets are open
+func (sm *SessionManager) ConnectionCount() int {
+	return sm.connTracker.Count()
+}
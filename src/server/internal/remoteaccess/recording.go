@@ -0,0 +1,603 @@
+package remoteaccess
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRecordingTooLarge is returned when an exported recording exceeds the configured size bound
+var ErrRecordingTooLarge = errors.New("recording export exceeds maximum size")
+
+// ErrNoRecording is returned when a session has no recorded frames
+var ErrNoRecording = errors.New("no recorded frames for session")
+
+// ErrInputLogFull is returned when a session's input-event log has reached its size bound
+var ErrInputLogFull = errors.New("input event log is full")
+
+// ErrNoSessionRecording is returned when a session has no recorded messages
+var ErrNoSessionRecording = errors.New("no recording for session")
+
+// inputLogName is the file, next to a session's frames directory, holding its input events
+const inputLogName = "input_events.jsonl"
+
+// messageLogName is the file, next to a session's frames directory, holding its recorded messages
+const messageLogName = "session.jsonl"
+
+// VideoEncoder assembles recorded frames into a single playable or downloadable file
+type VideoEncoder interface {
+	// Name identifies the encoder backend (e.g. "ffmpeg", "archive")
+	Name() string
+	// ContentType is the MIME type of the encoder output
+	ContentType() string
+	// Extension is the file extension of the encoder output, including the dot
+	Extension() string
+	// Encode writes frames, in order, to w at the given frame rate
+	Encode(ctx context.Context, frames []string, frameRate int, w io.Writer) error
+}
+
+// InputEventEncoder is implemented by encoders whose output can also carry the recorded input-event log
+type InputEventEncoder interface {
+	VideoEncoder
+	// EncodeWithInputEvents behaves like Encode and bundles the input-event log at inputLog, if non-empty
+	EncodeWithInputEvents(ctx context.Context, frames []string, inputLog string, frameRate int, w io.Writer) error
+}
+
+// InputEventRecord is one recorded input event, stored as a line of JSON
+type InputEventRecord struct {
+	Timestamp int64                  `json:"ts"` // Unix milliseconds
+	EventType string                 `json:"type"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Redacted  bool                   `json:"redacted,omitempty"`
+}
+
+// FFmpegEncoder encodes frames into a fragmented MP4 by shelling out to ffmpeg
+type FFmpegEncoder struct {
+	Path string
+}
+
+// NewFFmpegEncoder creates an ffmpeg-backed encoder, or returns an error if ffmpeg is not available
+func NewFFmpegEncoder(path string) (*FFmpegEncoder, error) {
+	if path == "" {
+		path = "ffmpeg"
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg not available: %v", err)
+	}
+	return &FFmpegEncoder{Path: resolved}, nil
+}
+
+// Name returns the encoder name
+func (e *FFmpegEncoder) Name() string { return "ffmpeg" }
+
+// ContentType returns the MIME type of the encoded video
+func (e *FFmpegEncoder) ContentType() string { return "video/mp4" }
+
+// Extension returns the file extension of the encoded video
+func (e *FFmpegEncoder) Extension() string { return ".mp4" }
+
+// Encode runs ffmpeg over a concat list of the frames and streams the MP4 to w
+func (e *FFmpegEncoder) Encode(ctx context.Context, frames []string, frameRate int, w io.Writer) error {
+	if frameRate <= 0 {
+		frameRate = 1
+	}
+
+	list, err := os.CreateTemp("", "recording_frames_*.txt")
+	if err != nil {
+		return fmt.Errorf("failed to create frame list: %v", err)
+	}
+	defer os.Remove(list.Name())
+
+	frameDuration := 1.0 / float64(frameRate)
+	for _, frame := range frames {
+		absPath, err := filepath.Abs(frame)
+		if err != nil {
+			list.Close()
+			return fmt.Errorf("failed to resolve frame path: %v", err)
+		}
+		fmt.Fprintf(list, "file '%s'\nduration %f\n", strings.ReplaceAll(absPath, "'", `'\''`), frameDuration)
+	}
+	if err := list.Close(); err != nil {
+		return fmt.Errorf("failed to write frame list: %v", err)
+	}
+
+	cmd := exec.CommandContext(ctx, e.Path,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "concat", "-safe", "0", "-i", list.Name(),
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p",
+		"-movflags", "frag_keyframe+empty_moov",
+		"-f", "mp4", "pipe:1",
+	)
+	var stderr strings.Builder
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// FrameArchiveEncoder packs frames into a zip archive; used when no video encoder is available
+type FrameArchiveEncoder struct{}
+
+// Name returns the encoder name
+func (e *FrameArchiveEncoder) Name() string { return "archive" }
+
+// ContentType returns the MIME type of the archive
+func (e *FrameArchiveEncoder) ContentType() string { return "application/zip" }
+
+// Extension returns the file extension of the archive
+func (e *FrameArchiveEncoder) Extension() string { return ".zip" }
+
+// Encode writes every frame into a zip archive in recording order
+func (e *FrameArchiveEncoder) Encode(ctx context.Context, frames []string, frameRate int, w io.Writer) error {
+	return e.EncodeWithInputEvents(ctx, frames, "", frameRate, w)
+}
+
+// EncodeWithInputEvents writes the frames and, if present, the input-event log into a zip archive
+func (e *FrameArchiveEncoder) EncodeWithInputEvents(ctx context.Context, frames []string, inputLog string, frameRate int, w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	files := frames
+	if inputLog != "" {
+		files = append(append([]string(nil), frames...), inputLog)
+	}
+
+	for _, frame := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:   filepath.Base(frame),
+			Method: zip.Store, // frames are already compressed images
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add frame to archive: %v", err)
+		}
+
+		file, err := os.Open(frame)
+		if err != nil {
+			return fmt.Errorf("failed to open frame: %v", err)
+		}
+		_, err = io.Copy(entry, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// NewVideoEncoder selects an encoder backend from the configuration, falling back to a frame archive
+func NewVideoEncoder(config *RemoteAccessConfig) VideoEncoder {
+	switch config.RecordingEncoder {
+	case "archive":
+		return &FrameArchiveEncoder{}
+	default:
+		encoder, err := NewFFmpegEncoder(config.FFmpegPath)
+		if err != nil {
+			return &FrameArchiveEncoder{}
+		}
+		return encoder
+	}
+}
+
+// RecordedMessage is one message of a session recording, stored as a line of JSON
+type RecordedMessage struct {
+	Timestamp int64           `json:"ts"` // Unix milliseconds
+	Type      string          `json:"type"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// messageLog is a session's open recording file; writes are buffered until the recording is read or finalized
+type messageLog struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// RecordingStore persists recorded screen frames, input events and messages on disk, one directory per session
+type RecordingStore struct {
+	dir         string
+	counts      map[string]int
+	inputSizes  map[string]int64
+	messageLogs map[string]*messageLog
+	mutex       sync.Mutex
+}
+
+// NewRecordingStore creates a recording store rooted at dir
+func NewRecordingStore(dir string) *RecordingStore {
+	return &RecordingStore{
+		dir:         dir,
+		counts:      make(map[string]int),
+		inputSizes:  make(map[string]int64),
+		messageLogs: make(map[string]*messageLog),
+	}
+}
+
+// messageLogPath returns the path of a session's recorded messages
+func (rs *RecordingStore) messageLogPath(sessionID string) string {
+	return filepath.Join(rs.dir, filepath.Base(sessionID), messageLogName)
+}
+
+// AppendMessage adds a message to the session's recording, opening the recording file on first use
+func (rs *RecordingStore) AppendMessage(sessionID string, record RecordedMessage) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recorded message: %v", err)
+	}
+	line = append(line, '\n')
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	recording, ok := rs.messageLogs[sessionID]
+	if !ok {
+		path := rs.messageLogPath(sessionID)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create recording directory: %v", err)
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open session recording: %v", err)
+		}
+		recording = &messageLog{file: file, writer: bufio.NewWriter(file)}
+		rs.messageLogs[sessionID] = recording
+	}
+
+	if _, err := recording.writer.Write(line); err != nil {
+		return fmt.Errorf("failed to write recorded message: %v", err)
+	}
+	return nil
+}
+
+// OpenMessages flushes the session's recording and opens it for reading from the start
+func (rs *RecordingStore) OpenMessages(sessionID string) (io.ReadCloser, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if recording, ok := rs.messageLogs[sessionID]; ok {
+		if err := recording.writer.Flush(); err != nil {
+			return nil, fmt.Errorf("failed to flush session recording: %v", err)
+		}
+	}
+
+	file, err := os.Open(rs.messageLogPath(sessionID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoSessionRecording
+		}
+		return nil, fmt.Errorf("failed to open session recording: %v", err)
+	}
+	return file, nil
+}
+
+// Finalize flushes the session's recording to disk and closes it
+func (rs *RecordingStore) Finalize(sessionID string) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	recording, ok := rs.messageLogs[sessionID]
+	if !ok {
+		return nil
+	}
+	delete(rs.messageLogs, sessionID)
+
+	if err := recording.writer.Flush(); err != nil {
+		recording.file.Close()
+		return fmt.Errorf("failed to flush session recording: %v", err)
+	}
+	if err := recording.file.Sync(); err != nil {
+		recording.file.Close()
+		return fmt.Errorf("failed to sync session recording: %v", err)
+	}
+	return recording.file.Close()
+}
+
+// RemoveExpired deletes the recordings of sessions not recording any more whose files were all
+// last written before cutoff, and returns the IDs of the sessions removed
+func (rs *RecordingStore) RemoveExpired(cutoff time.Time) ([]string, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	entries, err := os.ReadDir(rs.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read recording directory: %v", err)
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		sessionID := entry.Name()
+		if !entry.IsDir() || rs.messageLogs[sessionID] != nil {
+			continue
+		}
+
+		dir := filepath.Join(rs.dir, sessionID)
+		latest := time.Time{}
+		filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil && info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+			return nil
+		})
+		if !latest.Before(cutoff) {
+			continue
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, fmt.Errorf("failed to remove recording of session %s: %v", sessionID, err)
+		}
+		delete(rs.counts, sessionID)
+		delete(rs.inputSizes, sessionID)
+		removed = append(removed, sessionID)
+	}
+	return removed, nil
+}
+
+// inputLogPath returns the path of a session's input-event log
+func (rs *RecordingStore) inputLogPath(sessionID string) string {
+	return filepath.Join(rs.dir, filepath.Base(sessionID), inputLogName)
+}
+
+// SaveInputEvent appends an input event to the session's log, refusing it with ErrInputLogFull
+// once the log would grow past maxSize bytes. A zero maxSize disables the bound.
+func (rs *RecordingStore) SaveInputEvent(sessionID string, record InputEventRecord, maxSize int64) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal input event: %v", err)
+	}
+	line = append(line, '\n')
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	path := rs.inputLogPath(sessionID)
+	size, ok := rs.inputSizes[sessionID]
+	if !ok {
+		if info, err := os.Stat(path); err == nil {
+			size = info.Size()
+		}
+	}
+	if maxSize > 0 && size+int64(len(line)) > maxSize {
+		rs.inputSizes[sessionID] = size
+		return ErrInputLogFull
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create recording directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open input event log: %v", err)
+	}
+	defer file.Close()
+
+	n, err := file.Write(line)
+	rs.inputSizes[sessionID] = size + int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write input event: %v", err)
+	}
+
+	return nil
+}
+
+// ReadInputEvents returns a session's recorded input events in recording order
+func (rs *RecordingStore) ReadInputEvents(sessionID string) ([]InputEventRecord, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	data, err := os.ReadFile(rs.inputLogPath(sessionID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read input event log: %v", err)
+	}
+
+	var records []InputEventRecord
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var record InputEventRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("failed to parse input event log: %v", err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// frameDir returns the directory holding a session's frames
+func (rs *RecordingStore) frameDir(sessionID string) string {
+	return filepath.Join(rs.dir, filepath.Base(sessionID), "frames")
+}
+
+// SaveFrame stores a frame for the session; format is the image extension (jpeg, jpg, webp, png)
+func (rs *RecordingStore) SaveFrame(sessionID string, data []byte, format string) error {
+	ext, err := frameExtension(format)
+	if err != nil {
+		return err
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	dir := rs.frameDir(sessionID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create recording directory: %v", err)
+	}
+
+	// Resume numbering after a restart by counting what's already on disk
+	index, ok := rs.counts[sessionID]
+	if !ok {
+		existing, _ := rs.listFrames(sessionID)
+		index = len(existing)
+	}
+
+	framePath := filepath.Join(dir, fmt.Sprintf("frame_%06d%s", index, ext))
+	if err := os.WriteFile(framePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write frame: %v", err)
+	}
+	rs.counts[sessionID] = index + 1
+
+	return nil
+}
+
+// Release drops the cached frame counter for a session that will not record any more frames
+func (rs *RecordingStore) Release(sessionID string) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	delete(rs.counts, sessionID)
+	delete(rs.inputSizes, sessionID)
+}
+
+// ListFrames returns the session's frame paths in recording order
+func (rs *RecordingStore) ListFrames(sessionID string) ([]string, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.listFrames(sessionID)
+}
+
+func (rs *RecordingStore) listFrames(sessionID string) ([]string, error) {
+	entries, err := os.ReadDir(rs.frameDir(sessionID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read recording directory: %v", err)
+	}
+
+	var frames []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), "frame_") {
+			continue
+		}
+		frames = append(frames, filepath.Join(rs.frameDir(sessionID), entry.Name()))
+	}
+	sort.Strings(frames)
+	return frames, nil
+}
+
+// Export encodes the session's frames into a temp file bounded by maxSize and returns its path.
+// The caller is responsible for removing the file.
+func (rs *RecordingStore) Export(ctx context.Context, sessionID string, encoder VideoEncoder, frameRate int, maxSize int64) (string, error) {
+	frames, err := rs.ListFrames(sessionID)
+	if err != nil {
+		return "", err
+	}
+	if len(frames) == 0 {
+		return "", ErrNoRecording
+	}
+
+	exportDir := filepath.Join(rs.dir, filepath.Base(sessionID))
+	output, err := os.CreateTemp(exportDir, "export_*"+encoder.Extension())
+	if err != nil {
+		return "", fmt.Errorf("failed to create export file: %v", err)
+	}
+
+	// Bundle the input events when the encoder's output format can carry them
+	writer := &boundedWriter{w: output, limit: maxSize}
+	var encodeErr error
+	if inputEncoder, ok := encoder.(InputEventEncoder); ok {
+		inputLog := rs.inputLogPath(sessionID)
+		if _, err := os.Stat(inputLog); err != nil {
+			inputLog = ""
+		}
+		encodeErr = inputEncoder.EncodeWithInputEvents(ctx, frames, inputLog, frameRate, writer)
+	} else {
+		encodeErr = encoder.Encode(ctx, frames, frameRate, writer)
+	}
+	closeErr := output.Close()
+
+	if encodeErr != nil || writer.exceeded {
+		os.Remove(output.Name())
+		if writer.exceeded {
+			return "", ErrRecordingTooLarge
+		}
+		return "", fmt.Errorf("failed to encode recording with %s: %v", encoder.Name(), encodeErr)
+	}
+	if closeErr != nil {
+		os.Remove(output.Name())
+		return "", fmt.Errorf("failed to finalize export file: %v", closeErr)
+	}
+
+	return output.Name(), nil
+}
+
+// boundedWriter fails writes that would take the output past limit bytes; a zero limit disables the bound
+type boundedWriter struct {
+	w        io.Writer
+	limit    int64
+	written  int64
+	exceeded bool
+}
+
+func (bw *boundedWriter) Write(p []byte) (int, error) {
+	if bw.limit > 0 && bw.written+int64(len(p)) > bw.limit {
+		bw.exceeded = true
+		return 0, ErrRecordingTooLarge
+	}
+	n, err := bw.w.Write(p)
+	bw.written += int64(n)
+	return n, err
+}
+
+// isKeyboardEvent reports whether an input event carries keystrokes
+func isKeyboardEvent(eventType string) bool {
+	eventType = strings.ToLower(eventType)
+	return strings.HasPrefix(eventType, "key") || eventType == "text_input"
+}
+
+// isSensitiveInput reports whether the client flagged the event as typed into a sensitive field
+func isSensitiveInput(data map[string]interface{}) bool {
+	if sensitive, _ := data["sensitive"].(bool); sensitive {
+		return true
+	}
+	fieldType, _ := data["field_type"].(string)
+	return strings.EqualFold(fieldType, "password")
+}
+
+// frameExtension maps a frame format to the extension used on disk
+func frameExtension(format string) (string, error) {
+	switch strings.ToLower(strings.TrimPrefix(format, ".")) {
+	case "", "jpeg", "jpg":
+		return ".jpg", nil
+	case "webp":
+		return ".webp", nil
+	case "png":
+		return ".png", nil
+	default:
+		return "", fmt.Errorf("unsupported frame format: %s", format)
+	}
+}
+
+// recordingFrameRate derives the playback frame rate from the screenshot interval
+func recordingFrameRate(interval time.Duration) int {
+	if interval <= 0 || interval >= time.Second {
+		return 1
+	}
+	return int(time.Second / interval)
+}
@@ -0,0 +1,277 @@
+package remoteaccess
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEncoder concatenates frame contents so tests can check ordering without ffmpeg
+type fakeEncoder struct {
+	frameRate int
+}
+
+func (e *fakeEncoder) Name() string        { return "fake" }
+func (e *fakeEncoder) ContentType() string { return "video/mp4" }
+func (e *fakeEncoder) Extension() string   { return ".mp4" }
+
+func (e *fakeEncoder) Encode(ctx context.Context, frames []string, frameRate int, w io.Writer) error {
+	e.frameRate = frameRate
+	fmt.Fprintf(w, "FAKE%d:", len(frames))
+	for _, frame := range frames {
+		data, err := os.ReadFile(frame)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newRecordingTestManager(t *testing.T) *SessionManager {
+	t.Helper()
+
+	config := DefaultRemoteAccessConfig()
+	config.RecordingEnabled = true
+	config.RecordingDir = t.TempDir()
+	return newTestSessionManager(t, config)
+}
+
+func TestRecording_ExportAssemblesFramesWithEncoder(t *testing.T) {
+	sm := newRecordingTestManager(t)
+	encoder := &fakeEncoder{}
+	sm.SetVideoEncoder(encoder)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	require.True(t, session.Settings.RecordSession)
+
+	require.NoError(t, sm.RecordFrame(session.ID, []byte("one|"), "jpeg"))
+	require.NoError(t, sm.RecordFrame(session.ID, []byte("two|"), "webp"))
+	require.NoError(t, sm.RecordFrame(session.ID, []byte("three"), "jpg"))
+
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/remoteaccess/sessions/"+session.ID+"/recording.mp4", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "video/mp4", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "fake", rec.Header().Get("X-Recording-Encoder"))
+	assert.Equal(t, "FAKE3:one|two|three", rec.Body.String())
+	assert.Equal(t, 1, encoder.frameRate)
+
+	// The temporary export file must not be left behind
+	exports, err := filepath.Glob(filepath.Join(sm.config.RecordingDir, session.ID, "export_*"))
+	require.NoError(t, err)
+	assert.Empty(t, exports)
+}
+
+func TestRecording_ExportIsBounded(t *testing.T) {
+	sm := newRecordingTestManager(t)
+	sm.SetVideoEncoder(&fakeEncoder{})
+	sm.config.MaxRecordingExportSize = 16
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.RecordFrame(session.ID, []byte(strings.Repeat("x", 64)), "jpeg"))
+
+	_, _, err = sm.ExportRecording(context.Background(), session.ID)
+	assert.ErrorIs(t, err, ErrRecordingTooLarge)
+}
+
+func TestRecording_FallsBackToFrameArchive(t *testing.T) {
+	sm := newRecordingTestManager(t)
+	sm.SetVideoEncoder(&FrameArchiveEncoder{})
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.RecordFrame(session.ID, []byte("frame"), "jpeg"))
+
+	path, encoder, err := sm.ExportRecording(context.Background(), session.ID)
+	require.NoError(t, err)
+	defer os.Remove(path)
+
+	assert.Equal(t, "application/zip", encoder.ContentType())
+	assert.Equal(t, ".zip", filepath.Ext(path))
+
+	_, _, err = sm.ExportRecording(context.Background(), "unknown-session")
+	assert.ErrorIs(t, err, ErrNoRecording)
+}
+
+func TestRecording_InputEventsAreRecordedAndBundled(t *testing.T) {
+	sm := newRecordingTestManager(t)
+	sm.config.RecordInputEvents = true
+	sm.SetVideoEncoder(&FrameArchiveEncoder{})
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.RecordFrame(session.ID, []byte("frame"), "jpeg"))
+
+	require.NoError(t, sm.RecordInputEvent(session.ID, "mouse_move", map[string]interface{}{"x": 10.0, "y": 20.0}))
+	require.NoError(t, sm.RecordInputEvent(session.ID, "key_down", map[string]interface{}{"key": "a"}))
+	require.NoError(t, sm.RecordInputEvent(session.ID, "key_down", map[string]interface{}{"key": "s", "field_type": "password"}))
+	require.NoError(t, sm.RecordInputEvent(session.ID, "mouse_click", map[string]interface{}{"button": "left"}))
+
+	events, err := sm.GetInputEvents(session.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, "mouse_move", events[0].EventType)
+	assert.Equal(t, 10.0, events[0].Data["x"])
+	assert.Equal(t, "a", events[1].Data["key"])
+	assert.True(t, events[2].Redacted)
+	assert.Nil(t, events[2].Data)
+	assert.Equal(t, "mouse_click", events[3].EventType)
+	for i := 1; i < len(events); i++ {
+		assert.GreaterOrEqual(t, events[i].Timestamp, events[i-1].Timestamp)
+	}
+
+	// The archive export carries the input log next to the frames
+	path, _, err := sm.ExportRecording(context.Background(), session.ID)
+	require.NoError(t, err)
+	defer os.Remove(path)
+
+	archive, err := zip.OpenReader(path)
+	require.NoError(t, err)
+	defer archive.Close()
+
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	assert.Equal(t, []string{"frame_000000.jpg", inputLogName}, names)
+}
+
+func TestRecording_InputEventLogIsBounded(t *testing.T) {
+	sm := newRecordingTestManager(t)
+	sm.config.RecordInputEvents = true
+	sm.config.RecordKeystrokes = false
+	sm.config.MaxInputEventLogSize = 200
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	var full error
+	for i := 0; i < 10 && full == nil; i++ {
+		full = sm.RecordInputEvent(session.ID, "key_press", map[string]interface{}{"key": "x"})
+	}
+	assert.ErrorIs(t, full, ErrInputLogFull)
+
+	events, err := sm.GetInputEvents(session.ID)
+	require.NoError(t, err)
+	require.NotEmpty(t, events)
+	for _, event := range events {
+		assert.True(t, event.Redacted, "keystrokes must not be stored when keystroke recording is off")
+	}
+
+	info, err := os.Stat(filepath.Join(sm.config.RecordingDir, session.ID, inputLogName))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(200))
+}
+
+func TestRecording_RecordsSessionMessagesForReplay(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.RecordingEnabled = true
+	config.RecordingDir = t.TempDir()
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	client := dialTestHandler(t, wh)
+	require.NoError(t, client.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       "client",
+	}))
+	assert.Equal(t, "session_registered", readTestMessage(t, client)["type"])
+
+	portal := dialTestHandlerAs(t, wh, "tech")
+	require.NoError(t, portal.WriteJSON(map[string]string{
+		"type":          "session_join",
+		"session_id":    session.ID,
+		"technician_id": "tech",
+	}))
+	assert.Equal(t, "session_joined", readTestMessage(t, portal)["type"])
+
+	for _, message := range []map[string]interface{}{
+		{"type": "control_command", "session_id": session.ID, "command": "hostname"},
+		{"type": "screen_capture", "session_id": session.ID, "quality": 60},
+		{"type": "input_event", "session_id": session.ID, "event_type": "key_down", "data": map[string]interface{}{"key": "s", "field_type": "password"}},
+	} {
+		require.NoError(t, portal.WriteJSON(message))
+		assert.Equal(t, message["type"], readTestMessage(t, client)["type"])
+	}
+
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+	download := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/remoteaccess/sessions/"+session.ID+"/recording", nil))
+		return rec
+	}
+
+	// The recording can be replayed while the session is still live
+	rec := download()
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	var recorded []RecordedMessage
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var message RecordedMessage
+		require.NoError(t, json.Unmarshal([]byte(line), &message))
+		recorded = append(recorded, message)
+	}
+	require.Len(t, recorded, 3)
+	assert.Equal(t, "control_command", recorded[0].Type)
+	assert.Contains(t, string(recorded[0].Message), `"command":"hostname"`)
+	assert.Equal(t, "screen_capture", recorded[1].Type)
+	assert.Equal(t, "input_event", recorded[2].Type)
+	assert.NotContains(t, string(recorded[2].Message), `"key":"s"`, "password keystrokes must not be recorded")
+	for i := 1; i < len(recorded); i++ {
+		assert.GreaterOrEqual(t, recorded[i].Timestamp, recorded[i-1].Timestamp)
+	}
+
+	// Terminating finalizes the file; nothing more is appended afterwards
+	require.NoError(t, sm.TerminateSession(session.ID))
+	assert.Empty(t, sm.recordings.messageLogs)
+	require.NoError(t, sm.RecordMessage(session.ID, "control_command", map[string]string{"command": "late"}))
+	assert.Equal(t, 3, strings.Count(download().Body.String(), "\n"))
+
+	// The recording is still served once the session has dropped out of the history
+	sm.mutex.Lock()
+	delete(sm.terminated, session.ID)
+	sm.mutex.Unlock()
+	_, exists := sm.GetSession(session.ID)
+	require.False(t, exists)
+	assert.Equal(t, http.StatusOK, download().Code)
+
+	// Recordings are kept for the audit retention period
+	path := filepath.Join(config.RecordingDir, session.ID, messageLogName)
+	sm.removeExpiredRecordings()
+	assert.FileExists(t, path)
+
+	old := time.Now().AddDate(0, 0, -config.AuditRetentionDays-1)
+	require.NoError(t, os.Chtimes(path, old, old))
+	sm.removeExpiredRecordings()
+	assert.NoDirExists(t, filepath.Dir(path))
+	assert.Equal(t, http.StatusNotFound, download().Code)
+}
@@ -0,0 +1,64 @@
+package remoteaccess
+
+import (
+	"sync"
+	"time"
+)
+
+// requestLimiter counts each client's requests over a sliding window. Clients idle for a whole
+// window are forgotten, so memory stays bounded by the clients active within the last window.
+type requestLimiter struct {
+	mutex     sync.Mutex
+	clients   map[string][]time.Time // client IP -> times of its requests within the window, oldest first
+	lastSweep time.Time
+}
+
+func newRequestLimiter() *requestLimiter {
+	return &requestLimiter{
+		clients:   make(map[string][]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow records a request from client at now if it is within limit requests per window. When it
+// isn't, it returns how long until the client's oldest request leaves the window.
+func (rl *requestLimiter) allow(client string, limit int, window time.Duration, now time.Time) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	cutoff := now.Add(-window)
+	if now.Sub(rl.lastSweep) >= window {
+		rl.sweep(cutoff)
+		rl.lastSweep = now
+	}
+
+	requests := rl.clients[client]
+	expired := 0
+	for expired < len(requests) && !requests[expired].After(cutoff) {
+		expired++
+	}
+	requests = requests[expired:]
+
+	if len(requests) >= limit {
+		rl.clients[client] = requests
+		return false, requests[0].Add(window).Sub(now)
+	}
+	rl.clients[client] = append(requests, now)
+	return true, 0
+}
+
+// sweep forgets clients with no requests since cutoff. Caller must hold rl.mutex.
+func (rl *requestLimiter) sweep(cutoff time.Time) {
+	for client, requests := range rl.clients {
+		if len(requests) == 0 || !requests[len(requests)-1].After(cutoff) {
+			delete(rl.clients, client)
+		}
+	}
+}
+
+// size returns how many clients the limiter is tracking
+func (rl *requestLimiter) size() int {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return len(rl.clients)
+}
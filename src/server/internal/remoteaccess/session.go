@@ -2,23 +2,29 @@ package remoteaccess
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+
+	"github.com/onlitec/onlidesk-server/internal/clock"
 )
 
 // RemoteAccessSession represents an active remote access session
 type RemoteAccessSession struct {
 	ID              string                 `json:"id"`
+	Code            string                 `json:"code,omitempty"` // short code read to the technician, valid while the session is live
 	ClientID        string                 `json:"client_id"`
 	TechnicianID    string                 `json:"technician_id"`
 	Status          SessionStatus          `json:"status"`
 	StartTime       time.Time              `json:"start_time"`
 	EndTime         *time.Time             `json:"end_time,omitempty"`
+	ExpiresAt       time.Time              `json:"expires_at"` // the session times out after this, unless extended
 	ClientInfo      *ClientInfo            `json:"client_info"`
 	Privileges      []PrivilegeRequest     `json:"privileges"`
 	ActivePrivileges map[string]*ActivePrivilege `json:"active_privileges"`
@@ -27,7 +33,24 @@ type RemoteAccessSession struct {
 	LastActivity    time.Time              `json:"last_activity"`
 	Settings        *SessionSettings       `json:"settings"`
 	Statistics      *SessionStatistics     `json:"statistics"`
+	Tags            map[string]string      `json:"tags,omitempty"`
 	mutex           sync.RWMutex           `json:"-"`
+	inputLogFull    bool                   // set once the input-event recording hit its size bound
+	activeTransfers map[string]bool        // IDs of file transfers started and not yet finished
+	commandHistory  []CommandRecord        // oldest first, bounded by Settings.MaxCommandHistory
+	heldCommands    map[string]ControlCommand // high-risk commands awaiting approval, by privilege request ID
+	clock           clock.Clock            // the manager's clock, for expiry and rate checks; the system clock when unset
+}
+
+// CommandRecord is a command sent to the client and, once the client reports back, its outcome
+type CommandRecord struct {
+	ID          string     `json:"id"`
+	Command     string     `json:"command"`
+	IssuedAt    time.Time  `json:"issued_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	Output      string     `json:"output,omitempty"`
+	Truncated   bool       `json:"truncated,omitempty"` // output was cut to Settings.MaxCommandOutput
 }
 
 // SessionStatus represents the status of a remote access session
@@ -41,6 +64,52 @@ const (
 	StatusExpired     SessionStatus = "expired"
 )
 
+// ErrTransferQuotaExceeded is returned when a file transfer would exceed the session's byte quota
+var ErrTransferQuotaExceeded = errors.New("session file transfer quota exceeded")
+
+// ErrInvalidTransferSize is returned when a file transfer declares a negative size or one above the maximum file size
+var ErrInvalidTransferSize = errors.New("invalid file transfer size")
+
+// ErrTooManyConcurrentTransfers is returned when a session already has as many file transfers in progress as it may
+var ErrTooManyConcurrentTransfers = errors.New("too many concurrent file transfers for this session")
+
+// ErrTransferDirectionBlocked is returned when the session's settings don't permit a transfer in the requested direction
+var ErrTransferDirectionBlocked = errors.New("file transfer direction not permitted for this session")
+
+// ErrInvalidTags is returned when session tags exceed their bounds
+var ErrInvalidTags = errors.New("invalid session tags")
+
+// Bounds on the tags an operator can attach to a session
+const (
+	MaxSessionTags    = 20
+	MaxTagKeyLength   = 64
+	MaxTagValueLength = 256
+)
+
+// File transfer directions, from the technician's point of view
+const (
+	TransferDirectionUpload   = "upload"   // technician to client machine
+	TransferDirectionDownload = "download" // client machine to technician
+)
+
+// ErrSessionEnded is returned when changing a session that was terminated or has expired
+var ErrSessionEnded = errors.New("session has ended")
+
+// ErrSessionDurationExceeded is returned when an extension would keep a session open longer than allowed
+var ErrSessionDurationExceeded = errors.New("session would exceed the maximum session duration")
+
+// ErrPrivilegeRateLimited is returned when a session requests privileges faster than allowed
+var ErrPrivilegeRateLimited = errors.New("privilege request rate limit exceeded")
+
+// ErrPrivilegeBacklogFull is returned when too many privilege requests across all sessions await a decision
+var ErrPrivilegeBacklogFull = errors.New("too many privilege requests awaiting decision")
+
+// ErrDenialReasonRequired is returned when denying a privilege without a reason while the policy requires one
+var ErrDenialReasonRequired = errors.New("a reason is required to deny a privilege request")
+
+// ErrCommandSelfApproval is returned when the technician who sent a held command tries to approve it
+var ErrCommandSelfApproval = errors.New("a command cannot be approved by the technician who sent it")
+
 // ClientInfo contains information about the client machine
 type ClientInfo struct {
 	Hostname        string            `json:"hostname"`
@@ -62,6 +131,8 @@ type PrivilegeRequest struct {
 	Status      string        `json:"status"` // pending, approved, denied
 	ApprovedBy  string        `json:"approved_by,omitempty"`
 	ApprovedAt  *time.Time    `json:"approved_at,omitempty"`
+	AssignedApprover string   `json:"assigned_approver,omitempty"` // only this approver may decide, if set
+	RequestedBy string        `json:"requested_by,omitempty"`      // technician who sent a held command
 }
 
 // ActivePrivilege represents an active privilege with expiration
@@ -74,7 +145,8 @@ type ActivePrivilege struct {
 
 // SessionSettings contains session configuration
 type SessionSettings struct {
-	AllowFileTransfer   bool          `json:"allow_file_transfer"`
+	AllowUpload         bool          `json:"allow_upload"`
+	AllowDownload       bool          `json:"allow_download"`
 	AllowClipboard      bool          `json:"allow_clipboard"`
 	AllowPrinting       bool          `json:"allow_printing"`
 	SessionTimeout      time.Duration `json:"session_timeout"`
@@ -82,33 +154,44 @@ type SessionSettings struct {
 	RecordSession       bool          `json:"record_session"`
 	RequireApproval     bool          `json:"require_approval"`
 	MaxPrivilegeDuration time.Duration `json:"max_privilege_duration"`
+	MaxSessionTransferBytes int64      `json:"max_session_transfer_bytes"` // 0 means unlimited
+	MaxConcurrentTransfers int         `json:"max_concurrent_transfers"`   // 0 means unlimited
+	MaxCommandHistory   int           `json:"max_command_history"` // commands kept, oldest dropped first; 0 keeps none
+	MaxCommandOutput    int           `json:"max_command_output"`  // bytes of each command's output kept
 }
 
 // SessionStatistics contains session usage statistics
 type SessionStatistics struct {
 	CommandsExecuted    int           `json:"commands_executed"`
 	FilesTransferred    int           `json:"files_transferred"`
+	ActiveTransfers     int           `json:"active_transfers"`
 	BytesTransferred    int64         `json:"bytes_transferred"`
 	ScreenshotsTaken    int           `json:"screenshots_taken"`
 	PrivilegeEscalations int          `json:"privilege_escalations"`
 	Duration            time.Duration `json:"duration"`
 	LastCommand         string        `json:"last_command,omitempty"`
 	LastCommandTime     *time.Time    `json:"last_command_time,omitempty"`
+	ClientLatency       time.Duration `json:"client_latency"`
+	PortalLatency       time.Duration `json:"portal_latency"`
+	HighLatency         bool          `json:"high_latency"`
 }
 
-// NewRemoteAccessSession creates a new remote access session
-func NewRemoteAccessSession(clientID, technicianID string, clientInfo *ClientInfo) *RemoteAccessSession {
+// NewRemoteAccessSession creates a new remote access session with the given ID
+func NewRemoteAccessSession(id, clientID, technicianID string, clientInfo *ClientInfo) *RemoteAccessSession {
+	now := time.Now().UTC()
+	settings := DefaultSessionSettings()
 	return &RemoteAccessSession{
-		ID:               uuid.New().String(),
+		ID:               id,
 		ClientID:         clientID,
 		TechnicianID:     technicianID,
 		Status:           StatusPending,
-		StartTime:        time.Now(),
+		StartTime:        now,
+		ExpiresAt:        now.Add(settings.SessionTimeout),
 		ClientInfo:       clientInfo,
 		Privileges:       make([]PrivilegeRequest, 0),
 		ActivePrivileges: make(map[string]*ActivePrivilege),
-		LastActivity:     time.Now(),
-		Settings:         DefaultSessionSettings(),
+		LastActivity:     now,
+		Settings:         settings,
 		Statistics:       &SessionStatistics{},
 	}
 }
@@ -116,7 +199,8 @@ func NewRemoteAccessSession(clientID, technicianID string, clientInfo *ClientInf
 // DefaultSessionSettings returns default session settings
 func DefaultSessionSettings() *SessionSettings {
 	return &SessionSettings{
-		AllowFileTransfer:    true,
+		AllowUpload:          true,
+		AllowDownload:        true,
 		AllowClipboard:       true,
 		AllowPrinting:        false,
 		SessionTimeout:       4 * time.Hour,
@@ -124,14 +208,43 @@ func DefaultSessionSettings() *SessionSettings {
 		RecordSession:        true,
 		RequireApproval:      true,
 		MaxPrivilegeDuration: 1 * time.Hour,
+		MaxCommandHistory:    100,
+		MaxCommandOutput:     4096,
+	}
+}
+
+// Extend pushes the session's expiry back by d and returns the new expiry. A maxDuration above
+// zero bounds how long after its start the session may expire.
+func (s *RemoteAccessSession) Extend(d, maxDuration time.Duration) (time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// A session past its expiry has ended even before the cleanup sweep marks it
+	if s.Status == StatusTerminated || s.Status == StatusExpired || s.now().After(s.ExpiresAt) {
+		return time.Time{}, ErrSessionEnded
+	}
+
+	expiresAt := s.ExpiresAt.Add(d)
+	if maxDuration > 0 && expiresAt.Sub(s.StartTime) > maxDuration {
+		return time.Time{}, fmt.Errorf("%w of %s", ErrSessionDurationExceeded, maxDuration)
+	}
+	s.ExpiresAt = expiresAt
+	return expiresAt, nil
+}
+
+// now returns the current time on the session's clock
+func (s *RemoteAccessSession) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
 	}
+	return s.clock.Now()
 }
 
 // UpdateActivity updates the last activity timestamp
 func (s *RemoteAccessSession) UpdateActivity() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.LastActivity = time.Now()
+	s.LastActivity = s.now().UTC()
 }
 
 // IsExpired checks if the session has expired
@@ -144,12 +257,12 @@ func (s *RemoteAccessSession) IsExpired() bool {
 	}
 	
 	// Check session timeout
-	if time.Since(s.StartTime) > s.Settings.SessionTimeout {
+	if s.now().After(s.ExpiresAt) {
 		return true
 	}
 	
 	// Check idle timeout
-	if time.Since(s.LastActivity) > s.Settings.IdleTimeout {
+	if s.now().Sub(s.LastActivity) > s.Settings.IdleTimeout {
 		return true
 	}
 	
@@ -161,12 +274,17 @@ func (s *RemoteAccessSession) RequestPrivilege(privilegeType PrivilegeType, just
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	
+	return s.addPrivilegeRequest(privilegeType, justification, duration)
+}
+
+// addPrivilegeRequest records a pending privilege request. Caller must hold s.mutex.
+func (s *RemoteAccessSession) addPrivilegeRequest(privilegeType PrivilegeType, justification string, duration time.Duration) string {
 	request := PrivilegeRequest{
 		ID:            uuid.New().String(),
 		Type:          privilegeType,
 		Justification: justification,
 		Duration:      duration,
-		RequestedAt:   time.Now(),
+		RequestedAt:   s.now().UTC(),
 		Status:        "pending",
 	}
 	
@@ -176,6 +294,69 @@ func (s *RemoteAccessSession) RequestPrivilege(privilegeType PrivilegeType, just
 	return request.ID
 }
 
+// RequestPrivilegeLimited adds a privilege request unless the session already made limit
+// requests within the trailing window. A limit of 0 disables the check.
+func (s *RemoteAccessSession) RequestPrivilegeLimited(privilegeType PrivilegeType, justification string, duration time.Duration, limit int, window time.Duration) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if limit > 0 {
+		since := s.now().Add(-window)
+		recent := 0
+		for _, request := range s.Privileges {
+			if request.RequestedAt.After(since) {
+				recent++
+			}
+		}
+		if recent >= limit {
+			return "", ErrPrivilegeRateLimited
+		}
+	}
+
+	return s.addPrivilegeRequest(privilegeType, justification, duration), nil
+}
+
+// PendingPrivilegeCount returns how many of the session's privilege requests await a decision
+func (s *RemoteAccessSession) PendingPrivilegeCount() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	pending := 0
+	for _, request := range s.Privileges {
+		if request.Status == "pending" {
+			pending++
+		}
+	}
+	return pending
+}
+
+// countPendingByApprover adds the session's undecided requests to counts, by assigned approver
+func (s *RemoteAccessSession) countPendingByApprover(counts map[string]int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, request := range s.Privileges {
+		if request.Status == "pending" && request.AssignedApprover != "" {
+			counts[request.AssignedApprover]++
+		}
+	}
+}
+
+// ExpirePendingPrivileges marks pending requests made before cutoff as expired and returns them
+func (s *RemoteAccessSession) ExpirePendingPrivileges(cutoff time.Time) []PrivilegeRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var expired []PrivilegeRequest
+	for i, request := range s.Privileges {
+		if request.Status == "pending" && request.RequestedAt.Before(cutoff) {
+			s.Privileges[i].Status = "expired"
+			expired = append(expired, s.Privileges[i])
+		}
+	}
+	return expired
+}
+
 // ApprovePrivilege approves a privilege request
 func (s *RemoteAccessSession) ApprovePrivilege(requestID, approvedBy string) error {
 	s.mutex.Lock()
@@ -186,23 +367,31 @@ func (s *RemoteAccessSession) ApprovePrivilege(requestID, approvedBy string) err
 			if request.Status != "pending" {
 				return fmt.Errorf("privilege request is not pending")
 			}
+			if request.AssignedApprover != "" && request.AssignedApprover != approvedBy {
+				return fmt.Errorf("privilege request is assigned to %s", request.AssignedApprover)
+			}
+			if request.Type == PrivilegeTypeCommand && approvedBy == request.RequestedBy {
+				return ErrCommandSelfApproval
+			}
 			
 			// Update request status
-			now := time.Now()
+			now := s.now().UTC()
 			s.Privileges[i].Status = "approved"
 			s.Privileges[i].ApprovedBy = approvedBy
 			s.Privileges[i].ApprovedAt = &now
 			
-			// Add to active privileges
-			activePrivilege := &ActivePrivilege{
-				Type:      request.Type,
-				GrantedAt: now,
-				ExpiresAt: now.Add(request.Duration),
-				GrantedBy: approvedBy,
+			// A command approval lets its one command run and grants nothing lasting
+			if request.Type != PrivilegeTypeCommand {
+				activePrivilege := &ActivePrivilege{
+					Type:      request.Type,
+					GrantedAt: now,
+					ExpiresAt: now.Add(request.Duration),
+					GrantedBy: approvedBy,
+				}
+
+				s.ActivePrivileges[string(request.Type)] = activePrivilege
 			}
 			
-			s.ActivePrivileges[string(request.Type)] = activePrivilege
-			
 			log.Printf("Privilege %s approved for session %s", request.Type, s.ID)
 			return nil
 		}
@@ -221,6 +410,9 @@ func (s *RemoteAccessSession) DenyPrivilege(requestID, deniedBy string) error {
 			if request.Status != "pending" {
 				return fmt.Errorf("privilege request is not pending")
 			}
+			if request.AssignedApprover != "" && request.AssignedApprover != deniedBy {
+				return fmt.Errorf("privilege request is assigned to %s", request.AssignedApprover)
+			}
 			
 			s.Privileges[i].Status = "denied"
 			s.Privileges[i].ApprovedBy = deniedBy
@@ -233,6 +425,34 @@ func (s *RemoteAccessSession) DenyPrivilege(requestID, deniedBy string) error {
 	return fmt.Errorf("privilege request not found")
 }
 
+// AssignPrivilegeApprover restricts who may decide a pending privilege request
+func (s *RemoteAccessSession) AssignPrivilegeApprover(requestID, approver string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.Privileges {
+		if s.Privileges[i].ID == requestID {
+			s.Privileges[i].AssignedApprover = approver
+			return nil
+		}
+	}
+
+	return fmt.Errorf("privilege request not found")
+}
+
+// GetPrivilegeRequest returns a copy of a privilege request
+func (s *RemoteAccessSession) GetPrivilegeRequest(requestID string) (PrivilegeRequest, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, request := range s.Privileges {
+		if request.ID == requestID {
+			return request, true
+		}
+	}
+	return PrivilegeRequest{}, false
+}
+
 // RevokePrivilege revokes an active privilege
 func (s *RemoteAccessSession) RevokePrivilege(privilegeType PrivilegeType) error {
 	s.mutex.Lock()
@@ -258,18 +478,23 @@ func (s *RemoteAccessSession) HasActivePrivilege(privilegeType PrivilegeType) bo
 		return false
 	}
 	
-	// Check if privilege has expired
-	if time.Now().After(privilege.ExpiresAt) {
-		// Remove expired privilege
-		s.mutex.RUnlock()
-		s.mutex.Lock()
-		delete(s.ActivePrivileges, string(privilegeType))
-		s.mutex.Unlock()
-		s.mutex.RLock()
-		return false
+	// An expired privilege is removed, and the client told, by the cleanup sweep
+	return !s.now().After(privilege.ExpiresAt)
+}
+
+// ExpireActivePrivileges removes the active privileges that have expired by now and returns them
+func (s *RemoteAccessSession) ExpireActivePrivileges(now time.Time) []ActivePrivilege {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var expired []ActivePrivilege
+	for key, privilege := range s.ActivePrivileges {
+		if now.After(privilege.ExpiresAt) {
+			delete(s.ActivePrivileges, key)
+			expired = append(expired, *privilege)
+		}
 	}
-	
-	return true
+	return expired
 }
 
 // Terminate terminates the session
@@ -278,9 +503,10 @@ func (s *RemoteAccessSession) Terminate() {
 	defer s.mutex.Unlock()
 	
 	s.Status = StatusTerminated
-	now := time.Now()
+	now := s.now().UTC()
 	s.EndTime = &now
 	s.Statistics.Duration = now.Sub(s.StartTime)
+	s.releaseFileTransfers()
 	
 	// Close connections
 	if s.ClientConn != nil {
@@ -309,7 +535,7 @@ func (s *RemoteAccessSession) GetDuration() time.Duration {
 	if s.EndTime != nil {
 		return s.EndTime.Sub(s.StartTime)
 	}
-	return time.Since(s.StartTime)
+	return s.now().Sub(s.StartTime)
 }
 
 // IncrementCommand increments the command counter
@@ -319,11 +545,90 @@ func (s *RemoteAccessSession) IncrementCommand(command string) {
 	
 	s.Statistics.CommandsExecuted++
 	s.Statistics.LastCommand = command
-	now := time.Now()
+	now := s.now().UTC()
 	s.Statistics.LastCommandTime = &now
 	s.LastActivity = now
 }
 
+// RecordCommand adds a command to the session's history, dropping the oldest once it's full
+func (s *RemoteAccessSession) RecordCommand(id, command string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	limit := s.Settings.MaxCommandHistory
+	if limit <= 0 {
+		return
+	}
+
+	s.commandHistory = append(s.commandHistory, CommandRecord{
+		ID:       id,
+		Command:  command,
+		IssuedAt: s.now().UTC(),
+	})
+	if excess := len(s.commandHistory) - limit; excess > 0 {
+		s.commandHistory = append([]CommandRecord(nil), s.commandHistory[excess:]...)
+	}
+}
+
+// RecordCommandResult stores the outcome the client reported for a command in the history,
+// returning the updated record. It fails if the command isn't in the history.
+func (s *RemoteAccessSession) RecordCommandResult(id string, exitCode int, output string) (CommandRecord, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := len(s.commandHistory) - 1; i >= 0; i-- {
+		record := &s.commandHistory[i]
+		if record.ID != id {
+			continue
+		}
+
+		if limit := s.Settings.MaxCommandOutput; len(output) > limit {
+			output = strings.ToValidUTF8(output[:limit], "")
+			record.Truncated = true
+		}
+		now := s.now().UTC()
+		record.CompletedAt = &now
+		record.ExitCode = &exitCode
+		record.Output = output
+		s.LastActivity = now
+		return *record, true
+	}
+	return CommandRecord{}, false
+}
+
+// holdCommand keeps a command back until the privilege request guarding it is decided
+func (s *RemoteAccessSession) holdCommand(requestID string, command ControlCommand) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.heldCommands == nil {
+		s.heldCommands = make(map[string]ControlCommand)
+	}
+	s.heldCommands[requestID] = command
+	for i := range s.Privileges {
+		if s.Privileges[i].ID == requestID {
+			s.Privileges[i].RequestedBy = command.RequestedBy
+		}
+	}
+}
+
+// releaseCommand removes and returns the command held for a privilege request, if any
+func (s *RemoteAccessSession) releaseCommand(requestID string) (ControlCommand, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	command, held := s.heldCommands[requestID]
+	delete(s.heldCommands, requestID)
+	return command, held
+}
+
+// GetCommandHistory returns a copy of the session's command history, oldest first
+func (s *RemoteAccessSession) GetCommandHistory() []CommandRecord {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]CommandRecord{}, s.commandHistory...)
+}
+
 // AddFileTransfer adds file transfer statistics
 func (s *RemoteAccessSession) AddFileTransfer(bytes int64) {
 	s.mutex.Lock()
@@ -331,7 +636,180 @@ func (s *RemoteAccessSession) AddFileTransfer(bytes int64) {
 	
 	s.Statistics.FilesTransferred++
 	s.Statistics.BytesTransferred += bytes
-	s.LastActivity = time.Now()
+	s.LastActivity = s.now().UTC()
+}
+
+// AllowsTransfer reports whether the session's settings permit a file transfer in the given direction
+func (s *RemoteAccessSession) AllowsTransfer(direction string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var allowed bool
+	switch direction {
+	case TransferDirectionUpload:
+		allowed = s.Settings.AllowUpload
+	case TransferDirectionDownload:
+		allowed = s.Settings.AllowDownload
+	default:
+		return fmt.Errorf("unknown file transfer direction %q", direction)
+	}
+
+	if !allowed {
+		return fmt.Errorf("%w: %s", ErrTransferDirectionBlocked, direction)
+	}
+	return nil
+}
+
+// ValidateTags checks a tag set against the tag bounds
+func ValidateTags(tags map[string]string) error {
+	if len(tags) > MaxSessionTags {
+		return fmt.Errorf("%w: %d tags, at most %d allowed", ErrInvalidTags, len(tags), MaxSessionTags)
+	}
+	for key, value := range tags {
+		if key == "" || strings.TrimSpace(key) != key {
+			return fmt.Errorf("%w: tag keys must be non-empty without surrounding whitespace", ErrInvalidTags)
+		}
+		if len(key) > MaxTagKeyLength {
+			return fmt.Errorf("%w: tag key %q longer than %d bytes", ErrInvalidTags, key, MaxTagKeyLength)
+		}
+		if len(value) > MaxTagValueLength {
+			return fmt.Errorf("%w: value of tag %q longer than %d bytes", ErrInvalidTags, key, MaxTagValueLength)
+		}
+	}
+	return nil
+}
+
+// SetTags replaces the session's tags, returning the previous ones
+func (s *RemoteAccessSession) SetTags(tags map[string]string) map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.Tags
+	s.Tags = make(map[string]string, len(tags))
+	for key, value := range tags {
+		s.Tags[key] = value
+	}
+	return previous
+}
+
+// GetTags returns a copy of the session's tags
+func (s *RemoteAccessSession) GetTags() map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	tags := make(map[string]string, len(s.Tags))
+	for key, value := range s.Tags {
+		tags[key] = value
+	}
+	return tags
+}
+
+// MatchesTags reports whether the session carries every filter tag. An empty filter value
+// matches any value of that key.
+func (s *RemoteAccessSession) MatchesTags(filter map[string]string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for key, value := range filter {
+		tag, exists := s.Tags[key]
+		if !exists || (value != "" && tag != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReserveFileTransfer records a new file transfer if the session has a free transfer slot and it fits
+// within the session's byte quota. The slot is held until FinishFileTransfer.
+func (s *RemoteAccessSession) ReserveFileTransfer(transferID string, bytes int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if bytes < 0 {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidTransferSize, bytes)
+	}
+	if s.activeTransfers[transferID] {
+		return fmt.Errorf("file transfer %s already started", transferID)
+	}
+
+	limit := s.Settings.MaxConcurrentTransfers
+	if limit > 0 && len(s.activeTransfers) >= limit {
+		return fmt.Errorf("%w: %d of %d in progress", ErrTooManyConcurrentTransfers, len(s.activeTransfers), limit)
+	}
+
+	quota := s.Settings.MaxSessionTransferBytes
+	if quota > 0 && s.Statistics.BytesTransferred+bytes > quota {
+		return fmt.Errorf("%w: %d of %d bytes already transferred", ErrTransferQuotaExceeded, s.Statistics.BytesTransferred, quota)
+	}
+
+	if s.activeTransfers == nil {
+		s.activeTransfers = make(map[string]bool)
+	}
+	s.activeTransfers[transferID] = true
+	s.Statistics.ActiveTransfers = len(s.activeTransfers)
+	s.Statistics.FilesTransferred++
+	s.Statistics.BytesTransferred += bytes
+	s.LastActivity = s.now().UTC()
+	return nil
+}
+
+// FinishFileTransfer frees a transfer's slot, returning false if the transfer wasn't in progress
+func (s *RemoteAccessSession) FinishFileTransfer(transferID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.activeTransfers[transferID] {
+		return false
+	}
+	delete(s.activeTransfers, transferID)
+	s.Statistics.ActiveTransfers = len(s.activeTransfers)
+	s.LastActivity = s.now().UTC()
+	return true
+}
+
+// ReleaseFileTransfers frees every transfer slot the session holds and returns how many were freed
+func (s *RemoteAccessSession) ReleaseFileTransfers() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.releaseFileTransfers()
+}
+
+// releaseFileTransfers frees every transfer slot; the caller holds s.mutex
+func (s *RemoteAccessSession) releaseFileTransfers() int {
+	released := len(s.activeTransfers)
+	s.activeTransfers = nil
+	s.Statistics.ActiveTransfers = 0
+	return released
+}
+
+// UpdateLatency records the smoothed round-trip latency measured on one side of the session
+func (s *RemoteAccessSession) UpdateLatency(role string, latency time.Duration, threshold time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch role {
+	case "client":
+		s.Statistics.ClientLatency = latency
+	case "portal":
+		s.Statistics.PortalLatency = latency
+	default:
+		return
+	}
+
+	s.Statistics.HighLatency = threshold > 0 &&
+		(s.Statistics.ClientLatency > threshold || s.Statistics.PortalLatency > threshold)
+}
+
+// markInputLogFull records that input-event recording stopped, reporting whether this is the first time
+func (s *RemoteAccessSession) markInputLogFull() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.inputLogFull {
+		return false
+	}
+	s.inputLogFull = true
+	return true
 }
 
 // IncrementScreenshot increments the screenshot counter
@@ -340,5 +818,5 @@ func (s *RemoteAccessSession) IncrementScreenshot() {
 	defer s.mutex.Unlock()
 	
 	s.Statistics.ScreenshotsTaken++
-	s.LastActivity = time.Now()
+	s.LastActivity = s.now().UTC()
 }
\ No newline at end of file
@@ -0,0 +1,81 @@
+package remoteaccess
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/onlitec/onlidesk-server/internal/idgen"
+)
+
+// Session code lengths, in characters not counting separators
+const (
+	minSessionCodeLength     = 6
+	maxSessionCodeLength     = 9
+	defaultSessionCodeLength = 6
+)
+
+// GetSessionByCode finds the live session holding a short code. Codes are matched the way a
+// person would read them back, ignoring case and separators, and stop resolving when the session ends.
+func (sm *SessionManager) GetSessionByCode(code string) (*RemoteAccessSession, bool) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	sessionID, exists := sm.codes[idgen.NormalizeShortCode(code)]
+	if !exists {
+		return nil, false
+	}
+	session, exists := sm.sessions[sessionID]
+	return session, exists
+}
+
+// SetCodeGenerator replaces the configured session code format with gen, e.g. a deterministic
+// one in tests. A nil gen restores the configured format.
+func (sm *SessionManager) SetCodeGenerator(gen idgen.Generator) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.codeGenerator = gen
+}
+
+// assignSessionCode gives a new session a code no live session holds, drawing again on collision.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) assignSessionCode(session *RemoteAccessSession) error {
+	generator := sm.codeGenerator
+	if generator == nil {
+		length := sm.config.SessionCodeLength
+		if length == 0 {
+			length = defaultSessionCodeLength
+		}
+		generator = idgen.ShortCode{Length: length}
+	}
+
+	code, err := idgen.Unique(generator, func(code string) bool {
+		_, taken := sm.codes[idgen.NormalizeShortCode(code)]
+		return taken
+	})
+	if err != nil {
+		return fmt.Errorf("failed to generate session code: %w", err)
+	}
+	code = idgen.NormalizeShortCode(code)
+
+	session.Code = code
+	sm.codes[code] = session.ID
+
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:  "session_code_generated",
+		SessionID:  session.ID,
+		ClientID:   session.ClientID,
+		Technician: session.TechnicianID,
+		Details:    map[string]interface{}{"code": code},
+		Severity:   "info",
+		Success:    true,
+		Timestamp:  time.Now().UTC(),
+	})
+	return nil
+}
+
+// releaseSessionCode frees an ended session's code for reuse. Caller must hold sm.mutex.
+func (sm *SessionManager) releaseSessionCode(session *RemoteAccessSession) {
+	if session.Code != "" && sm.codes[session.Code] == session.ID {
+		delete(sm.codes, session.Code)
+	}
+}
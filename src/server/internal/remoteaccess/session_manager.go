@@ -1,24 +1,51 @@
 package remoteaccess
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+
+	"github.com/onlitec/onlidesk-server/internal/approval"
+	"github.com/onlitec/onlidesk-server/internal/clock"
+	"github.com/onlitec/onlidesk-server/internal/configdiff"
+	"github.com/onlitec/onlidesk-server/internal/idgen"
+	"github.com/onlitec/onlidesk-server/internal/lifecycle"
 )
 
 // SessionManager manages all remote access sessions
 type SessionManager struct {
 	sessions      map[string]*RemoteAccessSession
+	terminated    map[string]*RemoteAccessSession // recently ended sessions kept for queries
 	connections   map[string]*websocket.Conn // sessionID -> connection
 	config        *RemoteAccessConfig
 	mutex         sync.RWMutex
 	cleanupTicker *time.Ticker
-	shutdownChan  chan bool
+	workers       *lifecycle.Group
 	auditLogger   *AuditLogger
+	recordings    *RecordingStore
+	connTracker   *ConnectionTracker
+	videoEncoder  VideoEncoder
+	draining      bool
+	rejections    []time.Time // recent capacity refusals, used to back off retry hints
+	failures      map[string]*failedAttempts // client IP -> recent failed session attempts
+	approver      *approval.ExternalApprover
+	idGenerator   idgen.Generator // overrides the default UUID session IDs when set
+	codes         map[string]string // session code -> ID of the live session it was given to
+	codeGenerator idgen.Generator // overrides the configured session code length when set
+	startTime     time.Time       // when the manager was created, for reporting uptime
+	metrics       SessionMetrics  // counts sessions and escalations when set
+	auditStore    *AuditStore     // searchable copy of the audit log, when audit_database is set
+	queues        approverQueues  // routed privilege requests per approver, and the overflow backlog
+	clock         clock.Clock     // times sessions, privileges, lockouts and cleanup
 }
 
 
@@ -31,10 +58,32 @@ func NewSessionManager(config *RemoteAccessConfig) *SessionManager {
 
 	sm := &SessionManager{
 		sessions:     make(map[string]*RemoteAccessSession),
+		terminated:   make(map[string]*RemoteAccessSession),
+		codes:        make(map[string]string),
+		failures:     make(map[string]*failedAttempts),
 		connections:  make(map[string]*websocket.Conn),
 		config:       config,
-		shutdownChan: make(chan bool),
-		auditLogger:  NewAuditLogger("./logs/remoteaccess", true),
+		workers:      lifecycle.NewGroup("remote access session manager"),
+		auditLogger:  NewAuditLogger(auditLogDir, true),
+		recordings:   NewRecordingStore(config.RecordingDir),
+		connTracker:  NewConnectionTracker(),
+		videoEncoder: NewVideoEncoder(config),
+		startTime:    time.Now(),
+		clock:        clock.Real{},
+	}
+
+	sm.auditLogger.SetFilter(config.AuditEventTypes, config.AuditMinSeverity)
+	sm.auditLogger.SetMask(config.AuditMaskedFields, config.AuditMaskMode)
+
+	// Searches go to the audit database when one is configured, and to the log files otherwise
+	if config.AuditDatabase != "" {
+		store, err := OpenAuditStore(config.AuditDatabase)
+		if err != nil {
+			log.Printf("Failed to open audit database, searching the log files instead: %v", err)
+		} else {
+			sm.auditStore = store
+			sm.auditLogger.SetStore(store)
+		}
 	}
 
 	// Start cleanup routine
@@ -48,25 +97,81 @@ func (sm *SessionManager) CreateSession(clientID, portalID string, clientInfo *C
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
-	// Check session limit
+	// Refuse new sessions while draining or at the session limit
+	if sm.draining {
+		return nil, fmt.Errorf("server is shutting down")
+	}
 	if len(sm.sessions) >= sm.config.MaxConcurrentSessions {
-		return nil, fmt.Errorf("maximum number of sessions reached")
+		sm.recordCapacityRejection()
+		return nil, ErrAtCapacity
+	}
+
+	// Callers without handshake data (e.g. the REST API) may pass nil
+	if clientInfo == nil {
+		clientInfo = &ClientInfo{}
+	}
+	if clientInfo.SystemInfo == nil {
+		clientInfo.SystemInfo = make(map[string]string)
+	}
+	if err := clientInfo.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Refuse outdated or unsupported client agents
+	if err := sm.config.ClientPolicy.Check(clientInfo); err != nil {
+		sm.auditLogger.LogEvent(AuditEvent{
+			EventType:   "client_policy_rejected",
+			ClientID:    clientID,
+			Technician:  portalID,
+			IPAddress:   clientInfo.IPAddress,
+			UserAgent:   clientInfo.UserAgent,
+			Details:     map[string]interface{}{"os": clientInfo.OperatingSystem, "reason": err.Error()},
+			Severity:    "warning",
+			Success:     false,
+			Timestamp:   time.Now().UTC(),
+		})
+		return nil, err
+	}
+
+	sessionID, err := idgen.Unique(sm.sessionIDGenerator(), func(id string) bool {
+		_, live := sm.sessions[id]
+		_, ended := sm.terminated[id]
+		return live || ended
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
 	}
 
 	// Create new session
-	session := NewRemoteAccessSession(clientID, portalID, clientInfo)
+	session := NewRemoteAccessSession(sessionID, clientID, portalID, clientInfo)
+	now := sm.clock.Now().UTC()
+	session.clock = sm.clock
+	session.StartTime = now
+	session.LastActivity = now
 	session.Settings = &SessionSettings{
-		AllowFileTransfer:   sm.config.FileTransferEnabled,
+		AllowUpload:         sm.config.FileTransferEnabled && !sm.config.DenyUploads,
+		AllowDownload:       sm.config.FileTransferEnabled && !sm.config.DenyDownloads,
 		AllowClipboard:      true, // Default value
 		AllowPrinting:        true, // Default value
 		SessionTimeout:       sm.config.SessionTimeout,
 		IdleTimeout:          sm.config.IdleTimeout,
-		RecordSession:       false, // Default value
+		RecordSession:       sm.config.RecordingEnabled,
 		RequireApproval:     sm.config.PrivilegeEscalation.RequireApproval,
 		MaxPrivilegeDuration: sm.config.PrivilegeEscalation.MaxPrivilegeDuration,
+		MaxSessionTransferBytes: sm.config.MaxSessionTransferBytes,
+		MaxConcurrentTransfers: sm.config.MaxConcurrentTransfersPerSession,
+		MaxCommandHistory:   sm.config.MaxCommandHistory,
+		MaxCommandOutput:    sm.config.MaxCommandOutput,
 	}
+	session.ExpiresAt = session.StartTime.Add(sm.config.SessionTimeout)
 
+	if err := sm.assignSessionCode(session); err != nil {
+		return nil, err
+	}
 	sm.sessions[session.ID] = session
+	if sm.metrics != nil {
+		sm.metrics.SessionCreated()
+	}
 
 	// Log session creation
 	sm.auditLogger.LogEvent(AuditEvent{
@@ -78,7 +183,7 @@ func (sm *SessionManager) CreateSession(clientID, portalID string, clientInfo *C
 		Details:     map[string]interface{}{"hostname": clientInfo.Hostname, "os": clientInfo.OperatingSystem},
 		Severity:    "info",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
 	log.Printf("Created remote access session %s for client %s with technician %s", session.ID, clientID, portalID)
@@ -91,17 +196,23 @@ func (sm *SessionManager) GetSession(sessionID string) (*RemoteAccessSession, bo
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
 	session, exists := sm.sessions[sessionID]
+	if !exists {
+		session, exists = sm.terminated[sessionID]
+	}
 	return session, exists
 }
 
-// GetAllSessions returns all active sessions
+// GetAllSessions returns all live sessions plus recently terminated ones still held in memory
 func (sm *SessionManager) GetAllSessions() []*RemoteAccessSession {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
-	sessions := make([]*RemoteAccessSession, 0, len(sm.sessions))
+	sessions := make([]*RemoteAccessSession, 0, len(sm.sessions)+len(sm.terminated))
 	for _, session := range sm.sessions {
 		sessions = append(sessions, session)
 	}
+	for _, session := range sm.terminated {
+		sessions = append(sessions, session)
+	}
 	return sessions
 }
 
@@ -131,6 +242,11 @@ func (sm *SessionManager) GetSessionsByTechnician(technicianID string) []*Remote
 			sessions = append(sessions, session)
 		}
 	}
+	for _, session := range sm.terminated {
+		if session.TechnicianID == technicianID {
+			sessions = append(sessions, session)
+		}
+	}
 
 	return sessions
 }
@@ -146,6 +262,11 @@ func (sm *SessionManager) GetSessionsByClient(clientID string) []*RemoteAccessSe
 			sessions = append(sessions, session)
 		}
 	}
+	for _, session := range sm.terminated {
+		if session.ClientID == clientID {
+			sessions = append(sessions, session)
+		}
+	}
 
 	return sessions
 }
@@ -172,6 +293,7 @@ func (sm *SessionManager) RegisterConnection(sessionID string, conn *websocket.C
 	}
 
 	session.UpdateActivity()
+	sm.connTracker.Associate(conn, sessionID, role)
 
 	// Log connection registration
 	sm.auditLogger.LogEvent(AuditEvent{
@@ -181,7 +303,7 @@ func (sm *SessionManager) RegisterConnection(sessionID string, conn *websocket.C
 		Details:     map[string]interface{}{"role": role},
 		Severity:    "info",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
 	log.Printf("Registered %s connection for session %s", role, sessionID)
@@ -189,6 +311,48 @@ func (sm *SessionManager) RegisterConnection(sessionID string, conn *websocket.C
 	return nil
 }
 
+// UpdateClientInfo validates machine information reported by a session's client and stores it
+func (sm *SessionManager) UpdateClientInfo(sessionID string, info *ClientInfo) error {
+	sm.mutex.RLock()
+	session, exists := sm.sessions[sessionID]
+	sm.mutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+
+	if info == nil {
+		return fmt.Errorf("%w: client_info is required", ErrInvalidClientInfo)
+	}
+	if err := info.Validate(); err != nil {
+		sm.auditLogger.LogEvent(AuditEvent{
+			EventType:   "client_info_rejected",
+			SessionID:   sessionID,
+			ClientID:    session.ClientID,
+			Details:     map[string]interface{}{"reason": err.Error()},
+			Severity:    "warning",
+			Success:     false,
+			Timestamp:   time.Now().UTC(),
+		})
+		return err
+	}
+
+	session.UpdateClientInfo(info)
+
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:   "client_info_updated",
+		SessionID:   sessionID,
+		ClientID:    session.ClientID,
+		IPAddress:   info.IPAddress,
+		Details:     map[string]interface{}{"hostname": info.Hostname, "operating_system": info.OperatingSystem, "current_user": info.CurrentUser},
+		Severity:    "info",
+		Success:     true,
+		Timestamp:   time.Now().UTC(),
+	})
+
+	return nil
+}
+
 // UnregisterConnection removes a WebSocket connection
 func (sm *SessionManager) UnregisterConnection(sessionID, role string) {
 	sm.mutex.Lock()
@@ -220,6 +384,7 @@ func (sm *SessionManager) TerminateSession(sessionID string) error {
 	}
 
 	session.Terminate()
+	sm.retireSession(sessionID)
 
 	// Remove connections
 	delete(sm.connections, fmt.Sprintf("%s_client", sessionID))
@@ -232,7 +397,7 @@ func (sm *SessionManager) TerminateSession(sessionID string) error {
 		Details:     map[string]interface{}{"duration": session.GetDuration().String()},
 		Severity:    "info",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
 	log.Printf("Terminated session %s", sessionID)
@@ -240,27 +405,103 @@ func (sm *SessionManager) TerminateSession(sessionID string) error {
 	return nil
 }
 
+// ExtendSession pushes a live session's expiry back by d, within the configured maximum session
+// duration, and returns the new expiry
+func (sm *SessionManager) ExtendSession(sessionID string, d time.Duration) (time.Time, error) {
+	if d <= 0 {
+		return time.Time{}, fmt.Errorf("extension must be positive")
+	}
+
+	session, exists := sm.GetSession(sessionID)
+	if !exists {
+		return time.Time{}, fmt.Errorf("session not found")
+	}
+
+	maxDuration := sm.GetConfig().MaxSessionDuration
+	expiresAt, err := session.Extend(d, maxDuration)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:   "session_extended",
+		SessionID:   sessionID,
+		ClientID:    session.ClientID,
+		Technician:  session.TechnicianID,
+		Details:     map[string]interface{}{"extension": d.String(), "expires_at": expiresAt, "max_session_duration": maxDuration.String()},
+		Severity:    "info",
+		Success:     true,
+		Timestamp:   time.Now().UTC(),
+	})
+
+	return expiresAt, nil
+}
+
 // RequestPrivilege requests privilege escalation for a session
 func (sm *SessionManager) RequestPrivilege(sessionID string, privilegeType PrivilegeType, justification string, duration time.Duration) (string, error) {
+	return sm.requestPrivilege(sessionID, privilegeType, justification, duration, nil)
+}
+
+// requestPrivilege records a privilege request and routes it for a decision. A held command is
+// attached before routing, so a decision made right away by policy still finds it.
+func (sm *SessionManager) requestPrivilege(sessionID string, privilegeType PrivilegeType, justification string, duration time.Duration, held *ControlCommand) (string, error) {
 	sm.mutex.RLock()
 	session, exists := sm.sessions[sessionID]
+	approver := sm.approver
 	sm.mutex.RUnlock()
 
 	if !exists {
 		return "", fmt.Errorf("session not found")
 	}
 
+	config := sm.GetConfig()
+
 	// Validate duration
 	// Use default max duration if not configured
 	maxDuration := time.Hour * 24 // Default 24 hours
-	if sm.config.PrivilegeEscalation.MaxPrivilegeDuration > 0 {
-		maxDuration = sm.config.PrivilegeEscalation.MaxPrivilegeDuration
+	if config.PrivilegeEscalation.MaxPrivilegeDuration > 0 {
+		maxDuration = config.PrivilegeEscalation.MaxPrivilegeDuration
 	}
 	if duration > maxDuration {
 		duration = maxDuration
 	}
 
-	requestID := session.RequestPrivilege(privilegeType, justification, duration)
+	// Hold the manager lock so concurrent requests can't overshoot the global backlog cap
+	sm.mutex.Lock()
+	maxPending := config.PrivilegeEscalation.MaxPendingRequests
+	pending := sm.pendingPrivilegeCount()
+	if maxPending > 0 && pending >= maxPending {
+		sm.mutex.Unlock()
+		sm.auditLogger.LogEvent(AuditEvent{
+			EventType:   "privilege_request_throttled",
+			SessionID:   sessionID,
+			ClientID:    session.ClientID,
+			Technician:  session.TechnicianID,
+			Details:     map[string]interface{}{"privilege_type": privilegeType, "pending_requests": pending, "max_pending_requests": maxPending, "reason": ErrPrivilegeBacklogFull.Error()},
+			Severity:    "warning",
+			Success:     false,
+			Timestamp:   time.Now().UTC(),
+		})
+		return "", ErrPrivilegeBacklogFull
+	}
+	requestID, err := session.RequestPrivilegeLimited(privilegeType, justification, duration, config.PrivilegeEscalation.MaxRequestsPerMinute, time.Minute)
+	sm.mutex.Unlock()
+	if err != nil {
+		sm.auditLogger.LogEvent(AuditEvent{
+			EventType:   "privilege_request_throttled",
+			SessionID:   sessionID,
+			ClientID:    session.ClientID,
+			Technician:  session.TechnicianID,
+			Details:     map[string]interface{}{"privilege_type": privilegeType, "max_requests_per_minute": config.PrivilegeEscalation.MaxRequestsPerMinute, "reason": err.Error()},
+			Severity:    "warning",
+			Success:     false,
+			Timestamp:   time.Now().UTC(),
+		})
+		return "", err
+	}
+	if held != nil {
+		session.holdCommand(requestID, *held)
+	}
 
 	// Log privilege request
 	sm.auditLogger.LogEvent(AuditEvent{
@@ -269,17 +510,86 @@ func (sm *SessionManager) RequestPrivilege(sessionID string, privilegeType Privi
 		Details:     map[string]interface{}{"privilege_type": privilegeType, "justification": justification, "duration": duration.String()},
 		Severity:    "warning",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
-	// Notify portal if connected
-	if session.PortalConn != nil {
+	// Route to the external approval service when configured, else notify the portal if
+	// connected, otherwise fall back to the unattended policy
+	if config.PrivilegeEscalation.RequireApproval && approver.Enabled() {
+		sm.requestExternalPrivilegeApproval(approver, session, requestID, privilegeType, justification, duration)
+	} else if session.PortalConn != nil {
 		sm.notifyPortalPrivilegeRequest(session, requestID, privilegeType, justification, duration)
+	} else {
+		sm.applyUnattendedPolicy(session, requestID, privilegeType, justification, duration)
 	}
 
 	return requestID, nil
 }
 
+// unattendedPolicyActor is recorded as the approver of requests decided by an unattended policy
+const unattendedPolicyActor = "policy:unattended"
+
+// applyUnattendedPolicy routes a privilege request from a session without a portal to the
+// configured approver, or decides it automatically when a policy says so
+func (sm *SessionManager) applyUnattendedPolicy(session *RemoteAccessSession, requestID string, privilegeType PrivilegeType, justification string, duration time.Duration) {
+	session.mutex.RLock()
+	clientID := session.ClientID
+	session.mutex.RUnlock()
+
+	config := sm.GetConfig()
+	organizationalUnit := config.PrivilegeEscalation.EnrolledOrganizationalUnits[clientID]
+	rule, ok := config.PrivilegeEscalation.UnattendedRule(clientID)
+	if !ok {
+		return
+	}
+
+	decision := rule.Decision
+	approver := ""
+	var err error
+	switch {
+	case rule.Approver != "":
+		decision = "routed"
+		if approver, err = sm.routeToApprover(session, requestID, rule.Approvers()); err == nil && approver == "" {
+			decision = "backlogged"
+		}
+	case decision == UnattendedDecisionApprove && !config.IsPrivilegeAllowed(privilegeType):
+		// A policy can never grant a privilege that is disallowed outright
+		decision = UnattendedDecisionDeny
+		err = sm.DenyPrivilege(session.ID, requestID, unattendedPolicyActor, "privilege type is not allowed")
+	case decision == UnattendedDecisionApprove:
+		err = sm.ApprovePrivilege(session.ID, requestID, unattendedPolicyActor)
+	case decision == UnattendedDecisionDeny:
+		err = sm.DenyPrivilege(session.ID, requestID, unattendedPolicyActor, "denied by the unattended session policy")
+	}
+
+	details := map[string]interface{}{
+		"request_id":          requestID,
+		"privilege_type":      privilegeType,
+		"decision":            decision,
+		"organizational_unit": organizationalUnit,
+	}
+	if approver != "" {
+		details["approver"] = approver
+	}
+	if rule.ClientID == "" && rule.OrganizationalUnit == "" {
+		details["rule"] = "default"
+	}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:   "privilege_policy_decision",
+		SessionID:   session.ID,
+		ClientID:    clientID,
+		Technician:  approver,
+		Details:     details,
+		Severity:    "warning",
+		Success:     err == nil,
+		Timestamp:   time.Now().UTC(),
+	})
+}
+
 // ApprovePrivilege approves a privilege request
 func (sm *SessionManager) ApprovePrivilege(sessionID, requestID, approvedBy string) error {
 	sm.mutex.RLock()
@@ -294,6 +604,14 @@ func (sm *SessionManager) ApprovePrivilege(sessionID, requestID, approvedBy stri
 	if err != nil {
 		return err
 	}
+	if request, found := session.GetPrivilegeRequest(requestID); found {
+		sm.mutex.RLock()
+		metrics := sm.metrics
+		sm.mutex.RUnlock()
+		if metrics != nil {
+			metrics.PrivilegeEscalated(request.Type)
+		}
+	}
 
 	// Log privilege approval
 	sm.auditLogger.LogEvent(AuditEvent{
@@ -303,9 +621,14 @@ func (sm *SessionManager) ApprovePrivilege(sessionID, requestID, approvedBy stri
 		Details:     map[string]interface{}{"request_id": requestID},
 		Severity:    "warning",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
+	if command, held := session.releaseCommand(requestID); held {
+		sm.sendApprovedCommand(session, command)
+	}
+	sm.drainApprovalBacklog()
+
 	// Notify client of privilege approval
 	if session.ClientConn != nil {
 		sm.notifyClientPrivilegeApproved(session, requestID)
@@ -314,15 +637,20 @@ func (sm *SessionManager) ApprovePrivilege(sessionID, requestID, approvedBy stri
 	return nil
 }
 
-// DenyPrivilege denies a privilege request
-func (sm *SessionManager) DenyPrivilege(sessionID, requestID, deniedBy string) error {
+// DenyPrivilege denies a privilege request, recording why in the audit log. The reason may only
+// be empty when the privilege escalation policy doesn't require one.
+func (sm *SessionManager) DenyPrivilege(sessionID, requestID, deniedBy, reason string) error {
 	sm.mutex.RLock()
 	session, exists := sm.sessions[sessionID]
+	requireReason := sm.config.PrivilegeEscalation.RequireDenialReason
 	sm.mutex.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("session not found")
 	}
+	if requireReason && strings.TrimSpace(reason) == "" {
+		return ErrDenialReasonRequired
+	}
 
 	err := session.DenyPrivilege(requestID, deniedBy)
 	if err != nil {
@@ -334,12 +662,17 @@ func (sm *SessionManager) DenyPrivilege(sessionID, requestID, deniedBy string) e
 		EventType:   "privilege_denied",
 		SessionID:   sessionID,
 		Technician:  deniedBy,
-		Details:     map[string]interface{}{"request_id": requestID},
+		Details:     map[string]interface{}{"request_id": requestID, "reason": reason},
 		Severity:    "info",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
+	if command, held := session.releaseCommand(requestID); held {
+		sm.dropHeldCommand(session, command, reason)
+	}
+	sm.drainApprovalBacklog()
+
 	// Notify client of privilege denial
 	if session.ClientConn != nil {
 		sm.notifyClientPrivilegeDenied(session, requestID)
@@ -370,20 +703,22 @@ func (sm *SessionManager) RevokePrivilege(sessionID string, privilegeType Privil
 		Details:     map[string]interface{}{"privilege_type": privilegeType},
 		Severity:    "warning",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
 	// Notify client of privilege revocation
 	if session.ClientConn != nil {
-		sm.notifyClientPrivilegeRevoked(session, privilegeType)
+		sm.notifyClientPrivilegeRevoked(session, privilegeType, "revoked")
 	}
 
 	return nil
 }
 
-// GenerateSessionID generates a unique session ID
+// GenerateSessionID generates a session ID
 func (sm *SessionManager) GenerateSessionID() string {
-	return uuid.New().String()
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.sessionIDGenerator().NewID()
 }
 
 // ValidateSessionID validates a session ID format
@@ -392,6 +727,44 @@ func (sm *SessionManager) ValidateSessionID(sessionID string) bool {
 	return err == nil
 }
 
+// SetIDGenerator replaces the UUID session IDs with gen, e.g. a deterministic one in tests.
+// A nil gen restores UUIDs. Short codes for people to read aloud are given alongside the ID
+// (see assignSessionCode) and only ever used to look a session up.
+func (sm *SessionManager) SetIDGenerator(gen idgen.Generator) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.idGenerator = gen
+}
+
+// SetClock sets the clock sessions, privileges, lockouts and cleanup are timed on, and the audit log
+// named by, e.g. a manual one in tests. Sessions created before the call keep the clock they had.
+func (sm *SessionManager) SetClock(c clock.Clock) {
+	sm.mutex.Lock()
+	sm.clock = c
+	sm.mutex.Unlock()
+	sm.auditLogger.SetClock(c)
+}
+
+// now returns the current time on the manager's clock
+func (sm *SessionManager) now() time.Time {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.clock.Now()
+}
+
+// sessionIDGenerator returns the generator for new session IDs. Caller must hold sm.mutex.
+func (sm *SessionManager) sessionIDGenerator() idgen.Generator {
+	if sm.idGenerator != nil {
+		return sm.idGenerator
+	}
+	return idgen.UUID{}
+}
+
+// Uptime returns how long the session manager has been running
+func (sm *SessionManager) Uptime() time.Duration {
+	return time.Since(sm.startTime).Round(time.Millisecond)
+}
+
 // GetStatistics returns session statistics
 func (sm *SessionManager) GetStatistics() map[string]interface{} {
 	sm.mutex.RLock()
@@ -399,9 +772,13 @@ func (sm *SessionManager) GetStatistics() map[string]interface{} {
 
 	stats := map[string]interface{}{
 		"total_sessions":   len(sm.sessions),
+		"terminated_sessions": len(sm.terminated),
 		"active_sessions":  0,
 		"pending_sessions": 0,
 		"total_connections": len(sm.connections),
+		"high_latency_sessions": 0,
+		"pending_privilege_requests": sm.pendingPrivilegeCount(),
+		"uptime":           sm.Uptime().String(),
 		"config":           sm.config,
 	}
 
@@ -411,57 +788,424 @@ func (sm *SessionManager) GetStatistics() map[string]interface{} {
 		} else if session.Status == StatusPending {
 			stats["pending_sessions"] = stats["pending_sessions"].(int) + 1
 		}
+		session.mutex.RLock()
+		if session.Statistics.HighLatency {
+			stats["high_latency_sessions"] = stats["high_latency_sessions"].(int) + 1
+		}
+		session.mutex.RUnlock()
 	}
 
 	return stats
 }
 
+// TrackConnection starts latency tracking for a newly opened WebSocket from clientIP, recording the
+// subject it authenticated as
+func (sm *SessionManager) TrackConnection(conn *websocket.Conn, clientIP, identity string) {
+	sm.connTracker.Track(conn, clientIP, identity)
+}
+
+// UntrackConnection stops latency tracking for a closed WebSocket
+func (sm *SessionManager) UntrackConnection(conn *websocket.Conn) {
+	stats, tracked := sm.connTracker.Lookup(conn)
+	sm.connTracker.Untrack(conn)
+	if !tracked || stats.SessionID == "" {
+		return
+	}
+
+	// Transfers can't go on once either peer is gone, so they give up their slots
+	sm.mutex.RLock()
+	session, exists := sm.sessions[stats.SessionID]
+	peer := exists && (session.ClientConn == conn || session.PortalConn == conn)
+	sm.mutex.RUnlock()
+	if peer {
+		if released := session.ReleaseFileTransfers(); released > 0 {
+			log.Printf("Released %d file transfer slots of session %s after its %s disconnected", released, session.ID, stats.Role)
+		}
+	}
+}
+
+// RecordPong records a ping round trip and propagates the smoothed latency to the owning session
+func (sm *SessionManager) RecordPong(conn *websocket.Conn, rtt time.Duration) {
+	sm.mutex.RLock()
+	threshold := sm.config.HighLatencyThreshold
+	sm.mutex.RUnlock()
+
+	stats, tracked := sm.connTracker.RecordRTT(conn, rtt, threshold)
+	if !tracked || stats.SessionID == "" {
+		return
+	}
+
+	if session, exists := sm.GetSession(stats.SessionID); exists {
+		session.UpdateLatency(stats.Role, stats.Latency, threshold)
+	}
+}
+
+// GetConnections returns stats for every open WebSocket connection
+func (sm *SessionManager) GetConnections() []ConnectionStats {
+	return sm.connTracker.List()
+}
+
+// AuthorizeFileTransfer checks a transfer's direction against the session's settings, auditing blocked directions
+func (sm *SessionManager) AuthorizeFileTransfer(sessionID, direction, filename string, fileSize int64) error {
+	session, exists := sm.GetSession(sessionID)
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+
+	if err := session.AllowsTransfer(direction); err != nil {
+		sm.logTransferBlocked(session, direction, filename, fileSize, err)
+		return err
+	}
+
+	// A negative size would credit the session's quota instead of charging it
+	if maxSize := sm.GetConfig().MaxFileSize; fileSize < 0 || (maxSize > 0 && fileSize > maxSize) {
+		err := fmt.Errorf("%w: %d bytes, must be between 0 and %d", ErrInvalidTransferSize, fileSize, maxSize)
+		sm.logTransferBlocked(session, direction, filename, fileSize, err)
+		return err
+	}
+
+	return nil
+}
+
+// StartFileTransfer checks a new file transfer's direction, takes one of the session's transfer slots and
+// charges it against the session's byte quota, auditing refusals
+func (sm *SessionManager) StartFileTransfer(sessionID, transferID, direction, filename string, fileSize int64) error {
+	if err := sm.AuthorizeFileTransfer(sessionID, direction, filename, fileSize); err != nil {
+		return err
+	}
+
+	session, exists := sm.GetSession(sessionID)
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+
+	if err := session.ReserveFileTransfer(transferID, fileSize); err != nil {
+		sm.logTransferBlocked(session, direction, filename, fileSize, err)
+		return err
+	}
+
+	return nil
+}
+
+// FinishFileTransfer frees the slot a completed, cancelled or denied file transfer held
+func (sm *SessionManager) FinishFileTransfer(sessionID, transferID string) bool {
+	session, exists := sm.GetSession(sessionID)
+	if !exists {
+		return false
+	}
+	return session.FinishFileTransfer(transferID)
+}
+
+// SetSessionTags validates and replaces a session's tags, auditing the change
+func (sm *SessionManager) SetSessionTags(sessionID string, tags map[string]string, updatedBy string) error {
+	if err := ValidateTags(tags); err != nil {
+		return err
+	}
+
+	session, exists := sm.GetSession(sessionID)
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+
+	previous := session.SetTags(tags)
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:   "session_tags_updated",
+		SessionID:   session.ID,
+		ClientID:    session.ClientID,
+		Technician:  session.TechnicianID,
+		Details:     map[string]interface{}{"previous_tags": previous, "tags": tags, "updated_by": updatedBy},
+		Severity:    "info",
+		Success:     true,
+		Timestamp:   time.Now().UTC(),
+	})
+
+	return nil
+}
+
+// logTransferBlocked audits a refused file transfer
+func (sm *SessionManager) logTransferBlocked(session *RemoteAccessSession, direction, filename string, fileSize int64, reason error) {
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:   "file_transfer_blocked",
+		SessionID:   session.ID,
+		ClientID:    session.ClientID,
+		Technician:  session.TechnicianID,
+		Details:     map[string]interface{}{"filename": filename, "file_size": fileSize, "direction": direction, "reason": reason.Error()},
+		Severity:    "warning",
+		Success:     false,
+		Timestamp:   time.Now().UTC(),
+	})
+}
+
+// RecordFrame stores a screen frame for a session that has recording enabled
+func (sm *SessionManager) RecordFrame(sessionID string, data []byte, format string) error {
+	session, exists := sm.GetSession(sessionID)
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+	if !session.Settings.RecordSession {
+		return nil
+	}
+
+	return sm.recordings.SaveFrame(sessionID, data, format)
+}
+
+// RecordInputEvent stores an input event for replay when the session records input. Keystroke
+// payloads are dropped when keystroke recording is off or the event was flagged as sensitive.
+func (sm *SessionManager) RecordInputEvent(sessionID, eventType string, data map[string]interface{}) error {
+	session, exists := sm.GetSession(sessionID)
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+
+	sm.mutex.RLock()
+	recordInput := sm.config.RecordInputEvents
+	recordKeystrokes := sm.config.RecordKeystrokes
+	maxSize := sm.config.MaxInputEventLogSize
+	sm.mutex.RUnlock()
+
+	if !recordInput || !session.Settings.RecordSession {
+		return nil
+	}
+
+	record := InputEventRecord{
+		Timestamp: time.Now().UnixMilli(),
+		EventType: eventType,
+		Data:      data,
+	}
+	if redactInput(eventType, data, recordKeystrokes) {
+		record.Data = nil
+		record.Redacted = true
+	}
+
+	err := sm.recordings.SaveInputEvent(sessionID, record, maxSize)
+	if errors.Is(err, ErrInputLogFull) && session.markInputLogFull() {
+		sm.auditLogger.LogEvent(AuditEvent{
+			EventType:   "input_recording_truncated",
+			SessionID:   sessionID,
+			Details:     map[string]interface{}{"max_input_event_log_size": maxSize},
+			Severity:    "warning",
+			Success:     false,
+			Timestamp:   time.Now().UTC(),
+		})
+	}
+	return err
+}
+
+// redactInput reports whether an input event's payload must be left out of recordings
+func redactInput(eventType string, data map[string]interface{}, recordKeystrokes bool) bool {
+	return isKeyboardEvent(eventType) && (!recordKeystrokes || isSensitiveInput(data))
+}
+
+// RecordMessage appends a message to the recording of a live session that has recording enabled
+func (sm *SessionManager) RecordMessage(sessionID, messageType string, message interface{}) error {
+	sm.mutex.RLock()
+	session, exists := sm.sessions[sessionID]
+	sm.mutex.RUnlock()
+
+	if !exists || !session.Settings.RecordSession {
+		return nil
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recorded message: %v", err)
+	}
+	return sm.recordings.AppendMessage(sessionID, RecordedMessage{
+		Timestamp: time.Now().UnixMilli(),
+		Type:      messageType,
+		Message:   data,
+	})
+}
+
+// GetRecording returns a session's recorded messages as JSON lines in recording order, for replay.
+// The caller must close the stream.
+func (sm *SessionManager) GetRecording(sessionID string) (io.ReadCloser, error) {
+	return sm.recordings.OpenMessages(sessionID)
+}
+
+// removeExpiredRecordings deletes recordings older than the audit retention period
+func (sm *SessionManager) removeExpiredRecordings() {
+	retentionDays := sm.GetConfig().AuditRetentionDays
+	if retentionDays <= 0 {
+		return
+	}
+
+	removed, err := sm.recordings.RemoveExpired(sm.now().AddDate(0, 0, -retentionDays))
+	if err != nil {
+		log.Printf("Failed to remove expired recordings: %v", err)
+	}
+	for _, sessionID := range removed {
+		sm.auditLogger.LogEvent(AuditEvent{
+			EventType:   "recording_deleted",
+			SessionID:   sessionID,
+			Details:     map[string]interface{}{"audit_retention_days": retentionDays},
+			Severity:    "info",
+			Success:     true,
+			Timestamp:   time.Now().UTC(),
+		})
+	}
+}
+
+// pruneAuditStore deletes audit database rows older than the audit retention period
+func (sm *SessionManager) pruneAuditStore() {
+	retentionDays := sm.GetConfig().AuditRetentionDays
+	if sm.auditStore == nil || retentionDays <= 0 {
+		return
+	}
+
+	deleted, err := sm.auditStore.DeleteBefore(sm.now().AddDate(0, 0, -retentionDays))
+	if err != nil {
+		log.Printf("Failed to prune audit database: %v", err)
+		return
+	}
+	if deleted > 0 {
+		sm.auditLogger.LogEvent(AuditEvent{
+			EventType: "audit_events_pruned",
+			Details:   map[string]interface{}{"deleted": deleted, "audit_retention_days": retentionDays},
+			Severity:  "info",
+			Success:   true,
+			Timestamp: time.Now().UTC(),
+		})
+	}
+}
+
+// GetInputEvents returns the input events recorded for a session
+func (sm *SessionManager) GetInputEvents(sessionID string) ([]InputEventRecord, error) {
+	return sm.recordings.ReadInputEvents(sessionID)
+}
+
+// ExportRecording assembles a session's recorded frames and returns the output path and the encoder used.
+// The caller is responsible for removing the file.
+func (sm *SessionManager) ExportRecording(ctx context.Context, sessionID string) (string, VideoEncoder, error) {
+	sm.mutex.RLock()
+	encoder := sm.videoEncoder
+	frameRate := recordingFrameRate(sm.config.ScreenshotInterval)
+	maxSize := sm.config.MaxRecordingExportSize
+	sm.mutex.RUnlock()
+
+	path, err := sm.recordings.Export(ctx, sessionID, encoder, frameRate, maxSize)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:   "recording_exported",
+		SessionID:   sessionID,
+		Details:     map[string]interface{}{"encoder": encoder.Name()},
+		Severity:    "info",
+		Success:     true,
+		Timestamp:   time.Now().UTC(),
+	})
+
+	return path, encoder, nil
+}
+
+// SetVideoEncoder replaces the encoder backend used for recording exports
+func (sm *SessionManager) SetVideoEncoder(encoder VideoEncoder) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.videoEncoder = encoder
+}
+
 // GetConfig returns the current configuration
 func (sm *SessionManager) GetConfig() *RemoteAccessConfig {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
 	return sm.config
 }
 
-// UpdateConfig updates the configuration
+// UpdateConfig swaps in a new configuration and reschedules the cleanup ticker if its interval changed.
+// The config is replaced, never mutated, so callers holding a previous GetConfig result keep a consistent view.
 func (sm *SessionManager) UpdateConfig(config *RemoteAccessConfig) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
+
+	previous := sm.config
 	sm.config = config
+	sm.auditLogger.SetFilter(config.AuditEventTypes, config.AuditMinSeverity)
+	sm.auditLogger.SetMask(config.AuditMaskedFields, config.AuditMaskMode)
+
+	if sm.cleanupTicker != nil && config.CleanupInterval > 0 && config.CleanupInterval != previous.CleanupInterval {
+		sm.cleanupTicker.Reset(config.CleanupInterval)
+	}
+}
+
+// UpdateConfigBy applies a configuration update made by actor and audits the fields it changed
+func (sm *SessionManager) UpdateConfigBy(config *RemoteAccessConfig, actor, ipAddress string) error {
+	changes, err := configdiff.Diff(sm.GetConfig(), config)
+	if err != nil {
+		return err
+	}
+
+	sm.UpdateConfig(config)
+
+	sm.auditLogger.LogEvent(AuditEvent{
+		EventType:  "config_updated",
+		Technician: actor,
+		IPAddress:  ipAddress,
+		Details: map[string]interface{}{
+			"config_type": "remote_access",
+			"changes":     changes,
+		},
+		Severity:  "info",
+		Success:   true,
+		Timestamp: time.Now().UTC(),
+	})
+	return nil
 }
 
 // Shutdown gracefully shuts down the session manager
 func (sm *SessionManager) Shutdown() {
 	log.Println("Shutting down session manager...")
 
-	// Stop cleanup routine
+	// Stop cleanup routine and wait for it, so it can't race the terminations below
+	sm.workers.Stop(lifecycle.DefaultStopTimeout)
 	if sm.cleanupTicker != nil {
 		sm.cleanupTicker.Stop()
 	}
-	close(sm.shutdownChan)
 
 	// Terminate all sessions
 	sm.mutex.Lock()
 	for sessionID := range sm.sessions {
 		sm.sessions[sessionID].Terminate()
+		sm.retireSession(sessionID)
 	}
 	sm.mutex.Unlock()
 
+	if sm.auditStore != nil {
+		sm.auditLogger.SetStore(nil)
+		if err := sm.auditStore.Close(); err != nil {
+			log.Printf("Failed to close audit database: %v", err)
+		}
+	}
+
 	log.Println("Session manager shutdown complete")
 }
 
 // startCleanupRoutine starts the cleanup routine for expired sessions
 func (sm *SessionManager) startCleanupRoutine() {
-	sm.cleanupTicker = time.NewTicker(sm.config.CleanupInterval)
+	// The ticker is only ever reset in place, so the goroutine can hold on to it
+	ticker := time.NewTicker(sm.config.CleanupInterval)
+	sm.cleanupTicker = ticker
 
-	go func() {
+	sm.workers.Go("cleanup routine", func(stop <-chan struct{}) {
 		for {
 			select {
-			case <-sm.cleanupTicker.C:
+			case <-ticker.C:
 				sm.cleanupExpiredSessions()
-			case <-sm.shutdownChan:
+				sm.expirePendingPrivileges()
+				sm.revokeExpiredPrivileges()
+				sm.drainApprovalBacklog()
+				sm.sendDueDigests()
+				sm.evictTerminatedSessions()
+				sm.pruneFailedAttempts()
+				sm.removeExpiredRecordings()
+				sm.pruneAuditStore()
+			case <-stop:
 				return
 			}
 		}
-	}()
+	})
 }
 
 // cleanupExpiredSessions removes expired sessions
@@ -481,6 +1225,7 @@ func (sm *SessionManager) cleanupExpiredSessions() {
 		session := sm.sessions[sessionID]
 		session.Status = StatusExpired
 		session.Terminate()
+		sm.retireSession(sessionID)
 
 		// Remove connections
 		delete(sm.connections, fmt.Sprintf("%s_client", sessionID))
@@ -493,19 +1238,202 @@ func (sm *SessionManager) cleanupExpiredSessions() {
 			Details:     map[string]interface{}{"duration": session.GetDuration().String()},
 			Severity:    "info",
 			Success:     true,
-			Timestamp:   time.Now(),
+			Timestamp:   time.Now().UTC(),
 		})
 
 		log.Printf("Expired session %s cleaned up", sessionID)
 	}
 }
 
+// pendingPrivilegeCount returns the number of undecided privilege requests across live sessions.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) pendingPrivilegeCount() int {
+	pending := 0
+	for _, session := range sm.sessions {
+		pending += session.PendingPrivilegeCount()
+	}
+	return pending
+}
+
+// expirePendingPrivileges expires privilege requests left undecided past the pending timeout,
+// making room under the backlog cap
+func (sm *SessionManager) expirePendingPrivileges() {
+	timeout := sm.GetConfig().PrivilegeEscalation.PendingRequestTimeout
+	if timeout <= 0 {
+		return
+	}
+	cutoff := sm.now().Add(-timeout)
+
+	sm.mutex.RLock()
+	sessions := make([]*RemoteAccessSession, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	sm.mutex.RUnlock()
+
+	for _, session := range sessions {
+		for _, request := range session.ExpirePendingPrivileges(cutoff) {
+			sm.auditLogger.LogEvent(AuditEvent{
+				EventType:   "privilege_request_expired",
+				SessionID:   session.ID,
+				ClientID:    session.ClientID,
+				Technician:  session.TechnicianID,
+				Details:     map[string]interface{}{"request_id": request.ID, "privilege_type": request.Type, "pending_request_timeout": timeout.String()},
+				Severity:    "info",
+				Success:     false,
+				Timestamp:   time.Now().UTC(),
+			})
+			if command, held := session.releaseCommand(request.ID); held {
+				sm.dropHeldCommand(session, command, "approval request expired")
+			}
+		}
+	}
+}
+
+// revokeExpiredPrivileges revokes active privileges whose duration has run out and tells the
+// clients, rather than waiting for the next HasActivePrivilege check to notice
+func (sm *SessionManager) revokeExpiredPrivileges() {
+	now := sm.now()
+
+	sm.mutex.RLock()
+	sessions := make([]*RemoteAccessSession, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	sm.mutex.RUnlock()
+
+	for _, session := range sessions {
+		for _, privilege := range session.ExpireActivePrivileges(now) {
+			sm.auditLogger.LogEvent(AuditEvent{
+				EventType:   "privilege_revoked",
+				SessionID:   session.ID,
+				ClientID:    session.ClientID,
+				Technician:  session.TechnicianID,
+				Details:     map[string]interface{}{"privilege_type": privilege.Type, "reason": "expired", "granted_by": privilege.GrantedBy, "expires_at": privilege.ExpiresAt},
+				Severity:    "info",
+				Success:     true,
+				Timestamp:   time.Now().UTC(),
+			})
+			sm.notifyClientPrivilegeRevoked(session, privilege.Type, "expired")
+		}
+	}
+}
+
+// retireSession moves a session from the live map into terminated history.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) retireSession(sessionID string) {
+	session, exists := sm.sessions[sessionID]
+	if !exists {
+		return
+	}
+
+	delete(sm.sessions, sessionID)
+	sm.releaseSessionCode(session)
+	sm.terminated[sessionID] = session
+	sm.recordings.Release(sessionID)
+	if err := sm.recordings.Finalize(sessionID); err != nil {
+		log.Printf("Failed to finalize recording for session %s: %v", sessionID, err)
+	}
+
+	// Enforce the history cap right away so bursts of terminations can't grow memory
+	// between cleanup ticks
+	if max := sm.config.MaxTerminatedSessions; max > 0 {
+		for len(sm.terminated) > max {
+			sm.evictOldestTerminated()
+		}
+	}
+}
+
+// evictOldestTerminated drops the terminated session that ended first.
+// Caller must hold sm.mutex.
+func (sm *SessionManager) evictOldestTerminated() {
+	var oldestID string
+	var oldestEnd time.Time
+	for sessionID, session := range sm.terminated {
+		endTime := sessionEndTime(session)
+		if oldestID == "" || endTime.Before(oldestEnd) {
+			oldestID = sessionID
+			oldestEnd = endTime
+		}
+	}
+	delete(sm.terminated, oldestID)
+}
+
+// evictTerminatedSessions drops terminated sessions older than the retention window
+func (sm *SessionManager) evictTerminatedSessions() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	cutoff := sm.clock.Now().Add(-sm.config.TerminatedSessionRetention)
+	evicted := 0
+	for sessionID, session := range sm.terminated {
+		if sessionEndTime(session).Before(cutoff) {
+			delete(sm.terminated, sessionID)
+			evicted++
+		}
+	}
+
+	if evicted > 0 {
+		log.Printf("Evicted %d terminated sessions from memory", evicted)
+	}
+}
+
+// sessionEndTime returns when a session ended, falling back to its last activity
+func sessionEndTime(session *RemoteAccessSession) time.Time {
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+	if session.EndTime != nil {
+		return *session.EndTime
+	}
+	return session.LastActivity
+}
+
 // Notification methods
 func (sm *SessionManager) notifyPortalPrivilegeRequest(session *RemoteAccessSession, requestID string, privilegeType PrivilegeType, justification string, duration time.Duration) {
 	// Implementation for notifying portal of privilege request
 	// This would send a WebSocket message to the portal
 }
 
+// notifyApproverPrivilegeRequest sends an unattended session's privilege request to every portal the approver has open
+func (sm *SessionManager) notifyApproverPrivilegeRequest(approver string, session *RemoteAccessSession, requestID string, privilegeType PrivilegeType, justification string, duration time.Duration) {
+	for _, portal := range sm.approverPortals(approver) {
+		notification := map[string]interface{}{
+			"type":           "privilege_request_routed",
+			"session_id":     session.ID,
+			"client_id":      session.ClientID,
+			"request_id":     requestID,
+			"privilege_type": privilegeType,
+			"justification":  justification,
+			"duration":       duration.String(),
+			"timestamp":      time.Now().UTC(),
+		}
+		if err := sm.writeMessage(portal, notification); err != nil {
+			log.Printf("Failed to notify approver %s: %v", approver, err)
+		}
+	}
+}
+
+// ErrNoConnection is returned when writing to a connection that is nil or was never established
+var ErrNoConnection = errors.New("no websocket connection")
+
+// writeMessage encodes a message in the connection's negotiated encoding and sends it
+func (sm *SessionManager) writeMessage(conn *websocket.Conn, message interface{}) error {
+	// A zero-value connection has nothing beneath it and would panic when written to
+	if conn == nil || conn.UnderlyingConn() == nil {
+		return ErrNoConnection
+	}
+	codec := sm.connTracker.Codec(conn)
+	data, err := codec.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %v", err)
+	}
+
+	defer sm.connTracker.LockWrites(conn)()
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return sm.connTracker.WriteMessage(conn, codec.FrameType(), data)
+}
+
 func (sm *SessionManager) notifyClientPrivilegeApproved(session *RemoteAccessSession, requestID string) {
 	// Implementation for notifying client of privilege approval
 	// This would send a WebSocket message to the client
@@ -516,7 +1444,23 @@ func (sm *SessionManager) notifyClientPrivilegeDenied(session *RemoteAccessSessi
 	// This would send a WebSocket message to the client
 }
 
-func (sm *SessionManager) notifyClientPrivilegeRevoked(session *RemoteAccessSession, privilegeType PrivilegeType) {
-	// Implementation for notifying client of privilege revocation
-	// This would send a WebSocket message to the client
+// notifyClientPrivilegeRevoked tells the client a privilege is no longer held and why, e.g. "expired"
+func (sm *SessionManager) notifyClientPrivilegeRevoked(session *RemoteAccessSession, privilegeType PrivilegeType, reason string) {
+	sm.mutex.RLock()
+	conn := session.ClientConn
+	sm.mutex.RUnlock()
+	if conn == nil {
+		return
+	}
+
+	notification := map[string]interface{}{
+		"type":           "privilege_revoked",
+		"session_id":     session.ID,
+		"privilege_type": privilegeType,
+		"reason":         reason,
+		"timestamp":      time.Now().UTC(),
+	}
+	if err := sm.writeMessage(conn, notification); err != nil {
+		log.Printf("Failed to notify client of revoked privilege for session %s: %v", session.ID, err)
+	}
 }
\ No newline at end of file
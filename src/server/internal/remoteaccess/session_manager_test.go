@@ -0,0 +1,886 @@
+package remoteaccess
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onlitec/onlidesk-server/internal/approval"
+	"github.com/onlitec/onlidesk-server/internal/clock"
+	"github.com/onlitec/onlidesk-server/internal/delivery"
+	"github.com/onlitec/onlidesk-server/internal/idgen"
+)
+
+// newTestSessionManager creates a session manager that writes its audit log under the test dir
+func newTestSessionManager(t *testing.T, config *RemoteAccessConfig) *SessionManager {
+	t.Helper()
+
+	sm := NewSessionManager(config)
+	sm.auditLogger.Close()
+	sm.auditLogger = NewAuditLogger(t.TempDir(), true)
+	t.Cleanup(sm.Shutdown)
+	return sm
+}
+
+func TestSessionManager_CreateSessionWithNilClientInfo(t *testing.T) {
+	sm := newTestSessionManager(t, nil)
+
+	var session *RemoteAccessSession
+	var err error
+	require.NotPanics(t, func() {
+		session, err = sm.CreateSession("client-1", "tech-1", nil)
+	})
+	require.NoError(t, err)
+
+	require.NotNil(t, session.ClientInfo)
+	assert.Empty(t, session.ClientInfo.Hostname)
+	assert.Empty(t, session.ClientInfo.IPAddress)
+	assert.NotNil(t, session.ClientInfo.SystemInfo)
+	assert.Equal(t, StatusPending, session.Status)
+
+	stored, exists := sm.GetSession(session.ID)
+	require.True(t, exists)
+	assert.Same(t, session, stored)
+}
+
+func TestSessionManager_TerminatedSessionsAreEvicted(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxConcurrentSessions = 2
+	config.CleanupInterval = 10 * time.Millisecond
+	config.TerminatedSessionRetention = 50 * time.Millisecond
+	sm := newTestSessionManager(t, config)
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		session, err := sm.CreateSession("client", "tech", nil)
+		require.NoError(t, err, "terminated sessions must not count against the concurrency limit")
+		require.NoError(t, sm.TerminateSession(session.ID))
+		ids = append(ids, session.ID)
+	}
+
+	// Recently terminated sessions remain queryable
+	for _, id := range ids {
+		session, exists := sm.GetSession(id)
+		require.True(t, exists)
+		assert.Equal(t, StatusTerminated, session.Status)
+	}
+	assert.Len(t, sm.GetSessionsByClient("client"), 4)
+
+	assert.Eventually(t, func() bool {
+		sm.mutex.RLock()
+		defer sm.mutex.RUnlock()
+		return len(sm.terminated) == 0 && len(sm.sessions) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	_, exists := sm.GetSession(ids[0])
+	assert.False(t, exists)
+}
+
+func TestSessionManager_TerminatedHistoryIsCapped(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxTerminatedSessions = 2
+	sm := newTestSessionManager(t, config)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		session, err := sm.CreateSession("client", "tech", nil)
+		require.NoError(t, err)
+		require.NoError(t, sm.TerminateSession(session.ID))
+		ids = append(ids, session.ID)
+		time.Sleep(time.Millisecond)
+	}
+
+	_, exists := sm.GetSession(ids[0])
+	assert.False(t, exists, "oldest terminated session should be evicted first")
+	for _, id := range ids[1:] {
+		_, exists := sm.GetSession(id)
+		assert.True(t, exists)
+	}
+}
+
+func TestSessionManager_FileTransferQuota(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxSessionTransferBytes = 100
+	sm := newTestSessionManager(t, config)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), session.Settings.MaxSessionTransferBytes)
+
+	require.NoError(t, sm.StartFileTransfer(session.ID, "transfer-a", TransferDirectionUpload, "a.log", 60))
+	require.NoError(t, sm.StartFileTransfer(session.ID, "transfer-b", TransferDirectionUpload, "b.log", 40))
+
+	err = sm.StartFileTransfer(session.ID, "transfer-c", TransferDirectionUpload, "c.log", 1)
+	assert.ErrorIs(t, err, ErrTransferQuotaExceeded)
+
+	// Sizes outside 0..max_file_size can't stretch the quota
+	for _, size := range []int64{-50, config.MaxFileSize + 1} {
+		err = sm.StartFileTransfer(session.ID, "transfer-d", TransferDirectionUpload, "d.log", size)
+		assert.ErrorIs(t, err, ErrInvalidTransferSize)
+	}
+
+	assert.Equal(t, 2, session.Statistics.FilesTransferred)
+	assert.Equal(t, int64(100), session.Statistics.BytesTransferred)
+
+	// Terminating the session frees the slots its transfers held
+	assert.Equal(t, 2, session.Statistics.ActiveTransfers)
+	require.NoError(t, sm.TerminateSession(session.ID))
+	assert.Equal(t, 0, session.Statistics.ActiveTransfers)
+	assert.False(t, session.FinishFileTransfer("transfer-a"))
+}
+
+func TestSessionManager_TagsSessionsAndFiltersByTag(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+
+	setTags := func(sessionID string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/remoteaccess/sessions/"+sessionID+"/tags", bytes.NewBufferString(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	listIDs := func(query string) []string {
+		req := httptest.NewRequest(http.MethodGet, "/api/remoteaccess/sessions"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var response struct {
+			Sessions []struct {
+				ID string `json:"id"`
+			} `json:"sessions"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		var ids []string
+		for _, session := range response.Sessions {
+			ids = append(ids, session.ID)
+		}
+		return ids
+	}
+
+	urgent, err := sm.CreateSession("client-a", "tech", nil)
+	require.NoError(t, err)
+	routine, err := sm.CreateSession("client-b", "tech", nil)
+	require.NoError(t, err)
+	_, err = sm.CreateSession("client-c", "tech", nil)
+	require.NoError(t, err)
+
+	rec := setTags(urgent.ID, `{"tags": {"ticket": "1234", "priority": "high"}, "updated_by": "operator"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = setTags(routine.ID, `{"tags": {"ticket": "5678"}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, map[string]string{"ticket": "1234", "priority": "high"}, urgent.GetTags())
+
+	assert.ElementsMatch(t, []string{urgent.ID, routine.ID}, listIDs("?tag=ticket"))
+	assert.Equal(t, []string{urgent.ID}, listIDs("?tag=ticket:1234"))
+	assert.Equal(t, []string{urgent.ID}, listIDs("?tag=ticket&tag=priority:high"))
+	assert.Empty(t, listIDs("?tag=ticket:5678&tag=priority:high"))
+	assert.Len(t, listIDs(""), 3)
+
+	// Updates replace the whole set
+	require.NoError(t, sm.SetSessionTags(urgent.ID, map[string]string{"priority": "low"}, "operator"))
+	assert.Empty(t, listIDs("?tag=ticket:1234"))
+
+	tooMany := make(map[string]string)
+	for i := 0; i <= MaxSessionTags; i++ {
+		tooMany[string(rune('a'+i))] = "x"
+	}
+	assert.ErrorIs(t, sm.SetSessionTags(urgent.ID, tooMany, "operator"), ErrInvalidTags)
+	assert.ErrorIs(t, sm.SetSessionTags(urgent.ID, map[string]string{"note": string(make([]byte, MaxTagValueLength+1))}, "operator"), ErrInvalidTags)
+	assert.Equal(t, http.StatusBadRequest, setTags(urgent.ID, `{"tags": {"": "empty"}}`).Code)
+	assert.Equal(t, http.StatusNotFound, setTags("missing", `{"tags": {}}`).Code)
+	assert.Equal(t, map[string]string{"priority": "low"}, urgent.GetTags())
+
+	var updates int
+	for _, eventType := range readAuditEventTypes(t, sm.auditLogger) {
+		if eventType == "session_tags_updated" {
+			updates++
+		}
+	}
+	assert.Equal(t, 3, updates)
+}
+
+func TestSessionManager_FileTransferDirections(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		denyUploads   bool
+		denyDownloads bool
+		blocked       string
+		allowed       string
+	}{
+		{name: "upload allowed, download blocked", denyDownloads: true, blocked: TransferDirectionDownload, allowed: TransferDirectionUpload},
+		{name: "download allowed, upload blocked", denyUploads: true, blocked: TransferDirectionUpload, allowed: TransferDirectionDownload},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultRemoteAccessConfig()
+			config.DenyUploads = tc.denyUploads
+			config.DenyDownloads = tc.denyDownloads
+			sm := newTestSessionManager(t, config)
+
+			session, err := sm.CreateSession("client", "tech", nil)
+			require.NoError(t, err)
+			assert.Equal(t, !tc.denyUploads, session.Settings.AllowUpload)
+			assert.Equal(t, !tc.denyDownloads, session.Settings.AllowDownload)
+
+			require.NoError(t, sm.StartFileTransfer(session.ID, "transfer-allowed", tc.allowed, "fix.log", 10))
+
+			err = sm.StartFileTransfer(session.ID, "transfer-blocked", tc.blocked, "secrets.log", 10)
+			assert.ErrorIs(t, err, ErrTransferDirectionBlocked)
+			assert.ErrorIs(t, sm.AuthorizeFileTransfer(session.ID, tc.blocked, "secrets.log", 10), ErrTransferDirectionBlocked)
+			assert.Error(t, sm.StartFileTransfer(session.ID, "transfer-sideways", "sideways", "x.log", 10))
+
+			// Blocked transfers are audited and not charged against the quota
+			assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "file_transfer_blocked")
+			assert.Equal(t, 1, session.Statistics.FilesTransferred)
+			assert.Equal(t, int64(10), session.Statistics.BytesTransferred)
+		})
+	}
+}
+
+func TestSessionManager_PrivilegeRequestsAreRateLimited(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.PrivilegeEscalation.MaxRequestsPerMinute = 3
+	sm := newTestSessionManager(t, config)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	other, err := sm.CreateSession("other-client", "tech", nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := sm.RequestPrivilege(session.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+		require.NoError(t, err)
+	}
+
+	_, err = sm.RequestPrivilege(session.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+	assert.ErrorIs(t, err, ErrPrivilegeRateLimited)
+	assert.Len(t, session.Privileges, 3)
+	assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "privilege_request_throttled")
+
+	// Other sessions have their own budget
+	_, err = sm.RequestPrivilege(other.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+	assert.NoError(t, err)
+
+	// Once the oldest request leaves the window another one is allowed
+	session.mutex.Lock()
+	session.Privileges[0].RequestedAt = time.Now().Add(-2 * time.Minute)
+	session.mutex.Unlock()
+
+	_, err = sm.RequestPrivilege(session.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+	assert.NoError(t, err)
+}
+
+func TestSessionManager_UnattendedPrivilegeRoutesToConfiguredApprover(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.PrivilegeEscalation.UnattendedApprovers = []UnattendedApprovalRule{
+		{ClientID: "kiosk-lobby", Approver: "svc-approver"},
+	}
+	sm := newTestSessionManager(t, config)
+
+	session, err := sm.CreateSession("kiosk-lobby", "tech", nil)
+	require.NoError(t, err)
+
+	requestID, err := sm.RequestPrivilege(session.ID, PrivilegeTypeServices, "restart print spooler", time.Minute)
+	require.NoError(t, err)
+
+	request, found := session.GetPrivilegeRequest(requestID)
+	require.True(t, found)
+	assert.Equal(t, "pending", request.Status)
+	assert.Equal(t, "svc-approver", request.AssignedApprover)
+
+	// Only the designated approver may decide the request
+	assert.Error(t, sm.ApprovePrivilege(session.ID, requestID, "someone-else"))
+	require.NoError(t, sm.ApprovePrivilege(session.ID, requestID, "svc-approver"))
+	assert.True(t, session.HasActivePrivilege(PrivilegeTypeServices))
+
+	assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "privilege_policy_decision")
+}
+
+func TestSessionManager_UnattendedPrivilegeAutoPolicy(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.PrivilegeEscalation.UnattendedApprovers = []UnattendedApprovalRule{
+		{OrganizationalUnit: "OU=Servers", Decision: UnattendedDecisionApprove},
+	}
+	config.PrivilegeEscalation.UnattendedDefaultDecision = UnattendedDecisionDeny
+	config.PrivilegeEscalation.EnrolledOrganizationalUnits = map[string]string{"db-01": "ou=servers"}
+	sm := newTestSessionManager(t, config)
+
+	server, err := sm.CreateSession("db-01", "tech", nil)
+	require.NoError(t, err)
+	// An OU the client reports for itself counts for nothing
+	workstation, err := sm.CreateSession("ws-17", "tech", &ClientInfo{
+		SystemInfo: map[string]string{"organizational_unit": "OU=Servers"},
+	})
+	require.NoError(t, err)
+
+	approvedID, err := sm.RequestPrivilege(server.ID, PrivilegeTypeRegistry, "rotate service credentials", time.Minute)
+	require.NoError(t, err)
+	approved, _ := server.GetPrivilegeRequest(approvedID)
+	assert.Equal(t, "approved", approved.Status)
+	assert.Equal(t, unattendedPolicyActor, approved.ApprovedBy)
+
+	// Privileges that are disallowed outright are never auto-approved
+	adminID, err := sm.RequestPrivilege(server.ID, PrivilegeTypeAdmin, "rotate service credentials", time.Minute)
+	require.NoError(t, err)
+	admin, _ := server.GetPrivilegeRequest(adminID)
+	assert.Equal(t, "denied", admin.Status)
+
+	deniedID, err := sm.RequestPrivilege(workstation.ID, PrivilegeTypeRegistry, "rotate service credentials", time.Minute)
+	require.NoError(t, err)
+	denied, _ := workstation.GetPrivilegeRequest(deniedID)
+	assert.Equal(t, "denied", denied.Status)
+
+	decisions := 0
+	for _, eventType := range readAuditEventTypes(t, sm.auditLogger) {
+		if eventType == "privilege_policy_decision" {
+			decisions++
+		}
+	}
+	assert.Equal(t, 3, decisions)
+}
+
+func TestPrivilegeEscalationConfig_ValidatesUnattendedRules(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.PrivilegeEscalation.UnattendedApprovers = []UnattendedApprovalRule{{ClientID: "kiosk", Approver: "a", Decision: UnattendedDecisionApprove}}
+	assert.Error(t, config.Validate())
+
+	config.PrivilegeEscalation.UnattendedApprovers = []UnattendedApprovalRule{{Approver: "a"}}
+	assert.Error(t, config.Validate())
+
+	config.PrivilegeEscalation.UnattendedApprovers = []UnattendedApprovalRule{{ClientID: "kiosk", Decision: "maybe"}}
+	assert.Error(t, config.Validate())
+
+	config.PrivilegeEscalation.UnattendedApprovers = []UnattendedApprovalRule{{ClientID: "kiosk", Decision: UnattendedDecisionDeny}}
+	assert.NoError(t, config.Validate())
+}
+
+func TestSessionManager_ConfigUpdatesDuringCleanup(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.CleanupInterval = time.Hour
+	config.TerminatedSessionRetention = time.Millisecond
+	sm := newTestSessionManager(t, config)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	require.NoError(t, sm.TerminateSession(session.ID))
+
+	// Hammer the manager while config is swapped and the cleanup ticker is rescheduled
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			session, err := sm.CreateSession("client", "tech", nil)
+			if err != nil {
+				continue
+			}
+			sm.RequestPrivilege(session.ID, PrivilegeTypeAdmin, "maintenance", time.Minute)
+			sm.GetStatistics()
+			sm.TerminateSession(session.ID)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		updated := sm.GetConfig().Clone()
+		updated.CleanupInterval = time.Duration(1+i%3) * time.Millisecond
+		updated.PrivilegeEscalation.MaxRequestsPerMinute = i % 5
+		sm.UpdateConfig(updated)
+	}
+	close(done)
+	wg.Wait()
+
+	// The rescheduled ticker keeps running at the new interval
+	assert.Eventually(t, func() bool {
+		sm.mutex.RLock()
+		defer sm.mutex.RUnlock()
+		return len(sm.terminated) == 0
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestSessionManager_ClientPolicyRejectsUnsupportedClients(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.ClientPolicy.MinimumClientVersion = "2.0"
+	config.ClientPolicy.DeniedOperatingSystems = []string{"Windows 7"}
+	config.ClientPolicy.UpdateURL = "https://downloads.example.com/onlidesk"
+	require.NoError(t, config.Validate())
+	sm := newTestSessionManager(t, config)
+
+	session, err := sm.CreateSession("client-current", "tech", &ClientInfo{
+		OperatingSystem: "Windows 11 Pro",
+		UserAgent:       "OnliDesk-Client/2.10.1 (Windows NT 10.0)",
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, session.ID)
+
+	for name, info := range map[string]*ClientInfo{
+		"too old":      {OperatingSystem: "Windows 11 Pro", UserAgent: "OnliDesk-Client/1.9.3"},
+		"no version":   {OperatingSystem: "Ubuntu 22.04", UserAgent: "curl/8.0"},
+		"denied os":    {OperatingSystem: "Windows 7 Professional", UserAgent: "OnliDesk-Client/2.4.1"},
+		"no handshake": nil,
+	} {
+		_, err := sm.CreateSession("client-"+name, "tech", info)
+		require.ErrorIs(t, err, ErrClientNotSupported, name)
+		assert.Contains(t, err.Error(), "please update your client from https://downloads.example.com/onlidesk", name)
+	}
+	assert.Len(t, sm.GetAllSessions(), 1)
+
+	rejections := 0
+	for _, eventType := range readAuditEventTypes(t, sm.auditLogger) {
+		if eventType == "client_policy_rejected" {
+			rejections++
+		}
+	}
+	assert.Equal(t, 4, rejections)
+}
+
+func TestSessionManager_PendingPrivilegeBacklogIsCapped(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.PrivilegeEscalation.MaxRequestsPerMinute = 0
+	config.PrivilegeEscalation.MaxPendingRequests = 3
+	config.PrivilegeEscalation.PendingRequestTimeout = time.Hour
+	sm := newTestSessionManager(t, config)
+
+	first, err := sm.CreateSession("client-1", "tech", nil)
+	require.NoError(t, err)
+	second, err := sm.CreateSession("client-2", "tech", nil)
+	require.NoError(t, err)
+
+	var requestIDs []string
+	for _, session := range []*RemoteAccessSession{first, first, second} {
+		requestID, err := sm.RequestPrivilege(session.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+		require.NoError(t, err)
+		requestIDs = append(requestIDs, requestID)
+	}
+	assert.Equal(t, 3, sm.GetStatistics()["pending_privilege_requests"])
+
+	// The cap is global, so every session is turned away while the backlog is full
+	for _, session := range []*RemoteAccessSession{first, second} {
+		_, err := sm.RequestPrivilege(session.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+		assert.ErrorIs(t, err, ErrPrivilegeBacklogFull)
+	}
+	assert.Equal(t, 3, sm.GetStatistics()["pending_privilege_requests"])
+
+	// Deciding a request makes room for another
+	require.NoError(t, sm.DenyPrivilege(first.ID, requestIDs[0], "tech", "not needed"))
+	_, err = sm.RequestPrivilege(second.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+	require.NoError(t, err)
+
+	// So does a request timing out
+	first.mutex.Lock()
+	first.Privileges[1].RequestedAt = time.Now().Add(-2 * time.Hour)
+	first.mutex.Unlock()
+	sm.expirePendingPrivileges()
+
+	request, found := first.GetPrivilegeRequest(requestIDs[1])
+	require.True(t, found)
+	assert.Equal(t, "expired", request.Status)
+	assert.Equal(t, 2, sm.GetStatistics()["pending_privilege_requests"])
+
+	_, err = sm.RequestPrivilege(first.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+	assert.NoError(t, err)
+
+	eventTypes := readAuditEventTypes(t, sm.auditLogger)
+	assert.Contains(t, eventTypes, "privilege_request_throttled")
+	assert.Contains(t, eventTypes, "privilege_request_expired")
+}
+
+func TestSessionManager_ExternalPrivilegeApproval(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+
+	// The simulated ticketing system accepts requests and decides them later via the callback
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer service.Close()
+
+	deliveryConfig := delivery.DefaultConfig()
+	deliveryConfig.DeadLetterPath = filepath.Join(t.TempDir(), "dead_letters.jsonl")
+
+	approverConfig := approval.DefaultConfig()
+	approverConfig.Enabled = true
+	approverConfig.Endpoint = service.URL
+	approverConfig.Secret = "shared-secret"
+	deliverer := delivery.NewDeliverer(deliveryConfig)
+	defer deliverer.Stop()
+	approver := approval.NewExternalApprover(approverConfig, deliverer)
+	defer approver.Stop()
+	sm.SetExternalApprover(approver)
+
+	callbacks := httptest.NewServer(http.HandlerFunc(approver.HandleCallback))
+	defer callbacks.Close()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	requestID, err := sm.RequestPrivilege(session.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 1, approver.PendingCount())
+
+	body, err := json.Marshal(approval.Decision{RequestID: requestID, Approved: true, Approver: "change-board"})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, callbacks.URL, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set(approval.SignatureHeader, approval.Sign("shared-secret", body))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	request, ok := session.GetPrivilegeRequest(requestID)
+	require.True(t, ok)
+	assert.Equal(t, "approved", request.Status)
+	assert.Equal(t, "external:change-board", request.ApprovedBy)
+	assert.True(t, session.HasActivePrivilege(PrivilegeTypeElevated))
+	assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "privilege_external_decision")
+}
+
+// sequenceGenerator hands out a fixed list of IDs, repeating the last one once exhausted
+type sequenceGenerator struct {
+	mutex sync.Mutex
+	ids   []string
+}
+
+func (g *sequenceGenerator) NewID() string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	id := g.ids[0]
+	if len(g.ids) > 1 {
+		g.ids = g.ids[1:]
+	}
+	return id
+}
+
+func TestSessionManager_SessionIDsComeFromTheGenerator(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	sm.SetIDGenerator(&sequenceGenerator{ids: []string{"session-1", "session-1", "session-2"}})
+
+	first, err := sm.CreateSession("client-a", "tech", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "session-1", first.ID)
+
+	// A repeated ID is skipped rather than replacing the live session
+	second, err := sm.CreateSession("client-b", "tech", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "session-2", second.ID)
+
+	// Ended sessions still answer queries, so their IDs aren't reused either
+	require.NoError(t, sm.TerminateSession(second.ID))
+	_, err = sm.CreateSession("client-c", "tech", nil)
+	assert.ErrorIs(t, err, idgen.ErrExhausted)
+	assert.Len(t, sm.GetAllSessions(), 2)
+
+	// Once the injected generator is removed the ID is a UUID again, and the short code
+	// for attended sessions only finds the session
+	sm.SetIDGenerator(nil)
+
+	session, err := sm.CreateSession("client-d", "tech", nil)
+	require.NoError(t, err)
+	assert.True(t, sm.ValidateSessionID(session.ID))
+	assert.False(t, sm.ValidateSessionID(first.ID), "IDs from a custom generator aren't a known format")
+	assert.Regexp(t, `^[2-9A-Z]{3}-[2-9A-Z]{3}$`, session.Code)
+	assert.False(t, sm.ValidateSessionID(session.Code))
+
+	found, exists := sm.GetSessionByCode(session.Code)
+	require.True(t, exists)
+	assert.Equal(t, session.ID, found.ID)
+	_, exists = sm.GetSession(session.Code)
+	assert.False(t, exists, "a code isn't a session ID")
+}
+
+func TestSessionManager_SessionCodesAreUniqueAndExpireWithTheSession(t *testing.T) {
+	sm := newTestSessionManager(t, DefaultRemoteAccessConfig())
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+
+	lookup := func(code string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/remoteaccess/sessions/by-code/"+code, nil))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec, body
+	}
+
+	// The default codes are six readable characters
+	session, err := sm.CreateSession("client-a", "tech", nil)
+	require.NoError(t, err)
+	assert.Regexp(t, `^[2-9A-Z]{3}-[2-9A-Z]{3}$`, session.Code)
+
+	rec, body := lookup(session.Code)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, session.ID, body["id"])
+	assert.Equal(t, session.Code, body["code"])
+
+	// Codes are read back by people, so case and separators don't matter
+	found, exists := sm.GetSessionByCode(strings.ToLower(strings.ReplaceAll(session.Code, "-", " ")))
+	require.True(t, exists)
+	assert.Equal(t, session.ID, found.ID)
+
+	// A code still held by a live session is drawn again
+	sm.SetCodeGenerator(&sequenceGenerator{ids: []string{"ABC-DEF", "abcdef", "ABC-DEG"}})
+	first, err := sm.CreateSession("client-b", "tech", nil)
+	require.NoError(t, err)
+	second, err := sm.CreateSession("client-c", "tech", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "ABC-DEF", first.Code)
+	assert.Equal(t, "ABC-DEG", second.Code)
+
+	// Codes expire with the session and can then be handed out again
+	require.NoError(t, sm.TerminateSession(first.ID))
+	rec, _ = lookup("ABC-DEF")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	sm.SetCodeGenerator(&sequenceGenerator{ids: []string{"ABC-DEG", "ABC-DEF"}})
+	third, err := sm.CreateSession("client-d", "tech", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "ABC-DEF", third.Code)
+	rec, body = lookup("abc-def")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, third.ID, body["id"])
+
+	// Longer codes can be configured within bounds
+	config := sm.GetConfig().Clone()
+	config.SessionCodeLength = 9
+	require.NoError(t, config.Validate())
+	sm.UpdateConfig(config)
+	sm.SetCodeGenerator(nil)
+	session, err = sm.CreateSession("client-e", "tech", nil)
+	require.NoError(t, err)
+	assert.Regexp(t, `^[2-9A-Z]{3}-[2-9A-Z]{3}-[2-9A-Z]{3}$`, session.Code)
+
+	config = config.Clone()
+	config.SessionCodeLength = 12
+	assert.Error(t, config.Validate())
+
+	generated := 0
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == "session_code_generated" {
+			generated++
+		}
+	}
+	assert.Equal(t, 5, generated)
+}
+
+func TestSessionManager_LocksOutAfterMaxFailedAttempts(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxFailedAttempts = 3
+	config.LockoutDuration = 200 * time.Millisecond
+	sm := newTestSessionManager(t, config)
+
+	assert.False(t, sm.RecordFailedAttempt("203.0.113.7", "session_join"))
+	assert.False(t, sm.RecordFailedAttempt("203.0.113.7", "session_join"))
+	locked, _ := sm.IsLockedOut("203.0.113.7")
+	assert.False(t, locked)
+
+	assert.True(t, sm.RecordFailedAttempt("203.0.113.7", "session_join"))
+	locked, until := sm.IsLockedOut("203.0.113.7")
+	assert.True(t, locked)
+	assert.WithinDuration(t, time.Now().Add(config.LockoutDuration), until, 50*time.Millisecond)
+	assert.ErrorIs(t, sm.CheckLockout("203.0.113.7", "session_create"), ErrLockedOut)
+
+	// Other clients and successful attempts are unaffected
+	assert.NoError(t, sm.CheckLockout("198.51.100.2", "session_create"))
+	sm.ClearFailedAttempts("203.0.113.7")
+	locked, _ = sm.IsLockedOut("203.0.113.7")
+	assert.True(t, locked, "a success elsewhere doesn't lift a lockout")
+
+	// The lockout lifts by itself
+	assert.Eventually(t, func() bool {
+		locked, _ := sm.IsLockedOut("203.0.113.7")
+		return !locked
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, sm.CheckLockout("203.0.113.7", "session_create"))
+
+	var violations []string
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == "security_violation" {
+			assert.Equal(t, "203.0.113.7", event.IPAddress)
+			violations = append(violations, event.Details["violation"].(string))
+		}
+	}
+	require.Len(t, violations, 2)
+	assert.Contains(t, violations[0], "after 3 failed attempts")
+	assert.Contains(t, violations[1], "session_create attempted while locked out")
+}
+
+func TestSessionManager_DenyPrivilegeRequiresAReasonWhenConfigured(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.PrivilegeEscalation.RequireDenialReason = true
+	sm := newTestSessionManager(t, config)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	requestID, err := sm.RequestPrivilege(session.ID, PrivilegeTypeElevated, "install printer driver", time.Minute)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, sm.DenyPrivilege(session.ID, requestID, "tech", "  "), ErrDenialReasonRequired)
+	request, found := session.GetPrivilegeRequest(requestID)
+	require.True(t, found)
+	assert.Equal(t, "pending", request.Status)
+
+	require.NoError(t, sm.DenyPrivilege(session.ID, requestID, "tech", "driver is already installed"))
+	request, _ = session.GetPrivilegeRequest(requestID)
+	assert.Equal(t, "denied", request.Status)
+
+	var reasons []interface{}
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == "privilege_denied" {
+			reasons = append(reasons, event.Details["reason"])
+		}
+	}
+	assert.Equal(t, []interface{}{"driver is already installed"}, reasons)
+}
+
+func TestSessionManager_WritingToAMissingConnectionFails(t *testing.T) {
+	sm := newTestSessionManager(t, nil)
+
+	assert.ErrorIs(t, sm.writeMessage(nil, map[string]string{"type": "ping"}), ErrNoConnection)
+	assert.ErrorIs(t, sm.writeMessage(&websocket.Conn{}, map[string]string{"type": "ping"}), ErrNoConnection)
+}
+
+func TestSessionManager_ExtendSessionPushesBackExpiry(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.SessionTimeout = time.Hour
+	config.MaxSessionDuration = 3 * time.Hour
+	sm := newTestSessionManager(t, config)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	assert.Equal(t, session.StartTime.Add(time.Hour), session.ExpiresAt)
+
+	// Just past its expiry, but not yet cleaned up: too late to extend
+	session.mutex.Lock()
+	session.ExpiresAt = time.Now().Add(-time.Second)
+	session.mutex.Unlock()
+	require.True(t, session.IsExpired())
+	_, err = sm.ExtendSession(session.ID, 30*time.Minute)
+	assert.ErrorIs(t, err, ErrSessionEnded)
+
+	// About to expire
+	session.mutex.Lock()
+	session.ExpiresAt = time.Now().Add(time.Minute)
+	session.mutex.Unlock()
+
+	expiresAt, err := sm.ExtendSession(session.ID, 30*time.Minute)
+	require.NoError(t, err)
+	assert.False(t, session.IsExpired())
+	assert.WithinDuration(t, time.Now().Add(31*time.Minute), expiresAt, 5*time.Second)
+
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+	extend := func(duration string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := strings.NewReader(`{"duration":"` + duration + `"}`)
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/remoteaccess/sessions/"+session.ID+"/extend", body))
+		return rec
+	}
+
+	rec := extend("1h")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var response struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.True(t, response.ExpiresAt.Equal(expiresAt.Add(time.Hour)))
+
+	// The session started less than a second ago, so another 3h would run past the 3h cap
+	rec = extend("3h")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "maximum session duration")
+	assert.Equal(t, http.StatusBadRequest, extend("-5m").Code)
+
+	var extensions []AuditEvent
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == "session_extended" {
+			extensions = append(extensions, event)
+		}
+	}
+	require.Len(t, extensions, 2)
+	assert.Equal(t, "1h0m0s", extensions[1].Details["extension"])
+
+	require.NoError(t, sm.TerminateSession(session.ID))
+	_, err = sm.ExtendSession(session.ID, time.Minute)
+	assert.ErrorIs(t, err, ErrSessionEnded)
+	assert.Equal(t, http.StatusConflict, extend("1m").Code)
+}
+
+func TestSession_ExpiredPrivilegesAreLeftForTheSweep(t *testing.T) {
+	session := NewRemoteAccessSession("session", "client", "tech", nil)
+	now := time.Now()
+	session.ActivePrivileges[string(PrivilegeTypeServices)] = &ActivePrivilege{
+		Type:      PrivilegeTypeServices,
+		GrantedAt: now.Add(-time.Hour),
+		ExpiresAt: now.Add(-time.Minute),
+	}
+
+	assert.False(t, session.HasActivePrivilege(PrivilegeTypeServices))
+	assert.Len(t, session.ActivePrivileges, 1, "checking a privilege doesn't revoke it")
+
+	expired := session.ExpireActivePrivileges(now)
+	require.Len(t, expired, 1)
+	assert.Equal(t, PrivilegeTypeServices, expired[0].Type)
+	assert.Empty(t, session.ActivePrivileges)
+}
+
+func TestSessionManager_ManualClockDrivesExpiry(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.SessionTimeout = time.Hour
+	config.IdleTimeout = 10 * time.Minute
+	config.PrivilegeEscalation.PendingRequestTimeout = 5 * time.Minute
+	config.MaxFailedAttempts = 2
+	config.LockoutDuration = time.Minute
+	sm := newTestSessionManager(t, config)
+	now := clock.NewManual(time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	sm.SetClock(now)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	assert.Equal(t, now.Now(), session.StartTime)
+	requestID, err := sm.RequestPrivilege(session.ID, PrivilegeTypeServices, "restart print spooler", time.Minute)
+	require.NoError(t, err)
+
+	// A pending request lasts exactly the pending timeout
+	now.Advance(5 * time.Minute)
+	sm.expirePendingPrivileges()
+	request, _ := session.GetPrivilegeRequest(requestID)
+	assert.Equal(t, "pending", request.Status)
+	now.Advance(time.Nanosecond)
+	sm.expirePendingPrivileges()
+	request, _ = session.GetPrivilegeRequest(requestID)
+	assert.Equal(t, "expired", request.Status)
+
+	// Activity holds off the idle timeout until it elapses in full
+	session.UpdateActivity()
+	now.Advance(10 * time.Minute)
+	assert.False(t, session.IsExpired())
+	now.Advance(time.Nanosecond)
+	assert.True(t, session.IsExpired())
+	sm.cleanupExpiredSessions()
+	assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "session_expired")
+
+	// A lockout lifts the moment its duration has passed
+	sm.RecordFailedAttempt("203.0.113.7", "session_join")
+	assert.True(t, sm.RecordFailedAttempt("203.0.113.7", "session_join"))
+	now.Advance(time.Minute - time.Nanosecond)
+	locked, _ := sm.IsLockedOut("203.0.113.7")
+	assert.True(t, locked)
+	now.Advance(time.Nanosecond)
+	locked, _ = sm.IsLockedOut("203.0.113.7")
+	assert.False(t, locked)
+}
@@ -1,13 +1,18 @@
 package remoteaccess
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+
+	"github.com/onlitec/onlidesk-server/internal/auth"
+	"github.com/onlitec/onlidesk-server/internal/clientnet"
+	"github.com/onlitec/onlidesk-server/internal/lifecycle"
 )
 
 // WebSocketHandler manages WebSocket connections for remote access
@@ -16,6 +21,8 @@ type WebSocketHandler struct {
 	upgrader       websocket.Upgrader
 	config         *RemoteAccessConfig
 	auditLogger    *AuditLogger
+	workers        *lifecycle.Group   // per-connection ping loops
+	authenticator  auth.Authenticator // nil when no auth provider is configured
 }
 
 // NewWebSocketHandler creates a new WebSocket handler
@@ -24,27 +31,53 @@ func NewWebSocketHandler(config *RemoteAccessConfig) *WebSocketHandler {
 		config = DefaultRemoteAccessConfig()
 	}
 
-	return &WebSocketHandler{
-		sessionManager: NewSessionManager(config),
+	auditLogger := NewAuditLogger(auditLogDir, true)
+	auditLogger.SetFilter(config.AuditEventTypes, config.AuditMinSeverity)
+	auditLogger.SetMask(config.AuditMaskedFields, config.AuditMaskMode)
+
+	// Connection events are searchable alongside the session manager's
+	sessionManager := NewSessionManager(config)
+	auditLogger.SetStore(sessionManager.auditStore)
+
+	wh := &WebSocketHandler{
+		sessionManager: sessionManager,
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				// In production, implement proper origin checking
-				return true
-			},
 			ReadBufferSize:  1024 * 64,  // 64KB
 			WriteBufferSize: 1024 * 64,  // 64KB
 		},
 		config:      config,
-		auditLogger: NewAuditLogger("./logs/remoteaccess", true),
+		auditLogger: auditLogger,
+		workers:     lifecycle.NewGroup("remote access websocket handler"),
 	}
+	wh.upgrader.CheckOrigin = wh.originAllowed
+	return wh
 }
 
 // HandleWebSocket handles WebSocket connections for remote access
 func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Get client information for audit logging
-	ipAddress := r.RemoteAddr
+	ipAddress := wh.sessionManager.ClientIP(r)
 	userAgent := r.Header.Get("User-Agent")
 
+	// Only sources within the configured ranges may connect, even when mounted without the middleware
+	if !wh.sessionManager.AllowSource(r) {
+		http.Error(w, "Source address not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Browsers may only connect from the configured origins; checked here so the refusal is audited once
+	if !wh.originAllowed(r) {
+		wh.auditLogger.LogSecurityViolation("", "", "", fmt.Sprintf("WebSocket origin not allowed: %s", r.Header.Get("Origin")), ipAddress)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Turn away new connections while draining, telling the client when to come back
+	if wh.sessionManager.IsDraining() {
+		writeRetryRejection(w, wh.sessionManager.RetryHint(RetryReasonDraining))
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := wh.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -58,12 +91,25 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 
-	// Handle ping/pong for connection keep-alive
-	conn.SetPongHandler(func(string) error {
+	identity, _ := auth.IdentityFromContext(r.Context())
+	wh.sessionManager.TrackConnection(conn, ipAddress, identity.Subject)
+	defer wh.sessionManager.UntrackConnection(conn)
+
+	// Handle ping/pong for connection keep-alive; pongs echo the ping timestamp so we can time them
+	conn.SetPongHandler(func(payload string) error {
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		if sent, ok := decodePingPayload(payload); ok {
+			wh.sessionManager.RecordPong(conn, time.Since(sent))
+		}
 		return nil
 	})
 
+	done := make(chan struct{})
+	defer close(done)
+	wh.workers.Go("ping loop", func(stop <-chan struct{}) {
+		wh.pingLoop(conn, done, stop)
+	})
+
 	// Log successful WebSocket connection
 	wh.auditLogger.LogEvent(AuditEvent{
 		EventType:   "websocket_connected",
@@ -72,7 +118,7 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 		Details:     map[string]interface{}{"connection_type": "remoteaccess"},
 		Severity:    "info",
 		Success:     true,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().UTC(),
 	})
 
 	log.Printf("New remote access WebSocket connection established from %s", r.RemoteAddr)
@@ -80,7 +126,7 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 	// Message handling loop
 	for {
 		// Read message from client
-		messageType, message, err := conn.ReadMessage()
+		messageType, message, err := wh.sessionManager.connTracker.ReadMessage(conn)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
@@ -88,9 +134,14 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 			break
 		}
 
-		if messageType == websocket.TextMessage {
+		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
 			if err := wh.handleMessage(conn, message); err != nil {
 				log.Printf("Error handling message: %v", err)
+				wh.sessionManager.connTracker.RecordError(conn)
+				if errors.Is(err, ErrAtCapacity) {
+					wh.rejectAtCapacity(conn)
+					break
+				}
 				wh.sendErrorResponse(conn, err.Error())
 			}
 		}
@@ -99,21 +150,60 @@ func (wh *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 	log.Printf("Remote access WebSocket connection closed from %s", r.RemoteAddr)
 }
 
+// pingLoop sends timestamped keepalive pings until the connection is done, the handler stops or a ping fails
+func (wh *WebSocketHandler) pingLoop(conn *websocket.Conn, done, stop <-chan struct{}) {
+	interval := wh.config.WebSocketPingInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	writeTimeout := wh.config.WebSocketWriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			if err := conn.WriteControl(websocket.PingMessage, encodePingPayload(now), now.Add(writeTimeout)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
 // handleMessage processes incoming WebSocket messages
 func (wh *WebSocketHandler) handleMessage(conn *websocket.Conn, message []byte) error {
 	var baseMessage struct {
 		Type string `json:"type"`
 	}
 
-	if err := json.Unmarshal(message, &baseMessage); err != nil {
+	if err := wh.decode(conn, message, &baseMessage); err != nil {
 		return fmt.Errorf("failed to parse message: %v", err)
 	}
+	wh.sessionManager.connTracker.RecordMessageType(conn, baseMessage.Type)
+
+	// Enforce the allow-list for the connection's role before dispatching
+	if err := wh.sessionManager.AuthorizeMessage(conn, baseMessage.Type); err != nil {
+		return err
+	}
 
 	switch baseMessage.Type {
+	case "hello":
+		return wh.handleHello(conn, message)
 	case "session_register":
 		return wh.handleSessionRegister(conn, message)
 	case "session_create":
 		return wh.handleSessionCreate(conn, message)
+	case "client_info":
+		return wh.handleClientInfo(conn, message)
 	case "session_join":
 		return wh.handleSessionJoin(conn, message)
 	case "session_terminate":
@@ -126,8 +216,12 @@ func (wh *WebSocketHandler) handleMessage(conn *websocket.Conn, message []byte)
 		return wh.handlePrivilegeRevoke(conn, message)
 	case "control_command":
 		return wh.handleControlCommand(conn, message)
+	case "command_result":
+		return wh.handleCommandResult(conn, message)
 	case "screen_capture":
 		return wh.handleScreenCapture(conn, message)
+	case "screen_frame":
+		return wh.handleScreenFrame(conn, message)
 	case "input_event":
 		return wh.handleInputEvent(conn, message)
 	case "file_transfer_request":
@@ -139,27 +233,71 @@ func (wh *WebSocketHandler) handleMessage(conn *websocket.Conn, message []byte)
 	}
 }
 
+// handleHello negotiates the connection's wire encoding. The reply is sent in the encoding the
+// client spoke the hello in; every message after it uses the negotiated one.
+func (wh *WebSocketHandler) handleHello(conn *websocket.Conn, message []byte) error {
+	var hello struct {
+		Type      string   `json:"type"`
+		Encodings []string `json:"encodings"` // client's preference order
+	}
+
+	if err := wh.decode(conn, message, &hello); err != nil {
+		return fmt.Errorf("failed to parse hello: %v", err)
+	}
+
+	msgpackEnabled := wh.sessionManager.GetConfig().MessagePackEnabled
+	offered := []string{EncodingJSON}
+	if msgpackEnabled {
+		offered = append(offered, EncodingMsgPack)
+	}
+	encoding := negotiateEncoding(hello.Encodings, msgpackEnabled)
+
+	response := struct {
+		Type      string    `json:"type"`
+		Encoding  string    `json:"encoding"`
+		Encodings []string  `json:"encodings"`
+		Timestamp time.Time `json:"timestamp"`
+	}{
+		Type:      "hello",
+		Encoding:  encoding,
+		Encodings: offered,
+		Timestamp: time.Now().UTC(),
+	}
+
+	if err := wh.sendMessage(conn, response); err != nil {
+		return err
+	}
+	wh.sessionManager.connTracker.SetEncoding(conn, encoding)
+	return nil
+}
+
 // handleSessionRegister registers a WebSocket connection with a session
 func (wh *WebSocketHandler) handleSessionRegister(conn *websocket.Conn, message []byte) error {
 	var register struct {
 		Type      string `json:"type"`
 		SessionID string `json:"session_id"`
-		Role      string `json:"role"` // client, portal
+		Role      string `json:"role"` // client, portal, observer
 		ClientID  string `json:"client_id,omitempty"`
 		Technician string `json:"technician,omitempty"`
 	}
 
-	if err := json.Unmarshal(message, &register); err != nil {
+	if err := wh.decode(conn, message, &register); err != nil {
 		return fmt.Errorf("failed to parse session register: %v", err)
 	}
 
+	role, err := wh.registrationRole(conn, register.Role)
+	if err != nil {
+		wh.sessionManager.auditLogger.LogSecurityViolation(register.SessionID, "", "", err.Error(), wh.connIP(conn))
+		return err
+	}
+
 	// Register connection with session manager
-	err := wh.sessionManager.RegisterConnection(register.SessionID, conn, register.Role)
+	err = wh.sessionManager.RegisterConnection(register.SessionID, conn, role)
 	if err != nil {
 		return fmt.Errorf("failed to register connection: %v", err)
 	}
 
-	log.Printf("WebSocket connection registered for session %s as %s", register.SessionID, register.Role)
+	log.Printf("WebSocket connection registered for session %s as %s", register.SessionID, role)
 
 	// Send confirmation
 	response := struct {
@@ -171,10 +309,10 @@ func (wh *WebSocketHandler) handleSessionRegister(conn *websocket.Conn, message
 		Type:      "session_registered",
 		SessionID: register.SessionID,
 		Status:    "success",
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
-	return wh.sendJSONResponse(conn, response)
+	return wh.sendMessage(conn, response)
 }
 
 // handleSessionCreate creates a new remote access session
@@ -186,18 +324,34 @@ func (wh *WebSocketHandler) handleSessionCreate(conn *websocket.Conn, message []
 		ClientInfo   *ClientInfo `json:"client_info"`
 	}
 
-	if err := json.Unmarshal(message, &request); err != nil {
+	if err := wh.decode(conn, message, &request); err != nil {
 		return fmt.Errorf("failed to parse session create request: %v", err)
 	}
 
+	// Clients that keep failing are locked out for a while
+	clientIP := wh.connIP(conn)
+	if err := wh.sessionManager.CheckLockout(clientIP, "session_create"); err != nil {
+		return err
+	}
+
+	// Only the client's own anonymous connection creates its session
+	role, err := wh.registrationRole(conn, "client")
+	if err != nil {
+		return err
+	}
+
 	// Create new session
 	session, err := wh.sessionManager.CreateSession(request.ClientID, request.TechnicianID, request.ClientInfo)
 	if err != nil {
-		return fmt.Errorf("failed to create session: %v", err)
+		if !errors.Is(err, ErrAtCapacity) {
+			wh.sessionManager.RecordFailedAttempt(clientIP, "session_create")
+		}
+		return fmt.Errorf("failed to create session: %w", err)
 	}
+	wh.sessionManager.ClearFailedAttempts(clientIP)
 
 	// Register the connection
-	err = wh.sessionManager.RegisterConnection(session.ID, conn, "client")
+	err = wh.sessionManager.RegisterConnection(session.ID, conn, role)
 	if err != nil {
 		return fmt.Errorf("failed to register connection: %v", err)
 	}
@@ -216,10 +370,59 @@ func (wh *WebSocketHandler) handleSessionCreate(conn *websocket.Conn, message []
 		Session:   session,
 		Status:    "success",
 		Message:   "Remote access session created successfully",
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
+	}
+
+	return wh.sendMessage(conn, response)
+}
+
+// handleClientInfo stores the machine information a client reports after connecting
+func (wh *WebSocketHandler) handleClientInfo(conn *websocket.Conn, message []byte) error {
+	var request struct {
+		Type       string      `json:"type"`
+		SessionID  string      `json:"session_id"`
+		ClientInfo *ClientInfo `json:"client_info"`
+	}
+
+	if err := wh.decode(conn, message, &request); err != nil {
+		return fmt.Errorf("failed to parse client info: %v", err)
+	}
+
+	session, exists := wh.sessionManager.GetSession(request.SessionID)
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+
+	// Only the session's own client may describe the client machine
+	session.mutex.RLock()
+	isClient := session.ClientConn == conn
+	session.mutex.RUnlock()
+	if !isClient {
+		return fmt.Errorf("client info must be sent from the session's client connection")
+	}
+
+	// Fall back to the connection's address when the client doesn't report one
+	if request.ClientInfo != nil && request.ClientInfo.IPAddress == "" {
+		request.ClientInfo.IPAddress = wh.connIP(conn)
+	}
+
+	if err := wh.sessionManager.UpdateClientInfo(request.SessionID, request.ClientInfo); err != nil {
+		return fmt.Errorf("failed to update client info: %v", err)
+	}
+
+	response := struct {
+		Type      string    `json:"type"`
+		SessionID string    `json:"session_id"`
+		Status    string    `json:"status"`
+		Timestamp time.Time `json:"timestamp"`
+	}{
+		Type:      "client_info_ack",
+		SessionID: request.SessionID,
+		Status:    "success",
+		Timestamp: time.Now().UTC(),
 	}
 
-	return wh.sendJSONResponse(conn, response)
+	return wh.sendMessage(conn, response)
 }
 
 // handleSessionJoin handles portal joining an existing session
@@ -230,21 +433,35 @@ func (wh *WebSocketHandler) handleSessionJoin(conn *websocket.Conn, message []by
 		TechnicianID string `json:"technician_id"`
 	}
 
-	if err := json.Unmarshal(message, &request); err != nil {
+	if err := wh.decode(conn, message, &request); err != nil {
 		return fmt.Errorf("failed to parse session join request: %v", err)
 	}
 
+	// Guessing session IDs counts towards a lockout
+	clientIP := wh.connIP(conn)
+	if err := wh.sessionManager.CheckLockout(clientIP, "session_join"); err != nil {
+		return err
+	}
+
 	// Get session
 	session, exists := wh.sessionManager.GetSession(request.SessionID)
 	if !exists {
+		wh.sessionManager.RecordFailedAttempt(clientIP, "session_join")
 		return fmt.Errorf("session not found")
 	}
 
 	// Register portal connection
-	err := wh.sessionManager.RegisterConnection(request.SessionID, conn, "portal")
+	role, err := wh.registrationRole(conn, "portal")
+	if err != nil {
+		wh.sessionManager.auditLogger.LogSecurityViolation(request.SessionID, "", "", err.Error(), clientIP)
+		return err
+	}
+	err = wh.sessionManager.RegisterConnection(request.SessionID, conn, role)
 	if err != nil {
+		wh.sessionManager.RecordFailedAttempt(clientIP, "session_join")
 		return fmt.Errorf("failed to register portal connection: %v", err)
 	}
+	wh.sessionManager.ClearFailedAttempts(clientIP)
 
 	// Send response
 	response := struct {
@@ -260,10 +477,10 @@ func (wh *WebSocketHandler) handleSessionJoin(conn *websocket.Conn, message []by
 		Session:   session,
 		Status:    "success",
 		Message:   "Successfully joined remote access session",
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
-	return wh.sendJSONResponse(conn, response)
+	return wh.sendMessage(conn, response)
 }
 
 // handleSessionTerminate terminates a session
@@ -274,7 +491,7 @@ func (wh *WebSocketHandler) handleSessionTerminate(conn *websocket.Conn, message
 		Reason    string `json:"reason,omitempty"`
 	}
 
-	if err := json.Unmarshal(message, &request); err != nil {
+	if err := wh.decode(conn, message, &request); err != nil {
 		return fmt.Errorf("failed to parse session terminate request: %v", err)
 	}
 
@@ -296,10 +513,10 @@ func (wh *WebSocketHandler) handleSessionTerminate(conn *websocket.Conn, message
 		SessionID: request.SessionID,
 		Status:    "success",
 		Message:   "Session terminated successfully",
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
-	return wh.sendJSONResponse(conn, response)
+	return wh.sendMessage(conn, response)
 }
 
 // handlePrivilegeRequest handles privilege escalation requests
@@ -312,7 +529,7 @@ func (wh *WebSocketHandler) handlePrivilegeRequest(conn *websocket.Conn, message
 		Duration      time.Duration `json:"duration"`
 	}
 
-	if err := json.Unmarshal(message, &request); err != nil {
+	if err := wh.decode(conn, message, &request); err != nil {
 		return fmt.Errorf("failed to parse privilege request: %v", err)
 	}
 
@@ -322,6 +539,16 @@ func (wh *WebSocketHandler) handlePrivilegeRequest(conn *websocket.Conn, message
 		return fmt.Errorf("failed to request privilege: %v", err)
 	}
 
+	// Unattended sessions may have been decided by policy already
+	status := "pending"
+	responseMessage := "Privilege request submitted for approval"
+	if session, exists := wh.sessionManager.GetSession(request.SessionID); exists {
+		if privilege, found := session.GetPrivilegeRequest(requestID); found && privilege.Status != "pending" {
+			status = privilege.Status
+			responseMessage = "Privilege request " + privilege.Status + " by policy"
+		}
+	}
+
 	// Send response
 	response := struct {
 		Type      string    `json:"type"`
@@ -334,34 +561,47 @@ func (wh *WebSocketHandler) handlePrivilegeRequest(conn *websocket.Conn, message
 		Type:      "privilege_requested",
 		RequestID: requestID,
 		SessionID: request.SessionID,
-		Status:    "pending",
-		Message:   "Privilege request submitted for approval",
-		Timestamp: time.Now(),
+		Status:    status,
+		Message:   responseMessage,
+		Timestamp: time.Now().UTC(),
 	}
 
-	return wh.sendJSONResponse(conn, response)
+	return wh.sendMessage(conn, response)
 }
 
 // handlePrivilegeResponse handles privilege approval/denial responses
 func (wh *WebSocketHandler) handlePrivilegeResponse(conn *websocket.Conn, message []byte) error {
 	var response struct {
-		Type       string `json:"type"`
-		SessionID  string `json:"session_id"`
-		RequestID  string `json:"request_id"`
-		Approved   bool   `json:"approved"`
-		ApprovedBy string `json:"approved_by"`
-		Reason     string `json:"reason,omitempty"`
+		Type      string `json:"type"`
+		SessionID string `json:"session_id"`
+		RequestID string `json:"request_id"`
+		Approved  bool   `json:"approved"`
+		Reason    string `json:"reason,omitempty"`
 	}
 
-	if err := json.Unmarshal(message, &response); err != nil {
+	if err := wh.decode(conn, message, &response); err != nil {
 		return fmt.Errorf("failed to parse privilege response: %v", err)
 	}
 
+	// The decision is recorded against whoever the connection authenticated as, never a name it sends.
+	// The client user may only consent to commands held for its own session.
+	approver := wh.connIdentity(conn)
+	if session, exists := wh.sessionManager.GetSession(response.SessionID); exists && conn == session.ClientConn {
+		request, found := session.GetPrivilegeRequest(response.RequestID)
+		if !found || request.Type != PrivilegeTypeCommand {
+			return fmt.Errorf("the client can only decide command approvals")
+		}
+		approver = clientConsentActor
+	}
+	if approver == "" {
+		return fmt.Errorf("privilege decisions require an authenticated approver")
+	}
+
 	var err error
 	if response.Approved {
-		err = wh.sessionManager.ApprovePrivilege(response.SessionID, response.RequestID, response.ApprovedBy)
+		err = wh.sessionManager.ApprovePrivilege(response.SessionID, response.RequestID, approver)
 	} else {
-		err = wh.sessionManager.DenyPrivilege(response.SessionID, response.RequestID, response.ApprovedBy)
+		err = wh.sessionManager.DenyPrivilege(response.SessionID, response.RequestID, approver, response.Reason)
 	}
 
 	if err != nil {
@@ -381,7 +621,7 @@ func (wh *WebSocketHandler) handlePrivilegeResponse(conn *websocket.Conn, messag
 		RequestID: response.RequestID,
 		SessionID: response.SessionID,
 		Status:    "success",
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
 	if response.Approved {
@@ -390,7 +630,7 @@ func (wh *WebSocketHandler) handlePrivilegeResponse(conn *websocket.Conn, messag
 		confirmation.Message = "Privilege request denied"
 	}
 
-	return wh.sendJSONResponse(conn, confirmation)
+	return wh.sendMessage(conn, confirmation)
 }
 
 // handlePrivilegeRevoke handles privilege revocation
@@ -401,7 +641,7 @@ func (wh *WebSocketHandler) handlePrivilegeRevoke(conn *websocket.Conn, message
 		PrivilegeType PrivilegeType `json:"privilege_type"`
 	}
 
-	if err := json.Unmarshal(message, &request); err != nil {
+	if err := wh.decode(conn, message, &request); err != nil {
 		return fmt.Errorf("failed to parse privilege revoke request: %v", err)
 	}
 
@@ -423,22 +663,17 @@ func (wh *WebSocketHandler) handlePrivilegeRevoke(conn *websocket.Conn, message
 		SessionID: request.SessionID,
 		Status:    "success",
 		Message:   fmt.Sprintf("Privilege %s revoked successfully", request.PrivilegeType),
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
-	return wh.sendJSONResponse(conn, response)
+	return wh.sendMessage(conn, response)
 }
 
 // handleControlCommand handles remote control commands
 func (wh *WebSocketHandler) handleControlCommand(conn *websocket.Conn, message []byte) error {
-	var command struct {
-		Type      string                 `json:"type"`
-		SessionID string                 `json:"session_id"`
-		Command   string                 `json:"command"`
-		Params    map[string]interface{} `json:"params,omitempty"`
-	}
+	var command ControlCommand
 
-	if err := json.Unmarshal(message, &command); err != nil {
+	if err := wh.decode(conn, message, &command); err != nil {
 		return fmt.Errorf("failed to parse control command: %v", err)
 	}
 
@@ -448,13 +683,87 @@ func (wh *WebSocketHandler) handleControlCommand(conn *websocket.Conn, message [
 		return fmt.Errorf("session not found")
 	}
 
+	if command.CommandID == "" {
+		command.CommandID = uuid.New().String()
+	}
+	if err := wh.sessionManager.RecordMessage(session.ID, command.Type, command); err != nil {
+		log.Printf("Failed to record control command for session %s: %v", session.ID, err)
+	}
+
+	// High-risk commands from the portal wait for an approved privilege request before reaching the client
+	if conn != session.ClientConn && wh.sessionManager.GetConfig().CommandRequiresApproval(command.Command) {
+		requestID, err := wh.sessionManager.RequestCommandApproval(command, wh.connIdentity(conn))
+		if err != nil {
+			return err
+		}
+
+		// Unattended sessions may have been decided by policy already
+		status := "pending"
+		if privilege, found := session.GetPrivilegeRequest(requestID); found {
+			status = privilege.Status
+		}
+
+		response := struct {
+			Type      string    `json:"type"`
+			SessionID string    `json:"session_id"`
+			CommandID string    `json:"command_id"`
+			RequestID string    `json:"request_id"`
+			Status    string    `json:"status"`
+			Timestamp time.Time `json:"timestamp"`
+		}{
+			Type:      "command_approval_required",
+			SessionID: session.ID,
+			CommandID: command.CommandID,
+			RequestID: requestID,
+			Status:    status,
+			Timestamp: time.Now().UTC(),
+		}
+		return wh.sendMessage(conn, response)
+	}
+
 	session.IncrementCommand(command.Command)
+	session.RecordCommand(command.CommandID, command.Command)
 
 	// Forward command to client if this is from portal
 	if session.ClientConn != nil && session.ClientConn != conn {
-		return wh.sendJSONResponse(session.ClientConn, command)
+		return wh.sendMessage(session.ClientConn, command)
+	}
+
+	return nil
+}
+
+// handleCommandResult records the outcome the client reports for a command and passes it on to the portal
+func (wh *WebSocketHandler) handleCommandResult(conn *websocket.Conn, message []byte) error {
+	var result struct {
+		Type      string `json:"type"`
+		SessionID string `json:"session_id"`
+		CommandID string `json:"command_id"`
+		ExitCode  int    `json:"exit_code"`
+		Output    string `json:"output"`
+	}
+
+	if err := wh.decode(conn, message, &result); err != nil {
+		return fmt.Errorf("failed to parse command result: %v", err)
+	}
+
+	session, exists := wh.sessionManager.GetSession(result.SessionID)
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+	if session.ClientConn != conn {
+		return fmt.Errorf("command results must come from the session's client")
+	}
+
+	record, found := session.RecordCommandResult(result.CommandID, result.ExitCode, result.Output)
+	if !found {
+		return fmt.Errorf("unknown command: %s", result.CommandID)
 	}
+	wh.sessionManager.auditLogger.LogCommandExecution(session.ID, session.TechnicianID, record.Command, result.ExitCode == 0, record.Output)
 
+	if session.PortalConn != nil {
+		result.Output = record.Output
+		return wh.sendMessage(session.PortalConn, result)
+	}
 	return nil
 }
 
@@ -467,7 +776,7 @@ func (wh *WebSocketHandler) handleScreenCapture(conn *websocket.Conn, message []
 		Format    string `json:"format,omitempty"`
 	}
 
-	if err := json.Unmarshal(message, &request); err != nil {
+	if err := wh.decode(conn, message, &request); err != nil {
 		return fmt.Errorf("failed to parse screen capture request: %v", err)
 	}
 
@@ -477,16 +786,59 @@ func (wh *WebSocketHandler) handleScreenCapture(conn *websocket.Conn, message []
 		return fmt.Errorf("session not found")
 	}
 
+	// Bound the requested quality and settle the format before the client encodes anything
+	quality, format, err := wh.sessionManager.GetConfig().ScreenCaptureOptions(request.Quality, request.Format)
+	if err != nil {
+		return fmt.Errorf("invalid screen capture request: %v", err)
+	}
+	request.Quality = quality
+	request.Format = format
+
 	session.IncrementScreenshot()
+	if err := wh.sessionManager.RecordMessage(session.ID, request.Type, request); err != nil {
+		log.Printf("Failed to record screen capture request for session %s: %v", session.ID, err)
+	}
 
 	// Forward request to client
 	if session.ClientConn != nil {
-		return wh.sendJSONResponse(session.ClientConn, request)
+		return wh.sendMessage(session.ClientConn, request)
 	}
 
 	return fmt.Errorf("client not connected")
 }
 
+// handleScreenFrame records a captured frame from the client and forwards it to the portal
+func (wh *WebSocketHandler) handleScreenFrame(conn *websocket.Conn, message []byte) error {
+	var frame struct {
+		Type      string `json:"type"`
+		SessionID string `json:"session_id"`
+		Format    string `json:"format,omitempty"`
+		Data      []byte `json:"data"` // base64-encoded image
+	}
+
+	if err := wh.decode(conn, message, &frame); err != nil {
+		return fmt.Errorf("failed to parse screen frame: %v", err)
+	}
+
+	session, exists := wh.sessionManager.GetSession(frame.SessionID)
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+
+	session.UpdateActivity()
+
+	if err := wh.sessionManager.RecordFrame(frame.SessionID, frame.Data, frame.Format); err != nil {
+		log.Printf("Failed to record frame for session %s: %v", frame.SessionID, err)
+	}
+
+	// Forward frame to portal
+	if session.PortalConn != nil {
+		return wh.sendMessage(session.PortalConn, frame)
+	}
+
+	return nil
+}
+
 // handleInputEvent handles input events (mouse, keyboard)
 func (wh *WebSocketHandler) handleInputEvent(conn *websocket.Conn, message []byte) error {
 	var event struct {
@@ -496,7 +848,7 @@ func (wh *WebSocketHandler) handleInputEvent(conn *websocket.Conn, message []byt
 		Data      map[string]interface{} `json:"data"`
 	}
 
-	if err := json.Unmarshal(message, &event); err != nil {
+	if err := wh.decode(conn, message, &event); err != nil {
 		return fmt.Errorf("failed to parse input event: %v", err)
 	}
 
@@ -508,9 +860,20 @@ func (wh *WebSocketHandler) handleInputEvent(conn *websocket.Conn, message []byt
 
 	session.UpdateActivity()
 
+	if err := wh.sessionManager.RecordInputEvent(event.SessionID, event.EventType, event.Data); err != nil && !errors.Is(err, ErrInputLogFull) {
+		log.Printf("Failed to record input event for session %s: %v", event.SessionID, err)
+	}
+	recorded := event
+	if redactInput(event.EventType, event.Data, wh.sessionManager.GetConfig().RecordKeystrokes) {
+		recorded.Data = nil
+	}
+	if err := wh.sessionManager.RecordMessage(event.SessionID, event.Type, recorded); err != nil {
+		log.Printf("Failed to record input event for session %s: %v", event.SessionID, err)
+	}
+
 	// Forward event to client
 	if session.ClientConn != nil {
-		return wh.sendJSONResponse(session.ClientConn, event)
+		return wh.sendMessage(session.ClientConn, event)
 	}
 
 	return fmt.Errorf("client not connected")
@@ -521,12 +884,14 @@ func (wh *WebSocketHandler) handleFileTransferRequest(conn *websocket.Conn, mess
 	var request struct {
 		Type      string `json:"type"`
 		SessionID string `json:"session_id"`
-		Action    string `json:"action"` // start, approve, deny
+		Action     string `json:"action"` // start, approve, deny, complete, cancel
+		TransferID string `json:"transfer_id,omitempty"` // assigned on start if the sender didn't pick one
+		Direction  string `json:"direction,omitempty"` // upload, download
 		Filename  string `json:"filename,omitempty"`
 		FileSize  int64  `json:"file_size,omitempty"`
 	}
 
-	if err := json.Unmarshal(message, &request); err != nil {
+	if err := wh.decode(conn, message, &request); err != nil {
 		return fmt.Errorf("failed to parse file transfer request: %v", err)
 	}
 
@@ -536,15 +901,46 @@ func (wh *WebSocketHandler) handleFileTransferRequest(conn *websocket.Conn, mess
 		return fmt.Errorf("session not found")
 	}
 
-	if request.Action == "start" {
-		session.AddFileTransfer(request.FileSize)
+	// Only the session's own peers can take or free its transfer slots
+	if conn != session.ClientConn && conn != session.PortalConn {
+		wh.sessionManager.auditLogger.LogSecurityViolation(session.ID, "", "", "file transfer request from a connection outside the session", wh.connIP(conn))
+		return fmt.Errorf("only the session's client or portal can manage its file transfers")
+	}
+
+	switch request.Action {
+	case "start":
+		if request.TransferID == "" {
+			request.TransferID = uuid.New().String()
+		}
+		if err := wh.sessionManager.StartFileTransfer(request.SessionID, request.TransferID, request.Direction, request.Filename, request.FileSize); err != nil {
+			return err
+		}
+
+		// Tell the sender which ID the transfer goes by
+		accepted := struct {
+			Type       string    `json:"type"`
+			SessionID  string    `json:"session_id"`
+			TransferID string    `json:"transfer_id"`
+			Timestamp  time.Time `json:"timestamp"`
+		}{
+			Type:       "file_transfer_started",
+			SessionID:  session.ID,
+			TransferID: request.TransferID,
+			Timestamp:  time.Now().UTC(),
+		}
+		if err := wh.sendMessage(conn, accepted); err != nil {
+			return err
+		}
+	case "deny", "complete", "cancel":
+		// Free the session's transfer slot for the next one
+		wh.sessionManager.FinishFileTransfer(request.SessionID, request.TransferID)
 	}
 
 	// Forward to appropriate connection
 	if session.ClientConn != nil && session.ClientConn != conn {
-		return wh.sendJSONResponse(session.ClientConn, request)
+		return wh.sendMessage(session.ClientConn, request)
 	} else if session.PortalConn != nil && session.PortalConn != conn {
-		return wh.sendJSONResponse(session.PortalConn, request)
+		return wh.sendMessage(session.PortalConn, request)
 	}
 
 	return nil
@@ -558,7 +954,7 @@ func (wh *WebSocketHandler) handleHeartbeat(conn *websocket.Conn, message []byte
 		Timestamp int64  `json:"timestamp"`
 	}
 
-	if err := json.Unmarshal(message, &heartbeat); err != nil {
+	if err := wh.decode(conn, message, &heartbeat); err != nil {
 		return fmt.Errorf("failed to parse heartbeat: %v", err)
 	}
 
@@ -578,18 +974,37 @@ func (wh *WebSocketHandler) handleHeartbeat(conn *websocket.Conn, message []byte
 		Timestamp: time.Now().Unix(),
 	}
 
-	return wh.sendJSONResponse(conn, response)
+	return wh.sendMessage(conn, response)
 }
 
-// sendJSONResponse sends a JSON response to the WebSocket connection
-func (wh *WebSocketHandler) sendJSONResponse(conn *websocket.Conn, response interface{}) error {
-	data, err := json.Marshal(response)
-	if err != nil {
-		return fmt.Errorf("failed to marshal response: %v", err)
+// decode parses a message in the connection's negotiated encoding
+func (wh *WebSocketHandler) decode(conn *websocket.Conn, message []byte, v interface{}) error {
+	return wh.sessionManager.connTracker.Codec(conn).Unmarshal(message, v)
+}
+
+// sendMessage sends a message to the WebSocket connection in its negotiated encoding
+func (wh *WebSocketHandler) sendMessage(conn *websocket.Conn, response interface{}) error {
+	return wh.sessionManager.writeMessage(conn, response)
+}
+
+// originAllowed is the upgrader's origin check against the live configuration
+func (wh *WebSocketHandler) originAllowed(r *http.Request) bool {
+	return clientnet.OriginAllowed(r, wh.sessionManager.GetConfig().AllowedOrigins)
+}
+
+// connIP returns the client IP a connection was opened from, resolved through the trusted proxies
+// like the REST API's, so lockouts count the same client whichever way it comes in
+func (wh *WebSocketHandler) connIP(conn *websocket.Conn) string {
+	if stats, tracked := wh.sessionManager.connTracker.Lookup(conn); tracked && stats.ClientIP != "" {
+		return stats.ClientIP
 	}
+	return clientnet.PeerIP(conn.RemoteAddr().String())
+}
 
-	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	return conn.WriteMessage(websocket.TextMessage, data)
+// connIdentity returns the subject a connection authenticated as, empty for anonymous connections
+func (wh *WebSocketHandler) connIdentity(conn *websocket.Conn) string {
+	stats, _ := wh.sessionManager.connTracker.Lookup(conn)
+	return stats.Identity
 }
 
 // sendErrorResponse sends an error response to the WebSocket connection
@@ -601,10 +1016,67 @@ func (wh *WebSocketHandler) sendErrorResponse(conn *websocket.Conn, errorMessage
 	}{
 		Type:      "error",
 		Error:     errorMessage,
-		Timestamp: time.Now(),
+		Timestamp: time.Now().UTC(),
 	}
 
-	wh.sendJSONResponse(conn, errorResponse)
+	wh.sendMessage(conn, errorResponse)
+}
+
+// rejectAtCapacity tells the client the server is full and when to retry, then closes the connection
+func (wh *WebSocketHandler) rejectAtCapacity(conn *websocket.Conn) {
+	hint := wh.sessionManager.RetryHint(RetryReasonAtCapacity)
+
+	rejection := struct {
+		Type string `json:"type"`
+		RetryHint
+		Error     string    `json:"error"`
+		Timestamp time.Time `json:"timestamp"`
+	}{
+		Type:      "error",
+		RetryHint: hint,
+		Error:     ErrAtCapacity.Error(),
+		Timestamp: time.Now().UTC(),
+	}
+	wh.sendMessage(conn, rejection)
+
+	if err := closeWithRetryHint(conn, websocket.CloseTryAgainLater, hint, wh.config.WebSocketWriteTimeout); err != nil {
+		log.Printf("Failed to send close frame: %v", err)
+	}
+}
+
+// Drain stops accepting new sessions and tells every connected client the server is shutting down
+// and when to reconnect, then closes their connections with the same hint. Only the first call broadcasts.
+func (wh *WebSocketHandler) Drain() {
+	if !wh.sessionManager.BeginDrain() {
+		return
+	}
+	hint := wh.sessionManager.RetryHint(RetryReasonDraining)
+
+	notice := struct {
+		Type string `json:"type"`
+		RetryHint
+		Timestamp time.Time `json:"timestamp"`
+	}{
+		Type:      "server_shutting_down",
+		RetryHint: hint,
+		Timestamp: time.Now().UTC(),
+	}
+
+	for _, conn := range wh.sessionManager.connTracker.Conns() {
+		if err := wh.sendMessage(conn, notice); err != nil {
+			log.Printf("Failed to send shutdown notice to %s: %v", conn.RemoteAddr(), err)
+			continue
+		}
+		if err := closeWithRetryHint(conn, websocket.CloseServiceRestart, hint, wh.config.WebSocketWriteTimeout); err != nil {
+			log.Printf("Failed to send close frame: %v", err)
+		}
+	}
+}
+
+// SetAuthenticator tells the handler an auth provider is configured, so portal and observer
+// registrations need an authenticated identity
+func (wh *WebSocketHandler) SetAuthenticator(authenticator auth.Authenticator) {
+	wh.authenticator = authenticator
 }
 
 // GetSessionManager returns the session manager
@@ -626,8 +1098,18 @@ func (wh *WebSocketHandler) Shutdown() {
 	
 	// Shutdown session manager
 	if wh.sessionManager != nil {
+		wh.Drain()
+
+		// Clients that didn't act on the close frame are cut off so their handlers return
+		for _, conn := range wh.sessionManager.connTracker.Conns() {
+			conn.Close()
+		}
+		wh.auditLogger.SetStore(nil) // the session manager closes it
 		wh.sessionManager.Shutdown()
 	}
+
+	// Stop the ping loops and wait for them
+	wh.workers.Stop(lifecycle.DefaultStopTimeout)
 	
 	log.Println("WebSocket handler shutdown complete")
 }
\ No newline at end of file
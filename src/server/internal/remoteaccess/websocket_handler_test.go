@@ -0,0 +1,1191 @@
+package remoteaccess
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+
+	"github.com/onlitec/onlidesk-server/internal/auth"
+)
+
+// newTestWebSocketHandler creates a handler whose audit logs are written under the test dir
+func newTestWebSocketHandler(t *testing.T, config *RemoteAccessConfig) *WebSocketHandler {
+	t.Helper()
+
+	wh := NewWebSocketHandler(config)
+	wh.auditLogger.Close()
+	wh.auditLogger = NewAuditLogger(t.TempDir(), true)
+	wh.sessionManager.auditLogger.Close()
+	wh.sessionManager.auditLogger = NewAuditLogger(t.TempDir(), true)
+	t.Cleanup(wh.Shutdown)
+	return wh
+}
+
+// dialTestHandler connects a client to the handler through a test server
+func dialTestHandler(t *testing.T, wh *WebSocketHandler) *websocket.Conn {
+	t.Helper()
+	return dialTestHandlerAs(t, wh, "")
+}
+
+// dialTestHandlerAs connects to the handler authenticated as subject, or anonymously if empty
+func dialTestHandlerAs(t *testing.T, wh *WebSocketHandler, subject string) *websocket.Conn {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subject != "" {
+			r = r.WithContext(auth.WithIdentity(r.Context(), auth.Identity{Subject: subject}))
+		}
+		wh.HandleWebSocket(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWebSocketHandler_RejectsBlockedSourceIPsAtUpgrade(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.BlockedIPRanges = []string{"203.0.113.0/24"}
+	config.TrustedProxies = []string{"127.0.0.0/8"}
+	wh := newTestWebSocketHandler(t, config)
+
+	server := httptest.NewServer(http.HandlerFunc(wh.HandleWebSocket))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// A client behind the proxy from a blocked network is refused before the upgrade
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {"203.0.113.7"}})
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, readAuditEventTypes(t, wh.sessionManager.auditLogger), "connection_blocked")
+
+	// Other sources connect as before
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {"198.51.100.7"}})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestWebSocketHandler_MeasuresPingLatency(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.WebSocketPingInterval = 20 * time.Millisecond
+	config.HighLatencyThreshold = 25 * time.Millisecond
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	// The mock client answers every ping only after a fixed delay
+	const pongDelay = 50 * time.Millisecond
+	conn := dialTestHandler(t, wh)
+	conn.SetPingHandler(func(payload string) error {
+		time.Sleep(pongDelay)
+		return conn.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	require.NoError(t, conn.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       "client",
+	}))
+
+	require.Eventually(t, func() bool {
+		connections := sm.GetConnections()
+		return len(connections) == 1 && connections[0].PongCount >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stats := sm.GetConnections()[0]
+	assert.Equal(t, session.ID, stats.SessionID)
+	assert.Equal(t, "client", stats.Role)
+	assert.GreaterOrEqual(t, stats.Latency, pongDelay)
+	assert.Less(t, stats.Latency, 10*pongDelay)
+	assert.True(t, stats.HighLatency)
+
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+	assert.GreaterOrEqual(t, session.Statistics.ClientLatency, pongDelay)
+	assert.True(t, session.Statistics.HighLatency)
+}
+
+// readTestMessage reads the next JSON message from a test client connection
+func readTestMessage(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message map[string]interface{}
+	require.NoError(t, conn.ReadJSON(&message))
+	return message
+}
+
+func TestWebSocketHandler_ClientInfoHandshake(t *testing.T) {
+	wh := newTestWebSocketHandler(t, DefaultRemoteAccessConfig())
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	conn := dialTestHandler(t, wh)
+	require.NoError(t, conn.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       "client",
+	}))
+	assert.Equal(t, "session_registered", readTestMessage(t, conn)["type"])
+
+	before := session.LastActivity
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{
+		"type":       "client_info",
+		"session_id": session.ID,
+		"client_info": ClientInfo{
+			Hostname:         "ws-accounting-07",
+			OperatingSystem:  "Windows 11 Pro 23H2",
+			UserAgent:        "OnliDesk-Client/2.4.1",
+			ScreenResolution: "2560x1440",
+			CurrentUser:      "CORP\\jdoe",
+			SystemInfo:       map[string]string{"cpu": "Intel i7-1185G7", "memory_mb": "16384"},
+		},
+	}))
+	assert.Equal(t, "client_info_ack", readTestMessage(t, conn)["type"])
+
+	session.mutex.RLock()
+	info := *session.ClientInfo
+	lastActivity := session.LastActivity
+	session.mutex.RUnlock()
+
+	assert.Equal(t, "ws-accounting-07", info.Hostname)
+	assert.Equal(t, "Windows 11 Pro 23H2", info.OperatingSystem)
+	assert.Equal(t, "127.0.0.1", info.IPAddress)
+	assert.Equal(t, "2560x1440", info.ScreenResolution)
+	assert.Equal(t, "CORP\\jdoe", info.CurrentUser)
+	assert.Equal(t, "16384", info.SystemInfo["memory_mb"])
+	assert.True(t, lastActivity.After(before))
+
+	// Malformed info is rejected and leaves the stored info untouched
+	systemInfo := make(map[string]string)
+	for i := 0; i <= maxSystemInfoEntries; i++ {
+		systemInfo[fmt.Sprintf("key_%d", i)] = "value"
+	}
+	for _, bad := range []ClientInfo{
+		{Hostname: strings.Repeat("a", maxClientInfoFieldLength+1)},
+		{Hostname: "bad host;rm -rf"},
+		{ScreenResolution: "huge"},
+		{OperatingSystem: "Windows<script>"},
+		{IPAddress: "999.1.1.1"},
+		{SystemInfo: systemInfo},
+	} {
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"type":        "client_info",
+			"session_id":  session.ID,
+			"client_info": bad,
+		}))
+		response := readTestMessage(t, conn)
+		assert.Equal(t, "error", response["type"])
+		assert.Contains(t, response["error"], ErrInvalidClientInfo.Error())
+	}
+
+	// Operating systems are only checked for shape, not against a list of known ones
+	assert.NoError(t, (&ClientInfo{OperatingSystem: "TempleOS 5.03"}).Validate())
+	assert.NoError(t, (&ClientInfo{OperatingSystem: "macOS 14.4 (Sonoma)"}).Validate())
+
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+	assert.Equal(t, "ws-accounting-07", session.ClientInfo.Hostname)
+	assert.Len(t, session.ClientInfo.SystemInfo, 2)
+}
+
+func TestWebSocketHandler_AdvertisesBackoffWhenAtCapacity(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxConcurrentSessions = 1
+	config.ReconnectBaseDelay = 5 * time.Second
+	config.ReconnectMaxDelay = 12 * time.Second
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	_, err := sm.CreateSession("existing", "tech", nil)
+	require.NoError(t, err)
+
+	// Each rejection within the window doubles the advertised delay, up to the maximum
+	for _, expected := range []float64{5, 10, 12} {
+		conn := dialTestHandler(t, wh)
+		require.NoError(t, conn.WriteJSON(map[string]string{
+			"type":          "session_create",
+			"client_id":     "client",
+			"technician_id": "tech",
+		}))
+
+		response := readTestMessage(t, conn)
+		assert.Equal(t, "error", response["type"])
+		assert.Equal(t, RetryReasonAtCapacity, response["reason"])
+		assert.Equal(t, expected, response["retry_after"])
+		assert.Equal(t, float64(1), response["active_sessions"])
+		assert.Equal(t, float64(1), response["max_sessions"])
+
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.CloseTryAgainLater, closeErr.Code)
+
+		var hint RetryHint
+		require.NoError(t, json.Unmarshal([]byte(closeErr.Text), &hint))
+		assert.Equal(t, RetryReasonAtCapacity, hint.Reason)
+		assert.Equal(t, int(expected), hint.RetryAfter)
+	}
+}
+
+func TestWebSocketHandler_RefusesConnectionsWhileDraining(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.ReconnectDrainDelay = 45 * time.Second
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+	sm.BeginDrain()
+
+	server := httptest.NewServer(http.HandlerFunc(wh.HandleWebSocket))
+	defer server.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "45", resp.Header.Get("Retry-After"))
+
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, RetryReasonDraining, body["reason"])
+	assert.Equal(t, float64(45), body["retry_after"])
+
+	_, err = sm.CreateSession("client", "tech", nil)
+	assert.Error(t, err)
+}
+
+func TestWebSocketHandler_EnforcesRoleMessagePolicy(t *testing.T) {
+	wh := newTestWebSocketHandler(t, DefaultRemoteAccessConfig())
+	wh.SetAuthenticator(stubAuthenticator{})
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	observer := dialTestHandlerAs(t, wh, "auditor")
+	require.NoError(t, observer.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       RoleObserver,
+	}))
+	assert.Equal(t, "session_registered", readTestMessage(t, observer)["type"])
+
+	// Control, privilege and re-registration attempts are refused
+	for _, message := range []map[string]string{
+		{"type": "control_command", "session_id": session.ID, "command": "reboot"},
+		{"type": "privilege_request", "session_id": session.ID, "privilege_type": "elevated"},
+		{"type": "session_register", "session_id": session.ID, "role": "portal"},
+	} {
+		require.NoError(t, observer.WriteJSON(message))
+		response := readTestMessage(t, observer)
+		assert.Equal(t, "error", response["type"])
+		assert.Contains(t, response["error"], ErrMessageNotPermitted.Error())
+	}
+
+	// Screen subscriptions are dispatched; with no client attached there is nobody to forward to
+	require.NoError(t, observer.WriteJSON(map[string]interface{}{
+		"type":       "screen_capture",
+		"session_id": session.ID,
+	}))
+	response := readTestMessage(t, observer)
+	assert.Equal(t, "error", response["type"])
+	assert.Equal(t, "client not connected", response["error"])
+
+	session.mutex.RLock()
+	assert.Equal(t, 1, session.Statistics.ScreenshotsTaken)
+	assert.Equal(t, 0, session.Statistics.CommandsExecuted)
+	assert.Empty(t, session.Privileges)
+	session.mutex.RUnlock()
+
+	// Unregistered connections may only register, and only as the client unless authenticated
+	anonymous := dialTestHandler(t, wh)
+	require.NoError(t, anonymous.WriteJSON(map[string]interface{}{"type": "heartbeat", "timestamp": 1}))
+	response = readTestMessage(t, anonymous)
+	assert.Equal(t, "error", response["type"])
+	assert.Contains(t, response["error"], ErrMessageNotPermitted.Error())
+
+	for _, message := range []map[string]string{
+		{"type": "session_register", "session_id": session.ID, "role": "portal"},
+		{"type": "session_join", "session_id": session.ID, "technician_id": "tech"},
+	} {
+		require.NoError(t, anonymous.WriteJSON(message))
+		response = readTestMessage(t, anonymous)
+		assert.Equal(t, "error", response["type"])
+		assert.Contains(t, response["error"], ErrRoleNotPermitted.Error())
+	}
+
+	violations := 0
+	for _, eventType := range readAuditEventTypes(t, sm.auditLogger) {
+		if eventType == "security_violation" {
+			violations++
+		}
+	}
+	assert.Equal(t, 6, violations)
+}
+
+func TestWebSocketHandler_KeepsRequestedRolesWithoutAnAuthProvider(t *testing.T) {
+	wh := newTestWebSocketHandler(t, DefaultRemoteAccessConfig())
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	// Nobody can authenticate under the default provider, so the portal joins anonymously
+	portal := dialTestHandler(t, wh)
+	require.NoError(t, portal.WriteJSON(map[string]string{
+		"type":          "session_join",
+		"session_id":    session.ID,
+		"technician_id": "tech",
+	}))
+	assert.Equal(t, "session_joined", readTestMessage(t, portal)["type"])
+
+	observer := dialTestHandler(t, wh)
+	require.NoError(t, observer.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       RoleObserver,
+	}))
+	assert.Equal(t, "session_registered", readTestMessage(t, observer)["type"])
+
+	// Roles outside the policy are still refused
+	stranger := dialTestHandler(t, wh)
+	require.NoError(t, stranger.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       "admin",
+	}))
+	response := readTestMessage(t, stranger)
+	assert.Equal(t, "error", response["type"])
+	assert.Contains(t, response["error"], ErrRoleNotPermitted.Error())
+}
+
+func TestWebSocketHandler_ClampsScreenCaptureQuality(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.ScreenshotQuality = 70
+	config.MinScreenshotQuality = 20
+	config.MaxScreenshotQuality = 90
+
+	for _, tc := range []struct {
+		quality  int
+		format   string
+		expected int
+		resolved string
+	}{
+		{quality: 0, format: "", expected: 70, resolved: "jpg"},
+		{quality: 5, format: "png", expected: 20, resolved: "png"},
+		{quality: -40, format: "webp", expected: 20, resolved: "webp"},
+		{quality: 55, format: "JPEG", expected: 55, resolved: "jpg"},
+		{quality: 1000, format: "jpg", expected: 90, resolved: "jpg"},
+	} {
+		quality, format, err := config.ScreenCaptureOptions(tc.quality, tc.format)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, quality, "quality %d", tc.quality)
+		assert.Equal(t, tc.resolved, format)
+	}
+
+	_, _, err := config.ScreenCaptureOptions(50, "bmp")
+	assert.Error(t, err)
+
+	// Configs predating the bounds still stay within 1-100
+	unbounded := &RemoteAccessConfig{ScreenshotQuality: 80}
+	quality, _, err := unbounded.ScreenCaptureOptions(0, "")
+	require.NoError(t, err)
+	assert.Equal(t, 80, quality)
+	quality, _, err = unbounded.ScreenCaptureOptions(250, "")
+	require.NoError(t, err)
+	assert.Equal(t, 100, quality)
+
+	// Requests with unsupported formats are refused before reaching the client
+	wh := newTestWebSocketHandler(t, config)
+	session, err := wh.GetSessionManager().CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	conn := dialTestHandlerAs(t, wh, "tech")
+	require.NoError(t, conn.WriteJSON(map[string]string{
+		"type":          "session_join",
+		"session_id":    session.ID,
+		"technician_id": "tech",
+	}))
+	assert.Equal(t, "session_joined", readTestMessage(t, conn)["type"])
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{
+		"type":       "screen_capture",
+		"session_id": session.ID,
+		"quality":    500,
+		"format":     "tiff",
+	}))
+	response := readTestMessage(t, conn)
+	assert.Equal(t, "error", response["type"])
+	assert.Contains(t, response["error"], "unsupported frame format")
+
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+	assert.Equal(t, 0, session.Statistics.ScreenshotsTaken)
+}
+
+func TestWebSocketHandler_DrainNotifiesConnectionsBeforeClosing(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.ReconnectDrainDelay = 45 * time.Second
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	var conns []*websocket.Conn
+	for role, subject := range map[string]string{"client": "", "portal": "tech"} {
+		conn := dialTestHandlerAs(t, wh, subject)
+		require.NoError(t, conn.WriteJSON(map[string]string{
+			"type":       "session_register",
+			"session_id": session.ID,
+			"role":       role,
+		}))
+		assert.Equal(t, "session_registered", readTestMessage(t, conn)["type"])
+		conns = append(conns, conn)
+	}
+
+	wh.Drain()
+
+	for _, conn := range conns {
+		notice := readTestMessage(t, conn)
+		assert.Equal(t, "server_shutting_down", notice["type"])
+		assert.Equal(t, RetryReasonDraining, notice["reason"])
+		assert.Equal(t, float64(45), notice["retry_after"])
+		assert.NotEmpty(t, notice["message"])
+
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.CloseServiceRestart, closeErr.Code)
+	}
+
+	assert.True(t, sm.IsDraining())
+}
+
+func TestWebSocketHandler_ShutdownJoinsBackgroundGoroutines(t *testing.T) {
+	// Registered first so it runs after every other cleanup, including the test server
+	ignore := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+
+	config := DefaultRemoteAccessConfig()
+	config.WebSocketPingInterval = 10 * time.Millisecond
+	config.CleanupInterval = 10 * time.Millisecond
+	wh := newTestWebSocketHandler(t, config)
+
+	// Connected clients each have a ping loop, and the session manager runs its cleanup routine
+	for i := 0; i < 3; i++ {
+		dialTestHandler(t, wh)
+	}
+	_, err := wh.sessionManager.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(wh.sessionManager.GetConnections()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	wh.Shutdown()
+	assert.Empty(t, wh.workers.Running())
+
+	// Shutting down again is harmless
+	wh.Shutdown()
+}
+
+// writeCodecMessage sends a message in the given encoding
+func writeCodecMessage(t *testing.T, conn *websocket.Conn, codec MessageCodec, message interface{}) {
+	t.Helper()
+
+	data, err := codec.Marshal(message)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(codec.FrameType(), data))
+}
+
+// readCodecMessage reads the next message, checking it arrived in the given encoding
+func readCodecMessage(t *testing.T, conn *websocket.Conn, codec MessageCodec) map[string]interface{} {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frameType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, codec.FrameType(), frameType, "message arrived in the wrong encoding")
+
+	var message map[string]interface{}
+	require.NoError(t, codec.Unmarshal(data, &message))
+	return message
+}
+
+func TestWebSocketHandler_RoundTripsNegotiatedEncodings(t *testing.T) {
+	for _, encoding := range []string{EncodingJSON, EncodingMsgPack} {
+		t.Run(encoding, func(t *testing.T) {
+			wh := newTestWebSocketHandler(t, DefaultRemoteAccessConfig())
+			sm := wh.GetSessionManager()
+			codec, err := LookupCodec(encoding)
+			require.NoError(t, err)
+
+			session, err := sm.CreateSession("client", "tech", nil)
+			require.NoError(t, err)
+
+			// The hello is always spoken in JSON; the reply settles the encoding
+			client := dialTestHandler(t, wh)
+			require.NoError(t, client.WriteJSON(map[string]interface{}{
+				"type":      "hello",
+				"encodings": []string{encoding, EncodingJSON},
+			}))
+			hello := readTestMessage(t, client)
+			assert.Equal(t, "hello", hello["type"])
+			assert.Equal(t, encoding, hello["encoding"])
+			assert.Equal(t, []interface{}{EncodingJSON, EncodingMsgPack}, hello["encodings"])
+
+			writeCodecMessage(t, client, codec, map[string]string{
+				"type":       "session_register",
+				"session_id": session.ID,
+				"role":       "client",
+			})
+			registered := readCodecMessage(t, client, codec)
+			assert.Equal(t, "session_registered", registered["type"])
+			assert.Equal(t, session.ID, registered["session_id"])
+
+			// A JSON portal's input reaches the client in the client's encoding
+			portal := dialTestHandlerAs(t, wh, "tech")
+			require.NoError(t, portal.WriteJSON(map[string]string{
+				"type":          "session_join",
+				"session_id":    session.ID,
+				"technician_id": "tech",
+			}))
+			assert.Equal(t, "session_joined", readTestMessage(t, portal)["type"])
+			require.NoError(t, portal.WriteJSON(map[string]interface{}{
+				"type":       "input_event",
+				"session_id": session.ID,
+				"event_type": "mouse_click",
+				"data":       map[string]string{"button": "left"},
+			}))
+			event := readCodecMessage(t, client, codec)
+			assert.Equal(t, "input_event", event["type"])
+			assert.Equal(t, "mouse_click", event["event_type"])
+			assert.Equal(t, map[string]interface{}{"button": "left"}, event["data"])
+
+			writeCodecMessage(t, client, codec, map[string]interface{}{
+				"type":       "heartbeat",
+				"session_id": session.ID,
+				"timestamp":  time.Now().Unix(),
+			})
+			assert.Equal(t, "heartbeat_response", readCodecMessage(t, client, codec)["type"])
+
+			encodings := make(map[string]int)
+			for _, stats := range sm.GetConnections() {
+				encodings[stats.Encoding]++
+			}
+			if encoding == EncodingJSON {
+				assert.Equal(t, map[string]int{EncodingJSON: 2}, encodings)
+			} else {
+				assert.Equal(t, map[string]int{EncodingJSON: 1, EncodingMsgPack: 1}, encodings)
+			}
+		})
+	}
+}
+
+func TestWebSocketHandler_FallsBackToJSONWhenMessagePackDisabled(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MessagePackEnabled = false
+	wh := newTestWebSocketHandler(t, config)
+
+	conn := dialTestHandler(t, wh)
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{
+		"type":      "hello",
+		"encodings": []string{EncodingMsgPack},
+	}))
+	hello := readTestMessage(t, conn)
+	assert.Equal(t, EncodingJSON, hello["encoding"])
+	assert.Equal(t, []interface{}{EncodingJSON}, hello["encodings"])
+
+	session, err := wh.GetSessionManager().CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "session_register", "session_id": session.ID, "role": "client"}))
+	assert.Equal(t, "session_registered", readTestMessage(t, conn)["type"])
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "heartbeat", "timestamp": time.Now().Unix()}))
+	assert.Equal(t, "heartbeat_response", readTestMessage(t, conn)["type"])
+}
+
+func TestWebSocketHandler_LimitsConcurrentTransfersPerSession(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxConcurrentTransfersPerSession = 2
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	client := dialTestHandler(t, wh)
+	require.NoError(t, client.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       "client",
+	}))
+	assert.Equal(t, "session_registered", readTestMessage(t, client)["type"])
+
+	portal := dialTestHandlerAs(t, wh, "tech")
+	require.NoError(t, portal.WriteJSON(map[string]string{
+		"type":          "session_join",
+		"session_id":    session.ID,
+		"technician_id": "tech",
+	}))
+	assert.Equal(t, "session_joined", readTestMessage(t, portal)["type"])
+
+	transfer := func(action, transferID string) {
+		require.NoError(t, portal.WriteJSON(map[string]interface{}{
+			"type":        "file_transfer_request",
+			"session_id":  session.ID,
+			"action":      action,
+			"transfer_id": transferID,
+			"direction":   TransferDirectionUpload,
+			"filename":    "fix.log",
+			"file_size":   10,
+		}))
+	}
+
+	// Transfers up to the limit are forwarded to the client; a transfer ID is assigned if missing
+	// and returned to the sender
+	transfer("start", "transfer-1")
+	assert.Equal(t, "transfer-1", readTestMessage(t, portal)["transfer_id"])
+	assert.Equal(t, "transfer-1", readTestMessage(t, client)["transfer_id"])
+	transfer("start", "")
+	started := readTestMessage(t, portal)
+	assert.Equal(t, "file_transfer_started", started["type"])
+	assert.NotEmpty(t, started["transfer_id"])
+	assert.Equal(t, started["transfer_id"], readTestMessage(t, client)["transfer_id"])
+
+	transfer("start", "transfer-3")
+	response := readTestMessage(t, portal)
+	assert.Equal(t, "error", response["type"])
+	assert.Contains(t, response["error"], ErrTooManyConcurrentTransfers.Error())
+	assert.Equal(t, 2, session.Statistics.ActiveTransfers)
+
+	activeTransfers := func() int {
+		session.mutex.RLock()
+		defer session.mutex.RUnlock()
+		return session.Statistics.ActiveTransfers
+	}
+
+	// Connections outside the session can't free its slots
+	outsider := dialTestHandler(t, wh)
+	other, err := sm.CreateSession("other-client", "tech", nil)
+	require.NoError(t, err)
+	require.NoError(t, outsider.WriteJSON(map[string]string{"type": "session_register", "session_id": other.ID, "role": "client"}))
+	assert.Equal(t, "session_registered", readTestMessage(t, outsider)["type"])
+	require.NoError(t, outsider.WriteJSON(map[string]interface{}{
+		"type":        "file_transfer_request",
+		"session_id":  session.ID,
+		"action":      "cancel",
+		"transfer_id": "transfer-1",
+	}))
+	assert.Equal(t, "error", readTestMessage(t, outsider)["type"])
+	assert.Equal(t, 2, activeTransfers())
+
+	// Finishing a transfer frees its slot
+	transfer("complete", "transfer-1")
+	assert.Equal(t, "complete", readTestMessage(t, client)["action"])
+	transfer("start", "transfer-3")
+	assert.Equal(t, "transfer-3", readTestMessage(t, portal)["transfer_id"])
+	assert.Equal(t, "transfer-3", readTestMessage(t, client)["transfer_id"])
+
+	// A peer disconnecting frees every slot
+	portal.Close()
+	assert.Eventually(t, func() bool { return activeTransfers() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	var blocked []AuditEvent
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == "file_transfer_blocked" {
+			blocked = append(blocked, event)
+		}
+	}
+	require.Len(t, blocked, 1)
+	assert.Contains(t, blocked[0].Details["reason"], ErrTooManyConcurrentTransfers.Error())
+}
+
+func TestWebSocketHandler_RecordsCommandHistory(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxCommandHistory = 3
+	config.MaxCommandOutput = 8
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	client := dialTestHandler(t, wh)
+	require.NoError(t, client.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       "client",
+	}))
+	assert.Equal(t, "session_registered", readTestMessage(t, client)["type"])
+
+	portal := dialTestHandlerAs(t, wh, "tech")
+	require.NoError(t, portal.WriteJSON(map[string]string{
+		"type":          "session_join",
+		"session_id":    session.ID,
+		"technician_id": "tech",
+	}))
+	assert.Equal(t, "session_joined", readTestMessage(t, portal)["type"])
+
+	// The client runs each forwarded command and reports back; the oldest falls out of the history
+	for i, command := range []string{"hostname", "whoami", "ipconfig", "dir"} {
+		require.NoError(t, portal.WriteJSON(map[string]string{
+			"type":       "control_command",
+			"session_id": session.ID,
+			"command":    command,
+		}))
+		forwarded := readTestMessage(t, client)
+		require.Equal(t, command, forwarded["command"])
+		require.NotEmpty(t, forwarded["command_id"])
+
+		require.NoError(t, client.WriteJSON(map[string]interface{}{
+			"type":       "command_result",
+			"session_id": session.ID,
+			"command_id": forwarded["command_id"],
+			"exit_code":  i,
+			"output":     command + " output",
+		}))
+		result := readTestMessage(t, portal)
+		require.Equal(t, "command_result", result["type"])
+	}
+
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/remoteaccess/sessions/"+session.ID+"/commands", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var body struct {
+		Commands []CommandRecord `json:"commands"`
+		Total    int             `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Equal(t, 3, body.Total)
+	for i, command := range []string{"whoami", "ipconfig", "dir"} {
+		record := body.Commands[i]
+		assert.Equal(t, command, record.Command)
+		require.NotNil(t, record.ExitCode)
+		assert.Equal(t, i+1, *record.ExitCode)
+		assert.NotNil(t, record.CompletedAt)
+		assert.LessOrEqual(t, len(record.Output), 8)
+	}
+	assert.Equal(t, "dir outp", body.Commands[2].Output)
+	assert.True(t, body.Commands[2].Truncated)
+
+	// Results for commands the session never issued are refused
+	require.NoError(t, client.WriteJSON(map[string]interface{}{
+		"type":       "command_result",
+		"session_id": session.ID,
+		"command_id": "forged",
+	}))
+	assert.Equal(t, "error", readTestMessage(t, client)["type"])
+}
+
+func TestWebSocketHandler_HoldsHighRiskCommandsForApproval(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.CommandExecutionEnabled = true
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+
+	client := dialTestHandler(t, wh)
+	require.NoError(t, client.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       "client",
+	}))
+	assert.Equal(t, "session_registered", readTestMessage(t, client)["type"])
+
+	portal := dialTestHandlerAs(t, wh, "tech")
+	require.NoError(t, portal.WriteJSON(map[string]string{
+		"type":          "session_join",
+		"session_id":    session.ID,
+		"technician_id": "tech",
+	}))
+	assert.Equal(t, "session_joined", readTestMessage(t, portal)["type"])
+
+	sendCommand := func(command string) {
+		require.NoError(t, portal.WriteJSON(map[string]string{
+			"type":       "control_command",
+			"session_id": session.ID,
+			"command":    command,
+		}))
+	}
+
+	// The high-risk command is held back while the safe one goes straight through
+	sendCommand("rm -rf /tmp/cache")
+	held := readTestMessage(t, portal)
+	require.Equal(t, "command_approval_required", held["type"])
+	assert.Equal(t, "pending", held["status"])
+	requestID := held["request_id"].(string)
+
+	// The client user is asked to consent to it
+	consent := readTestMessage(t, client)
+	assert.Equal(t, "command_approval_request", consent["type"])
+	assert.Equal(t, requestID, consent["request_id"])
+	assert.Equal(t, "rm -rf /tmp/cache", consent["command"])
+
+	sendCommand("hostname")
+	assert.Equal(t, "hostname", readTestMessage(t, client)["command"])
+
+	request, found := session.GetPrivilegeRequest(requestID)
+	require.True(t, found)
+	assert.Equal(t, PrivilegeTypeCommand, request.Type)
+	assert.Equal(t, "rm -rf /tmp/cache", request.Justification)
+	assert.Equal(t, "tech", request.RequestedBy)
+
+	// Only an authenticated approver can decide it
+	anonymous := dialTestHandler(t, wh)
+	require.NoError(t, anonymous.WriteJSON(map[string]interface{}{
+		"type":       "privilege_response",
+		"session_id": session.ID,
+		"request_id": requestID,
+		"approved":   true,
+	}))
+	assert.Equal(t, "error", readTestMessage(t, anonymous)["type"])
+
+	// Nor can the technician who sent it
+	approve := func(conn *websocket.Conn, requestID interface{}, approved bool) {
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"type":       "privilege_response",
+			"session_id": session.ID,
+			"request_id": requestID,
+			"approved":   approved,
+			"reason":     "not during business hours",
+		}))
+	}
+	approve(portal, requestID, true)
+	assert.Equal(t, "error", readTestMessage(t, portal)["type"])
+
+	// Another approver's decision sends the command on, without granting a lasting privilege
+	supervised, err := sm.CreateSession("other-client", "supervisor", nil)
+	require.NoError(t, err)
+	supervisor := dialTestHandlerAs(t, wh, "supervisor")
+	require.NoError(t, supervisor.WriteJSON(map[string]string{
+		"type":          "session_join",
+		"session_id":    supervised.ID,
+		"technician_id": "supervisor",
+	}))
+	assert.Equal(t, "session_joined", readTestMessage(t, supervisor)["type"])
+	approve(supervisor, requestID, true)
+	forwarded := readTestMessage(t, client)
+	assert.Equal(t, "rm -rf /tmp/cache", forwarded["command"])
+	assert.Equal(t, held["command_id"], forwarded["command_id"])
+	assert.Equal(t, "privilege_response_processed", readTestMessage(t, supervisor)["type"])
+	assert.False(t, session.HasActivePrivilege(PrivilegeTypeCommand))
+	request, _ = session.GetPrivilegeRequest(requestID)
+	assert.Equal(t, "supervisor", request.ApprovedBy)
+
+	// A command the client user refuses never reaches the client
+	sendCommand("sudo reboot")
+	held = readTestMessage(t, portal)
+	require.Equal(t, "command_approval_required", held["type"])
+	assert.Equal(t, "command_approval_request", readTestMessage(t, client)["type"])
+	approve(client, held["request_id"], false)
+	denied := readTestMessage(t, portal)
+	assert.Equal(t, "command_denied", denied["type"])
+	assert.Equal(t, held["command_id"], denied["command_id"])
+	assert.Equal(t, "not during business hours", denied["reason"])
+	assert.Equal(t, "privilege_response_processed", readTestMessage(t, client)["type"])
+	request, _ = session.GetPrivilegeRequest(held["request_id"].(string))
+	assert.Equal(t, clientConsentActor, request.ApprovedBy)
+
+	history := session.GetCommandHistory()
+	require.Len(t, history, 2)
+	assert.Equal(t, "hostname", history[0].Command)
+	assert.Equal(t, "rm -rf /tmp/cache", history[1].Command)
+}
+
+func TestRemoteAccessConfig_CommandRequiresApproval(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	assert.False(t, config.CommandRequiresApproval("rm -rf /"), "command execution is disabled")
+
+	config.CommandExecutionEnabled = true
+	assert.True(t, config.CommandRequiresApproval("  rm -rf /"))
+	assert.False(t, config.CommandRequiresApproval("whoami"))
+
+	config.HighRiskCommandPatterns = []string{"shutdown", "Stop-Service"}
+	assert.True(t, config.CommandRequiresApproval("shutdown /r"))
+	assert.True(t, config.CommandRequiresApproval("Stop-Service spooler"))
+	assert.False(t, config.CommandRequiresApproval("rm -rf /"), "configured patterns replace the built-in list")
+
+	// Commands hidden behind a wrapper, path or another command are still caught
+	for _, command := range []string{"env rm -rf /", "x; rm -rf /", "ls && /bin/rm -rf /", "echo $(rm -rf /)", "FOO=1 nice -n 10 rm -rf /", `cmd /c del C:\data`} {
+		config.HighRiskCommandPatterns = nil
+		assert.True(t, config.CommandRequiresApproval(command), command)
+		config.HighRiskCommandPatterns = []string{"rm", "del"}
+		assert.True(t, config.CommandRequiresApproval(command), command)
+	}
+	assert.False(t, config.CommandRequiresApproval("ls -la | grep shut"))
+
+	config.RequireCommandApproval = false
+	assert.False(t, config.CommandRequiresApproval("shutdown /r"))
+}
+
+// trafficRecorder sums the traffic reported to it
+type trafficRecorder struct {
+	mutex    sync.Mutex
+	read     int
+	written  int
+	messages map[string]int
+	errors   int
+}
+
+func (r *trafficRecorder) BytesRead(bytes int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.read += bytes
+}
+
+func (r *trafficRecorder) BytesWritten(bytes int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.written += bytes
+}
+
+func (r *trafficRecorder) MessageReceived(messageType string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.messages[messageType]++
+}
+
+func (r *trafficRecorder) ConnectionError() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.errors++
+}
+
+func TestWebSocketHandler_CountsTrafficPerConnection(t *testing.T) {
+	wh := newTestWebSocketHandler(t, DefaultRemoteAccessConfig())
+	sm := wh.GetSessionManager()
+	recorder := &trafficRecorder{messages: make(map[string]int)}
+	sm.connTracker.SetMetrics(recorder)
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	conn := dialTestHandler(t, wh)
+
+	// Three heartbeats are answered; the unknown message fails handling and gets an error back
+	sent, received := 0, 0
+	for _, message := range []string{
+		`{"type":"session_register","session_id":"` + session.ID + `","role":"client"}`,
+		`{"type":"heartbeat","timestamp":1}`,
+		`{"type":"heartbeat","timestamp":2}`,
+		`{"type":"heartbeat","timestamp":3}`,
+		`{"type":"launch_missiles"}`,
+	} {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(message)))
+		sent += len(message)
+
+		_, reply, err := conn.ReadMessage()
+		require.NoError(t, err)
+		received += len(reply)
+	}
+
+	router := mux.NewRouter()
+	NewHTTPHandlers(sm).RegisterRoutes(router)
+	var stats ConnectionStats
+	require.Eventually(t, func() bool {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/remoteaccess/connections", nil))
+		var body struct {
+			Connections []ConnectionStats `json:"connections"`
+		}
+		if json.Unmarshal(rec.Body.Bytes(), &body) != nil || len(body.Connections) != 1 {
+			return false
+		}
+		stats = body.Connections[0]
+		return stats.MessagesWritten == 5
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, int64(5), stats.MessagesRead)
+	assert.Equal(t, int64(sent), stats.BytesRead)
+	assert.Equal(t, int64(received), stats.BytesWritten)
+	assert.Equal(t, map[string]int64{"session_register": 1, "heartbeat": 3, "unknown": 1}, stats.MessageTypes)
+	assert.Equal(t, int64(1), stats.Errors)
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	assert.Equal(t, sent, recorder.read)
+	assert.Equal(t, received, recorder.written)
+	assert.Equal(t, map[string]int{"session_register": 1, "heartbeat": 3, "unknown": 1}, recorder.messages)
+	assert.Equal(t, 1, recorder.errors)
+}
+
+func TestWebSocketHandler_CapsPendingApprovalsPerApprover(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.PrivilegeEscalation.MaxRequestsPerMinute = 0
+	config.PrivilegeEscalation.MaxPendingPerApprover = 3
+	config.PrivilegeEscalation.DigestThreshold = 1
+	config.PrivilegeEscalation.DigestInterval = time.Hour
+	config.PrivilegeEscalation.UnattendedApprovers = []UnattendedApprovalRule{
+		{ClientID: "kiosk", Approver: "alice", OverflowApprovers: []string{"bob"}},
+	}
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	desk, err := sm.CreateSession("alice-desk", "alice", nil)
+	require.NoError(t, err)
+	portal := dialTestHandlerAs(t, wh, "tech")
+	require.NoError(t, portal.WriteJSON(map[string]string{
+		"type":          "session_join",
+		"session_id":    desk.ID,
+		"technician_id": "alice",
+	}))
+	assert.Equal(t, "session_joined", readTestMessage(t, portal)["type"])
+
+	kiosk, err := sm.CreateSession("kiosk", "tech", nil)
+	require.NoError(t, err)
+	var requestIDs []string
+	for i := 0; i < 7; i++ {
+		requestID, err := sm.RequestPrivilege(kiosk.ID, PrivilegeTypeServices, "restart print spooler", time.Minute)
+		require.NoError(t, err)
+		requestIDs = append(requestIDs, requestID)
+	}
+
+	// Alice's queue fills first, then bob's, and the last request waits in the backlog
+	assert.Equal(t, ApprovalQueueStats{Approvers: map[string]int{"alice": 3, "bob": 3}, Backlog: 1}, sm.GetApprovalQueueStats())
+	last, _ := kiosk.GetPrivilegeRequest(requestIDs[6])
+	assert.Empty(t, last.AssignedApprover)
+
+	// Past the threshold alice gets one digest instead of a notification per request
+	assert.Equal(t, "privilege_request_routed", readTestMessage(t, portal)["type"])
+	digest := readTestMessage(t, portal)
+	assert.Equal(t, "privilege_request_digest", digest["type"])
+	assert.Equal(t, float64(2), digest["pending"])
+
+	// Deciding one of alice's requests frees room for the backlogged one
+	require.NoError(t, sm.ApprovePrivilege(kiosk.ID, requestIDs[0], "alice"))
+	last, _ = kiosk.GetPrivilegeRequest(requestIDs[6])
+	assert.Equal(t, "alice", last.AssignedApprover)
+	assert.Equal(t, ApprovalQueueStats{Approvers: map[string]int{"alice": 3, "bob": 3}, Backlog: 0}, sm.GetApprovalQueueStats())
+
+	decisions := map[string]int{}
+	for _, event := range readAuditEvents(t, sm.auditLogger) {
+		if event.EventType == "privilege_policy_decision" {
+			decisions[event.Details["decision"].(string)]++
+		}
+	}
+	assert.Equal(t, map[string]int{"routed": 6, "backlogged": 1}, decisions)
+	assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "privilege_backlog_routed")
+
+	// The deferred requests go out in alice's next digest rather than being lost
+	sm.queues.mutex.Lock()
+	assert.Equal(t, 2, sm.queues.digests["alice"].unsent)
+	sm.queues.mutex.Unlock()
+}
+
+func TestWebSocketHandler_RejectsDisallowedOrigins(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.AllowedOrigins = []string{"https://portal.example.com"}
+	wh := newTestWebSocketHandler(t, config)
+
+	server := httptest.NewServer(http.HandlerFunc(wh.HandleWebSocket))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.test"}})
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, readAuditEventTypes(t, wh.auditLogger), "security_violation")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://portal.example.com"}})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestWebSocketHandler_RevokesExpiredPrivileges(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.CleanupInterval = 10 * time.Millisecond
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	session, err := sm.CreateSession("client", "tech", nil)
+	require.NoError(t, err)
+	conn := dialTestHandler(t, wh)
+	require.NoError(t, conn.WriteJSON(map[string]string{
+		"type":       "session_register",
+		"session_id": session.ID,
+		"role":       "client",
+	}))
+	require.Equal(t, "session_registered", readTestMessage(t, conn)["type"])
+
+	requestID, err := sm.RequestPrivilege(session.ID, PrivilegeTypeServices, "restart print spooler", 50*time.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, sm.ApprovePrivilege(session.ID, requestID, "tech"))
+	granted := time.Now()
+
+	// The sweeper revokes the privilege and tells the client without anything checking it
+	message := readTestMessage(t, conn)
+	assert.Equal(t, "privilege_revoked", message["type"])
+	assert.Equal(t, string(PrivilegeTypeServices), message["privilege_type"])
+	assert.Equal(t, "expired", message["reason"])
+	assert.Less(t, time.Since(granted), time.Second)
+
+	session.mutex.RLock()
+	assert.Empty(t, session.ActivePrivileges)
+	session.mutex.RUnlock()
+	assert.Contains(t, readAuditEventTypes(t, sm.auditLogger), "privilege_revoked")
+}
+
+func TestWebSocketHandler_LocksOutEachClientBehindTheProxy(t *testing.T) {
+	config := DefaultRemoteAccessConfig()
+	config.MaxFailedAttempts = 2
+	config.LockoutDuration = time.Minute
+	config.TrustedProxies = []string{"127.0.0.0/8"}
+	wh := newTestWebSocketHandler(t, config)
+	sm := wh.GetSessionManager()
+
+	server := httptest.NewServer(http.HandlerFunc(wh.HandleWebSocket))
+	t.Cleanup(server.Close)
+	dial := func(forwardedFor string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"X-Forwarded-For": {forwardedFor}})
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	join := func(conn *websocket.Conn) string {
+		require.NoError(t, conn.WriteJSON(map[string]string{"type": "session_join", "session_id": "no-such-session"}))
+		message := readTestMessage(t, conn)
+		require.Equal(t, "error", message["type"])
+		return message["error"].(string)
+	}
+
+	guesser := dial("203.0.113.7")
+	join(guesser)
+	join(guesser)
+	assert.Contains(t, join(guesser), "locked out")
+
+	// Other clients sharing the proxy keep their own count, and the REST API sees the same lockout
+	assert.NotContains(t, join(dial("198.51.100.7")), "locked out")
+	locked, _ := sm.IsLockedOut("203.0.113.7")
+	assert.True(t, locked)
+	locked, _ = sm.IsLockedOut("127.0.0.1")
+	assert.False(t, locked)
+}